@@ -0,0 +1,845 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"rsc.io/gaby/internal/admin"
+	"rsc.io/gaby/internal/backup"
+	"rsc.io/gaby/internal/config"
+	"rsc.io/gaby/internal/crossref"
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/embeddocs"
+	"rsc.io/gaby/internal/eval"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/githubdocs"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/llmusage"
+	"rsc.io/gaby/internal/logstore"
+	"rsc.io/gaby/internal/pebble"
+	"rsc.io/gaby/internal/runlog"
+	"rsc.io/gaby/internal/sched"
+	"rsc.io/gaby/internal/search"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/ordered"
+)
+
+// A command is a gaby subcommand.
+type command struct {
+	name string // command name, possibly two words ("config check")
+	args string // argument summary, for usage
+	help string // one-line description, for usage
+	run  func(ctx context.Context, args []string) error
+}
+
+// subcommands lists the subcommands.
+// It is initialized in init to avoid an initialization cycle with usage.
+var subcommands []*command
+
+func init() {
+	subcommands = []*command{
+		{"serve", "[-admin addr]", "run the sync and subsystem tasks, each on its own schedule (the default)", cmdServe},
+		{"sync", "[project...]", "sync GitHub projects (default all) and update the document index", cmdSync},
+		{"search", "[query]", "search the document index (interactively if no query is given)", cmdSearch},
+		{"backfill related", "project min max", "evaluate the related poster on issues min through max", cmdBackfillRelated},
+		{"commentfix undo", "-since=time project...", "revert the comment fixer's edits in the projects made since time (RFC3339 or a duration ago)", cmdCommentFixUndo},
+		{"audit", "project [duration]", "print the GitHub edits made in project in the last duration (default 168h)", cmdAudit},
+		{"dump", "[name]", "print database entries (only those with keys beginning with name, if given)", cmdDump},
+		{"schema", "", "print the database key schemas, and the unregistered key kinds in the database", cmdSchema},
+		{"backup list", "[-dest url]", "list the database backups", cmdBackupList},
+		{"backup restore", "[-dest url] name dir", "unpack the named backup into the new database directory dir", cmdBackupRestore},
+		{"backup", "[-dest url]", "back up the database now", cmdBackup},
+		{"config check", "[file]", "check the -config file (or the named file) and print it", cmdConfigCheck},
+		{"eval", "file", "evaluate the embedding model on the labeled issues in the txtar file", cmdEval},
+		{"reembed", "[-model name] namespace", "embed all documents into a new vector namespace (resuming an interrupted reembed)", cmdReembed},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gaby [flags] [command] [args]\n\nCommands:\n\n")
+	for _, c := range subcommands {
+		fmt.Fprintf(os.Stderr, "\tgaby %s %s\n\t\t%s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// errUsage is returned by a command to print the usage message.
+var errUsage = errors.New("usage")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	c, args := lookup(args)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "gaby: unknown command %q\n", strings.Join(flag.Args(), " "))
+		usage()
+	}
+
+	// Stop cleanly on SIGINT or SIGTERM: the commands finish
+	// their current unit of work and close the database.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Export traces if an OpenTelemetry collector is configured
+	// in the environment; see [tracing.Init].
+	shutdown, err := tracing.Init(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.run(ctx, args)
+	shutdown(context.Background())
+	if err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: gaby %s %s\n", c.name, c.args)
+			os.Exit(2)
+		}
+		log.Fatal(err)
+	}
+}
+
+// lookup returns the command named by the leading words in args,
+// along with the remaining arguments.
+// If there is no such command, lookup returns nil, nil.
+func lookup(args []string) (*command, []string) {
+	for _, c := range subcommands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return c, args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// newLogger returns the logger used by all commands.
+// Messages logged with a context include its trace ID, if any.
+func newLogger() *slog.Logger {
+	return slog.New(tracing.NewHandler(newHandler()))
+}
+
+// newHandler returns the handler that writes log messages to standard output.
+func newHandler() slog.Handler {
+	return slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+}
+
+// keptMessages are the informational log messages stored in the
+// database along with warnings and errors (see [logstore.Store.Keep]):
+// the ones recording changes made to GitHub.
+var keptMessages = []string{
+	"approval.Queue perform",
+	"commentfix editing github",
+	"milestone.Suggester post",
+	"needinfo.Checker post",
+	"owners.Router post",
+	"related.Poster duplicate",
+	"related.Poster post",
+	"summary.Summarizer post",
+	"waitinfo.Pinger close",
+	"waitinfo.Pinger ping",
+}
+
+// loadConfig returns the configuration from the -config file,
+// or [config.Default] if there is no -config flag.
+func loadConfig() (*config.Config, error) {
+	if *configFile == "" {
+		return config.Default(), nil
+	}
+	return config.Load(*configFile)
+}
+
+// A gaby holds the state shared by the commands that
+// need the database, GitHub, and the LLM.
+type gaby struct {
+	slog   *slog.Logger
+	cfg    *config.Config
+	secret *secret.Refreshing
+	db     storage.DB
+	logs   *logstore.Store
+	runs   *runlog.Recorder
+	vdb    storage.VectorDB
+	github *github.Client
+	docs   *docs.Corpus
+	ai     llmClient
+	meter  *llmusage.Meter
+
+	// embeds embeds new documents into the index,
+	// reusing embeddings of unchanged documents.
+	embeds *embeddocs.Syncer
+
+	// searchEmbedder embeds search queries,
+	// which are accounted like any other LLM use.
+	searchEmbedder llm.Embedder
+}
+
+// open performs the initialization shared by the commands,
+// opening the database and connecting to GitHub and the LLM.
+func open() (*gaby, error) {
+	g := &gaby{slog: newLogger()}
+	var err error
+	if g.cfg, err = loadConfig(); err != nil {
+		return nil, err
+	}
+	if observeOnly() {
+		g.cfg.ObserveOnly = true
+	}
+	if g.cfg.ObserveOnly {
+		g.slog.Info("gaby observe-only mode: not writing to GitHub")
+	}
+
+	// The database, LLM, and secret backends are chosen
+	// by the configuration and flags (see [backends]).
+	if g.db, err = openDB(g.slog, g.cfg); err != nil {
+		return nil, err
+	}
+
+	// Keep warnings, errors, and records of GitHub changes in the database,
+	// for the admin interface, in case no one is collecting standard output.
+	g.logs = logstore.New(g.db)
+	g.logs.Keep(keptMessages...)
+
+	// Count the errors and embeddings in each main loop cycle
+	// for its summary (see cmdServe).
+	g.runs = runlog.New(g.db, "runlog")
+	g.slog = slog.New(tracing.NewHandler(g.runs.Handler(g.logs.Handler(newHandler()))))
+
+	// Reload secrets periodically, so that rotated tokens
+	// take effect without restarting.
+	if g.secret, err = secret.Refresh(g.slog, 10*time.Minute, func() (secret.DB, error) {
+		return secrets(g.cfg)
+	}); err != nil {
+		return nil, err
+	}
+	vdb, err := openVectorDB(g.slog, g.db, g.cfg)
+	if err != nil {
+		return nil, err
+	}
+	g.vdb = tracing.VectorDB(vdb)
+	g.github = github.New(g.slog, g.db, g.secret, http.DefaultClient)
+	g.docs = docs.New(g.db)
+	if backends(g.cfg).Compress {
+		g.github.EnableCompression()
+		g.docs.EnableCompression()
+	}
+	if g.ai, err = newLLM(g.slog, g.secret, g.cfg); err != nil {
+		return nil, err
+	}
+
+	// Account for LLM usage by each subsystem, and stop any subsystem
+	// that exceeds its daily budget until the next day.
+	g.meter = llmusage.New(g.slog, g.db)
+	for model, price := range textPrices {
+		g.meter.SetPrice(model, price)
+	}
+	for name, budget := range g.cfg.Budgets {
+		g.meter.SetDailyBudget(name, budget)
+	}
+
+	model := g.ai.EmbeddingModel()
+	for _, ns := range []string{backends(g.cfg).VectorNamespace, "flakes"} {
+		if err := checkVectorModel(g.db, ns, model); err != nil {
+			return nil, err
+		}
+	}
+	embedder := storage.CachedEmbedder(g.db, g.runs.Embedder(g.meter.Embedder("embeddocs", model, g.ai)), model)
+	g.embeds = g.newEmbeds(g.vdb, embedder, backends(g.cfg).VectorNamespace)
+	g.searchEmbedder = g.meter.Embedder("search", model, g.ai)
+	return g, nil
+}
+
+// newEmbeds returns a Syncer that embeds documents
+// into the vector database namespace ns.
+func (g *gaby) newEmbeds(vdb storage.VectorDB, embedder llm.Embedder, ns string) *embeddocs.Syncer {
+	s := embeddocs.New(g.slog, g.db, vdb, embedder, g.docs)
+	s.SetName(embedName(ns))
+	if b := g.cfg.Backends; b != nil && b.EmbedWorkers > 0 {
+		s.SetConcurrency(b.EmbedWorkers)
+	}
+	return s
+}
+
+// close flushes and closes the database.
+func (g *gaby) close() {
+	g.logs.Close()
+	g.db.Flush()
+	g.db.Close()
+}
+
+// syncDocs updates the document corpus and vector index
+// from the GitHub data already in the database.
+func (g *gaby) syncDocs(ctx context.Context) {
+	githubdocs.Sync(ctx, g.slog, g.docs, g.github)
+	g.embeds.Sync(ctx)
+}
+
+// pollInterval is the longest time gaby serve waits
+// before checking for admin tasks and configuration changes.
+const pollInterval = 30 * time.Second
+
+// syncTasks returns the tasks that sync GitHub data and
+// the document index, in the order of [config.SyncTasks].
+func (g *gaby) syncTasks(cfg *config.Config, xr *crossref.Index) []*sched.Task {
+	return []*sched.Task{
+		newTask(cfg, "github", g.github.Sync),
+		newTask(cfg, "githubdocs", func(ctx context.Context) error {
+			githubdocs.Sync(ctx, g.slog, g.docs, g.github)
+			return nil
+		}),
+		newTask(cfg, "embeddocs", func(ctx context.Context) error {
+			g.embeds.Sync(ctx)
+			return nil
+		}),
+		newTask(cfg, "crossref", func(ctx context.Context) error {
+			xr.SyncGitHub(ctx, g.github)
+			return nil
+		}),
+	}
+}
+
+// cmdServe implements "gaby serve".
+func cmdServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	adminAddr := fs.String("admin", "", "serve the admin web interface on `addr` (such as localhost:8080)")
+	instance := fs.String("instance", "", "identify this replica as `name` in task leases (default host-pid-random)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+
+	// With -admin, maintainers can inspect Gaby and change its configuration
+	// (for example, toggling a subsystem's dry-run mode) from a web browser.
+	// The subsystems are recreated at the start of the next cycle
+	// after a configuration change.
+	// The admin server also tracks configuration changes made
+	// through the interfaces of other instances sharing the database,
+	// so it is needed even without -admin.
+	adm := admin.New(g.slog, g.db, g.secret, g.cfg)
+	adm.SetEmbedName(embedName(backends(g.cfg).VectorNamespace))
+	if *adminAddr != "" {
+		ss := search.NewServer(g.slog, g.vdb, g.docs, g.searchEmbedder)
+		adm.Handle("GET /search", ss, "/search")
+		adm.Handle("GET /api/search", ss, "")
+		srv := &http.Server{Addr: *adminAddr, Handler: adm}
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		// Stop serving before the database is closed.
+		defer srv.Shutdown(context.Background())
+	}
+
+	// Each task runs on its own schedule (see [config.Config.Schedules]).
+	// Between tasks, the loop wakes at least every pollInterval
+	// to run queued admin tasks and apply configuration changes.
+	// Replicas sharing the database coordinate through task leases,
+	// so each task runs in only one replica at a time.
+	var sys *system
+	version := -1
+	xr := crossref.New(g.slog, g.db)
+	sch := sched.New(g.slog, g.db)
+	if *instance != "" {
+		sch.SetInstance(*instance)
+	}
+	defer sch.Resign()
+	g.slog.Info("gaby serving", "instance", sch.Instance())
+
+	// At the end of each cycle, record and log a summary of the work done
+	// (see [runlog.Recorder.Record]), for the admin interface and health checks.
+	g.runs.SetInstance(sch.Instance())
+	g.runs.Watch(g.github, g.docs)
+	var lastUsage time.Time
+	for ctx.Err() == nil {
+		g.secret.Check()
+		c, v := adm.Config()
+		if v != version {
+			sys, err = setup(g.slog, c, g.db, g.github, g.vdb, g.docs, g.ai, g.meter)
+			if err != nil {
+				return err
+			}
+			tasks := append(g.syncTasks(c, xr), sys.tasks...)
+			if c.Backup != nil {
+				b, err := newBacker(ctx, g.slog, g.db, g.secret, c.Backup)
+				if err != nil {
+					return err
+				}
+				tasks = append(tasks, newTask(c, c.Backup.Name, b.Run))
+			}
+			sch.SetTasks(tasks)
+			version = v
+		}
+		for _, t := range adm.Tasks() {
+			adm.Finish(t, runTask(ctx, g.github, sys, t))
+		}
+		next := sch.RunDue(ctx)
+		g.slog.Info("gaby cycle", "summary", g.runs.Record())
+		if time.Since(lastUsage) >= time.Hour {
+			for _, u := range g.meter.Today() {
+				g.slog.Info("llm usage", "usage", u)
+			}
+			lastUsage = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(min(time.Until(next), pollInterval)):
+		}
+	}
+	g.slog.Info("gaby shutting down", "cause", context.Cause(ctx))
+	return nil
+}
+
+// cmdSync implements "gaby sync".
+func cmdSync(ctx context.Context, args []string) error {
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+	if len(args) == 0 {
+		if err := g.github.Sync(ctx); err != nil {
+			return err
+		}
+	}
+	for _, project := range args {
+		if err := g.github.SyncProject(ctx, project); err != nil {
+			return err
+		}
+	}
+	g.syncDocs(ctx)
+	return nil
+}
+
+// cmdSearch implements "gaby search".
+func cmdSearch(ctx context.Context, args []string) error {
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+	query := func(q string) error {
+		results, err := search.Query(ctx, g.vdb, g.docs, g.searchEmbedder, q, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			fmt.Printf(" %.5f %s # %s\n", r.Score, r.ID, cmp.Or(r.Title, "?"))
+		}
+		return nil
+	}
+	if len(args) > 0 {
+		return query(strings.Join(args, " "))
+	}
+
+	// Search loop.
+	s := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "> ")
+		if !s.Scan() {
+			return s.Err()
+		}
+		if err := query(s.Text()); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+}
+
+// cmdBackfillRelated implements "gaby backfill related".
+func cmdBackfillRelated(_ context.Context, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	project := args[0]
+	min, err1 := strconv.ParseInt(args[1], 10, 64)
+	max, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil || min <= 0 || max < min {
+		return fmt.Errorf("invalid issue range %s %s", args[1], args[2])
+	}
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+	sys, err := setup(g.slog, g.cfg, g.db, g.github, g.vdb, g.docs, g.ai, g.meter)
+	if err != nil {
+		return err
+	}
+	if sys.related == nil {
+		return errors.New("related poster not enabled in configuration")
+	}
+	n := sys.related.Backfill(project, min, max)
+	fmt.Printf("evaluated %d issues\n", n)
+	return nil
+}
+
+// cmdCommentFixUndo implements "gaby commentfix undo".
+// Like the comment fixer itself, it only prints what it would do
+// if the configuration puts the fixer in dry-run mode.
+func cmdCommentFixUndo(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("commentfix undo", flag.ExitOnError)
+	sinceFlag := fs.String("since", "", "revert edits made at or after `time`, an RFC3339 time or a duration (such as 24h) before now")
+	fs.Parse(args)
+	if *sinceFlag == "" || fs.NArg() == 0 {
+		return errUsage
+	}
+	since, err := time.Parse(time.RFC3339, *sinceFlag)
+	if err != nil {
+		d, err := time.ParseDuration(*sinceFlag)
+		if err != nil {
+			return fmt.Errorf("invalid -since %q: want RFC3339 time or duration", *sinceFlag)
+		}
+		since = time.Now().Add(-d)
+	}
+
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+	sys, err := setup(g.slog, g.cfg, g.db, g.github, g.vdb, g.docs, g.ai, g.meter)
+	if err != nil {
+		return err
+	}
+	if sys.fixer == nil {
+		return errors.New("comment fixer not enabled in configuration")
+	}
+	verb := "reverted"
+	if !g.cfg.Writes(g.cfg.CommentFix.Name) {
+		verb = "would revert (dry run)"
+	}
+	for _, project := range fs.Args() {
+		n := sys.fixer.Undo(project, since)
+		fmt.Printf("%s: %s %d edits\n", project, verb, n)
+	}
+	return nil
+}
+
+// cmdDump implements "gaby dump".
+// It opens only the database, so that it works without
+// GitHub or LLM credentials.
+func cmdDump(_ context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	db, err := pebble.Open(newLogger(), *dbDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	start, end := ordered.Encode(), ordered.Encode(ordered.Inf)
+	if len(args) == 1 {
+		start = ordered.Encode(args[0])
+		end = ordered.Encode(args[0], ordered.Inf)
+	}
+	for key, val := range db.Scan(start, end) {
+		fmt.Printf("%s %s\n", storage.Fmt(key), storage.Fmt(val()))
+	}
+	return nil
+}
+
+// cmdSchema implements "gaby schema".
+// It prints the key schemas registered with [storage.RegisterSchema]
+// and then, if the database exists, the kinds of keys in the database
+// that have no registered schema.
+func cmdSchema(_ context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	for _, s := range storage.Schemas() {
+		fmt.Printf("%v\n", s)
+	}
+	if _, err := os.Stat(*dbDir); err != nil {
+		return nil
+	}
+	db, err := pebble.Open(newLogger(), *dbDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, kind := range storage.Kinds(db) {
+		if _, ok := storage.LookupSchema(kind); !ok {
+			fmt.Printf("[%q, ...] (unregistered)\n", kind)
+		}
+	}
+	return nil
+}
+
+// cmdAudit implements "gaby audit".
+// Like cmdDump, it opens only the database.
+func cmdAudit(_ context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	project := args[0]
+	window := 7 * 24 * time.Hour
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		window = d
+	}
+	lg := newLogger()
+	db, err := pebble.Open(lg, *dbDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	gh := github.New(lg, db, nil, nil)
+	for r := range gh.Audit(project, time.Now().Add(-window)) {
+		outcome := cmp.Or(r.Result, "ok")
+		if r.Error != "" {
+			outcome = "error: " + r.Error
+		}
+		if r.Diverted {
+			outcome += " (diverted)"
+		}
+		fmt.Printf("%s %s %s %s %s\n\t%s\n", r.Time.UTC().Format(time.RFC3339), cmp.Or(r.Actor, "-"), r.Action, r.URL, outcome, r.Changes)
+	}
+	return nil
+}
+
+// newBacker returns a [backup.Backer] for db configured by c,
+// reading any credentials for c.Dest from sdb.
+func newBacker(ctx context.Context, lg *slog.Logger, db storage.DB, sdb secret.DB, c *config.Backup) (*backup.Backer, error) {
+	dest, err := backup.Open(ctx, c.Dest, sdb, http.DefaultClient)
+	if err != nil {
+		return nil, err
+	}
+	b := backup.New(lg, db, dest, c.Name)
+	if c.Recent != 0 || c.Daily != 0 {
+		b.SetRetention(backup.Retention{Recent: c.Recent, Daily: c.Daily})
+	}
+	return b, nil
+}
+
+// backupConfig parses the flags for the "gaby backup" commands,
+// returning the configuration, the backup configuration
+// (with any -dest flag replacing the configured destination),
+// and the remaining arguments.
+func backupConfig(name string, args []string) (*config.Config, *config.Backup, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dest := fs.String("dest", "", "use the backup destination `url` instead of the configured one")
+	fs.Parse(args)
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c := &config.Backup{Name: "backup"}
+	if cfg.Backup != nil {
+		*c = *cfg.Backup
+	}
+	if *dest != "" {
+		c.Dest = *dest
+	}
+	if c.Dest == "" {
+		return nil, nil, nil, errors.New("no backup destination: use -dest or configure Backup")
+	}
+	return cfg, c, fs.Args(), nil
+}
+
+// backupDest returns the destination for the "gaby backup" commands.
+func backupDest(ctx context.Context, cfg *config.Config, c *config.Backup) (backup.Destination, error) {
+	sdb, err := secrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return backup.Open(ctx, c.Dest, sdb, http.DefaultClient)
+}
+
+// cmdBackup implements "gaby backup".
+// Like cmdDump, it opens only the database
+// (and the secrets, for the backup destination).
+func cmdBackup(ctx context.Context, args []string) error {
+	cfg, c, args, err := backupConfig("backup", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errUsage
+	}
+	lg := newLogger()
+	sdb, err := secrets(cfg)
+	if err != nil {
+		return err
+	}
+	db, err := pebble.Open(lg, *dbDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	b, err := newBacker(ctx, lg, db, sdb, c)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx)
+}
+
+// cmdBackupList implements "gaby backup list".
+func cmdBackupList(ctx context.Context, args []string) error {
+	cfg, c, args, err := backupConfig("backup list", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errUsage
+	}
+	dest, err := backupDest(ctx, cfg, c)
+	if err != nil {
+		return err
+	}
+	list, err := backup.List(ctx, dest)
+	if err != nil {
+		return err
+	}
+	for _, name := range list {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// cmdBackupRestore implements "gaby backup restore".
+// It does not open the database at all:
+// the restored database is a new directory,
+// which the next gaby command can use with -db.
+func cmdBackupRestore(ctx context.Context, args []string) error {
+	cfg, c, args, err := backupConfig("backup restore", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return errUsage
+	}
+	dest, err := backupDest(ctx, cfg, c)
+	if err != nil {
+		return err
+	}
+	return backup.Restore(ctx, dest, args[0], args[1])
+}
+
+// cmdConfigCheck implements "gaby config check".
+func cmdConfigCheck(_ context.Context, args []string) error {
+	var cfg *config.Config
+	var err error
+	switch len(args) {
+	default:
+		return errUsage
+	case 0:
+		cfg, err = loadConfig()
+	case 1:
+		cfg, err = config.Load(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		// unreachable
+		return err
+	}
+	fmt.Printf("%s\n", js)
+	return nil
+}
+
+// cmdEval implements "gaby eval".
+func cmdEval(_ context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	set, err := eval.Load(args[0])
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	lg := newLogger()
+	sdb, err := secrets(cfg)
+	if err != nil {
+		return err
+	}
+	ai, err := newLLM(lg, sdb, cfg)
+	if err != nil {
+		return err
+	}
+	r, err := eval.Evaluate(ai, set)
+	if err != nil {
+		return err
+	}
+	fmt.Println(r)
+	return nil
+}
+
+// cmdReembed implements "gaby reembed".
+func cmdReembed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reembed", flag.ExitOnError)
+	model := fs.String("model", "", "embed using the model `name` instead of the configured embedding model")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	ns := fs.Arg(0)
+
+	g, err := open()
+	if err != nil {
+		return err
+	}
+	defer g.close()
+	if ns == backends(g.cfg).VectorNamespace {
+		return fmt.Errorf("vector namespace %q is in use; reembed into a new namespace", ns)
+	}
+	ai := g.ai
+	if *model != "" {
+		cfg := *g.cfg
+		b := backends(g.cfg)
+		b.EmbedModel = *model
+		cfg.Backends = &b
+		if ai, err = newLLM(g.slog, g.secret, &cfg); err != nil {
+			return err
+		}
+	}
+	m := ai.EmbeddingModel()
+	if err := checkVectorModel(g.db, ns, m); err != nil {
+		return err
+	}
+	vdb := tracing.VectorDB(storage.MemVectorDB(g.db, g.slog, ns))
+	embedder := storage.CachedEmbedder(g.db, g.meter.Embedder("reembed", m, ai), m)
+	if err := g.newEmbeds(vdb, embedder, ns).Reembed(ctx); err != nil {
+		return err
+	}
+	p, _ := embeddocs.ReembedProgress(g.db, embedName(ns))
+	fmt.Printf("embedded %d documents into vector namespace %q using %s\n", p.Docs, ns, m)
+	fmt.Printf("to use them, set Backends.VectorNamespace to %q and Backends.EmbedModel to match\n", ns)
+	return nil
+}
@@ -0,0 +1,851 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package admin implements Gaby's administrative web interface,
+// which lets maintainers inspect and control a running Gaby.
+//
+// The interface lists the enabled subsystems with their projects and rules,
+// shows when each periodic task last ran and will next run,
+// summarizes the work done in recent cycles of the main loop
+// (see [rsc.io/gaby/internal/runlog]),
+// shows pending and recent GitHub actions (with diffs of comment fixer edits,
+// highlighting the changed words),
+// lets maintainers approve or reject actions awaiting approval
+// (see [rsc.io/gaby/internal/approval]),
+// shows recent warnings and errors logged to the database
+// (see [rsc.io/gaby/internal/logstore]) and lets maintainers search those logs,
+// lists documents that could not be embedded
+// (see [rsc.io/gaby/internal/embeddocs.DeadLetters])
+// and vectors rejected for having the wrong dimension
+// (see [storage.VectorMismatches]),
+// toggles dry-run mode for each subsystem that writes to GitHub
+// (unless Gaby is in observe-only mode; see [config.Config.ObserveOnly]),
+// and queues one-off GitHub project syncs and related-issue backfills.
+//
+// A [Server] does not run anything itself.
+// Instead, the main loop asks it for the current configuration
+// (see [Server.Config]) and for queued tasks (see [Server.Tasks]),
+// so that all work happens in the main loop, one step at a time.
+//
+// Every request must be authenticated with HTTP basic authentication,
+// using the user name and password stored as "user:password" in
+// the secret named "gaby-admin". If there is no such secret,
+// the interface refuses all requests.
+// The one exception is the health check, GET /healthz,
+// which reports only whether a cycle finished recently without errors
+// and no task is stuck, for use by monitoring systems.
+package admin
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/commentfix"
+	"rsc.io/gaby/internal/config"
+	"rsc.io/gaby/internal/diff"
+	"rsc.io/gaby/internal/embeddocs"
+	"rsc.io/gaby/internal/logstore"
+	"rsc.io/gaby/internal/runlog"
+	"rsc.io/gaby/internal/sched"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/themes"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["admin.DryRun", Name] => JSON bool
+//
+// Name is the name of a subsystem in the [config.Config],
+// and the value records a dry-run setting made in the interface,
+// which overrides the configuration, even across restarts.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "admin.DryRun", Key: "Name", Val: "JSON bool"},
+	)
+}
+
+// secretName is the name of the secret holding the admin "user:password".
+const secretName = "gaby-admin"
+
+const (
+	recentWindow = 7 * 24 * time.Hour // how far back to show recent actions and edits
+	maxRecent    = 100                // maximum number of recent actions, edits, tasks, and log records to show
+	maxProblems  = 20                 // maximum number of warnings and errors to show on the home page
+	maxCycles    = 10                 // maximum number of main loop cycles to show on the home page
+	healthWindow = 10 * time.Minute   // how recently a cycle must have finished for /healthz
+)
+
+// A Server serves the admin interface.
+// It is safe for concurrent use by multiple goroutines.
+type Server struct {
+	slog      *slog.Logger
+	db        storage.DB
+	secret    secret.DB
+	approvals *approval.Queue // for recording decisions only
+	mux       *http.ServeMux
+	now       func() time.Time // for testing
+	embedName string           // name of embeddocs Syncer, for dead letters
+
+	mu      sync.Mutex
+	pages   []string // paths of pages added by Handle, for linking
+	cfg     *config.Config
+	dryRuns map[string]bool // dry-run settings loaded from db
+	version int
+	queue   []*Task
+	done    []*Task // finished tasks, oldest first
+}
+
+// A Task is a one-off job requested through the interface,
+// to be run by the main loop.
+type Task struct {
+	Kind     string // "sync" or "backfill"
+	Project  string // GitHub project ("golang/go")
+	Min, Max int64  // issue range for "backfill"
+	Queued   time.Time
+	Finished time.Time
+	Result   string // result reported to [Server.Finish]
+}
+
+// String returns a short description of the task.
+func (t *Task) String() string {
+	if t.Kind == "backfill" {
+		return fmt.Sprintf("backfill %s #%d-#%d", t.Project, t.Min, t.Max)
+	}
+	return fmt.Sprintf("%s %s", t.Kind, t.Project)
+}
+
+// New returns a new Server for the given configuration.
+// The Server keeps a copy of cfg, with any dry-run settings
+// previously made in the interface applied.
+// Secrets are read from sdb.
+func New(lg *slog.Logger, db storage.DB, sdb secret.DB, cfg *config.Config) *Server {
+	s := &Server{
+		slog:      lg,
+		db:        db,
+		secret:    sdb,
+		approvals: approval.New(lg, db, nil, "admin"),
+		now:       time.Now,
+		embedName: "embeddocs",
+		cfg:       cfg.Clone(),
+		dryRuns:   make(map[string]bool),
+	}
+	s.loadDryRuns()
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /{$}", s.home)
+	s.mux.HandleFunc("GET /logs", s.logs)
+	s.mux.HandleFunc("POST /dryrun", s.dryRun)
+	s.mux.HandleFunc("POST /sync", s.sync)
+	s.mux.HandleFunc("POST /backfill", s.backfill)
+	s.mux.HandleFunc("POST /approval", s.approval)
+	return s
+}
+
+// SetEmbedName sets the name of the embeddocs Syncer
+// whose dead letters the home page lists
+// (see [embeddocs.Syncer.SetName]). The default is “embeddocs”.
+func (s *Server) SetEmbedName(name string) {
+	s.embedName = name
+}
+
+// Handle registers the handler for the given pattern,
+// as in [http.ServeMux.Handle], so that it is served
+// with the same authentication as the rest of the interface.
+// If link is non-empty, the home page links to it.
+// Handle must be called before the Server starts serving requests.
+func (s *Server) Handle(pattern string, h http.Handler, link string) {
+	s.mux.Handle(pattern, h)
+	if link != "" {
+		s.mu.Lock()
+		s.pages = append(s.pages, link)
+		s.mu.Unlock()
+	}
+}
+
+// Config returns a copy of the current configuration
+// along with its version, which increases each time
+// the configuration is changed through the interface,
+// including through the interface of another Gaby instance
+// sharing the database.
+// The main loop should recreate its subsystems
+// when the version changes.
+func (s *Server) Config() (cfg *config.Config, version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loadDryRuns() {
+		s.version++
+	}
+	return s.cfg.Clone(), s.version
+}
+
+// loadDryRuns applies the dry-run settings stored in the database
+// to s.cfg, reporting whether any differ from those applied before.
+// s.mu must be held or s not yet shared.
+func (s *Server) loadDryRuns() bool {
+	changed := false
+	for _, name := range s.cfg.Writers() {
+		val, ok := s.db.Get(ordered.Encode("admin.DryRun", name))
+		if !ok {
+			continue
+		}
+		var dryRun bool
+		if err := json.Unmarshal(val, &dryRun); err != nil {
+			// unreachable unless corrupt storage
+			s.db.Panic("admin dry run decode", "name", name, "err", err)
+		}
+		if old, ok := s.dryRuns[name]; !ok || old != dryRun {
+			s.cfg.SetDryRun(name, dryRun)
+			s.dryRuns[name] = dryRun
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Tasks removes and returns the tasks queued through the interface.
+// The caller should run each task and then call [Server.Finish].
+func (s *Server) Tasks() []*Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue
+	s.queue = nil
+	return q
+}
+
+// Finish records that the task t has finished with the given result,
+// for display in the interface.
+func (s *Server) Finish(t *Task, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Finished = s.now()
+	t.Result = result
+	s.done = append(s.done, t)
+	if len(s.done) > maxRecent {
+		s.done = slices.Delete(s.done, 0, len(s.done)-maxRecent)
+	}
+	s.slog.Info("admin task finished", "task", t.String(), "result", result)
+}
+
+// ServeHTTP serves the admin interface.
+// A request that fails because of a database error
+// gets a 500 response instead of crashing the program (see [storage.Try]).
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := storage.Try(func() { s.serve(w, r) })
+	if err != nil {
+		s.slog.Error("admin database error", "method", r.Method, "path", r.URL.Path, "err", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+	}
+}
+
+// serve serves the admin interface for ServeHTTP.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// Health checks come from monitoring systems without credentials.
+	if r.Method == "GET" && r.URL.Path == "/healthz" {
+		s.healthz(w, r)
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	if r.Method == "POST" && !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized reports whether r carries the admin credentials.
+// If not, it writes an error response to w.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	want, ok := s.secret.Get(secretName)
+	if !ok {
+		http.Error(w, "admin interface disabled: no "+secretName+" secret", http.StatusForbidden)
+		return false
+	}
+	user, pass, _ := r.BasicAuth()
+	if subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gaby"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// sameOrigin reports whether the request r
+// appears to come from a page served by this server,
+// to keep other sites from submitting forms using
+// the browser's saved credentials.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// dryRun handles a request to change a subsystem's dry-run mode.
+func (s *Server) dryRun(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	dryRun := r.FormValue("dryrun") == "on"
+
+	s.mu.Lock()
+	ok := s.cfg.SetDryRun(name, dryRun)
+	if ok {
+		s.dryRuns[name] = dryRun
+		s.version++
+		s.db.Set(ordered.Encode("admin.DryRun", name), storage.JSON(dryRun))
+		s.db.Flush()
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown subsystem %q", name), http.StatusBadRequest)
+		return
+	}
+	s.slog.Info("admin set dry run", "name", name, "dryrun", dryRun)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sync handles a request to sync a GitHub project.
+func (s *Server) sync(w http.ResponseWriter, r *http.Request) {
+	project := r.FormValue("project")
+	if !strings.Contains(project, "/") {
+		http.Error(w, fmt.Sprintf("invalid project %q", project), http.StatusBadRequest)
+		return
+	}
+	s.enqueue(&Task{Kind: "sync", Project: project})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// backfill handles a request to backfill related-issue posts.
+func (s *Server) backfill(w http.ResponseWriter, r *http.Request) {
+	project := r.FormValue("project")
+	if !strings.Contains(project, "/") {
+		http.Error(w, fmt.Sprintf("invalid project %q", project), http.StatusBadRequest)
+		return
+	}
+	min, err1 := strconv.ParseInt(r.FormValue("min"), 10, 64)
+	max, err2 := strconv.ParseInt(r.FormValue("max"), 10, 64)
+	if err1 != nil || err2 != nil || min <= 0 || max < min {
+		http.Error(w, "invalid issue range", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	related := s.cfg.Related != nil
+	s.mu.Unlock()
+	if !related {
+		http.Error(w, "related poster not enabled", http.StatusBadRequest)
+		return
+	}
+	s.enqueue(&Task{Kind: "backfill", Project: project, Min: min, Max: max})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// approval handles a request to approve or reject a proposed action.
+func (s *Server) approval(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid proposal ID", http.StatusBadRequest)
+		return
+	}
+	approve := r.FormValue("decision") == "approve"
+	user, _, _ := r.BasicAuth()
+	if err := s.approvals.Decide(id, approve, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.slog.Info("admin approval", "id", id, "approve", approve, "user", user)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// enqueue adds t to the task queue.
+func (s *Server) enqueue(t *Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Queued = s.now()
+	s.queue = append(s.queue, t)
+	s.slog.Info("admin task queued", "task", t.String())
+}
+
+// A subsystem is a subsystem listed on the home page.
+type subsystem struct {
+	Name     string
+	Kind     string // config section name
+	Writes   bool   // subsystem can write to GitHub
+	DryRun   bool
+	Projects []string
+	Config   string // indented JSON of config section
+}
+
+// An action is an action listed on the home page.
+type action struct {
+	Key     string
+	Start   time.Time
+	Outcome string
+}
+
+// home serves the home page.
+func (s *Server) home(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cfg := s.cfg.Clone()
+	queue := slices.Clone(s.queue)
+	done := slices.Clone(s.done)
+	pages := slices.Clone(s.pages)
+	s.mu.Unlock()
+	slices.Reverse(done)
+
+	since := s.now().Add(-recentWindow)
+	var pending, recent []*action
+	for key, a := range storage.Actions(s.db, nil) {
+		act := &action{Key: storage.Fmt(key), Start: a.Start, Outcome: string(a.Outcome)}
+		if !a.Done {
+			pending = append(pending, act)
+		} else if a.Start.After(since) {
+			recent = append(recent, act)
+		}
+	}
+	byStart := func(x, y *action) int { return y.Start.Compare(x.Start) }
+	slices.SortFunc(pending, byStart)
+	slices.SortFunc(recent, byStart)
+	recent = recent[:min(len(recent), maxRecent)]
+
+	var edits []*commentfix.Edit
+	if c := cfg.CommentFix; c != nil {
+		for _, p := range c.Projects {
+			for e := range commentfix.Edits(s.db, c.Name, p.Project, since) {
+				edits = append(edits, e)
+			}
+		}
+	}
+	slices.SortFunc(edits, func(x, y *commentfix.Edit) int { return y.Time.Compare(x.Time) })
+	edits = edits[:min(len(edits), maxRecent)]
+
+	var proposals, decided []*approval.Proposal
+	for p := range approval.Proposals(s.db) {
+		if p.Status == approval.Pending {
+			proposals = append(proposals, p)
+		} else if p.Created.After(since) {
+			decided = append(decided, p)
+		}
+	}
+	slices.Reverse(decided)
+	decided = decided[:min(len(decided), maxRecent)]
+
+	var cycles []*runlog.Summary
+	for c := range runlog.Summaries(s.db, since) {
+		cycles = append(cycles, c)
+	}
+	slices.Reverse(cycles)
+	cycles = cycles[:min(len(cycles), maxCycles)]
+
+	var dead []*embeddocs.Failure
+	for f := range embeddocs.DeadLetters(s.db, s.embedName) {
+		if len(dead) >= maxRecent {
+			break
+		}
+		dead = append(dead, f)
+	}
+
+	var reports []*themes.Report
+	for r := range themes.Reports(s.db) {
+		reports = append(reports, r)
+	}
+
+	var mismatches []*storage.VectorMismatch
+	for m := range storage.VectorMismatches(s.db) {
+		mismatches = append(mismatches, m)
+	}
+
+	var projects []string
+	var backfill bool
+	subs := s.subsystems(cfg)
+	for _, sub := range subs {
+		projects = append(projects, sub.Projects...)
+		backfill = backfill || sub.Kind == "Related"
+	}
+	slices.Sort(projects)
+	projects = slices.Compact(projects)
+
+	data := struct {
+		Observe    bool
+		Pages      []string
+		Subsystems []*subsystem
+		Projects   []string
+		Backfill   bool
+		Schedule   []*sched.Status
+		Cycles     []*runlog.Summary
+		Queue      []*Task
+		Done       []*Task
+		Pending    []*action
+		Recent     []*action
+		Edits      []*commentfix.Edit
+		Proposals  []*approval.Proposal
+		Decided    []*approval.Proposal
+		Problems   []*logstore.Record
+		Themes     []*themes.Report
+		Dead       []*embeddocs.Failure
+		Mismatches []*storage.VectorMismatch
+	}{cfg.ObserveOnly, pages, subs, projects, backfill, sched.Statuses(s.db), cycles, queue, done, pending, recent, edits, proposals, decided,
+		logstore.Records(s.db, &logstore.Query{Since: since, Level: slog.LevelWarn, Limit: maxProblems}), reports, dead, mismatches}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := homeTemplate.Execute(w, &data); err != nil {
+		s.slog.Error("admin home template", "err", err)
+	}
+}
+
+// healthz serves the health check, which does not require authentication.
+// It reports an error unless a main loop cycle finished recently without errors
+// (see [runlog.Healthy]) and no task is stuck (see [sched.Status]).
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if err := runlog.Healthy(s.db, s.now(), healthWindow); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for _, st := range sched.Statuses(s.db) {
+		if st.Stuck {
+			http.Error(w, fmt.Sprintf("task %s stuck since %s on %s", st.Name, st.LastStart.UTC().Format(time.RFC3339), st.Instance), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// logs serves the log search page, which shows the newest stored
+// log records at or above the level in the "level" parameter
+// (default INFO) whose messages contain the "msg" parameter.
+func (s *Server) logs(w http.ResponseWriter, r *http.Request) {
+	q := &logstore.Query{Msg: r.FormValue("msg"), Limit: maxRecent}
+	if lv := r.FormValue("level"); lv != "" {
+		if err := q.Level.UnmarshalText([]byte(lv)); err != nil {
+			http.Error(w, fmt.Sprintf("invalid level %q", lv), http.StatusBadRequest)
+			return
+		}
+	}
+	data := struct {
+		Level   string
+		Msg     string
+		Levels  []string
+		Records []*logstore.Record
+	}{q.Level.String(), q.Msg, []string{"DEBUG", "INFO", "WARN", "ERROR"}, logstore.Records(s.db, q)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := logsTemplate.Execute(w, &data); err != nil {
+		s.slog.Error("admin logs template", "err", err)
+	}
+}
+
+// subsystems returns the subsystems enabled in cfg, sorted by name.
+func (s *Server) subsystems(cfg *config.Config) []*subsystem {
+	var list []*subsystem
+	add := func(kind, name string, projects []string, section any) {
+		js, err := json.MarshalIndent(section, "", "\t")
+		if err != nil {
+			// unreachable
+			panic(err)
+		}
+		sub := &subsystem{Name: name, Kind: kind, Projects: projects, Config: string(js)}
+		sub.DryRun, sub.Writes = cfg.DryRun(name)
+		list = append(list, sub)
+	}
+	if c := cfg.CommentFix; c != nil {
+		var projects []string
+		for _, p := range c.Projects {
+			projects = append(projects, p.Project)
+		}
+		add("CommentFix", c.Name, projects, c)
+	}
+	if c := cfg.Related; c != nil {
+		add("Related", c.Name, c.Projects, c)
+	}
+	if c := cfg.NeedInfo; c != nil {
+		add("NeedInfo", c.Name, c.Projects, c)
+	}
+	if c := cfg.Summary; c != nil {
+		add("Summary", c.Name, c.Projects, c)
+	}
+	if c := cfg.Owners; c != nil {
+		add("Owners", c.Name, slices.Sorted(maps.Keys(c.Projects)), c)
+	}
+	if c := cfg.Commands; c != nil {
+		add("Commands", c.Name, slices.Sorted(maps.Keys(c.Allow)), c)
+	}
+	if c := cfg.Flakes; c != nil {
+		add("Flakes", c.Name, c.Projects, c)
+	}
+	if c := cfg.Milestone; c != nil {
+		add("Milestone", c.Name, c.Projects, c)
+	}
+	if c := cfg.WaitInfo; c != nil {
+		add("WaitInfo", c.Name, c.Projects, c)
+	}
+	if c := cfg.Priority; c != nil {
+		add("Priority", c.Name, c.Projects, c)
+	}
+	if c := cfg.Themes; c != nil {
+		add("Themes", c.Name, c.Projects, c)
+	}
+	if c := cfg.Approvals; c != nil {
+		add("Approvals", c.Name, slices.Sorted(maps.Keys(c.Approvers)), c)
+	}
+	slices.SortFunc(list, func(x, y *subsystem) int { return cmp.Compare(x.Name, y.Name) })
+	return list
+}
+
+var funcs = template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05Z") },
+	"diff": func(d string) template.HTML { return diff.HTML([]byte(d)) },
+}
+
+// logRecords is the template for a table of log records, shared by the pages.
+const logRecords = `{{define "records"}}
+<table>
+<tr><th>Time</th><th>Level</th><th>Message</th><th>Attributes</th></tr>
+{{range .}}<tr><td>{{time .Time}}</td><td>{{if ge .Level 4}}<span class="dry">{{.Level}}</span>{{else}}{{.Level}}{{end}}</td><td>{{.Msg}}</td><td>{{range .Attrs}}{{.Key}}={{.Value}}<br>{{end}}</td></tr>{{end}}
+</table>
+{{end}}`
+
+var homeTemplate = template.Must(template.Must(template.New("home").Funcs(funcs).Parse(logRecords)).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Gaby Admin{{if .Observe}} (observe-only){{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+pre { margin: 0; font-size: 85%; }
+.dry { color: #a60; }
+.live { color: #080; }
+.observe { background: #fd8; border: 2px solid #a60; padding: 0.5em; font-weight: bold; }
+pre .hdr, pre .hunk { color: #888; }
+pre .del { background: #fee; }
+pre .ins { background: #efe; }
+pre del { background: #fbb; text-decoration: none; }
+pre ins { background: #afa; text-decoration: none; }
+</style>
+</head>
+<body>
+<h1>Gaby Admin</h1>
+{{if .Observe}}<p class="observe">Observe-only mode: Gaby is not writing to GitHub.
+Every subsystem runs in dry-run mode, regardless of its own setting.</p>{{end}}
+{{with .Pages}}<p>{{range .}}<a href="{{.}}">{{.}}</a> {{end}}</p>{{end}}
+
+<h2>Subsystems</h2>
+<table>
+<tr><th>Name</th><th>Kind</th><th>Projects</th><th>Mode</th><th>Configuration</th></tr>
+{{range .Subsystems}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Kind}}</td>
+<td>{{range .Projects}}{{.}}<br>{{end}}</td>
+<td>
+{{if not .Writes}}read-only
+{{else if $.Observe}}<span class="dry">dry run</span> (observe-only)
+{{else}}
+<form method="post" action="/dryrun">
+<input type="hidden" name="name" value="{{.Name}}">
+{{if .DryRun}}<span class="dry">dry run</span>
+<input type="hidden" name="dryrun" value="off"><input type="submit" value="Go live">
+{{else}}<span class="live">live</span>
+<input type="hidden" name="dryrun" value="on"><input type="submit" value="Dry run">
+{{end}}
+</form>
+{{end}}
+</td>
+<td><details><summary>show</summary><pre>{{.Config}}</pre></details></td>
+</tr>
+{{end}}
+</table>
+
+<h2>Schedule</h2>
+{{if .Schedule}}
+<table>
+<tr><th>Task</th><th>Last Run</th><th>Next Run</th><th>Result</th></tr>
+{{range .Schedule}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .LastStart.IsZero}}never{{else if .Stuck}}{{time .LastStart}} (<span class="dry">stuck</span>){{with .Instance}}<br>on {{.}}{{end}}{{else}}{{time .LastStart}} ({{.LastEnd.Sub .LastStart}}){{with .Instance}}<br>on {{.}}{{end}}{{end}}</td>
+<td>{{time .Next}}</td>
+<td>{{if .Err}}<span class="dry">{{.Err}}</span>{{if .Failures}} ({{.Failures}} in a row){{end}}{{else}}ok{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>No tasks have run.</p>{{end}}
+
+<h2>Recent Cycles</h2>
+<p>The work done in the most recent cycles of the main loop. <a href="/healthz">Health check</a>.</p>
+{{if .Cycles}}
+<table>
+<tr><th>End</th><th>Duration</th><th>Instance</th><th>Events</th><th>Docs</th><th>Embeddings</th><th>Comments</th><th>Errors</th></tr>
+{{range .Cycles}}
+<tr><td>{{time .End}}</td><td>{{.End.Sub .Start}}</td><td>{{.Instance}}</td><td>{{.Events}}</td><td>{{.Docs}}</td><td>{{.Embeddings}}</td><td>{{.Comments}}</td><td>{{if .Errors}}<span class="dry">{{.Errors}}</span>{{else}}0{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>No cycles have finished.</p>{{end}}
+
+<h2>Tasks</h2>
+<form method="post" action="/sync">
+Sync GitHub project
+<select name="project">{{range .Projects}}<option>{{.}}</option>{{end}}</select>
+<input type="submit" value="Sync">
+</form>
+{{if .Backfill}}
+<form method="post" action="/backfill">
+Backfill related posts in
+<select name="project">{{range .Projects}}<option>{{.}}</option>{{end}}</select>
+issues <input name="min" size="8"> to <input name="max" size="8">
+<input type="submit" value="Backfill">
+</form>
+{{end}}
+{{if or .Queue .Done}}
+<table>
+<tr><th>Task</th><th>Queued</th><th>Finished</th><th>Result</th></tr>
+{{range .Queue}}<tr><td>{{.}}</td><td>{{time .Queued}}</td><td>queued</td><td></td></tr>{{end}}
+{{range .Done}}<tr><td>{{.}}</td><td>{{time .Queued}}</td><td>{{time .Finished}}</td><td>{{.Result}}</td></tr>{{end}}
+</table>
+{{end}}
+
+<h2>Proposed Actions</h2>
+<p>Actions awaiting a maintainer's approval. Approved actions are performed on the next run of the approval queue.</p>
+{{if .Proposals}}
+<table>
+<tr><th>Proposed</th><th>Expires</th><th>Issue</th><th>Action</th><th>Reason</th><th>Decision</th></tr>
+{{range .Proposals}}
+<tr>
+<td>{{time .Created}}<br>by {{.Actor}}</td>
+<td>{{time .Expires}}</td>
+<td><a href="{{.IssueURL}}">{{.Project}}#{{.Issue}}</a></td>
+<td>{{.Kind}}{{with .AddLabels}}<br>add labels: {{range .}}{{.}} {{end}}{{end}}{{with .State}}<br>set state: {{.}}{{end}}
+{{with .Comment}}<details><summary>comment</summary><pre>{{.}}</pre></details>{{end}}</td>
+<td>{{.Reason}}</td>
+<td>
+<form method="post" action="/approval">
+<input type="hidden" name="id" value="{{.ID}}">
+<button type="submit" name="decision" value="approve">Approve</button>
+<button type="submit" name="decision" value="reject">Reject</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+{{with .Decided}}
+<h3>Recently Decided</h3>
+<table>
+<tr><th>Proposed</th><th>Issue</th><th>Action</th><th>Status</th><th>Result</th></tr>
+{{range .}}<tr><td>{{time .Created}}</td><td><a href="{{.IssueURL}}">{{.Project}}#{{.Issue}}</a></td><td>{{.Kind}}</td><td>{{.Status}}{{with .Decider}} by {{.}}{{end}}</td><td>{{.Result}}{{with .Error}}<br>failed: {{.}}{{end}}</td></tr>{{end}}
+</table>
+{{end}}
+
+<h2>Recent Problems</h2>
+<p>Warnings and errors logged in the last week. <a href="/logs">Search all logs</a>.</p>
+{{with .Problems}}{{template "records" .}}{{else}}<p>None.</p>{{end}}
+
+<h2>Emerging Themes</h2>
+<p>Clusters of similar new issues, which may point to a widespread regression
+or a recurring confusion.</p>
+{{range .Themes}}
+<h3>{{.Project}} ({{.Name}})</h3>
+<p>{{.Issues}} issues created since {{time .Since}}, as of {{time .Time}}.</p>
+{{if .Themes}}
+<table>
+<tr><th>Theme</th><th>Similarity</th><th>Issues</th></tr>
+{{range .Themes}}<tr><td>{{.Title}}</td><td>{{printf "%.2f" .Score}}</td><td>{{range .Issues}}<a href="{{.URL}}">#{{.Number}}</a> {{.Title}}<br>{{end}}</td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+{{else}}<p>No reports.</p>{{end}}
+
+<h2>Unembedded Documents</h2>
+<p>Documents skipped by the embedding task after failing repeatedly.
+A new version of a document is tried again.</p>
+{{if .Dead}}
+<table>
+<tr><th>Document</th><th>Last Failure</th><th>Error</th></tr>
+{{range .Dead}}<tr><td>{{.ID}}</td><td>{{time .Time}}</td><td>{{.Err}}</td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h2>Vector Dimension Mismatches</h2>
+<p>Vectors rejected because their dimension differs from the rest of their namespace,
+usually because a different embedding model computed them.</p>
+{{if .Mismatches}}
+<table>
+<tr><th>Namespace</th><th>Dimension</th><th>Rejected</th><th>Last Rejected</th></tr>
+{{range .Mismatches}}<tr><td>{{printf "%q" .Namespace}}</td><td>{{.Dim}}</td><td>{{.Count}}</td><td>{{.ID}} (dimension {{.Len}}) at {{time .Time}}</td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h2>Pending Actions</h2>
+<p>Actions begun but never finished, usually because Gaby crashed while performing them.
+Check whether each took effect.</p>
+{{if .Pending}}
+<table>
+<tr><th>Started</th><th>Action</th></tr>
+{{range .Pending}}<tr><td>{{time .Start}}</td><td>{{.Key}}</td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h2>Recent Actions</h2>
+{{if .Recent}}
+<table>
+<tr><th>Started</th><th>Action</th><th>Outcome</th></tr>
+{{range .Recent}}<tr><td>{{time .Start}}</td><td>{{.Key}}</td><td>{{.Outcome}}</td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h2>Recent Edits</h2>
+{{if .Edits}}
+<table>
+<tr><th>Time</th><th>Issue</th><th>Diff</th></tr>
+{{range .Edits}}<tr><td>{{time .Time}}{{if .Undone}}<br>(undone){{end}}</td><td>{{.Project}}#{{.Issue}}</td><td><pre>{{diff .Diff}}</pre></td></tr>{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+var logsTemplate = template.Must(template.Must(template.New("logs").Funcs(funcs).Parse(logRecords)).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Gaby Logs</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+.dry { color: #a60; }
+</style>
+</head>
+<body>
+<h1>Gaby Logs</h1>
+<p><a href="/">Home</a></p>
+<form method="get" action="/logs">
+Level at least
+<select name="level">{{range .Levels}}<option{{if eq . $.Level}} selected{{end}}>{{.}}</option>{{end}}</select>
+message containing <input name="msg" value="{{.Msg}}">
+<input type="submit" value="Search">
+</form>
+<p>Only warnings, errors, and records of changes to GitHub are kept.</p>
+{{with .Records}}{{template "records" .}}{{else}}<p>No matching records.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,477 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/commentfix"
+	"rsc.io/gaby/internal/config"
+	"rsc.io/gaby/internal/embeddocs"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/logstore"
+	"rsc.io/gaby/internal/runlog"
+	"rsc.io/gaby/internal/sched"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/gaby/internal/themes"
+	"rsc.io/ordered"
+)
+
+var ctx = context.Background()
+
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.CommentFix.Name = "fixer"
+	cfg.CommentFix.Projects[0].Project = "rsc/tmp"
+	return cfg
+}
+
+// do serves a request to s, returning the response.
+// If form is non-nil, the request is a POST of form.
+func do(s *Server, path string, form url.Values, auth bool) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest("GET", path, nil)
+	}
+	if auth {
+		r.SetBasicAuth("admin", "pass")
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAuth(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+
+	s := New(lg, db, secret.Empty(), testConfig())
+	if w := do(s, "/", nil, true); w.Code != http.StatusForbidden {
+		t.Errorf("without secret: code %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	s = New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	if w := do(s, "/", nil, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("without auth: code %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := do(s, "/", nil, true); w.Code != http.StatusOK {
+		t.Errorf("with auth: code %d, want %d", w.Code, http.StatusOK)
+	}
+
+	r := httptest.NewRequest("POST", "/sync", strings.NewReader("project=rsc/tmp"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "https://evil.example")
+	r.SetBasicAuth("admin", "pass")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cross-origin POST: code %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if len(s.Tasks()) != 0 {
+		t.Errorf("cross-origin POST queued task")
+	}
+}
+
+func TestHome(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number:    1,
+		Title:     "spelling",
+		Body:      "Contexts are cancelled.",
+		CreatedAt: "2024-06-17T20:16:49-04:00",
+		UpdatedAt: "2024-06-17T20:16:49-04:00",
+	})
+	f := commentfix.New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.EnableProject("rsc/tmp")
+	f.ReplaceText("cancelled", "canceled")
+	f.SetTimeLimit(time.Time{})
+	f.EnableEdits()
+	f.Run(ctx)
+
+	storage.BeginAction(db, ordered.Encode("test.Post", "rsc/tmp", 2))
+	storage.BeginAction(db, ordered.Encode("test.Post", "rsc/tmp", 3))
+	storage.FinishAction(db, ordered.Encode("test.Post", "rsc/tmp", 3), "https://example.com/3")
+
+	sch := sched.New(lg, db)
+	sch.SetTasks([]*sched.Task{
+		{Name: "github", Interval: time.Minute, Run: func(context.Context) error { return errors.New("sync broke") }},
+		{Name: "crossref", Interval: time.Minute, Run: func(context.Context) error { return nil }},
+	})
+	sch.RunDue(ctx)
+
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	s.Handle("GET /hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello, world\n"))
+	}), "/hello")
+	if w := do(s, "/hello", nil, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("/hello without auth: code %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := do(s, "/hello", nil, true); w.Body.String() != "hello, world\n" {
+		t.Errorf("/hello = %q, want %q", w.Body, "hello, world\n")
+	}
+
+	w := do(s, "/", nil, true)
+	body := w.Body.String()
+	for _, want := range []string{
+		`<a href="/hello">/hello</a>`,
+		"fixer", "related", "priority",
+		`<span class="live">live</span>`,
+		`<span class="dry">dry run</span>`,
+		`&#34;test.Post&#34;, &#34;rsc/tmp&#34;, 2`,                   // pending
+		`https://example.com/3`,                                       // recent
+		`<span class="ins">+Contexts are <ins>canceled</ins>.</span>`, // edit diff
+		`<td>crossref</td>`,                                           // schedule
+		`sync broke</span> (1 in a row)`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	sdb := secret.Map{"gaby-admin": "admin:pass"}
+	s := New(lg, db, sdb, testConfig())
+
+	_, v0 := s.Config()
+	w := do(s, "/dryrun", url.Values{"name": {"related"}, "dryrun": {"on"}}, true)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /dryrun: code %d, want %d\n%s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	cfg, v1 := s.Config()
+	if v1 == v0 {
+		t.Errorf("version unchanged after dry run change")
+	}
+	if cfg.Related.Posts {
+		t.Errorf("Related.Posts = true after setting dry run")
+	}
+
+	if w := do(s, "/dryrun", url.Values{"name": {"priority"}, "dryrun": {"on"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("dry run of read-only subsystem: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// The setting persists in a new Server.
+	s = New(lg, db, sdb, testConfig())
+	if cfg, _ := s.Config(); cfg.Related.Posts {
+		t.Errorf("Related.Posts = true in new Server")
+	}
+
+	// Another Server sharing the database (as in another Gaby instance)
+	// sees the change at its next call to Config.
+	s2 := New(lg, db, sdb, testConfig())
+	_, v0 = s2.Config()
+	do(s, "/dryrun", url.Values{"name": {"related"}, "dryrun": {"off"}}, true)
+	cfg, v1 = s2.Config()
+	if v1 == v0 || !cfg.Related.Posts {
+		t.Errorf("other Server: version %d -> %d, Related.Posts = %v, want new version, true", v0, v1, cfg.Related.Posts)
+	}
+	if _, v2 := s2.Config(); v2 != v1 {
+		t.Errorf("other Server: version changed without a change: %d -> %d", v1, v2)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+
+	do(s, "/sync", url.Values{"project": {"rsc/tmp"}}, true)
+	do(s, "/backfill", url.Values{"project": {"rsc/tmp"}, "min": {"10"}, "max": {"20"}}, true)
+	if w := do(s, "/backfill", url.Values{"project": {"rsc/tmp"}, "min": {"20"}, "max": {"10"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("backfill with bad range: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "/sync", url.Values{"project": {"tmp"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("sync of bad project: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if body := do(s, "/", nil, true).Body.String(); !strings.Contains(body, "backfill rsc/tmp #10-#20</td><td>") {
+		t.Errorf("home page missing queued backfill:\n%s", body)
+	}
+
+	tasks := s.Tasks()
+	var list []string
+	for _, task := range tasks {
+		list = append(list, task.String())
+	}
+	if got, want := strings.Join(list, "; "), "sync rsc/tmp; backfill rsc/tmp #10-#20"; got != want {
+		t.Fatalf("Tasks() = %s, want %s", got, want)
+	}
+	if len(s.Tasks()) != 0 {
+		t.Errorf("second Tasks() returned tasks")
+	}
+
+	s.Finish(tasks[0], "synced OK")
+	if body := do(s, "/", nil, true).Body.String(); !strings.Contains(body, "synced OK") {
+		t.Errorf("home page missing task result:\n%s", body)
+	}
+}
+
+func TestObserveOnly(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	cfg := testConfig()
+	cfg.ObserveOnly = true
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, cfg)
+
+	body := do(s, "/", nil, true).Body.String()
+	for _, want := range []string{
+		`<title>Gaby Admin (observe-only)</title>`,
+		`Observe-only mode: Gaby is not writing to GitHub.`,
+		`<span class="dry">dry run</span> (observe-only)`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `action="/dryrun"`) || strings.Contains(body, `class="live"`) {
+		t.Errorf("observe-only home page offers dry-run toggle or shows live subsystem:\n%s", body)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	for n := range int64(2) {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{Number: n + 1, State: "open"})
+	}
+	q := approval.New(lg, db, gh, "approvals")
+	var ids []int64
+	for n := range int64(2) {
+		issue, err := gh.LookupIssueURL(fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", n+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &approval.Proposal{Kind: "waitinfo.Close", Actor: "waitinfo", Reason: "no reply", State: "closed"}
+		q.Propose(issue, ordered.Encode("waitinfo.Close", n+1), p)
+		ids = append(ids, p.ID)
+	}
+
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	body := do(s, "/", nil, true).Body.String()
+	for _, want := range []string{
+		`<a href="https://github.com/rsc/tmp/issues/1">rsc/tmp#1</a>`,
+		`set state: closed`,
+		fmt.Sprintf(`name="id" value="%d"`, ids[1]),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page missing %q:\n%s", want, body)
+		}
+	}
+
+	if w := do(s, "/approval", url.Values{"id": {fmt.Sprint(ids[0])}, "decision": {"approve"}}, true); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /approval: code %d, want %d\n%s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if w := do(s, "/approval", url.Values{"id": {fmt.Sprint(ids[0])}, "decision": {"reject"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("second decision: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do(s, "/approval", url.Values{"id": {"x"}, "decision": {"approve"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("bad ID: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if p, _ := approval.Lookup(db, ids[0]); p.Status != approval.Approved || p.Decider != "admin" {
+		t.Errorf("after approval: status %s, decider %q, want approved, admin", p.Status, p.Decider)
+	}
+	if body := do(s, "/", nil, true).Body.String(); !strings.Contains(body, "approved by admin") {
+		t.Errorf("home page missing decision:\n%s", body)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	db := storage.MemDB()
+	ls := logstore.New(db)
+	defer ls.Close()
+	ls.Keep("related.Poster post")
+	lg := slog.New(ls.Handler(testutil.Slogger(t).Handler()))
+	lg.Error("sync failed", "project", "rsc/tmp")
+	lg.Info("related.Poster post", "issue", 1)
+	ls.Flush()
+
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	body := do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "sync failed") || !strings.Contains(body, "project=rsc/tmp") {
+		t.Errorf("home page missing problem:\n%s", body)
+	}
+	if strings.Contains(body, "related.Poster post") {
+		t.Errorf("home page shows informational record:\n%s", body)
+	}
+
+	body = do(s, "/logs?msg=Poster", nil, true).Body.String()
+	if !strings.Contains(body, "related.Poster post") || strings.Contains(body, "sync failed") {
+		t.Errorf("/logs?msg=Poster:\n%s", body)
+	}
+	body = do(s, "/logs?level=ERROR", nil, true).Body.String()
+	if strings.Contains(body, "related.Poster post") || !strings.Contains(body, "sync failed") {
+		t.Errorf("/logs?level=ERROR:\n%s", body)
+	}
+	if w := do(s, "/logs?level=LOUD", nil, true); w.Code != http.StatusBadRequest {
+		t.Errorf("bad level: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	db := storage.MemDB()
+	s := New(testutil.Slogger(t), db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	if w := do(s, "/healthz", nil, false); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "no cycles") {
+		t.Errorf("/healthz before any cycles: %d %s", w.Code, w.Body)
+	}
+
+	r := runlog.New(db, "runlog")
+	r.SetInstance("inst1")
+	r.Record()
+	if w := do(s, "/healthz", nil, false); w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("/healthz after cycle: %d %s", w.Code, w.Body)
+	}
+	body := do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "<td>inst1</td>") {
+		t.Errorf("home page missing cycle:\n%s", body)
+	}
+
+	lg := slog.New(r.Handler(testutil.Slogger(t).Handler()))
+	lg.Error("oops")
+	r.Record()
+	if w := do(s, "/healthz", nil, false); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "1 errors") {
+		t.Errorf("/healthz after errors: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestStuck(t *testing.T) {
+	db := storage.MemDB()
+	s := New(testutil.Slogger(t), db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	runlog.New(db, "runlog").Record()
+	if w := do(s, "/healthz", nil, false); w.Code != http.StatusOK {
+		t.Fatalf("/healthz after cycle: %d %s", w.Code, w.Body)
+	}
+
+	// As recorded by the sched watchdog.
+	start := time.Now().Add(-time.Hour)
+	db.Set(ordered.Encode("sched.Status", "github"), storage.JSON(&sched.Status{Name: "github", LastStart: start, Instance: "inst1", Stuck: true}))
+	if w := do(s, "/healthz", nil, false); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "task github stuck since") {
+		t.Errorf("/healthz with stuck task: %d %s", w.Code, w.Body)
+	}
+	if body := do(s, "/", nil, true).Body.String(); !strings.Contains(body, `(<span class="dry">stuck</span>)`) {
+		t.Errorf("home page missing stuck task:\n%s", body)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	db := storage.MemDB()
+	s := New(testutil.Slogger(t), db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	if body := do(s, "/", nil, true).Body.String(); strings.Contains(body, "too long") {
+		t.Errorf("home page shows dead letter before any:\n%s", body)
+	}
+
+	// As recorded by embeddocs.
+	db.Set(ordered.Encode("embeddocs.Failure", "embeddocs", "https://go.dev/issue/1"), storage.JSON(&embeddocs.Failure{ID: "https://go.dev/issue/1", Failures: embeddocs.MaxFailures, Err: "too long", Time: time.Now()}))
+	db.Set(ordered.Encode("embeddocs.Failure", "embeddocs", "https://go.dev/issue/2"), storage.JSON(&embeddocs.Failure{ID: "https://go.dev/issue/2", Failures: 1, Err: "flaky", Time: time.Now()}))
+	db.Set(ordered.Encode("embeddocs.Failure", "embeddocs:v2", "https://go.dev/issue/3"), storage.JSON(&embeddocs.Failure{ID: "https://go.dev/issue/3", Failures: embeddocs.MaxFailures, Err: "too new", Time: time.Now()}))
+	body := do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "<td>https://go.dev/issue/1</td>") || !strings.Contains(body, "too long") {
+		t.Errorf("home page missing dead letter:\n%s", body)
+	}
+	if strings.Contains(body, "flaky") {
+		t.Errorf("home page shows document that has not failed repeatedly:\n%s", body)
+	}
+	if strings.Contains(body, "too new") {
+		t.Errorf("home page shows dead letter of another Syncer:\n%s", body)
+	}
+
+	// The home page lists the dead letters of the configured Syncer.
+	s.SetEmbedName("embeddocs:v2")
+	body = do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "too new") || strings.Contains(body, "too long") {
+		t.Errorf("home page with embed name embeddocs:v2 shows wrong dead letters:\n%s", body)
+	}
+}
+
+func TestThemes(t *testing.T) {
+	db := storage.MemDB()
+	s := New(testutil.Slogger(t), db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	if body := do(s, "/", nil, true).Body.String(); !strings.Contains(body, "<p>No reports.</p>") {
+		t.Errorf("home page missing empty themes:\n%s", body)
+	}
+
+	// As recorded by themes.Finder.Run.
+	db.Set(ordered.Encode("themes.Report", "themes", "rsc/tmp"), storage.JSON(&themes.Report{
+		Name:    "themes",
+		Project: "rsc/tmp",
+		Time:    time.Now(),
+		Issues:  10,
+		Themes: []*themes.Theme{{
+			Title:  "runtime: crash in GC",
+			Score:  0.93,
+			Issues: []*themes.Member{{Number: 1, Title: "runtime: crash in GC", URL: "https://github.com/rsc/tmp/issues/1"}},
+		}},
+	}))
+	body := do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "<td>runtime: crash in GC</td><td>0.93</td>") || !strings.Contains(body, `<a href="https://github.com/rsc/tmp/issues/1">#1</a>`) {
+		t.Errorf("home page missing theme:\n%s", body)
+	}
+}
+
+func TestVectorMismatches(t *testing.T) {
+	db := storage.MemDB()
+	s := New(testutil.Slogger(t), db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	storage.RecordVectorMismatch(db, "v2", 768, "https://go.dev/issue/1", 256)
+	body := do(s, "/", nil, true).Body.String()
+	if !strings.Contains(body, "<td>&#34;v2&#34;</td><td>768</td><td>1</td><td>https://go.dev/issue/1 (dimension 256)") {
+		t.Errorf("home page missing vector mismatch:\n%s", body)
+	}
+}
+
+// A wedgedDB is a database whose reads fail.
+type wedgedDB struct {
+	storage.DB
+}
+
+func (db wedgedDB) Get(key []byte) ([]byte, bool) {
+	db.Panic("wedged get", "key", storage.Fmt(key))
+	return nil, false
+}
+
+func (db wedgedDB) Scan(start, end []byte) iter.Seq2[[]byte, func() []byte] {
+	db.Panic("wedged scan", "start", storage.Fmt(start))
+	return nil
+}
+
+func TestDatabaseError(t *testing.T) {
+	lg, buf := testutil.SlogBuffer()
+	db := storage.MemDB()
+	s := New(lg, db, secret.Map{"gaby-admin": "admin:pass"}, testConfig())
+	s.db = wedgedDB{db}
+
+	w := do(s, "/", nil, true)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wedged database: code %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(buf.String(), "admin database error") {
+		t.Errorf("wedged database: missing log message:\n%s", buf)
+	}
+
+	s.db = db
+	if w := do(s, "/", nil, true); w.Code != http.StatusOK {
+		t.Errorf("after recovery: code %d, want %d", w.Code, http.StatusOK)
+	}
+}
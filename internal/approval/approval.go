@@ -0,0 +1,415 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package approval implements a queue of GitHub actions
+// awaiting approval by a maintainer.
+//
+// A subsystem configured to require approval for a kind of action
+// (see [Queue.Requires]) records each such action as a [Proposal]
+// (see [Queue.Propose]) instead of performing it.
+// A maintainer approves or rejects the proposal, using the admin interface
+// or a command in a GitHub comment (see [Decide]),
+// and [Queue.Run] performs the approved actions.
+// Proposals not decided before their expiry time (see [Queue.SetExpiry])
+// expire and are never performed.
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["approval.Proposal", ID] => JSON of Proposal
+//	["approval.Key", Key] => ID
+//
+// where Key is the [storage.BeginAction] key of the proposed action.
+// [Queue.Run] performs each approved action under that key,
+// so that the proposing subsystem sees the action as done.
+// It posts the action's comment under the separate action key
+// ["approval.Comment", ID], so that retrying an action whose
+// issue edit failed does not post the comment again.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "approval.Proposal", Key: "ID", Val: "JSON of Proposal"},
+		storage.Schema{Kind: "approval.Key", Key: "Key", Val: "ID"},
+	)
+}
+
+// A Status is the status of a [Proposal].
+type Status string
+
+const (
+	Pending  Status = "pending"  // awaiting a decision
+	Approved Status = "approved" // approved but not yet performed
+	Rejected Status = "rejected" // rejected by a maintainer
+	Expired  Status = "expired"  // not decided before the expiry time
+	Done     Status = "done"     // performed
+	Obsolete Status = "obsolete" // not performed because the issue changed
+)
+
+// A Proposal is a proposed GitHub action on a single issue:
+// posting a comment, adding labels, changing the issue state,
+// or a combination, performed in that order.
+type Proposal struct {
+	ID      int64  // unique ID, assigned by [Queue.Propose]
+	Key     []byte // [storage.BeginAction] key of the action
+	Kind    string // kind of action, such as "waitinfo.Close"
+	Actor   string // name of the proposing subsystem
+	Project string // GitHub project, such as "golang/go"
+	Issue   int64  // issue number
+	Reason  string // explanation for the approver
+
+	Comment   string   `json:",omitempty"` // comment to post
+	AddLabels []string `json:",omitempty"` // labels to add
+	State     string   `json:",omitempty"` // new issue state, such as "closed"
+
+	// The action is obsolete if, when it is performed,
+	// the issue state differs from IssueState
+	// or the issue does not have the label IfLabel (if non-empty).
+	IssueState string
+	IfLabel    string `json:",omitempty"`
+
+	Created time.Time
+	Expires time.Time
+	Status  Status
+	Decider string    `json:",omitempty"` // who approved or rejected the proposal
+	Decided time.Time `json:",omitempty"`
+	Result  string    `json:",omitempty"` // URL of posted comment, or why the action was not performed
+	Error   string    `json:",omitempty"` // error from the latest failed attempt to perform the action
+}
+
+// IssueURL returns the GitHub web URL of the proposal's issue.
+func (p *Proposal) IssueURL() string {
+	return fmt.Sprintf("https://github.com/%s/issues/%d", p.Project, p.Issue)
+}
+
+// A Queue records proposed actions and performs the approved ones.
+type Queue struct {
+	slog   *slog.Logger
+	db     storage.DB
+	github *github.Client
+	name   string
+	kinds  map[string]bool
+	expiry time.Duration
+	edit   bool
+	now    func() time.Time // for testing
+}
+
+// DefaultExpiry is the default time a proposal waits for a decision.
+const DefaultExpiry = 7 * 24 * time.Hour
+
+// New creates and returns a new Queue. It logs to lg, stores proposals in db,
+// and performs approved actions using gh.
+// The name is used only in log messages.
+//
+// Use the [Queue] methods to configure the queue
+// (especially [Queue.Require] and [Queue.EnableEdits])
+// before passing it to subsystems and calling [Queue.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, name string) *Queue {
+	return &Queue{
+		slog:   lg,
+		db:     db,
+		github: gh,
+		name:   name,
+		kinds:  make(map[string]bool),
+		expiry: DefaultExpiry,
+		now:    time.Now,
+	}
+}
+
+// Require configures the Queue to require approval
+// for the given kind of action, such as "waitinfo.Close".
+// By convention, the kind is the first element
+// of the action's [storage.BeginAction] key.
+func (q *Queue) Require(kind string) {
+	q.kinds[kind] = true
+}
+
+// Requires reports whether the given kind of action requires approval.
+// A nil Queue requires approval for nothing.
+func (q *Queue) Requires(kind string) bool {
+	return q != nil && q.kinds[kind]
+}
+
+// SetExpiry sets how long a proposal waits for a decision
+// before it expires. The default is [DefaultExpiry].
+func (q *Queue) SetExpiry(d time.Duration) {
+	q.expiry = d
+}
+
+// EnableEdits enables the Queue to perform approved actions on GitHub.
+// If EnableEdits has not been called, [Queue.Run] logs what it would do
+// but does not do it.
+func (q *Queue) EnableEdits() {
+	q.edit = true
+}
+
+// Propose records p as a proposed action on issue,
+// to be performed under the [storage.BeginAction] key
+// once a maintainer approves it.
+// Propose sets p's ID, Key, Project, Issue, IssueState, Created,
+// Expires, and Status fields; the caller sets the others.
+// If an action with the same key has already been proposed,
+// Propose leaves the earlier proposal alone (whatever its status)
+// and returns false.
+func (q *Queue) Propose(issue *github.Issue, key []byte, p *Proposal) bool {
+	const lock = "approval.Propose"
+	q.db.Lock(lock)
+	defer q.db.Unlock(lock)
+
+	byKey := ordered.Encode("approval.Key", string(key))
+	if _, ok := q.db.Get(byKey); ok {
+		return false
+	}
+	now := q.now()
+	id := now.UnixNano()
+	for {
+		if _, ok := q.db.Get(ordered.Encode("approval.Proposal", id)); !ok {
+			break
+		}
+		id++
+	}
+	p.ID = id
+	p.Key = key
+	p.Project = issue.Project()
+	p.Issue = issue.Number
+	p.IssueState = issue.State
+	p.Created = now
+	p.Expires = now.Add(q.expiry)
+	p.Status = Pending
+	q.slog.Info("approval.Queue propose", "name", q.name, "id", id, "kind", p.Kind, "project", p.Project, "issue", p.Issue, "reason", p.Reason)
+	q.db.Set(ordered.Encode("approval.Proposal", id), storage.JSON(p))
+	q.db.Set(byKey, storage.JSON(id))
+	q.db.Flush()
+	return true
+}
+
+// Proposals returns an iterator over all the proposals in db, oldest first.
+func Proposals(db storage.DB) iter.Seq[*Proposal] {
+	return func(yield func(*Proposal) bool) {
+		for key, val := range db.Scan(ordered.Encode("approval.Proposal"), ordered.Encode("approval.Proposal", ordered.Inf)) {
+			if !yield(decode(db, key, val())) {
+				return
+			}
+		}
+	}
+}
+
+// Lookup returns the proposal in db with the given ID.
+func Lookup(db storage.DB, id int64) (*Proposal, bool) {
+	key := ordered.Encode("approval.Proposal", id)
+	val, ok := db.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return decode(db, key, val), true
+}
+
+func decode(db storage.DB, key, val []byte) *Proposal {
+	var p Proposal
+	if err := json.Unmarshal(val, &p); err != nil {
+		// unreachable unless corrupt storage
+		db.Panic("approval proposal decode", "key", storage.Fmt(key), "err", err)
+	}
+	return &p
+}
+
+// update calls f on the proposal in db with the given ID
+// and stores the result, holding a lock on the proposal throughout.
+func update(db storage.DB, id int64, f func(*Proposal) error) error {
+	key := ordered.Encode("approval.Proposal", id)
+	lock := string(key)
+	db.Lock(lock)
+	defer db.Unlock(lock)
+
+	val, ok := db.Get(key)
+	if !ok {
+		return fmt.Errorf("approval: no proposal %d", id)
+	}
+	p := decode(db, key, val)
+	if err := f(p); err != nil {
+		return err
+	}
+	db.Set(key, storage.JSON(p))
+	db.Flush()
+	return nil
+}
+
+// Decide records the decision by who (a GitHub login or admin user)
+// to approve or reject the pending proposal with the given ID.
+// The next call to [Queue.Run] performs an approved action.
+// Decide returns an error if there is no such proposal
+// or it is no longer pending.
+func (q *Queue) Decide(id int64, approve bool, who string) error {
+	return update(q.db, id, func(p *Proposal) error {
+		if p.Status != Pending {
+			return fmt.Errorf("approval: proposal %d is %s", id, p.Status)
+		}
+		now := q.now()
+		if now.After(p.Expires) {
+			return fmt.Errorf("approval: proposal %d has expired", id)
+		}
+		p.Status = Rejected
+		if approve {
+			p.Status = Approved
+		}
+		p.Decider = who
+		p.Decided = now
+		return nil
+	})
+}
+
+// Run runs a single round of the Queue:
+// it expires the pending proposals that are past their expiry time,
+// and it performs the approved actions.
+// Before performing an action, Run downloads the issue from GitHub
+// and marks the proposal obsolete, without performing it,
+// if the issue has changed in a way that makes the action inappropriate
+// (see [Proposal.IssueState]).
+// If performing an action fails, the proposal stays approved,
+// with the failure recorded in its Error field,
+// and the next call to Run tries again.
+// A retry does not repeat the parts of the action that succeeded.
+//
+// Run logs each action to the [slog.Logger] passed to [New].
+// If [Queue.EnableEdits] has not been called, Run only logs what it would do.
+//
+// If ctx is canceled, Run stops before the next proposal.
+func (q *Queue) Run(ctx context.Context) {
+	q.slog.Info("approval.Queue start", "name", q.name)
+	defer q.slog.Info("approval.Queue end", "name", q.name)
+
+	now := q.now()
+	for p := range Proposals(q.db) {
+		if ctx.Err() != nil {
+			return
+		}
+		switch p.Status {
+		case Pending:
+			if now.After(p.Expires) {
+				q.slog.Info("approval.Queue expire", "name", q.name, "id", p.ID, "kind", p.Kind, "project", p.Project, "issue", p.Issue)
+				q.set(p.ID, Pending, Expired, "", "")
+			}
+		case Approved:
+			q.slog.Info("approval.Queue perform", "name", q.name, "id", p.ID, "kind", p.Kind, "project", p.Project, "issue", p.Issue, "by", p.Decider)
+			if q.edit {
+				q.perform(ctx, p)
+			}
+		}
+	}
+}
+
+// set changes the status of the proposal with the given ID
+// from old to status, recording the result and error.
+// It does nothing if the status is no longer old.
+func (q *Queue) set(id int64, old, status Status, result, errmsg string) {
+	update(q.db, id, func(p *Proposal) error {
+		if p.Status != old {
+			return fmt.Errorf("changed")
+		}
+		p.Status = status
+		p.Result = result
+		p.Error = errmsg
+		return nil
+	})
+}
+
+// fail records that the attempt to perform the approved proposal p
+// failed with err, leaving p approved so that [Queue.Run] tries again.
+func (q *Queue) fail(p *Proposal, result string, err error) {
+	q.set(p.ID, Approved, Approved, result, err.Error())
+}
+
+// perform performs the approved proposal p.
+func (q *Queue) perform(ctx context.Context, p *Proposal) {
+	live, err := q.github.DownloadIssue(fmt.Sprintf("https://api.github.com/repos/%s/issues/%d", p.Project, p.Issue))
+	if err != nil {
+		q.slog.Error("approval.Queue download", "project", p.Project, "issue", p.Issue, "err", err)
+		q.fail(p, p.Result, err)
+		return
+	}
+	if live.State != p.IssueState || p.IfLabel != "" && !hasLabel(live, p.IfLabel) {
+		q.slog.Info("approval.Queue obsolete", "name", q.name, "id", p.ID, "project", p.Project, "issue", p.Issue)
+		q.set(p.ID, Approved, Obsolete, "issue changed", p.Error)
+		return
+	}
+	if !storage.BeginAction(q.db, p.Key) {
+		q.set(p.ID, Approved, Done, "already performed", "")
+		return
+	}
+
+	// Edits are attributed to the proposing subsystem.
+	gh := q.github.As(p.Actor).WithContext(ctx)
+	var url string
+	if p.Comment != "" {
+		// The comment is its own action, so that if the
+		// issue edit below fails, the retry does not post it again.
+		commentKey := ordered.Encode("approval.Comment", p.ID)
+		if storage.BeginAction(q.db, commentKey) {
+			url, err = gh.PostIssueComment(live, &github.IssueCommentChanges{Body: p.Comment})
+			if err != nil {
+				q.slog.Error("PostIssueComment", "issue", p.Issue, "err", err)
+				storage.CancelAction(q.db, commentKey)
+				storage.CancelAction(q.db, p.Key)
+				q.fail(p, "", err)
+				return
+			}
+			storage.FinishAction(q.db, commentKey, url)
+		} else if a, ok := storage.LookupAction(q.db, commentKey); ok && a.Done {
+			if err := json.Unmarshal(a.Outcome, &url); err != nil {
+				// unreachable unless corrupt storage
+				q.db.Panic("approval comment outcome decode", "id", p.ID, "err", err)
+			}
+		}
+	}
+	var changes github.IssueChanges
+	edit := false
+	if len(p.AddLabels) > 0 {
+		var labels []string
+		for _, l := range live.Labels {
+			labels = append(labels, l.Name)
+		}
+		old := len(labels)
+		for _, l := range p.AddLabels {
+			if !slices.Contains(labels, l) {
+				labels = append(labels, l)
+			}
+		}
+		if len(labels) > old {
+			changes.Labels = &labels
+			edit = true
+		}
+	}
+	if p.State != "" && p.State != live.State {
+		changes.State = p.State
+		edit = true
+	}
+	if edit {
+		if err := gh.EditIssue(live, &changes); err != nil {
+			q.slog.Error("EditIssue", "issue", p.Issue, "err", err)
+			storage.CancelAction(q.db, p.Key)
+			q.fail(p, url, err)
+			return
+		}
+	}
+	storage.FinishAction(q.db, p.Key, url)
+	q.set(p.ID, Approved, Done, url, "")
+}
+
+// hasLabel reports whether issue has the label.
+func hasLabel(issue *github.Issue, label string) bool {
+	return slices.ContainsFunc(issue.Labels, func(l github.Label) bool { return l.Name == label })
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package approval
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
+)
+
+var ctx = context.Background()
+
+func TestQueue(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	tc := gh.Testing()
+	for n := range int64(4) {
+		tc.AddIssue("rsc/tmp", &github.Issue{
+			Number: n + 1,
+			State:  "open",
+			Labels: []github.Label{{Name: "WaitingForInfo"}},
+		})
+	}
+	issue := func(n int64) *github.Issue {
+		t.Helper()
+		issue, err := gh.LookupIssueURL(fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issue
+	}
+
+	q := New(lg, db, gh, "approvals")
+	if (*Queue)(nil).Requires("test.Close") {
+		t.Errorf("nil Queue requires approval")
+	}
+	q.Require("test.Close")
+	if !q.Requires("test.Close") || q.Requires("test.Post") {
+		t.Errorf("Requires wrong")
+	}
+
+	propose := func(n int64) *Proposal {
+		t.Helper()
+		p := &Proposal{Kind: "test.Close", Actor: "tester", Reason: "why not", Comment: "bye", AddLabels: []string{"Done"}, State: "closed", IfLabel: "WaitingForInfo"}
+		if !q.Propose(issue(n), ordered.Encode("test.Close", n), p) {
+			t.Fatalf("Propose(#%d) = false", n)
+		}
+		return p
+	}
+	p1 := propose(1)
+	p2 := propose(2)
+	p3 := propose(3)
+	if q.Propose(issue(1), ordered.Encode("test.Close", int64(1)), &Proposal{}) {
+		t.Errorf("second Propose(#1) = true")
+	}
+	if p, ok := Lookup(db, p1.ID); !ok || p.Status != Pending || p.IssueState != "open" || p.Project != "rsc/tmp" || p.Issue != 1 {
+		t.Errorf("Lookup(%d) = %+v, %v", p1.ID, p, ok)
+	}
+
+	if err := q.Decide(p1.ID, true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Decide(p1.ID, false, "bob"); err == nil {
+		t.Errorf("second Decide succeeded")
+	}
+	if err := q.Decide(p2.ID, false, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Decide(p3.ID, true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Decide(12345, true, "alice"); err == nil {
+		t.Errorf("Decide of missing proposal succeeded")
+	}
+	// #3 closes before its closure is performed.
+	tc.AddIssue("rsc/tmp", &github.Issue{Number: 3, State: "closed"})
+	p4 := propose(4)
+
+	// Dry run performs nothing.
+	q.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("dry run edited: %v", edits)
+	}
+
+	q.EnableEdits()
+	q.now = func() time.Time { return time.Now().Add(DefaultExpiry + time.Hour) }
+	q.Run(ctx)
+	var have []string
+	for _, e := range tc.Edits() {
+		have = append(have, e.String())
+	}
+	want := []string{
+		`PostIssueComment(rsc/tmp#1, {"body":"bye"})`,
+		`EditIssue(rsc/tmp#1, {"state":"closed","labels":["WaitingForInfo","Done"]})`,
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("edits = %q, want %q", have, want)
+	}
+	tc.ClearEdits()
+	if a, ok := storage.LookupAction(db, p1.Key); !ok || !a.Done {
+		t.Errorf("action for #1 not done: %v, %v", a, ok)
+	}
+
+	for id, want := range map[int64]Status{p1.ID: Done, p2.ID: Rejected, p3.ID: Obsolete, p4.ID: Expired} {
+		if p, _ := Lookup(db, id); p.Status != want {
+			t.Errorf("proposal for #%d: status %s, want %s", p.Issue, p.Status, want)
+		}
+	}
+	if err := q.Decide(p4.ID, true, "alice"); err == nil {
+		t.Errorf("Decide of expired proposal succeeded")
+	}
+
+	// Each action is performed at most once.
+	q.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("second Run edited: %v", edits)
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	tc := gh.Testing()
+	tc.AddIssue("rsc/tmp", &github.Issue{Number: 1, State: "open"})
+	issue, err := gh.LookupIssueURL("https://github.com/rsc/tmp/issues/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := New(lg, db, gh, "approvals")
+	q.EnableEdits()
+	p := &Proposal{Kind: "test.Close", Actor: "tester", Comment: "bye", State: "closed"}
+	q.Propose(issue, ordered.Encode("test.Close", 1), p)
+	if err := q.Decide(p.ID, true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The comment is posted but the edit fails.
+	tc.FailEdit("EditIssue", fmt.Errorf("edit failed"))
+	q.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 1 || edits[0].String() != `PostIssueComment(rsc/tmp#1, {"body":"bye"})` {
+		t.Errorf("failed Run edits = %v, want comment only", edits)
+	}
+	tc.ClearEdits()
+	if p, _ := Lookup(db, p.ID); p.Status != Approved || p.Error != "edit failed" || p.Result == "" {
+		t.Errorf("after failed edit: status %s, error %q, result %q; want approved, edit failed, comment URL", p.Status, p.Error, p.Result)
+	}
+	if _, ok := storage.LookupAction(db, p.Key); ok {
+		t.Errorf("action begun after failed edit")
+	}
+
+	// The retry edits the issue without posting the comment again.
+	tc.FailEdit("EditIssue", nil)
+	q.Run(ctx)
+	var have []string
+	for _, e := range tc.Edits() {
+		have = append(have, e.String())
+	}
+	want := []string{`EditIssue(rsc/tmp#1, {"state":"closed"})`}
+	if !slices.Equal(have, want) {
+		t.Errorf("retry edits = %q, want %q", have, want)
+	}
+	if p, _ := Lookup(db, p.ID); p.Status != Done || p.Error != "" || p.Result == "" {
+		t.Errorf("after retry: status %s, error %q, result %q; want done, no error, comment URL", p.Status, p.Error, p.Result)
+	}
+	if a, ok := storage.LookupAction(db, p.Key); !ok || !a.Done {
+		t.Errorf("action not done after retry: %v, %v", a, ok)
+	}
+}
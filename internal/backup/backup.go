@@ -0,0 +1,318 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package backup makes periodic backups of Gaby's database
+// and restores them.
+//
+// A [Backer] takes a checkpoint of the database (a consistent copy
+// of the Pebble database files, made while the database is in use),
+// packs it into a gzipped tar file, and uploads the file
+// to a [Destination]: a local directory, a Google Cloud Storage bucket,
+// or an Amazon S3 (or S3-compatible) bucket (see [Open]).
+// After each backup, it deletes the old backups not kept by its [Retention].
+//
+// # Restoring a Backup
+//
+// To restore a backup, stop Gaby and run
+//
+//	gaby backup list
+//	gaby backup restore gaby-20240102T030405Z.tar.gz newdb
+//
+// to list the backups and unpack one into the new database directory newdb
+// (which must not exist). Then start Gaby with -db newdb,
+// or replace the old database directory with newdb.
+// [Restore] does the same from Go code.
+// A backup can also be unpacked by hand with "tar xzf",
+// producing a Pebble database directory named "db".
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+)
+
+// A Checkpointer is a database that can write a consistent copy of itself
+// to a new directory, such as the databases returned by
+// [rsc.io/gaby/internal/pebble.Open].
+type Checkpointer interface {
+	Checkpoint(dir string) error
+}
+
+// Backup file names have the form "gaby-20060102T150405Z.tar.gz",
+// using the UTC time of the backup.
+const (
+	namePrefix = "gaby-"
+	nameSuffix = ".tar.gz"
+	nameTime   = "20060102T150405Z"
+)
+
+// A Retention says which backups to keep.
+// After each backup, a [Backer] keeps the Recent newest backups
+// and the newest backup made on each of the last Daily days (in UTC),
+// deleting all others.
+type Retention struct {
+	Recent int
+	Daily  int
+}
+
+// DefaultRetention is the default retention policy.
+var DefaultRetention = Retention{Recent: 3, Daily: 14}
+
+// A Backer backs up a database.
+type Backer struct {
+	slog *slog.Logger
+	db   storage.DB
+	dest Destination
+	name string
+	keep Retention
+	now  func() time.Time // for testing
+}
+
+// New returns a new Backer that backs up db to dest,
+// logging to lg. The name is used only in log messages.
+// The database must implement [Checkpointer].
+func New(lg *slog.Logger, db storage.DB, dest Destination, name string) *Backer {
+	return &Backer{
+		slog: lg,
+		db:   db,
+		dest: dest,
+		name: name,
+		keep: DefaultRetention,
+		now:  time.Now,
+	}
+}
+
+// SetRetention sets the retention policy for old backups.
+// At least the newest backup is always kept.
+func (b *Backer) SetRetention(keep Retention) {
+	b.keep = keep
+}
+
+// Run makes a new backup and then deletes old backups.
+func (b *Backer) Run(ctx context.Context) error {
+	cp, ok := b.db.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("backup: database does not support checkpoints")
+	}
+	tmp, err := os.MkdirTemp("", "gaby-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "db")
+	if err := cp.Checkpoint(dir); err != nil {
+		return fmt.Errorf("backup: checkpoint: %w", err)
+	}
+	f, err := os.Create(filepath.Join(tmp, "backup"+nameSuffix))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := archive(f, dir); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	name := namePrefix + b.now().UTC().Format(nameTime) + nameSuffix
+	if err := b.dest.Put(ctx, name, f); err != nil {
+		return fmt.Errorf("backup: uploading %s: %w", name, err)
+	}
+	b.slog.Info("backup saved", "name", b.name, "backup", name, "size", size)
+	return b.prune(ctx)
+}
+
+// prune deletes the backups not kept by b.keep.
+func (b *Backer) prune(ctx context.Context) error {
+	list, err := List(ctx, b.dest)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, name := range expired(list, b.keep, b.now()) {
+		b.slog.Info("backup delete", "name", b.name, "backup", name)
+		if err := b.dest.Delete(ctx, name); err != nil {
+			errs = append(errs, fmt.Errorf("backup: deleting %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expired returns the backups in list (sorted oldest first)
+// not kept by the retention policy keep at time now.
+func expired(list []string, keep Retention, now time.Time) []string {
+	kept := make(map[string]bool)
+	newest := slices.Clone(list)
+	slices.Reverse(newest)
+	for _, name := range newest[:min(max(keep.Recent, 1), len(newest))] {
+		kept[name] = true
+	}
+	days := make(map[string]bool)
+	first := now.UTC().AddDate(0, 0, -keep.Daily).Format("20060102")
+	for _, name := range newest {
+		day := nameTimeOf(name)[:len("20060102")]
+		if day > first && !days[day] {
+			days[day] = true
+			kept[name] = true
+		}
+	}
+	var old []string
+	for _, name := range list {
+		if !kept[name] {
+			old = append(old, name)
+		}
+	}
+	return old
+}
+
+// nameTimeOf returns the time part of the backup name.
+func nameTimeOf(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix)
+}
+
+// isBackup reports whether name is a backup file name.
+func isBackup(name string) bool {
+	t := nameTimeOf(name)
+	if len(t) == len(name) {
+		return false
+	}
+	_, err := time.Parse(nameTime, t)
+	return err == nil
+}
+
+// List returns the names of the backups in dest, oldest first.
+func List(ctx context.Context, dest Destination) ([]string, error) {
+	all, err := dest.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backup: listing: %w", err)
+	}
+	var list []string
+	for _, name := range all {
+		if isBackup(name) {
+			list = append(list, name)
+		}
+	}
+	slices.Sort(list)
+	return list, nil
+}
+
+// Restore unpacks the named backup from dest into a new database
+// directory dir, which must not already exist.
+func Restore(ctx context.Context, dest Destination, name, dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("backup: restore: %s already exists", dir)
+	}
+	r, err := dest.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("backup: restore: %w", err)
+	}
+	defer r.Close()
+	if err := unarchive(r, dir); err != nil {
+		return fmt.Errorf("backup: restore %s: %w", name, err)
+	}
+	return nil
+}
+
+// archive writes to w a gzipped tar file holding the files in dir,
+// in a directory named "db".
+func archive(w io.Writer, dir string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    "db/" + filepath.ToSlash(rel),
+			Mode:    0o644,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// unarchive unpacks the gzipped tar file read from r,
+// as written by archive, into dir.
+func unarchive(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	if err := os.Mkdir(dir, 0o777); err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, ok := strings.CutPrefix(hdr.Name, "db/")
+		if !ok || hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(rel) {
+			return fmt.Errorf("unexpected file %q in backup", hdr.Name)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(file), 0o777); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
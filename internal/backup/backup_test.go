@@ -0,0 +1,111 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/pebble"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// TestBackupRestore checks the restore instructions in the package comment:
+// a backup restored into a new directory is a usable database.
+func TestBackupRestore(t *testing.T) {
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	tmp := t.TempDir()
+
+	db, err := pebble.Create(lg, filepath.Join(tmp, "db"))
+	check(err)
+	for i := range 100 {
+		db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i)))
+	}
+
+	dest := Dir(filepath.Join(tmp, "backups"))
+	b := New(lg, db, dest, "backup")
+	b.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	check(b.Run(ctx))
+
+	// The database is still usable after the backup,
+	// and later changes are not in the backup.
+	db.Set([]byte("key100"), []byte("100"))
+	db.Close()
+
+	list, err := List(ctx, dest)
+	check(err)
+	if want := []string{"gaby-20240102T030405Z.tar.gz"}; !slices.Equal(list, want) {
+		t.Fatalf("List = %q, want %q", list, want)
+	}
+
+	restored := filepath.Join(tmp, "restored")
+	check(Restore(ctx, dest, list[0], restored))
+	if err := Restore(ctx, dest, list[0], restored); err == nil {
+		t.Errorf("Restore into existing directory succeeded")
+	}
+	if err := Restore(ctx, dest, "gaby-missing.tar.gz", filepath.Join(tmp, "missing")); err == nil {
+		t.Errorf("Restore of missing backup succeeded")
+	}
+
+	db, err = pebble.Open(lg, restored)
+	check(err)
+	defer db.Close()
+	n := 0
+	for key, val := range db.Scan(nil, []byte("\xff")) {
+		if want := fmt.Sprintf("key%03d", n); string(key) != want || string(val()) != fmt.Sprint(n) {
+			t.Fatalf("restored entry %d = %q: %q, want %q: %q", n, key, val(), want, fmt.Sprint(n))
+		}
+		n++
+	}
+	if n != 100 {
+		t.Errorf("restored %d entries, want 100", n)
+	}
+}
+
+func TestNoCheckpoint(t *testing.T) {
+	b := New(testutil.Slogger(t), storage.MemDB(), Dir(t.TempDir()), "backup")
+	if err := b.Run(ctx); err == nil {
+		t.Errorf("Run with MemDB succeeded")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	db, err := pebble.Create(lg, filepath.Join(t.TempDir(), "db"))
+	check(err)
+	defer db.Close()
+
+	// Back up every 8 hours for 5 days.
+	dest := Dir(t.TempDir())
+	b := New(lg, db, dest, "backup")
+	b.SetRetention(Retention{Recent: 2, Daily: 3})
+	now := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+	for range 15 {
+		check(b.Run(ctx))
+		now = now.Add(8 * time.Hour)
+	}
+
+	list, err := List(ctx, dest)
+	check(err)
+	want := []string{
+		"gaby-20240103T170000Z.tar.gz", // newest of Jan 3
+		"gaby-20240104T170000Z.tar.gz", // newest of Jan 4
+		"gaby-20240105T090000Z.tar.gz", // 2 most recent
+		"gaby-20240105T170000Z.tar.gz", // newest of Jan 5
+	}
+	if !slices.Equal(list, want) {
+		t.Errorf("after backups, List = %q, want %q", list, want)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rsc.io/gaby/internal/secret"
+)
+
+// A Destination is a place to store backups.
+type Destination interface {
+	// Put stores the content read from r as the named file,
+	// replacing any existing file with that name.
+	Put(ctx context.Context, name string, r io.ReadSeeker) error
+
+	// Get returns the content of the named file.
+	// The caller must close the result.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// List returns the names of all the stored files.
+	List(ctx context.Context) ([]string, error)
+
+	// Delete deletes the named file.
+	Delete(ctx context.Context, name string) error
+}
+
+// Open returns the destination described by the URL dest,
+// which has one of the forms:
+//
+//   - "file:///path/to/dir" or just "/path/to/dir", for a local directory
+//     (see [Dir]), usually on a different disk from the database;
+//   - "gs://bucket/prefix", for a Google Cloud Storage bucket (see [GCS]); or
+//   - "s3://bucket/prefix?region=us-east-1", for an Amazon S3 bucket,
+//     with an optional endpoint=https://host parameter for an
+//     S3-compatible service (see [S3]).
+//
+// The prefix is prepended to the names of the backup files;
+// it may be empty.
+// S3 credentials are read from sdb, in the secret named by the host
+// of the S3 endpoint (by default "s3.<region>.amazonaws.com"),
+// which must have the form "accesskey:secretkey".
+// S3 requests are made using hc.
+func Open(ctx context.Context, dest string, sdb secret.DB, hc *http.Client) (Destination, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("backup: invalid destination: %w", err)
+	}
+	switch u.Scheme {
+	case "":
+		return Dir(dest), nil
+	case "file":
+		return Dir(filepath.FromSlash(u.Path)), nil
+	case "gs":
+		return GCS(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "s3":
+		q := u.Query()
+		region := q.Get("region")
+		if region == "" {
+			return nil, fmt.Errorf("backup: destination %s: missing region", dest)
+		}
+		endpoint := q.Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		e, err := url.Parse(endpoint)
+		if err != nil || e.Host == "" {
+			return nil, fmt.Errorf("backup: destination %s: invalid endpoint %q", dest, endpoint)
+		}
+		auth, ok := sdb.Get(e.Host)
+		key, secretKey, _ := strings.Cut(auth, ":")
+		if !ok || key == "" || secretKey == "" {
+			return nil, fmt.Errorf("backup: no secret for %s", e.Host)
+		}
+		return S3(hc, endpoint, region, u.Host, strings.TrimPrefix(u.Path, "/"), key, secretKey), nil
+	}
+	return nil, fmt.Errorf("backup: destination %s: unknown scheme %q", dest, u.Scheme)
+}
+
+// Dir returns a destination storing backups in the local directory dir,
+// which is created if needed.
+func Dir(dir string) Destination {
+	return localDir(dir)
+}
+
+type localDir string
+
+func (d localDir) Put(ctx context.Context, name string, r io.ReadSeeker) error {
+	if err := os.MkdirAll(string(d), 0o777); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename,
+	// so that a partial backup never appears under the final name.
+	f, err := os.CreateTemp(string(d), "tmp-"+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(string(d), name))
+}
+
+func (d localDir) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+func (d localDir) List(ctx context.Context) ([]string, error) {
+	files, err := os.ReadDir(string(d))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []string
+	for _, f := range files {
+		if f.Type().IsRegular() {
+			list = append(list, f.Name())
+		}
+	}
+	return list, nil
+}
+
+func (d localDir) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
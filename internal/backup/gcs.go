@@ -0,0 +1,61 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"google.golang.org/api/option"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// GCS returns a destination storing backups in the Google Cloud Storage bucket,
+// with names beginning with prefix.
+// It authenticates using the Google Cloud application default credentials.
+// Additional options, such as [option.WithCredentialsFile],
+// are passed to the Cloud Storage client.
+func GCS(ctx context.Context, bucket, prefix string, opts ...option.ClientOption) (Destination, error) {
+	svc, err := gcs.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsDest{svc: svc, bucket: bucket, prefix: prefix}, nil
+}
+
+type gcsDest struct {
+	svc    *gcs.Service
+	bucket string
+	prefix string
+}
+
+func (d *gcsDest) Put(ctx context.Context, name string, r io.ReadSeeker) error {
+	_, err := d.svc.Objects.Insert(d.bucket, &gcs.Object{Name: d.prefix + name}).Media(r).Context(ctx).Do()
+	return err
+}
+
+func (d *gcsDest) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := d.svc.Objects.Get(d.bucket, d.prefix+name).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *gcsDest) List(ctx context.Context) ([]string, error) {
+	var list []string
+	err := d.svc.Objects.List(d.bucket).Prefix(d.prefix).Pages(ctx, func(objs *gcs.Objects) error {
+		for _, obj := range objs.Items {
+			list = append(list, strings.TrimPrefix(obj.Name, d.prefix))
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (d *gcsDest) Delete(ctx context.Context, name string) error {
+	return d.svc.Objects.Delete(d.bucket, d.prefix+name).Context(ctx).Do()
+}
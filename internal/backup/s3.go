@@ -0,0 +1,250 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// S3 returns a destination storing backups in the Amazon S3 bucket
+// in the given region, with names beginning with prefix,
+// making requests to the S3 endpoint (such as "https://s3.us-east-1.amazonaws.com")
+// using hc and the given access key and secret key.
+// Requests address the bucket as a path on the endpoint,
+// which S3-compatible services also accept.
+// Backups are uploaded with single PUT requests,
+// so they are limited to 5 GB.
+func S3(hc *http.Client, endpoint, region, bucket, prefix, key, secretKey string) Destination {
+	return &s3Dest{
+		http:     hc,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		region:   region,
+		bucket:   bucket,
+		prefix:   prefix,
+		key:      key,
+		secret:   secretKey,
+		now:      time.Now,
+	}
+}
+
+type s3Dest struct {
+	http     *http.Client
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+	key      string
+	secret   string
+	now      func() time.Time // for testing
+}
+
+func (d *s3Dest) Put(ctx context.Context, name string, r io.ReadSeeker) error {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", d.objectURL(name), io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := d.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *s3Dest) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// listResult is the S3 XML response to ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (d *s3Dest) List(ctx context.Context) ([]string, error) {
+	var list []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {d.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", d.endpoint+"/"+d.bucket+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding S3 list: %w", err)
+		}
+		for _, c := range res.Contents {
+			list = append(list, strings.TrimPrefix(c.Key, d.prefix))
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return list, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (d *s3Dest) Delete(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", d.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// objectURL returns the URL for the named backup.
+func (d *s3Dest) objectURL(name string) string {
+	return d.endpoint + "/" + d.bucket + "/" + uriEncode(d.prefix+name, false)
+}
+
+// do signs and sends req, whose body has the given SHA-256 hash (in hex),
+// returning an error for any non-2xx response.
+func (d *s3Dest) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", d.now().UTC().Format(amzTime))
+	req.Header.Set("Authorization", sign(req, d.region, d.key, d.secret))
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s\n%s", req.Method, req.URL.Path, resp.Status, data)
+	}
+	return resp, nil
+}
+
+const (
+	amzTime     = "20060102T150405Z"
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sign returns the AWS Signature Version 4 Authorization header for req,
+// which must already have its X-Amz-Date and X-Amz-Content-Sha256 headers.
+// All of req's headers, along with Host, are signed.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func sign(req *http.Request, region, key, secret string) string {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := slices.Sorted(func(yield func(string) bool) {
+		for k := range headers {
+			if k != "authorization" && !yield(k) {
+				return
+			}
+		}
+	})
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", k, headers[k])
+	}
+	signed := strings.Join(names, ";")
+
+	var query []string
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			query = append(query, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	slices.Sort(query)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canon := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(query, "&"),
+		canonHeaders.String(),
+		signed,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+
+	date := headers["x-amz-date"]
+	day := date[:len("20060102")]
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canon))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	return "AWS4-HMAC-SHA256 Credential=" + key + "/" + scope + ",SignedHeaders=" + signed + ",Signature=" + sig
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes s as required by AWS signatures:
+// all bytes except unreserved characters are percent-encoded,
+// and slashes are also encoded if encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,394 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package commands implements commands that people can issue
+// to Gaby in GitHub issue comments.
+//
+// A command is a line in a comment that mentions the bot and names the command,
+// followed by optional arguments, as in:
+//
+//	@gabyhelp related
+//	@gabyhelp label compiler NeedsInvestigation
+//	@gabyhelp summarize
+//
+// A [Dispatcher] watches for new comments containing commands
+// and runs them using the functions registered with [Dispatcher.Register],
+// which typically call into the existing subsystems (see [Related],
+// [Summarize], [Label], [Approve], and [Reject]).
+// Each command is run at most once, and only if the comment's author is
+// allowed to issue that command in that project (see [Dispatcher.Allow]).
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/related"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/gaby/internal/summary"
+	"rsc.io/ordered"
+)
+
+// This package uses the [storage.BeginAction] key
+// ["commands.Run", Project, CommentID, Line],
+// where Line is the 1-based line number of the command in the comment.
+
+// A Func runs a command with the given arguments on the issue.
+type Func func(issue *github.Issue, args []string) error
+
+// A Dispatcher runs commands found in issue comments.
+type Dispatcher struct {
+	slog      *slog.Logger
+	db        storage.DB
+	github    *github.Client
+	projects  map[string]bool
+	watcher   *timed.Watcher[*github.Event]
+	name      string
+	bot       string
+	cmds      map[string]Func
+	allow     map[string]map[string]map[string]bool // project → command → user
+	timeLimit time.Time
+	footer    *footer.Footer
+	run       bool
+}
+
+// New creates and returns a new Dispatcher. It logs to lg, stores state in db,
+// and watches for new GitHub comments using gh.
+// Commands must be addressed to the GitHub user bot (for example "gabyhelp"),
+// as in "@gabyhelp related".
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Dispatcher] methods to configure the commands
+// (especially [Dispatcher.Register], [Dispatcher.Allow], [Dispatcher.EnableProject],
+// and [Dispatcher.EnableCommands]) before calling [Dispatcher.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, bot, name string) *Dispatcher {
+	return &Dispatcher{
+		slog:      lg,
+		db:        db,
+		github:    gh,
+		projects:  make(map[string]bool),
+		watcher:   gh.EventWatcher("commands.Dispatcher:" + name),
+		name:      name,
+		bot:       bot,
+		cmds:      make(map[string]Func),
+		allow:     make(map[string]map[string]map[string]bool),
+		timeLimit: time.Now().Add(-defaultTooOld),
+		footer:    footer.Default(),
+	}
+}
+
+const defaultTooOld = 48 * time.Hour
+
+// EnableProject enables the Dispatcher to run commands in the given GitHub project
+// (for example "golang/go").
+// See also [Dispatcher.EnableCommands], which must also be called to run anything.
+func (d *Dispatcher) EnableProject(project string) {
+	d.projects[project] = true
+}
+
+// EnableCommands enables the Dispatcher to run commands
+// and to reply to GitHub when they fail.
+// If EnableCommands has not been called, [Dispatcher.Run] logs
+// the commands it would run but does not run them.
+func (d *Dispatcher) EnableCommands() {
+	d.run = true
+}
+
+// Register registers f to run the command with the given name.
+func (d *Dispatcher) Register(name string, f Func) {
+	d.cmds[name] = f
+}
+
+// Allow allows the named users to issue the command in the project.
+// If command is "*", the users may issue any command.
+// Commands from other users are ignored.
+func (d *Dispatcher) Allow(project, command string, users ...string) {
+	byCmd := d.allow[project]
+	if byCmd == nil {
+		byCmd = make(map[string]map[string]bool)
+		d.allow[project] = byCmd
+	}
+	if byCmd[command] == nil {
+		byCmd[command] = make(map[string]bool)
+	}
+	for _, u := range users {
+		byCmd[command][u] = true
+	}
+}
+
+// allowed reports whether user may issue the command in project.
+func (d *Dispatcher) allowed(project, command, user string) bool {
+	return d.allow[project][command][user] || d.allow[project]["*"][user]
+}
+
+// SetTimeLimit controls how old a comment can be for the Dispatcher to consider it.
+// Comments created before time t are ignored.
+// The default is to ignore comments that are more than 48 hours old
+// at the time of the call to [New].
+func (d *Dispatcher) SetTimeLimit(t time.Time) {
+	d.timeLimit = t
+}
+
+// SetFooter sets the footer appended to each reply.
+// The default is [footer.Default].
+func (d *Dispatcher) SetFooter(f *footer.Footer) {
+	d.footer = f
+}
+
+// A command is a single command parsed from a comment.
+type command struct {
+	line int      // 1-based line number in comment
+	name string   // command name
+	args []string // command arguments
+}
+
+// parse returns the commands addressed to bot in the comment body.
+// Lines in code blocks and quotations are ignored.
+func parse(body, bot string) []command {
+	var cmds []command
+	prefix := "@" + bot
+	inCode := false
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode || strings.HasPrefix(line, ">") {
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, prefix)
+		if !ok || rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+			continue
+		}
+		f := strings.Fields(rest)
+		if len(f) == 0 {
+			continue
+		}
+		cmds = append(cmds, command{line: i + 1, name: f[0], args: f[1:]})
+	}
+	return cmds
+}
+
+// Run runs a single round of commands.
+// It scans the comments in the enabled projects that have been posted
+// since the last call to [Dispatcher.Run] using a Dispatcher with the same name
+// (see [New]), ignoring comments older than the time limit
+// (see [Dispatcher.SetTimeLimit]) and the bot's own comments.
+// For each command in each comment, if the comment's author is allowed
+// to issue the command (see [Dispatcher.Allow]) and the command has been
+// registered (see [Dispatcher.Register]), Run runs the command, at most once.
+// If a command fails, or a permitted user issues an unknown command,
+// Run replies with a comment explaining the problem.
+//
+// Run logs each command to the [slog.Logger] passed to [New].
+// If [Dispatcher.EnableCommands] has been called, then Run also runs the commands
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+// When [Dispatcher.EnableCommands] has not been called, Run only logs the commands it would run.
+//
+// If ctx is canceled, Run stops before the next comment,
+// leaving the remaining comments for a future call.
+func (d *Dispatcher) Run(ctx context.Context) {
+	d.slog.Info("commands.Dispatcher start", "name", d.name)
+	defer d.slog.Info("commands.Dispatcher end", "name", d.name)
+
+	defer d.watcher.Flush()
+
+	for e := range d.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !d.projects[e.Project] || e.API != "/issues/comments" {
+			continue
+		}
+		c := e.Typed.(*github.IssueComment)
+		tm, err := time.Parse(time.RFC3339, c.CreatedAt)
+		if err != nil {
+			d.slog.Error("commands parse createdat", "CreatedAt", c.CreatedAt, "err", err)
+			continue
+		}
+		if tm.Before(d.timeLimit) || c.User.Login == d.bot {
+			continue
+		}
+		cmds := parse(c.Body, d.bot)
+		if len(cmds) == 0 {
+			continue
+		}
+		issue, err := d.github.LookupIssue(e.Project, e.Issue)
+		if err != nil {
+			d.slog.Error("commands.Dispatcher lookup", "project", e.Project, "issue", e.Issue, "err", err)
+			continue
+		}
+		for _, cmd := range cmds {
+			d.dispatch(issue, c, cmd)
+		}
+		if d.run {
+			d.watcher.MarkOld(e.DBTime)
+			d.watcher.Flush()
+			d.db.Flush()
+		}
+	}
+}
+
+// dispatch runs the command cmd from comment c on issue.
+func (d *Dispatcher) dispatch(issue *github.Issue, c *github.IssueComment, cmd command) {
+	project := issue.Project()
+	user := c.User.Login
+	if !d.allowed(project, cmd.name, user) {
+		d.slog.Info("commands.Dispatcher not allowed", "name", d.name, "project", project, "issue", issue.Number, "user", user, "command", cmd.name)
+		return
+	}
+	d.slog.Info("commands.Dispatcher run", "name", d.name, "project", project, "issue", issue.Number, "user", user, "command", cmd.name, "args", cmd.args)
+	if !d.run {
+		return
+	}
+	action := ordered.Encode("commands.Run", project, c.CommentID(), cmd.line)
+	if !storage.BeginAction(d.db, action) {
+		return
+	}
+	var err error
+	if f := d.cmds[cmd.name]; f == nil {
+		err = fmt.Errorf("unknown command %q (known commands: %s)", cmd.name, strings.Join(d.known(), ", "))
+	} else {
+		err = f(issue, cmd.args)
+	}
+	if err == nil {
+		storage.FinishAction(d.db, action, nil)
+		return
+	}
+	// Record the failure rather than retrying:
+	// a command that failed once will probably fail again.
+	d.slog.Error("commands.Dispatcher failed", "name", d.name, "project", project, "issue", issue.Number, "command", cmd.name, "err", err)
+	storage.FinishAction(d.db, action, err.Error())
+	body := fmt.Sprintf("@%s, sorry, I could not run `%s`: %v\n%s", user, cmd.name, err, d.footer.Render("commands", project))
+	if _, err := d.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body}); err != nil {
+		d.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+	}
+}
+
+// known returns the sorted names of the registered commands.
+func (d *Dispatcher) known() []string {
+	var names []string
+	for name := range d.cmds {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Related returns a command that posts documents related to the issue
+// using p (see [related.Poster.PostIssue]). It takes no arguments.
+func Related(p *related.Poster) Func {
+	return func(issue *github.Issue, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("usage: related")
+		}
+		return p.PostIssue(issue)
+	}
+}
+
+// Summarize returns a command that posts a summary of the issue's discussion
+// using s (see [summary.Summarizer.Post]). It takes no arguments.
+func Summarize(s *summary.Summarizer) Func {
+	return func(issue *github.Issue, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("usage: summarize")
+		}
+		return s.Post(issue)
+	}
+}
+
+// Label returns a command that changes the issue's labels using gh.
+// Its arguments are label names to add, or, when prefixed with "-", to remove.
+// Label names containing spaces cannot be used.
+func Label(gh *github.Client) Func {
+	return func(issue *github.Issue, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("usage: label [-]name...")
+		}
+		live, err := gh.DownloadIssue(issue.URL)
+		if err != nil {
+			return err
+		}
+		var labels []string
+		for _, l := range live.Labels {
+			labels = append(labels, l.Name)
+		}
+		old := slices.Clone(labels)
+		for _, arg := range args {
+			if name, ok := strings.CutPrefix(arg, "-"); ok {
+				labels = slices.DeleteFunc(labels, func(l string) bool { return l == name })
+			} else if !slices.Contains(labels, arg) {
+				labels = append(labels, arg)
+			}
+		}
+		if slices.Equal(labels, old) {
+			return nil
+		}
+		if labels == nil {
+			labels = []string{}
+		}
+		return gh.EditIssue(live, &github.IssueChanges{Labels: &labels})
+	}
+}
+
+// Approve returns a command that approves pending proposals on the issue
+// in the approval queue q, which stores its proposals in db
+// (see [approval.Queue.Decide]).
+// Its arguments are the IDs of the proposals to approve;
+// with no arguments, it approves all the issue's pending proposals.
+func Approve(db storage.DB, q *approval.Queue) Func {
+	return decide(db, q, true)
+}
+
+// Reject returns a command that rejects pending proposals on the issue,
+// with arguments like those of [Approve].
+func Reject(db storage.DB, q *approval.Queue) Func {
+	return decide(db, q, false)
+}
+
+// decide returns the command implementing [Approve] or [Reject].
+func decide(db storage.DB, q *approval.Queue, approve bool) Func {
+	return func(issue *github.Issue, args []string) error {
+		ids := make(map[int64]bool)
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid proposal ID %q", arg)
+			}
+			ids[id] = true
+		}
+		n := 0
+		for p := range approval.Proposals(db) {
+			if p.Project != issue.Project() || p.Issue != issue.Number || p.Status != approval.Pending {
+				continue
+			}
+			if len(ids) > 0 && !ids[p.ID] {
+				continue
+			}
+			if err := q.Decide(p.ID, approve, "GitHub comment"); err != nil {
+				return err
+			}
+			delete(ids, p.ID)
+			n++
+		}
+		for id := range ids {
+			return fmt.Errorf("no pending proposal %d on this issue", id)
+		}
+		if n == 0 {
+			return fmt.Errorf("no pending proposals on this issue")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
+)
+
+var ctx = context.Background()
+
+var parseTests = []struct {
+	body string
+	cmds []command
+}{
+	{"no commands here", nil},
+	{"@gabyhelp related", []command{{1, "related", []string{}}}},
+	{"Hi.\n  @gabyhelp   label  compiler -NeedsFix \n", []command{{2, "label", []string{"compiler", "-NeedsFix"}}}},
+	{"@gabyhelp\n@gabyhelpful related\nsee @gabyhelp related", nil},
+	{"> @gabyhelp related\n```\n@gabyhelp summarize\n```\n@gabyhelp summarize", []command{{5, "summarize", []string{}}}},
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range parseTests {
+		cmds := parse(tt.body, "gabyhelp")
+		if !reflect.DeepEqual(cmds, tt.cmds) {
+			t.Errorf("parse(%q) = %v, want %v", tt.body, cmds, tt.cmds)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	tc := gh.Testing()
+	tc.AddIssue("rsc/tmp", &github.Issue{Number: 1, Title: "bug", State: "open"})
+	comment := func(user, body string) {
+		tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+			User:      github.User{Login: user},
+			CreatedAt: "2024-06-01T10:00:00Z",
+			Body:      body,
+		})
+	}
+	comment("alice", "@gabyhelp ping 1\n@gabyhelp ping 2 3")
+	comment("bob", "@gabyhelp ping 4")      // not allowed to ping
+	comment("bob", "@gabyhelp fail")        // allowed to fail
+	comment("carol", "@gabyhelp unknown")   // allowed to do anything
+	comment("gabyhelp", "@gabyhelp ping 5") // own comment
+	tc.AddIssue("rsc/other", &github.Issue{Number: 1, Title: "bug", State: "open"})
+	tc.AddIssueComment("rsc/other", 1, &github.IssueComment{
+		User:      github.User{Login: "alice"},
+		CreatedAt: "2024-06-01T10:00:00Z",
+		Body:      "@gabyhelp ping 6",
+	})
+
+	var pings []string
+	d := New(lg, db, gh, "gabyhelp", "test")
+	d.EnableProject("rsc/tmp")
+	d.SetTimeLimit(time.Time{})
+	d.Register("ping", func(issue *github.Issue, args []string) error {
+		pings = append(pings, fmt.Sprintf("%s#%d %v", issue.Project(), issue.Number, args))
+		return nil
+	})
+	d.Register("fail", func(issue *github.Issue, args []string) error {
+		return errors.New("it failed")
+	})
+	d.Allow("rsc/tmp", "ping", "alice")
+	d.Allow("rsc/tmp", "fail", "bob")
+	d.Allow("rsc/tmp", "*", "carol")
+	d.Allow("rsc/other", "*", "alice")
+
+	d.Run(ctx)
+	if len(pings) != 0 || len(tc.Edits()) != 0 {
+		t.Fatalf("dry run ran commands: %v, %v", pings, tc.Edits())
+	}
+
+	d.EnableCommands()
+	d.Run(ctx)
+	if want := []string{"rsc/tmp#1 [1]", "rsc/tmp#1 [2 3]"}; !slices.Equal(pings, want) {
+		t.Errorf("pings = %v, want %v", pings, want)
+	}
+	var replies []string
+	for _, e := range tc.Edits() {
+		replies = append(replies, e.IssueCommentChanges.Body)
+	}
+	foot := footer.Default().Render("commands", "rsc/tmp")
+	want := []string{
+		"@bob, sorry, I could not run `fail`: it failed\n" + foot,
+		"@carol, sorry, I could not run `unknown`: unknown command \"unknown\" (known commands: fail, ping)\n" + foot,
+	}
+	if !slices.Equal(replies, want) {
+		t.Errorf("replies:\n%s\nwant:\n%s", strings.Join(replies, "\n"), strings.Join(want, "\n"))
+	}
+	tc.ClearEdits()
+
+	// Commands run at most once, even for a new Dispatcher.
+	pings = nil
+	d.Run(ctx)
+	d2 := New(lg, db, gh, "gabyhelp", "test2")
+	d2.EnableProject("rsc/tmp")
+	d2.SetTimeLimit(time.Time{})
+	d2.Allow("rsc/tmp", "*", "alice", "carol")
+	d2.EnableCommands()
+	d2.Run(ctx)
+	if len(pings) != 0 || len(tc.Edits()) != 0 {
+		t.Errorf("reran commands: %v, %v", pings, tc.Edits())
+	}
+}
+
+func TestLabel(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number: 1,
+		Labels: []github.Label{{Name: "NeedsInvestigation"}, {Name: "compiler"}},
+	})
+	issue, err := gh.LookupIssueURL("https://github.com/rsc/tmp/issues/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := Label(gh)
+	if err := label(issue, nil); err == nil {
+		t.Errorf("label with no arguments succeeded")
+	}
+	if err := label(issue, []string{"compiler"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := label(issue, []string{"-NeedsInvestigation", "NeedsFix", "runtime"}); err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, e := range gh.Testing().Edits() {
+		have = append(have, e.String())
+	}
+	want := []string{`EditIssue(rsc/tmp#1, {"labels":["compiler","NeedsFix","runtime"]})`}
+	if !slices.Equal(have, want) {
+		t.Errorf("edits = %q, want %q", have, want)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	for n := range int64(2) {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{Number: n + 1, State: "open"})
+	}
+	issue := func(n int64) *github.Issue {
+		t.Helper()
+		issue, err := gh.LookupIssueURL(fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issue
+	}
+	q := approval.New(lg, db, gh, "approvals")
+	var ids []int64
+	for i, kind := range []string{"test.Close", "test.Post", "test.Close"} {
+		n := int64(1 + i/2)
+		p := &approval.Proposal{Kind: kind}
+		q.Propose(issue(n), ordered.Encode(kind, n), p)
+		ids = append(ids, p.ID)
+	}
+
+	approve, reject := Approve(db, q), Reject(db, q)
+	if err := approve(issue(1), []string{fmt.Sprint(ids[2])}); err == nil {
+		t.Errorf("approve of proposal on other issue succeeded")
+	}
+	if err := reject(issue(1), []string{fmt.Sprint(ids[1])}); err != nil {
+		t.Fatal(err)
+	}
+	if err := approve(issue(1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := approve(issue(1), nil); err == nil {
+		t.Errorf("approve with nothing pending succeeded")
+	}
+	for i, want := range []approval.Status{approval.Approved, approval.Rejected, approval.Pending} {
+		if p, _ := approval.Lookup(db, ids[i]); p.Status != want {
+			t.Errorf("proposal %d: status %s, want %s", i, p.Status, want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// A Config is a data-driven Fixer configuration,
+// listing rewrite rules for each project.
+// It is usually written as JSON, for example:
+//
+//	{
+//		"Projects": [
+//			{
+//				"Project": "golang/go",
+//				"Rules": [
+//					{"Kind": "AutoLink", "Pattern": "\\bCL ([0-9]+)\\b", "Repl": "https://go.dev/cl/$1"},
+//					{"Kind": "ReplaceText", "Pattern": "cancelled", "Repl": "canceled"}
+//				]
+//			},
+//			{"Project": "golang/tools"}
+//		],
+//		"Rules": [
+//			{"Kind": "ReplaceWordsFile", "File": "spelling.txt"},
+//			{"Kind": "ExpandPlayLinks", "Projects": ["golang/go"], "DryRun": true}
+//		]
+//	}
+type Config struct {
+	Projects []ProjectConfig
+
+	// Rules lists rules shared by the projects:
+	// each rule applies to the projects it lists in its Projects field,
+	// or, if that is empty, to every project in Projects,
+	// after the project's own rules.
+	Rules []Rule `json:",omitempty"`
+}
+
+// A ProjectConfig lists the rules for a single project.
+type ProjectConfig struct {
+	Project string // GitHub project ("golang/go")
+	Rules   []Rule
+}
+
+// A Rule is a single rewrite rule in a [Config].
+// The Kind names the [Fixer] method that adds the rule:
+// "AutoLink", "ReplaceText", "ReplaceURL", and "ReplaceTitle" use Pattern and Repl;
+// "ReplaceWords" uses Words; "ReplaceWordsFile" uses File;
+// and "ExpandPlayLinks" downloads programs using the Fixer's
+// HTTP client (see [Fixer.SetHTTPClient]).
+type Rule struct {
+	Kind     string
+	Pattern  string            // regular expression pattern
+	Repl     string            // replacement URL or text
+	Words    map[string]string `json:",omitempty"` // word table
+	File     string            `json:",omitempty"` // word table file
+	Projects []string          `json:",omitempty"` // projects the rule applies to (see [Projects]); only in [Config.Rules]
+	DryRun   bool              // only report what the rule would do (see [DryRun])
+}
+
+// ParseConfig parses the JSON form of a [Config].
+func ParseConfig(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("commentfix config: %v", err)
+	}
+	return &cfg, nil
+}
+
+// Validate reports whether cfg is a valid configuration,
+// returning an error describing the first problem found, if any.
+func (cfg *Config) Validate() error {
+	_, err := cfg.compile(new(Fixer))
+	return err
+}
+
+// compile returns the compiled rules in cfg, by project,
+// for use by the Fixer f.
+func (cfg *Config) compile(f *Fixer) (map[string][]*rule, error) {
+	rules := make(map[string][]*rule)
+	for _, p := range cfg.Projects {
+		if p.Project == "" {
+			return nil, fmt.Errorf("commentfix config: missing project name")
+		}
+		if _, ok := rules[p.Project]; ok {
+			return nil, fmt.Errorf("commentfix config: duplicate project %s", p.Project)
+		}
+		list := []*rule{}
+		for _, r := range p.Rules {
+			if len(r.Projects) > 0 {
+				return nil, fmt.Errorf("commentfix config: %s: %s: Projects only allowed in shared Rules", p.Project, r.Kind)
+			}
+			cr, err := f.configRule(&r)
+			if err != nil {
+				return nil, fmt.Errorf("commentfix config: %s: %v", p.Project, err)
+			}
+			list = append(list, cr)
+		}
+		rules[p.Project] = list
+	}
+	for _, r := range cfg.Rules {
+		cr, err := f.configRule(&r)
+		if err != nil {
+			return nil, fmt.Errorf("commentfix config: %v", err)
+		}
+		for _, name := range r.Projects {
+			if _, ok := rules[name]; !ok {
+				return nil, fmt.Errorf("commentfix config: %s: unknown project %s", r.Kind, name)
+			}
+		}
+		for _, p := range cfg.Projects {
+			if len(r.Projects) == 0 || slices.Contains(r.Projects, p.Project) {
+				rules[p.Project] = append(rules[p.Project], cr)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// configRule returns the compiled form of the [Config] rule r.
+func (f *Fixer) configRule(r *Rule) (*rule, error) {
+	var cr *rule
+	var err error
+	switch r.Kind {
+	default:
+		return nil, fmt.Errorf("unknown rule kind %q", r.Kind)
+	case "AutoLink", "ReplaceText", "ReplaceURL", "ReplaceWords":
+		var fix func(any, int) any
+		switch r.Kind {
+		case "AutoLink":
+			fix, err = autoLink(r.Pattern, r.Repl)
+		case "ReplaceText":
+			fix, err = replaceText(r.Pattern, r.Repl)
+		case "ReplaceURL":
+			fix, err = replaceURL(r.Pattern, r.Repl)
+		case "ReplaceWords":
+			fix, err = replaceWords(r.Words)
+		}
+		cr = &rule{fix: fix}
+	case "ReplaceWordsFile":
+		var table map[string]string
+		if table, err = readWords(r.File); err == nil {
+			var fix func(any, int) any
+			fix, err = replaceWords(table)
+			cr = &rule{fix: fix}
+		}
+	case "ReplaceTitle":
+		var title func(string) string
+		title, err = replaceTitle(r.Pattern, r.Repl)
+		cr = &rule{title: title}
+	case "ExpandPlayLinks":
+		cr = f.expandPlayRule(f.httpClient())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.Kind, err)
+	}
+	cr.dryRun = r.DryRun
+	return cr, nil
+}
+
+// SetConfig replaces the Fixer's configuration with cfg.
+// The rules in cfg apply to their projects in addition to
+// any rules added with methods like [Fixer.AutoLink] and [Fixer.ReplaceText],
+// and each project listed in cfg is enabled as if by [Fixer.EnableProject].
+// If cfg contains an invalid rule, SetConfig returns an error
+// and leaves the previous configuration in place.
+func (f *Fixer) SetConfig(cfg *Config) error {
+	f.init()
+	rules, err := cfg.compile(f)
+	if err != nil {
+		return err
+	}
+	f.configRules = rules
+	return nil
+}
+
+// SetConfigFile configures the Fixer to read its configuration
+// from the named file, which holds the JSON form of a [Config].
+// SetConfigFile loads the file immediately, returning any error,
+// and then [Fixer.Run] reloads the file whenever it changes,
+// so that rules can be added or changed without restarting the program.
+// If a reload fails, Run logs the error and keeps using
+// the previous configuration.
+func (f *Fixer) SetConfigFile(file string) error {
+	f.init()
+	f.configFile = file
+	f.configData = nil
+	return f.loadConfigFile()
+}
+
+// loadConfigFile reloads f.configFile if its content has changed.
+func (f *Fixer) loadConfigFile() error {
+	if f.configFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.configFile)
+	if err != nil {
+		return err
+	}
+	if f.configData != nil && bytes.Equal(data, f.configData) {
+		return nil
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.configFile, err)
+	}
+	if err := f.SetConfig(cfg); err != nil {
+		return fmt.Errorf("%s: %v", f.configFile, err)
+	}
+	f.configData = data
+	f.slog.Info("commentfix config loaded", "file", f.configFile, "projects", len(cfg.Projects))
+	return nil
+}
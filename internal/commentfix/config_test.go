@@ -0,0 +1,158 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestConfigErrors(t *testing.T) {
+	bad := []struct {
+		cfg string
+		err string
+	}{
+		{`{"Projects": [{"Project": "a/b", "Rules": [{"Kind": "AutoLink", "Pattern": "\\"}]}]}`, "AutoLink: error parsing regexp"},
+		{`{"Projects": [{"Project": "a/b", "Rules": [{"Kind": "Spell"}]}]}`, `unknown rule kind "Spell"`},
+		{`{"Projects": [{"Rules": []}]}`, "missing project name"},
+		{`{"Projects": [{"Project": "a/b"}, {"Project": "a/b"}]}`, "duplicate project a/b"},
+		{`{"Project": "a/b"}`, `unknown field "Project"`},
+		{`{"Projects": [{"Project": "a/b", "Rules": [{"Kind": "ReplaceTitle", "Pattern": "("}]}]}`, "ReplaceTitle: error parsing regexp"},
+		{`{"Projects": [{"Project": "a/b", "Rules": [{"Kind": "ReplaceWords"}]}]}`, "ReplaceWords: "},
+		{`{"Projects": [{"Project": "a/b"}], "Rules": [{"Kind": "ReplaceWordsFile", "File": "/nonexistent/words.txt"}]}`, "ReplaceWordsFile: "},
+		{`{"Projects": [{"Project": "a/b"}], "Rules": [{"Kind": "ExpandPlayLinks", "Projects": ["c/d"]}]}`, "ExpandPlayLinks: unknown project c/d"},
+		{`{"Projects": [{"Project": "a/b", "Rules": [{"Kind": "ExpandPlayLinks", "Projects": ["a/b"]}]}]}`, "Projects only allowed in shared Rules"},
+	}
+	for _, tt := range bad {
+		var f Fixer
+		cfg, err := ParseConfig([]byte(tt.cfg))
+		if err == nil {
+			err = f.SetConfig(cfg)
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("config %s: err = %v, want %q", tt.cfg, err, tt.err)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for _, project := range []string{"rsc/tmp", "rsc/other"} {
+		gh.Testing().AddIssue(project, &github.Issue{
+			Number:    1,
+			Title:     "spelling",
+			Body:      "Contexts are cancelled; see CL 123.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "fix.json")
+	write := func(cfg string) {
+		testutil.Check(t, os.WriteFile(file, []byte(cfg), 0666))
+	}
+	write(`{"Projects": [{"Project": "rsc/tmp", "Rules": [{"Kind": "ReplaceText", "Pattern": "cancelled", "Repl": "canceled"}]}]}`)
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.SetTimeLimit(time.Time{})
+	testutil.Check(t, f.SetConfigFile(file))
+
+	// Dry run: only rsc/tmp, only the configured rule.
+	f.Run(ctx)
+	if !strings.Contains(buf.String(), "url=https://api.github.com/repos/rsc/tmp/issues/1") {
+		t.Fatalf("config rule did not apply to rsc/tmp:\n%s", buf)
+	}
+	if strings.Contains(buf.String(), "rsc/other") {
+		t.Fatalf("config rule applied to unconfigured project:\n%s", buf)
+	}
+
+	// A bad config is reported and ignored.
+	buf.Reset()
+	write(`{"Projects": [{"Project": "rsc/tmp", "Rules": [{"Kind": "Bad"}]}]}`)
+	f.Run(ctx)
+	if !strings.Contains(buf.String(), "commentfix config reload") || !strings.Contains(buf.String(), "rsc/tmp/issues/1") {
+		t.Fatalf("bad config not reported or not ignored:\n%s", buf)
+	}
+
+	// Reloaded config applies to the new project with the new rules.
+	buf.Reset()
+	write(`{"Projects": [{"Project": "rsc/other", "Rules": [{"Kind": "AutoLink", "Pattern": "\\bCL (\\d+)\\b", "Repl": "https://go.dev/cl/$1"}]}]}`)
+	f.EnableEdits()
+	f.Run(ctx)
+	if strings.Contains(buf.String(), "rsc/tmp/issues/1") {
+		t.Fatalf("old config still applied:\n%s", buf)
+	}
+	edits := gh.Testing().Edits()
+	if len(edits) != 1 || edits[0].Project != "rsc/other" {
+		t.Fatalf("edits = %v, want one edit of rsc/other", edits)
+	}
+	want := "Contexts are cancelled; see [CL 123](https://go.dev/cl/123).\n"
+	if body := edits[0].IssueChanges.Body; body != want {
+		t.Fatalf("edited body = %q, want %q", body, want)
+	}
+}
+
+func TestConfigKinds(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for _, project := range []string{"rsc/tmp", "rsc/other"} {
+		gh.Testing().AddIssue(project, &github.Issue{
+			Number:    1,
+			Title:     "spelling",
+			Body:      "Javascript contexts are cancelled.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "words.txt")
+	testutil.Check(t, os.WriteFile(file, []byte("Javascript → JavaScript\n"), 0666))
+	cfg, err := ParseConfig([]byte(`{
+		"Projects": [
+			{"Project": "rsc/tmp", "Rules": [{"Kind": "ReplaceWords", "Words": {"cancelled": "canceled"}}]},
+			{"Project": "rsc/other"}
+		],
+		"Rules": [
+			{"Kind": "ReplaceWordsFile", "File": ` + strconv.Quote(file) + `},
+			{"Kind": "ReplaceTitle", "Pattern": "^spelling$", "Repl": "all: fix spelling", "Projects": ["rsc/other"]},
+			{"Kind": "ExpandPlayLinks", "DryRun": true}
+		]
+	}`))
+	testutil.Check(t, err)
+
+	f := New(testutil.Slogger(t), db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.SetTimeLimit(time.Time{})
+	testutil.Check(t, f.SetConfig(cfg))
+	f.EnableEdits()
+	f.Run(ctx)
+
+	edits := gh.Testing().Edits()
+	if len(edits) != 2 {
+		t.Fatalf("edits = %v, want 2", edits)
+	}
+	for _, e := range edits {
+		title, body := "", "JavaScript contexts are cancelled.\n"
+		if e.Project == "rsc/tmp" {
+			body = "JavaScript contexts are canceled.\n"
+		} else {
+			title = "all: fix spelling"
+		}
+		if e.IssueChanges.Title != title || e.IssueChanges.Body != body {
+			t.Errorf("%s edit = title %q, body %q, want %q, %q", e.Project, e.IssueChanges.Title, e.IssueChanges.Body, title, body)
+		}
+	}
+}
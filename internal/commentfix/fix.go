@@ -6,26 +6,35 @@
 package commentfix
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"rsc.io/gaby/internal/diff"
 	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/storage/timed"
 	"rsc.io/markdown"
+	"rsc.io/ordered"
 )
 
 // A Fixer rewrites issue texts and issue comments using a set of rules.
 // After creating a fixer with [New], new rules can be added using
 // the [Fixer.AutoLink], [Fixer.ReplaceText], and [Fixer.ReplaceURL] methods,
+// or loaded as data using [Fixer.SetConfig] or [Fixer.SetConfigFile],
 // and then repeated calls to [Fixer.Run] apply the replacements on GitHub.
+// Each rule can be restricted to specific projects or marked as dry-run only
+// by passing [RuleOption] values to the method that adds it.
 //
 // The zero value of a Fixer can be used in “offline” mode with [Fixer.Fix],
 // which returns rewritten Markdown.
@@ -33,12 +42,28 @@ import (
 // TODO(rsc): Separate the GitHub logic more cleanly from the rewrite logic.
 type Fixer struct {
 	slog      *slog.Logger
+	db        storage.DB
 	github    *github.Client
+	name      string
 	watcher   *timed.Watcher[*github.Event]
-	fixes     []func(any, int) any
+	rules     []*rule
 	projects  map[string]bool
 	edit      bool
-	timeLimit time.Time
+	timeLimit time.Time // set by SetTimeLimit
+	hasLimit  bool      // SetTimeLimit has been called
+	workers   int       // concurrent downloads and fixes in Run
+
+	now   func() time.Time    // current time; see SetClock
+	sleep func(time.Duration) // pause between edits; nil means time.Sleep, except in tests
+
+	editsPerRun  int         // maximum edits per Run; 0 means no limit
+	editsPerHour int         // maximum edits per hour; 0 means no limit
+	editTimes    []time.Time // times of recent edits, for editsPerHour
+
+	configRules map[string][]*rule // per-project rules from Config
+	configFile  string             // file to reload Config from
+	configData  []byte             // last loaded content of configFile
+	hc          *http.Client       // client for Config ExpandPlayLinks rules
 
 	stderrw io.Writer
 }
@@ -58,6 +83,10 @@ func (f *Fixer) SetStderr(w io.Writer) {
 //
 // The Fixer logs status and errors to lg; if lg is nil, the Fixer does not log anything.
 //
+// The Fixer records the original text of every issue and comment it edits in db,
+// so that the edits can be reverted using [Fixer.Undo].
+// If gh is non-nil, db must be non-nil too.
+//
 // The GitHub client is used to watch for new issues and comments
 // and to edit issues and comments. If gh is nil, the Fixer can still be
 // configured and applied to Markdown using [Fixer.Fix], but calling
@@ -66,14 +95,16 @@ func (f *Fixer) SetStderr(w io.Writer) {
 // The name is the handle by which the Fixer's “last position” is retrieved
 // across multiple program invocations; each differently configured
 // Fixer needs a different name.
-func New(lg *slog.Logger, gh *github.Client, name string) *Fixer {
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, name string) *Fixer {
 	f := &Fixer{
-		slog:      lg,
-		github:    gh,
-		projects:  make(map[string]bool),
-		timeLimit: time.Now().Add(-30 * 24 * time.Hour),
+		slog:     lg,
+		db:       db,
+		github:   gh,
+		name:     name,
+		projects: make(map[string]bool),
+		workers:  8,
 	}
-	f.init() // set f.slog if lg==nil
+	f.init() // set f.slog if lg==nil, and f.now
 	if gh != nil {
 		f.watcher = gh.EventWatcher("commentfix.Fixer:" + name)
 	}
@@ -81,15 +112,81 @@ func New(lg *slog.Logger, gh *github.Client, name string) *Fixer {
 }
 
 // SetTimeLimit sets the time before which comments are not edited.
+// The default is not to edit comments last updated more than 30 days ago.
 func (f *Fixer) SetTimeLimit(limit time.Time) {
 	f.timeLimit = limit
+	f.hasLimit = true
+}
+
+const defaultTooOld = 30 * 24 * time.Hour
+
+// limit returns the time before which comments are not edited.
+func (f *Fixer) limit() time.Time {
+	if f.hasLimit {
+		return f.timeLimit
+	}
+	return f.now().Add(-defaultTooOld)
+}
+
+// SetClock sets the clock the Fixer uses for its time limit
+// and edit limits, and for pausing between edits,
+// in place of [time.Now] and [time.Sleep].
+// It is meant for tests, which can pass the methods of a
+// [rsc.io/gaby/internal/testutil.FakeClock].
+// Without a clock, the Fixer does not pause between edits in tests.
+func (f *Fixer) SetClock(now func() time.Time, sleep func(time.Duration)) {
+	f.now = now
+	f.sleep = sleep
+}
+
+// SetConcurrency sets the number of issues and comments that
+// [Fixer.Run] downloads and fixes concurrently. The default is 8.
+// Run still makes its GitHub edits one at a time, in order.
+// A concurrency of 1 or less processes issues and comments serially.
+func (f *Fixer) SetConcurrency(n int) {
+	f.workers = max(n, 1)
+}
+
+// SetEditLimits sets the maximum number of GitHub edits that
+// a single call to [Fixer.Run] will make and the maximum number of
+// edits that the Fixer will make in any one-hour period.
+// A limit of 0 means no limit, which is the default.
+// Once a limit is reached, Run stops processing issues and comments,
+// leaving the rest for a future call to Run.
+// The limits protect against a bad rule rewriting a large number
+// of comments before anyone notices.
+//
+// The hourly limit only counts edits made by this Fixer
+// in the current program invocation.
+func (f *Fixer) SetEditLimits(perRun, perHour int) {
+	f.editsPerRun = perRun
+	f.editsPerHour = perHour
 }
 
-// init makes sure slog is non-nil.
+// canEdit reports whether the Fixer can make another edit
+// within its edit limits, given that Run has already made runEdits edits.
+func (f *Fixer) canEdit(runEdits int) bool {
+	if f.editsPerRun > 0 && runEdits >= f.editsPerRun {
+		return false
+	}
+	hourAgo := f.now().Add(-1 * time.Hour)
+	for len(f.editTimes) > 0 && f.editTimes[0].Before(hourAgo) {
+		f.editTimes = f.editTimes[1:]
+	}
+	if f.editsPerHour > 0 && len(f.editTimes) >= f.editsPerHour {
+		return false
+	}
+	return true
+}
+
+// init makes sure slog and now are non-nil.
 func (f *Fixer) init() {
 	if f.slog == nil {
 		f.slog = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
+	if f.now == nil {
+		f.now = time.Now
+	}
 }
 
 func (f *Fixer) EnableProject(name string) {
@@ -125,13 +222,23 @@ func (f *Fixer) EnableEdits() {
 // you could use:
 //
 //	f.AutoLink(`\bCL (\d+)\b`, "https://go.dev/cl/$1")
-func (f *Fixer) AutoLink(pattern, url string) error {
+func (f *Fixer) AutoLink(pattern, url string, opts ...RuleOption) error {
 	f.init()
-	re, err := regexp.Compile(pattern)
+	fix, err := autoLink(pattern, url)
 	if err != nil {
 		return err
 	}
-	f.fixes = append(f.fixes, func(x any, flags int) any {
+	f.rules = append(f.rules, withOptions(&rule{fix: fix}, opts))
+	return nil
+}
+
+// autoLink returns the fix function for [Fixer.AutoLink].
+func autoLink(pattern, url string) (func(any, int) any, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(x any, flags int) any {
 		if flags&flagLink != 0 {
 			// already inside link
 			return nil
@@ -159,8 +266,7 @@ func (f *Fixer) AutoLink(pattern, url string) error {
 		}
 		out = append(out, &markdown.Plain{Text: text[start:]})
 		return out
-	})
-	return nil
+	}, nil
 }
 
 // ReplaceText instructs the fixer to replace any text
@@ -178,13 +284,23 @@ func (f *Fixer) AutoLink(pattern, url string) error {
 // following Go's usual conventions, with:
 //
 //	f.ReplaceText(`cancelled`, "canceled")
-func (f *Fixer) ReplaceText(pattern, repl string) error {
+func (f *Fixer) ReplaceText(pattern, repl string, opts ...RuleOption) error {
 	f.init()
-	re, err := regexp.Compile(pattern)
+	fix, err := replaceText(pattern, repl)
 	if err != nil {
 		return err
 	}
-	f.fixes = append(f.fixes, func(x any, flags int) any {
+	f.rules = append(f.rules, withOptions(&rule{fix: fix}, opts))
+	return nil
+}
+
+// replaceText returns the fix function for [Fixer.ReplaceText].
+func replaceText(pattern, repl string) (func(any, int) any, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(x any, flags int) any {
 		plain, ok := x.(*markdown.Plain)
 		if !ok {
 			return nil
@@ -194,8 +310,7 @@ func (f *Fixer) ReplaceText(pattern, repl string) error {
 		}
 		plain.Text = re.ReplaceAllString(plain.Text, repl)
 		return plain
-	})
-	return nil
+	}, nil
 }
 
 // ReplaceURL instructs the fixer to replace any linked URLs
@@ -210,13 +325,23 @@ func (f *Fixer) ReplaceText(pattern, repl string) error {
 // you could use:
 //
 //	f.ReplaceURL(`https://golang\.org(/?)`, "https://go.dev$1")
-func (f *Fixer) ReplaceURL(pattern, repl string) error {
+func (f *Fixer) ReplaceURL(pattern, repl string, opts ...RuleOption) error {
 	f.init()
-	re, err := regexp.Compile(`\A(?:` + pattern + `)`)
+	fix, err := replaceURL(pattern, repl)
 	if err != nil {
 		return err
 	}
-	f.fixes = append(f.fixes, func(x any, flags int) any {
+	f.rules = append(f.rules, withOptions(&rule{fix: fix}, opts))
+	return nil
+}
+
+// replaceURL returns the fix function for [Fixer.ReplaceURL].
+func replaceURL(pattern, repl string) (func(any, int) any, error) {
+	re, err := regexp.Compile(`\A(?:` + pattern + `)`)
+	if err != nil {
+		return nil, err
+	}
+	return func(x any, flags int) any {
 		switch x := x.(type) {
 		case *markdown.AutoLink:
 			old := x.URL
@@ -242,14 +367,15 @@ func (f *Fixer) ReplaceURL(pattern, repl string) error {
 			return x
 		}
 		return nil
-	})
-	return nil
+	}, nil
 }
 
 // Run applies the configured rewrites to issue texts and comments on GitHub
 // that have been updated since the last call to Run for this fixer with edits enabled
 // (including in different program invocations using the same fixer name).
 // Run ignores issues texts and comments more than 30 days old.
+// If title rules have been added with [Fixer.ReplaceTitle],
+// Run also rewrites the titles of those issues.
 //
 // Run prints diffs of its edits to standard error in addition to logging them,
 // because slog logs the diffs as single-line Go quoted strings that are
@@ -260,70 +386,240 @@ func (f *Fixer) ReplaceURL(pattern, repl string) error {
 // but it does not make the changes. It also does not mark the issues and comments as processed,
 // so that a future call to Run with edits enabled can rewrite them on GitHub.
 //
-// Run sleeps for 1 second after each GitHub edit.
+// Run downloads issues and comments and computes their fixes concurrently
+// (see [Fixer.SetConcurrency]), but it makes its GitHub edits one at a time,
+// in the order the issues and comments were updated.
+// Run sleeps for 1 second after each GitHub edit,
+// and it stops early if it reaches a limit set by [Fixer.SetEditLimits].
+// If ctx is canceled, Run stops before the next edit,
+// leaving the remaining issues and comments for a future call.
 //
 // Run panics if the Fixer was not constructed by calling [New]
 // with a non-nil [github.Client].
-func (f *Fixer) Run() {
+func (f *Fixer) Run(ctx context.Context) {
 	if f.watcher == nil {
 		panic("commentfix.Fixer: Run missing GitHub client")
 	}
+	if err := f.loadConfigFile(); err != nil {
+		f.slog.Error("commentfix config reload", "err", err)
+	}
+
+	// Candidates are prepared (fixed and downloaded) concurrently,
+	// up to a window of 4*f.workers ahead of the one being applied,
+	// but they are applied one at a time, in order,
+	// so that MarkOld and the edit limits behave
+	// exactly as they would in a serial loop.
+	var (
+		pending  []*candidate
+		wg       sync.WaitGroup
+		sema     = make(chan bool, f.workers)
+		window   = 4 * f.workers
+		runEdits = 0
+		stopped  = false
+	)
+	defer wg.Wait()
 	for e := range f.watcher.Recent() {
-		if !f.projects[e.Project] {
-			continue
+		if ctx.Err() != nil {
+			return
 		}
-		var ic *issueOrComment
-		switch x := e.Typed.(type) {
-		default:
+		c := f.newCandidate(e)
+		if c == nil {
 			continue
-		case *github.Issue:
-			if x.PullRequest != nil {
-				// Do not edit pull request bodies,
-				// because they turn into commit messages
-				// and cannot contain things like hyperlinks.
-				continue
-			}
-			ic = &issueOrComment{issue: x}
-		case *github.IssueComment:
-			ic = &issueOrComment{comment: x}
 		}
-		if tm, err := time.Parse(time.RFC3339, ic.updatedAt()); err == nil && tm.Before(f.timeLimit) {
-			if f.edit {
-				f.watcher.MarkOld(e.DBTime)
-			}
-			continue
+		pending = append(pending, c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sema <- true
+			defer func() { <-sema }()
+			f.prepare(ctx, c)
+		}()
+		for len(pending) >= window && !stopped {
+			stopped = !f.apply(pending[0], &runEdits)
+			pending = pending[1:]
 		}
-		body, updated := f.Fix(ic.body())
-		if !updated {
-			continue
+		if stopped {
+			return
 		}
-		live, err := ic.download(f.github)
-		if err != nil {
-			// unreachable unless github error
-			f.slog.Error("commentfix download error", "project", e.Project, "issue", e.Issue, "url", ic.url(), "err", err)
-			continue
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	// The iteration over Recent has ended, releasing the
+	// watcher's lock, but MarkOld must be called with the lock held.
+	// Iterate again to apply the remaining candidates.
+	for e := range f.watcher.Recent() {
+		// Drop candidates that are no longer recent,
+		// because another instance has processed them.
+		for len(pending) > 0 && pending[0].e.DBTime < e.DBTime {
+			pending = pending[1:]
+		}
+		if len(pending) == 0 {
+			break
 		}
-		if live.body() != ic.body() {
-			f.slog.Info("commentfix stale", "project", e.Project, "issue", e.Issue, "url", ic.url())
+		if pending[0].e.DBTime != e.DBTime {
 			continue
 		}
-		f.slog.Info("commentfix rewrite", "project", e.Project, "issue", e.Issue, "url", ic.url(), "edit", f.edit, "diff", bodyDiff(ic.body(), body))
-		fmt.Fprintf(f.stderr(), "Fix %s:\n%s\n", ic.url(), bodyDiff(ic.body(), body))
-		if f.edit {
-			f.slog.Info("commentfix editing github", "url", ic.url())
-			if err := ic.editBody(f.github, body); err != nil {
-				// unreachable unless github error
-				f.slog.Error("commentfix edit", "project", e.Project, "issue", e.Issue, "err", err)
-				continue
+		if ctx.Err() != nil {
+			break
+		}
+		if !f.apply(pending[0], &runEdits) {
+			break
+		}
+		pending = pending[1:]
+	}
+}
+
+// A candidate is an issue or comment that Run may edit,
+// along with the results of preparing the edit.
+type candidate struct {
+	e        *github.Event
+	ic       *issueOrComment
+	old      bool            // last updated before the time limit
+	done     chan struct{}   // closed when prepare finishes
+	body     string          // new body, or "" if unchanged
+	title    string          // new title, or "" if unchanged
+	dryBody  string          // body including dry-run rules, or "" if same as body
+	dryTitle string          // title including dry-run rules, or "" if same as title
+	live     *issueOrComment // live copy downloaded from GitHub
+	err      error           // error downloading live copy
+}
+
+// newCandidate returns the candidate for the event e,
+// or nil if e is not an issue or comment that Run should consider.
+func (f *Fixer) newCandidate(e *github.Event) *candidate {
+	if _, ok := f.configRules[e.Project]; !ok && !f.projects[e.Project] {
+		return nil
+	}
+	var ic *issueOrComment
+	switch x := e.Typed.(type) {
+	default:
+		return nil
+	case *github.Issue:
+		if x.PullRequest != nil {
+			// Do not edit pull request bodies,
+			// because they turn into commit messages
+			// and cannot contain things like hyperlinks.
+			return nil
+		}
+		ic = &issueOrComment{issue: x}
+	case *github.IssueComment:
+		ic = &issueOrComment{comment: x}
+	}
+	c := &candidate{e: e, ic: ic, done: make(chan struct{})}
+	if tm, err := time.Parse(time.RFC3339, ic.updatedAt()); err == nil && tm.Before(f.limit()) {
+		c.old = true
+	}
+	return c
+}
+
+// prepare computes the fixes for c and, if c needs editing,
+// downloads its live copy. It closes c.done when finished.
+// prepare runs concurrently with other calls to prepare and with [Fixer.apply].
+func (f *Fixer) prepare(ctx context.Context, c *candidate) {
+	defer close(c.done)
+	if c.old {
+		return
+	}
+	e, ic := c.e, c.ic
+	rules := f.rulesFor(e.Project, false)
+	c.body, _ = f.fix(ctx, rules, ic.body())
+	if ic.issue != nil {
+		c.title, _ = fixTitle(rules, ic.issue.Title)
+	}
+	if all := f.rulesFor(e.Project, true); len(all) > len(rules) {
+		if dryBody, ok := f.fix(ctx, all, ic.body()); ok && dryBody != cmp.Or(c.body, ic.body()) {
+			c.dryBody = dryBody
+		}
+		if ic.issue != nil {
+			if dryTitle, ok := fixTitle(all, ic.title()); ok && dryTitle != cmp.Or(c.title, ic.title()) {
+				c.dryTitle = dryTitle
 			}
+		}
+	}
+	if c.body == "" && c.title == "" {
+		return
+	}
+	c.live, c.err = ic.download(f.github)
+}
+
+// apply waits for c to be prepared and then logs and makes the edit,
+// counting it in *runEdits.
+// It returns false if Run should stop
+// because an edit limit has been reached.
+func (f *Fixer) apply(c *candidate, runEdits *int) bool {
+	<-c.done
+	e, ic, body, title := c.e, c.ic, c.body, c.title
+	if c.old {
+		if f.edit {
 			f.watcher.MarkOld(e.DBTime)
-			f.watcher.Flush()
-			if !testing.Testing() {
-				// unreachable in tests
-				time.Sleep(1 * time.Second)
-			}
 		}
+		return true
+	}
+	if c.dryBody != "" {
+		f.slog.Info("commentfix dry run rewrite", "project", e.Project, "issue", e.Issue, "url", ic.url(), "diff", bodyDiff(cmp.Or(body, ic.body()), c.dryBody), "words", bodyWords(cmp.Or(body, ic.body()), c.dryBody))
+		fmt.Fprintf(f.stderr(), "Dry run fix %s:\n%s\n", ic.url(), bodyDiff(cmp.Or(body, ic.body()), c.dryBody))
+	}
+	if c.dryTitle != "" {
+		f.slog.Info("commentfix dry run retitle", "project", e.Project, "issue", e.Issue, "url", ic.url(), "old", cmp.Or(title, ic.title()), "new", c.dryTitle)
+		fmt.Fprintf(f.stderr(), "Dry run fix title %s:\n-%s\n+%s\n", ic.url(), cmp.Or(title, ic.title()), c.dryTitle)
+	}
+	if body == "" && title == "" {
+		return true
 	}
+	if f.edit && !f.canEdit(*runEdits) {
+		f.slog.Info("commentfix edit limit reached; deferring remaining edits", "project", e.Project, "issue", e.Issue, "url", ic.url(), "edits", *runEdits)
+		return false
+	}
+	if c.err != nil {
+		// unreachable unless github error
+		f.slog.Error("commentfix download error", "project", e.Project, "issue", e.Issue, "url", ic.url(), "err", c.err)
+		return true
+	}
+	if c.live.body() != ic.body() || c.live.title() != ic.title() {
+		f.slog.Info("commentfix stale", "project", e.Project, "issue", e.Issue, "url", ic.url())
+		return true
+	}
+	if body != "" {
+		f.slog.Info("commentfix rewrite", "project", e.Project, "issue", e.Issue, "url", ic.url(), "edit", f.edit, "diff", bodyDiff(ic.body(), body), "words", bodyWords(ic.body(), body))
+		fmt.Fprintf(f.stderr(), "Fix %s:\n%s\n", ic.url(), bodyDiff(ic.body(), body))
+	}
+	if title != "" {
+		f.slog.Info("commentfix retitle", "project", e.Project, "issue", e.Issue, "url", ic.url(), "edit", f.edit, "old", ic.title(), "new", title)
+		fmt.Fprintf(f.stderr(), "Fix title %s:\n-%s\n+%s\n", ic.url(), ic.title(), title)
+	}
+	if f.edit {
+		// The action record guarantees at most one edit of this version
+		// of the issue or comment, even across crashes and multiple instances.
+		action := ordered.Encode("commentfix.Fix", f.name, ic.url(), c.live.updatedAt())
+		if !storage.BeginAction(f.db, action) {
+			f.slog.Info("commentfix already edited", "project", e.Project, "issue", e.Issue, "url", ic.url())
+			f.watcher.MarkOld(e.DBTime)
+			return true
+		}
+		f.slog.Info("commentfix editing github", "url", ic.url())
+		if err := ic.edit(f.github, title, body); err != nil {
+			// unreachable unless github error
+			f.slog.Error("commentfix edit", "project", e.Project, "issue", e.Issue, "err", err)
+			storage.CancelAction(f.db, action)
+			return true
+		}
+		storage.FinishAction(f.db, action, nil)
+		f.recordEdit(e, ic, title, body)
+		*runEdits++
+		f.editTimes = append(f.editTimes, f.now())
+		f.watcher.MarkOld(e.DBTime)
+		f.watcher.Flush()
+		switch {
+		case f.sleep != nil:
+			f.sleep(1 * time.Second)
+		case !testing.Testing():
+			// unreachable in tests
+			time.Sleep(1 * time.Second)
+		}
+	}
+	return true
 }
 
 type issueOrComment struct {
@@ -361,9 +657,19 @@ func (ic *issueOrComment) url() string {
 	return ic.comment.URL
 }
 
-func (ic *issueOrComment) editBody(gh *github.Client, body string) error {
+// title returns the issue title, or "" for a comment.
+func (ic *issueOrComment) title() string {
 	if ic.issue != nil {
-		return gh.EditIssue(ic.issue, &github.IssueChanges{Body: body})
+		return ic.issue.Title
+	}
+	return ""
+}
+
+// edit changes the title and body on GitHub.
+// An empty title or body is left unchanged.
+func (ic *issueOrComment) edit(gh *github.Client, title, body string) error {
+	if ic.issue != nil {
+		return gh.EditIssue(ic.issue, &github.IssueChanges{Title: title, Body: body})
 	}
 	return gh.EditIssueComment(ic.comment, &github.IssueCommentChanges{Body: body})
 }
@@ -371,7 +677,18 @@ func (ic *issueOrComment) editBody(gh *github.Client, body string) error {
 // Fix applies the configured rewrites to the markdown text.
 // If no fixes apply, it returns "", false.
 // If any fixes apply, it returns the updated text and true.
+//
+// Fix applies all the rules added directly to the Fixer,
+// ignoring their project restrictions and dry-run settings,
+// but not the per-project rules loaded from a [Config].
 func (f *Fixer) Fix(text string) (newText string, fixed bool) {
+	return f.fix(context.Background(), f.rules, text)
+}
+
+// fix applies the Markdown rules to the markdown text.
+// The context is passed to rules that fetch data,
+// such as [Fixer.ExpandPlayLinks].
+func (f *Fixer) fix(ctx context.Context, rules []*rule, text string) (newText string, fixed bool) {
 	p := &markdown.Parser{
 		AutoLinkText:  true,
 		Strikethrough: true,
@@ -379,8 +696,11 @@ func (f *Fixer) Fix(text string) (newText string, fixed bool) {
 		Emoji:         true,
 	}
 	doc := p.Parse(text)
-	for _, fixer := range f.fixes {
-		if f.fixOne(fixer, doc) {
+	for _, r := range rules {
+		if r.fix != nil && f.fixOne(r.fix, doc) {
+			fixed = true
+		}
+		if r.doc != nil && r.doc(ctx, doc) {
 			fixed = true
 		}
 	}
@@ -478,11 +798,19 @@ func (f *Fixer) fixOne(fix func(any, int) any, doc *markdown.Document) (fixed bo
 }
 
 func bodyDiff(old, new string) string {
-	old = strings.TrimRight(old, "\n") + "\n"
-	old = strings.ReplaceAll(old, "\r\n", "\n")
+	old, new = cleanBody(old), cleanBody(new)
+	return string(diff.Diff("old", []byte(old), "new", []byte(new)))
+}
 
-	new = strings.TrimRight(new, "\n") + "\n"
-	new = strings.ReplaceAll(new, "\r\n", "\n")
+// bodyWords returns a word-level diff of old and new (see [diff.WordDiff]),
+// which shows small fixes more clearly than [bodyDiff] in logs.
+func bodyWords(old, new string) string {
+	return diff.WordDiff(cleanBody(old), cleanBody(new))
+}
 
-	return string(diff.Diff("old", []byte(old), "new", []byte(new)))
+// cleanBody normalizes the line endings of the body text,
+// so that diffs do not show spurious changes.
+func cleanBody(text string) string {
+	text = strings.TrimRight(text, "\n") + "\n"
+	return strings.ReplaceAll(text, "\r\n", "\n")
 }
@@ -6,8 +6,11 @@ package commentfix
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"text/template"
@@ -18,8 +21,11 @@ import (
 	"rsc.io/gaby/internal/github"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
 )
 
+var ctx = context.Background()
+
 func TestTestdata(t *testing.T) {
 	files, err := filepath.Glob("testdata/*.txt")
 	testutil.Check(t, err)
@@ -73,7 +79,7 @@ func TestPanics(t *testing.T) {
 	func() {
 		defer callRecover()
 		var f Fixer
-		f.Run()
+		f.Run(ctx)
 		t.Errorf("Run on zero Fixer did not panic")
 	}()
 }
@@ -92,7 +98,7 @@ func TestErrors(t *testing.T) {
 }
 
 func TestGitHub(t *testing.T) {
-	testGH := func() *github.Client {
+	testGH := func() (storage.DB, *github.Client) {
 		db := storage.MemDB()
 		gh := github.New(testutil.Slogger(t), db, nil, nil)
 		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
@@ -123,19 +129,19 @@ func TestGitHub(t *testing.T) {
 			UpdatedAt: "2024-06-17T20:16:49-04:00",
 		})
 
-		return gh
+		return db, gh
 	}
 
 	// Check for comment with too-new cutoff and edits disabled.
 	// Finds nothing but also no-op.
-	gh := testGH()
+	db, gh := testGH()
 	lg, buf := testutil.SlogBuffer()
-	f := New(lg, gh, "fixer1")
+	f := New(lg, db, gh, "fixer1")
 	f.SetStderr(testutil.LogWriter(t))
 	f.EnableProject("rsc/tmp")
 	f.SetTimeLimit(time.Date(2222, 1, 1, 1, 1, 1, 1, time.UTC))
 	f.ReplaceText("cancelled", "canceled")
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs mention rewrite of old comment:\n%s", buf.Bytes())
@@ -143,16 +149,19 @@ func TestGitHub(t *testing.T) {
 
 	// Check again with old enough cutoff.
 	// Finds comment but does not edit, does not advance cursor.
-	f = New(lg, gh, "fixer1")
+	f = New(lg, db, gh, "fixer1")
 	f.SetStderr(testutil.LogWriter(t))
 	f.EnableProject("rsc/tmp")
 	f.SetTimeLimit(time.Time{})
 	f.ReplaceText("cancelled", "canceled")
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if !bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs do not mention rewrite of comment:\n%s", buf.Bytes())
 	}
+	if !bytes.Contains(buf.Bytes(), []byte("[-cancelled-]{+canceled+}")) {
+		t.Fatalf("logs do not show word diff of rewrite:\n%s", buf.Bytes())
+	}
 	if bytes.Contains(buf.Bytes(), []byte("editing github")) {
 		t.Fatalf("logs incorrectly mention editing github:\n%s", buf.Bytes())
 	}
@@ -161,14 +170,14 @@ func TestGitHub(t *testing.T) {
 	buf.Truncate(0)
 	f.SetTimeLimit(time.Date(2222, 1, 1, 1, 1, 1, 1, time.UTC))
 	f.EnableEdits()
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs incorrectly mention rewrite of comment:\n%s", buf.Bytes())
 	}
 
 	f.SetTimeLimit(time.Time{})
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs incorrectly mention rewrite of comment:\n%s", buf.Bytes())
@@ -176,13 +185,13 @@ func TestGitHub(t *testing.T) {
 
 	// Write comment (now using fixer2 to avoid 'marked as old' in fixer1).
 	lg, buf = testutil.SlogBuffer()
-	f = New(lg, gh, "fixer2")
+	f = New(lg, db, gh, "fixer2")
 	f.SetStderr(testutil.LogWriter(t))
 	f.EnableProject("rsc/tmp")
 	f.ReplaceText("cancelled", "canceled")
 	f.SetTimeLimit(time.Time{})
 	f.EnableEdits()
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if !bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs do not mention rewrite of comment:\n%s", buf.Bytes())
@@ -205,13 +214,13 @@ func TestGitHub(t *testing.T) {
 
 	// Try again; comment should now be marked old in watcher.
 	lg, buf = testutil.SlogBuffer()
-	f = New(lg, gh, "fixer2")
+	f = New(lg, db, gh, "fixer2")
 	f.SetStderr(testutil.LogWriter(t))
 	f.EnableProject("rsc/tmp")
 	f.ReplaceText("cancelled", "canceled")
 	f.EnableEdits()
 	f.SetTimeLimit(time.Time{})
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs incorrectly mention rewrite of comment:\n%s", buf.Bytes())
@@ -219,15 +228,254 @@ func TestGitHub(t *testing.T) {
 
 	// Check that not enabling the project doesn't edit comments.
 	lg, buf = testutil.SlogBuffer()
-	f = New(lg, gh, "fixer3")
+	f = New(lg, db, gh, "fixer3")
 	f.SetStderr(testutil.LogWriter(t))
 	f.EnableProject("xyz/tmp")
 	f.ReplaceText("cancelled", "canceled")
 	f.EnableEdits()
 	f.SetTimeLimit(time.Time{})
-	f.Run()
+	f.Run(ctx)
 	// t.Logf("output:\n%s", buf)
 	if bytes.Contains(buf.Bytes(), []byte("commentfix rewrite")) {
 		t.Fatalf("logs incorrectly mention rewrite of comment:\n%s", buf.Bytes())
 	}
 }
+
+func TestEditLimits(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for i := range 5 {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+			Number:    int64(i + 1),
+			Title:     "spellchecking",
+			Body:      "Contexts are cancelled.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.EnableProject("rsc/tmp")
+	f.ReplaceText("cancelled", "canceled")
+	clock := testutil.NewFakeClock(time.Date(2024, 6, 18, 12, 0, 0, 0, time.UTC))
+	f.SetClock(clock.Now, clock.Sleep)
+	f.EnableEdits()
+	f.SetEditLimits(2, 3)
+
+	check := func(want int) {
+		t.Helper()
+		if n := len(gh.Testing().Edits()); n != want {
+			t.Fatalf("have %d edits, want %d", n, want)
+		}
+	}
+
+	f.Run(ctx)
+	check(2) // per-run limit
+	if !bytes.Contains(buf.Bytes(), []byte("edit limit reached")) {
+		t.Fatalf("logs do not mention edit limit:\n%s", buf.Bytes())
+	}
+	f.Run(ctx)
+	check(3) // per-hour limit
+	f.Run(ctx)
+	check(3)
+
+	clock.Advance(2 * time.Hour)
+	f.Run(ctx)
+	check(5)
+
+	// Run pauses for a second after each edit.
+	if sleeps := clock.Sleeps(); len(sleeps) != 5 || sleeps[0] != time.Second {
+		t.Errorf("sleeps = %v, want 5 × 1s", sleeps)
+	}
+}
+
+func TestTimeLimitClock(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number:    1,
+		Title:     "spellchecking",
+		Body:      "Contexts are cancelled.",
+		CreatedAt: "2024-06-17T20:16:49-04:00",
+		UpdatedAt: "2024-06-17T20:16:49-04:00",
+	})
+
+	// By default, comments more than 30 days old are not edited.
+	for _, tt := range []struct {
+		name  string
+		now   time.Time
+		edits int
+	}{
+		{"fixer1", time.Date(2024, 7, 20, 0, 0, 0, 0, time.UTC), 0},
+		{"fixer2", time.Date(2024, 7, 10, 0, 0, 0, 0, time.UTC), 1},
+	} {
+		gh.Testing().ClearEdits()
+		f := New(testutil.Slogger(t), db, gh, tt.name)
+		f.SetStderr(testutil.LogWriter(t))
+		f.EnableProject("rsc/tmp")
+		f.ReplaceText("cancelled", "canceled")
+		f.EnableEdits()
+		clock := testutil.NewFakeClock(tt.now)
+		f.SetClock(clock.Now, clock.Sleep)
+		f.Run(ctx)
+		if n := len(gh.Testing().Edits()); n != tt.edits {
+			t.Errorf("%s: at %v, have %d edits, want %d", tt.name, tt.now, n, tt.edits)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	const n = 30
+	for i := range n {
+		body := "Nothing to fix."
+		if i%3 != 0 {
+			body = "Contexts are cancelled."
+		}
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+			Number:    int64(i + 1),
+			Title:     "spellchecking",
+			Body:      body,
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	f := New(testutil.Slogger(t), db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.EnableProject("rsc/tmp")
+	f.ReplaceText("cancelled", "canceled")
+	f.SetTimeLimit(time.Time{})
+	f.EnableEdits()
+	f.SetConcurrency(2)
+	f.SetEditLimits(15, 0)
+
+	// The first Run stops at the edit limit in the middle of the
+	// concurrent window; the second finishes the rest.
+	// The edits must be made in order, with none lost or repeated.
+	f.Run(ctx)
+	if n := len(gh.Testing().Edits()); n != 15 {
+		t.Fatalf("have %d edits, want 15", n)
+	}
+	f.Run(ctx)
+	var have []int64
+	for _, e := range gh.Testing().Edits() {
+		have = append(have, e.Issue)
+	}
+	var want []int64
+	for i := range n {
+		if i%3 != 0 {
+			want = append(want, int64(i+1))
+		}
+	}
+	if !slices.Equal(have, want) {
+		t.Fatalf("edited issues %v, want %v", have, want)
+	}
+}
+
+func TestAlreadyEdited(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for i := range 2 {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+			Number:    int64(i + 1),
+			Title:     "spellchecking",
+			Body:      "Contexts are cancelled.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	// Simulate a crash after editing issue 1 but before recording the edit.
+	url := "https://api.github.com/repos/rsc/tmp/issues/1"
+	storage.BeginAction(db, ordered.Encode("commentfix.Fix", "fixer", url, "2024-06-17T20:16:49-04:00"))
+
+	f := New(testutil.Slogger(t), db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.EnableProject("rsc/tmp")
+	f.ReplaceText("cancelled", "canceled")
+	f.SetTimeLimit(time.Time{})
+	f.EnableEdits()
+	f.Run(ctx)
+	var have []int64
+	for _, e := range gh.Testing().Edits() {
+		have = append(have, e.Issue)
+	}
+	if want := []int64{2}; !slices.Equal(have, want) {
+		t.Fatalf("edited issues %v, want %v", have, want)
+	}
+}
+
+// TestRunTestdata runs end-to-end tests of [Fixer.Run] described by testdata/run/*.txt.
+// Each file is a txtar archive. The archive comment is a template
+// executed with the Fixer as data to add rules, as in TestTestdata;
+// the template functions Projects and DryRun return the corresponding
+// [RuleOption] values. The files named “project#n” are issue histories
+// loaded using [github.TestingClient.LoadTxtarData]; each project
+// is enabled in the Fixer. The file named “edits” lists the edits
+// that a single Run with edits enabled should make, one per line,
+// in the form printed by [github.TestingEdit.String], except that
+// comment IDs are replaced by “cN”, meaning the Nth comment on the issue.
+func TestRunTestdata(t *testing.T) {
+	files, err := filepath.Glob("testdata/run/*.txt")
+	testutil.Check(t, err)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			a, err := txtar.ParseFile(file)
+			testutil.Check(t, err)
+
+			db := storage.MemDB()
+			gh := github.New(testutil.Slogger(t), db, nil, nil)
+			f := New(testutil.Slogger(t), db, gh, "fixer")
+			f.SetStderr(testutil.LogWriter(t))
+			f.SetTimeLimit(time.Time{})
+			f.EnableEdits()
+
+			var issues txtar.Archive
+			var want string
+			for _, file := range a.Files {
+				if file.Name == "edits" {
+					want = string(file.Data)
+					continue
+				}
+				issues.Files = append(issues.Files, file)
+				project, _, _ := strings.Cut(file.Name, "#")
+				f.EnableProject(project)
+			}
+			testutil.Check(t, gh.Testing().LoadTxtarData(txtar.Format(&issues)))
+
+			tmpl, err := new(template.Template).Funcs(template.FuncMap{
+				"Projects": Projects,
+				"DryRun":   DryRun,
+			}).Parse(string(a.Comment))
+			testutil.Check(t, err)
+			testutil.Check(t, tmpl.Execute(io.Discard, f))
+
+			f.Run(ctx)
+
+			var have bytes.Buffer
+			for _, e := range gh.Testing().Edits() {
+				s := e.String()
+				if e.Comment != 0 {
+					n := 0
+					for ev := range gh.Events(e.Project, e.Issue, e.Issue) {
+						if ev.API == "/issues/comments" {
+							n++
+							if ev.ID == e.Comment {
+								break
+							}
+						}
+					}
+					s = strings.Replace(s, fmt.Sprintf("#%d.%d,", e.Issue, e.Comment), fmt.Sprintf("#%d.c%d,", e.Issue, n), 1)
+				}
+				have.WriteString(s + "\n")
+			}
+			if have.String() != want {
+				t.Fatalf("Run edits:\n%s", diff.Diff("want", []byte(want), "have", have.Bytes()))
+			}
+		})
+	}
+}
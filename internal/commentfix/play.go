@@ -0,0 +1,251 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/markdown"
+)
+
+// playRE matches a Go playground snippet URL, capturing the snippet ID.
+var playRE = regexp.MustCompile(`\Ahttps?://(?:go\.dev/play|play\.golang\.org)/p/([A-Za-z0-9_-]+)(?:\.go)?\z`)
+
+// maxPlayLines is the maximum number of lines in a playground
+// program that ExpandPlayLinks will copy into a comment.
+const maxPlayLines = 100
+
+// maxPlayBytes is the maximum size of a playground program
+// that ExpandPlayLinks will download.
+// Larger programs are too long to copy anyway.
+const maxPlayBytes = 64 << 10
+
+// playTimeout is the time limit for downloading a playground program.
+const playTimeout = 30 * time.Second
+
+// maxPlayCache is the maximum number of programs kept in a playCache.
+const maxPlayCache = 1000
+
+// ExpandPlayLinks instructs the fixer to copy the programs behind
+// Go playground links (https://go.dev/play/p/ID or https://play.golang.org/p/ID)
+// into the text, as a Go code block appended after the existing text,
+// so that the programs are visible to readers, search, and embeddings,
+// and survive even if the playground snippet expires.
+//
+// The programs are downloaded using hc.
+// Programs longer than 100 lines are not copied,
+// nor are programs that already appear verbatim in a code block in the text.
+// Links that cannot be downloaded are logged as invalid and left alone.
+// Playground programs never change, so the rule remembers
+// the programs it has downloaded instead of downloading them
+// again each time it sees a link (for example, in a text
+// it has already expanded).
+func (f *Fixer) ExpandPlayLinks(hc *http.Client, opts ...RuleOption) {
+	f.init()
+	f.rules = append(f.rules, withOptions(f.expandPlayRule(hc), opts))
+}
+
+// SetHTTPClient sets the HTTP client used by "ExpandPlayLinks" rules
+// in a [Config]. The default is [http.DefaultClient].
+// Rules already loaded keep the client they were created with.
+func (f *Fixer) SetHTTPClient(hc *http.Client) {
+	f.hc = hc
+}
+
+// httpClient returns the client set by [Fixer.SetHTTPClient].
+func (f *Fixer) httpClient() *http.Client {
+	if f.hc == nil {
+		return http.DefaultClient
+	}
+	return f.hc
+}
+
+// expandPlayRule returns the rule for [Fixer.ExpandPlayLinks].
+func (f *Fixer) expandPlayRule(hc *http.Client) *rule {
+	cache := new(playCache)
+	return &rule{doc: func(ctx context.Context, doc *markdown.Document) bool {
+		return f.expandPlay(ctx, hc, cache, doc)
+	}}
+}
+
+// A playCache holds downloaded playground programs, by snippet ID.
+// It is safe for concurrent use by multiple goroutines.
+type playCache struct {
+	mu  sync.Mutex
+	src map[string]string
+}
+
+// get returns the source of the playground snippet with the given ID,
+// downloading it using hc if it is not already in the cache.
+func (c *playCache) get(ctx context.Context, hc *http.Client, id string) (string, error) {
+	c.mu.Lock()
+	src, ok := c.src[id]
+	c.mu.Unlock()
+	if ok {
+		return src, nil
+	}
+	src, err := fetchPlay(ctx, hc, id)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.src == nil || len(c.src) >= maxPlayCache {
+		c.src = make(map[string]string)
+	}
+	c.src[id] = src
+	return src, nil
+}
+
+// expandPlay implements the ExpandPlayLinks rule on doc.
+func (f *Fixer) expandPlay(ctx context.Context, hc *http.Client, cache *playCache, doc *markdown.Document) bool {
+	var urls []string
+	var code []string
+	walkDoc(doc, func(x any) {
+		switch x := x.(type) {
+		case *markdown.Link:
+			urls = append(urls, x.URL)
+		case *markdown.AutoLink:
+			urls = append(urls, x.URL)
+		case *markdown.CodeBlock:
+			code = append(code, strings.Join(x.Text, "\n"))
+		}
+	})
+
+	fixed := false
+	var seen []string
+	for _, u := range urls {
+		m := playRE.FindStringSubmatch(u)
+		if m == nil || slices.Contains(seen, m[1]) {
+			continue
+		}
+		id := m[1]
+		seen = append(seen, id)
+		src, err := cache.get(ctx, hc, id)
+		if err == errPlayTooLarge {
+			continue
+		}
+		if err != nil {
+			f.slog.Warn("commentfix invalid playground link", "url", u, "err", err)
+			continue
+		}
+		lines := strings.Split(strings.TrimRight(src, "\n"), "\n")
+		if len(lines) > maxPlayLines || slices.Contains(code, strings.Join(lines, "\n")) {
+			continue
+		}
+		fence := "```"
+		if strings.Contains(src, fence) {
+			fence = "~~~"
+		}
+		// The positions are only used to print blank lines between blocks.
+		end := 0
+		if len(doc.Blocks) > 0 {
+			end = doc.Blocks[len(doc.Blocks)-1].Pos().EndLine
+		}
+		doc.Blocks = append(doc.Blocks,
+			&markdown.Paragraph{
+				Position: markdown.Position{StartLine: end + 2, EndLine: end + 2},
+				Text:     &markdown.Text{Inline: []markdown.Inline{&markdown.Plain{Text: "Program from " + u + ":"}}},
+			},
+			&markdown.CodeBlock{
+				Position: markdown.Position{StartLine: end + 4, EndLine: end + 4 + len(lines) + 1},
+				Fence:    fence,
+				Info:     "go",
+				Text:     lines,
+			},
+		)
+		code = append(code, strings.Join(lines, "\n"))
+		fixed = true
+	}
+	return fixed
+}
+
+// errPlayTooLarge is returned by fetchPlay for programs
+// larger than maxPlayBytes.
+var errPlayTooLarge = errors.New("playground program too large")
+
+// fetchPlay returns the source code of the playground snippet with the given ID.
+func fetchPlay(ctx context.Context, hc *http.Client, id string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, playTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://go.dev/play/p/"+id+".go", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPlayBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	if len(data) > maxPlayBytes {
+		return "", errPlayTooLarge
+	}
+	return string(data), nil
+}
+
+// walkDoc calls visit for each block and inline in doc.
+func walkDoc(doc *markdown.Document, visit func(any)) {
+	var walkBlock func(markdown.Block)
+	var walkInlines func([]markdown.Inline)
+	walkBlock = func(x markdown.Block) {
+		visit(x)
+		switch x := x.(type) {
+		case *markdown.Document:
+			for _, sub := range x.Blocks {
+				walkBlock(sub)
+			}
+		case *markdown.Quote:
+			for _, sub := range x.Blocks {
+				walkBlock(sub)
+			}
+		case *markdown.List:
+			for _, sub := range x.Items {
+				walkBlock(sub)
+			}
+		case *markdown.Item:
+			for _, sub := range x.Blocks {
+				walkBlock(sub)
+			}
+		case *markdown.Heading:
+			walkBlock(x.Text)
+		case *markdown.Paragraph:
+			walkBlock(x.Text)
+		case *markdown.Text:
+			walkInlines(x.Inline)
+		}
+	}
+	walkInlines = func(inlines []markdown.Inline) {
+		for _, x := range inlines {
+			visit(x)
+			switch x := x.(type) {
+			case *markdown.Del:
+				walkInlines(x.Inner)
+			case *markdown.Emph:
+				walkInlines(x.Inner)
+			case *markdown.Strong:
+				walkInlines(x.Inner)
+			case *markdown.Link:
+				walkInlines(x.Inner)
+			}
+		}
+	}
+	walkBlock(doc)
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/markdown"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var playSnippets = map[string]string{
+	"/play/p/hello.go": "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n",
+	"/play/p/long.go":  strings.Repeat("// long\n", maxPlayLines+1),
+	"/play/p/huge.go":  strings.Repeat("x", maxPlayBytes+1),
+}
+
+func TestExpandPlayLinks(t *testing.T) {
+	var fetches []string
+	hc := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetches = append(fetches, req.URL.String())
+		src, ok := playSnippets[req.URL.Path]
+		if req.URL.Host != "go.dev" || !ok {
+			return &http.Response{StatusCode: 404, Status: "404 Not Found", Body: io.NopCloser(strings.NewReader("not found"))}, nil
+		}
+		return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader(src))}, nil
+	})}
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, nil, nil, "")
+	f.ExpandPlayLinks(hc)
+
+	in := "See <https://play.golang.org/p/hello> and [this](https://go.dev/play/p/hello).\n\n" +
+		"Also [long](https://go.dev/play/p/long) and [missing](https://go.dev/play/p/missing).\n"
+	want := in + "\nProgram from https://play.golang.org/p/hello:\n\n" +
+		"```go\npackage main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n```\n"
+	out, fixed := f.Fix(in)
+	if !fixed || out != want {
+		t.Fatalf("Fix:\nhave %q\nwant %q", out, want)
+	}
+	if len(fetches) != 3 {
+		t.Errorf("fetches = %v, want 3", fetches)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("invalid playground link")) || !bytes.Contains(buf.Bytes(), []byte("missing")) {
+		t.Errorf("missing snippet not logged:\n%s", buf.Bytes())
+	}
+
+	// Already expanded, using the cached programs.
+	// Only the failed download is tried again.
+	fetches = nil
+	if out, fixed := f.Fix(want); fixed {
+		t.Errorf("Fix of expanded text = %q, true, want no change", out)
+	}
+	if len(fetches) != 1 || !strings.HasSuffix(fetches[0], "/missing.go") {
+		t.Errorf("Fix of expanded text fetched %v, want only missing", fetches)
+	}
+
+	// Programs that are too large are skipped without a warning.
+	buf.Reset()
+	if out, fixed := f.Fix("See https://go.dev/play/p/huge.\n"); fixed {
+		t.Errorf("Fix of huge program = %q, true, want no change", out)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("invalid playground link")) {
+		t.Errorf("huge program logged as invalid:\n%s", buf.Bytes())
+	}
+}
+
+func TestExpandPlayLinksCancel(t *testing.T) {
+	hc := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, req.Context().Err()
+	})}
+	f := New(nil, nil, nil, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doc := (&markdown.Parser{AutoLinkText: true}).Parse("See https://go.dev/play/p/hello.\n")
+	if f.expandPlayRule(hc).doc(ctx, doc) {
+		t.Errorf("expandPlay with canceled context expanded link")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"context"
+
+	"rsc.io/markdown"
+)
+
+// A rule is a single rewrite rule in a Fixer.
+type rule struct {
+	fix      func(any, int) any                             // Markdown inline fix function, or nil
+	doc      func(context.Context, *markdown.Document) bool // Markdown document fix function, or nil
+	title    func(string) string                            // title fix function, or nil
+	projects map[string]bool                                // projects the rule applies to; nil means all
+	dryRun   bool                                           // only report what the rule would do
+}
+
+// A RuleOption configures a single rule added by
+// [Fixer.AutoLink], [Fixer.ReplaceText], [Fixer.ReplaceURL],
+// [Fixer.ReplaceWords], [Fixer.ReplaceTitle], or [Fixer.ExpandPlayLinks].
+type RuleOption func(*rule)
+
+// Projects restricts a rule to the named projects.
+// Each project must also be enabled using [Fixer.EnableProject];
+// Projects only narrows the set of enabled projects the rule applies to.
+// For example, to try a new rule only on rsc/tmp:
+//
+//	f.ReplaceText(`cancelled`, "canceled", commentfix.Projects("rsc/tmp"))
+func Projects(names ...string) RuleOption {
+	return func(r *rule) {
+		if r.projects == nil {
+			r.projects = make(map[string]bool)
+		}
+		for _, name := range names {
+			r.projects[name] = true
+		}
+	}
+}
+
+// DryRun marks a rule as dry-run only: [Fixer.Run] logs and prints
+// the edits the rule would make but does not make them,
+// even when edits are enabled using [Fixer.EnableEdits].
+// Other rules continue to edit as usual.
+// This makes it possible to trial a new rule while established rules keep running.
+func DryRun() RuleOption {
+	return func(r *rule) {
+		r.dryRun = true
+	}
+}
+
+// withOptions applies the options to r and returns r.
+func withOptions(r *rule, opts []RuleOption) *rule {
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// appliesTo reports whether r applies to the project.
+func (r *rule) appliesTo(project string) bool {
+	return r.projects == nil || r.projects[project]
+}
+
+// rulesFor returns the rules that apply to the project,
+// including the project's rules from the Fixer's [Config].
+// If dryRun is false, rulesFor omits dry-run rules.
+func (f *Fixer) rulesFor(project string, dryRun bool) []*rule {
+	var rules []*rule
+	for _, list := range [][]*rule{f.rules, f.configRules[project]} {
+		for _, r := range list {
+			if r.appliesTo(project) && (dryRun || !r.dryRun) {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestRuleOptions(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for _, project := range []string{"rsc/tmp", "rsc/big"} {
+		gh.Testing().AddIssue(project, &github.Issue{
+			Number:    1,
+			Title:     "pkg:title",
+			Body:      "Contexts are cancelled; see CL 123.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.SetTimeLimit(time.Time{})
+	f.EnableProject("rsc/tmp")
+	f.EnableProject("rsc/big")
+	f.EnableEdits()
+	f.ReplaceText("cancelled", "canceled")
+	f.AutoLink(`\bCL (\d+)\b`, "https://go.dev/cl/$1", Projects("rsc/tmp"))
+	f.ReplaceTitle(`^(\w+):(\S)`, "$1: $2", DryRun())
+	f.Run(ctx)
+
+	var out []string
+	for _, e := range gh.Testing().Edits() {
+		out = append(out, e.String())
+	}
+	want := []string{
+		`EditIssue(rsc/tmp#1, {"body":"Contexts are canceled; see [CL 123](https://go.dev/cl/123).\n"})`,
+		`EditIssue(rsc/big#1, {"body":"Contexts are canceled; see CL 123.\n"})`,
+	}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("edits:\n%s\nwant:\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+	if n := strings.Count(buf.String(), `commentfix dry run retitle`); n != 2 {
+		t.Fatalf("logged %d dry run retitles, want 2:\n%s", n, buf)
+	}
+
+	// Offline Fix ignores options.
+	if body, _ := f.Fix("CL 1"); body != "[CL 1](https://go.dev/cl/1)\n" {
+		t.Errorf("Fix ignored project-scoped rule: %q", body)
+	}
+	if title, _ := f.FixTitle("a:b"); title != "a: b" {
+		t.Errorf("FixTitle ignored dry-run rule: %q", title)
+	}
+}
+
+func TestConfigDryRun(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number:    1,
+		Title:     "title",
+		Body:      "Contexts are cancelled; see CL 123.",
+		CreatedAt: "2024-06-17T20:16:49-04:00",
+		UpdatedAt: "2024-06-17T20:16:49-04:00",
+	})
+
+	cfg, err := ParseConfig([]byte(`{"Projects": [{"Project": "rsc/tmp", "Rules": [
+		{"Kind": "ReplaceText", "Pattern": "cancelled", "Repl": "canceled"},
+		{"Kind": "AutoLink", "Pattern": "\\bCL (\\d+)\\b", "Repl": "https://go.dev/cl/$1", "DryRun": true}
+	]}]}`))
+	testutil.Check(t, err)
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.SetTimeLimit(time.Time{})
+	testutil.Check(t, f.SetConfig(cfg))
+	f.EnableEdits()
+	f.Run(ctx)
+
+	edits := gh.Testing().Edits()
+	if len(edits) != 1 || edits[0].IssueChanges.Body != "Contexts are canceled; see CL 123.\n" {
+		t.Fatalf("edits = %v, want one edit without link", edits)
+	}
+	if !strings.Contains(buf.String(), "commentfix dry run rewrite") || !strings.Contains(buf.String(), "go.dev/cl/123") {
+		t.Fatalf("dry run rule not logged:\n%s", buf)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ReplaceTitle instructs the fixer to rewrite issue titles,
+// replacing any text matching the regular expression pattern
+// with the replacement repl.
+// The replacement can contain substitution values like $1
+// as supported by [regexp.Regexp.Expand].
+//
+// Title rewriting is opt-in: a Fixer only edits titles
+// if ReplaceTitle has been called at least once.
+// When title rules are configured, the fixer also removes
+// leading and trailing white space from titles.
+// Titles are plain text, not Markdown, so the body rules
+// ([Fixer.AutoLink] and so on) never apply to titles.
+// Pull request titles are never edited.
+//
+// For example, to add the missing space in titles like “net/http:fix crash”,
+// you could use:
+//
+//	f.ReplaceTitle(`^([\w./]+):(\S)`, "$1: $2")
+func (f *Fixer) ReplaceTitle(pattern, repl string, opts ...RuleOption) error {
+	f.init()
+	title, err := replaceTitle(pattern, repl)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, withOptions(&rule{title: title}, opts))
+	return nil
+}
+
+// replaceTitle returns the title fix function for [Fixer.ReplaceTitle].
+func replaceTitle(pattern, repl string) (func(string) string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(title string) string {
+		return re.ReplaceAllString(title, repl)
+	}, nil
+}
+
+// FixTitle applies the configured title rewrites to the issue title.
+// If no rewrites apply, it returns "", false.
+// If any rewrites apply, it returns the updated title and true.
+// Like [Fixer.Fix], FixTitle ignores project restrictions and dry-run settings.
+func (f *Fixer) FixTitle(title string) (newTitle string, fixed bool) {
+	return fixTitle(f.rules, title)
+}
+
+// fixTitle applies the title rules to title.
+func fixTitle(rules []*rule, title string) (newTitle string, fixed bool) {
+	newTitle = strings.TrimSpace(title)
+	haveRules := false
+	for _, r := range rules {
+		if r.title != nil {
+			newTitle = r.title(newTitle)
+			haveRules = true
+		}
+	}
+	if !haveRules {
+		return "", false
+	}
+	newTitle = strings.TrimSpace(newTitle)
+	if newTitle == title || newTitle == "" {
+		return "", false
+	}
+	return newTitle, true
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var titleTests = []struct {
+	in  string
+	out string // "" means unchanged
+}{
+	{"net/http:fix crash", "net/http: fix crash"},
+	{"net/http: fix crash  ", "net/http: fix crash"},
+	{"  x/tools/gopls:crash ", "x/tools/gopls: crash"},
+	{"net/http: fix crash", ""},
+	{"crash in net/http", ""},
+	{"   ", ""},
+}
+
+func TestFixTitle(t *testing.T) {
+	var f Fixer
+	if title, fixed := f.FixTitle("  no rules  "); fixed {
+		t.Errorf("FixTitle with no rules = %q, true, want no change", title)
+	}
+
+	testutil.Check(t, f.ReplaceTitle(`^([\w./]+):(\S)`, "$1: $2"))
+	for _, tt := range titleTests {
+		out, fixed := f.FixTitle(tt.in)
+		if out != tt.out || fixed != (tt.out != "") {
+			t.Errorf("FixTitle(%q) = %q, %v, want %q, %v", tt.in, out, fixed, tt.out, tt.out != "")
+		}
+	}
+
+	if err := f.ReplaceTitle(`\`, ""); err == nil {
+		t.Errorf("ReplaceTitle succeeded on bad regexp")
+	}
+}
+
+func TestRunTitle(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for _, issue := range []*github.Issue{
+		{Number: 1, Title: "net/http:fix crash", Body: "Contexts are cancelled."},
+		{Number: 2, Title: "net/http:title only", Body: "Nothing to fix."},
+		{Number: 3, Title: "net/http:pull request", Body: "Nothing to fix.", PullRequest: new(struct{})},
+	} {
+		issue.CreatedAt = "2024-06-17T20:16:49-04:00"
+		issue.UpdatedAt = "2024-06-17T20:16:49-04:00"
+		gh.Testing().AddIssue("rsc/tmp", issue)
+	}
+
+	lg, buf := testutil.SlogBuffer()
+	f := New(lg, db, gh, "fixer")
+	f.SetStderr(testutil.LogWriter(t))
+	f.SetTimeLimit(time.Time{})
+	f.EnableProject("rsc/tmp")
+	f.ReplaceText("cancelled", "canceled")
+	f.ReplaceTitle(`^([\w./]+):(\S)`, "$1: $2")
+
+	// Dry run logs the title change but does not edit.
+	f.Run(ctx)
+	if !strings.Contains(buf.String(), `commentfix retitle`) || !strings.Contains(buf.String(), `new="net/http: fix crash"`) {
+		t.Fatalf("logs do not mention retitle:\n%s", buf)
+	}
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("dry run made edits: %v", edits)
+	}
+
+	f.EnableEdits()
+	f.Run(ctx)
+	var out []string
+	for _, e := range gh.Testing().Edits() {
+		out = append(out, e.String())
+	}
+	want := []string{
+		`EditIssue(rsc/tmp#1, {"title":"net/http: fix crash","body":"Contexts are canceled.\n"})`,
+		`EditIssue(rsc/tmp#2, {"title":"net/http: title only"})`,
+	}
+	if strings.Join(out, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("edits:\n%s\nwant:\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This file stores the following key schema in the database:
+//
+//	["commentfix.Edit", Name, Project, Time, URL] => JSON of editRecord
+//
+// Name is the Fixer name passed to [New],
+// Time is the time of the edit, in Unix nanoseconds,
+// and URL is the API URL of the edited issue or comment.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "commentfix.Edit", Key: "Name, Project, Time, URL", Val: "JSON of editRecord"},
+	)
+}
+
+// An editRecord records a single edit made by a Fixer.
+type editRecord struct {
+	Project  string
+	Issue    int64
+	URL      string // API URL of issue or comment
+	Comment  bool   // URL is a comment, not an issue
+	Time     time.Time
+	OldTitle string `json:",omitempty"`
+	NewTitle string `json:",omitempty"` // "" if title unchanged
+	OldBody  string
+	NewBody  string `json:",omitempty"` // "" if body unchanged
+	Undone   bool   `json:",omitempty"`
+}
+
+// recordEdit records in the database that the Fixer
+// is about to change ic to have the given title and body.
+// An empty title or body means that part is unchanged.
+func (f *Fixer) recordEdit(e *github.Event, ic *issueOrComment, title, body string) {
+	r := &editRecord{
+		Project:  e.Project,
+		Issue:    e.Issue,
+		URL:      ic.url(),
+		Comment:  ic.comment != nil,
+		Time:     f.now(),
+		OldTitle: ic.title(),
+		NewTitle: title,
+		OldBody:  ic.body(),
+		NewBody:  body,
+	}
+	f.db.Set(ordered.Encode("commentfix.Edit", f.name, e.Project, r.Time.UnixNano(), r.URL), storage.JSON(r))
+}
+
+// An Edit describes an edit made by a Fixer, for display to people.
+type Edit struct {
+	Project string
+	Issue   int64
+	URL     string // API URL of issue or comment
+	Time    time.Time
+	Diff    string // diff of title and body changes
+	Undone  bool   // reverted by [Fixer.Undo]
+}
+
+// Edits returns an iterator over the edits that Fixers
+// with the given name made in the project at or after the time since,
+// oldest first.
+func Edits(db storage.DB, name, project string, since time.Time) iter.Seq[*Edit] {
+	return func(yield func(*Edit) bool) {
+		start := ordered.Encode("commentfix.Edit", name, project, since.UnixNano())
+		end := ordered.Encode("commentfix.Edit", name, project, ordered.Inf)
+		for key, val := range db.Scan(start, end) {
+			var r editRecord
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("commentfix edit decode", "key", storage.Fmt(key), "err", err)
+			}
+			e := &Edit{
+				Project: r.Project,
+				Issue:   r.Issue,
+				URL:     r.URL,
+				Time:    r.Time,
+				Undone:  r.Undone,
+			}
+			if r.NewTitle != "" {
+				e.Diff += bodyDiff(r.OldTitle, r.NewTitle)
+			}
+			if r.NewBody != "" {
+				e.Diff += bodyDiff(r.OldBody, r.NewBody)
+			}
+			if !yield(e) {
+				return
+			}
+		}
+	}
+}
+
+// Undo reverts the edits that this Fixer (more precisely, any Fixer
+// with the same name) made in the project at or after the time since,
+// restoring the original issue titles and bodies and comment bodies.
+// Undo is meant for recovering from a rule that misfired:
+// remove or fix the rule and then call Undo.
+//
+// Undo reverts the edits newest first, so that a sequence of edits
+// to the same issue or comment is unwound back to its original text.
+// It only reverts an edit if the issue or comment
+// has not been changed again since the Fixer edited it
+// (or since Undo reverted a later edit);
+// otherwise it logs the conflict and leaves the issue or comment alone.
+// Each edit is reverted at most once.
+//
+// Like [Fixer.Run], if [Fixer.EnableEdits] has not been called,
+// Undo only prints what it would do.
+// Undo returns the number of edits reverted (or that would be reverted).
+func (f *Fixer) Undo(project string, since time.Time) int {
+	if f.github == nil {
+		panic("commentfix.Fixer: Undo missing GitHub client")
+	}
+	type keyedRecord struct {
+		key []byte
+		r   *editRecord
+	}
+	var records []keyedRecord
+	start := ordered.Encode("commentfix.Edit", f.name, project, since.UnixNano())
+	end := ordered.Encode("commentfix.Edit", f.name, project, ordered.Inf)
+	for key, val := range f.db.Scan(start, end) {
+		var r editRecord
+		if err := json.Unmarshal(val(), &r); err != nil {
+			// unreachable unless corrupt storage
+			f.db.Panic("commentfix edit decode", "key", storage.Fmt(key), "err", err)
+		}
+		if !r.Undone {
+			records = append(records, keyedRecord{slices.Clone(key), &r})
+		}
+	}
+
+	// live holds the current state of each issue or comment,
+	// updated as edits are reverted.
+	live := make(map[string]*issueOrComment)
+	n := 0
+	for _, kr := range slices.Backward(records) {
+		if f.undo(kr.r, live) {
+			n++
+			if f.edit {
+				kr.r.Undone = true
+				f.db.Set(kr.key, storage.JSON(kr.r))
+			}
+		}
+	}
+	return n
+}
+
+// undo reverts the single edit r, reporting whether it did (or would).
+// The map live holds the issues and comments already downloaded by Undo;
+// undo adds to it and updates it to reflect the reversion.
+func (f *Fixer) undo(r *editRecord, live map[string]*issueOrComment) bool {
+	ic := live[r.URL]
+	if ic == nil {
+		var err error
+		if r.Comment {
+			ic, err = (&issueOrComment{comment: &github.IssueComment{URL: r.URL}}).download(f.github)
+		} else {
+			ic, err = (&issueOrComment{issue: &github.Issue{URL: r.URL}}).download(f.github)
+		}
+		if err != nil {
+			// unreachable unless github error
+			f.slog.Error("commentfix undo download error", "project", r.Project, "issue", r.Issue, "url", r.URL, "err", err)
+			return false
+		}
+		live[r.URL] = ic
+	}
+	if r.NewBody != "" && ic.body() != r.NewBody || r.NewTitle != "" && ic.title() != r.NewTitle {
+		f.slog.Info("commentfix undo conflict", "project", r.Project, "issue", r.Issue, "url", r.URL)
+		return false
+	}
+
+	var title, body, diff, words string
+	if r.NewTitle != "" {
+		title = r.OldTitle
+		diff += bodyDiff(ic.title(), title)
+		words += bodyWords(ic.title(), title)
+	}
+	if r.NewBody != "" {
+		body = r.OldBody
+		diff += bodyDiff(ic.body(), body)
+		words += bodyWords(ic.body(), body)
+	}
+	f.slog.Info("commentfix undo", "project", r.Project, "issue", r.Issue, "url", r.URL, "edit", f.edit, "diff", diff, "words", words)
+	fmt.Fprintf(f.stderr(), "Undo %s:\n%s\n", r.URL, diff)
+	if f.edit {
+		action := ordered.Encode("commentfix.Undo", f.name, r.URL, r.Time.UnixNano())
+		if storage.BeginAction(f.db, action) {
+			if err := ic.edit(f.github, title, body); err != nil {
+				// unreachable unless github error
+				f.slog.Error("commentfix undo edit", "project", r.Project, "issue", r.Issue, "url", r.URL, "err", err)
+				storage.CancelAction(f.db, action)
+				return false
+			}
+			storage.FinishAction(f.db, action, nil)
+		} else {
+			f.slog.Info("commentfix undo already done", "project", r.Project, "issue", r.Issue, "url", r.URL)
+		}
+	}
+	ic.setText(title, body)
+	return true
+}
+
+// setText sets the title and body of ic,
+// as they would be after ic.edit(gh, title, body).
+// An empty title or body means that part is unchanged.
+func (ic *issueOrComment) setText(title, body string) {
+	if ic.issue != nil {
+		if title != "" {
+			ic.issue.Title = title
+		}
+		if body != "" {
+			ic.issue.Body = body
+		}
+		return
+	}
+	if body != "" {
+		ic.comment.Body = body
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestUndo(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	for _, n := range []int64{1, 2} {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+			Number:    n,
+			Title:     "spellchecking",
+			Body:      "Contexts are cancelled.",
+			CreatedAt: "2024-06-17T20:16:49-04:00",
+			UpdatedAt: "2024-06-17T20:16:49-04:00",
+		})
+	}
+
+	start := time.Now()
+	newFixer := func() *Fixer {
+		f := New(testutil.Slogger(t), db, gh, "fixer")
+		f.SetStderr(testutil.LogWriter(t))
+		f.EnableProject("rsc/tmp")
+		f.ReplaceText("cancelled", "canceled")
+		f.SetTimeLimit(time.Time{})
+		return f
+	}
+	f := newFixer()
+	f.EnableEdits()
+	f.Run(ctx)
+	if n := len(gh.Testing().Edits()); n != 2 {
+		t.Fatalf("Run made %d edits, want 2", n)
+	}
+	gh.Testing().ClearEdits()
+
+	// Simulate the edit of issue 1 arriving in the next sync.
+	// Issue 2 was edited by someone else (still has the old body),
+	// so it must not be reverted.
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number:    1,
+		Title:     "spellchecking",
+		Body:      "Contexts are canceled.\n",
+		CreatedAt: "2024-06-17T20:16:49-04:00",
+		UpdatedAt: "2024-06-17T20:16:49-04:00",
+	})
+
+	if n := f.Undo("rsc/other", start); n != 0 {
+		t.Errorf("Undo(rsc/other) = %d, want 0", n)
+	}
+	if n := f.Undo("rsc/tmp", time.Now()); n != 0 {
+		t.Errorf("Undo(rsc/tmp, now) = %d, want 0", n)
+	}
+
+	// Dry run.
+	if n := newFixer().Undo("rsc/tmp", start); n != 1 {
+		t.Errorf("dry run Undo = %d, want 1", n)
+	}
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("dry run Undo made edits: %v", edits)
+	}
+
+	if n := f.Undo("rsc/tmp", start); n != 1 {
+		t.Errorf("Undo = %d, want 1", n)
+	}
+	edits := gh.Testing().Edits()
+	want := `EditIssue(rsc/tmp#1, {"body":"Contexts are cancelled."})`
+	if len(edits) != 1 || edits[0].String() != want {
+		t.Fatalf("Undo edits = %v, want [%s]", edits, want)
+	}
+
+	// Undo does not revert the same edit twice.
+	if n := f.Undo("rsc/tmp", start); n != 0 {
+		t.Errorf("second Undo = %d, want 0", n)
+	}
+
+	var undone []int64
+	for e := range Edits(db, "fixer", "rsc/tmp", start) {
+		if !strings.Contains(e.Diff, "+Contexts are canceled.") {
+			t.Errorf("Edit %s Diff missing change:\n%s", e.URL, e.Diff)
+		}
+		if e.Undone {
+			undone = append(undone, e.Issue)
+		}
+	}
+	if !slices.Equal(undone, []int64{1}) {
+		t.Errorf("undone edits = %v, want [1]", undone)
+	}
+}
+
+func TestUndoChain(t *testing.T) {
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	issue := &github.Issue{
+		Number:    1,
+		Title:     "colour",
+		Body:      "Contexts are cancelled.",
+		CreatedAt: "2024-06-17T20:16:49-04:00",
+		UpdatedAt: "2024-06-17T20:16:49-04:00",
+	}
+	gh.Testing().AddIssue("rsc/tmp", issue)
+
+	// Fix the body, then, after a sync, the title.
+	start := time.Now()
+	var stderr strings.Builder
+	f := New(testutil.Slogger(t), db, gh, "fixer")
+	f.SetStderr(&stderr)
+	f.EnableProject("rsc/tmp")
+	f.EnableEdits()
+	f.SetTimeLimit(time.Time{})
+	f.ReplaceText("cancelled", "canceled")
+	f.Run(ctx)
+	edits := gh.Testing().Edits()
+	if len(edits) != 1 {
+		t.Fatalf("first Run made %d edits, want 1", len(edits))
+	}
+	gh.Testing().ClearEdits()
+	fixedBody := edits[0].IssueChanges.Body
+	issue.Body = fixedBody
+	issue.UpdatedAt = "2024-06-18T20:16:49-04:00"
+	gh.Testing().AddIssue("rsc/tmp", issue)
+
+	f.ReplaceTitle("colour", "color")
+	f.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 1 || edits[0].IssueChanges.Title != "color" {
+		t.Fatalf("second Run edits = %v, want title fix", edits)
+	}
+	gh.Testing().ClearEdits()
+	issue.Title = "color"
+	issue.UpdatedAt = "2024-06-19T20:16:49-04:00"
+	gh.Testing().AddIssue("rsc/tmp", issue)
+
+	// Undo reverts the title fix and then the body fix.
+	stderr.Reset()
+	if n := f.Undo("rsc/tmp", start); n != 2 {
+		t.Errorf("Undo = %d, want 2", n)
+	}
+	var have []string
+	for _, e := range gh.Testing().Edits() {
+		have = append(have, e.String())
+	}
+	want := []string{
+		`EditIssue(rsc/tmp#1, {"title":"colour"})`,
+		`EditIssue(rsc/tmp#1, {"body":"Contexts are cancelled."})`,
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Undo edits = %q, want %q", have, want)
+	}
+
+	// Each undo shows the diff of only the fields it changes.
+	undos := strings.Split(stderr.String(), "Undo ")[1:]
+	if len(undos) != 2 ||
+		!strings.Contains(undos[0], "+colour") || strings.Contains(undos[0], "Contexts") ||
+		!strings.Contains(undos[1], "+Contexts are cancelled.") || strings.Contains(undos[1], "colo") {
+		t.Errorf("Undo output:\n%s\nwant title diff, then body diff", stderr.String())
+	}
+}
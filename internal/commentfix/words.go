@@ -0,0 +1,163 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"rsc.io/markdown"
+)
+
+// ReplaceWords instructs the fixer to replace whole words
+// according to the table, which maps each old word to its replacement.
+// Matching is case-sensitive: a table entry “Javascript” → “JavaScript”
+// does not apply to “javascript”.
+//
+// Like [Fixer.ReplaceText], ReplaceWords only applies in Markdown plain text.
+// A match must be a whole word, not part of a larger word,
+// and it must not be part of a path, domain name, or identifier,
+// so that “golang” → “Go” rewrites “golang is fun” but not
+// “golang.org/x/tools”, “golang/go”, or “golang-nuts”.
+//
+// Using ReplaceWords is more efficient and easier to maintain
+// than many separate calls to ReplaceText.
+// See [Fixer.ReplaceWordsFile] for loading the table from a file.
+func (f *Fixer) ReplaceWords(table map[string]string, opts ...RuleOption) error {
+	f.init()
+	fix, err := replaceWords(table)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, withOptions(&rule{fix: fix}, opts))
+	return nil
+}
+
+// ReplaceWordsFile is like [Fixer.ReplaceWords]
+// but reads the table from the named file.
+// Each non-blank line in the file holds an old word and its replacement,
+// separated by “→” or white space, as in:
+//
+//	# British to American spelling.
+//	cancelled → canceled
+//	cancelling → canceling
+//	Javascript JavaScript
+//
+// Lines beginning with # are comments.
+func (f *Fixer) ReplaceWordsFile(file string, opts ...RuleOption) error {
+	table, err := readWords(file)
+	if err != nil {
+		return err
+	}
+	return f.ReplaceWords(table, opts...)
+}
+
+// readWords reads and parses the named ReplaceWordsFile file.
+func readWords(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseWords(file, string(data))
+}
+
+// parseWords parses the text of a ReplaceWordsFile file.
+func parseWords(file, text string) (map[string]string, error) {
+	table := make(map[string]string)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.Replace(line, "→", " ", 1))
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed line: %s", file, i+1, line)
+		}
+		if _, ok := table[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate word %s", file, i+1, fields[0])
+		}
+		table[fields[0]] = fields[1]
+	}
+	return table, nil
+}
+
+// wordRE matches a valid ReplaceWords table key.
+var wordRE = regexp.MustCompile(`\A\w(.*\w)?\z`)
+
+// replaceWords returns the fix function for [Fixer.ReplaceWords].
+func replaceWords(table map[string]string) (func(any, int) any, error) {
+	if len(table) == 0 {
+		return nil, fmt.Errorf("empty word table")
+	}
+	var words []string
+	for w := range table {
+		if !wordRE.MatchString(w) {
+			return nil, fmt.Errorf("invalid word %q", w)
+		}
+		words = append(words, regexp.QuoteMeta(w))
+	}
+	// Sort longest first so that the regexp prefers the longest match.
+	slices.SortFunc(words, func(x, y string) int {
+		if len(x) != len(y) {
+			return len(y) - len(x)
+		}
+		return strings.Compare(x, y)
+	})
+	re := regexp.MustCompile(`\b(?:` + strings.Join(words, "|") + `)\b`)
+
+	return func(x any, flags int) any {
+		plain, ok := x.(*markdown.Plain)
+		if !ok {
+			return nil
+		}
+		text := plain.Text
+		var out []byte
+		start := 0
+		for _, m := range re.FindAllStringIndex(text, -1) {
+			if !isWordAlone(text, m[0], m[1]) {
+				continue
+			}
+			out = append(out, text[start:m[0]]...)
+			out = append(out, table[text[m[0]:m[1]]]...)
+			start = m[1]
+		}
+		if start == 0 {
+			return nil
+		}
+		out = append(out, text[start:]...)
+		plain.Text = string(out)
+		return plain
+	}, nil
+}
+
+// isWordAlone reports whether the word text[i:j] stands alone
+// as prose, as opposed to being part of a path (golang/go),
+// domain name (golang.org), or hyphenated name (golang-nuts).
+// Trailing punctuation is allowed when it ends the word (“cancelled.”).
+func isWordAlone(text string, i, j int) bool {
+	if i > 0 {
+		r, _ := utf8.DecodeLastRuneInString(text[:i])
+		if strings.ContainsRune("./-_@", r) {
+			return false
+		}
+	}
+	if j < len(text) {
+		r, size := utf8.DecodeRuneInString(text[j:])
+		if strings.ContainsRune("/_@", r) {
+			return false
+		}
+		if strings.ContainsRune(".-", r) && j+size < len(text) {
+			r, _ := utf8.DecodeRuneInString(text[j+size:])
+			if r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				return false
+			}
+		}
+	}
+	return true
+}
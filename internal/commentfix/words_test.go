@@ -0,0 +1,76 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commentfix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/testutil"
+)
+
+var wordsFile = `# Test words.
+cancelled → canceled
+Javascript JavaScript
+
+golang → Go
+`
+
+var wordsTests = []struct {
+	in  string
+	out string // "" means unchanged
+}{
+	{"The context was cancelled.", "The context was canceled.\n"},
+	{"cancelled, cancelled; Cancelled", "canceled, canceled; Cancelled\n"},
+	{"Javascript and javascript", "JavaScript and javascript\n"},
+	{"I like golang.", "I like Go.\n"},
+	{"See golang.org/x/tools and golang/go.", ""},
+	{"Ask on golang-nuts or golang-dev.", ""},
+	{"The uncancelled and cancelledness contexts.", ""},
+	{"Call `cancelled()` in code.", ""},
+	{"Read [golang docs](https://golang.org/doc).", "Read [Go docs](https://golang.org/doc).\n"},
+	{"**golang** is great", "**Go** is great\n"},
+}
+
+func TestReplaceWords(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "words.txt")
+	testutil.Check(t, os.WriteFile(file, []byte(wordsFile), 0666))
+
+	var f Fixer
+	testutil.Check(t, f.ReplaceWordsFile(file))
+	for _, tt := range wordsTests {
+		out, fixed := f.Fix(tt.in)
+		if out != tt.out || fixed != (tt.out != "") {
+			t.Errorf("Fix(%q) = %q, %v, want %q, %v", tt.in, out, fixed, tt.out, tt.out != "")
+		}
+	}
+}
+
+func TestReplaceWordsErrors(t *testing.T) {
+	var f Fixer
+	for _, table := range []map[string]string{
+		nil,
+		{"": "x"},
+		{"go/": "Go"},
+	} {
+		if err := f.ReplaceWords(table); err == nil {
+			t.Errorf("ReplaceWords(%v) succeeded, want error", table)
+		}
+	}
+
+	for _, tt := range []struct{ text, err string }{
+		{"a b c\n", "x.txt:1: malformed line"},
+		{"# ok\na b\na c\n", "x.txt:3: duplicate word a"},
+	} {
+		if _, err := parseWords("x.txt", tt.text); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseWords(%q): err = %v, want %q", tt.text, err, tt.err)
+		}
+	}
+	if err := f.ReplaceWordsFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("ReplaceWordsFile(missing) succeeded")
+	}
+}
@@ -0,0 +1,996 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package config defines Gaby's declarative configuration:
+// which subsystems run, on which projects, and with what policies.
+//
+// A [Config] is usually written as a JSON file and loaded with [Load].
+// Keeping policy in data instead of in the program means it can be
+// reviewed, validated, and changed without rebuilding Gaby,
+// and eventually edited by an LLM acting on a maintainer's behalf.
+//
+// A nil subsystem section means that subsystem does not run.
+// Subsystems that can write to GitHub run in dry-run mode
+// unless their section enables writing, with Posts or Edits
+// and the configuration is not in observe-only mode
+// (see [Config.ObserveOnly]).
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/commentfix"
+	"rsc.io/gaby/internal/needinfo"
+	"rsc.io/gaby/internal/owners"
+	"rsc.io/gaby/internal/related"
+)
+
+// A Config is a complete Gaby configuration.
+type Config struct {
+	// ObserveOnly puts Gaby in observe-only (“gabysitter”) mode,
+	// in which every subsystem that can write to GitHub runs in dry-run mode,
+	// regardless of its own Posts or Edits setting.
+	ObserveOnly bool `json:",omitempty"`
+
+	// Interval is the default time to wait between runs of each task.
+	// The zero Interval means [DefaultInterval].
+	Interval Duration `json:",omitempty"`
+
+	// Schedules maps a task name (see [Config.Tasks])
+	// to the schedule for that task, overriding Interval.
+	Schedules map[string]*Schedule `json:",omitempty"`
+
+	// Budgets maps subsystem name to its daily LLM budget in US dollars.
+	// (See [rsc.io/gaby/internal/llmusage.Meter.SetDailyBudget].)
+	Budgets map[string]float64 `json:",omitempty"`
+
+	// Backends selects the implementations of the services Gaby uses.
+	// A nil Backends means the defaults.
+	Backends *Backends `json:",omitempty"`
+
+	// Orgs lists the GitHub organizations whose repositories
+	// are synced, in addition to any projects added directly
+	// (see [rsc.io/gaby/internal/github.Client.AddOrg]).
+	// An organization removed from the list is no longer listed,
+	// but its projects already added continue to be synced
+	// (see [rsc.io/gaby/internal/github.Client.RemoveOrg]).
+	Orgs []*Org `json:",omitempty"`
+
+	CommentFix *CommentFix `json:",omitempty"`
+	Related    *Related    `json:",omitempty"`
+	NeedInfo   *NeedInfo   `json:",omitempty"`
+	Summary    *Summary    `json:",omitempty"`
+	Owners     *Owners     `json:",omitempty"`
+	Commands   *Commands   `json:",omitempty"`
+	Flakes     *Flakes     `json:",omitempty"`
+	Milestone  *Milestone  `json:",omitempty"`
+	WaitInfo   *WaitInfo   `json:",omitempty"`
+	Priority   *Priority   `json:",omitempty"`
+	Themes     *Themes     `json:",omitempty"`
+	Approvals  *Approvals  `json:",omitempty"`
+	Prune      *Prune      `json:",omitempty"`
+	Backup     *Backup     `json:",omitempty"`
+}
+
+// DefaultInterval is the default interval between runs of a task.
+const DefaultInterval = 2 * time.Minute
+
+// SyncTasks lists the names of the tasks that sync
+// GitHub data and the document index.
+// They run before the subsystems' tasks, in this order.
+var SyncTasks = []string{"github", "githubdocs", "embeddocs", "crossref"}
+
+// An Org is a GitHub organization whose repositories are synced.
+type Org struct {
+	Org     string // organization name ("golang")
+	Pattern string `json:",omitempty"` // regular expression matching repository names; empty matches all
+}
+
+// A Schedule configures when a task runs
+// (see [rsc.io/gaby/internal/sched.Task]).
+type Schedule struct {
+	Interval  Duration `json:",omitempty"` // time between runs; 0 means [Config.Interval]
+	Jitter    Duration `json:",omitempty"` // maximum random delay added to Interval
+	Singleton bool     `json:",omitempty"` // run only in the leader replica (see sched.Task.Singleton)
+
+	// StuckAfter is how long a run can take before it is reported as stuck;
+	// 0 means the scheduler's default (see sched.Task.StuckAfter).
+	StuckAfter  Duration `json:",omitempty"`
+	CancelStuck bool     `json:",omitempty"` // cancel stuck runs (see sched.Task.CancelStuck)
+}
+
+// CommentFix configures a [commentfix.Fixer].
+// The embedded [commentfix.Config] lists the projects and their rules.
+type CommentFix struct {
+	Name  string // name passed to [commentfix.New]
+	Edits bool   // edit issues and comments (see [commentfix.Fixer.EnableEdits])
+	commentfix.Config
+}
+
+// Related configures a [related.Poster].
+// The embedded [related.Config] lists the projects and posting policy,
+// which replaces the Poster's stored configuration
+// each time the subsystems are created from the configuration
+// (see [related.Poster.SetConfig]).
+type Related struct {
+	Name  string // name passed to [related.New]
+	Posts bool   // post comments (see [related.Poster.EnablePosts])
+	related.Config
+}
+
+// NeedInfo configures a [needinfo.Checker].
+type NeedInfo struct {
+	Name            string   // name passed to [needinfo.New]
+	Posts           bool     `json:",omitempty"` // see [needinfo.Checker.EnablePosts]
+	Projects        []string // see [needinfo.Checker.EnableProject]
+	Requirements    string   // requirement set for all projects; see [Requirements]
+	SkipTitlePrefix []string `json:",omitempty"` // see [needinfo.Checker.SkipTitlePrefix]
+}
+
+// Requirements maps the names usable in [NeedInfo.Requirements]
+// to the corresponding requirement sets.
+var Requirements = map[string][]*needinfo.Requirement{
+	"go": needinfo.GoRequirements,
+}
+
+// Summary configures a [rsc.io/gaby/internal/summary.Summarizer],
+// which summarizes issues on request, automatically, or both.
+type Summary struct {
+	Name         string   // name passed to summary.New
+	Posts        bool     `json:",omitempty"` // see summary.Summarizer.EnablePosts
+	Projects     []string // see summary.Summarizer.EnableProject
+	AutoComments int      `json:",omitempty"` // see summary.Summarizer.SetAutoComments; 0 means no automatic summaries
+
+	// Command is the comment line asking for a summary,
+	// such as "@gabyhelp summarize", and Maintainers lists
+	// the GitHub users allowed to use it
+	// (see summary.Summarizer.EnableCommand).
+	// If Command is empty, issues are only summarized automatically
+	// or by the "summarize" command (see [Commands]).
+	Command     string   `json:",omitempty"`
+	Maintainers []string `json:",omitempty"`
+}
+
+// Owners configures an [owners.Router].
+type Owners struct {
+	Name            string   // name passed to [owners.New]
+	Posts           bool     `json:",omitempty"` // see [owners.Router.EnablePosts]
+	Apply           bool     `json:",omitempty"` // assign and label instead of suggesting; see [owners.Router.EnableApply]
+	MaxAssignees    int      `json:",omitempty"` // see [owners.Router.SetMaxAssignees]; 0 means the default
+	SkipTitlePrefix []string `json:",omitempty"` // see [owners.Router.SkipTitlePrefix]
+
+	// Projects maps each project to its owners file,
+	// package root, and area labels (see [owners.Router.EnableProject]).
+	Projects map[string]*owners.Config
+}
+
+// Commands configures a [rsc.io/gaby/internal/commands.Dispatcher]
+// running the commands that people issue in GitHub issue comments,
+// such as "@gabyhelp related" (see [CommandNames]).
+type Commands struct {
+	Name  string // name passed to commands.New
+	Edits bool   `json:",omitempty"` // see commands.Dispatcher.EnableCommands
+	Bot   string // GitHub user to address commands to, as in "@gabyhelp related"
+
+	// Allow maps a project to a map from command name
+	// to the GitHub users allowed to issue that command in the project's issues.
+	// The command name "*" allows the users to issue any command.
+	Allow map[string]map[string][]string
+}
+
+// CommandNames lists the commands that can be allowed
+// in [Commands.Allow]: "related" posts related documents,
+// which requires a [Related] section; "summarize" posts a summary,
+// which requires a [Summary] section; and "label" adds or removes labels.
+var CommandNames = []string{"related", "summarize", "label"}
+
+// Flakes configures a [rsc.io/gaby/internal/flakes.Tracker].
+type Flakes struct {
+	Name     string   // name passed to flakes.New
+	Posts    bool     `json:",omitempty"` // see flakes.Tracker.EnablePosts
+	Projects []string // see flakes.Tracker.EnableProject
+	MinScore float64  `json:",omitempty"` // see flakes.Tracker.SetMinScore; 0 means the default
+}
+
+// Milestone configures a [rsc.io/gaby/internal/milestone.Suggester].
+type Milestone struct {
+	Name            string   // name passed to milestone.New
+	Posts           bool     `json:",omitempty"` // see milestone.Suggester.EnablePosts
+	Projects        []string // see milestone.Suggester.EnableProject
+	MinScore        float64  `json:",omitempty"` // see milestone.Suggester.SetMinScore; 0 means the default
+	SkipTitlePrefix []string `json:",omitempty"` // see milestone.Suggester.SkipTitlePrefix
+}
+
+// WaitInfo configures a [rsc.io/gaby/internal/waitinfo.Pinger].
+type WaitInfo struct {
+	Name     string   // name passed to waitinfo.New
+	Edits    bool     `json:",omitempty"` // see waitinfo.Pinger.EnableEdits
+	Projects []string // see waitinfo.Pinger.EnableProject
+}
+
+// Priority configures a [rsc.io/gaby/internal/priority.Scorer].
+type Priority struct {
+	Name     string   // name passed to priority.New
+	Projects []string // see priority.Scorer.EnableProject
+}
+
+// Themes configures a [rsc.io/gaby/internal/themes.Finder].
+// Unless [Config.Schedules] says otherwise,
+// the themes task runs every [DefaultThemesInterval].
+type Themes struct {
+	Name     string   // name passed to themes.New
+	Projects []string // see themes.Finder.EnableProject
+	Window   Duration `json:",omitempty"` // see themes.Finder.SetWindow; 0 means the default
+	MinSize  int      `json:",omitempty"` // see themes.Finder.SetMinSize; 0 means the default
+	MinScore float64  `json:",omitempty"` // see themes.Finder.SetMinScore; 0 means the default
+}
+
+// DefaultThemesInterval is the default interval between theme reports.
+const DefaultThemesInterval = 24 * time.Hour
+
+// Approvals configures an [rsc.io/gaby/internal/approval.Queue]
+// holding the actions of other subsystems that await a maintainer's approval.
+type Approvals struct {
+	Name   string   // name passed to approval.New
+	Edits  bool     `json:",omitempty"` // see approval.Queue.EnableEdits
+	Kinds  []string // kinds of actions requiring approval; see [ApprovalKinds]
+	Expiry Duration `json:",omitempty"` // see approval.Queue.SetExpiry; 0 means the default
+
+	// Bot is the GitHub user to address approval commands to,
+	// as in "@gabyhelp approve" (see [rsc.io/gaby/internal/commands.Approve]).
+	// If Bot is empty, proposals can only be decided in the admin interface.
+	Bot string `json:",omitempty"`
+
+	// Approvers maps a project to the GitHub users
+	// allowed to approve or reject proposals in its issues using commands.
+	Approvers map[string][]string `json:",omitempty"`
+}
+
+// ApprovalKinds lists the kinds of actions that can require approval
+// (see [Approvals.Kinds]).
+var ApprovalKinds = []string{"needinfo.Post", "related.DuplicateLabel", "waitinfo.Close"}
+
+// Prune configures the pruning of old GitHub events
+// (see [rsc.io/gaby/internal/github.Client.PruneEvents]).
+// Unless [Config.Schedules] says otherwise,
+// the prune task runs every [DefaultPruneInterval].
+type Prune struct {
+	Name     string   // name of the prune task
+	Projects []string // projects whose events are pruned
+
+	// Months is how old an event must be to be pruned;
+	// 0 means [DefaultPruneMonths].
+	Months int `json:",omitempty"`
+}
+
+// DefaultPruneInterval is the default interval between prunings.
+const DefaultPruneInterval = 24 * time.Hour
+
+// DefaultPruneMonths is the default age, in months, of pruned events.
+const DefaultPruneMonths = 3
+
+// Backup configures a [rsc.io/gaby/internal/backup.Backer],
+// which periodically backs up the database.
+// Unless [Config.Schedules] says otherwise,
+// the backup task runs every [DefaultBackupInterval].
+type Backup struct {
+	Name string // name of the backup task
+	Dest string // destination URL; see backup.Open
+
+	// Recent and Daily set the retention policy (see backup.Retention).
+	// If both are zero, the default policy is used.
+	Recent int `json:",omitempty"`
+	Daily  int `json:",omitempty"`
+}
+
+// DefaultBackupInterval is the default interval between backups.
+const DefaultBackupInterval = 24 * time.Hour
+
+// Backends selects the storage, LLM, and secret implementations.
+// Unlike the rest of the configuration, the backends are chosen
+// once, when Gaby starts: changing them in a running Gaby
+// (for example, in the admin interface) takes effect at the next restart.
+// Gaby's command-line flags, such as -vertexai, override these settings.
+type Backends struct {
+	// DB is the database: "pebble" (the default), for a Pebble database
+	// in the directory named by the -db flag, or "mem", for an in-memory
+	// database that is discarded when Gaby exits (for testing and demos).
+	DB string `json:",omitempty"`
+
+	// VectorDB is the vector database: "mem" (the default),
+	// for an in-memory index of vectors stored in the database
+	// (see [rsc.io/gaby/internal/storage.MemVectorDB]).
+	VectorDB string `json:",omitempty"`
+
+	// VectorNamespace is the vector database namespace holding
+	// the document embeddings; the default is "".
+	// Each namespace holds embeddings from only one model,
+	// so changing models means switching to a new namespace
+	// after filling it with “gaby reembed”.
+	VectorNamespace string `json:",omitempty"`
+
+	// LLM is the LLM service used for embeddings and text generation:
+	// "gemini" (the default), for the Gemini API;
+	// "vertexai", for Gemini on Vertex AI (see VertexAI);
+	// "openai", for the OpenAI API or a compatible server (see URL); or
+	// "ollama", for a local Ollama server, using its OpenAI-compatible API.
+	LLM string `json:",omitempty"`
+
+	// VertexAI is the Google Cloud "project/location" for the "vertexai" LLM.
+	VertexAI string `json:",omitempty"`
+
+	// URL is the base URL of the API for the "openai" and "ollama" LLMs,
+	// overriding the service's usual URL.
+	URL string `json:",omitempty"`
+
+	// EmbedModel and TextModel override the LLM's default
+	// embedding and text generation models.
+	// The "vertexai" LLM does not support changing models.
+	EmbedModel string `json:",omitempty"`
+	TextModel  string `json:",omitempty"`
+
+	// EmbedDim shortens Gemini embeddings to EmbedDim dimensions.
+	// Only the "gemini" LLM supports EmbedDim.
+	EmbedDim int `json:",omitempty"`
+
+	// EmbedWorkers is the number of batches of documents to embed
+	// concurrently, within the LLM's rate limits and daily budget;
+	// 0 means the default (see rsc.io/gaby/internal/embeddocs.Syncer.SetConcurrency).
+	EmbedWorkers int `json:",omitempty"`
+
+	// Compress enables zstd compression of large GitHub events and
+	// documents as they are written to the database
+	// (see [rsc.io/gaby/internal/storage.Compress]).
+	// Values written with and without compression can be mixed,
+	// so Compress can be changed at any time;
+	// it only affects values written afterward.
+	Compress bool `json:",omitempty"`
+
+	// Secrets lists the sources of secrets, in decreasing precedence.
+	// Each source is "env", for environment variables beginning with GABY_SECRET_;
+	// "netrc", for $HOME/.netrc; "file:path", for a JSON file;
+	// or "store:path", for an encrypted file that Gaby can also write
+	// (see [rsc.io/gaby/internal/secret]).
+	// If Secrets is empty, or the -secrets or -secretstore flag is given,
+	// the sources are chosen by the flags instead.
+	Secrets []string `json:",omitempty"`
+}
+
+// A Duration is a [time.Duration] written in JSON
+// as a string such as "2m" or "1h30m".
+type Duration time.Duration
+
+// MarshalJSON returns the JSON string form of d.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses the JSON string form of a duration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2m\"")
+	}
+	t, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(t)
+	return nil
+}
+
+// Load reads, parses, and validates the configuration in the named file.
+func Load(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses and validates the JSON form of a configuration.
+// Unknown fields are errors, to catch misspellings.
+func Parse(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	cfg := new(Config)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// orgRE matches a GitHub organization name, such as "golang".
+var orgRE = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+
+// projectRE matches a GitHub project name, such as "golang/go".
+var projectRE = regexp.MustCompile(`^[A-Za-z0-9_.\-]+/[A-Za-z0-9_.\-]+$`)
+
+// secretSourceRE matches a secret source (see [Backends.Secrets]).
+var secretSourceRE = regexp.MustCompile(`^(env|netrc|(file|store):.+)$`)
+
+// backupDestRE matches a backup destination URL
+// (see [rsc.io/gaby/internal/backup.Open]).
+var backupDestRE = regexp.MustCompile(`^(/|file:///|gs://[^/]+|s3://[^/?]+.*[?&]region=)`)
+
+// Validate reports whether cfg is a valid configuration,
+// returning an error describing the first problem found, if any.
+func (cfg *Config) Validate() error {
+	if cfg.Interval != 0 && time.Duration(cfg.Interval) < time.Minute {
+		return fmt.Errorf("Interval %v is less than 1m", time.Duration(cfg.Interval))
+	}
+	for name, b := range cfg.Budgets {
+		if b < 0 {
+			return fmt.Errorf("Budgets: negative budget %v for %s", b, name)
+		}
+	}
+	if b := cfg.Backends; b != nil {
+		if err := b.validate(); err != nil {
+			return fmt.Errorf("Backends: %v", err)
+		}
+	}
+
+	orgs := make(map[string]bool)
+	for _, o := range cfg.Orgs {
+		if o == nil {
+			return fmt.Errorf("Orgs: missing organization")
+		}
+		if !orgRE.MatchString(o.Org) {
+			return fmt.Errorf("Orgs: invalid organization %q", o.Org)
+		}
+		if orgs[o.Org] {
+			return fmt.Errorf("Orgs: duplicate organization %q", o.Org)
+		}
+		orgs[o.Org] = true
+		if _, err := regexp.Compile(o.Pattern); err != nil {
+			return fmt.Errorf("Orgs: %s: %v", o.Org, err)
+		}
+	}
+
+	names := make(map[string]string)
+	for _, name := range SyncTasks {
+		names[name] = "built-in task"
+	}
+	checkName := func(section, name string) error {
+		if name == "" {
+			return fmt.Errorf("%s: missing Name", section)
+		}
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s: Name %q already used by %s", section, name, other)
+		}
+		names[name] = section
+		return nil
+	}
+	checkProjects := func(section string, projects []string) error {
+		for _, p := range projects {
+			if !projectRE.MatchString(p) {
+				return fmt.Errorf("%s: invalid project %q", section, p)
+			}
+		}
+		return nil
+	}
+	check := func(section, name string, projects []string, minScore float64) error {
+		if err := checkName(section, name); err != nil {
+			return err
+		}
+		if len(projects) == 0 {
+			return fmt.Errorf("%s: no Projects", section)
+		}
+		if err := checkProjects(section, projects); err != nil {
+			return err
+		}
+		if minScore < 0 || minScore > 1 {
+			return fmt.Errorf("%s: invalid MinScore %v", section, minScore)
+		}
+		return nil
+	}
+
+	if c := cfg.CommentFix; c != nil {
+		var projects []string
+		for _, p := range c.Projects {
+			projects = append(projects, p.Project)
+		}
+		if err := check("CommentFix", c.Name, projects, 0); err != nil {
+			return err
+		}
+		if err := c.Config.Validate(); err != nil {
+			return err
+		}
+	}
+	if c := cfg.Related; c != nil {
+		if err := check("Related", c.Name, c.Projects, c.MinScore); err != nil {
+			return err
+		}
+		if err := c.Config.Validate(); err != nil {
+			return err
+		}
+	}
+	if c := cfg.NeedInfo; c != nil {
+		if err := check("NeedInfo", c.Name, c.Projects, 0); err != nil {
+			return err
+		}
+		if _, ok := Requirements[c.Requirements]; !ok {
+			return fmt.Errorf("NeedInfo: unknown Requirements %q", c.Requirements)
+		}
+	}
+	if c := cfg.Summary; c != nil {
+		if err := check("Summary", c.Name, c.Projects, 0); err != nil {
+			return err
+		}
+		if c.AutoComments < 0 {
+			return fmt.Errorf("Summary: negative AutoComments %d", c.AutoComments)
+		}
+		if c.Command == "" && len(c.Maintainers) > 0 {
+			return fmt.Errorf("Summary: Maintainers set but no Command")
+		}
+		if c.Command != "" && len(c.Maintainers) == 0 {
+			return fmt.Errorf("Summary: Command set but no Maintainers")
+		}
+	}
+	if c := cfg.Owners; c != nil {
+		projects := slices.Sorted(maps.Keys(c.Projects))
+		if err := check("Owners", c.Name, projects, 0); err != nil {
+			return err
+		}
+		for _, p := range projects {
+			if c.Projects[p] == nil || c.Projects[p].OwnersFile == "" {
+				return fmt.Errorf("Owners: %s: missing OwnersFile", p)
+			}
+		}
+		if c.MaxAssignees < 0 {
+			return fmt.Errorf("Owners: negative MaxAssignees %d", c.MaxAssignees)
+		}
+	}
+	if c := cfg.Commands; c != nil {
+		if err := checkName("Commands", c.Name); err != nil {
+			return err
+		}
+		if c.Bot == "" {
+			return fmt.Errorf("Commands: missing Bot")
+		}
+		projects := slices.Sorted(maps.Keys(c.Allow))
+		if len(projects) == 0 {
+			return fmt.Errorf("Commands: no Allow")
+		}
+		if err := checkProjects("Commands", projects); err != nil {
+			return err
+		}
+		for _, p := range projects {
+			for _, cmd := range slices.Sorted(maps.Keys(c.Allow[p])) {
+				switch {
+				case cmd != "*" && !slices.Contains(CommandNames, cmd):
+					return fmt.Errorf("Commands: %s: unknown command %q", p, cmd)
+				case cmd == "related" && cfg.Related == nil:
+					return fmt.Errorf("Commands: %s: related command requires Related", p)
+				case cmd == "summarize" && cfg.Summary == nil:
+					return fmt.Errorf("Commands: %s: summarize command requires Summary", p)
+				}
+			}
+		}
+	}
+	if c := cfg.Flakes; c != nil {
+		if err := check("Flakes", c.Name, c.Projects, c.MinScore); err != nil {
+			return err
+		}
+	}
+	if c := cfg.Milestone; c != nil {
+		if err := check("Milestone", c.Name, c.Projects, c.MinScore); err != nil {
+			return err
+		}
+	}
+	if c := cfg.WaitInfo; c != nil {
+		if err := check("WaitInfo", c.Name, c.Projects, 0); err != nil {
+			return err
+		}
+	}
+	if c := cfg.Priority; c != nil {
+		if err := check("Priority", c.Name, c.Projects, 0); err != nil {
+			return err
+		}
+	}
+	if c := cfg.Themes; c != nil {
+		if err := check("Themes", c.Name, c.Projects, c.MinScore); err != nil {
+			return err
+		}
+		if c.Window < 0 {
+			return fmt.Errorf("Themes: negative Window %v", time.Duration(c.Window))
+		}
+		if c.MinSize < 0 {
+			return fmt.Errorf("Themes: negative MinSize %d", c.MinSize)
+		}
+	}
+	if c := cfg.Approvals; c != nil {
+		if err := checkName("Approvals", c.Name); err != nil {
+			return err
+		}
+		if c.Bot != "" {
+			if err := checkName("Approvals", c.Name+".commands"); err != nil {
+				return err
+			}
+			if len(c.Approvers) == 0 {
+				return fmt.Errorf("Approvals: Bot set but no Approvers")
+			}
+		}
+		if err := checkProjects("Approvals", slices.Sorted(maps.Keys(c.Approvers))); err != nil {
+			return err
+		}
+		for _, kind := range c.Kinds {
+			if !slices.Contains(ApprovalKinds, kind) {
+				return fmt.Errorf("Approvals: unknown kind %q", kind)
+			}
+		}
+		if c.Expiry < 0 {
+			return fmt.Errorf("Approvals: negative Expiry %v", time.Duration(c.Expiry))
+		}
+	}
+	if c := cfg.Prune; c != nil {
+		if err := check("Prune", c.Name, c.Projects, 0); err != nil {
+			return err
+		}
+		if c.Months < 0 {
+			return fmt.Errorf("Prune: negative Months %d", c.Months)
+		}
+	}
+	if c := cfg.Backup; c != nil {
+		if err := checkName("Backup", c.Name); err != nil {
+			return err
+		}
+		if !backupDestRE.MatchString(c.Dest) {
+			return fmt.Errorf("Backup: invalid Dest %q", c.Dest)
+		}
+		if c.Recent < 0 {
+			return fmt.Errorf("Backup: negative Recent %d", c.Recent)
+		}
+		if c.Daily < 0 {
+			return fmt.Errorf("Backup: negative Daily %d", c.Daily)
+		}
+	}
+
+	tasks := cfg.Tasks()
+	for _, name := range slices.Sorted(maps.Keys(cfg.Schedules)) {
+		sc := cfg.Schedules[name]
+		if !slices.Contains(tasks, name) {
+			return fmt.Errorf("Schedules: unknown task %q", name)
+		}
+		if sc == nil {
+			return fmt.Errorf("Schedules: missing schedule for %s", name)
+		}
+		if sc.Interval != 0 && time.Duration(sc.Interval) < time.Minute {
+			return fmt.Errorf("Schedules: %s: Interval %v is less than 1m", name, time.Duration(sc.Interval))
+		}
+		if sc.Jitter < 0 {
+			return fmt.Errorf("Schedules: %s: negative Jitter %v", name, time.Duration(sc.Jitter))
+		}
+		if sc.StuckAfter < 0 {
+			return fmt.Errorf("Schedules: %s: negative StuckAfter %v", name, time.Duration(sc.StuckAfter))
+		}
+	}
+	return nil
+}
+
+// validate reports whether b is valid,
+// returning an error describing the first problem found, if any.
+func (b *Backends) validate() error {
+	switch b.DB {
+	case "", "pebble", "mem":
+	default:
+		return fmt.Errorf("unknown DB %q", b.DB)
+	}
+	switch b.VectorDB {
+	case "", "mem":
+	default:
+		return fmt.Errorf("unknown VectorDB %q", b.VectorDB)
+	}
+	switch b.LLM {
+	case "", "gemini", "vertexai", "openai", "ollama":
+	default:
+		return fmt.Errorf("unknown LLM %q", b.LLM)
+	}
+	if b.LLM == "vertexai" {
+		if !vertexAIRE.MatchString(b.VertexAI) {
+			return fmt.Errorf("invalid VertexAI %q: want project/location", b.VertexAI)
+		}
+		if b.EmbedModel != "" || b.TextModel != "" {
+			return fmt.Errorf("vertexai LLM does not support EmbedModel or TextModel")
+		}
+	} else if b.VertexAI != "" {
+		return fmt.Errorf("VertexAI set but LLM is not vertexai")
+	}
+	if b.URL != "" && b.LLM != "openai" && b.LLM != "ollama" {
+		return fmt.Errorf("URL set but LLM is not openai or ollama")
+	}
+	if b.EmbedDim < 0 {
+		return fmt.Errorf("negative EmbedDim %d", b.EmbedDim)
+	}
+	if b.EmbedWorkers < 0 {
+		return fmt.Errorf("negative EmbedWorkers %d", b.EmbedWorkers)
+	}
+	if b.EmbedDim != 0 && b.LLM != "" && b.LLM != "gemini" {
+		return fmt.Errorf("%s LLM does not support EmbedDim", b.LLM)
+	}
+	for _, src := range b.Secrets {
+		if !secretSourceRE.MatchString(src) {
+			return fmt.Errorf("unknown Secrets source %q", src)
+		}
+	}
+	return nil
+}
+
+// vertexAIRE matches a Google Cloud project/location, such as "my-project/us-central1".
+var vertexAIRE = regexp.MustCompile(`^[^/]+/[^/]+$`)
+
+// Tasks returns the names of the periodic tasks run for cfg,
+// in the order they run: the [SyncTasks] and then,
+// for each enabled subsystem, a task with the subsystem's name.
+// The related poster also has a task named Name+".feedback"
+// that downloads the reactions to its posts
+// (see [related.Poster.SyncFeedback]),
+// and the approval queue, when it accepts commands (see [Approvals.Bot]),
+// has a task named Name+".commands" that runs them.
+// The approval queue's tasks run after the other subsystems' tasks,
+// so that it sees the proposals made by them in the same round,
+// and the prune and backup tasks run last.
+func (cfg *Config) Tasks() []string {
+	list := slices.Clone(SyncTasks)
+	if c := cfg.CommentFix; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Related; c != nil {
+		list = append(list, c.Name, c.Name+".feedback")
+	}
+	if c := cfg.NeedInfo; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Summary; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Owners; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Milestone; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Flakes; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.WaitInfo; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Priority; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Themes; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Commands; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Approvals; c != nil {
+		if c.Bot != "" {
+			list = append(list, c.Name+".commands")
+		}
+		list = append(list, c.Name)
+	}
+	if c := cfg.Prune; c != nil {
+		list = append(list, c.Name)
+	}
+	if c := cfg.Backup; c != nil {
+		list = append(list, c.Name)
+	}
+	return list
+}
+
+// Schedule returns the interval and jitter for the named task.
+func (cfg *Config) Schedule(name string) (interval, jitter time.Duration) {
+	interval = time.Duration(cfg.Interval)
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	if c := cfg.Backup; c != nil && name == c.Name {
+		interval = DefaultBackupInterval
+	}
+	if c := cfg.Themes; c != nil && name == c.Name {
+		interval = DefaultThemesInterval
+	}
+	if c := cfg.Prune; c != nil && name == c.Name {
+		interval = DefaultPruneInterval
+	}
+	if sc := cfg.Schedules[name]; sc != nil {
+		if sc.Interval != 0 {
+			interval = time.Duration(sc.Interval)
+		}
+		jitter = time.Duration(sc.Jitter)
+	}
+	return interval, jitter
+}
+
+// Singleton reports whether the named task runs only in the leader replica.
+func (cfg *Config) Singleton(name string) bool {
+	sc := cfg.Schedules[name]
+	return sc != nil && sc.Singleton
+}
+
+// Watchdog returns the stuck-run settings for the named task:
+// how long a run can take before it is stuck (0 means the default),
+// and whether to cancel a stuck run.
+func (cfg *Config) Watchdog(name string) (stuckAfter time.Duration, cancel bool) {
+	if sc := cfg.Schedules[name]; sc != nil {
+		return time.Duration(sc.StuckAfter), sc.CancelStuck
+	}
+	return 0, false
+}
+
+// Default returns the default configuration,
+// which is the configuration used for the Go issue tracker.
+func Default() *Config {
+	return &Config{
+		Interval: Duration(DefaultInterval),
+		Budgets: map[string]float64{
+			"needinfo": 5,
+			"flakes":   5,
+		},
+		CommentFix: &CommentFix{
+			Name:  "gerritlinks",
+			Edits: true,
+			Config: commentfix.Config{
+				Projects: []commentfix.ProjectConfig{{
+					Project: "golang/go",
+					Rules: []commentfix.Rule{
+						{Kind: "AutoLink", Pattern: `\bCL ([0-9]+)\b`, Repl: "https://go.dev/cl/$1"},
+						{Kind: "ReplaceURL", Pattern: `\Qhttps://go-review.git.corp.google.com/\E`, Repl: "https://go-review.googlesource.com/"},
+					},
+				}},
+			},
+		},
+		Related: &Related{
+			Name:  "related",
+			Posts: true,
+			Config: related.Config{
+				Projects:         []string{"golang/go"},
+				SkipBodyContains: []string{"— [watchflakes](https://go.dev/wiki/Watchflakes)"},
+				SkipTitlePrefix:  []string{"x/tools/gopls: release version v"},
+				SkipTitleSuffix:  []string{" backport]"},
+			},
+		},
+		NeedInfo: &NeedInfo{
+			Name:            "needinfo",
+			Projects:        []string{"golang/go"},
+			Requirements:    "go",
+			SkipTitlePrefix: []string{"proposal: "},
+		},
+		Flakes: &Flakes{
+			Name:     "flakes",
+			Projects: []string{"golang/go"},
+		},
+		Milestone: &Milestone{
+			Name:            "milestone",
+			Projects:        []string{"golang/go"},
+			SkipTitlePrefix: []string{"proposal: "},
+		},
+		WaitInfo: &WaitInfo{
+			Name:     "waitinfo",
+			Projects: []string{"golang/go"},
+		},
+		Priority: &Priority{
+			Name:     "priority",
+			Projects: []string{"golang/go"},
+		},
+		Themes: &Themes{
+			Name:     "themes",
+			Projects: []string{"golang/go"},
+		},
+		Approvals: &Approvals{
+			Name:  "approvals",
+			Edits: true,
+			Kinds: []string{"waitinfo.Close"},
+		},
+	}
+}
+
+// writes returns a map from subsystem name to the field
+// that enables that subsystem's GitHub writes (Posts or Edits).
+// Subsystems that never write to GitHub are omitted.
+func (cfg *Config) writes() map[string]*bool {
+	m := make(map[string]*bool)
+	if c := cfg.CommentFix; c != nil {
+		m[c.Name] = &c.Edits
+	}
+	if c := cfg.Related; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.NeedInfo; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.Summary; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.Owners; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.Commands; c != nil {
+		m[c.Name] = &c.Edits
+	}
+	if c := cfg.Flakes; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.Milestone; c != nil {
+		m[c.Name] = &c.Posts
+	}
+	if c := cfg.WaitInfo; c != nil {
+		m[c.Name] = &c.Edits
+	}
+	if c := cfg.Approvals; c != nil {
+		m[c.Name] = &c.Edits
+	}
+	return m
+}
+
+// Writers returns the names of the enabled subsystems
+// that can write to GitHub, in sorted order.
+func (cfg *Config) Writers() []string {
+	return slices.Sorted(maps.Keys(cfg.writes()))
+}
+
+// DryRun reports whether the named subsystem is in dry-run mode,
+// meaning that it logs the posts or edits it would make
+// without making them.
+// In observe-only mode, every subsystem is in dry-run mode.
+// The result ok is false if there is no such subsystem
+// or if it never writes to GitHub.
+func (cfg *Config) DryRun(name string) (dryRun, ok bool) {
+	w, ok := cfg.writes()[name]
+	if !ok {
+		return false, false
+	}
+	return !*w || cfg.ObserveOnly, true
+}
+
+// Writes reports whether the named subsystem
+// may write to GitHub: that is, whether it exists,
+// can write to GitHub, and is not in dry-run mode.
+func (cfg *Config) Writes(name string) bool {
+	dryRun, ok := cfg.DryRun(name)
+	return ok && !dryRun
+}
+
+// SetDryRun sets whether the named subsystem is in dry-run mode.
+// In observe-only mode, the setting takes effect only
+// when observe-only mode is turned off.
+// It reports whether the subsystem exists and can write to GitHub.
+func (cfg *Config) SetDryRun(name string, dryRun bool) bool {
+	w, ok := cfg.writes()[name]
+	if ok {
+		*w = !dryRun
+	}
+	return ok
+}
+
+// Clone returns a deep copy of cfg.
+func (cfg *Config) Clone() *Config {
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+	c := new(Config)
+	if err := json.Unmarshal(js, c); err != nil {
+		// unreachable
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,344 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	cfg, err := Load("testdata/gaby.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := Default(); !reflect.DeepEqual(cfg, def) {
+		js1, _ := json.MarshalIndent(cfg, "", "\t")
+		js2, _ := json.MarshalIndent(def, "", "\t")
+		t.Errorf("testdata/gaby.json != Default():\nfile:\n%s\nDefault:\n%s", js1, js2)
+	}
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Default().Validate() = %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	js, err := json.Marshal(Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Parse(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("Parse(Marshal(Default())) != Default()")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	cfg, err := Parse([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval != 0 || cfg.CommentFix != nil || cfg.Related != nil {
+		t.Errorf("Parse({}) = %+v, want zero Config", cfg)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	bad := []struct {
+		cfg string
+		err string
+	}{
+		{`{"Interval": "10s"}`, "Interval 10s is less than 1m"},
+		{`{"Interval": 120}`, `duration must be a string`},
+		{`{"Interval": "soon"}`, `invalid duration`},
+		{`{"Budgets": {"flakes": -1}}`, "negative budget -1 for flakes"},
+		{`{"Flakse": {}}`, `unknown field "Flakse"`},
+		{`{"Orgs": [{"Org": "golang/go"}]}`, `Orgs: invalid organization "golang/go"`},
+		{`{"Orgs": [null]}`, "Orgs: missing organization"},
+		{`{"Orgs": [{"Org": "golang"}, {"Org": "golang", "Pattern": "^go$"}]}`, `Orgs: duplicate organization "golang"`},
+		{`{"Orgs": [{"Org": "golang", "Pattern": "("}]}`, "Orgs: golang: error parsing regexp"},
+		{`{"Priority": {"Projects": ["golang/go"]}}`, "Priority: missing Name"},
+		{`{"Priority": {"Name": "p"}}`, "Priority: no Projects"},
+		{`{"Priority": {"Name": "p", "Projects": ["go"]}}`, `Priority: invalid project "go"`},
+		{`{"Priority": {"Name": "p", "Projects": ["golang/go"]}, "WaitInfo": {"Name": "p", "Projects": ["golang/go"]}}`, `Priority: Name "p" already used by WaitInfo`},
+		{`{"Flakes": {"Name": "f", "Projects": ["golang/go"], "MinScore": 2}}`, "Flakes: invalid MinScore 2"},
+		{`{"Milestone": {"Name": "m", "Projects": ["golang/go"], "MinScore": -1}}`, "Milestone: invalid MinScore -1"},
+		{`{"Themes": {"Name": "t", "Projects": ["golang/go"], "MinSize": -1}}`, "Themes: negative MinSize -1"},
+		{`{"Themes": {"Name": "t", "Projects": ["golang/go"], "Window": "-24h"}}`, "Themes: negative Window -24h0m0s"},
+		{`{"Prune": {"Name": "prune"}}`, "Prune: no Projects"},
+		{`{"Prune": {"Name": "prune", "Projects": ["golang/go"], "Months": -1}}`, "Prune: negative Months -1"},
+		{`{"NeedInfo": {"Name": "n", "Projects": ["golang/go"], "Requirements": "rust"}}`, `NeedInfo: unknown Requirements "rust"`},
+		{`{"Owners": {"Name": "o"}}`, "Owners: no Projects"},
+		{`{"Owners": {"Name": "o", "Projects": {"golang/go": {"PackageRoot": "src/"}}}}`, "Owners: golang/go: missing OwnersFile"},
+		{`{"Owners": {"Name": "o", "Projects": {"golang/go": {"OwnersFile": "CODEOWNERS"}}, "MaxAssignees": -1}}`, "Owners: negative MaxAssignees -1"},
+		{`{"Commands": {"Name": "c", "Allow": {"golang/go": {"label": ["rsc"]}}}}`, "Commands: missing Bot"},
+		{`{"Commands": {"Name": "c", "Bot": "gabyhelp"}}`, "Commands: no Allow"},
+		{`{"Commands": {"Name": "c", "Bot": "gabyhelp", "Allow": {"go": {"label": ["rsc"]}}}}`, `Commands: invalid project "go"`},
+		{`{"Commands": {"Name": "c", "Bot": "gabyhelp", "Allow": {"golang/go": {"close": ["rsc"]}}}}`, `Commands: golang/go: unknown command "close"`},
+		{`{"Commands": {"Name": "c", "Bot": "gabyhelp", "Allow": {"golang/go": {"summarize": ["rsc"]}}}}`, "Commands: golang/go: summarize command requires Summary"},
+		{`{"Summary": {"Name": "s", "Projects": ["golang/go"], "AutoComments": -1}}`, "Summary: negative AutoComments -1"},
+		{`{"Summary": {"Name": "s", "Projects": ["golang/go"], "Command": "@gabyhelp summarize"}}`, "Summary: Command set but no Maintainers"},
+		{`{"Summary": {"Name": "s", "Projects": ["golang/go"], "AutoComments": 50, "Maintainers": ["rsc"]}}`, "Summary: Maintainers set but no Command"},
+		{`{"Related": {"Name": "r", "Projects": ["golang/go"], "MaxResults": -1}}`, "invalid MaxResults -1"},
+		{`{"CommentFix": {"Name": "c", "Projects": [{"Project": "golang/go", "Rules": [{"Kind": "Spell"}]}]}}`, `unknown rule kind "Spell"`},
+		{`{"CommentFix": {"Name": "c", "Projects": [{"Project": "golang/go"}, {"Project": "golang/go"}]}}`, "duplicate project golang/go"},
+		{`{"Priority": {"Name": "github", "Projects": ["golang/go"]}}`, `Priority: Name "github" already used by built-in task`},
+		{`{"Schedules": {"priority": {"Interval": "5m"}}}`, `Schedules: unknown task "priority"`},
+		{`{"Schedules": {"github": {"Interval": "5s"}}}`, "Schedules: github: Interval 5s is less than 1m"},
+		{`{"Schedules": {"github": {"Jitter": "-5s"}}}`, "Schedules: github: negative Jitter -5s"},
+		{`{"Schedules": {"github": {"StuckAfter": "-1h"}}}`, "Schedules: github: negative StuckAfter -1h0m0s"},
+		{`{"Schedules": {"github": null}}`, "Schedules: missing schedule for github"},
+		{`{"Approvals": {"Name": "a", "Kinds": ["waitinfo.Delete"]}}`, `Approvals: unknown kind "waitinfo.Delete"`},
+		{`{"Approvals": {"Name": "a", "Expiry": "-1h"}}`, "Approvals: negative Expiry -1h0m0s"},
+		{`{"Approvals": {"Name": "a", "Bot": "gabyhelp"}}`, "Approvals: Bot set but no Approvers"},
+		{`{"Approvals": {"Name": "a", "Bot": "gabyhelp", "Approvers": {"go": ["rsc"]}}}`, `Approvals: invalid project "go"`},
+		{`{"Approvals": {"Name": "a", "Bot": "gabyhelp", "Approvers": {"golang/go": ["rsc"]}}, "Priority": {"Name": "a.commands", "Projects": ["golang/go"]}}`, `Approvals: Name "a.commands" already used by Priority`},
+		{`{"Backends": {"DB": "firestore"}}`, `Backends: unknown DB "firestore"`},
+		{`{"Backends": {"VectorDB": "pinecone"}}`, `Backends: unknown VectorDB "pinecone"`},
+		{`{"Backends": {"LLM": "claude"}}`, `Backends: unknown LLM "claude"`},
+		{`{"Backends": {"LLM": "vertexai", "VertexAI": "project"}}`, `Backends: invalid VertexAI "project"`},
+		{`{"Backends": {"LLM": "vertexai", "VertexAI": "p/l", "EmbedModel": "m"}}`, "Backends: vertexai LLM does not support EmbedModel"},
+		{`{"Backends": {"VertexAI": "p/l"}}`, "Backends: VertexAI set but LLM is not vertexai"},
+		{`{"Backends": {"URL": "http://localhost:8000/v1"}}`, "Backends: URL set but LLM is not openai or ollama"},
+		{`{"Backends": {"LLM": "ollama", "EmbedDim": 256}}`, "Backends: ollama LLM does not support EmbedDim"},
+		{`{"Backends": {"EmbedWorkers": -1}}`, "Backends: negative EmbedWorkers -1"},
+		{`{"Backends": {"Secrets": ["env", "vault"]}}`, `Backends: unknown Secrets source "vault"`},
+		{`{"Backup": {"Dest": "/backups"}}`, "Backup: missing Name"},
+		{`{"Backup": {"Name": "b", "Dest": "backups"}}`, `Backup: invalid Dest "backups"`},
+		{`{"Backup": {"Name": "b", "Dest": "s3://bucket/gaby"}}`, `Backup: invalid Dest "s3://bucket/gaby"`},
+		{`{"Backup": {"Name": "b", "Dest": "/backups", "Daily": -1}}`, "Backup: negative Daily -1"},
+	}
+	for _, tt := range bad {
+		_, err := Parse([]byte(tt.cfg))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%s): err = %v, want %q", tt.cfg, err, tt.err)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	_, err := Load("testdata/missing.json")
+	if err == nil {
+		t.Fatal("Load of missing file succeeded")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	js, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `"1m30s"` {
+		t.Errorf("Marshal(90s) = %s, want \"1m30s\"", js)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := Default()
+	want := []string{"approvals", "flakes", "gerritlinks", "milestone", "needinfo", "related", "waitinfo"}
+	if w := cfg.Writers(); !slices.Equal(w, want) {
+		t.Errorf("Writers() = %v, want %v", w, want)
+	}
+	if dry, ok := cfg.DryRun("related"); dry || !ok {
+		t.Errorf("DryRun(related) = %v, %v, want false, true", dry, ok)
+	}
+	if dry, ok := cfg.DryRun("needinfo"); !dry || !ok {
+		t.Errorf("DryRun(needinfo) = %v, %v, want true, true", dry, ok)
+	}
+	if _, ok := cfg.DryRun("priority"); ok {
+		t.Errorf("DryRun(priority) ok = true, want false")
+	}
+
+	c := cfg.Clone()
+	if !c.SetDryRun("related", true) || !c.SetDryRun("needinfo", false) {
+		t.Fatalf("SetDryRun failed")
+	}
+	if c.SetDryRun("priority", true) {
+		t.Errorf("SetDryRun(priority) = true, want false")
+	}
+	if c.Related.Posts || !c.NeedInfo.Posts {
+		t.Errorf("after SetDryRun: Related.Posts = %v, NeedInfo.Posts = %v, want false, true", c.Related.Posts, c.NeedInfo.Posts)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("SetDryRun on Clone modified original")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	cfg := Default()
+	want := []string{"github", "githubdocs", "embeddocs", "crossref", "gerritlinks", "related", "related.feedback", "needinfo", "milestone", "flakes", "waitinfo", "priority", "themes", "approvals"}
+	if tasks := cfg.Tasks(); !slices.Equal(tasks, want) {
+		t.Errorf("Tasks() = %v, want %v", tasks, want)
+	}
+
+	cfg, err := Parse([]byte(`{"Interval": "5m", "Schedules": {"github": {"Interval": "1h", "Jitter": "10m"}, "embeddocs": {"Jitter": "1m", "Singleton": true, "StuckAfter": "2h", "CancelStuck": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name             string
+		interval, jitter time.Duration
+	}{
+		{"github", time.Hour, 10 * time.Minute},
+		{"embeddocs", 5 * time.Minute, time.Minute},
+		{"crossref", 5 * time.Minute, 0},
+	} {
+		interval, jitter := cfg.Schedule(tt.name)
+		if interval != tt.interval || jitter != tt.jitter {
+			t.Errorf("Schedule(%q) = %v, %v, want %v, %v", tt.name, interval, jitter, tt.interval, tt.jitter)
+		}
+	}
+	if !cfg.Singleton("embeddocs") || cfg.Singleton("github") || cfg.Singleton("crossref") {
+		t.Errorf("Singleton(embeddocs, github, crossref) = %v, %v, %v, want true, false, false", cfg.Singleton("embeddocs"), cfg.Singleton("github"), cfg.Singleton("crossref"))
+	}
+	if stuck, cancel := cfg.Watchdog("embeddocs"); stuck != 2*time.Hour || !cancel {
+		t.Errorf("Watchdog(embeddocs) = %v, %v, want 2h, true", stuck, cancel)
+	}
+	if stuck, cancel := cfg.Watchdog("github"); stuck != 0 || cancel {
+		t.Errorf("Watchdog(github) = %v, %v, want 0, false", stuck, cancel)
+	}
+	if interval, _ := new(Config).Schedule("github"); interval != DefaultInterval {
+		t.Errorf("zero Config Schedule(github) interval = %v, want %v", interval, DefaultInterval)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, js := range []string{
+		`{"Backends": {}}`,
+		`{"Backends": {"DB": "mem", "VectorDB": "mem", "VectorNamespace": "v2", "LLM": "gemini", "EmbedModel": "text-embedding-004", "EmbedDim": 256, "EmbedWorkers": 8, "Compress": true}}`,
+		`{"Backends": {"LLM": "vertexai", "VertexAI": "my-project/us-central1"}}`,
+		`{"Backends": {"LLM": "openai", "URL": "http://localhost:8000/v1", "TextModel": "m"}}`,
+		`{"Backends": {"LLM": "ollama", "EmbedModel": "nomic-embed-text", "Secrets": ["store:/etc/gaby/secrets", "env", "file:secrets.json", "netrc"]}}`,
+	} {
+		if _, err := Parse([]byte(js)); err != nil {
+			t.Errorf("Parse(%s): %v", js, err)
+		}
+	}
+}
+
+func TestThemes(t *testing.T) {
+	cfg, err := Parse([]byte(`{"Themes": {"Name": "themes", "Projects": ["golang/go"], "Window": "168h", "MinSize": 3, "MinScore": 0.9}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval, _ := cfg.Schedule("themes"); interval != DefaultThemesInterval {
+		t.Errorf("Schedule(themes) interval = %v, want %v", interval, DefaultThemesInterval)
+	}
+	if cfg.Writes("themes") {
+		t.Errorf("Writes(themes) = true, want false")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	cfg, err := Parse([]byte(`{"Summary": {"Name": "summary", "Posts": true, "Projects": ["golang/go"], "AutoComments": 50, "Command": "@gabyhelp summarize", "Maintainers": ["rsc"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cfg.Tasks(), "summary") {
+		t.Errorf("Tasks() = %v, missing summary", cfg.Tasks())
+	}
+	if !cfg.Writes("summary") {
+		t.Errorf("Writes(summary) = false, want true")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	cfg, err := Parse([]byte(`{"Owners": {"Name": "owners", "Apply": true, "Projects": {"golang/go": {"OwnersFile": ".github/CODEOWNERS", "PackageRoot": "src/", "Labels": {"cmd/compile": "compiler/runtime"}}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cfg.Tasks(), "owners") {
+		t.Errorf("Tasks() = %v, missing owners", cfg.Tasks())
+	}
+	if dryRun, ok := cfg.DryRun("owners"); !ok || !dryRun {
+		t.Errorf("DryRun(owners) = %v, %v, want true, true", dryRun, ok)
+	}
+	if p := cfg.Owners.Projects["golang/go"]; p.Labels["cmd/compile"] != "compiler/runtime" {
+		t.Errorf("Owners.Projects[golang/go] = %+v", p)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+		"Summary": {"Name": "summary", "Projects": ["golang/go"]},
+		"Commands": {"Name": "commands", "Bot": "gabyhelp", "Allow": {"golang/go": {"summarize": ["rsc"], "*": ["gopherbot"]}}},
+		"Approvals": {"Name": "approvals"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := cfg.Tasks(); !slices.Equal(tasks[len(tasks)-2:], []string{"commands", "approvals"}) {
+		t.Errorf("Tasks() = %v, want commands before approvals", tasks)
+	}
+	if dryRun, ok := cfg.DryRun("commands"); !ok || !dryRun {
+		t.Errorf("DryRun(commands) = %v, %v, want true, true", dryRun, ok)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	cfg, err := Parse([]byte(`{"Prune": {"Name": "prune", "Projects": ["golang/go"], "Months": 6}, "Backup": {"Name": "backup", "Dest": "/backups"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := cfg.Tasks(); !slices.Equal(tasks[len(tasks)-2:], []string{"prune", "backup"}) {
+		t.Errorf("Tasks() = %v, want prune, backup last", tasks)
+	}
+	if interval, _ := cfg.Schedule("prune"); interval != DefaultPruneInterval {
+		t.Errorf("Schedule(prune) interval = %v, want %v", interval, DefaultPruneInterval)
+	}
+	if cfg.Writes("prune") {
+		t.Errorf("Writes(prune) = true, want false")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	cfg, err := Parse([]byte(`{"Backup": {"Name": "backup", "Dest": "gs://bucket/gaby/"}, "Priority": {"Name": "priority", "Projects": ["golang/go"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := cfg.Tasks(); tasks[len(tasks)-1] != "backup" {
+		t.Errorf("Tasks() = %v, want backup last", tasks)
+	}
+	if interval, _ := cfg.Schedule("backup"); interval != DefaultBackupInterval {
+		t.Errorf("Schedule(backup) interval = %v, want %v", interval, DefaultBackupInterval)
+	}
+
+	cfg, err = Parse([]byte(`{"Backup": {"Name": "backup", "Dest": "s3://bucket/gaby/?region=us-east-1"}, "Schedules": {"backup": {"Interval": "6h"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval, _ := cfg.Schedule("backup"); interval != 6*time.Hour {
+		t.Errorf("Schedule(backup) interval = %v, want 6h", interval)
+	}
+}
+
+func TestObserveOnly(t *testing.T) {
+	cfg := Default()
+	if !cfg.Writes("related") || cfg.Writes("needinfo") || cfg.Writes("priority") || cfg.Writes("missing") {
+		t.Errorf("Writes(related, needinfo, priority, missing) = %v, %v, %v, %v, want true, false, false, false",
+			cfg.Writes("related"), cfg.Writes("needinfo"), cfg.Writes("priority"), cfg.Writes("missing"))
+	}
+
+	cfg.ObserveOnly = true
+	for _, name := range cfg.Writers() {
+		if dry, ok := cfg.DryRun(name); !dry || !ok {
+			t.Errorf("observe-only DryRun(%s) = %v, %v, want true, true", name, dry, ok)
+		}
+		if cfg.Writes(name) {
+			t.Errorf("observe-only Writes(%s) = true", name)
+		}
+	}
+	cfg.SetDryRun("needinfo", false)
+	if cfg.Writes("needinfo") {
+		t.Errorf("observe-only Writes(needinfo) = true after SetDryRun(needinfo, false)")
+	}
+}
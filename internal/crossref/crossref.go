@@ -0,0 +1,334 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crossref maintains a bidirectional index between
+// GitHub issues and the changes that address them:
+// Gerrit changes (CLs) and GitHub pull requests (PRs).
+//
+// Links are extracted from three kinds of text:
+// GitHub issue bodies and comments, which mention CLs by URL
+// (https://go.dev/cl/123, https://go-review.googlesource.com/c/go/+/123)
+// or by name (“CL 123”); CL descriptions, which refer to issues
+// using the conventional “Fixes #123”, “Updates #123”, or “For #123” lines;
+// and pull request descriptions, which use the same lines.
+//
+// [Index.SyncGitHub] extracts links from new GitHub data,
+// including pull requests, and [Index.AddCL] records the links
+// in a CL description. Until Gaby syncs Gerrit, nothing calls AddCL,
+// so only the CL mentions in issues are indexed.
+// [Index.CLs] and [Index.Issues] query the CL links,
+// and [Index.PRs] and [Index.PRIssues] query the pull request links.
+package crossref
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schemas in the database:
+//
+//	["crossref.IssueToCL", Project, Issue, CL, Kind, Source] => []
+//	["crossref.CLToIssue", CL, Project, Issue, Kind, Source] => []
+//	["crossref.Source", Source] => JSON of []Link
+//	["crossref.IssueToPR", Project, Issue, PRProject, PR, Kind] => []
+//	["crossref.PRToIssue", PRProject, PR, Project, Issue, Kind] => []
+//	["crossref.PRSource", PRProject, PR] => JSON of []PRLink
+//
+// Source is the URL of the text the link was extracted from:
+// a GitHub issue or comment URL, or a CL URL ("https://go.dev/cl/123").
+// The Source entry records the links extracted from that text,
+// so that when the text is edited, its old links can be removed.
+// The PRSource entry does the same for a pull request description.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "crossref.IssueToCL", Key: "Project, Issue, CL, Kind, Source", Val: "[]"},
+		storage.Schema{Kind: "crossref.CLToIssue", Key: "CL, Project, Issue, Kind, Source", Val: "[]"},
+		storage.Schema{Kind: "crossref.Source", Key: "Source", Val: "JSON of []Link"},
+		storage.Schema{Kind: "crossref.IssueToPR", Key: "Project, Issue, PRProject, PR, Kind", Val: "[]"},
+		storage.Schema{Kind: "crossref.PRToIssue", Key: "PRProject, PR, Project, Issue, Kind", Val: "[]"},
+		storage.Schema{Kind: "crossref.PRSource", Key: "PRProject, PR", Val: "JSON of []PRLink"},
+	)
+}
+
+// Link kinds.
+const (
+	Fixes    = "fixes"    // CL description says it fixes the issue
+	Updates  = "updates"  // CL description says it updates the issue
+	Mentions = "mentions" // issue or comment mentions the CL
+)
+
+// A Link is a single link between an issue and a CL.
+type Link struct {
+	Project string // GitHub project ("golang/go")
+	Issue   int64  // issue number
+	CL      int64  // CL number
+	Kind    string // Fixes, Updates, or Mentions
+	Source  string // URL of text containing the link
+}
+
+// A PRLink is a single link between an issue and a pull request
+// whose description fixes or updates it.
+type PRLink struct {
+	Project   string // issue's GitHub project ("golang/go")
+	Issue     int64  // issue number
+	PRProject string // pull request's GitHub project ("golang/tools")
+	PR        int64  // pull request number
+	Kind      string // Fixes or Updates
+}
+
+// An Index is a bidirectional issue↔change index stored in a database.
+type Index struct {
+	slog *slog.Logger
+	db   storage.DB
+}
+
+// New returns a new Index that logs to lg and stores the index in db.
+func New(lg *slog.Logger, db storage.DB) *Index {
+	return &Index{slog: lg, db: db}
+}
+
+var (
+	clURLRE  = regexp.MustCompile(`\b(?:https?://)?(?:go\.dev|golang\.org)/cl/([0-9]+)\b|\bhttps://go-review\.googlesource\.com/(?:c/[\w./-]+/\+/)?([0-9]+)\b|\bCL ([0-9]+)\b`)
+	issueRE  = regexp.MustCompile(`(?im)^\s*(Fixes|Updates|For|Closes)\s+((?:(?:[\w.-]+/[\w.-]+)?#[0-9]+(?:\s*,\s*|\s+and\s+|\s+)?)+)`)
+	issueRef = regexp.MustCompile(`(?:([\w.-]+/[\w.-]+))?#([0-9]+)`)
+)
+
+// ExtractCLs returns the CL numbers mentioned in text,
+// in order of first mention.
+func ExtractCLs(text string) []int64 {
+	var cls []int64
+	for _, m := range clURLRE.FindAllStringSubmatch(text, -1) {
+		n, err := strconv.ParseInt(m[1]+m[2]+m[3], 10, 64)
+		if err != nil || n <= 0 || slices.Contains(cls, n) {
+			continue
+		}
+		cls = append(cls, n)
+	}
+	return cls
+}
+
+// An IssueRef is a reference to an issue in a CL description.
+type IssueRef struct {
+	Project string // GitHub project ("golang/go")
+	Issue   int64  // issue number
+	Kind    string // Fixes or Updates
+}
+
+// ExtractIssues returns the issue references in the CL description text.
+// References of the form “#123” are taken to be in the given project.
+// “Fixes” and “Closes” lines produce [Fixes] references;
+// “Updates” and “For” lines produce [Updates] references.
+func ExtractIssues(project, text string) []IssueRef {
+	var refs []IssueRef
+	for _, m := range issueRE.FindAllStringSubmatch(text, -1) {
+		kind := Updates
+		if verb := strings.ToLower(m[1]); verb == "fixes" || verb == "closes" {
+			kind = Fixes
+		}
+		for _, r := range issueRef.FindAllStringSubmatch(m[2], -1) {
+			n, err := strconv.ParseInt(r[2], 10, 64)
+			if err != nil || n <= 0 {
+				continue
+			}
+			ref := IssueRef{Project: project, Issue: n, Kind: kind}
+			if r[1] != "" {
+				ref.Project = r[1]
+			}
+			if !slices.Contains(refs, ref) {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// AddCL records the links in the description of the given CL,
+// replacing any links recorded from an earlier version of the description.
+// References of the form “#123” are taken to be in the given project.
+// AddCL is meant to be called by code that syncs Gerrit state.
+func (x *Index) AddCL(project string, cl int64, description string) {
+	var links []Link
+	source := fmt.Sprintf("https://go.dev/cl/%d", cl)
+	for _, r := range ExtractIssues(project, description) {
+		links = append(links, Link{Project: r.Project, Issue: r.Issue, CL: cl, Kind: r.Kind, Source: source})
+	}
+	x.setLinks(source, links)
+}
+
+// addText records the CL mentions in the text of a GitHub issue or comment,
+// replacing any links recorded from an earlier version of the text.
+func (x *Index) addText(project string, issue int64, source, text string) {
+	var links []Link
+	for _, cl := range ExtractCLs(text) {
+		links = append(links, Link{Project: project, Issue: issue, CL: cl, Kind: Mentions, Source: source})
+	}
+	x.setLinks(source, links)
+}
+
+// addPR records the issue references in the description of a pull request,
+// replacing any links recorded from an earlier version of the description.
+// References of the form “#123” are taken to be in the pull request's project.
+func (x *Index) addPR(project string, pr int64, description string) {
+	var links []PRLink
+	for _, r := range ExtractIssues(project, description) {
+		links = append(links, PRLink{Project: r.Project, Issue: r.Issue, PRProject: project, PR: pr, Kind: r.Kind})
+	}
+
+	skey := ordered.Encode("crossref.PRSource", project, pr)
+	b := x.db.Batch()
+	if val, ok := x.db.Get(skey); ok {
+		var old []PRLink
+		if err := json.Unmarshal(val, &old); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref pr source decode", "project", project, "pr", pr, "err", err)
+		}
+		for _, l := range old {
+			b.Delete(ordered.Encode("crossref.IssueToPR", l.Project, l.Issue, l.PRProject, l.PR, l.Kind))
+			b.Delete(ordered.Encode("crossref.PRToIssue", l.PRProject, l.PR, l.Project, l.Issue, l.Kind))
+		}
+	}
+	if len(links) == 0 {
+		b.Delete(skey)
+	} else {
+		b.Set(skey, storage.JSON(links))
+	}
+	for _, l := range links {
+		b.Set(ordered.Encode("crossref.IssueToPR", l.Project, l.Issue, l.PRProject, l.PR, l.Kind), nil)
+		b.Set(ordered.Encode("crossref.PRToIssue", l.PRProject, l.PR, l.Project, l.Issue, l.Kind), nil)
+	}
+	b.Apply()
+}
+
+// setLinks replaces the links recorded for source with links.
+func (x *Index) setLinks(source string, links []Link) {
+	skey := ordered.Encode("crossref.Source", source)
+	b := x.db.Batch()
+	if val, ok := x.db.Get(skey); ok {
+		var old []Link
+		if err := json.Unmarshal(val, &old); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref source decode", "source", source, "err", err)
+		}
+		for _, l := range old {
+			b.Delete(ordered.Encode("crossref.IssueToCL", l.Project, l.Issue, l.CL, l.Kind, l.Source))
+			b.Delete(ordered.Encode("crossref.CLToIssue", l.CL, l.Project, l.Issue, l.Kind, l.Source))
+		}
+	}
+	if len(links) == 0 {
+		b.Delete(skey)
+	} else {
+		b.Set(skey, storage.JSON(links))
+	}
+	for _, l := range links {
+		b.Set(ordered.Encode("crossref.IssueToCL", l.Project, l.Issue, l.CL, l.Kind, l.Source), nil)
+		b.Set(ordered.Encode("crossref.CLToIssue", l.CL, l.Project, l.Issue, l.Kind, l.Source), nil)
+	}
+	b.Apply()
+}
+
+// SyncGitHub records the CL mentions in GitHub issues and comments,
+// and the issue references in pull request descriptions,
+// that are new since the last call to SyncGitHub.
+// It uses a [github.Client.EventWatcher] named “crossref” to save its position.
+//
+// If ctx is canceled, SyncGitHub stops before the next issue or comment.
+func (x *Index) SyncGitHub(ctx context.Context, gh *github.Client) {
+	ctx, span := tracing.Start(ctx, "crossref.SyncGitHub")
+	defer span.End()
+
+	w := gh.EventWatcher("crossref")
+	n := 0
+	defer func() { span.SetAttributes(attribute.Int("events", n)) }()
+	for e := range w.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		switch v := e.Typed.(type) {
+		case *github.Issue:
+			x.slog.DebugContext(ctx, "crossref sync", "project", e.Project, "issue", e.Issue)
+			x.addText(e.Project, e.Issue, v.HTMLURL, v.Body)
+			if v.PullRequest != nil {
+				x.addPR(e.Project, e.Issue, v.Body)
+			}
+		case *github.IssueComment:
+			x.slog.DebugContext(ctx, "crossref sync", "project", e.Project, "issue", e.Issue, "comment", v.URL)
+			x.addText(e.Project, e.Issue, v.HTMLURL, v.Body)
+		}
+		w.MarkOld(e.DBTime)
+		n++
+	}
+}
+
+// CLs returns the links from the given issue to CLs,
+// ordered by CL number.
+func (x *Index) CLs(project string, issue int64) []Link {
+	var links []Link
+	for key := range x.db.Scan(ordered.Encode("crossref.IssueToCL", project, issue), ordered.Encode("crossref.IssueToCL", project, issue, ordered.Inf)) {
+		var l Link
+		if err := ordered.Decode(key, nil, &l.Project, &l.Issue, &l.CL, &l.Kind, &l.Source); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref decode", "key", storage.Fmt(key), "err", err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// Issues returns the links from the given CL to issues,
+// ordered by project and issue number.
+func (x *Index) Issues(cl int64) []Link {
+	var links []Link
+	for key := range x.db.Scan(ordered.Encode("crossref.CLToIssue", cl), ordered.Encode("crossref.CLToIssue", cl, ordered.Inf)) {
+		var l Link
+		if err := ordered.Decode(key, nil, &l.CL, &l.Project, &l.Issue, &l.Kind, &l.Source); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref decode", "key", storage.Fmt(key), "err", err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// PRs returns the links from the given issue to pull requests,
+// ordered by pull request project and number.
+func (x *Index) PRs(project string, issue int64) []PRLink {
+	var links []PRLink
+	for key := range x.db.Scan(ordered.Encode("crossref.IssueToPR", project, issue), ordered.Encode("crossref.IssueToPR", project, issue, ordered.Inf)) {
+		var l PRLink
+		if err := ordered.Decode(key, nil, &l.Project, &l.Issue, &l.PRProject, &l.PR, &l.Kind); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref decode", "key", storage.Fmt(key), "err", err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// PRIssues returns the links from the given pull request to issues,
+// ordered by project and issue number.
+func (x *Index) PRIssues(project string, pr int64) []PRLink {
+	var links []PRLink
+	for key := range x.db.Scan(ordered.Encode("crossref.PRToIssue", project, pr), ordered.Encode("crossref.PRToIssue", project, pr, ordered.Inf)) {
+		var l PRLink
+		if err := ordered.Decode(key, nil, &l.PRProject, &l.PR, &l.Project, &l.Issue, &l.Kind); err != nil {
+			// unreachable unless corrupt storage
+			x.db.Panic("crossref decode", "key", storage.Fmt(key), "err", err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package crossref
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+func TestExtractCLs(t *testing.T) {
+	text := `Change https://go.dev/cl/123 mentions this issue.
+See also golang.org/cl/456, https://go-review.googlesource.com/c/tools/+/789,
+https://go-review.googlesource.com/1011, and CL 123 (again) and CL 1213.
+Not a CL: https://go.dev/clx/99 or XCL 98.`
+	want := []int64{123, 456, 789, 1011, 1213}
+	if cls := ExtractCLs(text); !reflect.DeepEqual(cls, want) {
+		t.Errorf("ExtractCLs = %v, want %v", cls, want)
+	}
+}
+
+func TestExtractIssues(t *testing.T) {
+	text := `cmd/go: fix the thing
+
+This fixes #1 in the commit message body,
+which does not count.
+
+Fixes #10, #11 and golang/tools#12.
+Updates #20
+For #21.
+closes #22
+`
+	want := []IssueRef{
+		{"golang/go", 10, Fixes},
+		{"golang/go", 11, Fixes},
+		{"golang/tools", 12, Fixes},
+		{"golang/go", 20, Updates},
+		{"golang/go", 21, Updates},
+		{"golang/go", 22, Fixes},
+	}
+	if refs := ExtractIssues("golang/go", text); !reflect.DeepEqual(refs, want) {
+		t.Errorf("ExtractIssues:\nhave %v\nwant %v", refs, want)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	x := New(lg, db)
+
+	tc := gh.Testing()
+	tc.AddIssue("golang/go", &github.Issue{Number: 1, Title: "bug", Body: "Maybe CL 100 fixes this?"})
+	tc.AddIssueComment("golang/go", 1, &github.IssueComment{Body: "Change https://go.dev/cl/101 mentions this issue."})
+	tc.AddIssue("golang/go", &github.Issue{Number: 2, Title: "other bug", Body: "No CLs here."})
+	x.SyncGitHub(ctx, gh)
+	x.AddCL("golang/go", 101, "runtime: fix bug\n\nFixes #1.\nUpdates #2.\n")
+
+	url1 := "https://github.com/golang/go/issues/1"
+	cl101 := "https://go.dev/cl/101"
+	links := x.CLs("golang/go", 1)
+	want := []Link{
+		{"golang/go", 1, 100, Mentions, url1},
+		{"golang/go", 1, 101, Fixes, cl101},
+		{"golang/go", 1, 101, Mentions, links[len(links)-1].Source},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("CLs(1):\nhave %v\nwant %v", links, want)
+	}
+	want = []Link{
+		{"golang/go", 1, 101, Fixes, cl101},
+		{"golang/go", 1, 101, Mentions, want[2].Source},
+		{"golang/go", 2, 101, Updates, cl101},
+	}
+	if links := x.Issues(101); !reflect.DeepEqual(links, want) {
+		t.Errorf("Issues(101):\nhave %v\nwant %v", links, want)
+	}
+
+	// Editing the issue body or CL description replaces the old links.
+	tc.AddIssue("golang/go", &github.Issue{Number: 1, Title: "bug", Body: "Actually CL 102 fixes this."})
+	x.SyncGitHub(ctx, gh)
+	x.AddCL("golang/go", 101, "runtime: fix bug\n\nUpdates #1.\n")
+	if links := x.Issues(100); links != nil {
+		t.Errorf("Issues(100) after edit = %v, want nil", links)
+	}
+	want = []Link{{"golang/go", 1, 102, Mentions, url1}}
+	if links := x.Issues(102); !reflect.DeepEqual(links, want) {
+		t.Errorf("Issues(102):\nhave %v\nwant %v", links, want)
+	}
+	if links := x.Issues(101); len(links) != 2 || links[0].Kind != Mentions || links[1].Kind != Updates || links[1].Issue != 1 {
+		t.Errorf("Issues(101) after edit = %v, want mention and update of #1", links)
+	}
+}
+
+func TestPullRequests(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	x := New(lg, db)
+
+	tc := gh.Testing()
+	tc.AddIssue("golang/tools", &github.Issue{Number: 5, Title: "gopls: fix crash", Body: "Fixes golang/go#1\nUpdates #3", PullRequest: new(struct{})})
+	tc.AddIssue("golang/tools", &github.Issue{Number: 6, Title: "issue", Body: "Fixes #3"})
+	x.SyncGitHub(ctx, gh)
+
+	want := []PRLink{{"golang/go", 1, "golang/tools", 5, Fixes}}
+	if links := x.PRs("golang/go", 1); !reflect.DeepEqual(links, want) {
+		t.Errorf("PRs(golang/go#1):\nhave %v\nwant %v", links, want)
+	}
+	want = []PRLink{
+		{"golang/go", 1, "golang/tools", 5, Fixes},
+		{"golang/tools", 3, "golang/tools", 5, Updates},
+	}
+	if links := x.PRIssues("golang/tools", 5); !reflect.DeepEqual(links, want) {
+		t.Errorf("PRIssues(golang/tools#5):\nhave %v\nwant %v", links, want)
+	}
+	if links := x.PRIssues("golang/tools", 6); links != nil {
+		t.Errorf("PRIssues(golang/tools#6) = %v, want nil (not a pull request)", links)
+	}
+
+	// Editing the description replaces the old links.
+	tc.AddIssue("golang/tools", &github.Issue{Number: 5, Title: "gopls: fix crash", Body: "Updates golang/go#1", PullRequest: new(struct{})})
+	x.SyncGitHub(ctx, gh)
+	want = []PRLink{{"golang/go", 1, "golang/tools", 5, Updates}}
+	if links := x.PRIssues("golang/tools", 5); !reflect.DeepEqual(links, want) {
+		t.Errorf("PRIssues(golang/tools#5) after edit:\nhave %v\nwant %v", links, want)
+	}
+	if links := x.PRs("golang/tools", 3); links != nil {
+		t.Errorf("PRs(golang/tools#3) after edit = %v, want nil", links)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diff
+
+import (
+	"html"
+	"html/template"
+	"strings"
+)
+
+// HTML renders the unified diff udiff, as returned by [Diff]
+// (or a concatenation of such diffs),
+// as HTML suitable for display in a <pre> element.
+// Each line is wrapped in a <span> with class "hdr" (file headers),
+// "hunk" (“@@” lines), "del" (deleted lines), "ins" (inserted lines),
+// or "ctx" (context and other lines).
+// Within each run of deleted lines followed by inserted lines,
+// HTML marks the words that changed (see [Words])
+// with <del> and <ins> elements, so that a style sheet can
+// highlight exactly what changed within the lines.
+func HTML(udiff []byte) template.HTML {
+	var b strings.Builder
+	var dels, inss []string // current run of deleted and inserted lines
+	flush := func() {
+		if len(dels) > 0 && len(inss) > 0 {
+			ws := Words(strings.Join(dels, ""), strings.Join(inss, ""))
+			writeSide(&b, ws, Delete)
+			writeSide(&b, ws, Insert)
+		} else {
+			// Nothing to compare: don't mark every word as changed.
+			writeSide(&b, []Edit{{Same, strings.Join(dels, "")}}, Delete)
+			writeSide(&b, []Edit{{Same, strings.Join(inss, "")}}, Insert)
+		}
+		dels, inss = nil, nil
+	}
+
+	header := true
+	for _, line := range strings.SplitAfter(string(udiff), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		if strings.HasPrefix(line, "diff ") {
+			header = true // start of another diff
+		}
+		if header && (strings.HasPrefix(line, "diff ") || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "+++ ")) {
+			writeLine(&b, "hdr", line)
+			continue
+		}
+		switch line[0] {
+		case '-':
+			if len(inss) > 0 {
+				flush()
+			}
+			dels = append(dels, line[1:])
+		case '+':
+			inss = append(inss, line[1:])
+		default:
+			flush()
+			class := "ctx"
+			if strings.HasPrefix(line, "@@ ") {
+				class = "hunk"
+				header = false
+			}
+			writeLine(&b, class, line)
+		}
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+// writeLine writes a single line with the given class to b.
+func writeLine(b *strings.Builder, class, line string) {
+	b.WriteString(`<span class="` + class + `">`)
+	b.WriteString(html.EscapeString(strings.TrimSuffix(line, "\n")))
+	b.WriteString("</span>\n")
+}
+
+// writeSide writes to b the lines of one side of the word diff ws,
+// the old lines if kind is Delete or the new lines if kind is Insert,
+// marking the edits of that kind.
+func writeSide(b *strings.Builder, ws []Edit, kind Kind) {
+	class, prefix, tag := "del", "-", "del"
+	if kind == Insert {
+		class, prefix, tag = "ins", "+", "ins"
+	}
+	bol := true // at beginning of line
+	for _, e := range ws {
+		if e.Kind != Same && e.Kind != kind {
+			continue
+		}
+		for text := e.Text; text != ""; {
+			line, rest, nl := strings.Cut(text, "\n")
+			text = rest
+			if bol {
+				b.WriteString(`<span class="` + class + `">` + prefix)
+				bol = false
+			}
+			if line != "" {
+				if e.Kind == kind {
+					b.WriteString("<" + tag + ">" + html.EscapeString(line) + "</" + tag + ">")
+				} else {
+					b.WriteString(html.EscapeString(line))
+				}
+			}
+			if nl {
+				b.WriteString("</span>\n")
+				bol = true
+			}
+		}
+	}
+	if !bol {
+		b.WriteString("</span>\n")
+	}
+}
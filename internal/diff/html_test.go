@@ -0,0 +1,44 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTML(t *testing.T) {
+	old := "# Title\n\nfix teh typo\nkeep <this>\ndelete this\n"
+	new := "# Title\n\nfix the typo\nkeep <this>\nadd & this\nand this\n"
+	have := HTML(Diff("old", []byte(old), "new", []byte(new)))
+	want := `<span class="hdr">diff old new</span>
+<span class="hdr">--- old</span>
+<span class="hdr">+++ new</span>
+<span class="hunk">@@ -1,5 +1,6 @@</span>
+<span class="ctx"> # Title</span>
+<span class="ctx"> </span>
+<span class="del">-fix <del>teh</del> typo</span>
+<span class="ins">+fix <ins>the</ins> typo</span>
+<span class="ctx"> keep &lt;this&gt;</span>
+<span class="del">-<del>delete</del> this</span>
+<span class="ins">+<ins>add &amp; this</ins></span>
+<span class="ins">+<ins>and</ins> this</span>
+`
+	if string(have) != want {
+		t.Errorf("HTML:\nhave:\n%s\nwant:\n%s\n%s", have, want, Diff("want", []byte(want), "have", []byte(have)))
+	}
+
+	// Concatenated diffs each have headers.
+	two := append(Diff("old", []byte("x\n"), "new", []byte("y\n")), Diff("old", []byte("z\n"), "new", []byte("w\n"))...)
+	if n := strings.Count(string(HTML(two)), `<span class="hdr">--- old</span>`); n != 2 {
+		t.Errorf("HTML of two diffs has %d headers, want 2:\n%s", n, HTML(two))
+	}
+
+	// Pure insertions are not marked word by word.
+	have = HTML(Diff("old", []byte("a\n"), "new", []byte("a\nb\n")))
+	if !strings.Contains(string(have), `<span class="ins">+b</span>`) {
+		t.Errorf("HTML of insertion:\n%s", have)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diff
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Kind is the kind of an [Edit] in a word diff.
+type Kind int
+
+const (
+	Same   Kind = iota // text in both old and new
+	Delete             // text only in old
+	Insert             // text only in new
+)
+
+// An Edit is a single piece of a word diff.
+type Edit struct {
+	Kind Kind
+	Text string
+}
+
+// maxWork is the maximum number of token pairs that Words
+// compares when looking for a minimal diff. Beyond that,
+// it reports the changed region as a single deletion and insertion.
+const maxWork = 1 << 20
+
+// Words returns a word-level diff of old and new:
+// a sequence of edits that, reading only Same and Delete edits,
+// spells out old, and, reading only Same and Insert edits, spells out new.
+// Words splits the texts into words (runs of letters, digits, and underscores),
+// runs of spaces, and single punctuation characters,
+// and looks for a diff that deletes and inserts as few of them as possible.
+// Adjacent edits always have different kinds.
+// If old and new are identical, Words returns a single Same edit,
+// or no edits at all if they are empty.
+//
+// Unlike [Diff], Words takes quadratic time in the size of the
+// changed region. Above a fixed limit, it reports the whole
+// region as deleted and inserted.
+func Words(old, new string) []Edit {
+	x := tokens(old)
+	y := tokens(new)
+
+	// Trim common prefix and suffix.
+	var out []Edit
+	i := 0
+	for i < len(x) && i < len(y) && x[i] == y[i] {
+		i++
+	}
+	add(&out, Same, strings.Join(x[:i], ""))
+	x, y = x[i:], y[i:]
+	j := 0
+	for j < len(x) && j < len(y) && x[len(x)-1-j] == y[len(y)-1-j] {
+		j++
+	}
+	suffix := strings.Join(x[len(x)-j:], "")
+	x, y = x[:len(x)-j], y[:len(y)-j]
+
+	if len(x)*len(y) > maxWork {
+		add(&out, Delete, strings.Join(x, ""))
+		add(&out, Insert, strings.Join(y, ""))
+		add(&out, Same, suffix)
+		return out
+	}
+
+	// Standard dynamic programming for the longest common subsequence:
+	// lcs[i][j] is the length of the longest common subsequence
+	// of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j = 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			add(&out, Same, x[i])
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			add(&out, Delete, x[i])
+			i++
+		default:
+			add(&out, Insert, y[j])
+			j++
+		}
+	}
+	add(&out, Same, suffix)
+	return out
+}
+
+// add adds an edit with the given kind and text to *out,
+// merging it into the previous edit when possible.
+// Deletions are kept before insertions
+// when both appear between the same unchanged text.
+func add(out *[]Edit, kind Kind, text string) {
+	if text == "" {
+		return
+	}
+	e := *out
+	n := len(e)
+	switch {
+	case n > 0 && e[n-1].Kind == kind:
+		e[n-1].Text += text
+		return
+	case kind == Delete && n > 0 && e[n-1].Kind == Insert:
+		if n > 1 && e[n-2].Kind == Delete {
+			e[n-2].Text += text
+			return
+		}
+		*out = append(e[:n-1], Edit{Delete, text}, e[n-1])
+		return
+	}
+	*out = append(e, Edit{kind, text})
+}
+
+// tokens splits s into words, runs of non-newline spaces,
+// and single other characters (including newlines).
+func tokens(s string) []string {
+	var toks []string
+	for s != "" {
+		r, size := utf8.DecodeRuneInString(s)
+		n := size
+		switch {
+		case isWord(r):
+			for n < len(s) {
+				r, size := utf8.DecodeRuneInString(s[n:])
+				if !isWord(r) {
+					break
+				}
+				n += size
+			}
+		case isSpace(r):
+			for n < len(s) {
+				r, size := utf8.DecodeRuneInString(s[n:])
+				if !isSpace(r) {
+					break
+				}
+				n += size
+			}
+		}
+		toks = append(toks, s[:n])
+		s = s[n:]
+	}
+	return toks
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isSpace(r rune) bool {
+	return r != '\n' && unicode.IsSpace(r)
+}
+
+// WordDiff returns a textual word-level diff of old and new,
+// suitable for logs: the text of new, with deleted text
+// marked as [-text-] and inserted text marked as {+text+},
+// as in “git diff --word-diff”.
+// If old and new are identical, WordDiff returns the empty string.
+func WordDiff(old, new string) string {
+	if old == new {
+		return ""
+	}
+	var b strings.Builder
+	for _, e := range Words(old, new) {
+		switch e.Kind {
+		case Same:
+			b.WriteString(e.Text)
+		case Delete:
+			b.WriteString("[-" + e.Text + "-]")
+		case Insert:
+			b.WriteString("{+" + e.Text + "+}")
+		}
+	}
+	return b.String()
+}
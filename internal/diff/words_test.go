@@ -0,0 +1,78 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var wordDiffTests = []struct {
+	old, new string
+	diff     string
+}{
+	{"", "", ""},
+	{"same", "same", ""},
+	{"", "new", "{+new+}"},
+	{"old", "", "[-old-]"},
+	{"the quick fox", "the slow fox", "the [-quick-]{+slow+} fox"},
+	{"fix teh typo here", "fix the typo here", "fix [-teh-]{+the+} typo here"},
+	{"a b c", "a c", "a [-b -]c"},
+	{"a c", "a b c", "a {+b +}c"},
+	{"call f(x)", "call f(x, y)", "call f(x{+, y+})"},
+	{"line one\nline two\n", "line one\nline 2\n", "line one\nline [-two-]{+2+}\n"},
+	{"x\ny\n", "x\n\ny\n", "x\n{+\n+}y\n"},
+	{"αβ γ", "αβ δ", "αβ [-γ-]{+δ+}"},
+	{"one two", "three four", "[-one-]{+three+} [-two-]{+four+}"},
+}
+
+func TestWordDiff(t *testing.T) {
+	for _, tt := range wordDiffTests {
+		if d := WordDiff(tt.old, tt.new); d != tt.diff {
+			t.Errorf("WordDiff(%q, %q) = %q, want %q", tt.old, tt.new, d, tt.diff)
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	check := func(old, new string) {
+		t.Helper()
+		ws := Words(old, new)
+		var o, n strings.Builder
+		for i, e := range ws {
+			if e.Text == "" {
+				t.Errorf("Words(%q, %q): empty edit %d", old, new, i)
+			}
+			if i > 0 && ws[i-1].Kind == e.Kind {
+				t.Errorf("Words(%q, %q): edits %d and %d have same kind", old, new, i-1, i)
+			}
+			if i > 0 && ws[i-1].Kind == Insert && e.Kind == Delete {
+				t.Errorf("Words(%q, %q): insert %d before delete %d", old, new, i-1, i)
+			}
+			if e.Kind != Insert {
+				o.WriteString(e.Text)
+			}
+			if e.Kind != Delete {
+				n.WriteString(e.Text)
+			}
+		}
+		if o.String() != old || n.String() != new {
+			t.Errorf("Words(%q, %q) = %v, reconstructs %q, %q", old, new, ws, o.String(), n.String())
+		}
+	}
+	for _, tt := range wordDiffTests {
+		check(tt.old, tt.new)
+	}
+
+	// Large inputs fall back to a single replacement.
+	old := strings.Repeat("a b ", 1000)
+	new := "x " + strings.Repeat("b a ", 1000) + "y"
+	check(old, new)
+	want := []Edit{{Delete, old}, {Insert, new}}
+	if ws := Words(old, new); !reflect.DeepEqual(ws, want) {
+		t.Errorf("Words of large inputs = %d edits, want one deletion and one insertion", len(ws))
+	}
+}
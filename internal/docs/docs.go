@@ -18,32 +18,66 @@ import (
 
 // This package stores the following key schemas in the database:
 //
-//	["docs.Doc", URL] => [DBTime, Title, Text]
+//	["docs.Doc", URL] => [DBTime, Title, Text, Kind?, Deleted?]
 //	["docs.DocByTime", DBTime, URL] => []
+//	["docs.DocWatcher", Name] => DBTime
 //
 // DocByTime is an index of Docs by DBTime, which is the time when the
 // record was added to the database. Code that processes new docs can
 // record which DBTime it has most recently processed and then scan forward in
 // the index to learn about new docs.
+//
+// The Kind is omitted when it is empty (and Deleted is false),
+// so documents written before kinds were recorded still decode.
+//
+// A deleted document is kept as a tombstone, with an empty Title and Text
+// and with Deleted set to 1, so that code processing new docs learns
+// about the deletion (see [Corpus.Delete]).
+//
+// If compression is enabled (see [Corpus.EnableCompression]),
+// large Doc values are stored compressed by [storage.Compress].
+
+func init() {
+	timed.RegisterSchema("docs.Doc", "URL", "Title, Text, Kind?, Deleted?")
+}
 
 // A Corpus is the collection of documents stored in a database.
 type Corpus struct {
-	db storage.DB
+	db       storage.DB
+	compress bool // compress large documents; see EnableCompression
 }
 
 // New returns a new Corpus representing the documents stored in db.
 func New(db storage.DB) *Corpus {
-	return &Corpus{db}
+	return &Corpus{db: db}
+}
+
+// EnableCompression enables compression of large documents
+// written to the database (see [storage.Compress]).
+// Compressed and uncompressed documents can be mixed in one database,
+// so compression can be enabled or disabled at any time.
+func (c *Corpus) EnableCompression() {
+	c.compress = true
 }
 
 // A Doc is a single document in the Corpus.
 type Doc struct {
-	DBTime timed.DBTime // database time (from storage.Now) when Doc was written
-	ID     string       // document identifier (such as a URL)
-	Title  string       // title of document
-	Text   string       // text of document
+	DBTime  timed.DBTime // database time (from storage.Now) when Doc was written
+	ID      string       // document identifier (such as a URL)
+	Title   string       // title of document
+	Text    string       // text of document
+	Kind    string       // kind of document (such as [KindIssue]); "" if unknown
+	Deleted bool         // document has been deleted (see [Corpus.Delete])
 }
 
+// Well-known document kinds.
+// Other packages may define additional kinds.
+const (
+	KindIssue = "issue" // issue tracker issue
+	KindCL    = "cl"    // code change: Gerrit CL or GitHub pull request
+	KindDoc   = "doc"   // documentation page, such as a wiki page
+)
+
 // decodeDoc decodes the document in the timed key-value pair.
 // It calls c.db.Panic if the key-value pair is malformed.
 func (c *Corpus) decodeDoc(t *timed.Entry) *Doc {
@@ -53,7 +87,21 @@ func (c *Corpus) decodeDoc(t *timed.Entry) *Doc {
 		// unreachable unless db corruption
 		c.db.Panic("docs decode", "key", storage.Fmt(t.Key), "err", err)
 	}
-	if err := ordered.Decode(t.Val, &d.Title, &d.Text); err != nil {
+	val, err := storage.Decompress(t.Val)
+	if err != nil {
+		// unreachable unless db corruption
+		c.db.Panic("docs decompress", "key", storage.Fmt(t.Key), "err", err)
+	}
+	rest, err := ordered.DecodePrefix(val, &d.Title, &d.Text)
+	if err == nil && len(rest) > 0 {
+		rest, err = ordered.DecodePrefix(rest, &d.Kind)
+	}
+	if err == nil && len(rest) > 0 {
+		var deleted uint8
+		err = ordered.Decode(rest, &deleted)
+		d.Deleted = deleted != 0
+	}
+	if err != nil {
 		// unreachable unless db corruption
 		c.db.Panic("docs decode", "key", storage.Fmt(t.Key), "val", storage.Fmt(t.Val), "err", err)
 	}
@@ -61,9 +109,19 @@ func (c *Corpus) decodeDoc(t *timed.Entry) *Doc {
 }
 
 // Get returns the document with the given id.
-// It returns nil, false if no document is found.
+// It returns nil, false if no document is found
+// or the document has been deleted.
 // It returns d, true otherwise.
 func (c *Corpus) Get(id string) (doc *Doc, ok bool) {
+	d, ok := c.get(id)
+	if !ok || d.Deleted {
+		return nil, false
+	}
+	return d, true
+}
+
+// get is like Get but also returns tombstones.
+func (c *Corpus) get(id string) (doc *Doc, ok bool) {
 	t, ok := timed.Get(c.db, "docs.Doc", ordered.Encode(id))
 	if !ok {
 		return nil, false
@@ -71,27 +129,58 @@ func (c *Corpus) Get(id string) (doc *Doc, ok bool) {
 	return c.decodeDoc(t), true
 }
 
-// Add adds a document with the given id, title, and text.
+// Add adds a document with the given id, title, and text,
+// of unknown kind.
 // If the document already exists in the corpus with the same title and text,
 // Add is an no-op.
 // Otherwise, if the document already exists in the corpus, it is replaced.
 func (c *Corpus) Add(id, title, text string) {
+	c.AddKind(id, "", title, text)
+}
+
+// AddKind is like [Corpus.Add] but also records the document's kind,
+// such as [KindIssue].
+func (c *Corpus) AddKind(id, kind, title, text string) {
 	old, ok := c.Get(id)
-	if ok && old.Title == title && old.Text == text {
+	if ok && old.Title == title && old.Text == text && old.Kind == kind {
+		return
+	}
+	val := ordered.Encode(title, text)
+	if kind != "" {
+		val = ordered.Append(val, kind)
+	}
+	if c.compress {
+		val = storage.Compress(val)
+	}
+	b := c.db.Batch()
+	timed.Set(c.db, b, "docs.Doc", ordered.Encode(id), val)
+	b.Apply()
+}
+
+// Delete deletes the document with the given id, if it exists.
+// The document is replaced by a tombstone, which [Corpus.Get] and
+// [Corpus.Docs] ignore but a [Corpus.DocWatcher] returns as a new [Doc]
+// with Deleted set to true, so that code processing new documents
+// can remove what it derived from the deleted one.
+// Adding the document again replaces the tombstone.
+func (c *Corpus) Delete(id string) {
+	old, ok := c.get(id)
+	if !ok || old.Deleted {
 		return
 	}
+	val := ordered.Encode("", "", old.Kind, uint8(1))
 	b := c.db.Batch()
-	timed.Set(c.db, b, "docs.Doc", ordered.Encode(id), ordered.Encode(title, text))
+	timed.Set(c.db, b, "docs.Doc", ordered.Encode(id), val)
 	b.Apply()
 }
 
 // Docs returns an iterator over all documents in the corpus
-// with IDs starting with a given prefix.
+// with IDs starting with a given prefix, omitting deleted documents.
 // The documents are ordered by ID.
 func (c *Corpus) Docs(prefix string) iter.Seq[*Doc] {
 	return func(yield func(*Doc) bool) {
 		for t := range timed.Scan(c.db, "docs.Doc", ordered.Encode(prefix), ordered.Encode(prefix+"\xff")) {
-			if !yield(c.decodeDoc(t)) {
+			if d := c.decodeDoc(t); !d.Deleted && !yield(d) {
 				return
 			}
 		}
@@ -99,7 +188,8 @@ func (c *Corpus) Docs(prefix string) iter.Seq[*Doc] {
 }
 
 // DocsAfter returns an iterator over all documents with DBTime
-// greater than dbtime and with IDs starting with the prefix.
+// greater than dbtime and with IDs starting with the prefix,
+// omitting deleted documents.
 // The documents are ordered by DBTime.
 func (c *Corpus) DocsAfter(dbtime timed.DBTime, prefix string) iter.Seq[*Doc] {
 	filter := func(key []byte) bool {
@@ -115,7 +205,7 @@ func (c *Corpus) DocsAfter(dbtime timed.DBTime, prefix string) iter.Seq[*Doc] {
 	}
 	return func(yield func(*Doc) bool) {
 		for t := range timed.ScanAfter(c.db, "docs.Doc", dbtime, filter) {
-			if !yield(c.decodeDoc(t)) {
+			if d := c.decodeDoc(t); !d.Deleted && !yield(d) {
 				return
 			}
 		}
@@ -124,6 +214,8 @@ func (c *Corpus) DocsAfter(dbtime timed.DBTime, prefix string) iter.Seq[*Doc] {
 
 // DocWatcher returns a new [storage.Watcher] with the given name.
 // It picks up where any previous Watcher of the same name left off.
+// Unlike the other Corpus methods, the Watcher returns deleted documents
+// (with Deleted set to true), so that watchers learn about deletions.
 func (c *Corpus) DocWatcher(name string) *timed.Watcher[*Doc] {
 	return timed.NewWatcher(c.db, name, "docs.Doc", c.decodeDoc)
 }
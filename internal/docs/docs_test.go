@@ -10,6 +10,8 @@ import (
 	"testing"
 
 	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
 )
 
 func TestCorpus(t *testing.T) {
@@ -116,3 +118,116 @@ func TestCorpus(t *testing.T) {
 		t.Errorf("DocsAfter(0, id1) = %v, want %v", ids, want)
 	}
 }
+
+func TestKind(t *testing.T) {
+	db := storage.MemDB()
+	corpus := New(db)
+	corpus.Add("id1", "Title1", "text1")
+	corpus.AddKind("id2", KindDoc, "Title2", "text2")
+
+	check := func(id, kind string) {
+		t.Helper()
+		d, ok := corpus.Get(id)
+		if !ok || d.Kind != kind {
+			t.Fatalf("Get(%q) = %+v, %v, want Kind=%q", id, d, ok, kind)
+		}
+	}
+	check("id1", "")
+	check("id2", KindDoc)
+
+	// Changing only the kind replaces the document.
+	d1, _ := corpus.Get("id1")
+	corpus.AddKind("id1", KindIssue, "Title1", "text1")
+	check("id1", KindIssue)
+	if d, _ := corpus.Get("id1"); d.DBTime == d1.DBTime {
+		t.Errorf("AddKind with new kind did not update document")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := storage.MemDB()
+	corpus := New(db)
+	corpus.AddKind("id1", KindIssue, "Title1", "text1")
+	corpus.Add("id2", "Title2", "text2")
+	w := corpus.DocWatcher("test")
+	for d := range w.Recent() {
+		w.MarkOld(d.DBTime)
+	}
+
+	corpus.Delete("id1")
+	corpus.Delete("id1") // no-op
+	corpus.Delete("id3") // no-op
+	if d, ok := corpus.Get("id1"); ok {
+		t.Errorf("Get(id1) after Delete = %+v, true", d)
+	}
+	var ids []string
+	for d := range corpus.Docs("") {
+		ids = append(ids, d.ID)
+	}
+	if !slices.Equal(ids, []string{"id2"}) {
+		t.Errorf("Docs after Delete = %v, want [id2]", ids)
+	}
+	for d := range corpus.DocsAfter(0, "") {
+		if d.Deleted {
+			t.Errorf("DocsAfter returned deleted %+v", d)
+		}
+	}
+
+	// The watcher sees the tombstone.
+	var recent []*Doc
+	for d := range w.Recent() {
+		recent = append(recent, d)
+		w.MarkOld(d.DBTime)
+	}
+	if len(recent) != 1 || recent[0].ID != "id1" || !recent[0].Deleted || recent[0].Kind != KindIssue || recent[0].Text != "" {
+		t.Fatalf("Recent after Delete = %+v, want deleted id1", recent)
+	}
+
+	// Adding the document again replaces the tombstone.
+	corpus.Add("id1", "Title1", "text1")
+	if d, ok := corpus.Get("id1"); !ok || d.Deleted || d.Text != "text1" {
+		t.Errorf("Get(id1) after re-Add = %+v, %v", d, ok)
+	}
+	recent = nil
+	for d := range w.Recent() {
+		recent = append(recent, d)
+	}
+	if len(recent) != 1 || recent[0].ID != "id1" || recent[0].Deleted {
+		t.Errorf("Recent after re-Add = %+v, want id1", recent)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	db := storage.MemDB()
+	corpus := New(db)
+	corpus.EnableCompression()
+	big := strings.Repeat("text ", 1000)
+	corpus.AddKind("big", KindDoc, "Title", big)
+	corpus.Add("small", "Title", "text")
+
+	compressed := func(id string) bool {
+		t, _ := timed.Get(db, "docs.Doc", ordered.Encode(id))
+		return storage.IsCompressed(t.Val)
+	}
+	if !compressed("big") || compressed("small") {
+		t.Errorf("compressed big, small = %v, %v, want true, false", compressed("big"), compressed("small"))
+	}
+	if d, ok := corpus.Get("big"); !ok || d.Text != big || d.Kind != KindDoc {
+		t.Errorf("Get(big) = %+v, %v", d, ok)
+	}
+
+	// Adding the same document again is still a no-op.
+	d1, _ := corpus.Get("big")
+	corpus.AddKind("big", KindDoc, "Title", big)
+	if d, _ := corpus.Get("big"); d.DBTime != d1.DBTime {
+		t.Errorf("re-adding compressed document rewrote it")
+	}
+
+	// Uncompressed documents written earlier still decode.
+	corpus.compress = false
+	corpus.Add("big2", "Title", big)
+	corpus.compress = true
+	if d, ok := corpus.Get("big2"); compressed("big2") || !ok || d.Text != big {
+		t.Errorf("Get(big2) = %+v, %v", d, ok)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embeddocs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/ordered"
+)
+
+// reembedReport is how often, in documents, Reembed
+// records and logs its progress.
+const reembedReport = 1000
+
+// A Progress records the progress of re-embedding a corpus
+// (see [Syncer.Reembed]).
+type Progress struct {
+	Name  string    // name of the Syncer (see [Syncer.SetName])
+	Start time.Time // time the re-embedding started
+	End   time.Time // time the re-embedding finished; zero if unfinished
+	Docs  int64     // number of documents embedded so far
+}
+
+// Reembed is shorthand for creating a Syncer with
+// New(lg, db, vdb, embed, dc), setting its name to name,
+// and calling its Reembed method.
+func Reembed(ctx context.Context, lg *slog.Logger, db storage.DB, vdb storage.VectorDB, embed llm.Embedder, dc *docs.Corpus, name string) error {
+	s := New(lg, db, vdb, embed, dc)
+	s.SetName(name)
+	return s.Reembed(ctx)
+}
+
+// Reembed embeds every document in the corpus into the vector database,
+// for example to fill a new vector database namespace
+// using a new embedding model.
+//
+// Unlike [Syncer.Sync], which embeds only the documents added
+// since its last call, Reembed starts over at the beginning of
+// the corpus, restarting the Syncer's [docs.DocWatcher]
+// and forgetting which documents it has embedded before,
+// so that even unchanged documents are embedded again.
+// Its position in the corpus is saved after each batch,
+// so if Reembed stops early, because of an error or because ctx
+// is canceled, calling Reembed again on a Syncer with the same name
+// (see [Syncer.SetName]) resumes where the first call left off.
+// Once Reembed has finished, calling it again starts over,
+// while calling Sync keeps the vector database up to date.
+//
+// Reembed records its progress in the database (see [ReembedProgress]).
+// It returns an error if it stops before embedding every document.
+func (s *Syncer) Reembed(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "embeddocs.Reembed")
+	defer span.End()
+
+	p, ok := ReembedProgress(s.db, s.name)
+	if !ok || !p.End.IsZero() {
+		p = &Progress{Name: s.name, Start: s.now()}
+		s.dc.DocWatcher(s.name).Restart()
+		s.db.DeleteRange(hashKey(s.name, ""), ordered.Encode("embeddocs.Hash", s.name, ordered.Inf))
+		s.setProgress(p)
+		s.slog.InfoContext(ctx, "embeddocs reembed start", "name", s.name)
+	} else {
+		s.slog.InfoContext(ctx, "embeddocs reembed resume", "name", s.name, "docs", p.Docs)
+	}
+
+	next := p.Docs + reembedReport
+	ok = s.sync(ctx, func(n int) {
+		p.Docs += int64(n)
+		if p.Docs >= next {
+			s.setProgress(p)
+			s.slog.InfoContext(ctx, "embeddocs reembed progress", "name", s.name, "docs", p.Docs)
+			next = p.Docs + reembedReport
+		}
+	})
+	s.setProgress(p)
+	if ok {
+		for range s.dc.DocWatcher(s.name).Recent() {
+			ok = false
+			break
+		}
+	}
+	if !ok {
+		err := fmt.Errorf("embeddocs reembed %s: stopped after %d documents; run again to resume", s.name, p.Docs)
+		tracing.End(span, err)
+		return err
+	}
+	p.End = s.now()
+	s.setProgress(p)
+	s.slog.InfoContext(ctx, "embeddocs reembed done", "name", s.name, "docs", p.Docs, "duration", p.End.Sub(p.Start))
+	return nil
+}
+
+func progressKey(name string) []byte {
+	return ordered.Encode("embeddocs.Reembed", name)
+}
+
+// setProgress records p in the database.
+func (s *Syncer) setProgress(p *Progress) {
+	s.db.Set(progressKey(p.Name), storage.JSON(p))
+	s.db.Flush()
+}
+
+// ReembedProgress returns the progress of the most recent
+// re-embedding by a Syncer with the given name (see [Syncer.Reembed]).
+// If there has been none, ReembedProgress returns nil, false.
+func ReembedProgress(db storage.DB, name string) (*Progress, bool) {
+	val, ok := db.Get(progressKey(name))
+	if !ok {
+		return nil, false
+	}
+	p := new(Progress)
+	if err := json.Unmarshal(val, p); err != nil {
+		// unreachable unless corrupt storage
+		db.Panic("embeddocs progress decode", "name", name, "err", err)
+	}
+	return p, true
+}
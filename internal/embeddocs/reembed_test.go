@@ -0,0 +1,96 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embeddocs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestReembed(t *testing.T) {
+	const N = 250
+
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	dc := docs.New(db)
+	for i := range N {
+		dc.Add(fmt.Sprintf("URL%03d", i), "", fmt.Sprintf("Text%d", i))
+	}
+	vdb := storage.MemVectorDB(db, lg, "")
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+
+	if _, ok := ReembedProgress(db, "embeddocs:v2"); ok {
+		t.Fatalf("ReembedProgress before Reembed succeeded")
+	}
+
+	// The LLM goes down partway through.
+	vdb2 := storage.MemVectorDB(db, lg, "v2")
+	e := &slowEmbed{fail: func(n int) bool { return n >= 150 }}
+	s := New(lg, db, vdb2, e, dc)
+	s.SetName("embeddocs:v2")
+	s.backoff = 0
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return start }
+	err := s.Reembed(ctx)
+	if err == nil || !strings.Contains(err.Error(), "stopped after 100 documents") {
+		t.Fatalf("Reembed with failing LLM = %v, want stopped after 100 documents", err)
+	}
+	p, ok := ReembedProgress(db, "embeddocs:v2")
+	if want := (Progress{Name: "embeddocs:v2", Start: start, Docs: 100}); !ok || *p != want {
+		t.Errorf("ReembedProgress = %+v, %v, want %+v", p, ok, want)
+	}
+
+	// Reembed resumes where it left off,
+	// skipping documents embedded before the failure.
+	e = &slowEmbed{}
+	s.embed = e
+	end := start.Add(time.Hour)
+	s.now = func() time.Time { return end }
+	if err := s.Reembed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if e.batches["Text0"] || !e.batches["Text150"] || e.calls != 1 {
+		t.Errorf("resumed Reembed: batches %v, %d calls, want from Text150, 1 call", e.batches, e.calls)
+	}
+	p, _ = ReembedProgress(db, "embeddocs:v2")
+	if want := (Progress{Name: "embeddocs:v2", Start: start, End: end, Docs: N}); *p != want {
+		t.Errorf("ReembedProgress = %+v, want %+v", p, want)
+	}
+	for i := range N {
+		if _, ok := vdb2.Get(fmt.Sprintf("URL%03d", i)); !ok {
+			t.Errorf("URL%03d missing from v2", i)
+		}
+	}
+
+	// Sync with the same name picks up only new documents,
+	// and the original namespace is unaffected.
+	dc.Add("URL250", "", "Text250")
+	e = &slowEmbed{}
+	s.embed = e
+	s.Sync(ctx)
+	if e.calls != 1 || !e.batches["Text250"] {
+		t.Errorf("Sync after Reembed: batches %v, %d calls, want Text250, 1 call", e.batches, e.calls)
+	}
+	if _, ok := vdb.Get("URL250"); ok {
+		t.Errorf("Sync of v2 wrote URL250 to original namespace")
+	}
+
+	// Reembed after finishing starts over.
+	e = &slowEmbed{}
+	s.embed = e
+	if err := s.Reembed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !e.batches["Text0"] || e.calls != 3 {
+		t.Errorf("second Reembed: batches %v, %d calls, want from Text0, 3 calls", e.batches, e.calls)
+	}
+}
@@ -3,80 +3,484 @@
 // license that can be found in the LICENSE file.
 
 // Package embeddocs implements embedding text docs into a vector database.
+//
+// A failed EmbedDocs call is retried a few times with exponential backoff.
+// If the batch still fails, its documents are embedded one at a time,
+// to find the ones that cannot be embedded (for example, because they
+// are too long for the model). A document that fails in [MaxFailures]
+// calls to [Syncer.Sync] is skipped, so that it does not hold up the
+// documents after it, and recorded in a dead-letter list (see [DeadLetters]).
+//
+// Along with each vector, a [Syncer] records a hash of the document
+// it was computed from, so that it can skip documents that are re-added
+// unchanged, as happens when a [rsc.io/gaby/internal/githubdocs.Restart]
+// reconverts every issue.
 package embeddocs
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
 	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"rsc.io/gaby/internal/docs"
 	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/llmusage"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/ordered"
 )
 
-// Sync reads new documents from dc, embeds them using embed,
-// and then writes the (docid, vector) pairs to vdb.
+// This package stores the following key schema in the database:
+//
+//	["embeddocs.Failure", Name, ID] => JSON of Failure
+//	["embeddocs.Reembed", Name] => JSON of Progress
+//	["embeddocs.Hash", Name, ID] => SHA-256 of ordered.Encode(Title, Text)
+//
+// Name is the Syncer's name (see [Syncer.SetName]).
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "embeddocs.Failure", Key: "Name, ID", Val: "JSON of Failure"},
+		storage.Schema{Kind: "embeddocs.Reembed", Key: "Name", Val: "JSON of Progress"},
+		storage.Schema{Kind: "embeddocs.Hash", Key: "Name, ID", Val: "SHA-256 of ordered.Encode(Title, Text)"},
+	)
+}
+
+const (
+	batchSize = 100  // documents embedded in each call to EmbedDocs
+	maxBatch  = 1000 // documents, including unchanged and deleted ones, in a batch
+	maxTries  = 3    // calls to EmbedDocs for a batch before giving up
+	maxSolo   = 3    // failed one-document calls before assuming all will fail
+
+	// MaxFailures is the number of calls to [Syncer.Sync]
+	// in which a document must fail to embed before it is skipped.
+	MaxFailures = 3
+)
+
+// A Failure records a document that could not be embedded.
+type Failure struct {
+	ID       string    // document ID
+	Failures int       // number of Syncs in which the document failed to embed
+	Err      string    // error from the most recent failure
+	Time     time.Time // time of the most recent failure
+}
+
+// Dead reports whether the document has failed often enough
+// to be skipped (see [MaxFailures]).
+func (f *Failure) Dead() bool {
+	return f.Failures >= MaxFailures
+}
+
+// A Syncer embeds new documents from a corpus into a vector database.
+type Syncer struct {
+	slog    *slog.Logger
+	name    string
+	db      storage.DB
+	vdb     storage.VectorDB
+	embed   llm.Embedder
+	dc      *docs.Corpus
+	workers int              // concurrent EmbedDocs calls in Sync
+	backoff time.Duration    // delay before first retry; doubles for each retry
+	now     func() time.Time // for testing
+}
+
+// New returns a new Syncer that reads new documents from dc,
+// embeds them using embed, and writes the (docid, vector) pairs to vdb.
+// The Syncer logs status and unexpected problems to lg
+// and records documents that fail to embed in db.
+func New(lg *slog.Logger, db storage.DB, vdb storage.VectorDB, embed llm.Embedder, dc *docs.Corpus) *Syncer {
+	return &Syncer{
+		slog:    lg,
+		name:    "embeddocs",
+		db:      db,
+		vdb:     vdb,
+		embed:   embed,
+		dc:      dc,
+		workers: 4,
+		backoff: time.Second,
+		now:     time.Now,
+	}
+}
+
+// SetConcurrency sets the number of batches of documents that
+// [Syncer.Sync] embeds concurrently. The default is 4.
+// Sync still saves the embeddings one batch at a time, in order.
+// A concurrency of 1 or less embeds batches serially.
+func (s *Syncer) SetConcurrency(n int) {
+	s.workers = max(n, 1)
+}
+
+// SetName sets the name of the [docs.DocWatcher] that the Syncer uses
+// to save its position, which is also the name of its re-embedding
+// progress record (see [Syncer.Reembed]) and of its failure records
+// (see [DeadLetters]). The default is “embeddocs”.
+// Syncers writing to different vector database namespaces
+// need different names.
+func (s *Syncer) SetName(name string) {
+	s.name = name
+}
+
+// Sync is shorthand for New(lg, db, vdb, embed, dc).Sync(ctx).
+func Sync(ctx context.Context, lg *slog.Logger, db storage.DB, vdb storage.VectorDB, embed llm.Embedder, dc *docs.Corpus) {
+	New(lg, db, vdb, embed, dc).Sync(ctx)
+}
+
+// A batch is a batch of documents being embedded.
+type batch struct {
+	seq  int64 // sequence number of batch within Sync
+	docs []llm.EmbedDoc
+	ids  []string
+	sums [][]byte      // hashes of docs
+	dels []string      // IDs of deleted documents, whose vectors to delete
+	same int           // number of unchanged documents skipped
+	last timed.DBTime  // DBTime of the last document in the batch
+	done chan struct{} // closed when vecs, errs, and err are set
+	vecs []llm.Vector
+	errs []error // if non-nil, errors for individual docs; vecs[i] is nil if errs[i] != nil
+	err  error
+}
+
+// errSkipped is the error for a batch that was not embedded
+// because an earlier batch failed.
+// Sync never saves such a batch, since it stops at the earlier one.
+var errSkipped = errors.New("skipped after earlier failure")
+
+// Sync reads new documents, embeds them, and writes them to the vector database.
 //
-// Sync uses [docs.DocWatcher] with the the name “embeddocs” to
+// Sync uses a [docs.DocWatcher] (see [Syncer.SetName]) to
 // save its position across multiple calls.
+// It embeds up to the configured number of batches concurrently
+// (see [Syncer.SetConcurrency]), but it saves them in order,
+// advancing its position past a batch only after that batch
+// and all earlier ones have been saved.
+// Once a batch fails despite retries, for example because the
+// LLM's daily budget has been exceeded, Sync starts no more batches,
+// leaving the remaining documents for a future call.
+// A batch in which only some documents fail also stops Sync,
+// unless the failing documents have failed [MaxFailures] times,
+// in which case Sync skips them and continues.
 //
-// Sync logs status and unexpected problems to lg.
-func Sync(lg *slog.Logger, vdb storage.VectorDB, embed llm.Embedder, dc *docs.Corpus) {
-	lg.Info("embeddocs sync")
+// If ctx is canceled, Sync stops reading documents
+// but still embeds and saves the ones already read.
+func (s *Syncer) Sync(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "embeddocs.Sync")
+	defer span.End()
 
-	const batchSize = 100
+	s.slog.InfoContext(ctx, "embeddocs sync")
+	s.sync(ctx, nil)
+}
+
+// sync implements [Syncer.Sync], calling progress (if non-nil)
+// with the number of documents, embedded or unchanged,
+// in each batch it saves.
+// It reports whether it saved all the documents it read.
+func (s *Syncer) sync(ctx context.Context, progress func(int)) bool {
 	var (
-		batch     []llm.EmbedDoc
-		ids       []string
-		batchLast timed.DBTime
+		w       = s.dc.DocWatcher(s.name)
+		b       = new(batch)
+		pending []*batch // batches started but not yet saved
+		seq     int64
+		wg      sync.WaitGroup
+		failed  atomic.Int64 // seq of earliest failed batch
 	)
-	w := dc.DocWatcher("embeddocs")
+	failed.Store(math.MaxInt64)
+	defer wg.Wait()
 
-	flush := func() bool {
-		vecs, err := embed.EmbedDocs(batch)
-		if len(vecs) > len(ids) {
-			lg.Error("embeddocs length mismatch", "batch", len(batch), "vecs", len(vecs), "ids", len(ids))
-			return false
-		}
-		for i, v := range vecs {
-			vdb.Set(ids[i], v)
-		}
-		if err != nil {
-			lg.Error("embeddocs EmbedDocs error", "err", err)
+	// start starts embedding the batch b and begins a new one.
+	start := func() {
+		b.seq = seq
+		seq++
+		b.done = make(chan struct{})
+		pending = append(pending, b)
+		wg.Add(1)
+		go func(b *batch) {
+			defer wg.Done()
+			defer close(b.done)
+			if failed.Load() < b.seq {
+				b.err = errSkipped
+				return
+			}
+			s.embedBatch(ctx, b)
+			for b.err != nil {
+				old := failed.Load()
+				if old <= b.seq || failed.CompareAndSwap(old, b.seq) {
+					break
+				}
+			}
+		}(b)
+		b = new(batch)
+	}
+
+	// save waits for the first pending batch and saves it,
+	// reporting whether it succeeded.
+	// It must be called during an iteration over w.Recent,
+	// so that it can call w.MarkOld.
+	save := func() bool {
+		b := pending[0]
+		pending = pending[1:]
+		<-b.done
+		if !s.save(ctx, w, b) {
 			return false
 		}
-		if len(vecs) != len(ids) {
-			lg.Error("embeddocs length mismatch", "batch", len(batch), "vecs", len(vecs), "ids", len(ids))
-			return false
+		if progress != nil {
+			progress(len(b.ids) + b.same)
 		}
-		vdb.Flush() // todo vdb
-		w.MarkOld(batchLast)
-		w.Flush()
-		batch = nil
-		ids = nil
 		return true
 	}
 
 	for d := range w.Recent() {
-		lg.Debug("embeddocs sync start", "doc", d.ID)
-		batch = append(batch, llm.EmbedDoc{Title: d.Title, Text: d.Text})
-		ids = append(ids, d.ID)
-		batchLast = d.DBTime
-		if len(batch) >= batchSize {
-			if !flush() {
-				break
+		if ctx.Err() != nil {
+			break
+		}
+		if d.Deleted {
+			s.slog.DebugContext(ctx, "embeddocs sync delete", "doc", d.ID)
+			b.dels = append(b.dels, d.ID)
+		} else if sum := hash(d); s.unchanged(d.ID, sum) {
+			s.slog.DebugContext(ctx, "embeddocs sync unchanged", "doc", d.ID)
+			b.same++
+		} else {
+			s.slog.DebugContext(ctx, "embeddocs sync start", "doc", d.ID)
+			b.docs = append(b.docs, llm.EmbedDoc{Title: d.Title, Text: d.Text})
+			b.ids = append(b.ids, d.ID)
+			b.sums = append(b.sums, sum)
+		}
+		b.last = d.DBTime
+		if len(b.docs) >= batchSize || b.size() >= maxBatch {
+			start()
+		}
+		// Save the batches that are done, and wait for
+		// the oldest one if all the workers are busy.
+		for len(pending) > 0 && (len(pending) >= s.workers || isDone(pending[0])) {
+			if !save() {
+				return false
 			}
 		}
 	}
-	if len(batch) > 0 {
-		// More to flush, but flush uses w.MarkOld,
+	if b.size() > 0 {
+		start()
+	}
+	if len(pending) > 0 {
+		// More to save, but save uses w.MarkOld,
 		// which has to be called during an iteration over w.Recent.
-		// Start a new iteration just to call flush and then break out.
+		// Start a new iteration just to save and then break out.
 		for _ = range w.Recent() {
-			if !flush() {
-				return
+			for len(pending) > 0 {
+				if !save() {
+					return false
+				}
 			}
 			break
 		}
 	}
+	return true
+}
+
+// size returns the number of documents in b,
+// including deleted and unchanged ones.
+func (b *batch) size() int {
+	return len(b.docs) + len(b.dels) + b.same
+}
+
+// hash returns the hash of the content of d.
+func hash(d *docs.Doc) []byte {
+	sum := sha256.Sum256(ordered.Encode(d.Title, d.Text))
+	return sum[:]
+}
+
+func hashKey(name, id string) []byte {
+	return ordered.Encode("embeddocs.Hash", name, id)
+}
+
+// unchanged reports whether the vector database holds a vector for
+// the document with the given id computed from content with the given hash.
+func (s *Syncer) unchanged(id string, sum []byte) bool {
+	old, ok := s.db.Get(hashKey(s.name, id))
+	if !ok || !bytes.Equal(old, sum) {
+		return false
+	}
+	_, ok = s.vdb.Get(id)
+	return ok
+}
+
+// isDone reports whether b has finished embedding.
+func isDone(b *batch) bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// embedBatch embeds the documents in b, setting b.vecs and b.err,
+// retrying failed calls with exponential backoff.
+// If the batch keeps failing, embedBatch embeds the documents
+// one at a time, setting b.errs to the errors for the ones that fail,
+// unless they all fail, suggesting that the problem is not the documents.
+func (s *Syncer) embedBatch(ctx context.Context, b *batch) {
+	if len(b.docs) == 0 {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "embeddocs.batch", attribute.Int("docs", len(b.docs)))
+	defer func() { tracing.End(span, b.err) }()
+
+	delay := s.backoff
+	for try := 1; ; try++ {
+		b.vecs, b.err = s.embed.EmbedDocs(ctx, b.docs)
+		if b.err == nil && len(b.vecs) != len(b.docs) {
+			b.err = fmt.Errorf("embeddocs length mismatch: batch %d, vecs %d", len(b.docs), len(b.vecs))
+		}
+		if b.err == nil || try >= maxTries || !retryable(ctx, b.err) {
+			break
+		}
+		s.slog.WarnContext(ctx, "embeddocs EmbedDocs retry", "try", try, "delay", delay, "err", b.err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if b.err == nil || !retryable(ctx, b.err) {
+		return
+	}
+
+	vecs := make([]llm.Vector, len(b.docs))
+	errs := make([]error, len(b.docs))
+	ok, bad := 0, 0
+	for i, d := range b.docs {
+		v, err := s.embed.EmbedDocs(ctx, []llm.EmbedDoc{d})
+		if err == nil && len(v) != 1 {
+			err = fmt.Errorf("embeddocs length mismatch: batch 1, vecs %d", len(v))
+		}
+		if err != nil && !retryable(ctx, err) {
+			b.vecs, b.err = nil, err
+			return
+		}
+		if err != nil {
+			if bad++; ok == 0 && bad >= min(maxSolo, len(b.docs)) && len(b.docs) > 1 {
+				return // everything is failing; keep b.err
+			}
+			errs[i] = err
+			continue
+		}
+		ok++
+		vecs[i] = v[0]
+	}
+	b.vecs, b.errs, b.err = vecs, errs, nil
+}
+
+// retryable reports whether the error err from EmbedDocs is worth retrying.
+// Errors from exceeding the daily LLM budget are not,
+// nor are any errors once ctx is canceled.
+func retryable(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, llmusage.ErrOverBudget)
+}
+
+// save writes the vectors for b to the vector database
+// and marks its documents old in w, reporting whether it succeeded.
+// Vectors returned along with an error are still saved,
+// but the documents are not marked old.
+// Documents that failed individually are recorded as failures;
+// they are skipped only if they have failed [MaxFailures] times.
+// The vectors for deleted documents are deleted once the rest
+// of the batch has been saved.
+func (s *Syncer) save(ctx context.Context, w *timed.Watcher[*docs.Doc], b *batch) bool {
+	if len(b.vecs) > len(b.ids) {
+		s.slog.ErrorContext(ctx, "embeddocs length mismatch", "batch", len(b.docs), "vecs", len(b.vecs), "ids", len(b.ids))
+		return false
+	}
+	blocked := false
+	for i, v := range b.vecs {
+		if b.errs != nil && b.errs[i] != nil {
+			if f := s.fail(b.ids[i], b.errs[i]); f.Dead() {
+				s.slog.ErrorContext(ctx, "embeddocs skipping doc", "doc", b.ids[i], "failures", f.Failures, "err", f.Err)
+			} else {
+				s.slog.WarnContext(ctx, "embeddocs doc failed", "doc", b.ids[i], "failures", f.Failures, "err", f.Err)
+				blocked = true
+			}
+			continue
+		}
+		s.vdb.Set(b.ids[i], v)
+		s.db.Set(hashKey(s.name, b.ids[i]), b.sums[i])
+		if _, ok := s.db.Get(failureKey(s.name, b.ids[i])); ok {
+			s.db.Delete(failureKey(s.name, b.ids[i]))
+		}
+	}
+	if b.err != nil {
+		s.slog.ErrorContext(ctx, "embeddocs EmbedDocs error", "err", b.err)
+		return false
+	}
+	if len(b.vecs) != len(b.ids) {
+		s.slog.ErrorContext(ctx, "embeddocs length mismatch", "batch", len(b.docs), "vecs", len(b.vecs), "ids", len(b.ids))
+		return false
+	}
+	if blocked {
+		s.vdb.Flush() // todo vdb
+		s.db.Flush()
+		return false
+	}
+	for _, id := range b.dels {
+		s.vdb.Delete(id)
+		s.db.Delete(hashKey(s.name, id))
+		if _, ok := s.db.Get(failureKey(s.name, id)); ok {
+			s.db.Delete(failureKey(s.name, id))
+		}
+	}
+	s.vdb.Flush() // todo vdb
+	w.MarkOld(b.last)
+	w.Flush()
+	return true
+}
+
+func failureKey(name, id string) []byte {
+	return ordered.Encode("embeddocs.Failure", name, id)
+}
+
+// fail records that the document with the given id failed to embed
+// with the given error, returning the updated failure record.
+func (s *Syncer) fail(id string, err error) *Failure {
+	f := &Failure{ID: id}
+	if val, ok := s.db.Get(failureKey(s.name, id)); ok {
+		if err := json.Unmarshal(val, f); err != nil {
+			// unreachable unless corrupt storage
+			s.db.Panic("embeddocs failure decode", "doc", id, "err", err)
+		}
+	}
+	f.Failures++
+	f.Err = err.Error()
+	f.Time = s.now()
+	s.db.Set(failureKey(s.name, id), storage.JSON(f))
+	return f
+}
+
+// DeadLetters returns an iterator over the documents in db
+// that the Syncer with the given name (see [Syncer.SetName])
+// has skipped because they failed to embed
+// (see [MaxFailures]), in order by document ID.
+// A dead letter is removed if a later version of its document
+// embeds successfully.
+func DeadLetters(db storage.DB, name string) iter.Seq[*Failure] {
+	return func(yield func(*Failure) bool) {
+		for key, val := range db.Scan(failureKey(name, ""), ordered.Encode("embeddocs.Failure", name, ordered.Inf)) {
+			var f Failure
+			if err := json.Unmarshal(val(), &f); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("embeddocs failure decode", "key", storage.Fmt(key), "err", err)
+			}
+			if f.Dead() && !yield(&f) {
+				return
+			}
+		}
+	}
 }
@@ -5,16 +5,26 @@
 package embeddocs
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"rsc.io/gaby/internal/docs"
 	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/llmusage"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/testutil"
 )
 
+var ctx = context.Background()
+
 var texts = []string{
 	"for loops",
 	"for all time, always",
@@ -42,7 +52,7 @@ func TestSync(t *testing.T) {
 		dc.Add(fmt.Sprintf("URL%d", i), "", text)
 	}
 
-	Sync(lg, vdb, llm.QuoteEmbedder(), dc)
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
 	for i, text := range texts {
 		vec, ok := vdb.Get(fmt.Sprintf("URL%d", i))
 		if !ok {
@@ -59,7 +69,7 @@ func TestSync(t *testing.T) {
 		dc.Add(fmt.Sprintf("rot13%d", i), "", rot13(text))
 	}
 	vdb2 := storage.MemVectorDB(db, lg, "step2")
-	Sync(lg, vdb2, llm.QuoteEmbedder(), dc)
+	Sync(ctx, lg, db, vdb2, llm.QuoteEmbedder(), dc)
 	for i, text := range texts {
 		vec, ok := vdb2.Get(fmt.Sprintf("URL%d", i))
 		if ok {
@@ -86,7 +96,7 @@ func TestBigSync(t *testing.T) {
 		dc.Add(fmt.Sprintf("URL%d", i), "", fmt.Sprintf("Text%d", i))
 	}
 
-	Sync(lg, vdb, llm.QuoteEmbedder(), dc)
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
 	for i := range N {
 		vec, ok := vdb.Get(fmt.Sprintf("URL%d", i))
 		if !ok {
@@ -112,7 +122,7 @@ func TestBadEmbedders(t *testing.T) {
 	lg, out := testutil.SlogBuffer()
 	db = storage.MemDB()
 	vdb := storage.MemVectorDB(db, lg, "vdb")
-	Sync(lg, vdb, tooManyEmbed{}, dc)
+	syncNoBackoff(lg, db, vdb, tooManyEmbed{}, dc)
 	if !strings.Contains(out.String(), "embeddocs length mismatch") {
 		t.Errorf("tooManyEmbed did not report error:\n%s", out)
 	}
@@ -120,7 +130,7 @@ func TestBadEmbedders(t *testing.T) {
 	lg, out = testutil.SlogBuffer()
 	db = storage.MemDB()
 	vdb = storage.MemVectorDB(db, lg, "vdb")
-	Sync(lg, vdb, embedErr{}, dc)
+	syncNoBackoff(lg, db, vdb, embedErr{}, dc)
 	if !strings.Contains(out.String(), "EMBED ERROR") {
 		t.Errorf("embedErr did not report error:\n%s", out)
 	}
@@ -131,7 +141,7 @@ func TestBadEmbedders(t *testing.T) {
 	lg, out = testutil.SlogBuffer()
 	db = storage.MemDB()
 	vdb = storage.MemVectorDB(db, lg, "vdb")
-	Sync(lg, vdb, embedHalf{}, dc)
+	syncNoBackoff(lg, db, vdb, embedHalf{}, dc)
 	if !strings.Contains(out.String(), "length mismatch") {
 		t.Errorf("embedHalf did not report error:\n%s", out)
 	}
@@ -140,6 +150,13 @@ func TestBadEmbedders(t *testing.T) {
 	}
 }
 
+// syncNoBackoff is like [Sync] but retries failures without waiting.
+func syncNoBackoff(lg *slog.Logger, db storage.DB, vdb storage.VectorDB, e llm.Embedder, dc *docs.Corpus) {
+	s := New(lg, db, vdb, e, dc)
+	s.backoff = 0
+	s.Sync(ctx)
+}
+
 func rot13(s string) string {
 	b := []byte(s)
 	for i, x := range b {
@@ -154,23 +171,506 @@ func rot13(s string) string {
 
 type tooManyEmbed struct{}
 
-func (tooManyEmbed) EmbedDocs(docs []llm.EmbedDoc) ([]llm.Vector, error) {
-	vec, _ := llm.QuoteEmbedder().EmbedDocs(docs)
+func (tooManyEmbed) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	vec, _ := llm.QuoteEmbedder().EmbedDocs(ctx, docs)
 	vec = append(vec, vec...)
 	return vec, nil
 }
 
 type embedErr struct{}
 
-func (embedErr) EmbedDocs(docs []llm.EmbedDoc) ([]llm.Vector, error) {
-	vec, _ := llm.QuoteEmbedder().EmbedDocs(docs)
+func (embedErr) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	vec, _ := llm.QuoteEmbedder().EmbedDocs(ctx, docs)
 	return vec, fmt.Errorf("EMBED ERROR")
 }
 
 type embedHalf struct{}
 
-func (embedHalf) EmbedDocs(docs []llm.EmbedDoc) ([]llm.Vector, error) {
-	vec, _ := llm.QuoteEmbedder().EmbedDocs(docs)
+func (embedHalf) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	vec, _ := llm.QuoteEmbedder().EmbedDocs(ctx, docs)
 	vec = vec[:len(vec)/2]
 	return vec, nil
 }
+
+func TestSyncCanceled(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "")
+	dc := docs.New(db)
+	for i, text := range texts {
+		dc.Add(fmt.Sprintf("URL%d", i), "", text)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	Sync(canceled, lg, db, vdb, llm.QuoteEmbedder(), dc)
+	if _, ok := vdb.Get("URL0"); ok {
+		t.Errorf("canceled Sync wrote URL0")
+	}
+
+	// The next Sync picks up where the canceled one left off.
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+	for i := range texts {
+		if _, ok := vdb.Get(fmt.Sprintf("URL%d", i)); !ok {
+			t.Errorf("URL%d missing from vdb", i)
+		}
+	}
+}
+
+func TestSyncConcurrent(t *testing.T) {
+	const N = 1000
+
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	dc := docs.New(db)
+	for i := range N {
+		dc.Add(fmt.Sprintf("URL%04d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	e := &slowEmbed{delay: 10 * time.Millisecond}
+	s := New(lg, db, vdb, e, dc)
+	s.SetConcurrency(3)
+	s.Sync(ctx)
+	for i := range N {
+		vec, ok := vdb.Get(fmt.Sprintf("URL%04d", i))
+		if !ok {
+			t.Errorf("URL%04d missing from vdb", i)
+			continue
+		}
+		if text := llm.UnquoteVector(vec); text != fmt.Sprintf("Text%d", i) {
+			t.Errorf("URL%04d decoded to %q, want %q", i, text, fmt.Sprintf("Text%d", i))
+		}
+	}
+	if e.calls != N/batchSize {
+		t.Errorf("EmbedDocs calls = %d, want %d", e.calls, N/batchSize)
+	}
+	if e.max > 3 {
+		t.Errorf("max concurrent EmbedDocs calls = %d, want ≤ 3", e.max)
+	}
+
+	// Everything was marked old.
+	e = &slowEmbed{}
+	Sync(ctx, lg, db, vdb, e, dc)
+	if e.calls != 0 {
+		t.Errorf("second Sync made %d EmbedDocs calls, want 0", e.calls)
+	}
+}
+
+// A blockEmbed is an embedder that blocks until its context is canceled,
+// closing started when the first call begins.
+type blockEmbed struct {
+	once    sync.Once
+	started chan struct{}
+}
+
+func (e *blockEmbed) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	e.once.Do(func() { close(e.started) })
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSyncCancel(t *testing.T) {
+	const N = 1000
+
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	dc := docs.New(db)
+	for i := range N {
+		dc.Add(fmt.Sprintf("URL%04d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	// Canceling the context must interrupt the in-flight EmbedDocs calls.
+	e := &blockEmbed{started: make(chan struct{})}
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-e.started
+		cancel()
+	}()
+	s := New(lg, db, vdb, e, dc)
+	s.SetConcurrency(3)
+	s.Sync(cctx)
+	if _, ok := vdb.Get("URL0000"); ok {
+		t.Errorf("URL0000 embedded after cancel")
+	}
+	for f := range DeadLetters(db, "embeddocs") {
+		t.Errorf("canceled Sync recorded failure for %s", f.ID)
+	}
+
+	// Nothing was marked old, so the next Sync embeds everything.
+	e2 := &slowEmbed{}
+	s = New(lg, db, vdb, e2, dc)
+	s.Sync(ctx)
+	for i := range N {
+		if _, ok := vdb.Get(fmt.Sprintf("URL%04d", i)); !ok {
+			t.Fatalf("URL%04d missing from vdb after second Sync", i)
+		}
+	}
+}
+
+func TestSyncConcurrentError(t *testing.T) {
+	const N = 1000
+
+	db := storage.MemDB()
+	dc := docs.New(db)
+	for i := range N {
+		dc.Add(fmt.Sprintf("URL%04d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	// The LLM goes down at batch 2 (docs 200-299),
+	// after batches 3 and 4 have started.
+	lg, out := testutil.SlogBuffer()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	e := &slowEmbed{delay: 10 * time.Millisecond, fail: func(n int) bool { return n >= 200 }}
+	s := New(lg, db, vdb, e, dc)
+	s.backoff = 0
+	s.SetConcurrency(4)
+	s.Sync(ctx)
+	if !strings.Contains(out.String(), "embeddocs EmbedDocs error") || !strings.Contains(out.String(), "EMBED ERROR") {
+		t.Errorf("failing batch did not report error:\n%s", out)
+	}
+	if strings.Contains(out.String(), errSkipped.Error()) {
+		t.Errorf("Sync reported skipped batch:\n%s", out)
+	}
+	if _, ok := vdb.Get("URL0199"); !ok {
+		t.Errorf("URL0199 missing from vdb")
+	}
+	if _, ok := db.Get(failureKey("embeddocs", "URL0200")); ok {
+		t.Errorf("Sync recorded failure for URL0200 during outage")
+	}
+
+	// The next Sync starts at the failed batch,
+	// even though later batches were embedded.
+	e = &slowEmbed{}
+	Sync(ctx, lg, db, vdb, e, dc)
+	if !e.batches["Text200"] || e.batches["Text100"] || e.calls != (N-200)/batchSize {
+		t.Errorf("second Sync: batches %v, %d calls, want from Text200, %d calls", e.batches, e.calls, (N-200)/batchSize)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	dc := docs.New(db)
+	for i := range 150 {
+		dc.Add(fmt.Sprintf("URL%03d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	// Two transient failures are retried.
+	e := &slowEmbed{flaky: maxTries - 1}
+	s := New(lg, db, vdb, e, dc)
+	s.backoff = 0
+	s.SetConcurrency(1)
+	s.Sync(ctx)
+	if e.calls != 2+maxTries-1 {
+		t.Errorf("EmbedDocs calls = %d, want %d", e.calls, 2+maxTries-1)
+	}
+	for i := range 150 {
+		if _, ok := vdb.Get(fmt.Sprintf("URL%03d", i)); !ok {
+			t.Errorf("URL%03d missing from vdb", i)
+		}
+	}
+
+	// An exhausted budget is not retried.
+	dc.Add("URL150", "", "Text150")
+	e = &slowEmbed{flaky: 1, err: fmt.Errorf("embeddocs: %w", llmusage.ErrOverBudget)}
+	s = New(lg, db, vdb, e, dc)
+	s.Sync(ctx)
+	if e.calls != 1 {
+		t.Errorf("EmbedDocs calls over budget = %d, want 1", e.calls)
+	}
+	if _, ok := db.Get(failureKey("embeddocs", "URL150")); ok {
+		t.Errorf("Sync recorded failure for URL150 over budget")
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	db := storage.MemDB()
+	dc := docs.New(db)
+	for i := range 150 {
+		dc.Add(fmt.Sprintf("URL%03d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	lg, out := testutil.SlogBuffer()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	e := &slowEmbed{fail: func(n int) bool { return n == 5 }}
+	s := New(lg, db, vdb, e, dc)
+	s.backoff = 0
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// The document holds up the rest for MaxFailures-1 Syncs.
+	// (Once its batch-mates are embedded, later documents
+	// join its batch and are embedded along with it.)
+	for n := 1; n < MaxFailures; n++ {
+		s.Sync(ctx)
+		if _, ok := vdb.Get("URL004"); !ok {
+			t.Fatalf("Sync #%d: URL004 missing from vdb", n)
+		}
+		if _, ok := vdb.Get("URL100"); ok && n == 1 {
+			t.Fatalf("Sync #%d: URL100 embedded despite failing URL005", n)
+		}
+		for f := range DeadLetters(db, "embeddocs") {
+			t.Fatalf("Sync #%d: dead letter %+v", n, f)
+		}
+	}
+	if !strings.Contains(out.String(), "embeddocs doc failed") {
+		t.Errorf("Sync did not report failed doc:\n%s", out)
+	}
+
+	// Then it is skipped.
+	s.Sync(ctx)
+	if !strings.Contains(out.String(), "embeddocs skipping doc") {
+		t.Errorf("Sync did not report skipped doc:\n%s", out)
+	}
+	for i := range 150 {
+		_, ok := vdb.Get(fmt.Sprintf("URL%03d", i))
+		if ok != (i != 5) {
+			t.Errorf("URL%03d in vdb = %v, want %v", i, ok, i != 5)
+		}
+	}
+	var dead []*Failure
+	for f := range DeadLetters(db, "embeddocs") {
+		dead = append(dead, f)
+	}
+	want := Failure{ID: "URL005", Failures: MaxFailures, Err: "EMBED ERROR", Time: now}
+	if len(dead) != 1 || *dead[0] != want {
+		t.Errorf("DeadLetters = %v, want [%+v]", dead, want)
+	}
+
+	// A fixed document is embedded and removed from the dead letters.
+	dc.Add("URL005", "", "Fixed5")
+	s.Sync(ctx)
+	if _, ok := vdb.Get("URL005"); !ok {
+		t.Errorf("fixed URL005 missing from vdb")
+	}
+	for f := range DeadLetters(db, "embeddocs") {
+		t.Errorf("dead letter after fix: %+v", f)
+	}
+}
+
+func TestFailureNames(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	dc := docs.New(db)
+	for i := range 10 {
+		dc.Add(fmt.Sprintf("URL%03d", i), "", fmt.Sprintf("Text%d", i))
+	}
+
+	// newSyncer returns a Syncer with the given name
+	// that fails to embed URL005 if fail is true.
+	newSyncer := func(name string, fail bool) *Syncer {
+		e := &slowEmbed{fail: func(n int) bool { return fail && n == 5 }}
+		s := New(lg, db, storage.MemVectorDB(db, lg, name), e, dc)
+		s.SetName(name)
+		s.backoff = 0
+		return s
+	}
+	failures := func(name string) int {
+		val, ok := db.Get(failureKey(name, "URL005"))
+		if !ok {
+			return 0
+		}
+		var f Failure
+		if err := json.Unmarshal(val, &f); err != nil {
+			t.Fatal(err)
+		}
+		return f.Failures
+	}
+
+	// Failures in one Syncer are not counted against the other.
+	newSyncer("live", true).Sync(ctx)
+	newSyncer("reembed", true).Sync(ctx)
+	if n := failures("live"); n != 1 {
+		t.Errorf("live failures = %d, want 1", n)
+	}
+	if n := failures("reembed"); n != 1 {
+		t.Errorf("reembed failures = %d, want 1", n)
+	}
+
+	// A success in one Syncer does not clear the other's failures.
+	newSyncer("reembed", false).Sync(ctx)
+	if n := failures("reembed"); n != 0 {
+		t.Errorf("reembed failures after success = %d, want 0", n)
+	}
+	if n := failures("live"); n != 1 {
+		t.Errorf("live failures after reembed success = %d, want 1", n)
+	}
+
+	// Dead letters are listed only for their own Syncer.
+	for range MaxFailures - 1 {
+		newSyncer("live", true).Sync(ctx)
+	}
+	var dead []string
+	for f := range DeadLetters(db, "live") {
+		dead = append(dead, f.ID)
+	}
+	if !slices.Equal(dead, []string{"URL005"}) {
+		t.Errorf("DeadLetters(live) = %v, want [URL005]", dead)
+	}
+	for f := range DeadLetters(db, "reembed") {
+		t.Errorf("DeadLetters(reembed) = %+v, want none", f)
+	}
+}
+
+// A slowEmbed is a quote embedder that takes delay to embed each batch,
+// fails the first flaky calls and any batch containing a document
+// "TextN" for which fail(N) is true, and records
+// the number of calls, the maximum number of concurrent calls,
+// and the first document of each batch.
+type slowEmbed struct {
+	delay time.Duration
+	fail  func(int) bool
+	flaky int
+	err   error // error for failed calls; default "EMBED ERROR"
+
+	mu      sync.Mutex
+	active  int
+	calls   int
+	max     int
+	batches map[string]bool
+}
+
+func (e *slowEmbed) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	e.mu.Lock()
+	e.active++
+	e.calls++
+	e.max = max(e.max, e.active)
+	if e.batches == nil {
+		e.batches = make(map[string]bool)
+	}
+	e.batches[docs[0].Text] = true
+	flaky := e.calls <= e.flaky
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.active--
+		e.mu.Unlock()
+	}()
+
+	err := e.err
+	if err == nil {
+		err = fmt.Errorf("EMBED ERROR")
+	}
+	if flaky {
+		return nil, err
+	}
+	for _, d := range docs {
+		n, ok := strings.CutPrefix(d.Text, "Text")
+		if i, _ := strconv.Atoi(n); ok && e.fail != nil && e.fail(i) {
+			// Give the later batches time to start.
+			time.Sleep(2 * e.delay)
+			return nil, err
+		}
+	}
+	time.Sleep(e.delay)
+	return llm.QuoteEmbedder().EmbedDocs(ctx, docs)
+}
+
+func TestSyncDelete(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	dc := docs.New(db)
+	for i, text := range texts {
+		dc.Add(fmt.Sprintf("URL%d", i), "", text)
+	}
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+
+	has := func(id, text string) {
+		t.Helper()
+		vec, ok := vdb.Get(id)
+		if text == "" {
+			if ok {
+				t.Errorf("%s in vdb after delete: %q", id, llm.UnquoteVector(vec))
+			}
+			return
+		}
+		if !ok || llm.UnquoteVector(vec) != text {
+			t.Errorf("%s in vdb = %q, %v, want %q", id, llm.UnquoteVector(vec), ok, text)
+		}
+	}
+
+	// Delete.
+	dc.Delete("URL1")
+	dc.Delete("URL2")
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+	has("URL0", texts[0])
+	has("URL1", "")
+	has("URL2", "")
+
+	// Delete then re-add, in separate Syncs and in one.
+	dc.Add("URL1", "", "new text 1")
+	dc.Delete("URL3")
+	dc.Add("URL3", "", "new text 3")
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+	has("URL1", "new text 1")
+	has("URL2", "")
+	has("URL3", "new text 3")
+
+	// Add then delete in one Sync.
+	dc.Add("URL9", "", "short-lived")
+	dc.Delete("URL9")
+	dc.Delete("URL4")
+	Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
+	has("URL9", "")
+	has("URL4", "")
+	has("URL5", texts[5])
+}
+
+func TestSyncUnchanged(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "vdb")
+	dc := docs.New(db)
+	for i := range 150 {
+		dc.Add(fmt.Sprintf("URL%03d", i), "", fmt.Sprintf("Text%d", i))
+	}
+	e := &slowEmbed{}
+	s := New(lg, db, vdb, e, dc)
+	s.Sync(ctx)
+	if e.calls != 2 {
+		t.Fatalf("EmbedDocs calls = %d, want 2", e.calls)
+	}
+
+	// Rereading the corpus embeds only what changed:
+	// a new kind is not a new text, and neither is a text
+	// changed and then changed back.
+	dc.AddKind("URL000", docs.KindIssue, "", "Text0")
+	dc.Add("URL001", "", "Edited1")
+	dc.Add("URL001", "", "Text1")
+	dc.Add("URL002", "", "Edited2")
+	dc.DocWatcher("embeddocs").Restart()
+	e = &slowEmbed{}
+	s.embed = e
+	s.Sync(ctx)
+	if e.calls != 1 || !e.batches["Edited2"] {
+		t.Errorf("Sync after Restart: batches %v, %d calls, want Edited2, 1 call", e.batches, e.calls)
+	}
+	if vec, _ := vdb.Get("URL002"); llm.UnquoteVector(vec) != "Edited2" {
+		t.Errorf("URL002 in vdb = %q, want %q", llm.UnquoteVector(vec), "Edited2")
+	}
+
+	// A Sync that finds only unchanged documents embeds nothing.
+	e = &slowEmbed{}
+	s.embed = e
+	dc.DocWatcher("embeddocs").Restart()
+	s.Sync(ctx)
+	s.Sync(ctx)
+	if e.calls != 0 {
+		t.Errorf("repeated Sync: %d calls, want 0", e.calls)
+	}
+
+	// A document whose vector is missing is embedded again.
+	vdb.Delete("URL003")
+	dc.DocWatcher("embeddocs").Restart()
+	s.Sync(ctx)
+	if e.calls != 1 || !e.batches["Text3"] {
+		t.Errorf("Sync after vector loss: batches %v, %d calls, want Text3, 1 call", e.batches, e.calls)
+	}
+	if _, ok := vdb.Get("URL003"); !ok {
+		t.Errorf("URL003 missing from vdb")
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package eval measures the quality of an [llm.Embedder]
+// for finding related issues.
+//
+// A labeled [Set] of issues records, for some query issues,
+// which other issues are known to be duplicates of or related to them.
+// [Evaluate] embeds all the issues, ranks the other issues by
+// similarity to each query, and reports how well the ranking
+// finds the known related issues, as recall@k and mean reciprocal rank.
+// The same set can be evaluated against different embedders
+// (for example different models, providers, or quantization levels)
+// to compare them objectively.
+package eval
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+	"rsc.io/gaby/internal/llm"
+)
+
+// A Set is a labeled set of issues.
+type Set struct {
+	Name    string   // name of set, for reports
+	Docs    []*Doc   // all issues in the set
+	Queries []*Query // queries with known related issues
+}
+
+// A Doc is a single issue in a [Set].
+type Doc struct {
+	ID    string // issue ID, such as "golang/go#123"
+	Title string // issue title
+	Text  string // issue body
+}
+
+// A Query is an issue together with the issues that
+// an embedder should rank as most similar to it.
+type Query struct {
+	ID      string   // query issue ID
+	Related []string // related issue IDs
+}
+
+// Load loads a labeled set from the named txtar file.
+// See [Parse] for the format.
+func Load(file string) (*Set, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(file, data)
+}
+
+// Parse parses a labeled set from the txtar archive data,
+// using name as the set name.
+//
+// Each file in the archive other than “related” is an issue,
+// named by its ID (for example “golang/go#123”).
+// The first line of an issue file is “Title: ” followed by the title;
+// the rest of the file, after a blank line, is the body.
+//
+// The file named “related” lists the queries, one per line.
+// Each line is a query issue ID followed by the IDs of
+// its related issues, separated by spaces.
+// Blank lines and lines beginning with # are ignored.
+//
+// For example:
+//
+//	-- related --
+//	golang/go#1 golang/go#2
+//	-- golang/go#1 --
+//	Title: crash in net/http
+//
+//	The server crashes when ...
+//	-- golang/go#2 --
+//	Title: net/http: nil pointer dereference
+//
+//	A nil pointer dereference in ...
+func Parse(name string, data []byte) (*Set, error) {
+	ar := txtar.Parse(data)
+	set := &Set{Name: name}
+	ids := make(map[string]bool)
+	var related []byte
+	for _, f := range ar.Files {
+		if f.Name == "related" {
+			related = f.Data
+			continue
+		}
+		if ids[f.Name] {
+			return nil, fmt.Errorf("%s: duplicate issue %s", name, f.Name)
+		}
+		ids[f.Name] = true
+		line, text, _ := strings.Cut(string(f.Data), "\n")
+		title, ok := strings.CutPrefix(line, "Title: ")
+		if !ok {
+			return nil, fmt.Errorf("%s: %s: missing Title line", name, f.Name)
+		}
+		set.Docs = append(set.Docs, &Doc{ID: f.Name, Title: title, Text: strings.TrimSpace(text)})
+	}
+
+	for i, line := range strings.Split(string(related), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, fmt.Errorf("%s: related:%d: query %s has no related issues", name, i+1, f[0])
+		}
+		for _, id := range f {
+			if !ids[id] {
+				return nil, fmt.Errorf("%s: related:%d: unknown issue %s", name, i+1, id)
+			}
+		}
+		if slices.Contains(f[1:], f[0]) {
+			return nil, fmt.Errorf("%s: related:%d: query %s is related to itself", name, i+1, f[0])
+		}
+		set.Queries = append(set.Queries, &Query{ID: f[0], Related: f[1:]})
+	}
+	if len(set.Queries) == 0 {
+		return nil, fmt.Errorf("%s: no queries", name)
+	}
+	return set, nil
+}
+
+// A Result is the result of evaluating an embedder on a [Set].
+type Result struct {
+	Name    string    // set name
+	Queries int       // number of queries
+	K       []int     // cutoffs for recall
+	Recall  []float64 // Recall[i] is the mean recall@K[i]
+	MRR     float64   // mean reciprocal rank of the first related issue
+}
+
+// String returns a one-line summary of the result.
+func (r *Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d queries", r.Name, r.Queries)
+	for i, k := range r.K {
+		fmt.Fprintf(&b, " recall@%d=%.3f", k, r.Recall[i])
+	}
+	fmt.Fprintf(&b, " mrr=%.3f", r.MRR)
+	return b.String()
+}
+
+// DefaultK is the default list of recall cutoffs used by [Evaluate].
+var DefaultK = []int{1, 5, 10}
+
+// Evaluate evaluates the embedder e on the labeled set,
+// reporting recall at each of the cutoffs k (default [DefaultK]).
+//
+// For each query, Evaluate ranks all the other issues in the set
+// by similarity to the query. The recall@k for the query is the
+// fraction of its related issues ranked in the top k, and its
+// reciprocal rank is 1/r, where r is the rank (starting at 1)
+// of the first related issue. Evaluate reports the means
+// of these over all queries.
+func Evaluate(e llm.Embedder, set *Set, k ...int) (*Result, error) {
+	if len(k) == 0 {
+		k = DefaultK
+	}
+	var docs []llm.EmbedDoc
+	index := make(map[string]int)
+	for i, d := range set.Docs {
+		docs = append(docs, llm.EmbedDoc{Title: d.Title, Text: d.Text})
+		index[d.ID] = i
+	}
+	vecs, err := e.EmbedDocs(context.Background(), docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != len(docs) {
+		return nil, fmt.Errorf("eval: embedder returned %d vectors for %d docs", len(vecs), len(docs))
+	}
+
+	r := &Result{Name: set.Name, Queries: len(set.Queries), K: k, Recall: make([]float64, len(k))}
+	for _, q := range set.Queries {
+		rank := ranking(vecs, index[q.ID])
+		rankOf := make(map[int]int) // doc index → rank
+		for i, d := range rank {
+			rankOf[d] = i + 1
+		}
+		first := len(rank) + 1
+		for _, id := range q.Related {
+			first = min(first, rankOf[index[id]])
+		}
+		r.MRR += 1 / float64(first)
+		for i, k := range k {
+			n := 0
+			for _, id := range q.Related {
+				if rankOf[index[id]] <= k {
+					n++
+				}
+			}
+			r.Recall[i] += float64(n) / float64(len(q.Related))
+		}
+	}
+	r.MRR /= float64(r.Queries)
+	for i := range r.Recall {
+		r.Recall[i] /= float64(r.Queries)
+	}
+	return r, nil
+}
+
+// ranking returns the indexes of the vectors other than vecs[q],
+// ordered by decreasing similarity to vecs[q].
+// Ties are broken by index, for determinism.
+func ranking(vecs []llm.Vector, q int) []int {
+	type scored struct {
+		i     int
+		score float64
+	}
+	var list []scored
+	for i, v := range vecs {
+		if i != q {
+			list = append(list, scored{i, vecs[q].Dot(v)})
+		}
+	}
+	slices.SortStableFunc(list, func(x, y scored) int {
+		switch {
+		case x.score > y.score:
+			return -1
+		case x.score < y.score:
+			return +1
+		}
+		return 0
+	})
+	var rank []int
+	for _, s := range list {
+		rank = append(rank, s.i)
+	}
+	return rank
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eval
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/llm"
+)
+
+// wordEmbedder embeds each document as a one-hot vector
+// in the dimension w[f] for the first word f in its title that is in w,
+// or as a zero vector if it has none of them.
+type wordEmbedder map[string]int
+
+func (w wordEmbedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	var vecs []llm.Vector
+	for _, d := range docs {
+		v := make(llm.Vector, 10)
+		for _, f := range strings.Fields(d.Title) {
+			if i, ok := w[f]; ok {
+				v[i] = 1
+				break
+			}
+		}
+		vecs = append(vecs, v)
+	}
+	return vecs, nil
+}
+
+func TestEvaluate(t *testing.T) {
+	set, err := Load("testdata/dups.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Docs) != 6 || len(set.Queries) != 2 {
+		t.Fatalf("Load: %d docs, %d queries, want 6, 2", len(set.Docs), len(set.Queries))
+	}
+
+	var tests = []struct {
+		words  wordEmbedder
+		recall []float64
+		mrr    float64
+	}{
+		// All net/http issues together, all cmd/go issues together.
+		// For #1, the ranking of #2 and #3 is a tie, broken by index.
+		{wordEmbedder{"net/http:": 0, "cmd/go:": 1}, []float64{0.75, 1}, 1},
+		// #1 is most like #6 (rank 1), followed by a tie (2, 3, 4, 5).
+		// #4 and #5 are alike.
+		{wordEmbedder{"panics": 0, "Parse": 0, "mod": 1, "dereference": 2, "crash": 2}, []float64{0.5, 0.75}, 0.75},
+	}
+	for _, tt := range tests {
+		r, err := Evaluate(tt.words, set, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Queries != 2 || !slices.Equal(r.Recall, tt.recall) || math.Abs(r.MRR-tt.mrr) > 1e-9 {
+			t.Errorf("Evaluate(%v) = %v, want recall %v mrr %.3f", tt.words, r, tt.recall, tt.mrr)
+		}
+	}
+
+	r, err := Evaluate(llm.QuoteEmbedder(), set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.K, DefaultK) || len(r.Recall) != len(DefaultK) {
+		t.Errorf("Evaluate with default k = %v", r)
+	}
+	if !strings.HasPrefix(r.String(), "testdata/dups.txt: 2 queries recall@1=") {
+		t.Errorf("Result.String() = %q", r)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var tests = []struct {
+		data string
+		err  string
+	}{
+		{"-- a --\nTitle: a\n-- b --\nTitle: b\n", "no queries"},
+		{"-- related --\na\n-- a --\nTitle: a\n", "query a has no related issues"},
+		{"-- related --\na c\n-- a --\nTitle: a\n", "unknown issue c"},
+		{"-- related --\na a\n-- a --\nTitle: a\n", "query a is related to itself"},
+		{"-- a --\nno title\n", "missing Title line"},
+		{"-- a --\nTitle: a\n-- a --\nTitle: a\n", "duplicate issue a"},
+	}
+	for _, tt := range tests {
+		_, err := Parse("x", []byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Parse(%q) = %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
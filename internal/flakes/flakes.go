@@ -0,0 +1,565 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package flakes implements clustering of test failures
+// and linking them to flake-tracking issues.
+//
+// A [Tracker] ingests test failure reports, both from flake-tracking
+// GitHub issues filed by watchflakes (see [Tracker.Run]) and from
+// individual build logs (see [Tracker.Add]).
+// It reduces each failure log to a signature of its most telling lines,
+// with incidental details such as addresses, line numbers, and timings removed,
+// embeds the signature, and assigns the failure to the cluster of
+// the most similar known failure or, if none is similar enough,
+// to a new cluster.
+// Failures reported in a tracking issue define that issue's cluster.
+// When a new failure joins the cluster of a tracking issue,
+// the Tracker posts it to that issue, and when a new tracking issue's
+// failures belong to an older issue's cluster, the Tracker notes
+// the likely duplicate, so that near-duplicate flake issues do not proliferate.
+package flakes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"iter"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["flakes.Failure", Name, FailureID] => JSON of failureRecord
+//	["flakes.Cluster", Name, ClusterID] => JSON of Cluster
+//
+// and uses the [storage.BeginAction] keys ["flakes.Link", Name, FailureID]
+// and ["flakes.Duplicate", Project, Issue].
+//
+// The vector database passed to [New] holds the embeddings
+// of the failure signatures, keyed by FailureID.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "flakes.Failure", Key: "Name, FailureID", Val: "JSON of failureRecord"},
+		storage.Schema{Kind: "flakes.Cluster", Key: "Name, ClusterID", Val: "JSON of Cluster"},
+	)
+}
+
+// A Failure is a single test failure.
+type Failure struct {
+	ID      string // unique ID, typically the URL of the log
+	Summary string // one-line description, such as the builder, commit, and test
+	Log     string // failure log
+}
+
+// A Cluster is a cluster of similar failures.
+type Cluster struct {
+	ID       string // HTML URL of tracking issue, or else ID of first failure in cluster
+	Project  string `json:",omitempty"` // project of tracking issue, if any
+	Issue    int64  `json:",omitempty"` // number of tracking issue, if any
+	Failures int    // number of failures in cluster
+}
+
+// A failureRecord is the database record of a failure.
+type failureRecord struct {
+	Failure
+	Signature string
+	Cluster   string // cluster ID
+	Source    string `json:",omitempty"` // HTML URL of issue or comment reporting the failure, if any
+}
+
+// A Tracker clusters test failures and links them to flake-tracking issues.
+type Tracker struct {
+	slog        *slog.Logger
+	db          storage.DB
+	github      *github.Client
+	embed       llm.Embedder
+	vdb         storage.VectorDB
+	projects    map[string]bool
+	watcher     *timed.Watcher[*github.Event]
+	name        string
+	scoreCutoff float64
+	footer      *footer.Footer
+	post        bool
+}
+
+// New creates and returns a new Tracker. It logs to lg, stores state in db,
+// watches for flake-tracking GitHub issues using gh, embeds failure signatures
+// using embed, and stores the embeddings in vdb,
+// which must be dedicated to the Tracker's use.
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Tracker] methods to configure the parameters
+// (especially [Tracker.EnableProject] and [Tracker.EnablePosts])
+// before calling [Tracker.Run] or [Tracker.Add].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, embed llm.Embedder, vdb storage.VectorDB, name string) *Tracker {
+	return &Tracker{
+		slog:        lg,
+		db:          db,
+		github:      gh,
+		embed:       embed,
+		vdb:         vdb,
+		projects:    make(map[string]bool),
+		watcher:     gh.EventWatcher("flakes.Tracker:" + name),
+		name:        name,
+		scoreCutoff: defaultScoreCutoff,
+		footer:      footer.Default(),
+	}
+}
+
+const defaultScoreCutoff = 0.9
+
+// EnableProject enables the Tracker to read flake-tracking issues
+// in the given GitHub project (for example "golang/go").
+// See also [Tracker.EnablePosts], which must also be called to post anything to GitHub.
+func (t *Tracker) EnableProject(project string) {
+	t.projects[project] = true
+}
+
+// EnablePosts enables the Tracker to post to GitHub.
+// If EnablePosts has not been called, the Tracker logs what it would post
+// but does not post the messages.
+func (t *Tracker) EnablePosts() {
+	t.post = true
+}
+
+// SetMinScore sets the minimum vector search score
+// for two failures to be considered the same flake.
+// The default is 0.9.
+func (t *Tracker) SetMinScore(min float64) {
+	t.scoreCutoff = min
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (t *Tracker) SetFooter(f *footer.Footer) {
+	t.footer = f
+}
+
+// watchflakesMarker marks the body of a flake-tracking issue
+// or a comment reporting new failures for one.
+const watchflakesMarker = "#!watchflakes"
+
+// Run runs a single round of ingesting flake-tracking issues.
+// It scans the issues and comments in the enabled projects
+// that have changed since the last call to [Tracker.Run]
+// using a Tracker with the same name (see [New]).
+// A flake-tracking issue is one whose body contains a watchflakes script
+// (a line beginning “#!watchflakes”).
+// Run ingests the failures reported in the bodies of flake-tracking issues
+// and their comments (see [ParseFailures]), assigning them to the issue's cluster.
+// If an open tracking issue's failures are similar to the failures of an older
+// open tracking issue, Run posts a comment noting the likely duplicate.
+//
+// Run logs each post to the [slog.Logger] passed to [New].
+// If [Tracker.EnablePosts] has been called, then Run also posts the comment to GitHub
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+//
+// If ctx is canceled, Run stops before the next issue or comment.
+func (t *Tracker) Run(ctx context.Context) {
+	t.slog.Info("flakes.Tracker start", "name", t.name)
+	defer t.slog.Info("flakes.Tracker end", "name", t.name)
+
+	defer t.watcher.Flush()
+
+	for e := range t.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !t.projects[e.Project] {
+			continue
+		}
+		var text, source string
+		switch x := e.Typed.(type) {
+		default:
+			// Not a failure report.
+			if t.post {
+				t.watcher.MarkOld(e.DBTime)
+			}
+			continue
+		case *github.Issue:
+			text, source = x.Body, x.HTMLURL
+		case *github.IssueComment:
+			text, source = x.Body, x.HTMLURL
+		}
+		issue, err := t.github.LookupIssue(e.Project, e.Issue)
+		if err != nil || !strings.Contains(issue.Body, watchflakesMarker) {
+			if t.post {
+				t.watcher.MarkOld(e.DBTime)
+			}
+			continue
+		}
+		if err := t.ingest(ctx, issue, text, source); err != nil {
+			t.slog.Error("flakes.Tracker ingest", "project", e.Project, "issue", e.Issue, "url", source, "err", err)
+			continue
+		}
+		if e.API == "/issues" && issue.State == "open" {
+			t.checkDuplicate(issue)
+		}
+		if t.post {
+			t.watcher.MarkOld(e.DBTime)
+		}
+		t.db.Flush()
+	}
+}
+
+// ingest ingests the failures reported in text,
+// from the issue or comment with the given URL,
+// assigning them to the cluster of the tracking issue.
+func (t *Tracker) ingest(ctx context.Context, issue *github.Issue, text, source string) error {
+	failures := ParseFailures(text, source)
+	if len(failures) == 0 {
+		return nil
+	}
+	c, ok := t.lookupCluster(issue.HTMLURL)
+	if !ok {
+		c = &Cluster{ID: issue.HTMLURL, Project: issue.Project(), Issue: issue.Number}
+	}
+	for _, f := range failures {
+		if _, ok := t.lookup(f.ID); ok {
+			continue
+		}
+		sig := signature(f.Log)
+		vec, err := t.embedSignature(ctx, sig)
+		if err != nil {
+			return err
+		}
+		t.record(&failureRecord{Failure: *f, Signature: sig, Source: source}, vec, c)
+	}
+	return nil
+}
+
+// checkDuplicate checks whether the open tracking issue duplicates
+// an older open tracking issue and if so posts a note saying so.
+func (t *Tracker) checkDuplicate(issue *github.Issue) {
+	project := issue.Project()
+	cid := issue.HTMLURL
+	if _, ok := t.lookupCluster(cid); !ok {
+		return
+	}
+	action := ordered.Encode("flakes.Duplicate", project, issue.Number)
+	if _, ok := storage.LookupAction(t.db, action); ok {
+		return
+	}
+
+	var orig *github.Issue
+	best := 0.0
+	for r := range t.failures(cid) {
+		vec, ok := t.vdb.Get(r.ID)
+		if !ok {
+			continue
+		}
+		for _, res := range t.vdb.Search(vec, 10) {
+			if res.Score < t.scoreCutoff || res.Score <= best {
+				break
+			}
+			other, ok := t.lookup(res.ID)
+			if !ok || other.Cluster == cid {
+				continue
+			}
+			c := t.cluster(other.Cluster)
+			if c.Project != project || c.Issue == 0 || c.Issue >= issue.Number {
+				continue
+			}
+			o, err := t.github.LookupIssue(project, c.Issue)
+			if err != nil || o.State != "open" {
+				continue
+			}
+			orig, best = o, res.Score
+			break
+		}
+	}
+	if orig == nil {
+		return
+	}
+
+	body := fmt.Sprintf("These failures look like the ones tracked in #%d (similarity %.2f). "+
+		"If so, please consider closing this issue as a duplicate and updating the watchflakes script in #%d.\n%s",
+		orig.Number, best, orig.Number, t.footer.Render("flakes", project))
+	t.slog.Info("flakes.Tracker duplicate", "name", t.name, "project", project, "issue", issue.Number, "of", orig.Number, "comment", body)
+	if !t.post || !storage.BeginAction(t.db, action) {
+		return
+	}
+	url, err := t.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		t.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(t.db, action)
+		return
+	}
+	storage.FinishAction(t.db, action, url)
+}
+
+// Add ingests a single failure, such as one read from a build log,
+// and returns the cluster it belongs to.
+// If the failure has already been ingested, Add returns its existing cluster.
+// Otherwise Add assigns the failure to the cluster of the most similar
+// known failure, if that one is similar enough (see [Tracker.SetMinScore]),
+// or else to a new cluster.
+// If the cluster has a tracking issue, Add posts the failure to that issue,
+// at most once per failure.
+// Like [Tracker.Run], Add only logs the post unless
+// [Tracker.EnablePosts] has been called.
+// Add returns an error only if the failure cannot be embedded.
+func (t *Tracker) Add(f *Failure) (*Cluster, error) {
+	if r, ok := t.lookup(f.ID); ok {
+		return t.cluster(r.Cluster), nil
+	}
+	sig := signature(f.Log)
+	vec, err := t.embedSignature(context.Background(), sig)
+	if err != nil {
+		return nil, err
+	}
+	var c *Cluster
+	for _, res := range t.vdb.Search(vec, 1) {
+		if res.Score < t.scoreCutoff {
+			break
+		}
+		if other, ok := t.lookup(res.ID); ok {
+			c = t.cluster(other.Cluster)
+		}
+	}
+	if c == nil {
+		c = &Cluster{ID: f.ID}
+	}
+	t.record(&failureRecord{Failure: *f, Signature: sig}, vec, c)
+	t.db.Flush()
+	if c.Issue != 0 {
+		t.link(c, f, sig)
+	}
+	return c, nil
+}
+
+// link posts the failure f, with signature sig, to the tracking issue for c.
+func (t *Tracker) link(c *Cluster, f *Failure, sig string) {
+	issue, err := t.github.LookupIssue(c.Project, c.Issue)
+	if err != nil {
+		t.slog.Error("flakes.Tracker lookup", "project", c.Project, "issue", c.Issue, "err", err)
+		return
+	}
+	desc := html.EscapeString(f.Summary)
+	if strings.HasPrefix(f.ID, "https://") {
+		desc += fmt.Sprintf(" (<a href=\"%s\">log</a>)", html.EscapeString(f.ID))
+	}
+	body := fmt.Sprintf("Found a new failure that looks like this issue:\n\n"+
+		"<details><summary>%s</summary>\n<pre>\n%s\n</pre>\n</details>\n%s",
+		desc, html.EscapeString(sig), t.footer.Render("flakes", c.Project))
+	t.slog.Info("flakes.Tracker link", "name", t.name, "project", c.Project, "issue", c.Issue, "failure", f.ID, "comment", body)
+	if !t.post {
+		return
+	}
+	action := ordered.Encode("flakes.Link", t.name, f.ID)
+	if !storage.BeginAction(t.db, action) {
+		return
+	}
+	url, err := t.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		t.slog.Error("PostIssueComment", "issue", c.Issue, "err", err)
+		storage.CancelAction(t.db, action)
+		return
+	}
+	storage.FinishAction(t.db, action, url)
+}
+
+// embedSignature returns the embedding of the failure signature sig.
+func (t *Tracker) embedSignature(ctx context.Context, sig string) (llm.Vector, error) {
+	vecs, err := t.embed.EmbedDocs(ctx, []llm.EmbedDoc{{Title: "test failure", Text: sig}})
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != 1 {
+		return nil, fmt.Errorf("embedding returned %d vectors, want 1", len(vecs))
+	}
+	return vecs[0], nil
+}
+
+// record records the failure r, with embedding vec, as a member of cluster c.
+func (t *Tracker) record(r *failureRecord, vec llm.Vector, c *Cluster) {
+	r.Cluster = c.ID
+	c.Failures++
+	t.vdb.Set(r.ID, vec)
+	t.db.Set(ordered.Encode("flakes.Failure", t.name, r.ID), storage.JSON(r))
+	t.db.Set(ordered.Encode("flakes.Cluster", t.name, c.ID), storage.JSON(c))
+}
+
+// lookup returns the record for the failure with the given ID.
+func (t *Tracker) lookup(id string) (*failureRecord, bool) {
+	key := ordered.Encode("flakes.Failure", t.name, id)
+	val, ok := t.db.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var r failureRecord
+	if err := json.Unmarshal(val, &r); err != nil {
+		// unreachable unless corrupt storage
+		t.db.Panic("flakes failure decode", "key", storage.Fmt(key), "err", err)
+	}
+	return &r, true
+}
+
+// cluster returns the cluster with the given ID,
+// which must exist.
+func (t *Tracker) cluster(id string) *Cluster {
+	c, ok := t.lookupCluster(id)
+	if !ok {
+		// unreachable unless corrupt storage
+		t.db.Panic("flakes cluster missing", "id", id)
+	}
+	return c
+}
+
+// lookupCluster returns the cluster with the given ID, if it exists.
+func (t *Tracker) lookupCluster(id string) (*Cluster, bool) {
+	key := ordered.Encode("flakes.Cluster", t.name, id)
+	val, ok := t.db.Get(key)
+	if !ok {
+		return nil, false
+	}
+	var c Cluster
+	if err := json.Unmarshal(val, &c); err != nil {
+		// unreachable unless corrupt storage
+		t.db.Panic("flakes cluster decode", "key", storage.Fmt(key), "err", err)
+	}
+	return &c, true
+}
+
+// Clusters returns an iterator over the clusters, ordered by ID.
+func (t *Tracker) Clusters() iter.Seq[*Cluster] {
+	return func(yield func(*Cluster) bool) {
+		start := ordered.Encode("flakes.Cluster", t.name)
+		end := ordered.Encode("flakes.Cluster", t.name, ordered.Inf)
+		for key, val := range t.db.Scan(start, end) {
+			var c Cluster
+			if err := json.Unmarshal(val(), &c); err != nil {
+				// unreachable unless corrupt storage
+				t.db.Panic("flakes cluster decode", "key", storage.Fmt(key), "err", err)
+			}
+			if !yield(&c) {
+				return
+			}
+		}
+	}
+}
+
+// Failures returns an iterator over the failures in the given cluster, ordered by ID.
+func (t *Tracker) Failures(cluster string) iter.Seq[*Failure] {
+	return func(yield func(*Failure) bool) {
+		for r := range t.failures(cluster) {
+			if !yield(&r.Failure) {
+				return
+			}
+		}
+	}
+}
+
+// failures returns an iterator over the records of the failures in the given cluster.
+func (t *Tracker) failures(cluster string) iter.Seq[*failureRecord] {
+	return func(yield func(*failureRecord) bool) {
+		start := ordered.Encode("flakes.Failure", t.name)
+		end := ordered.Encode("flakes.Failure", t.name, ordered.Inf)
+		for key, val := range t.db.Scan(start, end) {
+			var r failureRecord
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				t.db.Panic("flakes failure decode", "key", storage.Fmt(key), "err", err)
+			}
+			if r.Cluster == cluster && !yield(&r) {
+				return
+			}
+		}
+	}
+}
+
+var (
+	detailsRE = regexp.MustCompile(`(?s)<details><summary>(.*?)</summary>\s*<pre>\n?(.*?)</pre>\s*</details>`)
+	hrefRE    = regexp.MustCompile(`href="([^"]+)"`)
+	tagRE     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// ParseFailures parses the failures reported in text,
+// the body of a watchflakes issue or comment with the given URL.
+// Watchflakes reports each failure as an HTML details element
+// whose summary describes the failure and links to its log,
+// followed by an excerpt of the log in a pre element.
+// The ID of each failure is the log URL, if any,
+// or else url followed by a fragment giving the failure's index in text.
+func ParseFailures(text, url string) []*Failure {
+	var list []*Failure
+	for i, m := range detailsRE.FindAllStringSubmatch(text, -1) {
+		f := &Failure{
+			Summary: strings.TrimSpace(html.UnescapeString(tagRE.ReplaceAllString(m[1], ""))),
+			Log:     html.UnescapeString(m[2]),
+		}
+		if h := hrefRE.FindStringSubmatch(m[1]); h != nil {
+			f.ID = html.UnescapeString(h[1])
+		} else {
+			f.ID = fmt.Sprintf("%s#failure-%d", url, i+1)
+		}
+		list = append(list, f)
+	}
+	return list
+}
+
+// maxSignatureLines is the maximum number of lines in a failure signature.
+const maxSignatureLines = 40
+
+var (
+	// interestingRE matches the log lines that characterize a failure.
+	interestingRE = regexp.MustCompile(`(?i)fail|panic|fatal|error|timed? ?out|\.go:\d`)
+
+	// normalizers remove incidental details from log lines.
+	normalizers = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`\b\d{4}[-/]\d\d[-/]\d\d[ T]\d\d:\d\d:\d\d(\.\d+)?Z?`), "TIME"},
+		{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "0x?"},
+		{regexp.MustCompile(`\bgoroutine \d+\b`), "goroutine ?"},
+		{regexp.MustCompile(`\b\d+(\.\d+)?m?s\b`), "?s"},
+		{regexp.MustCompile(`(?:/[\w.@+-]+)+/([\w.@+-]+\.(?:go|s|c))\b`), "$1"},
+		{regexp.MustCompile(`\.(go|s|c):\d+`), ".$1:?"},
+	}
+)
+
+// signature returns the signature of the failure log:
+// its interesting lines (or, if none, its last lines),
+// with incidental details such as times, addresses, directories,
+// and line numbers normalized away.
+func signature(log string) string {
+	lines := strings.Split(strings.TrimSpace(log), "\n")
+	var keep []string
+	for _, line := range lines {
+		if interestingRE.MatchString(line) {
+			keep = append(keep, line)
+		}
+	}
+	if len(keep) == 0 {
+		keep = lines[max(0, len(lines)-maxSignatureLines/2):]
+	}
+	var sig []string
+	for _, line := range keep {
+		line = strings.TrimSpace(line)
+		for _, n := range normalizers {
+			line = n.re.ReplaceAllString(line, n.repl)
+		}
+		if len(sig) > 0 && sig[len(sig)-1] == line {
+			continue
+		}
+		sig = append(sig, line)
+		if len(sig) == maxSignatureLines {
+			break
+		}
+	}
+	return strings.Join(sig, "\n")
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flakes
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/diff"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// testEmbedder embeds failure signatures by the test that failed:
+// TestA and TestB each have their own direction, and all else a third.
+type testEmbedder struct{}
+
+func (testEmbedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	var vecs []llm.Vector
+	for _, d := range docs {
+		switch {
+		case strings.Contains(d.Text, "TestA"):
+			vecs = append(vecs, llm.Vector{1, 0, 0})
+		case strings.Contains(d.Text, "TestB"):
+			vecs = append(vecs, llm.Vector{0, 1, 0})
+		default:
+			vecs = append(vecs, llm.Vector{0, 0, 1})
+		}
+	}
+	return vecs, nil
+}
+
+// report returns a watchflakes-style report of a failure of test,
+// with the given log URL.
+func report(test, url string) string {
+	return fmt.Sprintf("<details><summary>2024-06-10 15:04 linux-amd64 go@4a9d8f8 pkg.%s (<a href=\"%s\">log</a>)</summary>\n"+
+		"<pre>\n=== RUN   %s\n    x_test.go:12: got 1, want 2\n--- FAIL: %s (0.01s)\n</pre>\n</details>\n",
+		test, url, test, test)
+}
+
+const script = "<pre>\n#!watchflakes\ndefault <- pkg == \"pkg\" && test == \"%s\"\n</pre>\n"
+
+func TestTracker(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "flakes")
+	tc := gh.Testing()
+	tc.AddIssue("rsc/tmp", &github.Issue{
+		Number: 1,
+		Title:  "pkg: TestA failures",
+		State:  "open",
+		Body:   fmt.Sprintf(script, "TestA") + report("TestA", "https://ci/log/1"),
+	})
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		Body: "Found new dashboard test flakes for:\n\n" + fmt.Sprintf(script, "TestA") + report("TestA", "https://ci/log/2") + report("TestA", "https://ci/log/3"),
+	})
+	tc.AddIssue("rsc/tmp", &github.Issue{
+		Number: 2,
+		Title:  "pkg: TestB failures",
+		State:  "open",
+		Body:   fmt.Sprintf(script, "TestB") + report("TestB", "https://ci/log/4"),
+	})
+	tc.AddIssue("rsc/tmp", &github.Issue{
+		Number: 3,
+		Title:  "pkg: TestA/sub failures",
+		State:  "open",
+		Body:   fmt.Sprintf(script, "TestA/sub") + report("TestA/sub", "https://ci/log/5"),
+	})
+	tc.AddIssue("rsc/tmp", &github.Issue{
+		Number: 4,
+		Title:  "pkg: not a flake",
+		State:  "open",
+		Body:   report("TestA", "https://ci/log/6"),
+	})
+
+	tr := New(lg, db, gh, testEmbedder{}, vdb, "test")
+	tr.EnableProject("rsc/tmp")
+	tr.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("dry run posted: %v", edits)
+	}
+
+	tr.EnablePosts()
+	tr.Run(ctx)
+	var have []string
+	for _, e := range tc.Edits() {
+		have = append(have, fmt.Sprintf("%s#%d %s", e.Project, e.Issue, firstLine(e.IssueCommentChanges.Body)))
+	}
+	want := []string{
+		"rsc/tmp#3 These failures look like the ones tracked in #1 (similarity 1.00). If so, please consider closing this issue as a duplicate and updating the watchflakes script in #1.",
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Run posted:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+	tc.ClearEdits()
+
+	tr.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("second Run posted: %v", edits)
+	}
+
+	c, err := tr.Add(&Failure{ID: "https://ci/log/7", Summary: "darwin-arm64 pkg.TestB", Log: "=== RUN TestB\n--- FAIL: TestB (1.00s)\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Issue != 2 || c.Failures != 2 {
+		t.Errorf("Add(TestB) = %+v, want issue 2 with 2 failures", c)
+	}
+	edits := tc.Edits()
+	if len(edits) != 1 || edits[0].Issue != 2 {
+		t.Fatalf("Add(TestB) posted %v, want post on #2", edits)
+	}
+	wantBody := "Found a new failure that looks like this issue:\n\n" +
+		"<details><summary>darwin-arm64 pkg.TestB (<a href=\"https://ci/log/7\">log</a>)</summary>\n" +
+		"<pre>\n--- FAIL: TestB (?s)\n</pre>\n</details>\n"
+	if body := edits[0].IssueCommentChanges.Body; !strings.HasPrefix(body, wantBody) {
+		t.Errorf("Add(TestB) posted:\n%s", diff.Diff("want", []byte(wantBody), "have", []byte(body)))
+	}
+	tc.ClearEdits()
+
+	// Adding again changes nothing.
+	c, err = tr.Add(&Failure{ID: "https://ci/log/7", Log: "--- FAIL: TestB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Issue != 2 || c.Failures != 2 || len(tc.Edits()) != 0 {
+		t.Errorf("Add(TestB) again = %+v, %v", c, tc.Edits())
+	}
+
+	// An unfamiliar failure starts a new cluster, which a similar failure joins.
+	for i := range 2 {
+		c, err = tr.Add(&Failure{ID: fmt.Sprint("https://ci/log/c", i), Log: "--- FAIL: TestC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.ID != "https://ci/log/c0" || c.Issue != 0 || c.Failures != 2 || len(tc.Edits()) != 0 {
+		t.Errorf("Add(TestC) = %+v, %v", c, tc.Edits())
+	}
+
+	have = nil
+	for c := range tr.Clusters() {
+		var ids []string
+		for f := range tr.Failures(c.ID) {
+			ids = append(ids, f.ID)
+		}
+		have = append(have, fmt.Sprintf("%s #%d %d %v", c.ID, c.Issue, c.Failures, ids))
+	}
+	want = []string{
+		"https://ci/log/c0 #0 2 [https://ci/log/c0 https://ci/log/c1]",
+		"https://github.com/rsc/tmp/issues/1 #1 3 [https://ci/log/1 https://ci/log/2 https://ci/log/3]",
+		"https://github.com/rsc/tmp/issues/2 #2 2 [https://ci/log/4 https://ci/log/7]",
+		"https://github.com/rsc/tmp/issues/3 #3 1 [https://ci/log/5]",
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Clusters:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func firstLine(s string) string {
+	s, _, _ = strings.Cut(s, "\n")
+	return s
+}
+
+func TestParseFailures(t *testing.T) {
+	text := report("TestA", "https://ci/log?a=1&amp;b=2") +
+		"<details><summary>no log &lt;link&gt;</summary>\n<pre>\nx &amp; y\n</pre>\n</details>"
+	have := ParseFailures(text, "https://github.com/rsc/tmp/issues/1#issuecomment-2")
+	want := []*Failure{
+		{
+			ID:      "https://ci/log?a=1&b=2",
+			Summary: "2024-06-10 15:04 linux-amd64 go@4a9d8f8 pkg.TestA (log)",
+			Log:     "=== RUN   TestA\n    x_test.go:12: got 1, want 2\n--- FAIL: TestA (0.01s)\n",
+		},
+		{
+			ID:      "https://github.com/rsc/tmp/issues/1#issuecomment-2#failure-2",
+			Summary: "no log <link>",
+			Log:     "x & y\n",
+		},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("ParseFailures: have %d failures, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if *have[i] != *want[i] {
+			t.Errorf("ParseFailures[%d]:\nhave %+v\nwant %+v", i, *have[i], *want[i])
+		}
+	}
+}
+
+var signatureTests = []struct {
+	log string
+	sig string
+}{
+	{
+		"=== RUN   TestX\n    x_test.go:12: got 1, want 2\n--- FAIL: TestX (0.01s)\nFAIL\nFAIL\tpkg\t1.234s\n",
+		"x_test.go:?: got 1, want 2\n--- FAIL: TestX (?s)\nFAIL\nFAIL\tpkg\t?s",
+	},
+	{
+		"panic: runtime error: invalid memory address or nil pointer dereference\n" +
+			"[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4a5b6c]\n\n" +
+			"goroutine 17 [running]:\npkg.f(...)\n\t/tmp/workdir/go/src/pkg/x.go:123 +0x1c\n" +
+			"2024-06-10T15:04:05.123Z fatal error: oops\n",
+		"panic: runtime error: invalid memory address or nil pointer dereference\nx.go:? +0x?\nTIME fatal error: oops",
+	},
+	{
+		"line 1\nline 2\n",
+		"line 1\nline 2",
+	},
+}
+
+func TestSignature(t *testing.T) {
+	for _, tt := range signatureTests {
+		if sig := signature(tt.log); sig != tt.sig {
+			t.Errorf("signature(%q):\nhave %q\nwant %q", tt.log, sig, tt.sig)
+		}
+	}
+}
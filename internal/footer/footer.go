@@ -0,0 +1,114 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package footer implements the footers appended to comments
+// that Gaby posts, such as the related-issue comments
+// posted by [rsc.io/gaby/internal/related].
+//
+// A footer has two parts: visible text, produced by a [text/template]
+// and typically containing attribution and a link for feedback,
+// and an invisible machine-readable marker (an HTML comment)
+// recording which poster wrote the comment, so that later code
+// can identify Gaby's own comments (see [Poster]).
+package footer
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+// DefaultTemplate is the default footer template.
+const DefaultTemplate = `<sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion]({{.FeedbackURL}}).)</sub>`
+
+// DefaultFeedbackURL is the default feedback URL.
+const DefaultFeedbackURL = "https://github.com/golang/go/discussions/67901"
+
+// A Footer is a parsed footer template.
+type Footer struct {
+	tmpl        *template.Template
+	feedbackURL string
+}
+
+// Data is the data passed to a footer template.
+type Data struct {
+	Poster      string // name of the poster ("related")
+	Project     string // GitHub project being posted to ("golang/go")
+	FeedbackURL string // URL where people can leave feedback
+}
+
+// New returns a new Footer using the given template text and feedback URL.
+// The template is executed with a *[Data] as its data.
+// New returns an error if the template cannot be parsed or executed.
+func New(text, feedbackURL string) (*Footer, error) {
+	tmpl, err := template.New("footer").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	f := &Footer{tmpl: tmpl, feedbackURL: feedbackURL}
+	// Check that the template executes on sample data,
+	// so that errors are reported now instead of when posting.
+	if _, err := f.text("poster", "project"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Default returns a Footer using [DefaultTemplate] and [DefaultFeedbackURL].
+func Default() *Footer {
+	f, err := New(DefaultTemplate, DefaultFeedbackURL)
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+	return f
+}
+
+// text returns the visible footer text for the poster and project.
+func (f *Footer) text(poster, project string) (string, error) {
+	var buf bytes.Buffer
+	err := f.tmpl.Execute(&buf, &Data{Poster: poster, Project: project, FeedbackURL: f.feedbackURL})
+	return buf.String(), err
+}
+
+// Render returns the footer for a comment posted by the named poster
+// to the given project, including the leading blank line
+// and the trailing marker.
+func (f *Footer) Render(poster, project string) string {
+	text, err := f.text(poster, project)
+	if err != nil {
+		// unreachable: New checked that the template executes.
+		text = ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\n")
+	if text != "" {
+		buf.WriteString(text)
+		buf.WriteString("\n")
+	}
+	buf.WriteString(Marker(poster))
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+// Marker returns the machine-readable marker identifying
+// a comment posted by the named poster.
+func Marker(poster string) string {
+	return fmt.Sprintf("<!-- gaby:%s -->", poster)
+}
+
+var markerRE = regexp.MustCompile(`<!-- gaby:([^ ]+) -->`)
+
+// Poster returns the name of the poster that posted the comment body,
+// as recorded by the marker in its footer.
+// If the body has no marker, Poster returns "", false.
+func Poster(body string) (poster string, ok bool) {
+	m := markerRE.FindAllStringSubmatch(body, -1)
+	if m == nil {
+		return "", false
+	}
+	// Use the last marker, in case the body quotes another comment.
+	return m[len(m)-1][1], true
+}
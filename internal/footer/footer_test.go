@@ -0,0 +1,49 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package footer
+
+import "testing"
+
+func TestFooter(t *testing.T) {
+	got := Default().Render("related", "golang/go")
+	want := "\n<sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion](https://github.com/golang/go/discussions/67901).)</sub>\n<!-- gaby:related -->\n"
+	if got != want {
+		t.Errorf("Default().Render:\nhave %q\nwant %q", got, want)
+	}
+
+	f, err := New(`— {{.Poster}} bot for {{.Project}}; feedback at {{.FeedbackURL}}`, "https://example.com/feedback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = f.Render("related", "rsc/tmp")
+	want = "\n— related bot for rsc/tmp; feedback at https://example.com/feedback\n<!-- gaby:related -->\n"
+	if got != want {
+		t.Errorf("Render:\nhave %q\nwant %q", got, want)
+	}
+
+	f, err = New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Render("x", "y"), "\n<!-- gaby:x -->\n"; got != want {
+		t.Errorf("empty Render = %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"{{", "{{.Missing}}"} {
+		if _, err := New(bad, ""); err == nil {
+			t.Errorf("New(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestPoster(t *testing.T) {
+	body := "> quoted\n> <!-- gaby:other -->\n\ntext\n" + Default().Render("related", "golang/go")
+	if poster, ok := Poster(body); !ok || poster != "related" {
+		t.Errorf("Poster = %q, %v, want related, true", poster, ok)
+	}
+	if poster, ok := Poster("hello"); ok {
+		t.Errorf("Poster(hello) = %q, true, want false", poster)
+	}
+}
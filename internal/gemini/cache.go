@@ -0,0 +1,161 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gemini
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This file stores the following key schema in the database:
+//
+//	["gemini.Cache", Model, Hash] => JSON of cacheEntry
+//
+// Model is the text model name, and Hash is the SHA-256 hash
+// of the cached text.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "gemini.Cache", Key: "Model, Hash", Val: "JSON of cacheEntry"},
+	)
+}
+
+// A cacheEntry records a Gemini cached content object.
+type cacheEntry struct {
+	Name   string    // server-assigned name, like "cachedContents/abc123"
+	Expire time.Time // server-reported expiration time
+}
+
+const (
+	// defaultCacheTTL is the cache lifetime used when
+	// [Client.CachedContext] is passed a zero TTL.
+	defaultCacheTTL = 1 * time.Hour
+
+	// cacheMargin is how long before its expiration a cache
+	// is considered expired, to avoid racing the server.
+	cacheMargin = 1 * time.Minute
+)
+
+// CachedContext returns an [llm.TextGenerator] that prefixes every prompt
+// with the static text, using Gemini's context caching so that the text
+// is uploaded and billed at the full input rate only once per TTL
+// instead of on every call.
+// It is intended for large prompt parts that rarely change,
+// like label taxonomies or triage guidelines.
+//
+// The names of the server-side caches are stored in db,
+// so that they are reused across generators and program restarts.
+// A cache expires ttl after it is created (a zero ttl means one hour);
+// after that, the next call creates a new cache.
+//
+// Gemini only caches content for explicitly versioned models
+// (such as "gemini-1.5-flash-001"; see [Client.SetTextModel])
+// and only content above a minimum size (32,768 tokens at the time of writing).
+// If the cache cannot be created, the returned generator
+// logs a warning and sends the static text with each prompt instead.
+func (c *Client) CachedContext(db storage.DB, static string, ttl time.Duration) llm.TextGenerator {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &cachedGenerator{c: c, db: db, static: static, ttl: ttl}
+}
+
+type cachedGenerator struct {
+	c      *Client
+	db     storage.DB
+	static string
+	ttl    time.Duration
+}
+
+// GenerateText returns model-generated text for the static text
+// followed by the prompt, implementing [llm.TextGenerator].
+func (g *cachedGenerator) GenerateText(prompt ...string) (string, error) {
+	name := g.cache()
+	if name == "" {
+		return g.c.generate(nil, "", append([]string{g.static}, prompt...)...)
+	}
+	text, err := g.c.generate(nil, name, prompt...)
+	var e *apiError
+	if errors.As(err, &e) && (e.Code == http.StatusNotFound || e.Code == http.StatusForbidden) {
+		// The cache was deleted or expired early. Make a new one.
+		g.c.slog.Info("gemini cache lost", "name", name, "err", err)
+		g.db.Delete(g.key())
+		if name = g.cache(); name == "" {
+			return g.c.generate(nil, "", append([]string{g.static}, prompt...)...)
+		}
+		text, err = g.c.generate(nil, name, prompt...)
+	}
+	return text, err
+}
+
+// key returns the database key for g's cache entry.
+func (g *cachedGenerator) key() []byte {
+	sum := sha256.Sum256([]byte(g.static))
+	return ordered.Encode("gemini.Cache", g.c.textModel, sum[:])
+}
+
+// cache returns the name of an unexpired server-side cache
+// holding g.static, creating one if needed.
+// It returns "" if the cache cannot be created.
+func (g *cachedGenerator) cache() string {
+	key := g.key()
+	if val, ok := g.db.Get(key); ok {
+		var e cacheEntry
+		if err := json.Unmarshal(val, &e); err != nil {
+			// unreachable unless corrupt storage
+			g.db.Panic("gemini cache decode", "key", storage.Fmt(key), "err", err)
+		}
+		if g.c.now().Add(cacheMargin).Before(e.Expire) {
+			return e.Name
+		}
+	}
+
+	e, err := g.c.createCache(g.static, g.ttl)
+	if err != nil {
+		g.c.slog.Warn("gemini cache create failed", "model", g.c.textModel, "err", err)
+		return ""
+	}
+	g.c.slog.Info("gemini cache created", "name", e.Name, "expire", e.Expire)
+	g.db.Set(key, storage.JSON(e))
+	return e.Name
+}
+
+type cacheRequest struct {
+	Model    string     `json:"model"`
+	Contents []*content `json:"contents"`
+	TTL      string     `json:"ttl"`
+}
+
+type cacheResponse struct {
+	Name       string    `json:"name"`
+	ExpireTime time.Time `json:"expireTime"`
+}
+
+// createCache creates a new server-side cache holding text
+// for use with the client's text model, expiring after ttl.
+func (c *Client) createCache(text string, ttl time.Duration) (*cacheEntry, error) {
+	req := &cacheRequest{
+		Model:    "models/" + c.textModel,
+		Contents: []*content{{Parts: []part{{text}}, Role: "user"}},
+		TTL:      fmt.Sprintf("%ds", int64(ttl/time.Second)),
+	}
+	var resp cacheResponse
+	if err := c.post(context.Background(), "cachedContents", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Name == "" {
+		return nil, fmt.Errorf("gemini: cachedContents returned no name")
+	}
+	return &cacheEntry{Name: resp.Name, Expire: resp.ExpireTime}, nil
+}
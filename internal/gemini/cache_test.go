@@ -0,0 +1,146 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+// cacheTransport is an http.RoundTripper that fakes the Gemini
+// cachedContents and generateContent APIs.
+// Generated text is the cache name (if any) followed by the prompt parts,
+// separated by |.
+type cacheTransport struct {
+	now     func() time.Time
+	failNew bool                 // fail cache creation
+	caches  map[string]string    // name → cached text
+	expire  map[string]time.Time // name → expiration
+	created int
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reply := func(code int, body any) (*http.Response, error) {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(js)),
+			Request:    req,
+		}, nil
+	}
+	fail := func(code int) (*http.Response, error) {
+		return reply(code, map[string]any{"error": map[string]any{"code": code, "message": "scripted failure"}})
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/cachedContents"):
+		var creq cacheRequest
+		if err := json.NewDecoder(req.Body).Decode(&creq); err != nil {
+			return nil, err
+		}
+		if t.failNew {
+			return fail(400)
+		}
+		ttl, err := time.ParseDuration(creq.TTL)
+		if err != nil {
+			return fail(400)
+		}
+		t.created++
+		name := fmt.Sprintf("cachedContents/%d", t.created)
+		t.caches[name] = creq.Contents[0].Parts[0].Text
+		t.expire[name] = t.now().Add(ttl)
+		return reply(200, map[string]any{"name": name, "expireTime": t.expire[name]})
+
+	case strings.HasSuffix(req.URL.Path, ":generateContent"):
+		var greq generateRequest
+		if err := json.NewDecoder(req.Body).Decode(&greq); err != nil {
+			return nil, err
+		}
+		var out []string
+		if name := greq.CachedContent; name != "" {
+			if _, ok := t.caches[name]; !ok || !t.now().Before(t.expire[name]) {
+				return fail(403)
+			}
+			out = append(out, name)
+		}
+		for _, p := range greq.Contents[0].Parts {
+			out = append(out, p.Text)
+		}
+		return reply(200, map[string]any{
+			"candidates": []any{map[string]any{
+				"content":      map[string]any{"role": "model", "parts": []any{map[string]any{"text": strings.Join(out, "|")}}},
+				"finishReason": "STOP",
+			}},
+		})
+	}
+	return fail(404)
+}
+
+func TestCachedContext(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := &cacheTransport{
+		now:    func() time.Time { return now },
+		caches: make(map[string]string),
+		expire: make(map[string]time.Time),
+	}
+	c, err := NewClient(lg, secret.Map{"ai.google.dev": "nokey"}, &http.Client{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = tr.now
+
+	check := func(g interface {
+		GenerateText(...string) (string, error)
+	}, prompt, want string, created int) {
+		t.Helper()
+		text, err := g.GenerateText(prompt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != want || tr.created != created {
+			t.Errorf("GenerateText(%q) = %q with %d caches created, want %q with %d", prompt, text, tr.created, want, created)
+		}
+	}
+
+	// The first call creates the cache, and later calls reuse it,
+	// even from a new generator using the same database.
+	g := c.CachedContext(db, "guidelines", 0)
+	check(g, "a", "cachedContents/1|a", 1)
+	check(g, "b", "cachedContents/1|b", 1)
+	check(c.CachedContext(db, "guidelines", 0), "c", "cachedContents/1|c", 1)
+
+	// Different static text uses a different cache.
+	check(c.CachedContext(db, "taxonomy", 0), "d", "cachedContents/2|d", 2)
+
+	// Shortly before expiration, a new cache is created.
+	now = now.Add(defaultCacheTTL - cacheMargin/2)
+	check(g, "e", "cachedContents/3|e", 3)
+
+	// A cache lost on the server is recreated.
+	delete(tr.caches, "cachedContents/3")
+	check(g, "f", "cachedContents/4|f", 4)
+
+	// If the cache cannot be created, the text is sent inline.
+	tr.failNew = true
+	now = now.Add(2 * defaultCacheTTL)
+	check(g, "g", "guidelines|g", 4)
+}
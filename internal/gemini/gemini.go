@@ -4,131 +4,473 @@
 
 // Package gemini implements access to Google's Gemini model.
 //
-// [Client] implements [llm.Embedder]. Use [NewClient] to connect.
+// [Client] implements [llm.Embedder], [llm.TextGenerator], and [llm.TokenCounter].
+// Use [NewClient] to connect.
+//
+// The client uses the Gemini REST API directly
+// (see https://ai.google.dev/api/rest).
+// [Client.CachedContext] uses Gemini's context caching
+// to avoid resending large static prompt text on every call.
 package gemini
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"maps"
+	"math"
 	"net/http"
 	"slices"
 	"strings"
-	_ "unsafe" // for linkname
+	"sync"
+	"time"
 
-	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
-	"rsc.io/gaby/internal/httprr"
 	"rsc.io/gaby/internal/llm"
 	"rsc.io/gaby/internal/secret"
 )
 
 // Scrub is a request scrubber for use with [rsc.io/httprr].
 func Scrub(req *http.Request) error {
-	delete(req.Header, "x-goog-api-key")    // genai does not canonicalize
-	req.Header.Del("X-Goog-Api-Key")        // in case it starts
-	delete(req.Header, "x-goog-api-client") // contains version numbers
-	req.Header.Del("X-Goog-Api-Client")
-
-	if ctype := req.Header.Get("Content-Type"); ctype == "application/json" || strings.HasPrefix(ctype, "application/json;") {
-		// Canonicalize JSON body.
-		// google.golang.org/protobuf/internal/encoding.json
-		// goes out of its way to randomize the JSON encodings
-		// of protobuf messages by adding or not adding spaces
-		// after commas. Derandomize by compacting the JSON.
-		b := req.Body.(*httprr.Body)
-		var buf bytes.Buffer
-		if err := json.Compact(&buf, b.Data); err == nil {
-			b.Data = buf.Bytes()
-		}
-	}
+	req.Header.Del("X-Goog-Api-Key")
 	return nil
 }
 
+// ScrubResponse is a response scrubber for use with [rsc.io/httprr].
+// It removes server diagnostic headers that vary from request to request
+// and only add noise to recorded traces.
+func ScrubResponse(resp *http.Response) error {
+	resp.Header.Del("Server-Timing")
+	resp.Header.Del("Alt-Svc")
+	return nil
+}
+
+// apiURL is the base URL of the Gemini REST API.
+const apiURL = "https://generativelanguage.googleapis.com/v1beta"
+
 // A Client represents a connection to Gemini.
 type Client struct {
-	slog  *slog.Logger
-	genai *genai.Client
+	slog       *slog.Logger
+	http       *http.Client
+	url        string
+	embedModel string
+	embedDim   int
+	taskType   string
+	textModel  string
+	sleep      func(time.Duration) // for testing
+	now        func() time.Time    // for testing
+
+	mu  sync.Mutex
+	key string
 }
 
 // NewClient returns a connection to Gemini, using the given logger and HTTP client.
 // It expects to find a secret of the form "AIza..." or "user:AIza..." in sdb
 // under the name "ai.google.dev".
+// If sdb is a [secret.Subscriber], the client uses the new key
+// whenever the secret changes.
 func NewClient(lg *slog.Logger, sdb secret.DB, hc *http.Client) (*Client, error) {
 	key, ok := sdb.Get("ai.google.dev")
 	if !ok {
 		return nil, fmt.Errorf("missing api key for ai.google.dev")
 	}
+	c := &Client{
+		slog:       lg,
+		http:       hc,
+		url:        apiURL,
+		key:        apiKey(key),
+		embedModel: defaultEmbedModel,
+		textModel:  defaultTextModel,
+		sleep:      time.Sleep,
+		now:        time.Now,
+	}
+	if sub, ok := sdb.(secret.Subscriber); ok {
+		sub.Subscribe("ai.google.dev", func(key string) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.key = apiKey(key)
+		})
+	}
+	return c, nil
+}
+
+// apiKey returns the API key in the secret.
+func apiKey(secret string) string {
 	// If key is from .netrc, ignore user name.
-	if _, pass, ok := strings.Cut(key, ":"); ok {
-		key = pass
-	}
-
-	// Ideally this would use use “option.WithAPIKey(key), option.WithHTTPClient(hc),”
-	// but using option.WithHTTPClient bypasses the code that passes along the API key.
-	// Instead we make our own derived http.Client that re-adds the key.
-	// And then we still have to say option.WithAPIKey("ignored") because
-	// otherwise NewClient complains that we haven't passed in a key.
-	// (If we pass in the key, it ignores it, but if we don't pass it in,
-	// it complains that we didn't give it a key.)
-	ai, err := genai.NewClient(context.Background(),
-		option.WithAPIKey("ignored"),
-		option.WithHTTPClient(withKey(hc, key)))
-	if err != nil {
-		return nil, err
+	if _, pass, ok := strings.Cut(secret, ":"); ok {
+		return pass
 	}
+	return secret
+}
+
+const (
+	defaultEmbedModel = "text-embedding-004"
+	defaultTextModel  = "gemini-1.5-flash"
+)
+
+// SetEmbeddingModel sets the model used by [Client.EmbedDocs].
+// The default is "text-embedding-004".
+func (c *Client) SetEmbeddingModel(model string) {
+	c.embedModel = model
+}
+
+// SetEmbeddingDim sets the number of dimensions in the vectors
+// returned by [Client.EmbedDocs]. The default, 0, means to use the
+// model's full dimension (768 for text-embedding-004).
+// Smaller values save space at some cost in accuracy:
+// EmbedDocs keeps the leading n elements of each vector
+// and rescales the result to a unit vector, which is how the
+// Gemini embedding models are trained to be shortened.
+func (c *Client) SetEmbeddingDim(n int) {
+	c.embedDim = n
+}
 
-	return &Client{slog: lg, genai: ai}, nil
+// taskTypes lists the Gemini API names for embedding task types.
+var taskTypes = []string{
+	"RETRIEVAL_QUERY",
+	"RETRIEVAL_DOCUMENT",
+	"SEMANTIC_SIMILARITY",
+	"CLASSIFICATION",
+	"CLUSTERING",
+	"QUESTION_ANSWERING",
+	"FACT_VERIFICATION",
 }
 
-// withKey returns a new http.Client that is the same as hc
-// except that it adds "x-goog-api-key: key" to every request.
-func withKey(hc *http.Client, key string) *http.Client {
-	c := *hc
-	t := c.Transport
-	if t == nil {
-		t = http.DefaultTransport
+// SetTaskType sets the task type used by [Client.EmbedDocs] for documents
+// without titles, such as "SEMANTIC_SIMILARITY" or "CLUSTERING".
+// (Documents with titles always use "RETRIEVAL_DOCUMENT".)
+// The default, "", lets the model choose.
+// SetTaskType returns an error for an unknown task type.
+func (c *Client) SetTaskType(task string) error {
+	if task != "" && !slices.Contains(taskTypes, task) {
+		return fmt.Errorf("gemini: unknown task type %q", task)
 	}
-	c.Transport = &transportWithKey{t, key}
-	return &c
+	c.taskType = task
+	return nil
 }
 
-// transportWithKey is the same as rt
-// except that it adds "x-goog-api-key: key" to every request.
-type transportWithKey struct {
-	rt  http.RoundTripper
-	key string
+// SetTextModel sets the model used by [Client.GenerateText],
+// [Client.CountTokens], and [Client.Check].
+// The default is "gemini-1.5-flash".
+func (c *Client) SetTextModel(model string) {
+	c.textModel = model
+}
+
+// TextModel returns a description of the text generation model,
+// such as "gemini/gemini-1.5-flash", for use in usage accounting
+// (see [rsc.io/gaby/internal/llmusage.Meter.SetPrice]).
+func (c *Client) TextModel() string {
+	return "gemini/" + c.textModel
 }
 
-func (t *transportWithKey) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	r := *req
-	r.Header = maps.Clone(req.Header)
-	r.Header["x-goog-api-key"] = []string{t.key}
-	return t.rt.RoundTrip(&r)
+// EmbeddingModel returns a description of the embedding configuration,
+// such as "gemini/text-embedding-004" or "gemini/text-embedding-004,dim=256".
+// Vectors computed with different descriptions are not comparable,
+// so the description is suitable for recording alongside stored vectors
+// (see [rsc.io/gaby/internal/storage.SetVectorModel])
+// and as an embedding cache key.
+func (c *Client) EmbeddingModel() string {
+	desc := "gemini/" + c.embedModel
+	if c.embedDim > 0 {
+		desc += fmt.Sprintf(",dim=%d", c.embedDim)
+	}
+	if c.taskType != "" {
+		desc += ",task=" + c.taskType
+	}
+	return desc
 }
 
 const maxBatch = 100 // empirical limit
 
+const (
+	maxRetries   = 4           // retries of a failed batch
+	retryBackoff = time.Second // delay before first retry, doubled for each later one
+)
+
+type part struct {
+	Text string `json:"text"`
+}
+
+type content struct {
+	Parts []part `json:"parts"`
+	Role  string `json:"role,omitempty"`
+}
+
+type embedRequest struct {
+	Model    string   `json:"model"`
+	Content  *content `json:"content"`
+	TaskType string   `json:"taskType,omitempty"`
+	Title    string   `json:"title,omitempty"`
+}
+
+type batchEmbedRequest struct {
+	Requests []*embedRequest `json:"requests"`
+}
+
+type batchEmbedResponse struct {
+	Embeddings []struct {
+		Values llm.Vector `json:"values"`
+	} `json:"embeddings"`
+}
+
 // EmbedDocs returns the vector embeddings for the docs,
 // implementing [llm.Embedder].
-func (c *Client) EmbedDocs(docs []llm.EmbedDoc) ([]llm.Vector, error) {
-	model := c.genai.EmbeddingModel("text-embedding-004")
+// It sends the docs in batches, retrying a batch that fails with a
+// transient error (such as exceeding a rate limit) up to four times,
+// with exponential backoff. If a batch still fails, EmbedDocs returns
+// the vectors for the preceding batches along with the error.
+func (c *Client) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	model := "models/" + c.embedModel
 	var vecs []llm.Vector
 	for docs := range slices.Chunk(docs, maxBatch) {
-		b := model.NewBatch()
+		req := new(batchEmbedRequest)
 		for _, d := range docs {
-			b.AddContentWithTitle(d.Title, genai.Text(d.Text))
+			r := &embedRequest{
+				Model:    model,
+				Content:  &content{Parts: []part{{d.Text}}},
+				TaskType: c.taskType,
+			}
+			// A title requires (and implies) the document task type.
+			if d.Title != "" {
+				r.Title = d.Title
+				r.TaskType = "RETRIEVAL_DOCUMENT"
+			}
+			req.Requests = append(req.Requests, r)
+		}
+		var resp batchEmbedResponse
+		var err error
+		for try := 0; ; try++ {
+			err = c.post(ctx, model+":batchEmbedContents", req, &resp)
+			if err == nil || try >= maxRetries || !transient(err) || ctx.Err() != nil {
+				break
+			}
+			delay := retryBackoff << try
+			c.slog.Warn("gemini EmbedDocs retry", "docs", len(vecs), "delay", delay, "err", err)
+			c.sleep(delay)
 		}
-		resp, err := model.BatchEmbedContents(context.Background(), b)
 		if err != nil {
 			return vecs, err
 		}
+		if len(resp.Embeddings) != len(docs) {
+			return vecs, fmt.Errorf("gemini: embedded %d docs, want %d", len(resp.Embeddings), len(docs))
+		}
 		for _, e := range resp.Embeddings {
-			vecs = append(vecs, e.Values)
+			vecs = append(vecs, c.shorten(e.Values))
 		}
 	}
 	return vecs, nil
 }
+
+// An apiError is an error reported by the Gemini API.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("gemini: %d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// transient reports whether err is a transient API error,
+// such as exceeding a rate limit or an internal server error,
+// after which the request may succeed if retried.
+func transient(err error) bool {
+	var e *apiError
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// shorten returns v shortened to the configured dimension, if any.
+func (c *Client) shorten(v llm.Vector) llm.Vector {
+	if c.embedDim <= 0 || c.embedDim >= len(v) {
+		return v
+	}
+	v = v[:c.embedDim:c.embedDim]
+	d := math.Sqrt(v.Dot(v))
+	if d == 0 {
+		return v
+	}
+	for i := range v {
+		v[i] /= float32(d)
+	}
+	return v
+}
+
+type safetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type generateRequest struct {
+	Contents       []*content       `json:"contents"`
+	SafetySettings []*safetySetting `json:"safetySettings,omitempty"`
+	CachedContent  string           `json:"cachedContent,omitempty"`
+}
+
+type generateResponse struct {
+	Candidates []struct {
+		Content      *content `json:"content"`
+		FinishReason string   `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+}
+
+// A blockedError reports that the prompt or response was blocked,
+// usually by safety settings.
+type blockedError struct {
+	reason string
+}
+
+func (e *blockedError) Error() string {
+	return "gemini: blocked: " + e.reason
+}
+
+// generate returns the text generated for the prompt parts,
+// using the given safety settings and cached content, if any
+// (see [Client.CachedContext]).
+func (c *Client) generate(safety []*safetySetting, cached string, prompt ...string) (string, error) {
+	req := &generateRequest{
+		Contents:       []*content{{Role: "user"}},
+		SafetySettings: safety,
+		CachedContent:  cached,
+	}
+	for _, p := range prompt {
+		req.Contents[0].Parts = append(req.Contents[0].Parts, part{p})
+	}
+	var resp generateResponse
+	if err := c.post(context.Background(), "models/"+c.textModel+":generateContent", req, &resp); err != nil {
+		return "", err
+	}
+	if fb := resp.PromptFeedback; fb != nil && fb.BlockReason != "" {
+		return "", &blockedError{"prompt: " + fb.BlockReason}
+	}
+	if len(resp.Candidates) == 0 {
+		return "", fmt.Errorf("gemini: no content generated")
+	}
+	cand := resp.Candidates[0]
+	if cand.FinishReason == "SAFETY" {
+		return "", &blockedError{"candidate: " + cand.FinishReason}
+	}
+	if cand.Content == nil {
+		return "", fmt.Errorf("gemini: no content generated")
+	}
+	var buf strings.Builder
+	for _, p := range cand.Content.Parts {
+		buf.WriteString(p.Text)
+	}
+	return buf.String(), nil
+}
+
+// GenerateText returns model-generated text for the prompt,
+// implementing [llm.TextGenerator].
+func (c *Client) GenerateText(prompt ...string) (string, error) {
+	return c.generate(nil, "", prompt...)
+}
+
+type countRequest struct {
+	Contents []*content `json:"contents"`
+}
+
+type countResponse struct {
+	TotalTokens int `json:"totalTokens"`
+}
+
+// CountTokens returns the number of tokens in text
+// as seen by the model used by [Client.GenerateText],
+// implementing [llm.TokenCounter].
+func (c *Client) CountTokens(text string) (int, error) {
+	req := &countRequest{Contents: []*content{{Parts: []part{{text}}, Role: "user"}}}
+	var resp countResponse
+	if err := c.post(context.Background(), "models/"+c.textModel+":countTokens", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.TotalTokens, nil
+}
+
+// checkPrompt is the instruction given to the model by [Client.Check].
+// The reply is ignored; only the safety ratings matter.
+const checkPrompt = "Reply with the single word OK. The text to consider follows.\n\n"
+
+// Check asks the model to rate the safety of text,
+// implementing [rsc.io/gaby/internal/safety.Filter].
+// It returns a non-empty reason if the model blocks the text
+// as having at least a medium probability of being harassment,
+// hate speech, sexually explicit, or dangerous.
+func (c *Client) Check(text string) (string, error) {
+	var safety []*safetySetting
+	for _, cat := range []string{
+		"HARM_CATEGORY_HARASSMENT",
+		"HARM_CATEGORY_HATE_SPEECH",
+		"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+		"HARM_CATEGORY_DANGEROUS_CONTENT",
+	} {
+		safety = append(safety, &safetySetting{Category: cat, Threshold: "BLOCK_MEDIUM_AND_ABOVE"})
+	}
+	_, err := c.generate(safety, "", checkPrompt+text)
+	if b, ok := err.(*blockedError); ok {
+		return "gemini safety: " + b.reason, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// post posts the JSON encoding of req to the API method
+// (for example "models/gemini-1.5-flash:generateContent")
+// and decodes the JSON response into reply.
+func (c *Client) post(ctx context.Context, method string, req, reply any) error {
+	js, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", c.url+"/"+method, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	c.mu.Lock()
+	key := c.key
+	c.mu.Unlock()
+	hreq.Header.Set("X-Goog-Api-Key", key)
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("gemini: reading body: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		var e struct {
+			Error *apiError `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != nil {
+			if e.Error.Code == 0 {
+				e.Error.Code = resp.StatusCode
+			}
+			return e.Error
+		}
+		return &apiError{Code: resp.StatusCode, Status: resp.Status, Message: string(data)}
+	}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return fmt.Errorf("gemini: decoding reply: %v", err)
+	}
+	return nil
+}
@@ -6,11 +6,16 @@ package gemini
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"rsc.io/gaby/internal/httprr"
 	"rsc.io/gaby/internal/llm"
@@ -18,6 +23,8 @@ import (
 	"rsc.io/gaby/internal/testutil"
 )
 
+var ctx = context.Background()
+
 var docs = []llm.EmbedDoc{
 	{Text: "for loops"},
 	{Text: "for all time, always"},
@@ -46,6 +53,7 @@ func newTestClient(t *testing.T, rrfile string) *Client {
 	rr, err := httprr.Open(rrfile, http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.Netrc()
 
 	c, err := NewClient(lg, sdb, rr.Client())
@@ -57,7 +65,7 @@ func newTestClient(t *testing.T, rrfile string) *Client {
 func TestEmbedBatch(t *testing.T) {
 	check := testutil.Checker(t)
 	c := newTestClient(t, "testdata/embedbatch.httprr")
-	vecs, err := c.EmbedDocs(docs)
+	vecs, err := c.EmbedDocs(ctx, docs)
 	check(err)
 	if len(vecs) != len(docs) {
 		t.Fatalf("len(vecs) = %d, but len(docs) = %d", len(vecs), len(docs))
@@ -91,7 +99,7 @@ func TestEmbedBatch(t *testing.T) {
 
 func TestBigBatch(t *testing.T) {
 	check := testutil.Checker(t)
-	c := newTestClient(t, "testdata/bigbatch.httprr")
+	c := newTestClient(t, "testdata/bigbatch.httprr.gz")
 	var docs []llm.EmbedDoc
 	data, err := os.ReadFile("/usr/local/plan9/lib/words")
 	check(err)
@@ -99,9 +107,252 @@ func TestBigBatch(t *testing.T) {
 		docs = append(docs, llm.EmbedDoc{Text: w})
 	}
 	docs = docs[:251]
-	vecs, err := c.EmbedDocs(docs)
+	vecs, err := c.EmbedDocs(ctx, docs)
 	check(err)
 	if len(vecs) != len(docs) {
 		t.Fatalf("len(vecs) = %d, but len(docs) = %d", len(vecs), len(docs))
 	}
 }
+
+func TestConfig(t *testing.T) {
+	lg := testutil.Slogger(t)
+	c, err := NewClient(lg, secret.Map{"ai.google.dev": "nokey"}, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := c.EmbeddingModel(); m != "gemini/text-embedding-004" {
+		t.Errorf("EmbeddingModel() = %q, want default", m)
+	}
+	if m := c.TextModel(); m != "gemini/gemini-1.5-flash" {
+		t.Errorf("TextModel() = %q, want default", m)
+	}
+	c.SetTextModel("gemini-1.5-pro")
+	if m, want := c.TextModel(), "gemini/gemini-1.5-pro"; m != want {
+		t.Errorf("TextModel() = %q, want %q", m, want)
+	}
+	if err := c.SetTaskType("NOT_A_TASK"); err == nil {
+		t.Errorf("SetTaskType(NOT_A_TASK) succeeded")
+	}
+	if err := c.SetTaskType("CLUSTERING"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetEmbeddingModel("text-embedding-005")
+	c.SetEmbeddingDim(2)
+	if m, want := c.EmbeddingModel(), "gemini/text-embedding-005,dim=2,task=CLUSTERING"; m != want {
+		t.Errorf("EmbeddingModel() = %q, want %q", m, want)
+	}
+
+	v := c.shorten(llm.Vector{0.6, 0, 0.8})
+	if want := (llm.Vector{1, 0}); !slices.Equal(v, want) {
+		t.Errorf("shorten = %v, want %v", v, want)
+	}
+	c.SetEmbeddingDim(0)
+	if v := c.shorten(llm.Vector{0.6, 0, 0.8}); len(v) != 3 {
+		t.Errorf("shorten with dim 0 = %v", v)
+	}
+}
+
+// scriptTransport is an http.RoundTripper that fakes the Gemini
+// batchEmbedContents API. Each request fails with the next status code
+// in fail, if any (0 means succeed), and otherwise embeds each text
+// as the vector {len(text)}.
+type scriptTransport struct {
+	fail     []int
+	requests int
+}
+
+func (t *scriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	reply := func(code int, body any) (*http.Response, error) {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(js)),
+			Request:    req,
+		}, nil
+	}
+	var code int
+	if len(t.fail) > 0 {
+		code, t.fail = t.fail[0], t.fail[1:]
+	}
+	if code != 0 {
+		return reply(code, map[string]any{"error": map[string]any{"code": code, "message": "scripted failure"}})
+	}
+	var breq struct {
+		Requests []struct {
+			Content struct {
+				Parts []struct{ Text string }
+			}
+		}
+	}
+	if err := json.NewDecoder(req.Body).Decode(&breq); err != nil {
+		return nil, err
+	}
+	type embedding struct {
+		Values []float32 `json:"values"`
+	}
+	var resp struct {
+		Embeddings []embedding `json:"embeddings"`
+	}
+	for _, r := range breq.Requests {
+		resp.Embeddings = append(resp.Embeddings, embedding{[]float32{float32(len(r.Content.Parts[0].Text))}})
+	}
+	return reply(200, resp)
+}
+
+func TestEmbedRetry(t *testing.T) {
+	lg := testutil.Slogger(t)
+	tr := new(scriptTransport)
+	c, err := NewClient(lg, secret.Map{"ai.google.dev": "nokey"}, &http.Client{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	c.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	var docs []llm.EmbedDoc
+	for i := range 2*maxBatch + 1 {
+		docs = append(docs, llm.EmbedDoc{Text: strings.Repeat("x", i)})
+	}
+	check := func(vecs []llm.Vector, n int) {
+		t.Helper()
+		if len(vecs) != n {
+			t.Fatalf("EmbedDocs returned %d vectors, want %d", len(vecs), n)
+		}
+		for i, v := range vecs {
+			if len(v) != 1 || v[0] != float32(i) {
+				t.Fatalf("vecs[%d] = %v, want [%d]", i, v, i)
+			}
+		}
+	}
+
+	// Transient failures are retried with backoff.
+	tr.fail = []int{429, 500}
+	vecs, err := c.EmbedDocs(ctx, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(vecs, len(docs))
+	if want := []time.Duration{retryBackoff, 2 * retryBackoff}; !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+	if tr.requests != 5 {
+		t.Errorf("made %d requests, want 5", tr.requests)
+	}
+
+	// A persistent failure in the second batch returns the first batch.
+	tr.fail = []int{0, 429, 429, 429, 429, 429}
+	delays = nil
+	vecs, err = c.EmbedDocs(ctx, docs)
+	if err == nil {
+		t.Fatalf("EmbedDocs succeeded despite persistent failure")
+	}
+	check(vecs, maxBatch)
+	if len(delays) != maxRetries {
+		t.Errorf("retried %d times, want %d", len(delays), maxRetries)
+	}
+
+	// Permanent failures are not retried.
+	delays = nil
+	tr.fail = []int{400}
+	if _, err := c.EmbedDocs(ctx, docs[:1]); err == nil {
+		t.Fatalf("EmbedDocs succeeded despite failure")
+	}
+	if len(delays) != 0 {
+		t.Errorf("retried permanent failure")
+	}
+}
+
+// keyTransport is an http.RoundTripper that fakes the Gemini
+// countTokens API, recording the API keys used.
+type keyTransport struct {
+	keys []string
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.keys = append(t.keys, req.Header.Get("X-Goog-Api-Key"))
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"totalTokens": 1}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestKeyRotation(t *testing.T) {
+	lg := testutil.Slogger(t)
+	current := "user:key1"
+	sdb, err := secret.Refresh(lg, 0, func() (secret.DB, error) {
+		return secret.Map{"ai.google.dev": current}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := new(keyTransport)
+	c, err := NewClient(lg, sdb, &http.Client{Transport: tr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CountTokens("x"); err != nil {
+		t.Fatal(err)
+	}
+	current = "user:key2"
+	sdb.Check()
+	if _, err := c.CountTokens("x"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"key1", "key2"}; !slices.Equal(tr.keys, want) {
+		t.Errorf("used keys %q, want %q", tr.keys, want)
+	}
+}
+
+func TestFakeServer(t *testing.T) {
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	srv := testutil.NewLLMServer(t)
+	c, err := NewClient(lg, secret.Map{"ai.google.dev": "fakekey"}, srv.Client())
+	check(err)
+	c.sleep = func(time.Duration) {}
+
+	srv.FailNext(1, http.StatusTooManyRequests)
+	vecs, err := c.EmbedDocs(ctx, docs)
+	check(err)
+	if len(vecs) != len(docs) {
+		t.Fatalf("EmbedDocs returned %d vectors, want %d", len(vecs), len(docs))
+	}
+	for i, v := range vecs {
+		if text := llm.UnquoteVector(v); text != docs[i].Text {
+			t.Errorf("EmbedDocs #%d = quote of %q, want %q", i, text, docs[i].Text)
+		}
+	}
+
+	text, err := c.GenerateText("hello", "world")
+	check(err)
+	if want := defaultTextModel + ": hello\nworld"; text != want {
+		t.Errorf("GenerateText = %q, want %q", text, want)
+	}
+	if n, err := c.CountTokens("hello, world"); err != nil || n <= 0 {
+		t.Errorf("CountTokens = %d, %v, want > 0, nil", n, err)
+	}
+
+	srv.FailNext(1, http.StatusBadRequest)
+	if _, err := c.GenerateText("hello"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("GenerateText with failure: err = %v, want 400 error", err)
+	}
+
+	want := []string{
+		"/v1beta/models/text-embedding-004:batchEmbedContents",
+		"/v1beta/models/text-embedding-004:batchEmbedContents",
+		"/v1beta/models/gemini-1.5-flash:generateContent",
+		"/v1beta/models/gemini-1.5-flash:countTokens",
+		"/v1beta/models/gemini-1.5-flash:generateContent",
+	}
+	if have := srv.Requests(); !slices.Equal(have, want) {
+		t.Errorf("Requests:\nhave %q\nwant %q", have, want)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// The audit log is stored in time-indexed storage (see [timed]):
+//
+//	["github.Audit", Project, Time, Issue, Comment] => [DBTime, JSON of AuditRecord]
+//	["github.AuditByTime", DBTime, Project, Time, Issue, Comment] => []
+//
+// Time is the time of the edit in Unix nanoseconds.
+// Comment is 0 for edits of an issue and for new comments.
+// Entries are only ever added, never changed or deleted.
+
+func init() {
+	timed.RegisterSchema("github.Audit", "Project, Time, Issue, Comment", "JSON of AuditRecord")
+}
+
+// An AuditRecord records a single edit made on GitHub
+// (or diverted, in testing mode) by a [Client].
+type AuditRecord struct {
+	DBTime   timed.DBTime    `json:"-"` // when the record was written
+	Time     time.Time       // time of the edit
+	Actor    string          // subsystem that made the edit (see [Client.As])
+	Action   string          // "PostIssueComment", "EditIssue", or "EditIssueComment"
+	Project  string          // GitHub project ("golang/go")
+	Issue    int64           // issue number
+	Comment  int64           // comment ID, for EditIssueComment
+	URL      string          // HTML URL of the edited issue or comment
+	Changes  json.RawMessage // the changes sent to GitHub
+	Result   string          // URL of the new comment, for PostIssueComment
+	Error    string          `json:",omitempty"` // error making the edit
+	Diverted bool            `json:",omitempty"` // edit was diverted (see [Client.EnableTesting])
+}
+
+// audit records an edit in the audit log.
+func (c *Client) audit(action, project string, issue, comment int64, changes any, result string, err error) {
+	r := &AuditRecord{
+		Time:     time.Now(),
+		Actor:    c.actor,
+		Action:   action,
+		Project:  project,
+		Issue:    issue,
+		Comment:  comment,
+		URL:      fmt.Sprintf("https://github.com/%s/issues/%d", project, issue),
+		Changes:  storage.JSON(changes),
+		Result:   result,
+		Diverted: c.divertEdits(),
+	}
+	if comment != 0 {
+		r.URL += fmt.Sprintf("#issuecomment-%d", comment)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b := c.db.Batch()
+	timed.Set(c.db, b, "github.Audit", o(project, r.Time.UnixNano(), issue, comment), storage.JSON(r))
+	b.Apply()
+	c.db.Flush()
+}
+
+// Audit returns an iterator over the audit log records
+// of the edits made to the given project at or after since,
+// in time order.
+// The audit log records every edit made through a Client
+// (posting a comment, editing a comment, or editing an issue,
+// including changing its labels, milestone, assignees, or state),
+// whether or not it succeeded.
+func (c *Client) Audit(project string, since time.Time) iter.Seq[*AuditRecord] {
+	return func(yield func(*AuditRecord) bool) {
+		for e := range timed.Scan(c.db, "github.Audit", o(project, since.UnixNano()), o(project, ordered.Inf)) {
+			if !yield(c.decodeAudit(e)) {
+				return
+			}
+		}
+	}
+}
+
+// AuditWatcher returns a new [timed.Watcher] with the given name
+// over the audit log records of all projects.
+// It picks up where any previous Watcher of the same name left off.
+func (c *Client) AuditWatcher(name string) *timed.Watcher[*AuditRecord] {
+	return timed.NewWatcher(c.db, name, "github.Audit", c.decodeAudit)
+}
+
+// decodeAudit decodes an audit log entry.
+func (c *Client) decodeAudit(e *timed.Entry) *AuditRecord {
+	var r AuditRecord
+	if err := json.Unmarshal(e.Val, &r); err != nil {
+		// unreachable unless corrupt storage
+		c.db.Panic("github audit decode", "key", storage.Fmt(e.Key), "err", err)
+	}
+	r.DBTime = e.ModTime
+	return &r
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/gaby/internal/tracing"
+)
+
+func TestAudit(t *testing.T) {
+	keepIDs(t)
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	c := New(lg, db, nil, nil)
+	tc := c.Testing()
+
+	issue := &Issue{Number: 1, Title: "title"}
+	tc.AddIssue("rsc/tmp", issue)
+	other := &Issue{Number: 2}
+	tc.AddIssue("rsc/other", other)
+
+	start := time.Now()
+	fixer := c.As("fixer")
+	url, err := fixer.PostIssueComment(issue, &IssueCommentChanges{Body: "hello"})
+	check(err)
+	comment, err := fixer.DownloadIssueComment(url)
+	check(err)
+	check(fixer.EditIssueComment(comment, &IssueCommentChanges{Body: "hello, world"}))
+	check(c.As("labeler").EditIssue(issue, &IssueChanges{Labels: &[]string{"bug"}}))
+	mid := time.Now()
+	check(c.EditIssue(issue, &IssueChanges{State: "closed"}))
+
+	if len(tc.Edits()) != 4 {
+		t.Errorf("As clients do not share testing state: %d edits, want 4", len(tc.Edits()))
+	}
+
+	var have []string
+	for r := range c.Audit("rsc/tmp", start) {
+		if r.Project != "rsc/tmp" || !r.Diverted || r.Time.Before(start) {
+			t.Errorf("bad record %+v", r)
+		}
+		have = append(have, r.Actor+" "+r.Action+" "+r.URL+" "+string(r.Changes))
+	}
+	want := []string{
+		`fixer PostIssueComment https://github.com/rsc/tmp/issues/1 {"body":"hello"}`,
+		`fixer EditIssueComment https://github.com/rsc/tmp/issues/1#issuecomment-` + strings.TrimPrefix(url, "https://api.github.com/repos/rsc/tmp/issues/comments/") + ` {"body":"hello, world"}`,
+		`labeler EditIssue https://github.com/rsc/tmp/issues/1 {"labels":["bug"]}`,
+		` EditIssue https://github.com/rsc/tmp/issues/1 {"state":"closed"}`,
+	}
+	if strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Audit:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+
+	var first *AuditRecord
+	for r := range c.Audit("rsc/tmp", start) {
+		first = r
+		break
+	}
+	if first == nil || first.Result != url {
+		t.Errorf("PostIssueComment record Result = %v, want %q", first, url)
+	}
+
+	n := 0
+	for range c.Audit("rsc/tmp", mid) {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("Audit since mid: %d records, want 1", n)
+	}
+	for r := range c.Audit("rsc/other", start) {
+		t.Errorf("unexpected record for rsc/other: %+v", r)
+	}
+
+	w := c.AuditWatcher("test")
+	have = nil
+	for r := range w.Recent() {
+		have = append(have, r.Actor+" "+r.Action)
+		w.MarkOld(r.DBTime)
+	}
+	if want := []string{"fixer PostIssueComment", "fixer EditIssueComment", "labeler EditIssue", " EditIssue"}; !slices.Equal(have, want) {
+		t.Errorf("AuditWatcher: %q, want %q", have, want)
+	}
+	check(c.EditIssue(other, &IssueChanges{State: "closed"}))
+	for r := range w.Recent() {
+		if r.Project != "rsc/other" {
+			t.Errorf("AuditWatcher after MarkOld: %+v, want only rsc/other", r)
+		}
+	}
+}
+
+func TestEditTrace(t *testing.T) {
+	keepIDs(t)
+	sr := tracetest.NewSpanRecorder()
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(old)
+
+	check := testutil.Checker(t)
+	c := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	tc := c.Testing()
+	issue := &Issue{Number: 1}
+	tc.AddIssue("rsc/tmp", issue)
+
+	pctx, parent := tracing.Start(ctx, "parent")
+	check(c.As("fixer").WithContext(pctx).EditIssue(issue, &IssueChanges{State: "closed"}))
+	parent.End()
+	check(c.EditIssue(issue, &IssueChanges{State: "open"}))
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("ended %d spans, want 3", len(spans))
+	}
+	edit, root := spans[0], spans[2]
+	if edit.Name() != "github.EditIssue" || edit.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("edit span %q not child of parent", edit.Name())
+	}
+	if root.Name() != "github.EditIssue" || root.Parent().IsValid() {
+		t.Errorf("edit without context: span %q has parent", root.Name())
+	}
+	var attrs []string
+	for _, kv := range edit.Attributes() {
+		attrs = append(attrs, string(kv.Key)+"="+kv.Value.Emit())
+	}
+	if have, want := strings.Join(attrs, " "), "actor=fixer project=rsc/tmp issue=1 comment=0 diverted=true"; have != want {
+		t.Errorf("attributes = %q, want %q", have, want)
+	}
+}
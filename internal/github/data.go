@@ -5,10 +5,12 @@
 package github
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"iter"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -37,12 +39,70 @@ func (c *Client) LookupIssueURL(url string) (*Issue, error) {
 		return bad()
 	}
 
-	for e := range c.Events(proj, n, n) {
-		if e.API == "/issues" {
-			return e.Typed.(*Issue), nil
+	return c.LookupIssue(proj, n)
+}
+
+// LookupIssue looks up the issue with the given number in project,
+// only consulting the database (not actual GitHub).
+func (c *Client) LookupIssue(project string, n int64) (*Issue, error) {
+	if issue, ok := c.lookupIssue(project, n); ok {
+		return issue, nil
+	}
+	return nil, fmt.Errorf("%s#%d not in database", project, n)
+}
+
+// LookupIssueComment looks up the issue comment with the given ID in project,
+// only consulting the database (not actual GitHub).
+// The comment's issue number is available from its [IssueComment.Issue] method.
+//
+// Comment IDs appear to be unique across GitHub, but if several issues
+// in project have comments with the given ID, LookupIssueComment returns
+// the one on the lowest-numbered issue.
+func (c *Client) LookupIssueComment(project string, id int64) (*IssueComment, error) {
+	for key := range c.db.Scan(o("githubdl.CommentByID", project, id), o("githubdl.CommentByID", project, id, ordered.Inf)) {
+		var issue int64
+		if err := ordered.Decode(key, nil, nil, nil, &issue); err != nil {
+			// unreachable unless corrupt storage
+			c.db.Panic("github comment index decode", "key", storage.Fmt(key), "err", err)
+		}
+		if e, ok := timed.Get(c.db, "githubdl.Event", o(project, issue, "/issues/comments", id)); ok {
+			return c.decodeEvent(e).Typed.(*IssueComment), nil
+		}
+	}
+	return nil, fmt.Errorf("%s comment %d not in database", project, id)
+}
+
+// Milestones returns the milestones in use by issues in the given project,
+// in increasing order by milestone number.
+// The state of each milestone is as recorded in the most recently updated
+// issue in that milestone, so it may be stale for milestones
+// whose issues have not changed since the milestone was closed.
+// Only the database is consulted, not actual GitHub.
+func (c *Client) Milestones(project string) []Milestone {
+	latest := make(map[int64]string) // UpdatedAt of issue providing milestone
+	byNum := make(map[int64]Milestone)
+	for e := range c.Events(project, 0, -1) {
+		if e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*Issue)
+		m := issue.Milestone
+		if m.Number == 0 {
+			continue
+		}
+		if t, ok := latest[m.Number]; !ok || t < issue.UpdatedAt {
+			latest[m.Number] = issue.UpdatedAt
+			byNum[m.Number] = m
 		}
 	}
-	return nil, fmt.Errorf("%s#%d not in database", proj, n)
+	var list []Milestone
+	for _, m := range byNum {
+		list = append(list, m)
+	}
+	slices.SortFunc(list, func(x, y Milestone) int {
+		return cmp.Compare(x.Number, y.Number)
+	})
+	return list
 }
 
 // An Event is a single GitHub issue event stored in the database.
@@ -78,6 +138,37 @@ func (c *Client) Events(project string, issueMin, issueMax int64) iter.Seq[*Even
 	}
 }
 
+// Timeline returns the events for the given issue in chronological order,
+// merging the "/issues", "/issues/comments", and "/issues/events" APIs,
+// which have independent ID spaces and are stored separately in the database.
+// The first event is normally the issue creation event (API "/issues").
+// Events with the same creation time are ordered as in [Client.Events].
+// Only the database is consulted, not actual GitHub.
+func (c *Client) Timeline(project string, issue int64) []*Event {
+	var list []*Event
+	for e := range c.Events(project, issue, issue) {
+		list = append(list, e)
+	}
+	slices.SortStableFunc(list, func(x, y *Event) int {
+		return strings.Compare(x.CreatedAt(), y.CreatedAt())
+	})
+	return list
+}
+
+// CreatedAt returns the creation time of the event,
+// in the RFC3339 format used by GitHub (for example "2024-06-03T15:04:05Z").
+func (e *Event) CreatedAt() string {
+	switch x := e.Typed.(type) {
+	case *Issue:
+		return x.CreatedAt
+	case *IssueComment:
+		return x.CreatedAt
+	case *IssueEvent:
+		return x.CreatedAt
+	}
+	return ""
+}
+
 // EventsAfter returns an iterator over events in the given project after DBTime t,
 // which should be e.DBTime from the most recent processed event.
 // The events are iterated over in DBTime order, so the DBTime of the last
@@ -113,10 +204,7 @@ func (c *Client) decodeEvent(t *timed.Entry) *Event {
 		c.db.Panic("github event decode", "key", storage.Fmt(t.Key), "err", err)
 	}
 
-	var js ordered.Raw
-	if err := ordered.Decode(t.Val, &js); err != nil {
-		c.db.Panic("github event val decode", "key", storage.Fmt(t.Key), "val", storage.Fmt(t.Val), "err", err)
-	}
+	js, _ := c.decodeEventVal(t)
 	e.JSON = js
 	switch e.API {
 	default:
@@ -170,7 +258,9 @@ type Label struct {
 
 // A Milestone represents a project issue milestone in GitHub JSON.
 type Milestone struct {
-	Title string
+	Number int64
+	Title  string
+	State  string // "open" or "closed"
 }
 
 // A Rename describes an issue title renaming in GitHub JSON.
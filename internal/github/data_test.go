@@ -0,0 +1,134 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
+)
+
+func TestTimeline(t *testing.T) {
+	keepIDs(t)
+	check := testutil.Checker(t)
+	c := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	check(c.Testing().LoadTxtar("../testdata/rsctmp.txt"))
+
+	var have []string
+	for _, e := range c.Timeline("rsc/tmp", 1) {
+		desc := e.API
+		switch x := e.Typed.(type) {
+		case *Issue:
+			desc += " " + x.User.Login
+		case *IssueComment:
+			desc += " " + strings.TrimSpace(x.Body)
+		case *IssueEvent:
+			desc += " " + x.Event
+		}
+		have = append(have, fmt.Sprintf("%s %s", e.CreatedAt(), desc))
+		if len(have) == 6 {
+			break
+		}
+	}
+	want := []string{
+		"2015-01-07T23:11:46Z /issues rsc",
+		"2015-01-07T23:12:19Z /issues/events renamed",
+		"2015-01-07T23:12:37Z /issues/comments Hello, world.",
+		"2015-01-07T23:12:49Z /issues/comments Another comment.",
+		"2015-01-07T23:13:10Z /issues/events assigned",
+		"2015-01-07T23:13:16Z /issues/events unassigned",
+	}
+	if strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Timeline(rsc/tmp#1):\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+
+	if tl := c.Timeline("rsc/tmp", 1000); len(tl) != 0 {
+		t.Errorf("Timeline(rsc/tmp#1000) = %d events, want 0", len(tl))
+	}
+}
+
+func TestMilestones(t *testing.T) {
+	keepIDs(t)
+	c := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	tc := c.Testing()
+	tc.AddIssue("rsc/tmp", &Issue{Number: 1, UpdatedAt: "2024-01-01T00:00:00Z", Milestone: Milestone{Number: 2, Title: "Go1.22", State: "open"}})
+	tc.AddIssue("rsc/tmp", &Issue{Number: 2, UpdatedAt: "2024-03-01T00:00:00Z", Milestone: Milestone{Number: 2, Title: "Go1.22", State: "closed"}})
+	tc.AddIssue("rsc/tmp", &Issue{Number: 3, UpdatedAt: "2024-02-01T00:00:00Z", Milestone: Milestone{Number: 1, Title: "Backlog", State: "open"}})
+	tc.AddIssue("rsc/tmp", &Issue{Number: 4, UpdatedAt: "2024-02-01T00:00:00Z"})
+	tc.AddIssue("rsc/other", &Issue{Number: 1, Milestone: Milestone{Number: 3, Title: "Other", State: "open"}})
+
+	have := c.Milestones("rsc/tmp")
+	want := []Milestone{
+		{Number: 1, Title: "Backlog", State: "open"},
+		{Number: 2, Title: "Go1.22", State: "closed"},
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Milestones = %v, want %v", have, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	keepIDs(t)
+	check := testutil.Checker(t)
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, nil, nil)
+	check(c.Testing().LoadTxtar("../testdata/rsctmp.txt"))
+
+	issue, err := c.LookupIssue("rsc/tmp", 1)
+	check(err)
+	if issue.Number != 1 || issue.User.Login != "rsc" {
+		t.Errorf("LookupIssue(rsc/tmp, 1) = #%d by %s, want #1 by rsc", issue.Number, issue.User.Login)
+	}
+	if _, err := c.LookupIssue("rsc/tmp", 1000); err == nil {
+		t.Errorf("LookupIssue(rsc/tmp, 1000) succeeded, want error")
+	}
+	if _, err := c.LookupIssue("rsc/other", 1); err == nil {
+		t.Errorf("LookupIssue(rsc/other, 1) succeeded, want error")
+	}
+
+	var comments []*IssueComment
+	for e := range c.Events("rsc/tmp", -1, -1) {
+		if e.API == "/issues/comments" {
+			comments = append(comments, e.Typed.(*IssueComment))
+		}
+	}
+	if len(comments) == 0 {
+		t.Fatal("no comments in rsctmp.txt")
+	}
+	checkComments := func() {
+		t.Helper()
+		for _, want := range comments {
+			have, err := c.LookupIssueComment("rsc/tmp", want.CommentID())
+			if err != nil {
+				t.Errorf("LookupIssueComment(rsc/tmp, %d): %v", want.CommentID(), err)
+				continue
+			}
+			if have.URL != want.URL || have.Issue() != want.Issue() || have.Body != want.Body {
+				t.Errorf("LookupIssueComment(rsc/tmp, %d) = %s, want %s", want.CommentID(), have.URL, want.URL)
+			}
+		}
+	}
+	checkComments()
+	id := comments[0].CommentID()
+	if _, err := c.LookupIssueComment("rsc/other", id); err == nil {
+		t.Errorf("LookupIssueComment(rsc/other, %d) succeeded, want error", id)
+	}
+	if _, err := c.LookupIssueComment("rsc/tmp", 1); err == nil {
+		t.Errorf("LookupIssueComment(rsc/tmp, 1) succeeded, want error")
+	}
+
+	// Rebuilding the index must find the same comments.
+	db.DeleteRange(o("githubdl.CommentByID"), o("githubdl.CommentByID", ordered.Inf))
+	if _, err := c.LookupIssueComment("rsc/tmp", id); err == nil {
+		t.Errorf("LookupIssueComment(rsc/tmp, %d) succeeded after deleting index, want error", id)
+	}
+	c.reindexIssues("rsc/tmp")
+	checkComments()
+}
@@ -6,13 +6,21 @@ package github
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/tracing"
 )
 
 // NOTE: It's possible that we should elevate TestingEdit to a general
@@ -22,21 +30,54 @@ import (
 // the work has been done, so normally “deferred edits” should be
 // as high in the stack as possible, and the GitHub client is not.
 
+// The edit methods below record each edit in the audit log (see [Client.Audit])
+// and trace it (see [Client.WithContext]).
+
 // PostIssueComment posts a new comment with the given body (written in Markdown) on issue.
-func (c *Client) PostIssueComment(issue *Issue, changes *IssueCommentChanges) error {
+// It returns the API URL of the new comment, which can be passed to
+// [Client.DownloadIssueComment] or used to construct an [IssueComment]
+// for [Client.EditIssueComment].
+func (c *Client) PostIssueComment(issue *Issue, changes *IssueCommentChanges) (commentURL string, err error) {
+	span := c.startEdit("PostIssueComment", issue.Project(), issue.Number, 0)
+	defer func() {
+		tracing.End(span, err)
+		c.audit("PostIssueComment", issue.Project(), issue.Number, 0, changes, commentURL, err)
+	}()
+
 	if c.divertEdits() {
 		c.testMu.Lock()
 		defer c.testMu.Unlock()
 
+		if err := c.testFail["PostIssueComment"]; err != nil {
+			return "", err
+		}
 		c.testEdits = append(c.testEdits, &TestingEdit{
 			Project:             issue.Project(),
 			Issue:               issue.Number,
 			IssueCommentChanges: changes.clone(),
 		})
-		return nil
+
+		// Make the comment available to DownloadIssueComment,
+		// as it would be on GitHub, but not in the database,
+		// which only sees it after the next sync.
+		id := atomic.AddInt64(&commentID, +1)
+		comment := &IssueComment{
+			URL:     fmt.Sprintf("https://api.github.com/repos/%s/issues/comments/%d", issue.Project(), id),
+			HTMLURL: fmt.Sprintf("https://github.com/%s/issues/%d#issuecomment-%d", issue.Project(), issue.Number, id),
+			Body:    changes.Body,
+		}
+		if c.testEvents == nil {
+			c.testEvents = make(map[string]json.RawMessage)
+		}
+		c.testEvents[comment.URL] = storage.JSON(comment)
+		return comment.URL, nil
 	}
 
-	return c.post(issue.URL+"/comments", changes)
+	var comment IssueComment
+	if err := c.json("POST", issue.URL+"/comments", changes, &comment); err != nil {
+		return "", err
+	}
+	return comment.URL, nil
 }
 
 // DownloadIssue downloads the current issue JSON from the given URL
@@ -44,7 +85,7 @@ func (c *Client) PostIssueComment(issue *Issue, changes *IssueCommentChanges) er
 // Given an issue, c.DownloadIssue(issue.URL) fetches the very latest state for the issue.
 func (c *Client) DownloadIssue(url string) (*Issue, error) {
 	x := new(Issue)
-	_, err := c.get(url, "", x)
+	_, err := c.get(c.context(), url, validator{}, x)
 	if err != nil {
 		return nil, err
 	}
@@ -56,13 +97,85 @@ func (c *Client) DownloadIssue(url string) (*Issue, error) {
 // Given a comment, c.DownloadIssueComment(comment.URL) fetches the very latest state for the comment.
 func (c *Client) DownloadIssueComment(url string) (*IssueComment, error) {
 	x := new(IssueComment)
-	_, err := c.get(url, "", x)
+	_, err := c.get(c.context(), url, validator{}, x)
 	if err != nil {
 		return nil, err
 	}
 	return x, nil
 }
 
+// A Reaction is the GitHub JSON structure for an emoji reaction
+// to an issue or issue comment.
+type Reaction struct {
+	User    User   `json:"user"`
+	Content string `json:"content"` // "+1", "-1", "laugh", "confused", "heart", "hooray", "rocket", or "eyes"
+}
+
+// DownloadReactions downloads the reactions to the issue or issue comment
+// with the given API URL (an [Issue.URL] or [IssueComment.URL]).
+// It returns at most 100 reactions.
+// Reactions are not stored in the database, so checking them
+// always requires a call to GitHub.
+//
+// In testing mode, DownloadReactions returns the reactions
+// added by [TestingClient.AddReaction].
+func (c *Client) DownloadReactions(url string) ([]*Reaction, error) {
+	if c.divertEdits() {
+		c.testMu.Lock()
+		defer c.testMu.Unlock()
+		return slices.Clone(c.testReacts[url]), nil
+	}
+	var list []*Reaction
+	if _, err := c.get(c.context(), url+"/reactions?per_page=100", validator{}, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// fileContent is the GitHub JSON structure for file contents.
+type fileContent struct {
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+// DownloadFile downloads the current content of the file
+// with the given path in the default branch of project.
+// Files are not stored in the database, so reading them
+// always requires a call to GitHub.
+//
+// In testing mode, DownloadFile returns the files
+// added by [TestingClient.AddFile].
+func (c *Client) DownloadFile(project, path string) ([]byte, error) {
+	url := fileURL(project, path)
+	if c.divertEdits() {
+		c.testMu.Lock()
+		_, ok := c.testEvents[url]
+		c.testMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("%s: 404 Not Found", url)
+		}
+	}
+	var f fileContent
+	if _, err := c.get(c.context(), url, validator{}, &f); err != nil {
+		return nil, err
+	}
+	if f.Type != "file" || f.Encoding != "base64" {
+		return nil, fmt.Errorf("%s: unexpected %s content with encoding %q", url, f.Type, f.Encoding)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(f.Content, "\n", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	return data, nil
+}
+
+// fileURL returns the API URL for the content of the file
+// with the given path in project.
+func fileURL(project, path string) string {
+	return fmt.Sprintf("https://api.github.com/repos/%s/contents/%s", project, path)
+}
+
 type IssueCommentChanges struct {
 	Body string `json:"body,omitempty"`
 }
@@ -77,11 +190,20 @@ func (ch *IssueCommentChanges) clone() *IssueCommentChanges {
 // It is typically a good idea to use c.DownloadIssueComment first and check
 // that the live comment body matches the one obtained from the database,
 // to minimize race windows.
-func (c *Client) EditIssueComment(comment *IssueComment, changes *IssueCommentChanges) error {
+func (c *Client) EditIssueComment(comment *IssueComment, changes *IssueCommentChanges) (err error) {
+	span := c.startEdit("EditIssueComment", comment.Project(), comment.Issue(), comment.CommentID())
+	defer func() {
+		tracing.End(span, err)
+		c.audit("EditIssueComment", comment.Project(), comment.Issue(), comment.CommentID(), changes, "", err)
+	}()
+
 	if c.divertEdits() {
 		c.testMu.Lock()
 		defer c.testMu.Unlock()
 
+		if err := c.testFail["EditIssueComment"]; err != nil {
+			return err
+		}
 		c.testEdits = append(c.testEdits, &TestingEdit{
 			Project:             comment.Project(),
 			Issue:               comment.Issue(),
@@ -102,11 +224,18 @@ func (c *Client) EditIssueComment(comment *IssueComment, changes *IssueCommentCh
 // you need to include all the existing labels as well.
 // Labels is a *[]string so that it can be set to new([]string)
 // to clear the labels.
+//
+// Milestone is the milestone number, not its title.
+//
+// Like Labels, Assignees is the new set of all assignee logins
+// for the issue, not assignees to add.
 type IssueChanges struct {
-	Title  string    `json:"title,omitempty"`
-	Body   string    `json:"body,omitempty"`
-	State  string    `json:"state,omitempty"`
-	Labels *[]string `json:"labels,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Labels    *[]string `json:"labels,omitempty"`
+	Milestone int64     `json:"milestone,omitempty"`
+	Assignees *[]string `json:"assignees,omitempty"`
 }
 
 func (ch *IssueChanges) clone() *IssueChanges {
@@ -116,15 +245,28 @@ func (ch *IssueChanges) clone() *IssueChanges {
 		x := slices.Clone(*ch.Labels)
 		ch.Labels = &x
 	}
+	if ch.Assignees != nil {
+		x := slices.Clone(*ch.Assignees)
+		ch.Assignees = &x
+	}
 	return ch
 }
 
 // EditIssue applies the changes to issue on GitHub.
-func (c *Client) EditIssue(issue *Issue, changes *IssueChanges) error {
+func (c *Client) EditIssue(issue *Issue, changes *IssueChanges) (err error) {
+	span := c.startEdit("EditIssue", issue.Project(), issue.Number, 0)
+	defer func() {
+		tracing.End(span, err)
+		c.audit("EditIssue", issue.Project(), issue.Number, 0, changes, "", err)
+	}()
+
 	if c.divertEdits() {
 		c.testMu.Lock()
 		defer c.testMu.Unlock()
 
+		if err := c.testFail["EditIssue"]; err != nil {
+			return err
+		}
 		c.testEdits = append(c.testEdits, &TestingEdit{
 			Project:      issue.Project(),
 			Issue:        issue.Number,
@@ -136,20 +278,27 @@ func (c *Client) EditIssue(issue *Issue, changes *IssueChanges) error {
 	return c.patch(issue.URL, changes)
 }
 
-// patch is like c.get but makes a PATCH request.
-// Unlike c.get, it requires authentication.
-func (c *Client) patch(url string, changes any) error {
-	return c.json("PATCH", url, changes)
+// startEdit starts a span tracing an edit by the named method
+// to the given issue or issue comment.
+func (c *Client) startEdit(method, project string, issue, comment int64) trace.Span {
+	_, span := tracing.Start(c.context(), "github."+method,
+		attribute.String("actor", c.actor),
+		attribute.String("project", project),
+		attribute.Int64("issue", issue),
+		attribute.Int64("comment", comment),
+		attribute.Bool("diverted", c.divertEdits()))
+	return span
 }
 
-// post is like c.get but makes a POST request.
+// patch is like c.get but makes a PATCH request.
 // Unlike c.get, it requires authentication.
-func (c *Client) post(url string, body any) error {
-	return c.json("POST", url, body)
+func (c *Client) patch(url string, changes any) error {
+	return c.json("PATCH", url, changes, nil)
 }
 
 // json is the general PATCH/POST implementation.
-func (c *Client) json(method, url string, body any) error {
+// If reply is non-nil, json decodes the response body into reply.
+func (c *Client) json(method, url string, body, reply any) error {
 	js, err := json.Marshal(body)
 	if err != nil {
 		return err
@@ -161,8 +310,11 @@ func (c *Client) json(method, url string, body any) error {
 	}
 	user, pass, _ := strings.Cut(auth, ":")
 
+	// Edits are not canceled, so that an edit is never left
+	// in an unknown state (see [Client.WithContext]).
+	ctx := context.WithoutCancel(c.context())
 Redo:
-	req, err := http.NewRequest(method, url, bytes.NewReader(js))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(js))
 	if err != nil {
 		return err
 	}
@@ -177,11 +329,17 @@ Redo:
 	if err != nil {
 		return fmt.Errorf("reading body: %v", err)
 	}
-	if c.rateLimit(resp) {
+	if wait, ok := c.rateLimit(resp); ok {
+		c.wait(ctx, wait)
 		goto Redo
 	}
 	if resp.StatusCode/10 != 20 { // allow 200, 201, maybe others
 		return fmt.Errorf("%s\n%s", resp.Status, data)
 	}
+	if reply != nil {
+		if err := json.Unmarshal(data, reply); err != nil {
+			return fmt.Errorf("%s %s: decoding reply: %v", method, url, err)
+		}
+	}
 	return nil
 }
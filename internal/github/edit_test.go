@@ -24,13 +24,14 @@ func TestMarkdownEditing(t *testing.T) {
 	rr, err := httprr.Open("../testdata/tmpedit.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.DB(secret.Map{"api.github.com": "user:pass"})
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c := New(lg, db, sdb, rr.Client())
 	check(c.Add("rsc/tmp"))
-	check(c.Sync())
+	check(c.Sync(ctx))
 
 	var ei, ec *Event
 	for e := range c.Events("rsc/tmp", 5, 5) {
@@ -64,7 +65,11 @@ func TestMarkdownEditing(t *testing.T) {
 
 	c.testing = false // edit github directly (except for the httprr in the way)
 	check(c.EditIssueComment(comment, &IssueCommentChanges{Body: rot13(comment.Body)}))
-	check(c.PostIssueComment(issue, &IssueCommentChanges{Body: "testing. rot13 is the best."}))
+	url, err := c.PostIssueComment(issue, &IssueCommentChanges{Body: "testing. rot13 is the best."})
+	check(err)
+	if want := "https://api.github.com/repos/rsc/tmp/issues/comments/2163990617"; url != want {
+		t.Errorf("PostIssueComment: URL=%q, want %q", url, want)
+	}
 	check(c.EditIssue(issue, &IssueChanges{Title: rot13(issue.Title)}))
 }
 
@@ -107,8 +112,30 @@ func TestMarkdownDivertEdit(t *testing.T) {
 	}
 
 	check(c.EditIssueComment(comment, &IssueCommentChanges{Body: rot13(comment.Body)}))
-	check(c.PostIssueComment(issue, &IssueCommentChanges{Body: "testing. rot13 is the best."}))
+	url, err := c.PostIssueComment(issue, &IssueCommentChanges{Body: "testing. rot13 is the best."})
+	check(err)
+	posted, err := c.DownloadIssueComment(url)
+	check(err)
+	if posted.Body != "testing. rot13 is the best." {
+		t.Errorf("DownloadIssueComment(posted): Body=%q, want %q", posted.Body, "testing. rot13 is the best.")
+	}
+	c.Testing().AddReaction(url, &Reaction{User: User{Login: "rsc"}, Content: "+1"})
+	reacts, err := c.DownloadReactions(url)
+	check(err)
+	if len(reacts) != 1 || reacts[0].User.Login != "rsc" || reacts[0].Content != "+1" {
+		t.Errorf("DownloadReactions(posted) = %v, want one +1 by rsc", reacts)
+	}
+	c.Testing().AddFile("rsc/tmp", "CODEOWNERS", []byte("* @rsc\n"))
+	data, err := c.DownloadFile("rsc/tmp", "CODEOWNERS")
+	check(err)
+	if string(data) != "* @rsc\n" {
+		t.Errorf("DownloadFile(CODEOWNERS) = %q, want %q", data, "* @rsc\n")
+	}
+	if _, err := c.DownloadFile("rsc/tmp", "OWNERS"); err == nil {
+		t.Errorf("DownloadFile(OWNERS) succeeded, want error")
+	}
 	check(c.EditIssue(issue, &IssueChanges{Title: rot13(issue.Title), Labels: &[]string{"ebg13"}}))
+	check(c.EditIssue(issue, &IssueChanges{Assignees: &[]string{"rsc"}}))
 
 	var edits []string
 	for _, e := range c.Testing().Edits() {
@@ -119,6 +146,7 @@ func TestMarkdownDivertEdit(t *testing.T) {
 		`EditIssueComment(rsc/tmp#5.10000000008, {"body":"Comment!\n"})`,
 		`PostIssueComment(rsc/tmp#5, {"body":"testing. rot13 is the best."})`,
 		`EditIssue(rsc/tmp#5, {"title":"another new issue","labels":["ebg13"]})`,
+		`EditIssue(rsc/tmp#5, {"assignees":["rsc"]})`,
 	}
 	if !slices.Equal(edits, want) {
 		t.Fatalf("Testing().Edits():\nhave %s\nwant %s", edits, want)
@@ -0,0 +1,215 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// An orgSync is per-GitHub organization sync state stored in the database.
+type orgSync struct {
+	Name    string    // organization name ("golang")
+	Pattern string    // regexp matching repo names to track; empty matches all
+	Listed  time.Time // time of last successful repository list fetch
+}
+
+// orgInterval is how often [Client.Sync] fetches
+// an organization's repository list.
+// New repositories are rare, so there is no need
+// to spend API requests listing them on every Sync.
+const orgInterval = 1 * time.Hour
+
+// store stores org into db.
+func (org *orgSync) store(db storage.DB) {
+	db.Set(o("githubdl.OrgSync", org.Name), storage.JSON(org))
+}
+
+// AddOrg adds a GitHub organization (for example "golang") to the database.
+// [Client.Sync] lists the organization's repositories (at most once an hour)
+// and adds any new ones (as if by [Client.Add]), so that the set of
+// projects being synced follows the repositories in the organization.
+//
+// If pattern is non-empty, it is a regular expression,
+// and only repositories with names (not including the organization)
+// matching the pattern are added. For example, AddOrg("golang", `^(go|tools)$`)
+// tracks only golang/go and golang/tools.
+// Forks are never added.
+//
+// Repositories that are archived are not added,
+// and projects that become archived are no longer synced,
+// although their data remains in the database.
+// A project that is later unarchived resumes syncing.
+//
+// AddOrg only adds the organization sync metadata.
+// The repository list is not fetched until [Client.Sync] is called.
+// AddOrg returns an error if the organization has already been added
+// or the pattern is not a valid regular expression.
+func (c *Client) AddOrg(org, pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("githubdl.AddOrg: %v", err)
+	}
+	key := o("githubdl.OrgSync", org)
+	if _, ok := c.db.Get(key); ok {
+		return fmt.Errorf("githubdl.AddOrg: already added: %q", org)
+	}
+	(&orgSync{Name: org, Pattern: pattern}).store(c.db)
+	return nil
+}
+
+// SetOrg is like [Client.AddOrg] but, if the organization
+// has already been added, replaces its pattern instead of
+// returning an error, so that a configuration listing the
+// organizations can be applied each time Gaby starts.
+// Narrowing the pattern does not remove projects already added.
+// Changing the pattern makes the next [Client.Sync]
+// fetch the repository list again.
+func (c *Client) SetOrg(org, pattern string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("githubdl.SetOrg: %v", err)
+	}
+	if old, ok := c.loadOrg(org); ok && old.Pattern == pattern {
+		return nil
+	}
+	(&orgSync{Name: org, Pattern: pattern}).store(c.db)
+	return nil
+}
+
+// RemoveOrg removes a GitHub organization added by [Client.AddOrg]
+// or [Client.SetOrg], so that [Client.Sync] no longer lists
+// its repositories. Like narrowing the pattern, removing the
+// organization does not remove projects already added.
+// RemoveOrg does nothing if the organization has not been added.
+func (c *Client) RemoveOrg(org string) {
+	c.db.Delete(o("githubdl.OrgSync", org))
+}
+
+// Orgs returns the names of the organizations that have been added,
+// in sorted order.
+func (c *Client) Orgs() []string {
+	var orgs []string
+	for key := range c.db.Scan(o("githubdl.OrgSync"), o("githubdl.OrgSync", ordered.Inf)) {
+		var org string
+		if err := ordered.Decode(key, nil, &org); err != nil {
+			// unreachable unless corrupt storage
+			c.db.Panic("github org key decode", "key", storage.Fmt(key), "err", err)
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs
+}
+
+// loadOrg returns the sync state for the organization, if it has been added.
+func (c *Client) loadOrg(name string) (*orgSync, bool) {
+	val, ok := c.db.Get(o("githubdl.OrgSync", name))
+	if !ok {
+		return nil, false
+	}
+	var org orgSync
+	if err := json.Unmarshal(val, &org); err != nil {
+		// unreachable unless corrupt storage
+		c.db.Panic("github org decode", "val", storage.Fmt(val), "err", err)
+	}
+	return &org, true
+}
+
+// syncOrgs updates the project list for all organizations
+// whose repository lists have not been fetched in the last [orgInterval].
+func (c *Client) syncOrgs(ctx context.Context) error {
+	var errs []error
+	for _, val := range c.db.Scan(o("githubdl.OrgSync"), o("githubdl.OrgSync", ordered.Inf)) {
+		var org orgSync
+		if err := json.Unmarshal(val(), &org); err != nil {
+			c.db.Panic("github org decode", "val", storage.Fmt(val()), "err", err)
+		}
+		if c.now().Sub(org.Listed) < orgInterval {
+			continue
+		}
+		if err := c.syncOrg(ctx, &org); err != nil {
+			errs = append(errs, fmt.Errorf("syncOrg(%q): %w", org.Name, err))
+			continue
+		}
+		org.Listed = c.now()
+		org.store(c.db)
+	}
+	return errors.Join(errs...)
+}
+
+// syncOrg updates the project list for a single organization.
+func (c *Client) syncOrg(ctx context.Context, org *orgSync) error {
+	c.slog.Debug("githubdl.syncOrg", "org", org.Name)
+	re, err := regexp.Compile(org.Pattern)
+	if err != nil {
+		// unreachable unless corrupt storage; checked in AddOrg
+		return err
+	}
+
+	values := url.Values{
+		"type":     {"public"},
+		"per_page": {"100"},
+	}
+	urlStr := "https://api.github.com/orgs/" + url.PathEscape(org.Name) + "/repos?" + values.Encode()
+	for pg, err := range c.pages(ctx, urlStr, validator{}) {
+		if err != nil {
+			return err
+		}
+		for _, raw := range pg.body {
+			var repo struct {
+				Name     string `json:"name"`
+				FullName string `json:"full_name"`
+				Archived bool   `json:"archived"`
+				Fork     bool   `json:"fork"`
+			}
+			if err := json.Unmarshal(raw, &repo); err != nil {
+				return fmt.Errorf("parsing JSON: %v", err)
+			}
+			if repo.FullName == "" {
+				return fmt.Errorf("parsing message: no full_name: %s", string(raw))
+			}
+			if repo.Fork || !re.MatchString(repo.Name) {
+				continue
+			}
+			c.setArchived(repo.FullName, repo.Archived)
+		}
+	}
+	return nil
+}
+
+// setArchived records whether the project is archived,
+// adding the project to the database if it is not already present
+// and not archived.
+func (c *Client) setArchived(project string, archived bool) {
+	key := o("githubdl.ProjectSync", project)
+	skey := string(key)
+	c.db.Lock(skey)
+	defer c.db.Unlock(skey)
+
+	var proj projectSync
+	val, ok := c.db.Get(key)
+	if !ok {
+		if archived {
+			return
+		}
+		c.slog.Info("githubdl.syncOrg add", "project", project)
+		(&projectSync{Name: project}).store(c.db)
+		return
+	}
+	if err := json.Unmarshal(val, &proj); err != nil {
+		c.db.Panic("github project decode", "key", storage.Fmt(key), "err", err)
+	}
+	if proj.Archived != archived {
+		c.slog.Info("githubdl.syncOrg archived", "project", project, "archived", archived)
+		proj.Archived = archived
+		proj.store(c.db)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// pruneVersion is the current version of the pruning rules in pruneValue.
+// A pruned event is stored as [Raw(JSON), pruneVersion] instead of [Raw(JSON)],
+// so that [Client.PruneEvents] can skip events that have already been pruned.
+// Changing the pruning rules requires incrementing pruneVersion,
+// so that previously pruned events are reconsidered.
+const pruneVersion = 1
+
+// PruneEvents rewrites the stored JSON for events in the given project
+// that were created before cutoff, dropping fields that are rarely needed
+// and make up most of the size of the raw JSON served by GitHub:
+// API URLs other than url, html_url, and issue_url; node IDs;
+// gravatar IDs; reaction counts; and GitHub App metadata.
+// All the fields used by the [Issue], [IssueComment], and [IssueEvent]
+// types are kept.
+//
+// Pruning does not change the DBTime of the rewritten events,
+// so pruned events do not appear new to [Client.EventWatcher]
+// or [Client.EventsAfter].
+//
+// Pruning scans all the events in the project, so it is meant to
+// be run occasionally (for example, daily, with a cutoff a few months ago),
+// not after every sync. It returns the number of events rewritten.
+func (c *Client) PruneEvents(project string, cutoff time.Time) int {
+	limit := cutoff.UTC().Format(time.RFC3339)
+	n := 0
+	b := c.db.Batch()
+	for t := range timed.Scan(c.db, "githubdl.Event", o(project), o(project, ordered.Inf)) {
+		js, version := c.decodeEventVal(t)
+		if version >= pruneVersion {
+			continue
+		}
+		e := c.decodeEvent(t)
+		if created := e.CreatedAt(); created == "" || created >= limit {
+			continue
+		}
+		pruned, err := pruneJSON(js)
+		if err != nil {
+			// unreachable unless corrupt storage
+			c.db.Panic("github prune", "key", storage.Fmt(t.Key), "err", err)
+		}
+		timed.Rewrite(c.db, b, "githubdl.Event", t.Key, c.eventVal(o(ordered.Raw(pruned), int64(pruneVersion))))
+		b.MaybeApply()
+		n++
+	}
+	b.Apply()
+	c.slog.Info("github prune", "project", project, "cutoff", limit, "events", n)
+	return n
+}
+
+// decodeEventVal decodes the stored value of the event entry t,
+// which may be compressed, returning the raw JSON and the
+// prune version (0 if unpruned).
+// It calls c.db.Panic for malformed data.
+func (c *Client) decodeEventVal(t *timed.Entry) (js ordered.Raw, version int64) {
+	val, err := storage.Decompress(t.Val)
+	if err != nil {
+		// unreachable unless corrupt storage
+		c.db.Panic("github event val decompress", "key", storage.Fmt(t.Key), "err", err)
+	}
+	rest, err := ordered.DecodePrefix(val, &js)
+	if err == nil && len(rest) > 0 {
+		err = ordered.Decode(rest, &version)
+	}
+	if err != nil {
+		c.db.Panic("github event val decode", "key", storage.Fmt(t.Key), "val", storage.Fmt(t.Val), "err", err)
+	}
+	return js, version
+}
+
+// pruneJSON returns a copy of the JSON object js
+// with rarely needed fields removed (see [Client.PruneEvents]).
+func pruneJSON(js []byte) ([]byte, error) {
+	// Use json.Number to preserve large IDs exactly.
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var x any
+	if err := dec.Decode(&x); err != nil {
+		return nil, err
+	}
+	return json.Marshal(pruneValue(x))
+}
+
+// pruneValue removes rarely needed fields from x,
+// which is the result of decoding JSON into an any.
+func pruneValue(x any) any {
+	switch x := x.(type) {
+	case map[string]any:
+		for k, v := range x {
+			switch {
+			case k == "node_id", k == "gravatar_id", k == "reactions", k == "performed_via_github_app",
+				strings.HasSuffix(k, "_url") && k != "html_url" && k != "issue_url":
+				delete(x, k)
+			default:
+				x[k] = pruneValue(v)
+			}
+		}
+	case []any:
+		for i, v := range x {
+			x[i] = pruneValue(v)
+		}
+	}
+	return x
+}
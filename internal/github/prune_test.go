@@ -0,0 +1,136 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
+)
+
+var pruneIssueJSON = `{
+	"url": "https://api.github.com/repos/rsc/tmp/issues/1",
+	"repository_url": "https://api.github.com/repos/rsc/tmp",
+	"html_url": "https://github.com/rsc/tmp/issues/1",
+	"id": 53770233,
+	"node_id": "MDU6SXNzdWU1Mzc3MDIzMw==",
+	"number": 1,
+	"title": "old issue",
+	"user": {"login": "rsc", "id": 104030, "avatar_url": "https://avatars.githubusercontent.com/u/104030?v=4", "gravatar_id": ""},
+	"labels": [{"id": 12345678901, "name": "bug", "url": "https://api.github.com/repos/rsc/tmp/labels/bug"}],
+	"state": "closed",
+	"created_at": "2015-01-07T23:11:46Z",
+	"updated_at": "2015-01-07T23:11:46Z",
+	"reactions": {"url": "https://api.github.com/repos/rsc/tmp/issues/1/reactions", "total_count": 0},
+	"body": "body"
+}`
+
+var pruneCommentJSON = `{
+	"url": "https://api.github.com/repos/rsc/tmp/issues/comments/2",
+	"html_url": "https://github.com/rsc/tmp/issues/1#issuecomment-2",
+	"issue_url": "https://api.github.com/repos/rsc/tmp/issues/1",
+	"node_id": "xyz",
+	"user": {"login": "gopherbot"},
+	"created_at": "2024-06-01T00:00:00Z",
+	"updated_at": "2024-06-01T00:00:00Z",
+	"body": "new comment",
+	"performed_via_github_app": null
+}`
+
+func TestPruneEvents(t *testing.T) {
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, nil, nil)
+	b := db.Batch()
+	c.writeEvent(b, "rsc/tmp", 1, "/issues", 53770233, []byte(pruneIssueJSON))
+	c.writeEvent(b, "rsc/tmp", 1, "/issues/comments", 2, []byte(pruneCommentJSON))
+	b.Apply()
+
+	before := c.Timeline("rsc/tmp", 1)
+	w := c.EventWatcher("prunetest")
+	for e := range w.Recent() {
+		w.MarkOld(e.DBTime)
+	}
+
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if n := c.PruneEvents("rsc/tmp", cutoff); n != 1 {
+		t.Errorf("PruneEvents = %d, want 1", n)
+	}
+	if n := c.PruneEvents("rsc/tmp", cutoff); n != 0 {
+		t.Errorf("PruneEvents again = %d, want 0", n)
+	}
+
+	after := c.Timeline("rsc/tmp", 1)
+	if len(after) != 2 || len(before) != 2 {
+		t.Fatalf("Timeline before, after = %d, %d events, want 2, 2", len(before), len(after))
+	}
+	if after[0].DBTime != before[0].DBTime {
+		t.Errorf("pruned DBTime = %d, want %d", after[0].DBTime, before[0].DBTime)
+	}
+	want := `{"body":"body","created_at":"2015-01-07T23:11:46Z","html_url":"https://github.com/rsc/tmp/issues/1","id":53770233,"labels":[{"id":12345678901,"name":"bug","url":"https://api.github.com/repos/rsc/tmp/labels/bug"}],"number":1,"state":"closed","title":"old issue","updated_at":"2015-01-07T23:11:46Z","url":"https://api.github.com/repos/rsc/tmp/issues/1","user":{"id":104030,"login":"rsc"}}`
+	if string(after[0].JSON) != want {
+		t.Errorf("pruned JSON:\nhave %s\nwant %s", after[0].JSON, want)
+	}
+	if issue := after[0].Typed.(*Issue); issue.Title != "old issue" || issue.Labels[0].Name != "bug" || issue.User.Login != "rsc" {
+		t.Errorf("pruned issue = %+v", issue)
+	}
+	if string(after[1].JSON) != pruneCommentJSON {
+		t.Errorf("recent comment was pruned: %s", after[1].JSON)
+	}
+
+	for e := range w.Recent() {
+		t.Errorf("pruned event appears new: %v", e)
+	}
+	if issues := collectIssues(c.SearchIssues("rsc/tmp", &IssueFilter{Labels: []string{"bug"}})); len(issues) != 1 {
+		t.Errorf("SearchIssues after prune = %v, want 1 issue", issues)
+	}
+}
+
+func TestCompressEvents(t *testing.T) {
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, nil, nil)
+	c.EnableCompression()
+
+	// A large issue body is compressed; a small comment is not.
+	issueJSON := strings.Replace(pruneIssueJSON, `"body": "body"`, `"body": "`+strings.Repeat("body ", 1000)+`"`, 1)
+	b := db.Batch()
+	c.writeEvent(b, "rsc/tmp", 1, "/issues", 53770233, []byte(issueJSON))
+	c.writeEvent(b, "rsc/tmp", 1, "/issues/comments", 2, []byte(pruneCommentJSON))
+	b.Apply()
+
+	for t1 := range timed.Scan(db, "githubdl.Event", o("rsc/tmp"), o("rsc/tmp", ordered.Inf)) {
+		var api string
+		if err := ordered.Decode(t1.Key, nil, nil, &api, nil); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := storage.IsCompressed(t1.Val), api == "/issues"; have != want {
+			t.Errorf("%s event compressed = %v, want %v", api, have, want)
+		}
+	}
+
+	// Reading is transparent.
+	events := c.Timeline("rsc/tmp", 1)
+	if len(events) != 2 || string(events[0].JSON) != issueJSON || string(events[1].JSON) != pruneCommentJSON {
+		t.Fatalf("Timeline after compressed writes = %v", events)
+	}
+	if issue, err := c.LookupIssue("rsc/tmp", 1); err != nil || issue.Title != "old issue" {
+		t.Errorf("LookupIssue = %+v, %v", issue, err)
+	}
+	if issues := collectIssues(c.SearchIssues("rsc/tmp", &IssueFilter{Labels: []string{"bug"}})); len(issues) != 1 {
+		t.Errorf("SearchIssues = %v, want 1 issue", issues)
+	}
+
+	// Pruning works on compressed events.
+	if n := c.PruneEvents("rsc/tmp", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); n != 1 {
+		t.Errorf("PruneEvents = %d, want 1", n)
+	}
+	if issue, err := c.LookupIssue("rsc/tmp", 1); err != nil || issue.Body != strings.Repeat("body ", 1000) {
+		t.Errorf("LookupIssue after prune = %+v, %v", issue, err)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"encoding/json"
+	"iter"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// The issue indexes are secondary indexes over the "/issues" events,
+// maintained by writeEvent. See the key schema comment in sync.go.
+//
+// An index entry is only a hint that an issue may match:
+// if the same issue is written twice in a single batch,
+// the second write cannot see the first write's index entries
+// to delete them, leaving a stale entry behind.
+// SearchIssues therefore always rechecks the actual issue
+// against the full filter before returning it.
+
+// issueIndexVersion is the current version of the issue indexes.
+// If the indexes change in an incompatible way, incrementing
+// issueIndexVersion causes the next SyncProject to rebuild them.
+const issueIndexVersion = 2
+
+// An IssueFilter describes a set of issues to return from [Client.SearchIssues].
+// The zero IssueFilter matches all issues, including pull requests.
+// Each non-zero field further restricts the set of matching issues.
+type IssueFilter struct {
+	State         string    // "open" or "closed"
+	Labels        []string  // issue must have all these labels
+	Author        string    // login of issue author
+	CreatedAfter  time.Time // issue created at or after this time
+	CreatedBefore time.Time // issue created before this time
+	UpdatedAfter  time.Time // issue updated at or after this time
+	UpdatedBefore time.Time // issue updated before this time
+	TitleContains string    // title contains this text (case-insensitive)
+	NoPullRequest bool      // exclude pull requests
+}
+
+// Match reports whether the issue matches the filter.
+func (f *IssueFilter) Match(issue *Issue) bool {
+	if f.State != "" && issue.State != f.State {
+		return false
+	}
+	for _, name := range f.Labels {
+		if !slices.ContainsFunc(issue.Labels, func(l Label) bool { return l.Name == name }) {
+			return false
+		}
+	}
+	if f.Author != "" && issue.User.Login != f.Author {
+		return false
+	}
+	if !inTimeRange(issue.CreatedAt, f.CreatedAfter, f.CreatedBefore) ||
+		!inTimeRange(issue.UpdatedAt, f.UpdatedAfter, f.UpdatedBefore) {
+		return false
+	}
+	if f.TitleContains != "" && !strings.Contains(strings.ToLower(issue.Title), strings.ToLower(f.TitleContains)) {
+		return false
+	}
+	if f.NoPullRequest && issue.PullRequest != nil {
+		return false
+	}
+	return true
+}
+
+// inTimeRange reports whether the RFC3339 time ts is in the range [after, before).
+// A zero after or before means there is no limit on that side.
+// A malformed ts is only in range if there are no limits.
+func inTimeRange(ts string, after, before time.Time) bool {
+	if after.IsZero() && before.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return false
+	}
+	return (after.IsZero() || !t.Before(after)) && (before.IsZero() || t.Before(before))
+}
+
+// SearchIssues returns an iterator over the issues in the given project
+// that match the filter, in increasing issue number order.
+// Only the database is consulted, not actual GitHub.
+//
+// SearchIssues uses the issue indexes to find candidate issues,
+// choosing the most selective index for the filter,
+// so that a typical search does not need to scan all the events in the project.
+func (c *Client) SearchIssues(project string, f *IssueFilter) iter.Seq[*Issue] {
+	return func(yield func(*Issue) bool) {
+		for _, n := range c.searchCandidates(project, f) {
+			issue, ok := c.lookupIssue(project, n)
+			if !ok || !f.Match(issue) {
+				continue
+			}
+			if !yield(issue) {
+				return
+			}
+		}
+	}
+}
+
+// searchCandidates returns a sorted list of issue numbers that may
+// match the filter, using a single index chosen by selectivity.
+func (c *Client) searchCandidates(project string, f *IssueFilter) []int64 {
+	var start, end []byte
+	switch {
+	case f.Author != "":
+		start = o("githubdl.IssueByAuthor", project, f.Author)
+		end = o("githubdl.IssueByAuthor", project, f.Author, ordered.Inf)
+	case len(f.Labels) > 0:
+		start = o("githubdl.IssueByLabel", project, f.Labels[0])
+		end = o("githubdl.IssueByLabel", project, f.Labels[0], ordered.Inf)
+	case !f.CreatedAfter.IsZero() || !f.CreatedBefore.IsZero():
+		start = o("githubdl.IssueByCreated", project)
+		end = o("githubdl.IssueByCreated", project, ordered.Inf)
+		if !f.CreatedAfter.IsZero() {
+			start = o("githubdl.IssueByCreated", project, f.CreatedAfter.UTC().Format(time.RFC3339))
+		}
+		if !f.CreatedBefore.IsZero() {
+			end = o("githubdl.IssueByCreated", project, f.CreatedBefore.UTC().Format(time.RFC3339), ordered.Inf)
+		}
+	case f.State != "":
+		start = o("githubdl.IssueByState", project, f.State)
+		end = o("githubdl.IssueByState", project, f.State, ordered.Inf)
+	default:
+		start = o("githubdl.IssueByState", project)
+		end = o("githubdl.IssueByState", project, ordered.Inf)
+	}
+
+	var list []int64
+	for key := range c.db.Scan(start, end) {
+		// The issue number is always the last element of an index key.
+		var kind, proj, attr string
+		var n int64
+		if err := ordered.Decode(key, &kind, &proj, &attr, &n); err != nil {
+			c.db.Panic("github search decode", "key", storage.Fmt(key), "err", err)
+		}
+		list = append(list, n)
+	}
+	slices.Sort(list)
+	return slices.Compact(list)
+}
+
+// lookupIssue returns the issue with the given number in the database.
+func (c *Client) lookupIssue(project string, n int64) (*Issue, bool) {
+	for e := range timed.Scan(c.db, "githubdl.Event", o(project, n, "/issues"), o(project, n, "/issues", ordered.Inf)) {
+		return c.decodeEvent(e).Typed.(*Issue), true
+	}
+	return nil, false
+}
+
+// issueIndexKeys returns the index keys for the issue.
+func issueIndexKeys(project string, issue *Issue) [][]byte {
+	n := issue.Number
+	keys := [][]byte{
+		o("githubdl.IssueByState", project, issue.State, n),
+		o("githubdl.IssueByAuthor", project, issue.User.Login, n),
+		o("githubdl.IssueByCreated", project, issue.CreatedAt, n),
+	}
+	for _, l := range issue.Labels {
+		keys = append(keys, o("githubdl.IssueByLabel", project, l.Name, n))
+	}
+	return keys
+}
+
+// indexIssue adds to b the database updates to index the issue,
+// first deleting the index entries for the issue's previous state,
+// if the previous state is stored in the database at key
+// (the "/issues" event key, minus the "githubdl.Event" prefix).
+func (c *Client) indexIssue(b storage.Batch, project string, key []byte, raw json.RawMessage) {
+	if old, ok := timed.Get(c.db, "githubdl.Event", key); ok {
+		var issue Issue
+		if js, _ := c.decodeEventVal(old); json.Unmarshal(js, &issue) == nil {
+			for _, k := range issueIndexKeys(project, &issue) {
+				b.Delete(k)
+			}
+		}
+	}
+	var issue Issue
+	if err := json.Unmarshal(raw, &issue); err != nil {
+		// Unreachable: syncByDate has already parsed raw.
+		c.slog.Error("github index issue", "project", project, "err", err)
+		return
+	}
+	for _, k := range issueIndexKeys(project, &issue) {
+		b.Set(k, nil)
+	}
+}
+
+// reindexIssues rebuilds the issue and comment indexes for the project
+// from the "/issues" and "/issues/comments" events stored in the database.
+func (c *Client) reindexIssues(project string) {
+	for _, kind := range []string{"githubdl.IssueByState", "githubdl.IssueByAuthor", "githubdl.IssueByCreated", "githubdl.IssueByLabel", "githubdl.CommentByID"} {
+		c.db.DeleteRange(o(kind, project), o(kind, project, ordered.Inf))
+	}
+	b := c.db.Batch()
+	for e := range c.Events(project, -1, -1) {
+		switch e.API {
+		case "/issues":
+			for _, k := range issueIndexKeys(project, e.Typed.(*Issue)) {
+				b.Set(k, nil)
+			}
+		case "/issues/comments":
+			b.Set(o("githubdl.CommentByID", project, e.ID, e.Issue), nil)
+		}
+		b.MaybeApply()
+	}
+	b.Apply()
+}
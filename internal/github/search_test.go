@@ -0,0 +1,92 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"iter"
+	"slices"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestSearchIssues(t *testing.T) {
+	check := testutil.Checker(t)
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, nil, nil)
+	check(c.Testing().LoadTxtar("../testdata/rsctmp.txt"))
+	check(c.Testing().LoadTxtar("../testdata/markdown.txt"))
+
+	search := func(project string, f *IssueFilter) []int64 {
+		return collectIssues(c.SearchIssues(project, f))
+	}
+	date := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse(time.DateOnly, s)
+		check(err)
+		return tm
+	}
+
+	var tests = []struct {
+		project string
+		filter  IssueFilter
+		want    []int64
+	}{
+		{"rsc/markdown", IssueFilter{State: "open"}, []int64{13, 19}},
+		{"rsc/markdown", IssueFilter{Author: "jba"}, []int64{10, 11, 12}},
+		{"rsc/markdown", IssueFilter{Author: "jba", TitleContains: "MARKDOWN RENDERING"}, []int64{10}},
+		{"rsc/markdown", IssueFilter{TitleContains: "reference links"}, []int64{13, 14, 15}},
+		{"rsc/markdown", IssueFilter{CreatedAfter: date("2024-03-15"), CreatedBefore: date("2024-05-03")}, []int64{16, 17, 18}},
+		{"rsc/markdown", IssueFilter{UpdatedAfter: date("2024-05-03")}, []int64{19}},
+		{"rsc/tmp", IssueFilter{Labels: []string{"dependencies"}}, []int64{10, 11, 12, 13, 14, 15}},
+		{"rsc/tmp", IssueFilter{Labels: []string{"dependencies", "none"}}, nil},
+		{"rsc/tmp", IssueFilter{Labels: []string{"abc.def foo"}, State: "open"}, []int64{5}},
+		{"rsc/tmp", IssueFilter{Author: "nobody"}, nil},
+		{"rsc/tmp", IssueFilter{Author: "rsc", State: "closed"}, []int64{1, 2, 4}},
+		{"fauxlang/faux", IssueFilter{}, nil},
+	}
+	for _, tt := range tests {
+		if have := search(tt.project, &tt.filter); !slices.Equal(have, tt.want) {
+			t.Errorf("SearchIssues(%q, %+v) = %v, want %v", tt.project, tt.filter, have, tt.want)
+		}
+	}
+
+	if have := search("rsc/markdown", &IssueFilter{}); len(have) != 19 {
+		t.Errorf("SearchIssues(rsc/markdown, all) = %v, want 19 issues", have)
+	}
+
+	// Changing an issue must update the indexes.
+	for e := range c.Events("rsc/markdown", 13, 13) {
+		if e.API == "/issues" {
+			issue := e.Typed.(*Issue)
+			issue.State = "closed"
+			b := db.Batch()
+			c.writeEvent(b, e.Project, e.Issue, e.API, e.ID, storage.JSON(issue))
+			b.Apply()
+		}
+	}
+	if have, want := search("rsc/markdown", &IssueFilter{State: "open"}), []int64{19}; !slices.Equal(have, want) {
+		t.Errorf("SearchIssues(open) after close = %v, want %v", have, want)
+	}
+	if have, want := search("rsc/markdown", &IssueFilter{State: "closed", TitleContains: "reference links"}), []int64{13, 14, 15}; !slices.Equal(have, want) {
+		t.Errorf("SearchIssues(closed) after close = %v, want %v", have, want)
+	}
+
+	// Rebuilding the indexes must give the same answers.
+	c.reindexIssues("rsc/tmp")
+	if have, want := search("rsc/tmp", &IssueFilter{Author: "rsc", State: "closed"}), []int64{1, 2, 4}; !slices.Equal(have, want) {
+		t.Errorf("SearchIssues after reindex = %v, want %v", have, want)
+	}
+}
+
+func collectIssues(seq iter.Seq[*Issue]) []int64 {
+	var list []int64
+	for issue := range seq {
+		list = append(list, issue.Number)
+	}
+	return list
+}
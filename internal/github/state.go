@@ -0,0 +1,230 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"encoding/json"
+	"iter"
+	"slices"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// The issue states are a materialized view of the current state
+// of each issue, maintained during [Client.SyncProject]
+// (and by the [TestingClient] as it adds events)
+// so that code asking about an issue's current labels, milestone,
+// or open/closed state need not replay the issue's event stream.
+// See the key schema comment in sync.go.
+
+// An IssueState is the current state of an issue,
+// computed from the issue and the events that follow it.
+type IssueState struct {
+	Project     string
+	Number      int64
+	Title       string
+	State       string   // "open" or "closed"
+	Labels      []string // label names, sorted
+	Milestone   string   // milestone title, or "" for none
+	Assignees   []string // assignee logins, sorted
+	PullRequest bool     // issue is a pull request
+	UpdatedAt   string   // time of the latest change to the issue, comments, or events
+}
+
+// HasLabel reports whether the issue has the named label.
+func (s *IssueState) HasLabel(name string) bool {
+	_, ok := slices.BinarySearch(s.Labels, name)
+	return ok
+}
+
+// IssueState returns the current state of the issue with the given number in project,
+// only consulting the database (not actual GitHub).
+// It returns false if the state has not been recorded,
+// typically because the issue has not been synced.
+func (c *Client) IssueState(project string, n int64) (*IssueState, bool) {
+	val, ok := c.db.Get(o("githubdl.IssueState", project, n))
+	if !ok {
+		return nil, false
+	}
+	return c.decodeIssueState(val), true
+}
+
+// IssueStates returns an iterator over the current states of the issues
+// in project, in increasing issue number order, using the issue state indexes.
+// If state is not empty, only issues in that state ("open" or "closed") are included.
+// If label is not empty, only issues with that label are included.
+// Only the database is consulted, not actual GitHub.
+func (c *Client) IssueStates(project, state, label string) iter.Seq[*IssueState] {
+	return func(yield func(*IssueState) bool) {
+		start, end := o("githubdl.IssueStateByState", project), o("githubdl.IssueStateByState", project, ordered.Inf)
+		switch {
+		case label != "":
+			start, end = o("githubdl.IssueStateByLabel", project, label), o("githubdl.IssueStateByLabel", project, label, ordered.Inf)
+		case state != "":
+			start, end = o("githubdl.IssueStateByState", project, state), o("githubdl.IssueStateByState", project, state, ordered.Inf)
+		}
+		var list []int64
+		for key := range c.db.Scan(start, end) {
+			var n int64
+			if err := ordered.Decode(key, nil, nil, nil, &n); err != nil {
+				// unreachable unless corrupt storage
+				c.db.Panic("github issue state index decode", "key", storage.Fmt(key), "err", err)
+			}
+			list = append(list, n)
+		}
+		slices.Sort(list)
+		for _, n := range list {
+			s, ok := c.IssueState(project, n)
+			if !ok || state != "" && s.State != state || label != "" && !s.HasLabel(label) {
+				continue
+			}
+			if !yield(s) {
+				return
+			}
+		}
+	}
+}
+
+// decodeIssueState decodes the JSON of an IssueState.
+func (c *Client) decodeIssueState(val []byte) *IssueState {
+	var s IssueState
+	if err := json.Unmarshal(val, &s); err != nil {
+		// unreachable unless corrupt storage
+		c.db.Panic("github issue state decode", "val", storage.Fmt(val), "err", err)
+	}
+	return &s
+}
+
+// updateIssueStates updates the issue states in proj.Name
+// for the issues with events added since proj.StateDBTime,
+// and then advances proj.StateDBTime.
+func (c *Client) updateIssueStates(proj *projectSync) {
+	var issues []int64
+	last := proj.StateDBTime
+	for e := range c.EventsAfter(proj.StateDBTime, proj.Name) {
+		issues = append(issues, e.Issue)
+		last = e.DBTime
+	}
+	if len(issues) == 0 {
+		return
+	}
+	slices.Sort(issues)
+	b := c.db.Batch()
+	for _, n := range slices.Compact(issues) {
+		c.updateIssueState(b, proj.Name, n)
+		b.MaybeApply()
+	}
+	b.Apply()
+	proj.StateDBTime = last
+	proj.store(c.db)
+}
+
+// updateIssueState adds to b the database updates to recompute
+// the state of the issue, along with its index entries.
+// Each issue must be updated at most once per batch,
+// since the deletion of the old index entries
+// depends on the state stored in the database.
+func (c *Client) updateIssueState(b storage.Batch, project string, n int64) {
+	s := c.computeIssueState(project, n)
+	if s == nil {
+		return
+	}
+	if val, ok := c.db.Get(o("githubdl.IssueState", project, n)); ok {
+		for _, k := range issueStateKeys(c.decodeIssueState(val)) {
+			b.Delete(k)
+		}
+	}
+	b.Set(o("githubdl.IssueState", project, n), storage.JSON(s))
+	for _, k := range issueStateKeys(s) {
+		b.Set(k, nil)
+	}
+}
+
+// issueStateKeys returns the index keys for the issue state.
+func issueStateKeys(s *IssueState) [][]byte {
+	keys := [][]byte{o("githubdl.IssueStateByState", s.Project, s.State, s.Number)}
+	for _, l := range s.Labels {
+		keys = append(keys, o("githubdl.IssueStateByLabel", s.Project, l, s.Number))
+	}
+	return keys
+}
+
+// computeIssueState computes the current state of the issue
+// by starting with the stored issue and applying the events
+// that GitHub reported after the issue was last updated.
+// It returns nil if the issue is not in the database.
+func (c *Client) computeIssueState(project string, n int64) *IssueState {
+	issue, ok := c.lookupIssue(project, n)
+	if !ok {
+		return nil
+	}
+	s := &IssueState{
+		Project:     project,
+		Number:      n,
+		Title:       issue.Title,
+		State:       issue.State,
+		Milestone:   issue.Milestone.Title,
+		PullRequest: issue.PullRequest != nil,
+		UpdatedAt:   issue.UpdatedAt,
+	}
+	labels := make(map[string]bool)
+	for _, l := range issue.Labels {
+		labels[l.Name] = true
+	}
+	assignees := make(map[string]bool)
+	for _, u := range issue.Assignees {
+		assignees[u.Login] = true
+	}
+
+	for _, e := range c.Timeline(project, n) {
+		t := e.CreatedAt()
+		if t <= issue.UpdatedAt {
+			continue
+		}
+		s.UpdatedAt = max(s.UpdatedAt, t)
+		x, ok := e.Typed.(*IssueEvent)
+		if !ok {
+			continue
+		}
+		switch x.Event {
+		case "closed":
+			s.State = "closed"
+		case "reopened":
+			s.State = "open"
+		case "renamed":
+			s.Title = x.Rename.To
+		case "milestoned":
+			s.Milestone = x.Milestone.Title
+		case "demilestoned":
+			if s.Milestone == x.Milestone.Title {
+				s.Milestone = ""
+			}
+		case "labeled", "unlabeled":
+			for _, l := range x.Labels {
+				labels[l.Name] = x.Event == "labeled"
+			}
+		case "assigned", "unassigned":
+			for _, u := range x.Assignees {
+				assignees[u.Login] = x.Event == "assigned"
+			}
+		}
+	}
+	s.Labels = setKeys(labels)
+	s.Assignees = setKeys(assignees)
+	return s
+}
+
+// setKeys returns the sorted keys of the map whose values are true.
+func setKeys(m map[string]bool) []string {
+	var list []string
+	for k, v := range m {
+		if v {
+			list = append(list, k)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
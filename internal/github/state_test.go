@@ -0,0 +1,165 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestIssueStateTxtar(t *testing.T) {
+	check := testutil.Checker(t)
+	c := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	check(c.Testing().LoadTxtar("../testdata/rsctmp.txt"))
+
+	// The txtar header records the final state,
+	// which replaying the events must reproduce.
+	have, ok := c.IssueState("rsc/tmp", 1)
+	if !ok {
+		t.Fatalf("IssueState(rsc/tmp, 1) missing")
+	}
+	want := &IssueState{
+		Project:   "rsc/tmp",
+		Number:    1,
+		Title:     "Dummy issue with dummy title",
+		State:     "closed",
+		Labels:    []string{"none"},
+		Milestone: "Granite",
+		UpdatedAt: "2024-06-17T14:56:22Z",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("IssueState(rsc/tmp, 1) = %+v, want %+v", have, want)
+	}
+
+	if _, ok := c.IssueState("rsc/tmp", 1000); ok {
+		t.Errorf("IssueState(rsc/tmp, 1000) succeeded, want missing")
+	}
+}
+
+func TestIssueStateEvents(t *testing.T) {
+	c := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	tc := c.Testing()
+	tc.AddIssue("rsc/tmp", &Issue{
+		Number:    1,
+		Title:     "old title",
+		State:     "open",
+		UpdatedAt: "2024-01-01T00:00:00Z",
+		Labels:    []Label{{Name: "bug"}, {Name: "NeedsInfo"}},
+		Milestone: Milestone{Title: "Go1.22"},
+		Assignees: []User{{Login: "rsc"}},
+	})
+	tc.AddIssue("rsc/tmp", &Issue{Number: 2, State: "open", UpdatedAt: "2024-01-01T00:00:00Z"})
+
+	// Events at or before the issue's UpdatedAt are already reflected in the issue.
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "unlabeled", CreatedAt: "2024-01-01T00:00:00Z", Labels: []Label{{Name: "bug"}}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "unlabeled", CreatedAt: "2024-02-01T00:00:00Z", Labels: []Label{{Name: "NeedsInfo"}}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "labeled", CreatedAt: "2024-02-02T00:00:00Z", Labels: []Label{{Name: "WaitingForInfo"}}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "milestoned", CreatedAt: "2024-02-03T00:00:00Z", Milestone: Milestone{Title: "Go1.23"}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "demilestoned", CreatedAt: "2024-02-03T00:00:00Z", Milestone: Milestone{Title: "Go1.22"}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "renamed", CreatedAt: "2024-02-04T00:00:00Z", Rename: Rename{From: "old title", To: "new title"}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "assigned", CreatedAt: "2024-02-05T00:00:00Z", Assignees: []User{{Login: "gopher"}}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "unassigned", CreatedAt: "2024-02-05T00:00:00Z", Assignees: []User{{Login: "rsc"}}})
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "closed", CreatedAt: "2024-02-06T00:00:00Z"})
+	tc.AddIssueComment("rsc/tmp", 1, &IssueComment{CreatedAt: "2024-02-07T00:00:00Z"})
+
+	have, _ := c.IssueState("rsc/tmp", 1)
+	want := &IssueState{
+		Project:   "rsc/tmp",
+		Number:    1,
+		Title:     "new title",
+		State:     "closed",
+		Labels:    []string{"WaitingForInfo", "bug"},
+		Milestone: "Go1.23",
+		Assignees: []string{"gopher"},
+		UpdatedAt: "2024-02-07T00:00:00Z",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("IssueState(rsc/tmp, 1) = %+v, want %+v", have, want)
+	}
+
+	states := func(state, label string) []int64 {
+		var list []int64
+		for s := range c.IssueStates("rsc/tmp", state, label) {
+			list = append(list, s.Number)
+		}
+		return list
+	}
+	checkStates := func(state, label string, want ...int64) {
+		t.Helper()
+		if have := states(state, label); !reflect.DeepEqual(have, want) {
+			t.Errorf("IssueStates(rsc/tmp, %q, %q) = %v, want %v", state, label, have, want)
+		}
+	}
+	checkStates("", "", 1, 2)
+	checkStates("open", "", 2)
+	checkStates("closed", "", 1)
+	checkStates("", "NeedsInfo")
+	checkStates("", "WaitingForInfo", 1)
+	checkStates("open", "WaitingForInfo")
+
+	// Reopening must move the issue in the state index.
+	tc.AddIssueEvent("rsc/tmp", 1, &IssueEvent{Event: "reopened", CreatedAt: "2024-03-01T00:00:00Z"})
+	checkStates("open", "", 1, 2)
+	checkStates("closed", "")
+	checkStates("open", "WaitingForInfo", 1)
+}
+
+func TestUpdateIssueStates(t *testing.T) {
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, nil, nil)
+	proj := &projectSync{Name: "rsc/tmp"}
+
+	write := func(issue int64, api string, id int64, x any) {
+		b := db.Batch()
+		c.writeEvent(b, "rsc/tmp", issue, api, id, json.RawMessage(storage.JSON(x)))
+		b.Apply()
+	}
+	labels := func(n int64) []string {
+		s, ok := c.IssueState("rsc/tmp", n)
+		if !ok {
+			return nil
+		}
+		return s.Labels
+	}
+
+	write(1, "/issues", 1, &Issue{Number: 1, State: "open", UpdatedAt: "2024-01-01T00:00:00Z"})
+	write(1, "/issues/events", 10, &IssueEvent{Event: "labeled", CreatedAt: "2024-01-02T00:00:00Z", Labels: []Label{{Name: "bug"}}})
+	write(2, "/issues/events", 11, &IssueEvent{Event: "labeled", CreatedAt: "2024-01-02T00:00:00Z", Labels: []Label{{Name: "bug"}}})
+	if _, ok := c.IssueState("rsc/tmp", 1); ok {
+		t.Fatalf("IssueState before update succeeded")
+	}
+
+	c.updateIssueStates(proj)
+	if have := labels(1); !reflect.DeepEqual(have, []string{"bug"}) {
+		t.Errorf("labels(1) = %v, want [bug]", have)
+	}
+	if _, ok := c.IssueState("rsc/tmp", 2); ok {
+		t.Errorf("IssueState for issue with events but no issue succeeded")
+	}
+	if proj.StateDBTime == 0 {
+		t.Errorf("updateIssueStates did not advance StateDBTime")
+	}
+
+	// A newer issue snapshot replaces the state, and the index follows.
+	write(1, "/issues", 1, &Issue{Number: 1, State: "open", UpdatedAt: "2024-01-03T00:00:00Z", Labels: []Label{{Name: "NeedsFix"}}})
+	c.updateIssueStates(proj)
+	if have := labels(1); !reflect.DeepEqual(have, []string{"NeedsFix"}) {
+		t.Errorf("labels(1) = %v, want [NeedsFix]", have)
+	}
+	for s := range c.IssueStates("rsc/tmp", "", "bug") {
+		t.Errorf("IssueStates(bug) found stale #%d", s.Number)
+	}
+
+	// Updating with no new events changes nothing.
+	last := proj.StateDBTime
+	c.updateIssueStates(proj)
+	if proj.StateDBTime != last {
+		t.Errorf("StateDBTime changed without new events: %v -> %v", last, proj.StateDBTime)
+	}
+}
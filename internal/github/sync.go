@@ -10,9 +10,19 @@ package github
 
 // This package stores the following key schemas in the database:
 //
-//	["githubdl.SyncProject", Project] => JSON of projectSync structure
-//	["githubdl.Event", Project, Issue, Type, API, ID] => [DBTime, Raw(JSON)]
-//	["githubdl.EventByTime", DBTime, Project, Issue, Type, API, ID] => []
+//	["githubdl.ProjectSync", Project] => JSON of projectSync structure
+//	["githubdl.OrgSync", Org] => JSON of orgSync structure
+//	["githubdl.Event", Project, Issue, API, ID] => [DBTime, Raw(JSON), PruneVersion?]
+//	["githubdl.EventByTime", DBTime, Project, Issue, API, ID] => []
+//	["githubdl.EventWatcher", Name] => DBTime
+//	["githubdl.IssueByState", Project, State, Issue] => []
+//	["githubdl.IssueByAuthor", Project, Login, Issue] => []
+//	["githubdl.IssueByCreated", Project, CreatedAt, Issue] => []
+//	["githubdl.IssueByLabel", Project, Label, Issue] => []
+//	["githubdl.CommentByID", Project, ID, Issue] => []
+//	["githubdl.IssueState", Project, Issue] => JSON of IssueState structure
+//	["githubdl.IssueStateByState", Project, State, Issue] => []
+//	["githubdl.IssueStateByLabel", Project, Label, Issue] => []
 //
 // (The dl stands for download.)
 //
@@ -30,13 +40,31 @@ package github
 // The JSON is the raw JSON served from GitHub describing the event.
 // Storing the raw JSON avoids having to re-download everything if we decide
 // another field is of interest to us.
+// Old events can be pruned to drop rarely needed fields (see [Client.PruneEvents]);
+// a pruned event's value has a trailing PruneVersion recording which
+// pruning rules were applied.
+// If compression is enabled (see [Client.EnableCompression]),
+// large event values are stored compressed by [storage.Compress];
+// events are read the same way either way.
 //
 // EventByTime is an index of Events by DBTime, which is the time when the
 // record was added to the database. Code that processes new events can
 // record which DBTime it has most recently processed and then scan forward in
 // the index to learn about new events.
+//
+// The IssueBy* keys are secondary indexes of the "/issues" events,
+// used by [Client.SearchIssues] to find issues without scanning all events.
+// The CommentByID keys index the "/issues/comments" events by comment ID,
+// used by [Client.LookupIssueComment] to find a comment's issue.
+//
+// The IssueState keys hold the current state of each issue,
+// computed from its "/issues" event and the later "/issues/events" events
+// (see [Client.IssueState]), and the IssueStateBy* keys index them.
+// SyncProject updates them for the issues with events newer than
+// the project's StateDBTime.
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -45,21 +73,41 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"rsc.io/gaby/internal/httprr"
 	"rsc.io/gaby/internal/secret"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/gaby/internal/tracing"
 	"rsc.io/ordered"
 )
 
 // o is short for ordered.Encode.
 func o(list ...any) []byte { return ordered.Encode(list...) }
 
+func init() {
+	timed.RegisterSchema("githubdl.Event", "Project, Issue, API, ID", "Raw(JSON), PruneVersion?")
+	storage.RegisterSchema(
+		storage.Schema{Kind: "githubdl.ProjectSync", Key: "Project", Val: "JSON of projectSync structure"},
+		storage.Schema{Kind: "githubdl.OrgSync", Key: "Org", Val: "JSON of orgSync structure"},
+		storage.Schema{Kind: "githubdl.IssueByState", Key: "Project, State, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.IssueByAuthor", Key: "Project, Login, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.IssueByCreated", Key: "Project, CreatedAt, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.IssueByLabel", Key: "Project, Label, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.CommentByID", Key: "Project, ID, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.IssueState", Key: "Project, Issue", Val: "JSON of IssueState structure"},
+		storage.Schema{Kind: "githubdl.IssueStateByState", Key: "Project, State, Issue", Val: "[]"},
+		storage.Schema{Kind: "githubdl.IssueStateByLabel", Key: "Project, Label, Issue", Val: "[]"},
+	)
+}
+
 // Scrub is a scrubber for use with [rsc.io/httprr].
 // It removes auth credentials from the request.
 func Scrub(req *http.Request) error {
@@ -67,18 +115,55 @@ func Scrub(req *http.Request) error {
 	return nil
 }
 
+// emailRE matches an "email" field in a JSON response body.
+var emailRE = regexp.MustCompile(`"email":\s*"[^"]*"`)
+
+// ScrubResponse is a response scrubber for use with [rsc.io/httprr].
+// It removes the headers describing the credentials' OAuth scopes,
+// the rate-limit headers (except in rate-limit responses, which
+// the client interprets), and email addresses in JSON response bodies.
+func ScrubResponse(resp *http.Response) error {
+	resp.Header.Del("X-Oauth-Scopes")
+	resp.Header.Del("X-Accepted-Oauth-Scopes")
+	if resp.StatusCode != 403 {
+		for k := range resp.Header {
+			if strings.HasPrefix(k, "X-Ratelimit-") {
+				resp.Header.Del(k)
+			}
+		}
+	}
+	if b, ok := resp.Body.(*httprr.Body); ok {
+		b.Data = emailRE.ReplaceAll(b.Data, []byte(`"email":""`))
+	}
+	return nil
+}
+
 // A Client is a connection to GitHub state in a database and on GitHub itself.
 type Client struct {
+	*client                 // state shared with clients returned by [Client.As]
+	actor   string          // subsystem making edits, recorded in the audit log
+	ctx     context.Context // context for tracing edits; see [Client.WithContext]
+}
+
+// A client is the state shared by a Client and the clients returned by its As method.
+type client struct {
 	slog   *slog.Logger
 	db     storage.DB
 	secret secret.DB
 	http   *http.Client
 
+	now   func() time.Time    // current time; see SetClock
+	sleep func(time.Duration) // wait for rate limits and retries; see SetClock
+
+	compress bool // compress large event values; see EnableCompression
+
 	testing bool
 
 	testMu     sync.Mutex
 	testEdits  []*TestingEdit
 	testEvents map[string]json.RawMessage
+	testReacts map[string][]*Reaction
+	testFail   map[string]error
 }
 
 // New returns a new client that uses the given logger, databases, and HTTP client.
@@ -88,12 +173,64 @@ type Client struct {
 // ("ghp_...").
 func New(lg *slog.Logger, db storage.DB, sdb secret.DB, hc *http.Client) *Client {
 	return &Client{
-		slog:    lg,
-		db:      db,
-		secret:  sdb,
-		http:    hc,
-		testing: testing.Testing(),
+		client: &client{
+			slog:    lg,
+			db:      db,
+			secret:  sdb,
+			http:    hc,
+			now:     time.Now,
+			sleep:   time.Sleep,
+			testing: testing.Testing(),
+		},
+	}
+}
+
+// SetClock sets the functions the Client uses to find the current time
+// and to wait out rate limits and server failures,
+// in place of [time.Now] and [time.Sleep].
+// It is meant for tests, which can pass the methods of a
+// [rsc.io/gaby/internal/testutil.FakeClock].
+// The clock is shared with the clients returned by [Client.As].
+func (c *Client) SetClock(now func() time.Time, sleep func(time.Duration)) {
+	c.now = now
+	c.sleep = sleep
+}
+
+// EnableCompression enables compression of large event values
+// written to the database (see [storage.Compress]).
+// Compressed and uncompressed values can be mixed in one database,
+// so compression can be enabled or disabled at any time;
+// disabling it leaves existing compressed values compressed.
+func (c *Client) EnableCompression() {
+	c.compress = true
+}
+
+// eventVal returns the database value for an event with the given JSON,
+// compressing it if enabled.
+func (c *Client) eventVal(val []byte) []byte {
+	if c.compress {
+		val = storage.Compress(val)
 	}
+	return val
+}
+
+// As returns a Client that shares c's database, credentials, and state
+// but records its edits in the audit log as made by the named actor,
+// typically the name of the subsystem using the returned Client
+// (see [Client.Audit]).
+func (c *Client) As(actor string) *Client {
+	return &Client{client: c.client, actor: actor, ctx: c.ctx}
+}
+
+// WithContext returns a Client that is like c but traces its edits
+// as part of the span (if any) in ctx, so that a trace of the work
+// causing an edit includes the edit itself.
+// Without WithContext, each edit is traced as its own trace.
+// Canceling ctx cancels the returned Client's downloads
+// (such as [Client.DownloadIssue]), but it does not cancel edits,
+// which must not be left half done.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	return &Client{client: c.client, actor: c.actor, ctx: ctx}
 }
 
 // A projectSync is per-GitHub project ("owner/repo") sync state stored in the database.
@@ -105,8 +242,20 @@ type projectSync struct {
 	CommentDate string
 	RefillID    int64
 
+	// Cache validators for the most recent first page of
+	// the /issues and /issues/comments feeds.
+	// See syncByDate for details.
+	IssueCache   pageCache
+	CommentCache pageCache
+
 	FullSyncActive bool
 	FullSyncIssue  int64
+
+	IssueIndexVersion int // version of issue indexes; see issueIndexVersion
+
+	StateDBTime timed.DBTime // DBTime of latest event reflected in issue states
+
+	Archived bool // project is archived and no longer synced; see [Client.AddOrg]
 }
 
 // store stores proj into db.
@@ -130,14 +279,38 @@ func (c *Client) Add(project string) error {
 }
 
 // Sync syncs all projects.
-func (c *Client) Sync() error {
+// It first updates the project list for any organizations added with [Client.AddOrg]
+// whose repositories have not been listed in the last hour,
+// and it skips projects that have been archived.
+//
+// If ctx is canceled, Sync stops the current project's sync
+// (see [Client.SyncProject]), does not start the next project,
+// and returns an error including ctx.Err().
+func (c *Client) Sync(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "github.Sync")
+	defer func() { tracing.End(span, err) }()
+
 	var errs []error
-	for key, _ := range c.db.Scan(o("githubdl.ProjectSync"), o("githubdl.ProjectSync", ordered.Inf)) {
+	if err := c.syncOrgs(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	for key, val := range c.db.Scan(o("githubdl.ProjectSync"), o("githubdl.ProjectSync", ordered.Inf)) {
 		var project string
 		if err := ordered.Decode(key, new(string), &project); err != nil {
 			c.db.Panic("github client sync decode", "key", storage.Fmt(key), "err", err)
 		}
-		if err := c.SyncProject(project); err != nil {
+		var proj projectSync
+		if err := json.Unmarshal(val(), &proj); err != nil {
+			c.db.Panic("github client sync decode", "key", storage.Fmt(key), "err", err)
+		}
+		if proj.Archived {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := c.SyncProject(ctx, project); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -153,12 +326,18 @@ func (c *Client) Sync() error {
 var testFullSyncStop error
 
 // SyncProject syncs a single project.
-func (c *Client) SyncProject(project string) (err error) {
-	c.slog.Debug("githubdl.SyncProject", "project", project)
+// If ctx is canceled, SyncProject stops at its next GitHub request
+// (interrupting any wait for a rate limit to reset)
+// or, during the initial full sync of a project's events, before the next issue.
+// It saves its progress and returns an error wrapping ctx.Err().
+func (c *Client) SyncProject(ctx context.Context, project string) (err error) {
+	ctx, span := tracing.Start(ctx, "github.SyncProject", attribute.String("project", project))
+	c.slog.DebugContext(ctx, "githubdl.SyncProject", "project", project)
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("SyncProject(%q): %w", project, err)
 		}
+		tracing.End(span, err)
 	}()
 
 	key := o("githubdl.ProjectSync", project)
@@ -177,11 +356,18 @@ func (c *Client) SyncProject(project string) (err error) {
 		return err
 	}
 
+	// Build issue indexes for projects synced before they existed.
+	if proj.IssueIndexVersion != issueIndexVersion {
+		c.reindexIssues(project)
+		proj.IssueIndexVersion = issueIndexVersion
+		proj.store(c.db)
+	}
+
 	// Sync issues, comments, events.
-	if err := c.syncIssues(&proj); err != nil {
+	if err := c.syncIssues(ctx, &proj); err != nil {
 		return err
 	}
-	if err := c.syncIssueComments(&proj); err != nil {
+	if err := c.syncIssueComments(ctx, &proj); err != nil {
 		return err
 	}
 
@@ -196,11 +382,11 @@ func (c *Client) SyncProject(project string) (err error) {
 			proj.FullSyncActive = true
 			proj.FullSyncIssue = 0
 			proj.store(c.db)
-			if err := c.syncIssueEvents(&proj, 0, true); err != nil {
+			if err := c.syncIssueEvents(ctx, &proj, 0, true); err != nil {
 				return err
 			}
 		}
-		if err := c.syncIssues(&proj); err != nil {
+		if err := c.syncIssues(ctx, &proj); err != nil {
 			return err
 		}
 		for key, _ := range c.db.Scan(o("githubdl.Event", project), o("githubdl.Event", project, ordered.Inf)) {
@@ -211,7 +397,10 @@ func (c *Client) SyncProject(project string) (err error) {
 			if issue <= proj.FullSyncIssue {
 				continue
 			}
-			if err := c.syncIssueEvents(&proj, issue, false); err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := c.syncIssueEvents(ctx, &proj, issue, false); err != nil {
 				return err
 			}
 			proj.FullSyncIssue = issue
@@ -226,24 +415,26 @@ func (c *Client) SyncProject(project string) (err error) {
 	}
 
 	// Incremental scan.
-	if err := c.syncIssueEvents(&proj, 0, false); err != nil {
+	if err := c.syncIssueEvents(ctx, &proj, 0, false); err != nil {
 		return err
 	}
+
+	c.updateIssueStates(&proj)
 	return nil
 }
 
 // syncIssues syncs the issues for a given project.
 // It records all new issues since proj.IssueDate.
 // If successful, it updates proj.IssueDate to the latest issue date seen.
-func (c *Client) syncIssues(proj *projectSync) error {
-	return c.syncByDate(proj, "/issues")
+func (c *Client) syncIssues(ctx context.Context, proj *projectSync) error {
+	return c.syncByDate(ctx, proj, "/issues")
 }
 
 // syncIssueComments sync the issue comments for a given project.
 // It records all new issue comments since proj.CommentDate.
 // If successful, it updates proj.CommentDate to the latest comment date seen.
-func (c *Client) syncIssueComments(proj *projectSync) error {
-	return c.syncByDate(proj, "/issues/comments")
+func (c *Client) syncIssueComments(ctx context.Context, proj *projectSync) error {
+	return c.syncByDate(ctx, proj, "/issues/comments")
 }
 
 // syncByDate downloads and saves issues or issue comments since
@@ -251,12 +442,13 @@ func (c *Client) syncIssueComments(proj *projectSync) error {
 // api is "/issues" for issues or "/issues/comments" for issue comments.
 // syncByDate updates the proj date with the new latest date seen
 // before any error.
-func (c *Client) syncByDate(proj *projectSync, api string) error {
+func (c *Client) syncByDate(ctx context.Context, proj *projectSync, api string) error {
 Restart:
 	// For these APIs, we can ask GitHub for the event stream in increasing time order,
 	// so we can iterate through all the events, saving the latest time we have seen,
 	// and pick up where we left off.
 	var since *string
+	var cache *pageCache
 	values := url.Values{
 		"sort":      {"updated"},
 		"direction": {"asc"},
@@ -267,10 +459,12 @@ Restart:
 		panic("downloadByDate api: " + api)
 	case "/issues":
 		since = &proj.IssueDate
+		cache = &proj.IssueCache
 		values["state"] = []string{"all"}
 		values["per_page"] = []string{"100"}
 	case "/issues/comments":
 		since = &proj.CommentDate
+		cache = &proj.CommentCache
 	}
 	if *since != "" {
 		values["since"] = []string{*since}
@@ -279,13 +473,32 @@ Restart:
 	b := c.db.Batch()
 	defer b.Apply()
 
+	// If nothing has changed since the last sync, the request is for
+	// the same URL as last time (since is the latest update seen then),
+	// and the response is the same. Make a conditional request in that case,
+	// so that an idle repo costs nothing from the GitHub rate limit.
+	// The cache validators are only meaningful for the same URL,
+	// so do not send them for a different one.
+	// Conditional requests are an optimization for the steady-state
+	// polling loop, so only use them once the project is fully synced.
 	urlStr := "https://api.github.com/repos/" + proj.Name + api + "?" + values.Encode()
+	incremental := proj.EventID != 0 && !proj.FullSyncActive
+	var v validator
+	if incremental && cache.URL == urlStr {
+		v = cache.validator
+	}
 	npage := 0
 	defer proj.store(c.db)
-	for pg, err := range c.pages(urlStr, "") {
+	for pg, err := range c.pages(ctx, urlStr, v) {
+		if err == errNotModified {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if incremental && npage == 0 {
+			*cache = pageCache{URL: urlStr, validator: validatorFor(pg.resp)}
+		}
 
 		for _, raw := range pg.body {
 			var meta struct {
@@ -379,7 +592,7 @@ Restart:
 //   - syncIssueEvents(db, hc, proj, 0, false) to read any events since the beginning of the sync.
 //
 //     Now the database should contain all events up to the new proj.EventID.
-func (c *Client) syncIssueEvents(proj *projectSync, issue int64, onlySetLatest bool) error {
+func (c *Client) syncIssueEvents(ctx context.Context, proj *projectSync, issue int64, onlySetLatest bool) error {
 	if issue > 0 && onlySetLatest {
 		panic("syncIssueEvents misuse")
 	}
@@ -405,7 +618,7 @@ func (c *Client) syncIssueEvents(proj *projectSync, issue int64, onlySetLatest b
 	defer b.Apply()
 
 Pages:
-	for pg, err := range c.pages(urlStr, proj.EventETag) {
+	for pg, err := range c.pages(ctx, urlStr, validator{ETag: proj.EventETag}) {
 		if err == errNotModified {
 			return nil
 		}
@@ -460,23 +673,54 @@ Pages:
 }
 
 // writeEvent writes a single event to the database using SetTimed, to maintain a time-ordered index.
+// Writing an "/issues" event also updates the issue indexes,
+// and writing an "/issues/comments" event updates the comment index.
 func (c *Client) writeEvent(b storage.Batch, project string, issue int64, api string, id int64, raw json.RawMessage) {
-	timed.Set(c.db, b, "githubdl.Event", o(project, issue, api, id), o(ordered.Raw(raw)))
+	key := o(project, issue, api, id)
+	switch api {
+	case "/issues":
+		c.indexIssue(b, project, key, raw)
+	case "/issues/comments":
+		b.Set(o("githubdl.CommentByID", project, id, issue), nil)
+	}
+	timed.Set(c.db, b, "githubdl.Event", key, c.eventVal(o(ordered.Raw(raw))))
 }
 
-// errNotModified is returned by get when an etag is being used
+// errNotModified is returned by get when a validator is being used
 // and the server returns a 304 not modified response.
 var errNotModified = errors.New("304 not modified")
 
+// A validator holds the HTTP cache validators from a previous response,
+// for use in a conditional request.
+type validator struct {
+	ETag         string // Etag header; sent as If-None-Match
+	LastModified string // Last-Modified header; sent as If-Modified-Since
+}
+
+// validatorFor returns the validator for the response.
+func validatorFor(resp *http.Response) validator {
+	return validator{
+		ETag:         resp.Header.Get("Etag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+// A pageCache records the validator for a particular URL.
+type pageCache struct {
+	URL string
+	validator
+}
+
 // get fetches url and decodes the body as JSON into obj.
 //
-// If etag is non-empty, the request includes an If-None-Match: etag header
-// and get returns errNotModified if the server says the object is unmodified
-// since that etag.
+// If v.ETag is non-empty, the request includes an If-None-Match: v.ETag header,
+// and if v.LastModified is non-empty, the request includes an
+// If-Modified-Since: v.LastModified header.
+// In either case, get returns errNotModified if the server says the object is unmodified.
 //
 // get uses the api.github.com secret if available.
 // Otherwise it makes an unauthenticated request.
-func (c *Client) get(url, etag string, obj any) (*http.Response, error) {
+func (c *Client) get(ctx context.Context, url string, v validator, obj any) (*http.Response, error) {
 	if c.divertEdits() {
 		c.testMu.Lock()
 		js := c.testEvents[url]
@@ -495,13 +739,16 @@ func (c *Client) get(url, etag string, obj any) (*http.Response, error) {
 	nrate := 0
 	nfail := 0
 Redo:
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.SetBasicAuth(user, pass)
-	if etag != "" {
-		req.Header.Set("If-None-Match", etag)
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
 	}
 	resp, err := c.http.Do(req)
 	if err != nil {
@@ -516,16 +763,21 @@ Redo:
 		if resp.StatusCode == 304 {
 			return nil, errNotModified
 		}
-		if c.rateLimit(resp) {
+		if wait, ok := c.rateLimit(resp); ok {
 			if nrate++; nrate > 20 {
 				return nil, fmt.Errorf("%s # too many rate limits\n%s", resp.Status, data)
 			}
+			if err := c.wait(ctx, wait); err != nil {
+				return nil, err
+			}
 			goto Redo
 		}
 		if resp.StatusCode == 500 || resp.StatusCode == 502 {
 			c.slog.Error("github get server failure", "code", resp.StatusCode, "status", resp.Status, "body", string(data))
 			if nfail++; nfail < 3 {
-				time.Sleep(time.Duration(nfail) * 2 * time.Second)
+				if err := c.wait(ctx, time.Duration(nfail)*2*time.Second); err != nil {
+					return nil, err
+				}
 				goto Redo
 			}
 		}
@@ -541,17 +793,21 @@ type page struct {
 	body []json.RawMessage
 }
 
-// pages returns a paginated result starting at url and using etag.
+// pages returns a paginated result starting at url.
+// The request for the first page uses the validator v;
+// the validator describes only that page, so the requests
+// for later pages are unconditional.
 // If pages encounters an error, it yields nil, err.
-func (c *Client) pages(url, etag string) iter.Seq2[*page, error] {
+func (c *Client) pages(ctx context.Context, url string, v validator) iter.Seq2[*page, error] {
 	return func(yield func(*page, error) bool) {
 		for n := 0; url != ""; n++ {
 			var body []json.RawMessage
-			resp, err := c.get(url, etag, &body)
+			resp, err := c.get(ctx, url, v, &body)
 			if err != nil {
 				yield(nil, err)
 				return
 			}
+			v = validator{}
 			if !yield(&page{resp, body}, nil) {
 				return
 			}
@@ -598,28 +854,60 @@ func findNext(link string) string {
 }
 
 // rateLimit looks at the response to decide whether a rate limit has been applied.
-// If so, rateLimit sleeps until the time specified in the response, plus a bit extra.
+// If so, rateLimit returns how long to wait before retrying the request:
+// until the time specified in the response, plus a bit extra.
 // rateLimit reports whether this was a rate-limit response.
-func (c *Client) rateLimit(resp *http.Response) bool {
+func (c *Client) rateLimit(resp *http.Response) (wait time.Duration, ok bool) {
 	if resp.StatusCode != 403 || resp.Header.Get("X-Ratelimit-Remaining") != "0" {
-		return false
+		return 0, false
 	}
 	n, _ := strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
 	if n == 0 {
-		return false
+		return 0, false
 	}
 	t := time.Unix(int64(n), 0)
-	now := time.Now()
+	now := c.now()
 	if t.Before(now) {
 		if now.Sub(t) > 2*time.Minute {
-			return false
+			return 0, false
 		}
-		return true
+		return 0, true
 	}
 	c.slog.Info("github ratelimit", "reset", t.Format(time.RFC3339),
 		"limit", resp.Header.Get("X-Ratelimit-Limit"),
 		"remaining", resp.Header.Get("X-Ratelimit-Remaining"),
 		"used", resp.Header.Get("X-Ratelimit-Used"))
-	time.Sleep(now.Sub(t) + 1*time.Minute)
-	return true
+	return t.Sub(now) + 1*time.Minute, true
+}
+
+// wait waits for d to elapse (using c.sleep),
+// returning early with ctx's error if ctx is canceled first.
+// A sleep interrupted by cancellation finishes in the background.
+func (c *Client) wait(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		c.sleep(d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// context returns the context set by [Client.WithContext],
+// or else [context.Background].
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
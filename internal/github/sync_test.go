@@ -6,14 +6,19 @@ package github
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"iter"
 	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"rsc.io/gaby/internal/httprr"
 	"rsc.io/gaby/internal/secret"
@@ -22,6 +27,8 @@ import (
 	"rsc.io/gaby/internal/testutil"
 )
 
+var ctx = context.Background()
+
 func githubAuth() (string, string) {
 	data, err := os.ReadFile(filepath.Join(os.Getenv("HOME"), ".netrc"))
 	if err != nil {
@@ -45,13 +52,14 @@ func TestMarkdown(t *testing.T) {
 	rr, err := httprr.Open("../testdata/markdown.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c := New(lg, db, sdb, rr.Client())
 	check(c.Add("rsc/markdown"))
-	check(c.Sync())
+	check(c.Sync(ctx))
 
 	w := c.EventWatcher("test1")
 	for e := range w.Recent() {
@@ -62,12 +70,13 @@ func TestMarkdown(t *testing.T) {
 	rr, err = httprr.Open("../testdata/markdown2.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb = secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c = New(lg, db, sdb, rr.Client())
-	check(c.Sync())
+	check(c.Sync(ctx))
 
 	// Test that EventWatcher sees the updates.
 	diffEvents(t,
@@ -83,12 +92,13 @@ func TestMarkdown(t *testing.T) {
 	rr, err = httprr.Open("../testdata/markdown3.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb = secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c = New(lg, db, sdb, rr.Client())
-	check(c.Sync())
+	check(c.Sync(ctx))
 
 	testMarkdownEvents(t, c)
 }
@@ -102,6 +112,7 @@ func TestMarkdownIncrementalSync(t *testing.T) {
 	rr, err := httprr.Open("../testdata/markdowninc.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
@@ -114,7 +125,7 @@ func TestMarkdownIncrementalSync(t *testing.T) {
 		testFullSyncStop = nil
 	}()
 	for {
-		err := c.Sync()
+		err := c.Sync(ctx)
 		if err == nil {
 			break
 		}
@@ -215,13 +226,14 @@ func TestIvy(t *testing.T) {
 	rr, err := httprr.Open("../testdata/ivy.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c := New(lg, db, sdb, rr.Client())
 	check(c.Add("robpike/ivy"))
-	check(c.Sync())
+	check(c.Sync(ctx))
 }
 
 func TestOmap(t *testing.T) {
@@ -231,13 +243,14 @@ func TestOmap(t *testing.T) {
 	rr, err := httprr.Open("../testdata/omap.httprr", http.DefaultTransport)
 	check(err)
 	rr.Scrub(Scrub)
+	rr.ScrubResponse(ScrubResponse)
 	sdb := secret.Empty()
 	if rr.Recording() {
 		sdb = secret.Netrc()
 	}
 	c := New(lg, db, sdb, rr.Client())
 	check(c.Add("rsc/omap"))
-	check(c.Sync())
+	check(c.Sync(ctx))
 }
 
 var markdownEarlyEvents = [][]byte{
@@ -341,3 +354,336 @@ var markdownEvents = [][]byte{
 	o("rsc/markdown", 19, "/issues", 2308816936),
 	o("rsc/markdown", 19, "/issues/comments", 2146197528),
 }
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestConditionalSync(t *testing.T) {
+	check := testutil.Checker(t)
+	var log []string
+	rt := func(req *http.Request) (*http.Response, error) {
+		api := strings.TrimPrefix(req.URL.Path, "/repos/rsc/tmp")
+		etag := `"` + api + `"`
+		lastMod := "Mon, 03 Jun 2024 00:00:00 GMT"
+		var body string
+		switch api {
+		case "/issues":
+			body = `[{"id":1,"number":1,"url":"https://api.github.com/repos/rsc/tmp/issues/1","updated_at":"2024-06-03T00:00:00Z"}]`
+		case "/issues/comments":
+			body = `[{"id":2,"issue_url":"https://api.github.com/repos/rsc/tmp/issues/1","updated_at":"2024-06-03T00:00:00Z"}]`
+		case "/issues/events":
+			etag = `"events"`
+			body = `[{"id":3,"issue":{"number":1}}]`
+		}
+		status := 200
+		if req.Header.Get("If-None-Match") == etag {
+			status = 304
+			body = ""
+			if api != "/issues/events" && req.Header.Get("If-Modified-Since") != lastMod {
+				t.Errorf("%s: If-Modified-Since = %q, want %q", api, req.Header.Get("If-Modified-Since"), lastMod)
+			}
+		}
+		log = append(log, fmt.Sprintf("%s %d", api, status))
+		return &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Header:     http.Header{"Etag": {etag}, "Last-Modified": {lastMod}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, secret.Empty(), &http.Client{Transport: roundTripFunc(rt)})
+	check(c.Add("rsc/tmp"))
+	(&projectSync{Name: "rsc/tmp", EventID: 3, EventETag: `"events"`, IssueIndexVersion: issueIndexVersion}).store(db)
+
+	// First sync fetches new data, changing the since values in the URLs.
+	// Second sync fetches the same data again, since the since values are inclusive.
+	// Third sync uses the same URLs as the second and gets 304s.
+	want := [][]string{
+		{"/issues 200", "/issues/comments 200", "/issues/events 304"},
+		{"/issues 200", "/issues/comments 200", "/issues/events 304"},
+		{"/issues 304", "/issues/comments 304", "/issues/events 304"},
+	}
+	for i, w := range want {
+		log = nil
+		check(c.SyncProject(ctx, "rsc/tmp"))
+		if !slices.Equal(log, w) {
+			t.Errorf("sync #%d:\nhave %q\nwant %q", i+1, log, w)
+		}
+	}
+	if n := len(collectEvents(c.Events("rsc/tmp", -1, -1))); n != 2 {
+		t.Errorf("after sync, have %d events, want 2", n)
+	}
+}
+
+func TestPagesValidator(t *testing.T) {
+	var conds []string
+	rt := func(req *http.Request) (*http.Response, error) {
+		conds = append(conds, req.Header.Get("If-None-Match"))
+		h := http.Header{"Etag": {`"etag"`}}
+		if req.URL.Query().Get("page") == "" {
+			h.Set("Link", `<https://api.github.com/repos/rsc/tmp/issues?page=2>; rel="next"`)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Header:     h,
+			Body:       io.NopCloser(strings.NewReader(`[{"id": 1}]`)),
+		}, nil
+	}
+
+	c := New(testutil.Slogger(t), storage.MemDB(), secret.Empty(), &http.Client{Transport: roundTripFunc(rt)})
+	n := 0
+	for _, err := range c.pages(ctx, "https://api.github.com/repos/rsc/tmp/issues", validator{ETag: `"old"`}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if want := []string{`"old"`, ""}; n != 2 || !slices.Equal(conds, want) {
+		t.Errorf("read %d pages with If-None-Match %q, want 2 pages with %q", n, conds, want)
+	}
+}
+
+func TestSyncOrg(t *testing.T) {
+	check := testutil.Checker(t)
+	repos := `[
+		{"name": "go", "full_name": "golang/go"},
+		{"name": "tools", "full_name": "golang/tools"},
+		{"name": "old", "full_name": "golang/old", "archived": true},
+		{"name": "fork", "full_name": "golang/fork", "fork": true},
+		{"name": "website", "full_name": "golang/website"}
+	]`
+	var synced []string
+	listed := 0
+	rt := func(req *http.Request) (*http.Response, error) {
+		body := "[]"
+		if req.URL.Path == "/orgs/golang/repos" {
+			body = repos
+			listed++
+		} else if p, ok := strings.CutSuffix(req.URL.Path, "/issues"); ok {
+			// Note: full sync fetches /issues twice; record only once.
+			p = strings.TrimPrefix(p, "/repos/")
+			if len(synced) == 0 || synced[len(synced)-1] != p {
+				synced = append(synced, p)
+			}
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	db := storage.MemDB()
+	c := New(testutil.Slogger(t), db, secret.Empty(), &http.Client{Transport: roundTripFunc(rt)})
+	clock := testutil.NewFakeClock(time.Now())
+	c.SetClock(clock.Now, clock.Sleep)
+	check(c.AddOrg("golang", `^(go|tools|old|fork)$`))
+	if err := c.AddOrg("golang", ""); err == nil {
+		t.Errorf("AddOrg twice succeeded")
+	}
+	if err := c.AddOrg("bad", "("); err == nil {
+		t.Errorf("AddOrg with bad pattern succeeded")
+	}
+
+	check(c.Sync(ctx))
+	if want := []string{"golang/go", "golang/tools"}; !slices.Equal(synced, want) {
+		t.Errorf("first Sync synced %v, want %v", synced, want)
+	}
+
+	// The repository list is not fetched again until orgInterval has passed.
+	listed = 0
+	check(c.Sync(ctx))
+	if listed != 0 {
+		t.Errorf("Sync within orgInterval listed repos %d times, want 0", listed)
+	}
+
+	// Archiving a repo stops syncing it; unarchiving starts again.
+	repos = strings.Replace(repos, `"golang/go"`, `"golang/go", "archived": true`, 1)
+	synced = nil
+	clock.Advance(orgInterval)
+	check(c.Sync(ctx))
+	if want := []string{"golang/tools"}; !slices.Equal(synced, want) {
+		t.Errorf("Sync after archive synced %v, want %v", synced, want)
+	}
+
+	repos = strings.Replace(repos, `"golang/go", "archived": true`, `"golang/go"`, 1)
+	synced = nil
+	clock.Advance(orgInterval)
+	check(c.Sync(ctx))
+	if want := []string{"golang/go", "golang/tools"}; !slices.Equal(synced, want) {
+		t.Errorf("Sync after unarchive synced %v, want %v", synced, want)
+	}
+
+	// SetOrg with an unchanged pattern keeps the last listing time.
+	check(c.SetOrg("golang", `^(go|tools|old|fork)$`))
+	listed = 0
+	check(c.Sync(ctx))
+	if listed != 0 {
+		t.Errorf("Sync after SetOrg with same pattern listed repos %d times, want 0", listed)
+	}
+
+	// SetOrg replaces the pattern of an added organization,
+	// and the next Sync lists the repositories immediately.
+	check(c.SetOrg("golang", ""))
+	if err := c.SetOrg("golang", "("); err == nil {
+		t.Errorf("SetOrg with bad pattern succeeded")
+	}
+	synced = nil
+	check(c.Sync(ctx))
+	if want := []string{"golang/go", "golang/tools", "golang/website"}; !slices.Equal(synced, want) {
+		t.Errorf("Sync after SetOrg synced %v, want %v", synced, want)
+	}
+
+	repos = `[{"name": "go"}]`
+	clock.Advance(orgInterval)
+	if err := c.Sync(ctx); err == nil || !strings.Contains(err.Error(), "no full_name") {
+		t.Errorf("Sync with bad repo list: err = %v, want no full_name error", err)
+	}
+
+	// A failed listing is retried at the next Sync.
+	listed = 0
+	c.Sync(ctx)
+	if listed != 1 {
+		t.Errorf("Sync after failed listing listed repos %d times, want 1", listed)
+	}
+
+	// RemoveOrg stops listing the organization.
+	if orgs := c.Orgs(); !slices.Equal(orgs, []string{"golang"}) {
+		t.Errorf("Orgs() = %v, want [golang]", orgs)
+	}
+	c.RemoveOrg("golang")
+	if orgs := c.Orgs(); len(orgs) != 0 {
+		t.Errorf("Orgs() after RemoveOrg = %v, want none", orgs)
+	}
+	listed = 0
+	clock.Advance(orgInterval)
+	check(c.Sync(ctx))
+	if listed != 0 {
+		t.Errorf("Sync after RemoveOrg listed repos %d times, want 0", listed)
+	}
+}
+
+func TestScrubResponse(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: 200,
+		Header: http.Header{
+			"X-Oauth-Scopes":        {"repo"},
+			"X-Ratelimit-Remaining": {"4999"},
+			"Etag":                  {`"abc"`},
+		},
+		Body: &httprr.Body{Data: []byte(`{"author":{"name":"Gopher","email": "gopher@example.com"}}`)},
+	}
+	if err := ScrubResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Header) != 1 || resp.Header.Get("Etag") == "" {
+		t.Errorf("ScrubResponse left headers %v, want only Etag", resp.Header)
+	}
+	if body, want := string(resp.Body.(*httprr.Body).Data), `{"author":{"name":"Gopher","email":""}}`; body != want {
+		t.Errorf("ScrubResponse body = %s, want %s", body, want)
+	}
+
+	// Rate-limit responses keep their rate-limit headers.
+	resp = &http.Response{StatusCode: 403, Header: http.Header{"X-Ratelimit-Remaining": {"0"}}}
+	if err := ScrubResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("X-Ratelimit-Remaining") != "0" {
+		t.Errorf("ScrubResponse removed rate limit from 403 response")
+	}
+}
+
+func TestRetryClock(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	reset := clock.Now().Add(10 * time.Minute)
+	rateLimited := func() *http.Response {
+		return &http.Response{
+			StatusCode: 403,
+			Status:     "403 Forbidden",
+			Header: http.Header{
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {strconv.FormatInt(reset.Unix(), 10)},
+			},
+			Body: io.NopCloser(strings.NewReader("{}")),
+		}
+	}
+	codes := []int{403, 502, 200}
+	rt := func(req *http.Request) (*http.Response, error) {
+		code := codes[0]
+		codes = codes[1:]
+		if code == 403 {
+			return rateLimited(), nil
+		}
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Body:       io.NopCloser(strings.NewReader("[]")),
+		}, nil
+	}
+
+	c := New(testutil.Slogger(t), storage.MemDB(), secret.Empty(), &http.Client{Transport: roundTripFunc(rt)})
+	c.SetClock(clock.Now, clock.Sleep)
+	var list []any
+	if _, err := c.get(ctx, "https://api.github.com/repos/rsc/tmp/issues", validator{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the rate limit to reset, plus a minute,
+	// and then for 2 seconds after the server failure.
+	if sleeps, want := clock.Sleeps(), []time.Duration{11 * time.Minute, 2 * time.Second}; !slices.Equal(sleeps, want) {
+		t.Errorf("sleeps = %v, want %v", sleeps, want)
+	}
+
+	// A reset time just passed means retry right away;
+	// a reset time long past means the 403 is not a rate limit.
+	clock.Set(reset.Add(1 * time.Minute))
+	if wait, ok := c.rateLimit(rateLimited()); !ok || wait != 0 {
+		t.Errorf("rateLimit just after reset = %v, %v, want 0, true", wait, ok)
+	}
+	clock.Set(reset.Add(1 * time.Hour))
+	if _, ok := c.rateLimit(rateLimited()); ok {
+		t.Errorf("rateLimit long after reset = true, want false")
+	}
+}
+
+func TestGetCancel(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	reset := clock.Now().Add(10 * time.Minute)
+	ctx, cancel := context.WithCancel(ctx)
+	rt := func(req *http.Request) (*http.Response, error) {
+		if req.Context() != ctx {
+			t.Errorf("request context is not the context passed to get")
+		}
+		return &http.Response{
+			StatusCode: 403,
+			Status:     "403 Forbidden",
+			Header: http.Header{
+				"X-Ratelimit-Remaining": {"0"},
+				"X-Ratelimit-Reset":     {strconv.FormatInt(reset.Unix(), 10)},
+			},
+			Body: io.NopCloser(strings.NewReader("{}")),
+		}, nil
+	}
+
+	// The wait for the rate limit to reset blocks until the test ends,
+	// so get can only return by noticing the cancellation.
+	block := make(chan struct{})
+	defer close(block)
+	sleep := func(time.Duration) { <-block }
+
+	c := New(testutil.Slogger(t), storage.MemDB(), secret.Empty(), &http.Client{Transport: roundTripFunc(rt)})
+	c.SetClock(clock.Now, sleep)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	var list []any
+	if _, err := c.get(ctx, "https://api.github.com/repos/rsc/tmp/issues", validator{}, &list); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get after cancel = %v, want context.Canceled", err)
+	}
+
+	// A canceled context stops the request before it is sent.
+	if _, err := c.get(ctx, "https://api.github.com/repos/rsc/tmp/issues", validator{}, &list); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get with canceled context = %v, want context.Canceled", err)
+	}
+}
@@ -5,6 +5,8 @@
 package github
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -91,6 +93,8 @@ func (tc *TestingClient) addEvent(url string, e *Event) {
 	b := tc.c.db.Batch()
 	tc.c.writeEvent(b, e.Project, e.Issue, e.API, e.ID, js)
 	b.Apply()
+	tc.c.updateIssueState(b, e.Project, e.Issue)
+	b.Apply()
 }
 
 var issueID int64 = 1e9
@@ -159,12 +163,55 @@ func (tc *TestingClient) AddIssueEvent(project string, issue int64, event *Issue
 	tc.addEvent(event.URL, &Event{
 		Project: project,
 		Issue:   issue,
-		API:     "/issues/comments",
+		API:     "/issues/events",
 		ID:      id,
 		Typed:   event,
 	})
 }
 
+// AddReaction adds the reaction r to the issue or issue comment
+// with the given API URL, to be returned by [Client.DownloadReactions].
+// Like the edits, reactions are not stored in the database.
+func (tc *TestingClient) AddReaction(url string, r *Reaction) {
+	tc.c.testMu.Lock()
+	defer tc.c.testMu.Unlock()
+
+	if tc.c.testReacts == nil {
+		tc.c.testReacts = make(map[string][]*Reaction)
+	}
+	tc.c.testReacts[url] = append(tc.c.testReacts[url], r)
+}
+
+// FailEdit makes later calls to the named edit method
+// (such as "EditIssue") fail with err instead of being diverted.
+// FailEdit(method, nil) makes the calls succeed again.
+func (tc *TestingClient) FailEdit(method string, err error) {
+	tc.c.testMu.Lock()
+	defer tc.c.testMu.Unlock()
+
+	if tc.c.testFail == nil {
+		tc.c.testFail = make(map[string]error)
+	}
+	tc.c.testFail[method] = err
+}
+
+// AddFile adds a file with the given path and content to project,
+// to be returned by [Client.DownloadFile].
+// Like the edits, files are not stored in the database.
+func (tc *TestingClient) AddFile(project, path string, data []byte) {
+	tc.c.testMu.Lock()
+	defer tc.c.testMu.Unlock()
+
+	if tc.c.testEvents == nil {
+		tc.c.testEvents = make(map[string]json.RawMessage)
+	}
+	tc.c.testEvents[fileURL(project, path)] = storage.JSON(&fileContent{
+		Type:     "file",
+		Encoding: "base64",
+		Content:  base64.StdEncoding.EncodeToString(data),
+	})
+}
+
 // Edits returns a list of all the edits that have been applied using [Client] methods
 // (for example [Client.EditIssue], [Client.EditIssueComment], [Client.PostIssueComment]).
 // These edits have not been applied on GitHub, only diverted into the [TestingClient].
@@ -204,6 +251,7 @@ func (c *Client) divertEdits() bool {
 // Each file in the archive should be named “project#n” (for example “golang/go#123”)
 // and contain an issue history in the format printed by the [rsc.io/github/issue] command.
 // See the file ../testdata/rsctmp.txt for an example.
+// [Client.Txtar] writes issue histories in the same format.
 //
 // To download a specific set of issues into a new file, you can use a script like:
 //
@@ -373,7 +421,7 @@ func (tc *TestingClient) LoadTxtarData(data []byte) error {
 			if who, whom, ok := strings.Cut(op, " unassigned "); ok {
 				tc.AddIssueEvent(project, issue.Number, &IssueEvent{
 					Actor:     User{Login: who},
-					Event:     "assigned",
+					Event:     "unassigned",
 					CreatedAt: tm,
 					Assignees: []User{{Login: whom}},
 				})
@@ -460,7 +508,7 @@ func (tc *TestingClient) LoadTxtarData(data []byte) error {
 				readBody()
 				tc.AddIssueEvent(project, issue.Number, &IssueEvent{
 					Actor:     User{Login: who},
-					Event:     "merged",
+					Event:     "referenced",
 					CreatedAt: tm,
 					CommitID:  commit, // note: truncated
 				})
@@ -516,6 +564,132 @@ func (tc *TestingClient) LoadTxtarData(data []byte) error {
 	return nil
 }
 
+// Txtar returns a txtar archive holding the histories of the issues
+// in the range issueMin ≤ issue ≤ issueMax in the given project,
+// in the format read by [TestingClient.LoadTxtar].
+// If issueMax < 0, there is no upper limit.
+// Only the database is consulted, not actual GitHub.
+//
+// Txtar is the inverse of LoadTxtar, except for details the format
+// does not record, such as issue event types it does not describe
+// (which Txtar omits), secondary assignees, sub-second times,
+// the messages of referenced commits, and trailing blank lines in bodies.
+// It can be used to regenerate test data from a synced database.
+func (c *Client) Txtar(project string, issueMin, issueMax int64) []byte {
+	ar := new(txtar.Archive)
+	last := int64(0)
+	for e := range c.Events(project, issueMin, issueMax) {
+		if e.API != "/issues" || e.Issue == last {
+			continue
+		}
+		last = e.Issue
+		ar.Files = append(ar.Files, txtar.File{
+			Name: fmt.Sprintf("%s#%d", project, e.Issue),
+			Data: c.issueTxtar(project, e.Typed.(*Issue)),
+		})
+	}
+	return txtar.Format(ar)
+}
+
+// issueTxtar returns the history of issue in the format read by
+// [TestingClient.LoadTxtar].
+func (c *Client) issueTxtar(project string, issue *Issue) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Title: %s\n", issue.Title)
+	fmt.Fprintf(&b, "State: %s\n", issue.State)
+	assignee := ""
+	if len(issue.Assignees) > 0 {
+		assignee = issue.Assignees[0].Login
+	}
+	fmt.Fprintf(&b, "Assignee: %s\n", assignee)
+	if issue.ClosedAt != "" {
+		fmt.Fprintf(&b, "Closed: %s\n", txtarTime(issue.ClosedAt))
+	}
+	var labels []string
+	for _, l := range issue.Labels {
+		labels = append(labels, l.Name)
+	}
+	fmt.Fprintf(&b, "Labels: %s\n", strings.Join(labels, ", "))
+	fmt.Fprintf(&b, "Milestone: %s\n", issue.Milestone.Title)
+	kind := "issues"
+	if issue.PullRequest != nil {
+		kind = "pull"
+	}
+	fmt.Fprintf(&b, "URL: https://github.com/%s/%s/%d\n", project, kind, issue.Number)
+
+	fmt.Fprintf(&b, "\nReported by %s (%s)\n", issue.User.Login, txtarTime(issue.CreatedAt))
+	writeTxtarBody(&b, issue.Body)
+	b.WriteString("\n")
+
+	for _, e := range c.Timeline(project, issue.Number) {
+		switch x := e.Typed.(type) {
+		case *IssueComment:
+			fmt.Fprintf(&b, "Comment by %s (%s)\n", x.User.Login, txtarTime(x.CreatedAt))
+			writeTxtarBody(&b, x.Body)
+			b.WriteString("\n")
+		case *IssueEvent:
+			var desc string
+			switch x.Event {
+			case "assigned", "unassigned":
+				if len(x.Assignees) == 0 {
+					continue
+				}
+				desc = x.Event + " " + x.Assignees[0].Login
+			case "labeled", "unlabeled":
+				if len(x.Labels) == 0 {
+					continue
+				}
+				desc = x.Event + " " + x.Labels[0].Name
+			case "milestoned":
+				desc = "added to milestone " + x.Milestone.Title
+			case "demilestoned":
+				desc = "removed from milestone " + x.Milestone.Title
+			case "renamed":
+				desc = "changed title"
+			case "closed":
+				desc = "closed"
+				if x.CommitID != "" {
+					desc = "closed in commit " + x.CommitID
+				}
+			case "merged", "referenced":
+				desc = x.Event + " in commit " + x.CommitID
+			case "review_requested", "head_ref_force_pushed", "head_ref_deleted", "head_ref_restored":
+				desc = x.Event
+			default:
+				continue
+			}
+			fmt.Fprintf(&b, "* %s %s (%s)\n", x.Actor.Login, desc, txtarTime(x.CreatedAt))
+			if x.Event == "renamed" {
+				fmt.Fprintf(&b, "  - %s\n  + %s\n", x.Rename.From, x.Rename.To)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// txtarTime returns the RFC3339 time tm in the format used by
+// [TestingClient.LoadTxtar].
+func txtarTime(tm string) string {
+	t, err := time.Parse(time.RFC3339, tm)
+	if err != nil {
+		return tm
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// writeTxtarBody writes the issue or comment body to b,
+// in the indented form read by [TestingClient.LoadTxtar].
+func writeTxtarBody(b *bytes.Buffer, body string) {
+	if body == "" {
+		return
+	}
+	b.WriteString("\n")
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		b.WriteString("\t" + line + "\n")
+	}
+}
+
 /* event types:
 https://docs.github.com/en/rest/using-the-rest-api/issue-event-types?apiVersion=2022-11-28#issue-event-object-common-properties
 
@@ -5,13 +5,181 @@
 package github
 
 import (
+	"bytes"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 
+	"golang.org/x/tools/txtar"
+	"rsc.io/gaby/internal/diff"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/testutil"
 )
 
+// keepIDs restores the global test ID counters when t finishes,
+// so that the test data t loads does not change the IDs
+// assigned in later tests (such as TestMarkdownDivertEdit).
+func keepIDs(t *testing.T) {
+	i, c, e := atomic.LoadInt64(&issueID), atomic.LoadInt64(&commentID), atomic.LoadInt64(&eventID)
+	t.Cleanup(func() {
+		atomic.StoreInt64(&issueID, i)
+		atomic.StoreInt64(&commentID, c)
+		atomic.StoreInt64(&eventID, e)
+	})
+}
+
 func TestLoadTxtar(t *testing.T) {
 	gh := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
 	testutil.Check(t, gh.Testing().LoadTxtar("../testdata/rsctmp.txt"))
+
+	events := make(map[string]int)
+	for e := range gh.Events("rsc/tmp", 0, -1) {
+		if x, ok := e.Typed.(*IssueEvent); ok {
+			events[x.Event]++
+		}
+	}
+	for _, name := range []string{"assigned", "unassigned", "labeled", "unlabeled", "renamed", "closed"} {
+		if events[name] == 0 {
+			t.Errorf("no %q events loaded", name)
+		}
+	}
+}
+
+var txtarTests = []struct {
+	file    string
+	project string
+}{
+	{"../testdata/rsctmp.txt", "rsc/tmp"},
+	{"../testdata/markdown.txt", "rsc/markdown"},
+}
+
+func TestTxtarRoundTrip(t *testing.T) {
+	for _, tt := range txtarTests {
+		t.Run(tt.project, func(t *testing.T) {
+			gh := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+			testutil.Check(t, gh.Testing().LoadTxtar(tt.file))
+			out := gh.Txtar(tt.project, 0, -1)
+			if len(txtar.Parse(out).Files) == 0 {
+				t.Fatalf("Txtar wrote no issues")
+			}
+			checkTxtarRoundTrip(t, out, tt.project)
+		})
+	}
+}
+
+// checkTxtarRoundTrip checks that loading and writing out,
+// the output of [Client.Txtar] for project, reproduces out.
+func checkTxtarRoundTrip(t *testing.T, out []byte, project string) {
+	t.Helper()
+	gh := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	if err := gh.Testing().LoadTxtarData(out); err != nil {
+		t.Fatalf("reloading Txtar output: %v\n%s", err, out)
+	}
+	if out2 := gh.Txtar(project, 0, -1); !bytes.Equal(out, out2) {
+		t.Fatalf("Txtar round trip mismatch:\n%s", diff.Diff("before", out, "after", out2))
+	}
+}
+
+func TestTxtar(t *testing.T) {
+	gh := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+	tc := gh.Testing()
+	tc.AddIssue("rsc/tmp", &Issue{
+		Number:    7,
+		Title:     "a title",
+		State:     "closed",
+		User:      User{Login: "gopher"},
+		Assignees: []User{{Login: "rsc"}, {Login: "other"}},
+		Labels:    []Label{{Name: "bug"}, {Name: "help wanted"}},
+		Milestone: Milestone{Title: "v1"},
+		Body:      "Line 1.\n\nLine 3.",
+		CreatedAt: "2024-06-01T10:00:00-04:00",
+		ClosedAt:  "2024-06-02T15:00:00Z",
+	})
+	tc.AddIssueComment("rsc/tmp", 7, &IssueComment{
+		User:      User{Login: "rsc"},
+		Body:      "A comment.\n",
+		CreatedAt: "2024-06-01T15:00:00Z",
+	})
+	tc.AddIssueEvent("rsc/tmp", 7, &IssueEvent{
+		Actor:     User{Login: "rsc"},
+		Event:     "renamed",
+		CreatedAt: "2024-06-01T14:30:00Z",
+		Rename:    Rename{From: "old title", To: "a title"},
+	})
+	tc.AddIssueEvent("rsc/tmp", 7, &IssueEvent{
+		Actor:     User{Login: "rsc"},
+		Event:     "subscribed", // not recorded
+		CreatedAt: "2024-06-01T14:45:00Z",
+	})
+	tc.AddIssueEvent("rsc/tmp", 7, &IssueEvent{
+		Actor:     User{Login: "rsc"},
+		Event:     "closed",
+		CreatedAt: "2024-06-02T15:00:00Z",
+		CommitID:  "abc1234",
+	})
+
+	out := gh.Txtar("rsc/tmp", 0, -1)
+	want := `-- rsc/tmp#7 --
+Title: a title
+State: closed
+Assignee: rsc
+Closed: 2024-06-02 15:00:00
+Labels: bug, help wanted
+Milestone: v1
+URL: https://github.com/rsc/tmp/issues/7
+
+Reported by gopher (2024-06-01 14:00:00)
+
+	Line 1.
+	
+	Line 3.
+
+* rsc changed title (2024-06-01 14:30:00)
+  - old title
+  + a title
+
+Comment by rsc (2024-06-01 15:00:00)
+
+	A comment.
+
+* rsc closed in commit abc1234 (2024-06-02 15:00:00)
+
+`
+	if string(out) != want {
+		t.Fatalf("Txtar:\n%s", diff.Diff("want", []byte(want), "have", out))
+	}
+	checkTxtarRoundTrip(t, out, "rsc/tmp")
+}
+
+func FuzzLoadTxtar(f *testing.F) {
+	// Seed with each issue in the test data separately:
+	// small inputs make for faster fuzzing.
+	for _, tt := range txtarTests {
+		data, err := os.ReadFile(tt.file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, file := range txtar.Parse(data).Files {
+			f.Add(txtar.Format(&txtar.Archive{Files: []txtar.File{file}}))
+		}
+	}
+	f.Add([]byte("-- a/b#1 --\nTitle: x\n\nReported by u (2024-01-02 03:04:05)\n\n\tbody\n"))
+	f.Add([]byte("-- a/b#1 --\nURL: https://github.com/a/b/pull/1\n\nReported by u (2024-01-02 03:04:05)\n* u changed title (2024-01-02 03:04:06)\n  - x\n  + y\n"))
+	f.Add([]byte("-- a/b#x --\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		gh := New(testutil.Slogger(t), storage.MemDB(), nil, nil)
+		if err := gh.Testing().LoadTxtarData(data); err != nil {
+			return
+		}
+		projects := make(map[string]bool)
+		for _, file := range txtar.Parse(data).Files {
+			project, _, _ := strings.Cut(file.Name, "#")
+			projects[project] = true
+		}
+		for project := range projects {
+			checkTxtarRoundTrip(t, gh.Txtar(project, 0, -1), project)
+		}
+	})
 }
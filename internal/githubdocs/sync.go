@@ -7,11 +7,14 @@
 package githubdocs
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 
+	"go.opentelemetry.io/otel/attribute"
 	"rsc.io/gaby/internal/docs"
 	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/tracing"
 )
 
 // Sync writes to dc docs corresponding to each issue in gh that is
@@ -22,21 +25,61 @@ import (
 // Only the issue body (what looks like the top comment in the UI)
 // is saved as a document.
 // The document ID for each issue is its GitHub URL: "https://github.com/<org>/<repo>/issues/<n>".
-func Sync(lg *slog.Logger, dc *docs.Corpus, gh *github.Client) {
+// The document kind is [docs.KindIssue], or [docs.KindCL] for pull requests.
+//
+// If an issue is transferred to another repository or converted
+// to a discussion, Sync deletes its document (see [docs.Corpus.Delete]).
+//
+// If ctx is canceled, Sync stops before the next issue.
+func Sync(ctx context.Context, lg *slog.Logger, dc *docs.Corpus, gh *github.Client) {
+	ctx, span := tracing.Start(ctx, "githubdocs.Sync")
+	defer span.End()
+
 	w := gh.EventWatcher("githubdocs")
+	n := 0
+	defer func() { span.SetAttributes(attribute.Int("issues", n)) }()
 	for e := range w.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		if e.API == "/issues/events" {
+			if ev := e.Typed.(*github.IssueEvent); removed[ev.Event] {
+				lg.InfoContext(ctx, "githubdocs delete", "issue", e.Issue, "event", ev.Event)
+				dc.Delete(issueURL(e))
+				w.MarkOld(e.DBTime)
+				n++
+			}
+			continue
+		}
 		if e.API != "/issues" {
 			continue
 		}
-		lg.Debug("githubdocs sync", "issue", e.Issue, "dbtime", e.DBTime)
+		lg.DebugContext(ctx, "githubdocs sync", "issue", e.Issue, "dbtime", e.DBTime)
 		issue := e.Typed.(*github.Issue)
 		title := cleanTitle(issue.Title)
 		text := cleanBody(issue.Body)
-		dc.Add(fmt.Sprintf("https://github.com/%s/issues/%d", e.Project, e.Issue), title, text)
+		kind := docs.KindIssue
+		if issue.PullRequest != nil {
+			kind = docs.KindCL
+		}
+		dc.AddKind(issueURL(e), kind, title, text)
 		w.MarkOld(e.DBTime)
+		n++
 	}
 }
 
+// removed lists the issue events after which
+// the issue is no longer in the repository.
+var removed = map[string]bool{
+	"transferred":             true,
+	"converted_to_discussion": true,
+}
+
+// issueURL returns the document ID for the issue of event e.
+func issueURL(e *github.Event) string {
+	return fmt.Sprintf("https://github.com/%s/issues/%d", e.Project, e.Issue)
+}
+
 // Restart causes the next call to Sync to behave as if
 // it has never sync'ed any issues before.
 // The result is that all issues will be reconverted to doc form
@@ -5,6 +5,8 @@
 package githubdocs
 
 import (
+	"context"
+	"fmt"
 	"testing"
 
 	"rsc.io/gaby/internal/docs"
@@ -13,6 +15,8 @@ import (
 	"rsc.io/gaby/internal/testutil"
 )
 
+var ctx = context.Background()
+
 func TestMarkdown(t *testing.T) {
 	check := testutil.Checker(t)
 	lg := testutil.Slogger(t)
@@ -21,7 +25,7 @@ func TestMarkdown(t *testing.T) {
 	check(gh.Testing().LoadTxtar("../testdata/markdown.txt"))
 
 	dc := docs.New(db)
-	Sync(lg, dc, gh)
+	Sync(ctx, lg, dc, gh)
 
 	var want = []string{
 		"https://github.com/rsc/markdown/issues/1",
@@ -59,6 +63,12 @@ func TestMarkdown(t *testing.T) {
 			if d.Text != md1Text {
 				t.Errorf("#1 Text = %q, want %q", d.Text, md1Text)
 			}
+			if d.Kind != docs.KindIssue {
+				t.Errorf("#1 Kind = %q, want %q", d.Kind, docs.KindIssue)
+			}
+		}
+		if d.ID == "https://github.com/rsc/markdown/issues/10" && d.Kind != docs.KindCL {
+			t.Errorf("#10 (pull request) Kind = %q, want %q", d.Kind, docs.KindCL)
 		}
 	}
 	if len(want) > 0 {
@@ -66,20 +76,43 @@ func TestMarkdown(t *testing.T) {
 	}
 
 	dc.Add("https://github.com/rsc/markdown/issues/1", "OLD TITLE", "OLD TEXT")
-	Sync(lg, dc, gh)
+	Sync(ctx, lg, dc, gh)
 	d, _ := dc.Get(md1)
 	if d.Title != "OLD TITLE" || d.Text != "OLD TEXT" {
 		t.Errorf("Sync rewrote #1: Title=%q Text=%q, want OLD TITLE, OLD TEXT", d.Title, d.Text)
 	}
 
 	Restart(lg, gh)
-	Sync(lg, dc, gh)
+	Sync(ctx, lg, dc, gh)
 	d, _ = dc.Get(md1)
 	if d.Title == "OLD TITLE" || d.Text == "OLD TEXT" {
 		t.Errorf("Restart+Sync did not rewrite #1: Title=%q Text=%q", d.Title, d.Text)
 	}
 }
 
+func TestRemoved(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	tc := gh.Testing()
+	for i := range 3 {
+		tc.AddIssue("rsc/tmp", &github.Issue{Number: int64(i + 1), Title: "title", Body: "body"})
+	}
+	dc := docs.New(db)
+	Sync(ctx, lg, dc, gh)
+
+	tc.AddIssueEvent("rsc/tmp", 1, &github.IssueEvent{Event: "transferred"})
+	tc.AddIssueEvent("rsc/tmp", 2, &github.IssueEvent{Event: "converted_to_discussion"})
+	tc.AddIssueEvent("rsc/tmp", 3, &github.IssueEvent{Event: "labeled"})
+	Sync(ctx, lg, dc, gh)
+	for i, want := range []bool{false, false, true} {
+		url := fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", i+1)
+		if _, ok := dc.Get(url); ok != want {
+			t.Errorf("Get(%s) = %v, want %v", url, ok, want)
+		}
+	}
+}
+
 var (
 	md1      = "https://github.com/rsc/markdown/issues/1"
 	md1Title = "Support Github Emojis"
@@ -14,27 +14,45 @@ import (
 	"bufio"
 	"bytes"
 	"cmp"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
-var record = new(string)
+var (
+	record        = new(string)
+	recordMissing = new(string)
+	maxAge        = new(time.Duration)
+	failStale     = new(bool)
+)
 
 func init() {
 	if testing.Testing() {
 		record = flag.String("httprecord", "", "re-record traces for files matching `regexp`")
+		recordMissing = flag.String("httprecordmissing", "", "record only requests missing from traces for files matching `regexp`")
+		maxAge = flag.Duration("httpmaxage", 180*24*time.Hour, "warn about replaying traces recorded more than `duration` ago")
+		failStale = flag.Bool("httpfailstale", false, "fail instead of warning about traces older than -httpmaxage")
 	}
 }
 
+// timeNow is time.Now, for testing.
+var timeNow = time.Now
+
 // A RecordReplay is an [http.RoundTripper] that can operate in two modes: record and replay.
 //
 // In record mode, the RecordReplay invokes another RoundTripper
@@ -42,15 +60,37 @@ func init() {
 //
 // In replay mode, the RecordReplay responds to requests by finding
 // an identical request in the log and sending the logged response.
+// If the log contains multiple identical requests, as happens with
+// retry and polling loops, the RecordReplay sends their responses
+// in the order they were logged, repeating the last one
+// once the others have been used.
+//
+// A RecordReplay is safe for concurrent use by multiple goroutines,
+// so that tests can issue requests from parallel subtests.
 type RecordReplay struct {
 	file string
 	real http.RoundTripper
 
-	mu     sync.Mutex
-	broken error
-	record *os.File
-	replay map[string]string
-	scrub  []func(*http.Request) error
+	mu        sync.Mutex
+	broken    error
+	record    *os.File     // current log file in record mode
+	zw        *gzip.Writer // compressor writing to record, or nil
+	w         io.Writer    // writer for log entries (record or zw)
+	written   int64        // bytes of log entries written to current file
+	split     int64        // maximum bytes of log entries per file; 0 for no limit
+	nfile     int          // number of continuation files
+	appending bool         // appending to an existing log (-httprecordmissing)
+	pattern   string       // -httprecord pattern being recorded, if any
+	recorded  time.Time    // time log was recorded
+	replay    map[string]*replayEntry
+	scrub     []func(*http.Request) error
+	rscrub    []func(*http.Response) error
+}
+
+// A replayEntry holds the logged responses for a single request.
+type replayEntry struct {
+	resps []string // responses, in log order
+	used  int      // number of times the request has been matched
 }
 
 // Scrub adds new scrubbing functions to rr.
@@ -68,7 +108,87 @@ func (rr *RecordReplay) Scrub(scrubs ...func(req *http.Request) error) {
 	rr.scrub = append(rr.scrub, scrubs...)
 }
 
-// Recording reports whether the rr is in recording mode.
+// IgnoreHeaders arranges for rr to ignore the named request headers,
+// such as request IDs or client version strings,
+// by deleting them when scrubbing requests (see [RecordReplay.Scrub]).
+func (rr *RecordReplay) IgnoreHeaders(names ...string) {
+	rr.Scrub(func(req *http.Request) error {
+		for _, name := range names {
+			req.Header.Del(name)
+		}
+		return nil
+	})
+}
+
+// UnorderedQuery arranges for rr to treat URL query parameters as unordered,
+// by sorting them by key when scrubbing requests (see [RecordReplay.Scrub]).
+// The order of multiple values for a single key is preserved.
+func (rr *RecordReplay) UnorderedQuery() {
+	rr.Scrub(func(req *http.Request) error {
+		if req.URL.RawQuery != "" {
+			req.URL.RawQuery = req.URL.Query().Encode()
+		}
+		return nil
+	})
+}
+
+// CanonicalJSON arranges for rr to canonicalize JSON request bodies
+// when scrubbing requests (see [RecordReplay.Scrub]),
+// so that requests differing only in JSON spacing or object key order match.
+// The canonical form is compact, with object keys sorted.
+// Bodies that are not valid JSON are left unchanged.
+func (rr *RecordReplay) CanonicalJSON() {
+	rr.Scrub(canonicalJSON)
+}
+
+// canonicalJSON is a scrub function implementing [RecordReplay.CanonicalJSON].
+func canonicalJSON(req *http.Request) error {
+	if req.Body == nil {
+		return nil
+	}
+	body := req.Body.(*Body)
+	if !json.Valid(body.Data) {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body.Data))
+	dec.UseNumber() // preserve numbers exactly
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		// unreachable unless json.Valid and json.Decoder disagree
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		// unreachable
+		return err
+	}
+	body.Data = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	return nil
+}
+
+// ScrubResponse adds new response scrubbing functions to rr.
+//
+// In record mode, before saving a response in the record/replay log,
+// the RecordReplay calls each response scrub function, in the order they
+// were registered, to remove secrets and other unwanted data,
+// such as credentials echoed by the server, rate-limit headers,
+// or email addresses.
+// The scrubbed response is also the one returned by [RecordReplay.RoundTrip],
+// so that record and replay modes behave identically.
+// A response scrub function can assume that if resp.Body is not nil,
+// then it has type [*Body].
+//
+// Calling ScrubResponse adds to the list of registered response
+// scrubbing functions; it does not replace those registered by earlier calls.
+func (rr *RecordReplay) ScrubResponse(scrubs ...func(resp *http.Response) error) {
+	rr.rscrub = append(rr.rscrub, scrubs...)
+}
+
+// Recording reports whether the rr is in recording mode,
+// including the incremental mode enabled by -httprecordmissing.
+// In either case, rr may make actual HTTP requests.
 func (rr *RecordReplay) Recording() bool {
 	return rr.record != nil
 }
@@ -85,74 +205,304 @@ func (rr *RecordReplay) Recording() bool {
 // the file as a new log. In that mode, [RecordReplay.RoundTrip]
 // makes actual HTTP requests using rt but then logs the requests and
 // responses to the file for replaying in a future run.
+// If the file name ends in ".gz", the recorded log is compressed.
+// (Replay mode reads compressed and uncompressed logs regardless of name.)
+//
+// If instead the command-line flag -httprecordmissing is set to a
+// non-empty regular expression that matches file, then Open opens
+// the existing log (or creates a new one, if the file does not exist)
+// in an incremental mode: [RecordReplay.RoundTrip] replays requests
+// found in the log and makes actual HTTP requests using rt only for
+// requests that are missing from it, appending them to the log.
+// This is useful when a test gains a few new requests,
+// since the rest of the trace need not be re-recorded.
+//
+// A recorded log notes the time it was recorded (see [RecordReplay.Recorded]).
+// When Open replays a log recorded more than -httpmaxage ago
+// (default 180 days), it prints a warning suggesting that the
+// log be re-recorded, since the recorded servers' behavior may have changed.
+// If the -httpfailstale flag is set, Open returns an error instead.
 func Open(file string, rt http.RoundTripper) (*RecordReplay, error) {
-	if *record != "" {
-		re, err := regexp.Compile(*record)
-		if err != nil {
-			return nil, fmt.Errorf("invalid -httprecord flag: %v", err)
-		}
-		if re.MatchString(file) {
-			return create(file, rt)
-		}
+	if ok, err := matchFlag("httprecord", *record, file); err != nil {
+		return nil, err
+	} else if ok {
+		return createFor(file, rt, *record)
+	}
+	if ok, err := matchFlag("httprecordmissing", *recordMissing, file); err != nil {
+		return nil, err
+	} else if ok {
+		return openMissing(file, rt)
+	}
+	rr, err := open(file, rt)
+	if err != nil {
+		return nil, err
+	}
+	if err := rr.checkAge(); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// checkAge checks that rr's trace is no older than -httpmaxage,
+// printing a warning or, if -httpfailstale is set, returning an error
+// when it is. Traces with no recording time are not checked.
+func (rr *RecordReplay) checkAge() error {
+	if *maxAge <= 0 || rr.recorded.IsZero() {
+		return nil
+	}
+	age := timeNow().Sub(rr.recorded)
+	if age <= *maxAge {
+		return nil
+	}
+	msg := fmt.Sprintf("httprr: %s: trace recorded %s ago (at %s), more than -httpmaxage=%v; re-record with -httprecord",
+		rr.file, age.Round(time.Hour), rr.recorded.Format(time.RFC3339), *maxAge)
+	if *failStale {
+		return errors.New(msg)
 	}
-	return open(file, rt)
+	log.Print(msg)
+	return nil
 }
 
+// matchFlag reports whether the regexp pattern, the value of the named flag,
+// matches file. An empty pattern matches nothing.
+func matchFlag(name, pattern, file string) (bool, error) {
+	if pattern == "" {
+		return false, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid -%s flag: %v", name, err)
+	}
+	return re.MatchString(file), nil
+}
+
+// Trace file headers. A v1 trace holds the log entries directly.
+// A v2 trace holds a gzip-compressed stream of the log entries.
+const (
+	header   = "httprr trace v1\n"
+	headerGz = "httprr trace v2 gzip\n"
+)
+
 // creates creates a new record-mode RecordReplay in the file.
+// If the file name ends in ".gz", the log is compressed.
 // TODO maybe export
 func create(file string, rt http.RoundTripper) (*RecordReplay, error) {
+	return createFor(file, rt, "")
+}
+
+// createFor is like create but notes in the log that it is
+// being recorded for the -httprecord pattern.
+func createFor(file string, rt http.RoundTripper, pattern string) (*RecordReplay, error) {
+	// Remove continuation files from an earlier recording.
+	for i := 1; ; i++ {
+		if err := os.Remove(contFile(file, i)); err != nil {
+			break
+		}
+	}
+	rr := &RecordReplay{
+		file:     file,
+		real:     rt,
+		pattern:  pattern,
+		recorded: timeNow().UTC().Truncate(time.Second),
+	}
+	if err := rr.startFile(file); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// contFile returns the name of the i'th continuation file for file.
+func contFile(file string, i int) string {
+	return fmt.Sprintf("%s.%d", file, i)
+}
+
+// startFile creates the named file and starts logging to it.
+func (rr *RecordReplay) startFile(file string) error {
 	f, err := os.Create(file)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	hdr := header
+	if strings.HasSuffix(rr.file, ".gz") {
+		hdr = headerGz
+	}
+	// Metadata lines follow the header line.
+	hdr += "# recorded " + rr.recorded.Format(time.RFC3339) + "\n"
+	if rr.pattern != "" {
+		hdr += "# httprecord " + rr.pattern + "\n"
 	}
-	if _, err := fmt.Fprintf(f, "httprr trace v1\n"); err != nil {
+	if _, err := f.WriteString(hdr); err != nil {
 		// unreachable unless write error immediately after os.Create
 		f.Close()
-		return nil, err
+		return err
 	}
-	rr := &RecordReplay{
-		file:   file,
-		real:   rt,
-		record: f,
+	rr.record, rr.zw, rr.w, rr.written = f, nil, f, 0
+	if strings.HasPrefix(hdr, headerGz) {
+		rr.zw = gzip.NewWriter(f)
+		rr.w = rr.zw
 	}
-	return rr, nil
+	return nil
 }
 
-// open opens a replay-mode RecordReplay using the data in the file.
+// closeFile flushes and closes the current log file.
+func (rr *RecordReplay) closeFile() error {
+	var err error
+	if rr.zw != nil {
+		err = rr.zw.Close()
+	}
+	return cmp.Or(err, rr.record.Close())
+}
+
+// SetMaxFileSize sets the approximate maximum size of a trace file
+// in record mode to n bytes (before compression),
+// which keeps the traces of large tests under repository file size limits.
+// The default, 0, means no limit.
+// After a file reaches n bytes, the RecordReplay continues
+// the log in a new file named by adding ".1", ".2", and so on to
+// the original file name. In replay mode, [Open] reads the
+// original file and any continuation files.
+func (rr *RecordReplay) SetMaxFileSize(n int64) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.split = n
+}
+
+// open opens a replay-mode RecordReplay using the data in the file
+// and any continuation files.
 func open(file string, rt http.RoundTripper) (*RecordReplay, error) {
 	// Note: To handle larger traces without storing entirely in memory,
 	// could instead read the file incrementally, storing a map[hash]offsets
 	// and then reread the relevant part of the file during RoundTrip.
 
-	bdata, err := os.ReadFile(file)
+	replay := make(map[string]*replayEntry)
+	nfile := 0
+	var recorded time.Time
+	for i := 0; ; i++ {
+		name := file
+		if i > 0 {
+			name = contFile(file, i)
+			if _, err := os.Stat(name); err != nil {
+				break
+			}
+			nfile = i
+		}
+		t, err := readTrace(name, replay)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			recorded = t
+		}
+	}
+
+	rr := &RecordReplay{
+		file:     file,
+		real:     rt,
+		replay:   replay,
+		nfile:    nfile,
+		recorded: recorded,
+	}
+	return rr, nil
+}
+
+// openMissing opens an incremental-mode RecordReplay using the data in
+// the file and any continuation files, appending new entries to the
+// last of them. If file does not exist, openMissing creates it.
+func openMissing(file string, rt http.RoundTripper) (*RecordReplay, error) {
+	if _, err := os.Stat(file); errors.Is(err, fs.ErrNotExist) {
+		return create(file, rt)
+	}
+	rr, err := open(file, rt)
+	if err != nil {
+		return nil, err
+	}
+	last := file
+	if rr.nfile > 0 {
+		last = contFile(file, rr.nfile)
+	}
+	f, err := os.OpenFile(last, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, len(headerGz))
+	n, _ := f.ReadAt(hdr, 0)
+	info, err := f.Stat()
 	if err != nil {
+		// unreachable unless file system error immediately after open
+		f.Close()
 		return nil, err
 	}
+	rr.record, rr.w, rr.written = f, f, info.Size()
+	rr.appending = true
+	if string(hdr[:n]) == headerGz {
+		// A gzip file can hold multiple concatenated streams,
+		// so appending a new stream is fine.
+		rr.zw = gzip.NewWriter(f)
+		rr.w = rr.zw
+	}
+	return rr, nil
+}
+
+// readTrace reads the log entries in the named file into replay.
+// It returns the recording time noted in the file, if any.
+func readTrace(file string, replay map[string]*replayEntry) (time.Time, error) {
+	var recorded time.Time
+	bdata, err := os.ReadFile(file)
+	if err != nil {
+		return recorded, err
+	}
 	data := string(bdata)
-	line, data, ok := strings.Cut(data, "\n")
-	if !ok || line != "httprr trace v1" {
-		return nil, fmt.Errorf("read %s: not an httprr trace", file)
+	var gz bool
+	switch {
+	case strings.HasPrefix(data, header):
+		data = data[len(header):]
+	case strings.HasPrefix(data, headerGz):
+		data = data[len(headerGz):]
+		gz = true
+	default:
+		return recorded, fmt.Errorf("read %s: not an httprr trace", file)
+	}
+	for strings.HasPrefix(data, "# ") {
+		line, rest, _ := strings.Cut(data, "\n")
+		data = rest
+		if v, ok := strings.CutPrefix(line, "# recorded "); ok {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return recorded, fmt.Errorf("read %s: corrupt httprr trace: %v", file, err)
+			}
+			recorded = t
+		}
+	}
+	if gz {
+		zr, err := gzip.NewReader(strings.NewReader(data))
+		if err != nil {
+			return recorded, fmt.Errorf("read %s: corrupt httprr trace: %v", file, err)
+		}
+		bdata, err := io.ReadAll(zr)
+		if err != nil {
+			return recorded, fmt.Errorf("read %s: corrupt httprr trace: %v", file, err)
+		}
+		data = string(bdata)
 	}
-	replay := make(map[string]string)
 	for data != "" {
-		line, data, ok = strings.Cut(data, "\n")
+		line, rest, ok := strings.Cut(data, "\n")
+		data = rest
 		f1, f2, _ := strings.Cut(line, " ")
 		n1, err1 := strconv.Atoi(f1)
 		n2, err2 := strconv.Atoi(f2)
 		if !ok || err1 != nil || err2 != nil || n1 > len(data) || n2 > len(data[n1:]) {
-			return nil, fmt.Errorf("read %s: corrupt httprr trace", file)
+			return recorded, fmt.Errorf("read %s: corrupt httprr trace", file)
 		}
 		var req, resp string
 		req, resp, data = data[:n1], data[n1:n1+n2], data[n1+n2:]
-		replay[req] = resp
-	}
-
-	rr := &RecordReplay{
-		file:   file,
-		real:   rt,
-		replay: replay,
+		e := replay[req]
+		if e == nil {
+			e = new(replayEntry)
+			replay[req] = e
+		}
+		e.resps = append(e.resps, resp)
 	}
-	return rr, nil
+	return recorded, nil
 }
 
 // Client returns an http.Client using rr as its transport.
@@ -231,14 +581,25 @@ func (rr *RecordReplay) RoundTrip(req *http.Request) (*http.Response, error) {
 	key := bkey.String()
 
 	if rr.replay != nil {
-		if respWire, ok := rr.replay[key]; ok {
+		rr.mu.Lock()
+		e := rr.replay[key]
+		var respWire string
+		if e != nil {
+			respWire = e.resps[min(e.used, len(e.resps)-1)]
+			e.used++
+		}
+		rr.mu.Unlock()
+		if e != nil {
 			resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(respWire)), req)
 			if err != nil {
 				return nil, fmt.Errorf("read %s: corrupt httprr trace: %v", rr.file, err)
 			}
 			return resp, nil
 		}
-		return nil, fmt.Errorf("cached HTTP response not found for:\n%s", key)
+		if rr.record == nil {
+			return nil, fmt.Errorf("cached HTTP response not found for:\n%s", key)
+		}
+		// Otherwise, in incremental mode, record the missing request.
 	}
 
 	rr.mu.Lock()
@@ -252,6 +613,9 @@ func (rr *RecordReplay) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := rr.scrubResponse(resp); err != nil {
+		return nil, err
+	}
 
 	var respBuf strings.Builder
 	if err := resp.Write(&respBuf); err != nil {
@@ -271,18 +635,92 @@ func (rr *RecordReplay) RoundTrip(req *http.Request) (*http.Response, error) {
 		// unreachable unless concurrent I/O error; checked above
 		return nil, rr.broken
 	}
-	_, err1 := fmt.Fprintf(rr.record, "%d %d\n", len(key), len(respWire))
-	_, err2 := rr.record.WriteString(key)
-	_, err3 := rr.record.WriteString(respWire)
-	if err := cmp.Or(err1, err2, err3); err != nil {
+	if err := rr.writeEntry(key, respWire); err != nil {
 		rr.broken = err
 		rr.record.Close()
-		os.Remove(rr.file)
+		if !rr.appending {
+			os.Remove(rr.file)
+			for i := 1; i <= rr.nfile; i++ {
+				os.Remove(contFile(rr.file, i))
+			}
+		}
 		return nil, err
 	}
 	return resp, nil
 }
 
+// scrubResponse applies the response scrubbers to resp.
+func (rr *RecordReplay) scrubResponse(resp *http.Response) error {
+	if len(rr.rscrub) == 0 {
+		return nil
+	}
+	if resp.Body != nil {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = &Body{Data: data}
+	}
+	for _, scrub := range rr.rscrub {
+		if err := scrub(resp); err != nil {
+			return err
+		}
+	}
+	if b, ok := resp.Body.(*Body); ok {
+		// The body is now fully known; record it without chunking.
+		resp.ContentLength = int64(len(b.Data))
+		resp.TransferEncoding = nil
+	}
+	return nil
+}
+
+// writeEntry logs the (request, response) pair,
+// starting a new continuation file if the current one is full.
+// rr.mu must be held.
+func (rr *RecordReplay) writeEntry(req, resp string) error {
+	if rr.split > 0 && rr.written >= rr.split {
+		if err := rr.closeFile(); err != nil {
+			return err
+		}
+		rr.nfile++
+		if err := rr.startFile(contFile(rr.file, rr.nfile)); err != nil {
+			return err
+		}
+	}
+	n1, err1 := fmt.Fprintf(rr.w, "%d %d\n", len(req), len(resp))
+	n2, err2 := io.WriteString(rr.w, req)
+	n3, err3 := io.WriteString(rr.w, resp)
+	rr.written += int64(n1 + n2 + n3)
+	return cmp.Or(err1, err2, err3)
+}
+
+// Recorded returns the time rr's log was recorded,
+// or the zero time if the log does not say.
+// (Logs written before httprr noted recording times do not.)
+func (rr *RecordReplay) Recorded() time.Time {
+	return rr.recorded
+}
+
+// Unused returns the logged requests with responses that have not been
+// sent in replay mode, in sorted order. A logged request appears in the
+// result once for each unsent response. After a test completes,
+// a non-empty result usually means the trace is stale and
+// should be re-recorded.
+// In record mode, Unused returns nil.
+func (rr *RecordReplay) Unused() []string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	var list []string
+	for req, e := range rr.replay {
+		for range len(e.resps) - min(e.used, len(e.resps)) {
+			list = append(list, req)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
+
 // Close closes the RecordReplay.
 // It is a no-op in replay mode.
 func (rr *RecordReplay) Close() error {
@@ -290,7 +728,7 @@ func (rr *RecordReplay) Close() error {
 		return rr.broken
 	}
 	if rr.record != nil {
-		return rr.record.Close()
+		return rr.closeFile()
 	}
 	return nil
 }
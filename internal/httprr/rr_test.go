@@ -5,14 +5,20 @@
 package httprr
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"testing/iotest"
+	"time"
 )
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -243,7 +249,7 @@ func TestErrors(t *testing.T) {
 	// error during Write logging request
 	srv := httptest.NewServer(http.HandlerFunc(always555))
 	defer srv.Close()
-	rr, err = create(os.DevNull, http.DefaultTransport)
+	rr, err = create(dir+"/broken", http.DefaultTransport) // not os.DevNull: the write error removes the file
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -295,3 +301,439 @@ func (badRespTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	resp.Body = io.NopCloser(iotest.ErrReader(errors.New("TRANSPORT ERROR")))
 	return resp, nil
 }
+
+func TestReplayOrder(t *testing.T) {
+	file := t.TempDir() + "/rr"
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/count" {
+			n++
+			fmt.Fprintf(w, "%d", n)
+		} else {
+			fmt.Fprintf(w, "%s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	get := func(rr *RecordReplay, path string) string {
+		t.Helper()
+		resp, err := rr.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	rr, err := create(file, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		get(rr, "/count")
+	}
+	for i := range 10 {
+		get(rr, fmt.Sprintf("/p%d", i))
+	}
+	if err := rr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, err = open(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Identical requests get their responses in order,
+	// with the last one repeated.
+	var got []string
+	for range 4 {
+		got = append(got, get(rr, "/count"))
+	}
+	if want := []string{"1", "2", "3", "3"}; !slices.Equal(got, want) {
+		t.Errorf("replayed /count = %q, want %q", got, want)
+	}
+
+	// Concurrent requests are safe, and unsent responses are reported.
+	var wg sync.WaitGroup
+	for i := range 9 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/p%d", i)
+			resp, err := rr.Client().Get(srv.URL + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != path {
+				t.Errorf("GET %s = %q", path, body)
+			}
+		}()
+	}
+	wg.Wait()
+	unused := rr.Unused()
+	if len(unused) != 1 || !strings.Contains(unused[0], "/p9 ") {
+		t.Errorf("Unused() = %q, want just /p9", unused)
+	}
+}
+
+func TestCompressSplit(t *testing.T) {
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL.Path, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+
+	get := func(rr *RecordReplay, path string) {
+		t.Helper()
+		resp, err := rr.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasPrefix(string(body), path+" ") {
+			t.Fatalf("GET %s = %.20q...", path, body)
+		}
+	}
+
+	for _, name := range []string{"rr", "rr.gz"} {
+		file := dir + "/" + name
+		os.WriteFile(file+".9", []byte("stale"), 0666)
+		os.WriteFile(file+".1", []byte("stale"), 0666)
+		rr, err := create(file, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr.SetMaxFileSize(2000)
+		for i := range 5 {
+			get(rr, fmt.Sprintf("/%d", i))
+		}
+		if err := rr.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each file holds two entries.
+		// The stale .9 file is not part of the trace, because .3 is missing.
+		for i, want := range []bool{true, true, true, false} {
+			f := file
+			if i > 0 {
+				f = contFile(file, i)
+			}
+			data, err := os.ReadFile(f)
+			if (err == nil) != want {
+				t.Fatalf("%s: exists=%v, want %v", f, err == nil, want)
+			}
+			if err != nil {
+				continue
+			}
+			gz := strings.HasPrefix(string(data), headerGz)
+			if gz != strings.HasSuffix(name, ".gz") {
+				t.Errorf("%s: compressed=%v, want %v", f, gz, !gz)
+			}
+			if gz && len(data) > 1000 {
+				t.Errorf("%s: compressed to %d bytes, want less", f, len(data))
+			}
+		}
+
+		rr, err = open(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 5 {
+			get(rr, fmt.Sprintf("/%d", i))
+		}
+		if u := rr.Unused(); len(u) != 0 {
+			t.Errorf("Unused() = %q", u)
+		}
+	}
+
+	// Corrupt compressed data.
+	os.WriteFile(dir+"/bad", []byte(headerGz+"garbage"), 0666)
+	if _, err := open(dir+"/bad", nil); err == nil || !strings.Contains(err.Error(), "corrupt httprr trace") {
+		t.Errorf("did not diagnose corrupt compressed trace: err = %v", err)
+	}
+}
+
+func TestScrubResponse(t *testing.T) {
+	file := t.TempDir() + "/rr"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Token", "my Secret")
+		fmt.Fprintf(w, "hello, my Secret is here")
+	}))
+	defer srv.Close()
+
+	dropToken := func(resp *http.Response) error {
+		resp.Header.Del("Token")
+		return nil
+	}
+	redactBody := func(resp *http.Response) error {
+		b := resp.Body.(*Body)
+		b.Data = []byte(strings.ReplaceAll(string(b.Data), "my Secret", "[redacted]"))
+		return nil
+	}
+
+	check := func(rr *RecordReplay) {
+		t.Helper()
+		resp, err := rr.Client().Get(srv.URL + "/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello, [redacted] is here" || resp.Header.Get("Token") != "" {
+			t.Errorf("response: Token=%q body=%q, want scrubbed", resp.Header.Get("Token"), body)
+		}
+	}
+
+	rr, err := create(file, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.ScrubResponse(dropToken)
+	rr.ScrubResponse(redactBody)
+	check(rr)
+	if err := rr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Secret") {
+		t.Fatalf("rr file contains Secret:\n%s", data)
+	}
+
+	rr, err = open(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rr)
+
+	// error during response scrub
+	rr, err = create(os.DevNull, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.ScrubResponse(func(*http.Response) error { return errors.New("SCRUB ERROR") })
+	if _, err := rr.Client().Get(srv.URL); err == nil || !strings.Contains(err.Error(), "SCRUB ERROR") {
+		t.Errorf("did not report failure from response scrub: err = %v", err)
+	}
+	rr.Close()
+}
+
+func TestRecordMissing(t *testing.T) {
+	defer func() { *recordMissing = "" }()
+	dir := t.TempDir()
+	live := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		live++
+		fmt.Fprintf(w, "%s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	get := func(rr *RecordReplay, path string) {
+		t.Helper()
+		resp, err := rr.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Fatalf("GET %s = %q", path, body)
+		}
+	}
+
+	for _, name := range []string{"rr", "rr.gz"} {
+		file := dir + "/" + name
+		live = 0
+
+		// With no trace, incremental mode records everything.
+		*recordMissing = "rr"
+		rr, err := Open(file, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rr.Recording() {
+			t.Fatalf("Open with -httprecordmissing: not recording")
+		}
+		get(rr, "/a")
+		if err := rr.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// With a trace, only missing requests are made and recorded.
+		rr, err = Open(file, http.DefaultTransport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get(rr, "/a")
+		get(rr, "/b")
+		if err := rr.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if live != 2 {
+			t.Errorf("%s: made %d live requests, want 2", name, live)
+		}
+
+		// The appended trace replays both.
+		*recordMissing = ""
+		rr, err = Open(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get(rr, "/a")
+		get(rr, "/b")
+		if u := rr.Unused(); len(u) != 0 {
+			t.Errorf("%s: Unused() = %q", name, u)
+		}
+	}
+
+	*recordMissing = "+"
+	if _, err := Open(os.DevNull, nil); err == nil || !strings.Contains(err.Error(), "invalid -httprecordmissing flag") {
+		t.Errorf("did not diagnose bad -httprecordmissing: err = %v", err)
+	}
+}
+
+func TestStale(t *testing.T) {
+	defer func() {
+		timeNow = time.Now
+		*record = ""
+		*failStale = false
+		log.SetOutput(os.Stderr)
+	}()
+	file := t.TempDir() + "/rr"
+	recorded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	timeNow = func() time.Time { return recorded }
+
+	*record = "rr$"
+	rr, err := Open(file, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	*record = ""
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := header + "# recorded 2024-01-02T03:04:05Z\n# httprecord rr$\n"; string(data) != want {
+		t.Errorf("trace = %q, want %q", data, want)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	reopen := func() error {
+		t.Helper()
+		buf.Reset()
+		rr, err := Open(file, nil)
+		if err == nil && !rr.Recorded().Equal(recorded) {
+			t.Errorf("Recorded() = %v, want %v", rr.Recorded(), recorded)
+		}
+		return err
+	}
+
+	// A fresh trace is fine.
+	timeNow = func() time.Time { return recorded.Add(*maxAge) }
+	if err := reopen(); err != nil || buf.Len() != 0 {
+		t.Errorf("Open of fresh trace: err=%v, log=%q", err, buf.String())
+	}
+
+	// A stale trace gets a warning, or an error with -httpfailstale.
+	timeNow = func() time.Time { return recorded.Add(*maxAge + time.Hour) }
+	if err := reopen(); err != nil || !strings.Contains(buf.String(), "re-record") {
+		t.Errorf("Open of stale trace: err=%v, log=%q, want warning", err, buf.String())
+	}
+	*failStale = true
+	if err := reopen(); err == nil || !strings.Contains(err.Error(), "re-record") {
+		t.Errorf("Open of stale trace with -httpfailstale: err=%v, want error", err)
+	}
+
+	// Traces without a recording time are not checked.
+	os.WriteFile(file, []byte(header), 0666)
+	rr, err = Open(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rr.Recorded().IsZero() {
+		t.Errorf("Open of undated trace: Recorded() = %v, want zero time", rr.Recorded())
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	file := t.TempDir() + "/rr"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer srv.Close()
+
+	do := func(rr *RecordReplay, query, reqID, body string) error {
+		req, err := http.NewRequest("POST", srv.URL+"/x?"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Request-Id", reqID)
+		resp, err := rr.Client().Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	normalize := func(rr *RecordReplay) {
+		rr.IgnoreHeaders("Request-Id")
+		rr.UnorderedQuery()
+		rr.CanonicalJSON()
+	}
+
+	rr, err := create(file, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalize(rr)
+	if err := do(rr, "b=2&a=1&a=0", "123", `{"y": [1.50, "<&>"], "x": {"q": null, "p": true}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := do(rr, "", "", "not json {"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"/x?a=1&a=0&b=2 ", `{"x":{"p":true,"q":null},"y":[1.50,"<&>"]}`, "not json {"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("trace does not contain %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "Request-Id") {
+		t.Errorf("trace contains ignored header:\n%s", data)
+	}
+
+	rr, err = open(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalize(rr)
+	if err := do(rr, "a=1&b=2&a=0", "456", `{"x":{"p":true,"q":null},   "y":[1.50,"<&>"]}`); err != nil {
+		t.Errorf("replay of equivalent request: %v", err)
+	}
+	if err := do(rr, "a=0&b=2&a=1", "456", `{"x":{"p":true,"q":null},"y":[1.50,"<&>"]}`); err == nil {
+		t.Errorf("replay with reordered values succeeded")
+	}
+	if err := do(rr, "", "", "not json {"); err != nil {
+		t.Errorf("replay of non-JSON request: %v", err)
+	}
+}
@@ -4,7 +4,13 @@
 
 package llm
 
-import "math"
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
 
 const quoteLen = 123
 
@@ -13,8 +19,20 @@ const quoteLen = 123
 // is completely pointless for real use.
 // It encodes up to the first 122 bytes of each document
 // directly into the first 122 elements of a 123-element unit vector.
+//
+// See [QuoteEmbedderDim] for other vector sizes.
 func QuoteEmbedder() Embedder {
-	return quoter{}
+	return quoter(quoteLen)
+}
+
+// QuoteEmbedderDim is like [QuoteEmbedder] but returns
+// n-element vectors, encoding up to the first n-1 bytes
+// of each document. It panics if n < 2.
+func QuoteEmbedderDim(n int) Embedder {
+	if n < 2 {
+		panic("QuoteEmbedderDim with n < 2")
+	}
+	return quoter(n)
 }
 
 // quote quotes text into a vector.
@@ -23,8 +41,8 @@ func QuoteEmbedder() Embedder {
 // before normalization, so that the final entry of a
 // normalized vector lets us know scaling to reverse
 // to obtain the original bytes.
-func quote(text string) Vector {
-	v := make(Vector, quoteLen)
+func quote(text string, n int) Vector {
+	v := make(Vector, n)
 	var d float64
 	for i := range len(text) {
 		if i >= len(v)-1 {
@@ -47,23 +65,25 @@ func quote(text string) Vector {
 	return v
 }
 
-// quoter is a quoting Embedder, returned by QuoteEmbedder
-type quoter struct{}
+// quoter is a quoting Embedder, returned by QuoteEmbedder.
+// Its value is the vector length.
+type quoter int
 
 // EmbedDocs implements Embedder by quoting.
-func (quoter) EmbedDocs(docs []EmbedDoc) ([]Vector, error) {
+func (q quoter) EmbedDocs(_ context.Context, docs []EmbedDoc) ([]Vector, error) {
 	var vecs []Vector
 	for _, d := range docs {
-		vecs = append(vecs, quote(d.Text))
+		vecs = append(vecs, quote(d.Text, int(q)))
 	}
 	return vecs, nil
 }
 
 // UnquoteVector recovers the original text prefix
-// passed to a [QuoteEmbedder]'s EmbedDocs method.
+// passed to a [QuoteEmbedder]'s
+// or [QuoteEmbedderDim]'s EmbedDocs method.
 // Like QuoteEmbedder, UnquoteVector is only useful in tests.
 func UnquoteVector(v Vector) string {
-	if len(v) != quoteLen {
+	if len(v) < 2 || v[len(v)-1] >= 0 {
 		panic("UnquoteVector of non-quotation vector")
 	}
 	d := -1 / v[len(v)-1]
@@ -76,3 +96,60 @@ func UnquoteVector(v Vector) string {
 	}
 	return string(b)
 }
+
+// BagOfWordsEmbedder returns an implementation of Embedder that,
+// like [QuoteEmbedder], is meant only for testing.
+// Unlike QuoteEmbedder, its vectors behave somewhat like real embeddings:
+// documents that share more words have more similar vectors,
+// independent of word order, so tests of vector indexes, quantization,
+// and score cutoffs see realistic distributions of scores.
+//
+// Each document's title and text are split into lower-case words,
+// and each word adds ±1 to an element of an n-element vector
+// chosen by hashing the word. The result is normalized to a unit vector,
+// except that a document with no words has a zero vector.
+// The embedding is deterministic. BagOfWordsEmbedder panics if n < 1.
+func BagOfWordsEmbedder(n int) Embedder {
+	if n < 1 {
+		panic("BagOfWordsEmbedder with n < 1")
+	}
+	return bagOfWords(n)
+}
+
+// bagOfWords is a hashed bag-of-words Embedder, returned by BagOfWordsEmbedder.
+// Its value is the vector length.
+type bagOfWords int
+
+// EmbedDocs implements Embedder by hashing words.
+func (n bagOfWords) EmbedDocs(_ context.Context, docs []EmbedDoc) ([]Vector, error) {
+	var vecs []Vector
+	for _, d := range docs {
+		vecs = append(vecs, n.embed(d.Title+"\n"+d.Text))
+	}
+	return vecs, nil
+}
+
+func (n bagOfWords) embed(text string) Vector {
+	v := make(Vector, n)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		h := fnv.New64a()
+		h.Write([]byte(w))
+		x := h.Sum64()
+		if x&1 == 0 {
+			v[(x>>1)%uint64(n)]++
+		} else {
+			v[(x>>1)%uint64(n)]--
+		}
+	}
+	d := math.Sqrt(v.Dot(v))
+	if d == 0 {
+		return v
+	}
+	for i := range v {
+		v[i] /= float32(d)
+	}
+	return v
+}
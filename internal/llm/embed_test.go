@@ -6,13 +6,17 @@ package llm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"testing"
 )
 
+var ctx = context.Background()
+
 func TestQuote(t *testing.T) {
 	docs := []EmbedDoc{{Text: "abc"}, {Text: "alphabetical order"}}
-	vecs, err := QuoteEmbedder().EmbedDocs(docs)
+	vecs, err := QuoteEmbedder().EmbedDocs(ctx, docs)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,3 +41,55 @@ func TestQuote(t *testing.T) {
 		}
 	}
 }
+
+func TestQuoteDim(t *testing.T) {
+	vecs, err := QuoteEmbedderDim(5).EmbedDocs(ctx, []EmbedDoc{{Text: "ab"}, {Text: "abcdefg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"ab", "abcd"} {
+		if len(vecs[i]) != 5 {
+			t.Errorf("len(vecs[%d]) = %d, want 5", i, len(vecs[i]))
+		}
+		if u := UnquoteVector(vecs[i]); u != want {
+			t.Errorf("UnquoteVector(vecs[%d]) = %q, want %q", i, u, want)
+		}
+		if d := vecs[i].Dot(vecs[i]); math.Abs(d-1) > 1e-6 {
+			t.Errorf("vecs[%d] has length² %v, want 1", i, d)
+		}
+	}
+}
+
+func TestBagOfWords(t *testing.T) {
+	docs := []EmbedDoc{
+		{Title: "net/http: server panics", Text: "The server panics on an empty Host header."},
+		{Title: "net/http: panic on empty Host", Text: "The HTTP server panics when the Host header is empty."},
+		{Title: "time: Parse accepts invalid month", Text: "Parsing 2024-13-01 does not fail."},
+		{Text: "  ...  "},
+	}
+	e := BagOfWordsEmbedder(256)
+	vecs, err := e.EmbedDocs(ctx, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vecs[:3] {
+		if len(v) != 256 {
+			t.Errorf("len(vecs[%d]) = %d, want 256", i, len(v))
+		}
+		if d := v.Dot(v); math.Abs(d-1) > 1e-6 {
+			t.Errorf("vecs[%d] has length² %v, want 1", i, d)
+		}
+	}
+	if d := vecs[3].Dot(vecs[3]); d != 0 {
+		t.Errorf("empty doc has length² %v, want 0", d)
+	}
+	if same, other := vecs[0].Dot(vecs[1]), vecs[0].Dot(vecs[2]); same < 0.5 || same <= other {
+		t.Errorf("similar docs score %.3f, different docs score %.3f", same, other)
+	}
+
+	// Deterministic and independent of word order and case.
+	again, _ := e.EmbedDocs(ctx, []EmbedDoc{{Text: "Empty host HEADER panics server the on an  net/http: server panics"}})
+	if d := again[0].Dot(vecs[0]); math.Abs(d-1) > 1e-6 {
+		t.Errorf("reordered doc scores %v, want 1", d)
+	}
+}
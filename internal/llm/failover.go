@@ -0,0 +1,135 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Fallback returns an Embedder that sends each EmbedDocs call to the
+// first of the embedders that is healthy, falling back to the next one
+// if that call fails. If an embedder returns a partial result,
+// the remaining documents are sent to the next embedder.
+//
+// An embedder that fails is considered unhealthy and is skipped
+// for a backoff period, starting at one minute and doubling with each
+// consecutive failure, up to one hour. A successful call resets it.
+// If all embedders are unhealthy, each is tried anyway, in order.
+//
+// The embedders must produce compatible vectors: they should be
+// different providers or endpoints for the same embedding model,
+// such as the Gemini API and Vertex AI versions of text-embedding-004.
+// Mixing vectors from different models in one vector database
+// makes similarity search meaningless.
+func Fallback(embedders ...Embedder) Embedder {
+	return newPool(false, embedders)
+}
+
+// RoundRobin returns an Embedder that spreads EmbedDocs calls
+// across the embedders, starting each call at the next healthy
+// embedder in rotation and otherwise behaving like [Fallback].
+// As with Fallback, the embedders must produce compatible vectors.
+func RoundRobin(embedders ...Embedder) Embedder {
+	return newPool(true, embedders)
+}
+
+const (
+	minBackoff = 1 * time.Minute
+	maxBackoff = 1 * time.Hour
+)
+
+// A pool is the implementation of Fallback and RoundRobin.
+type pool struct {
+	rotate bool
+	now    func() time.Time
+
+	mu      sync.Mutex
+	members []*member
+	next    int // next member to start at, when rotating
+}
+
+// A member is an embedder in a pool, with its health.
+type member struct {
+	e         Embedder
+	failures  int       // consecutive failures
+	downUntil time.Time // skip until this time
+}
+
+func newPool(rotate bool, embedders []Embedder) *pool {
+	p := &pool{rotate: rotate, now: time.Now}
+	for _, e := range embedders {
+		p.members = append(p.members, &member{e: e})
+	}
+	return p
+}
+
+// order returns the members in the order they should be tried:
+// healthy ones first, then unhealthy ones.
+func (p *pool) order() []*member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := 0
+	if p.rotate && len(p.members) > 0 {
+		start = p.next
+		p.next = (p.next + 1) % len(p.members)
+	}
+	now := p.now()
+	var healthy, unhealthy []*member
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		if now.Before(m.downUntil) {
+			unhealthy = append(unhealthy, m)
+		} else {
+			healthy = append(healthy, m)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// update records the outcome of a call to m.
+func (p *pool) update(m *member, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		m.failures = 0
+		m.downUntil = time.Time{}
+		return
+	}
+	backoff := maxBackoff
+	if m.failures < 6 { // 1<<6 minutes > maxBackoff
+		backoff = min(minBackoff<<m.failures, maxBackoff)
+	}
+	m.failures++
+	m.downUntil = p.now().Add(backoff)
+}
+
+// EmbedDocs implements [Embedder].
+// A failure caused by canceling ctx does not count against the embedder,
+// and EmbedDocs does not fall back to the next one.
+func (p *pool) EmbedDocs(ctx context.Context, docs []EmbedDoc) ([]Vector, error) {
+	if len(p.members) == 0 {
+		return nil, errors.New("llm: no embedders")
+	}
+	var vecs []Vector
+	var err error
+	for _, m := range p.order() {
+		var v []Vector
+		v, err = m.e.EmbedDocs(ctx, docs[len(vecs):])
+		vecs = append(vecs, v...)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		p.update(m, err)
+		if err == nil {
+			break
+		}
+	}
+	return vecs, err
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// A flakyEmbedder is an Embedder that embeds at most limit documents
+// per call before failing (limit < 0 means no limit),
+// and records the documents it embedded.
+type flakyEmbedder struct {
+	name  string
+	limit int
+	docs  []string
+}
+
+func (e *flakyEmbedder) EmbedDocs(ctx context.Context, docs []EmbedDoc) ([]Vector, error) {
+	var vecs []Vector
+	for i, d := range docs {
+		if e.limit >= 0 && i >= e.limit {
+			return vecs, errors.New(e.name + " failed")
+		}
+		e.docs = append(e.docs, d.Text)
+		vecs = append(vecs, quote(d.Text, quoteLen))
+	}
+	return vecs, nil
+}
+
+func texts(list ...string) []EmbedDoc {
+	var docs []EmbedDoc
+	for _, s := range list {
+		docs = append(docs, EmbedDoc{Text: s})
+	}
+	return docs
+}
+
+func TestFallback(t *testing.T) {
+	a := &flakyEmbedder{name: "a", limit: 1}
+	b := &flakyEmbedder{name: "b", limit: -1}
+	e := Fallback(a, b)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.(*pool).now = func() time.Time { return now }
+
+	check := func(docs []EmbedDoc, wantA, wantB []string) {
+		t.Helper()
+		a.docs, b.docs = nil, nil
+		vecs, err := e.EmbedDocs(ctx, docs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vecs) != len(docs) {
+			t.Fatalf("EmbedDocs returned %d vectors, want %d", len(vecs), len(docs))
+		}
+		for i, v := range vecs {
+			if UnquoteVector(v) != docs[i].Text {
+				t.Errorf("vecs[%d] = %q, want %q", i, UnquoteVector(v), docs[i].Text)
+			}
+		}
+		if !slices.Equal(a.docs, wantA) || !slices.Equal(b.docs, wantB) {
+			t.Errorf("a embedded %q, b embedded %q; want %q, %q", a.docs, b.docs, wantA, wantB)
+		}
+	}
+
+	// a fails partway, so b finishes, and a is marked down.
+	check(texts("x", "y", "z"), []string{"x"}, []string{"y", "z"})
+	check(texts("w"), nil, []string{"w"})
+
+	// After the backoff, a is tried again, fails again,
+	// and is down for twice as long.
+	now = now.Add(minBackoff)
+	check(texts("u", "v"), []string{"u"}, []string{"v"})
+	now = now.Add(minBackoff)
+	check(texts("t"), nil, []string{"t"})
+	now = now.Add(minBackoff)
+	a.limit = -1
+	check(texts("s", "r"), []string{"s", "r"}, nil)
+
+	// If all fail, the error is returned with the partial result.
+	a.limit, b.limit = 1, 1
+	vecs, err := e.EmbedDocs(ctx, texts("1", "2", "3"))
+	if err == nil || err.Error() != "b failed" || len(vecs) != 2 {
+		t.Errorf("EmbedDocs with all failing = %d vectors, %v; want 2, b failed", len(vecs), err)
+	}
+
+	// Even when all are down, they are still tried.
+	a.limit, b.limit = -1, -1
+	check(texts("q"), []string{"q"}, nil)
+
+	if _, err := Fallback().EmbedDocs(ctx, texts("x")); err == nil {
+		t.Errorf("Fallback() succeeded")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := &flakyEmbedder{name: "a", limit: -1}
+	b := &flakyEmbedder{name: "b", limit: -1}
+	e := RoundRobin(a, b)
+	for _, s := range []string{"1", "2", "3", "4"} {
+		if _, err := e.EmbedDocs(ctx, texts(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"1", "3"}; !slices.Equal(a.docs, want) {
+		t.Errorf("a embedded %q, want %q", a.docs, want)
+	}
+	if want := []string{"2", "4"}; !slices.Equal(b.docs, want) {
+		t.Errorf("b embedded %q, want %q", b.docs, want)
+	}
+
+	// When b is down, a gets everything.
+	b.limit = 0
+	a.docs, b.docs = nil, nil
+	for _, s := range []string{"5", "6", "7"} {
+		if _, err := e.EmbedDocs(ctx, texts(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"5", "6", "7"}; !slices.Equal(a.docs, want) {
+		t.Errorf("a embedded %q, want %q", a.docs, want)
+	}
+}
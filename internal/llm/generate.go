@@ -0,0 +1,22 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import "strings"
+
+// EchoTextGenerator returns an implementation
+// of TextGenerator that can be useful for testing but
+// is completely pointless for real use.
+// It “generates” the prompt parts themselves,
+// joined by newlines.
+func EchoTextGenerator() TextGenerator {
+	return echoer{}
+}
+
+type echoer struct{}
+
+func (echoer) GenerateText(prompt ...string) (string, error) {
+	return strings.Join(prompt, "\n"), nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import "testing"
+
+func TestEcho(t *testing.T) {
+	text, err := EchoTextGenerator().GenerateText("hello", "world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello\nworld"; text != want {
+		t.Errorf("GenerateText() = %q, want %q", text, want)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// GenerateJSON asks g to respond to the prompt with JSON
+// conforming to the schema of v (see [JSONSchema])
+// and decodes the response into v, which must be a
+// non-nil pointer to a struct.
+//
+// If the response is not valid JSON or does not conform to the
+// schema, GenerateJSON asks again, showing the model its previous
+// response and the problem with it, up to a total of three attempts.
+func GenerateJSON(g TextGenerator, v any, prompt ...string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("llm.GenerateJSON: non-pointer %T", v)
+	}
+	s, err := schemaOf(rv.Type().Elem())
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(s)
+	if err != nil {
+		// unreachable
+		return err
+	}
+
+	prompt = append(slices.Clip(prompt),
+		"Respond with only a JSON value conforming to this JSON schema, without any other text:\n"+string(js))
+	const maxTries = 3
+	var text string
+	for try := range maxTries {
+		p := prompt
+		if try > 0 {
+			p = append(slices.Clip(p),
+				"Your previous response was:\n"+text,
+				"That response is invalid: "+err.Error()+"\nPlease try again.")
+		}
+		text, err = g.GenerateText(p...)
+		if err != nil {
+			return err
+		}
+		if err = decodeJSON(s, text, v); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("llm.GenerateJSON: invalid response after %d tries: %v", maxTries, err)
+}
+
+// decodeJSON decodes text, which must conform to the schema s, into v.
+// It accepts JSON in a Markdown code block, which models often produce
+// despite instructions.
+func decodeJSON(s *schema, text string, v any) error {
+	t := strings.TrimSpace(text)
+	if strings.HasPrefix(t, "```") {
+		t = strings.TrimPrefix(t, "```")
+		t = strings.TrimPrefix(t, "json")
+		t = strings.TrimSuffix(t, "```")
+	}
+	dec := json.NewDecoder(strings.NewReader(t))
+	dec.UseNumber()
+	var x any
+	if err := dec.Decode(&x); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if dec.More() {
+		return errors.New("unexpected text after JSON value")
+	}
+	if err := s.validate("", x); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(t), v)
+}
+
+// JSONSchema returns the JSON schema for the type of v,
+// which must be a struct or a pointer to a struct,
+// as used by [GenerateJSON].
+//
+// The schema is derived from the Go type: structs are objects
+// whose properties are the fields, named as in [encoding/json].
+// Fields are required unless tagged omitempty.
+// A field tagged `description:"text"` has that description in the schema,
+// and a string field tagged `enum:"a,b,c"` must be one of the listed values.
+// Only strings, booleans, numbers, slices, structs, and maps with string
+// keys are allowed.
+func JSONSchema(v any) (json.RawMessage, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	s, err := schemaOf(t)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// A schema is the subset of JSON schema used by [GenerateJSON].
+type schema struct {
+	Type                 string             `json:"type"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"` // false or *schema
+}
+
+// schemaOf returns the schema for the struct type t.
+func schemaOf(t reflect.Type) (*schema, error) {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("llm: JSON schema for non-struct type %v", t)
+	}
+	return typeSchema(t)
+}
+
+func typeSchema(t reflect.Type) (*schema, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return &schema{Type: "string"}, nil
+	case reflect.Bool:
+		return &schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}, nil
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Slice, reflect.Array:
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			break
+		}
+		elem, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &schema{Type: "object", AdditionalProperties: elem}, nil
+	case reflect.Struct:
+		s := &schema{Type: "object", Properties: make(map[string]*schema), AdditionalProperties: false}
+		for _, f := range reflect.VisibleFields(t) {
+			if !f.IsExported() || f.Anonymous {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" && opts == "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fs, err := typeSchema(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%v.%s: %v", t, f.Name, err)
+			}
+			c := *fs // copy before adding field-specific details
+			fs = &c
+			if desc := f.Tag.Get("description"); desc != "" {
+				fs.Description = desc
+			}
+			if enum := f.Tag.Get("enum"); enum != "" {
+				if fs.Type != "string" {
+					return nil, fmt.Errorf("%v.%s: enum for non-string field", t, f.Name)
+				}
+				fs.Enum = strings.Split(enum, ",")
+			}
+			s.Properties[name] = fs
+			if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("llm: no JSON schema for type %v", t)
+}
+
+// validate checks that the JSON value x, decoded using [json.Decoder.UseNumber],
+// conforms to s. The path is the location of x in the overall value, for errors.
+func (s *schema) validate(path string, x any) error {
+	where := func() string {
+		if path == "" {
+			return "value"
+		}
+		return path
+	}
+	switch s.Type {
+	case "string":
+		str, ok := x.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", where())
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fmt.Errorf("%s must be one of %q", where(), s.Enum)
+		}
+	case "boolean":
+		if _, ok := x.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", where())
+		}
+	case "integer":
+		n, ok := x.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be an integer", where())
+		}
+		if _, err := n.Int64(); err != nil {
+			return fmt.Errorf("%s must be an integer", where())
+		}
+	case "number":
+		if _, ok := x.(json.Number); !ok {
+			return fmt.Errorf("%s must be a number", where())
+		}
+	case "array":
+		list, ok := x.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be an array", where())
+		}
+		for i, y := range list {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), y); err != nil {
+				return err
+			}
+		}
+	case "object":
+		m, ok := x.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be an object", where())
+		}
+		for _, name := range s.Required {
+			if _, ok := m[name]; !ok {
+				return fmt.Errorf("%s is missing required property %q", where(), name)
+			}
+		}
+		// Check properties in sorted order for deterministic errors.
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			ps := s.Properties[name]
+			if ps == nil {
+				elem, ok := s.AdditionalProperties.(*schema)
+				if !ok {
+					return fmt.Errorf("%s has unexpected property %q", where(), name)
+				}
+				ps = elem
+			}
+			if err := ps.validate(joinPath(path, name), m[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// joinPath returns the path to the named property of the value at path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
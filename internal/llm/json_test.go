@@ -0,0 +1,120 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type label struct {
+	Name   string   `json:"name" enum:"bug,feature"`
+	Score  float64  `json:"score" description:"confidence from 0 to 1"`
+	Count  int      `json:"count,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	hidden bool
+}
+
+func TestJSONSchema(t *testing.T) {
+	js, err := JSONSchema(new(label))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"object","properties":{` +
+		`"count":{"type":"integer"},` +
+		`"name":{"type":"string","enum":["bug","feature"]},` +
+		`"score":{"type":"number","description":"confidence from 0 to 1"},` +
+		`"tags":{"type":"array","items":{"type":"string"}}},` +
+		`"required":["name","score"],"additionalProperties":false}`
+	if string(js) != want {
+		t.Errorf("JSONSchema:\nhave %s\nwant %s", js, want)
+	}
+
+	if _, err := JSONSchema(1); err == nil {
+		t.Errorf("JSONSchema(int) succeeded")
+	}
+	if _, err := JSONSchema(struct{ C chan int }{}); err == nil {
+		t.Errorf("JSONSchema(chan field) succeeded")
+	}
+}
+
+// replyGenerator is a TextGenerator that returns a fixed sequence
+// of replies and records the prompts it was given.
+type replyGenerator struct {
+	replies []string
+	prompts [][]string
+}
+
+func (g *replyGenerator) GenerateText(prompt ...string) (string, error) {
+	g.prompts = append(g.prompts, prompt)
+	reply := g.replies[0]
+	g.replies = g.replies[1:]
+	return reply, nil
+}
+
+func TestGenerateJSON(t *testing.T) {
+	g := &replyGenerator{replies: []string{
+		`Sure! {"name": "bug"}`,
+		`{"name": "bug"}`,
+		`{"name": "crash", "score": 1}`,
+		"```json\n" + `{"name": "bug", "score": 0.5, "tags": ["x"]}` + "\n```",
+	}}
+	var l label
+	if err := GenerateJSON(g, &l, "classify"); err == nil {
+		t.Fatalf("GenerateJSON succeeded with three bad replies")
+	} else if !strings.Contains(err.Error(), `must be one of ["bug" "feature"]`) {
+		t.Errorf("GenerateJSON: err = %v, want enum error", err)
+	}
+	if len(g.prompts) != 3 {
+		t.Fatalf("GenerateJSON asked %d times, want 3", len(g.prompts))
+	}
+	if p := g.prompts[0]; len(p) != 2 || p[0] != "classify" || !strings.Contains(p[1], `"required":["name","score"]`) {
+		t.Errorf("first prompt = %q", p)
+	}
+	if p := g.prompts[1]; len(p) != 4 || !strings.Contains(p[3], "invalid: invalid JSON") {
+		t.Errorf("second prompt = %q", p)
+	}
+	if p := g.prompts[2]; len(p) != 4 || !strings.Contains(p[3], `missing required property "score"`) {
+		t.Errorf("third prompt = %q", p)
+	}
+
+	if err := GenerateJSON(g, &l, "classify"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (label{Name: "bug", Score: 0.5, Tags: []string{"x"}}); !reflect.DeepEqual(l, want) {
+		t.Errorf("GenerateJSON = %+v, want %+v", l, want)
+	}
+
+	if err := GenerateJSON(g, l, "classify"); err == nil {
+		t.Errorf("GenerateJSON with non-pointer succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		js  string
+		err string
+	}{
+		{`{"name":"bug","score":1}`, ""},
+		{`{"name":"bug","score":1,"extra":1}`, `value has unexpected property "extra"`},
+		{`{"name":"bug","score":"1"}`, "score must be a number"},
+		{`{"name":"bug","score":1,"count":1.5}`, "count must be an integer"},
+		{`{"name":"bug","score":1,"tags":["a",2]}`, "tags[1] must be a string"},
+		{`[]`, "value must be an object"},
+		{`{"name":"bug","score":1} {}`, "unexpected text after JSON value"},
+	}
+	s, err := schemaOf(reflect.TypeFor[label]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var l label
+		err := decodeJSON(s, tt.js, &l)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("decodeJSON(%s) = %v, want %q", tt.js, err, tt.err)
+		}
+	}
+}
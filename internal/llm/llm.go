@@ -6,6 +6,7 @@
 package llm
 
 import (
+	"context"
 	"encoding/binary"
 	"math"
 )
@@ -18,12 +19,27 @@ import (
 // all the documents. If an error occurs after some, but not all, documents
 // have been processed, EmbedDocs can return an error along with a
 // shortened vector slice giving the vectors for a prefix of the document slice.
+// If ctx is canceled, EmbedDocs should stop making requests and return
+// an error wrapping ctx.Err(), along with any vectors computed so far.
 //
 // See [QuoteEmbedder] for a semantically useless embedder that
 // can nonetheless be helpful when writing tests,
 // and see [rsc.io/gaby/internal/gemini] for a real implementation.
 type Embedder interface {
-	EmbedDocs(docs []EmbedDoc) ([]Vector, error)
+	EmbedDocs(ctx context.Context, docs []EmbedDoc) ([]Vector, error)
+}
+
+// A TextGenerator generates text in response to a prompt.
+//
+// GenerateText accepts one or more prompt parts, which are
+// concatenated (in order) to form the full prompt,
+// and returns the generated text.
+//
+// See [EchoTextGenerator] for a semantically useless generator that
+// can nonetheless be helpful when writing tests,
+// and see [rsc.io/gaby/internal/gemini] for a real implementation.
+type TextGenerator interface {
+	GenerateText(prompt ...string) (string, error)
 }
 
 // An EmbedDoc is a single document to be embedded.
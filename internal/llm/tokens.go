@@ -0,0 +1,93 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A TokenCounter counts the tokens in text, as seen by a particular model.
+//
+// See [ApproxTokenCounter] for an offline approximation,
+// and see [rsc.io/gaby/internal/gemini] for a real implementation.
+type TokenCounter interface {
+	CountTokens(text string) (int, error)
+}
+
+// ApproxTokenCounter returns a TokenCounter that estimates
+// the number of tokens without consulting a model,
+// assuming about four characters per token,
+// which is typical for English text and code.
+func ApproxTokenCounter() TokenCounter {
+	return approxCounter{}
+}
+
+type approxCounter struct{}
+
+func (approxCounter) CountTokens(text string) (int, error) {
+	return (utf8.RuneCountInString(text) + 3) / 4, nil
+}
+
+// Pack returns the number of texts, starting with the first,
+// that fit together in a context budget of max tokens, as counted by tc.
+func Pack(tc TokenCounter, max int, texts ...string) (int, error) {
+	total := 0
+	for i, text := range texts {
+		n, err := tc.CountTokens(text)
+		if err != nil {
+			return 0, err
+		}
+		if total += n; total > max {
+			return i, nil
+		}
+	}
+	return len(texts), nil
+}
+
+// Truncate returns the longest prefix of text that fits in
+// max tokens, as counted by tc, preferring to cut at the end of a line.
+// It reports whether text was truncated.
+func Truncate(tc TokenCounter, text string, max int) (string, bool, error) {
+	n, err := tc.CountTokens(text)
+	if err != nil {
+		return "", false, err
+	}
+	if n <= max {
+		return text, false, nil
+	}
+
+	// Binary search for the longest prefix that fits:
+	// text[:lo] fits and text[:hi] does not.
+	lo, hi := 0, len(text)
+	for hi-lo > 1 {
+		// Find a rune boundary m with lo < m < hi, if any.
+		m := lo + (hi-lo)/2
+		for m > lo && !utf8.RuneStart(text[m]) {
+			m--
+		}
+		if m == lo {
+			for m++; m < hi && !utf8.RuneStart(text[m]); m++ {
+			}
+			if m == hi {
+				break
+			}
+		}
+		n, err := tc.CountTokens(text[:m])
+		if err != nil {
+			return "", false, err
+		}
+		if n <= max {
+			lo = m
+		} else {
+			hi = m
+		}
+	}
+	prefix := text[:lo]
+	if i := strings.LastIndex(prefix, "\n"); i >= 0 {
+		prefix = prefix[:i+1]
+	}
+	return prefix, true, nil
+}
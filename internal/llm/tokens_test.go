@@ -0,0 +1,77 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApproxTokenCounter(t *testing.T) {
+	tc := ApproxTokenCounter()
+	for _, tt := range []struct {
+		text string
+		n    int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"αβγδ", 1},
+	} {
+		if n, err := tc.CountTokens(tt.text); n != tt.n || err != nil {
+			t.Errorf("CountTokens(%q) = %d, %v, want %d, nil", tt.text, n, err, tt.n)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	tc := ApproxTokenCounter()
+	texts := []string{"12345678", "1234", "12345678", "1"}
+	for _, tt := range []struct {
+		max int
+		n   int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{5, 3},
+		{6, 4},
+		{100, 4},
+	} {
+		if n, err := Pack(tc, tt.max, texts...); n != tt.n || err != nil {
+			t.Errorf("Pack(%d) = %d, %v, want %d, nil", tt.max, n, err, tt.n)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tc := ApproxTokenCounter()
+	for _, tt := range []struct {
+		text  string
+		max   int
+		out   string
+		trunc bool
+	}{
+		{"short", 2, "short", false},
+		{"line one\nline two\nline three\n", 5, "line one\nline two\n", true},
+		{"no newlines in this text", 2, "no newli", true},
+		{"ααααβββ", 1, "αααα", true},
+		{"αxy", 0, "", true},
+	} {
+		out, trunc, err := Truncate(tc, tt.text, tt.max)
+		if out != tt.out || trunc != tt.trunc || err != nil {
+			t.Errorf("Truncate(%q, %d) = %q, %v, %v, want %q, %v, nil", tt.text, tt.max, out, trunc, err, tt.out, tt.trunc)
+		}
+	}
+
+	long := strings.Repeat("x", 1000)
+	out, _, _ := Truncate(tc, long, 100)
+	if len(out) != 400 {
+		t.Errorf("Truncate(long, 100) = %d bytes, want 400", len(out))
+	}
+}
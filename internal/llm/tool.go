@@ -0,0 +1,152 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A Tool is a function that a model can call during generation
+// (see [ToolGenerator] and [RunTools]).
+type Tool interface {
+	// Name returns the tool's name, which must be unique
+	// among the tools offered to a model.
+	Name() string
+
+	// Description describes what the tool does, for the model.
+	Description() string
+
+	// Parameters returns the JSON schema of the tool's arguments,
+	// which must describe a JSON object.
+	Parameters() json.RawMessage
+
+	// Invoke runs the tool with the given JSON arguments
+	// and returns its JSON result.
+	Invoke(args json.RawMessage) (json.RawMessage, error)
+}
+
+// NewTool returns a [Tool] with the given name, description,
+// and parameter schema that is implemented by calling f.
+func NewTool(name, description string, params json.RawMessage, f func(args json.RawMessage) (json.RawMessage, error)) Tool {
+	return &funcTool{name, description, params, f}
+}
+
+type funcTool struct {
+	name        string
+	description string
+	params      json.RawMessage
+	f           func(json.RawMessage) (json.RawMessage, error)
+}
+
+func (t *funcTool) Name() string                                         { return t.name }
+func (t *funcTool) Description() string                                  { return t.description }
+func (t *funcTool) Parameters() json.RawMessage                          { return t.params }
+func (t *funcTool) Invoke(args json.RawMessage) (json.RawMessage, error) { return t.f(args) }
+
+// A Message is a single message in a conversation with a model
+// that uses tools.
+type Message struct {
+	Role    string       // "user", "model", or "tool"
+	Text    string       // text of message, for "user" and "model"
+	Calls   []ToolCall   // tool calls requested by "model"
+	Results []ToolResult // results of calls, for "tool"
+}
+
+// A ToolCall is a model's request to call a tool.
+type ToolCall struct {
+	ID   string          // identifies call in [ToolResult]; may be empty
+	Name string          // name of tool
+	Args json.RawMessage // JSON arguments
+}
+
+// A ToolResult is the result of a [ToolCall].
+// Exactly one of Result and Error is set.
+type ToolResult struct {
+	ID     string          // ID from ToolCall
+	Name   string          // name of tool
+	Result json.RawMessage // JSON result
+	Error  string          // error message
+}
+
+// A ToolGenerator generates messages in a conversation
+// in which the model can call tools.
+//
+// GenerateMessage returns the next "model" message for the conversation
+// in history, which begins with a "user" message. The returned message
+// either contains text, ending the conversation, or requests calls to
+// one or more of the tools, in which case the caller is expected to add
+// the message and a "tool" message with the results to the history
+// and call GenerateMessage again.
+// [RunTools] implements that loop.
+//
+// See [rsc.io/gaby/internal/openai] for an implementation.
+type ToolGenerator interface {
+	GenerateMessage(tools []Tool, history []Message) (*Message, error)
+}
+
+// RunTools generates text for the prompt using g,
+// letting the model call the given tools as needed,
+// up to maxCalls tool calls in total.
+// The prompt parts are joined by newlines to form the full prompt.
+//
+// The model is trusted only to choose tools and arguments:
+// calls to unknown tools, calls with arguments that are not a JSON object,
+// and calls for which the tool returns an error are reported back to
+// the model as errors rather than ending the conversation.
+// RunTools returns an error if the model makes more than maxCalls calls.
+func RunTools(g ToolGenerator, tools []Tool, maxCalls int, prompt ...string) (string, error) {
+	byName := make(map[string]Tool)
+	for _, t := range tools {
+		if byName[t.Name()] != nil {
+			return "", fmt.Errorf("llm.RunTools: duplicate tool %q", t.Name())
+		}
+		byName[t.Name()] = t
+	}
+
+	history := []Message{{Role: "user", Text: strings.Join(prompt, "\n")}}
+	calls := 0
+	for {
+		msg, err := g.GenerateMessage(tools, history)
+		if err != nil {
+			return "", err
+		}
+		if len(msg.Calls) == 0 {
+			return msg.Text, nil
+		}
+		if calls += len(msg.Calls); calls > maxCalls {
+			return "", fmt.Errorf("llm.RunTools: too many tool calls (limit %d)", maxCalls)
+		}
+		results := &Message{Role: "tool"}
+		for _, c := range msg.Calls {
+			results.Results = append(results.Results, invoke(byName[c.Name], c))
+		}
+		history = append(history, *msg, *results)
+	}
+}
+
+// invoke invokes the tool t for the call c.
+// If t is nil, the call is to an unknown tool.
+func invoke(t Tool, c ToolCall) ToolResult {
+	r := ToolResult{ID: c.ID, Name: c.Name}
+	var args map[string]json.RawMessage
+	switch {
+	case t == nil:
+		r.Error = fmt.Sprintf("unknown tool %q", c.Name)
+	case json.Unmarshal(c.Args, &args) != nil || args == nil:
+		r.Error = "arguments are not a JSON object"
+	default:
+		res, err := t.Invoke(c.Args)
+		if err != nil {
+			r.Error = err.Error()
+		} else if !json.Valid(res) {
+			r.Error = "tool returned invalid JSON"
+		} else {
+			r.Result = res
+		}
+	}
+	return r
+}
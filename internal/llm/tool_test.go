@@ -0,0 +1,104 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scriptGenerator is a ToolGenerator that returns a fixed sequence of
+// messages and records the history it was given each time.
+type scriptGenerator struct {
+	script    []*Message
+	histories [][]Message
+}
+
+func (g *scriptGenerator) GenerateMessage(tools []Tool, history []Message) (*Message, error) {
+	g.histories = append(g.histories, history)
+	if len(g.script) == 0 {
+		return nil, errors.New("script done")
+	}
+	msg := g.script[0]
+	g.script = g.script[1:]
+	return msg, nil
+}
+
+var addTool = NewTool("add", "adds x and y",
+	json.RawMessage(`{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"}}}`),
+	func(args json.RawMessage) (json.RawMessage, error) {
+		var xy struct{ X, Y float64 }
+		if err := json.Unmarshal(args, &xy); err != nil {
+			return nil, err
+		}
+		if xy.X < 0 {
+			return nil, errors.New("negative x")
+		}
+		return json.RawMessage(fmt.Sprint(xy.X + xy.Y)), nil
+	})
+
+func call(id, name, args string) ToolCall {
+	return ToolCall{ID: id, Name: name, Args: json.RawMessage(args)}
+}
+
+func TestRunTools(t *testing.T) {
+	g := &scriptGenerator{script: []*Message{
+		{Role: "model", Calls: []ToolCall{
+			call("1", "add", `{"x":1,"y":2}`),
+			call("2", "sub", `{"x":1,"y":2}`),
+		}},
+		{Role: "model", Calls: []ToolCall{
+			call("3", "add", `[1,2]`),
+			call("4", "add", `{"x":-1,"y":2}`),
+		}},
+		{Role: "model", Text: "3"},
+	}}
+	text, err := RunTools(g, []Tool{addTool}, 4, "what is", "1+2?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "3" {
+		t.Errorf("RunTools = %q, want %q", text, "3")
+	}
+	if len(g.histories) != 3 {
+		t.Fatalf("GenerateMessage called %d times, want 3", len(g.histories))
+	}
+	want := []Message{
+		{Role: "user", Text: "what is\n1+2?"},
+		{Role: "model", Calls: []ToolCall{call("1", "add", `{"x":1,"y":2}`), call("2", "sub", `{"x":1,"y":2}`)}},
+		{Role: "tool", Results: []ToolResult{
+			{ID: "1", Name: "add", Result: json.RawMessage("3")},
+			{ID: "2", Name: "sub", Error: `unknown tool "sub"`},
+		}},
+		{Role: "model", Calls: []ToolCall{call("3", "add", `[1,2]`), call("4", "add", `{"x":-1,"y":2}`)}},
+		{Role: "tool", Results: []ToolResult{
+			{ID: "3", Name: "add", Error: "arguments are not a JSON object"},
+			{ID: "4", Name: "add", Error: "negative x"},
+		}},
+	}
+	if have := g.histories[2]; !reflect.DeepEqual(have, want) {
+		t.Errorf("history:\nhave %+v\nwant %+v", have, want)
+	}
+}
+
+func TestRunToolsLimits(t *testing.T) {
+	loop := &Message{Role: "model", Calls: []ToolCall{call("1", "add", `{"x":1,"y":2}`)}}
+	g := &scriptGenerator{script: []*Message{loop, loop, loop}}
+	if _, err := RunTools(g, []Tool{addTool}, 2, "loop"); err == nil || !strings.Contains(err.Error(), "too many tool calls") {
+		t.Errorf("RunTools with too many calls: err = %v", err)
+	}
+
+	g = &scriptGenerator{}
+	if _, err := RunTools(g, []Tool{addTool, addTool}, 2, "dup"); err == nil || !strings.Contains(err.Error(), "duplicate tool") {
+		t.Errorf("RunTools with duplicate tools: err = %v", err)
+	}
+	if len(g.histories) != 0 {
+		t.Errorf("RunTools with duplicate tools called model")
+	}
+}
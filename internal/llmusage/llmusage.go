@@ -0,0 +1,270 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package llmusage accounts for LLM usage and enforces daily budgets.
+//
+// A [Meter] wraps the [llm.Embedder] and [llm.TextGenerator] used
+// by each Gaby subsystem, recording the number of requests,
+// the number of input and output tokens, and the estimated cost
+// for each day, subsystem, and model.
+// When a subsystem's daily budget is exhausted, its wrapped clients
+// refuse further requests with an error wrapping [ErrOverBudget]
+// until the next day (in UTC), so that features relying on the LLM
+// stop acting instead of running up costs.
+package llmusage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["llmusage.Usage", Day, Subsystem, Model] => JSON of Usage
+//
+// Day is the UTC date in the form "2006-01-02".
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "llmusage.Usage", Key: "Day, Subsystem, Model", Val: "JSON of Usage"},
+	)
+}
+
+// ErrOverBudget is the error (wrapped) returned by metered clients
+// when their subsystem has exhausted its daily budget.
+var ErrOverBudget = errors.New("daily LLM budget exceeded")
+
+// A Meter records LLM usage and enforces budgets.
+type Meter struct {
+	slog    *slog.Logger
+	db      storage.DB
+	tc      llm.TokenCounter
+	now     func() time.Time
+	prices  map[string]Price
+	budgets map[string]float64
+
+	mu sync.Mutex // protects read-modify-write of usage records
+}
+
+// A Price is the price of using a model,
+// in US dollars per million tokens.
+type Price struct {
+	Input  float64 // price per million input tokens
+	Output float64 // price per million output tokens
+}
+
+// New returns a new Meter that logs to lg and stores usage in db.
+// Use the [Meter] methods to configure prices and budgets
+// before wrapping clients with [Meter.Embedder] and [Meter.TextGenerator].
+func New(lg *slog.Logger, db storage.DB) *Meter {
+	return &Meter{
+		slog:    lg,
+		db:      db,
+		tc:      llm.ApproxTokenCounter(),
+		now:     time.Now,
+		prices:  make(map[string]Price),
+		budgets: make(map[string]float64),
+	}
+}
+
+// SetPrice sets the price of using the named model.
+// Usage of models without a price is recorded with zero cost.
+func (m *Meter) SetPrice(model string, p Price) {
+	m.prices[model] = p
+}
+
+// SetDailyBudget sets the maximum cost, in US dollars, that the
+// named subsystem may incur in a single day (in UTC).
+// Subsystems without a budget are not limited.
+func (m *Meter) SetDailyBudget(subsystem string, dollars float64) {
+	m.budgets[subsystem] = dollars
+}
+
+// SetTokenCounter sets the token counter used to measure requests.
+// The default is [llm.ApproxTokenCounter], which requires no
+// additional requests to the model.
+func (m *Meter) SetTokenCounter(tc llm.TokenCounter) {
+	m.tc = tc
+}
+
+// A Usage is the recorded usage of a model by a subsystem on a given day.
+type Usage struct {
+	Day          string  // UTC date, "2006-01-02"
+	Subsystem    string  // subsystem name, such as "needinfo"
+	Model        string  // model name, such as "gemini/text-embedding-004"
+	Requests     int64   // number of requests
+	InputTokens  int64   // number of input tokens
+	OutputTokens int64   // number of output tokens
+	Cost         float64 // estimated cost in US dollars
+}
+
+// String returns a one-line summary of u.
+func (u *Usage) String() string {
+	return fmt.Sprintf("%s %s %s: %d requests, %d input tokens, %d output tokens, $%.4f",
+		u.Day, u.Subsystem, u.Model, u.Requests, u.InputTokens, u.OutputTokens, u.Cost)
+}
+
+// today returns the current UTC day.
+func (m *Meter) today() string {
+	return m.now().UTC().Format(time.DateOnly)
+}
+
+// Usage returns the recorded usage for the given day ("2006-01-02"),
+// ordered by subsystem and then model.
+func (m *Meter) Usage(day string) []*Usage {
+	var list []*Usage
+	start := ordered.Encode("llmusage.Usage", day)
+	end := ordered.Encode("llmusage.Usage", day, ordered.Inf)
+	for _, val := range m.db.Scan(start, end) {
+		var u Usage
+		if err := json.Unmarshal(val(), &u); err != nil {
+			// unreachable unless corrupt storage
+			m.db.Panic("llmusage decode", "day", day, "err", err)
+		}
+		list = append(list, &u)
+	}
+	return list
+}
+
+// Today returns the recorded usage for the current day.
+func (m *Meter) Today() []*Usage {
+	return m.Usage(m.today())
+}
+
+// Spent returns the total cost incurred by the subsystem on the current day.
+func (m *Meter) Spent(subsystem string) float64 {
+	day := m.today()
+	start := ordered.Encode("llmusage.Usage", day, subsystem)
+	end := ordered.Encode("llmusage.Usage", day, subsystem, ordered.Inf)
+	total := 0.0
+	for _, val := range m.db.Scan(start, end) {
+		var u Usage
+		if err := json.Unmarshal(val(), &u); err != nil {
+			// unreachable unless corrupt storage
+			m.db.Panic("llmusage decode", "day", day, "subsystem", subsystem, "err", err)
+		}
+		total += u.Cost
+	}
+	return total
+}
+
+// OverBudget reports whether the subsystem has exhausted its daily budget.
+// Callers can use it to skip LLM-dependent work entirely;
+// the metered clients check it before every request.
+func (m *Meter) OverBudget(subsystem string) bool {
+	budget, ok := m.budgets[subsystem]
+	return ok && m.Spent(subsystem) >= budget
+}
+
+// check returns an error if the subsystem may not make a request.
+func (m *Meter) check(subsystem, model string) error {
+	if m.OverBudget(subsystem) {
+		m.slog.Warn("llmusage over budget", "subsystem", subsystem, "model", model, "budget", m.budgets[subsystem])
+		return fmt.Errorf("%s: %w", subsystem, ErrOverBudget)
+	}
+	return nil
+}
+
+// record records a request made by the subsystem to the model.
+func (m *Meter) record(subsystem, model string, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	day := m.today()
+	key := ordered.Encode("llmusage.Usage", day, subsystem, model)
+
+	// Other Gaby instances may be recording usage for the same key.
+	lock := string(key)
+	m.db.Lock(lock)
+	defer m.db.Unlock(lock)
+
+	u := &Usage{Day: day, Subsystem: subsystem, Model: model}
+	if val, ok := m.db.Get(key); ok {
+		if err := json.Unmarshal(val, u); err != nil {
+			// unreachable unless corrupt storage
+			m.db.Panic("llmusage decode", "key", storage.Fmt(key), "err", err)
+		}
+	}
+	p := m.prices[model]
+	u.Requests++
+	u.InputTokens += in
+	u.OutputTokens += out
+	u.Cost += (float64(in)*p.Input + float64(out)*p.Output) / 1e6
+	m.db.Set(key, storage.JSON(u))
+}
+
+// count returns the number of tokens in the texts,
+// logging and ignoring errors, since an accounting failure
+// should not prevent the request.
+func (m *Meter) count(texts ...string) int64 {
+	total := int64(0)
+	for _, text := range texts {
+		n, err := m.tc.CountTokens(text)
+		if err != nil {
+			m.slog.Error("llmusage CountTokens", "err", err)
+			continue
+		}
+		total += int64(n)
+	}
+	return total
+}
+
+// Embedder returns an [llm.Embedder] that records the usage
+// of e, which embeds using the named model, by the named subsystem.
+func (m *Meter) Embedder(subsystem, model string, e llm.Embedder) llm.Embedder {
+	return &embedder{m, subsystem, model, e}
+}
+
+type embedder struct {
+	m         *Meter
+	subsystem string
+	model     string
+	e         llm.Embedder
+}
+
+func (e *embedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	if err := e.m.check(e.subsystem, e.model); err != nil {
+		return nil, err
+	}
+	vecs, err := e.e.EmbedDocs(ctx, docs)
+	var in int64
+	for _, d := range docs[:min(len(vecs), len(docs))] {
+		in += e.m.count(d.Title, d.Text)
+	}
+	e.m.record(e.subsystem, e.model, in, 0)
+	return vecs, err
+}
+
+// TextGenerator returns an [llm.TextGenerator] that records the usage
+// of g, which generates using the named model, by the named subsystem.
+func (m *Meter) TextGenerator(subsystem, model string, g llm.TextGenerator) llm.TextGenerator {
+	return &generator{m, subsystem, model, g}
+}
+
+type generator struct {
+	m         *Meter
+	subsystem string
+	model     string
+	g         llm.TextGenerator
+}
+
+func (g *generator) GenerateText(prompt ...string) (string, error) {
+	if err := g.m.check(g.subsystem, g.model); err != nil {
+		return "", err
+	}
+	text, err := g.g.GenerateText(prompt...)
+	// A failed request may still have been billed for its input.
+	g.m.record(g.subsystem, g.model, g.m.count(strings.Join(prompt, "\n")), g.m.count(text))
+	return text, err
+}
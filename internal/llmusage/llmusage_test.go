@@ -0,0 +1,91 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package llmusage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+func TestMeter(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	m := New(lg, db)
+	now := time.Date(2024, 7, 1, 23, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	m.SetPrice("echo", Price{Input: 1e6, Output: 2e6}) // $1 per input token, $2 per output token
+	m.SetDailyBudget("small", 20)
+
+	small := m.TextGenerator("small", "echo", llm.EchoTextGenerator())
+	big := m.TextGenerator("big", "echo", llm.EchoTextGenerator())
+	embed := m.Embedder("small", "quote", llm.QuoteEmbedder())
+
+	// "abcdefgh" is 2 tokens in and 2 tokens out: $6.
+	for range 3 {
+		if _, err := small.GenerateText("abcd", "efg"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := big.GenerateText("abcdefgh"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := embed.EmbedDocs(ctx, []llm.EmbedDoc{{Title: "abcd", Text: "efgh"}, {Text: "ijkl"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Usage{
+		{"2024-07-01", "big", "echo", 3, 6, 6, 18},
+		{"2024-07-01", "small", "echo", 3, 6, 6, 18},
+		{"2024-07-01", "small", "quote", 1, 3, 0, 0},
+	}
+	have := m.Today()
+	if len(have) != len(want) {
+		t.Fatalf("Today() = %v, want %v", have, want)
+	}
+	for i, u := range have {
+		if *u != want[i] {
+			t.Errorf("Today()[%d] = %v, want %v", i, u, &want[i])
+		}
+	}
+
+	if m.OverBudget("small") || m.OverBudget("big") {
+		t.Fatalf("OverBudget before budget exhausted")
+	}
+	if _, err := small.GenerateText("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.OverBudget("small") {
+		t.Fatalf("OverBudget(small) = false after spending %v", m.Spent("small"))
+	}
+	if _, err := small.GenerateText("x"); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("GenerateText over budget: err = %v, want ErrOverBudget", err)
+	}
+	if _, err := embed.EmbedDocs(ctx, []llm.EmbedDoc{{Text: "x"}}); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("EmbedDocs over budget: err = %v, want ErrOverBudget", err)
+	}
+	if _, err := big.GenerateText("x"); err != nil {
+		t.Errorf("GenerateText without budget: %v", err)
+	}
+
+	// The budget resets the next day.
+	now = now.Add(2 * time.Hour)
+	if m.OverBudget("small") {
+		t.Errorf("OverBudget(small) on next day")
+	}
+	if _, err := small.GenerateText("x"); err != nil {
+		t.Errorf("GenerateText on next day: %v", err)
+	}
+	if n := len(m.Usage("2024-07-01")); n != 3 {
+		t.Errorf("len(Usage(2024-07-01)) = %d, want 3", n)
+	}
+}
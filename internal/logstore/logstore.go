@@ -0,0 +1,370 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logstore keeps selected log records in the database,
+// so that they can be seen in the admin interface even when
+// no one is collecting Gaby's standard output.
+//
+// A [Store] provides a [slog.Handler] (see [Store.Handler])
+// that passes every record on to another handler and also
+// saves the records at or above a minimum level (by default, warnings
+// and errors) along with informational records with selected messages
+// (see [Store.Keep]), such as the ones logged when Gaby posts to GitHub.
+// Records are written to the database in the background, so that
+// logging never waits for the database, and old records are deleted
+// to bound the space used (see [Store.SetRetention]).
+//
+// [Records] returns the stored records matching a [Query].
+package logstore
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores timed entries in the database of the form:
+//
+//	["logstore.Record", Time, Seq] => JSON of Record
+//
+// Time is the time of the record in Unix nanoseconds,
+// and Seq distinguishes records with the same time.
+
+func init() {
+	timed.RegisterSchema("logstore.Record", "Time, Seq", "JSON of Record")
+}
+
+const kind = "logstore.Record"
+
+const (
+	DefaultRetention = 30 * 24 * time.Hour // default maximum age of stored records
+	DefaultMax       = 10000               // default maximum number of stored records
+
+	pruneEvery = 100  // delete old records after every pruneEvery writes
+	queueSize  = 1000 // records waiting to be written; more are dropped
+)
+
+// A Record is a stored log record.
+type Record struct {
+	Time  time.Time
+	Level slog.Level
+	Msg   string
+	Attrs []Attr `json:",omitempty"`
+}
+
+// An Attr is a record attribute, formatted as a string.
+// Attributes in groups have keys of the form "group.key".
+type Attr struct {
+	Key   string
+	Value string
+}
+
+// A Store stores log records in a database.
+type Store struct {
+	db        storage.DB
+	level     slog.Level
+	keep      map[string]bool
+	retention time.Duration
+	max       int
+	now       func() time.Time // for testing
+
+	mu      sync.RWMutex // protects closed and sends on queue
+	closed  bool
+	queue   chan *item
+	done    chan struct{}
+	dropped atomic.Int64
+	seq     atomic.Int64
+	writes  int // number of records written, used only by loop
+}
+
+// An item is a record to write or a flush request (or both).
+type item struct {
+	rec     *Record
+	flushed chan struct{}
+}
+
+// New returns a new Store that stores warnings and errors in db,
+// keeping them for [DefaultRetention], up to [DefaultMax] records.
+// The Store's configuration must be completed (using SetLevel, Keep,
+// and SetRetention) before its handler is used.
+// The caller must call [Store.Close] when finished with the Store,
+// before closing db.
+func New(db storage.DB) *Store {
+	s := &Store{
+		db:        db,
+		level:     slog.LevelWarn,
+		keep:      make(map[string]bool),
+		retention: DefaultRetention,
+		max:       DefaultMax,
+		now:       time.Now,
+		queue:     make(chan *item, queueSize),
+		done:      make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// SetLevel sets the minimum level of the records to store.
+func (s *Store) SetLevel(level slog.Level) {
+	s.level = level
+}
+
+// Keep arranges for s to store informational (or more severe)
+// records with any of the given messages, even if they are below
+// the minimum level.
+func (s *Store) Keep(msgs ...string) {
+	for _, msg := range msgs {
+		s.keep[msg] = true
+	}
+}
+
+// SetRetention sets the maximum age and the maximum number
+// of stored records. Older records are deleted,
+// as are the oldest records beyond the maximum number.
+func (s *Store) SetRetention(age time.Duration, max int) {
+	s.retention = age
+	s.max = max
+}
+
+// enabled reports whether s might store records at the given level.
+func (s *Store) enabled(level slog.Level) bool {
+	return level >= s.level || level >= slog.LevelInfo && len(s.keep) > 0
+}
+
+// wants reports whether s stores the record r.
+func (s *Store) wants(r *slog.Record) bool {
+	return r.Level >= s.level || r.Level >= slog.LevelInfo && s.keep[r.Message]
+}
+
+// add queues r to be written.
+// If the queue is full, add drops r, to be reported later.
+func (s *Store) add(r *Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- &item{rec: r}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Flush waits until the records logged so far are written to the database
+// and then flushes the database.
+func (s *Store) Flush() {
+	flushed := make(chan struct{})
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return
+	}
+	s.queue <- &item{flushed: flushed}
+	s.mu.RUnlock()
+	<-flushed
+}
+
+// Close writes any remaining records to the database and
+// stops storing records. Records logged after Close are not stored.
+func (s *Store) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+}
+
+// loop writes queued records to the database until the queue is closed.
+func (s *Store) loop() {
+	defer close(s.done)
+	for it := range s.queue {
+		if it.rec != nil {
+			s.write(it.rec)
+		}
+		if it.flushed != nil {
+			s.db.Flush()
+			close(it.flushed)
+		}
+	}
+	s.db.Flush()
+}
+
+// write writes r to the database, after a record of any dropped records,
+// pruning old records periodically.
+func (s *Store) write(r *Record) {
+	b := s.db.Batch()
+	if n := s.dropped.Swap(0); n > 0 {
+		d := &Record{Time: r.Time, Level: slog.LevelWarn, Msg: "logstore dropped records", Attrs: []Attr{{"n", strconv.FormatInt(n, 10)}}}
+		timed.Set(s.db, b, kind, ordered.Encode(d.Time.UnixNano(), s.seq.Add(1)), storage.JSON(d))
+	}
+	timed.Set(s.db, b, kind, ordered.Encode(r.Time.UnixNano(), s.seq.Add(1)), storage.JSON(r))
+	b.Apply()
+	if s.writes++; s.writes%pruneEvery == 0 {
+		s.prune()
+	}
+}
+
+// prune deletes the records older than the retention period
+// and the oldest records beyond the maximum number.
+func (s *Store) prune() {
+	n := 0
+	for range s.db.Scan(ordered.Encode(kind), ordered.Encode(kind, ordered.Inf)) {
+		n++
+	}
+	cutoff := s.now().Add(-s.retention).UnixNano()
+	var last []byte
+	for e := range timed.Scan(s.db, kind, nil, ordered.Encode(ordered.Inf)) {
+		var t int64
+		if _, err := ordered.DecodePrefix(e.Key, &t); err != nil {
+			// unreachable unless corrupt storage
+			s.db.Panic("logstore prune decode", "key", storage.Fmt(e.Key), "err", err)
+		}
+		if t >= cutoff && n <= s.max {
+			break
+		}
+		last = e.Key
+		n--
+	}
+	if last != nil {
+		b := s.db.Batch()
+		timed.DeleteRange(s.db, b, kind, nil, last)
+		b.Apply()
+	}
+}
+
+// Handler returns a handler that passes records to h
+// and also stores the ones selected by s's configuration.
+// Records are stored whether or not h is enabled for their level.
+func (s *Store) Handler(h slog.Handler) slog.Handler {
+	return &handler{Handler: h, store: s}
+}
+
+type handler struct {
+	slog.Handler
+	store  *Store
+	attrs  []Attr // attributes added by WithAttrs
+	prefix string // group prefix added by WithGroup
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.Handler.Enabled(ctx, level) || h.store.enabled(level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.store.wants(&r) {
+		attrs := slices.Clone(h.attrs)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs = appendAttr(attrs, h.prefix, a)
+			return true
+		})
+		h.store.add(&Record{Time: r.Time, Level: r.Level, Msg: r.Message, Attrs: attrs})
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(as []slog.Attr) slog.Handler {
+	h1 := *h
+	h1.Handler = h.Handler.WithAttrs(as)
+	h1.attrs = slices.Clip(h.attrs)
+	for _, a := range as {
+		h1.attrs = appendAttr(h1.attrs, h.prefix, a)
+	}
+	return &h1
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h1 := *h
+	h1.Handler = h.Handler.WithGroup(name)
+	h1.prefix = h.prefix + name + "."
+	return &h1
+}
+
+// appendAttr appends the formatted attribute a to list,
+// flattening groups into keys with the given prefix.
+func appendAttr(list []Attr, prefix string, a slog.Attr) []Attr {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return list
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range a.Value.Group() {
+			list = appendAttr(list, prefix, g)
+		}
+		return list
+	}
+	return append(list, Attr{prefix + a.Key, a.Value.String()})
+}
+
+// A Query selects stored records.
+type Query struct {
+	Since time.Time  // only records at or after Since
+	Level slog.Level // only records at or above Level
+	Msg   string     // only records whose message contains Msg
+	Limit int        // at most Limit records (0 means no limit)
+}
+
+// Records returns the records stored in db that match q, newest first.
+// A nil Query matches all records.
+func Records(db storage.DB, q *Query) []*Record {
+	if q == nil {
+		q = new(Query)
+	}
+	var start []byte
+	if !q.Since.IsZero() {
+		start = ordered.Encode(q.Since.UnixNano())
+	}
+	var list []*Record
+	for r := range scan(db, start) {
+		if r.Level >= q.Level && strings.Contains(r.Msg, q.Msg) {
+			list = append(list, r)
+		}
+	}
+	slices.Reverse(list)
+	if q.Limit > 0 && len(list) > q.Limit {
+		list = list[:q.Limit]
+	}
+	return list
+}
+
+// scan returns an iterator over the records in db
+// with keys at or after start, oldest first.
+func scan(db storage.DB, start []byte) iter.Seq[*Record] {
+	return func(yield func(*Record) bool) {
+		for e := range timed.Scan(db, kind, start, ordered.Encode(ordered.Inf)) {
+			var r Record
+			if err := json.Unmarshal(e.Val, &r); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("logstore record decode", "key", storage.Fmt(e.Key), "err", err)
+			}
+			if !yield(&r) {
+				return
+			}
+		}
+	}
+}
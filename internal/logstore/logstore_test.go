@@ -0,0 +1,109 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+)
+
+var ctx = context.Background()
+
+func TestHandler(t *testing.T) {
+	db := storage.MemDB()
+	s := New(db)
+	defer s.Close()
+	s.Keep("related.Poster post")
+
+	var buf bytes.Buffer
+	lg := slog.New(s.Handler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})))
+	lg.Debug("debug")
+	lg.Info("info")
+	lg.Info("related.Poster post", "issue", 1)
+	lg.With("name", "x").WithGroup("g").Warn("warn", "a", 1, slog.Group("h", "b", 2))
+	lg.Error("error", "err", "broken")
+	s.Flush()
+
+	// The wrapped handler still applies its own level.
+	if out := buf.String(); strings.Count(out, "\n") != 1 || !strings.Contains(out, "msg=error") {
+		t.Errorf("text output:\n%s", out)
+	}
+
+	var have []string
+	for _, r := range Records(db, nil) {
+		line := r.Level.String() + " " + r.Msg
+		for _, a := range r.Attrs {
+			line += " " + a.Key + "=" + a.Value
+		}
+		have = append(have, line)
+	}
+	want := []string{
+		"ERROR error err=broken",
+		"WARN warn name=x g.a=1 g.h.b=2",
+		"INFO related.Poster post issue=1",
+	}
+	if strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Records:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+
+	q := &Query{Level: slog.LevelWarn, Limit: 1}
+	if rs := Records(db, q); len(rs) != 1 || rs[0].Msg != "error" {
+		t.Errorf("Records(%+v) = %v", q, rs)
+	}
+	q = &Query{Msg: "Poster"}
+	if rs := Records(db, q); len(rs) != 1 || rs[0].Msg != "related.Poster post" {
+		t.Errorf("Records(%+v) = %v", q, rs)
+	}
+	q = &Query{Since: time.Now().Add(time.Hour)}
+	if rs := Records(db, q); len(rs) != 0 {
+		t.Errorf("Records(%+v) = %v", q, rs)
+	}
+
+	s.Close()
+	lg.Error("after close")
+	if n := len(Records(db, nil)); n != 3 {
+		t.Errorf("stored %d records after Close, want 3", n)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := storage.MemDB()
+	s := New(db)
+	defer s.Close()
+	s.SetRetention(time.Hour, 5)
+	lg := slog.New(s.Handler(slog.NewTextHandler(io.Discard, nil)))
+
+	// Records older than the retention period are deleted,
+	// as are the oldest records beyond the maximum number.
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	old := slog.NewRecord(start.Add(-2*time.Hour), slog.LevelError, "old", 0)
+	lg.Handler().Handle(ctx, old)
+	for range pruneEvery - 2 {
+		lg.Error("new")
+	}
+	s.Flush()
+	if n := len(Records(db, nil)); n != pruneEvery-1 {
+		t.Fatalf("stored %d records before pruning, want %d", n, pruneEvery-1)
+	}
+	lg.Error("last")
+	s.Flush()
+	rs := Records(db, nil)
+	if len(rs) != 5 || rs[0].Msg != "last" {
+		t.Fatalf("after pruning: %d records, newest %q; want 5, last", len(rs), rs[0].Msg)
+	}
+	for _, r := range rs {
+		if r.Msg == "old" {
+			t.Errorf("old record not pruned")
+		}
+	}
+}
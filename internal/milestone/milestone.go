@@ -0,0 +1,536 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package milestone implements suggesting milestones for new GitHub issues.
+//
+// A [Suggester] looks up the issues most similar to each new issue
+// in a vector database of GitHub issue embeddings and lets them vote,
+// weighted by similarity, for their own milestones.
+// If enough of the vote goes to one milestone, the Suggester posts
+// a comment suggesting it, and in high-confidence cases it can
+// set the milestone directly (see [Suggester.EnableApply]).
+// Before enabling posts, maintainers can use [Suggester.Backtest]
+// to measure how accurate the suggestions would have been
+// on historical issues.
+package milestone
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["milestone.Suggested", Project, Issue] => JSON of suggestRecord
+//	["milestone.Backtest", Name, Project, Issue] => JSON of BacktestResult
+//
+// and uses the [storage.BeginAction] keys ["milestone.Post", Project, Issue]
+// and ["milestone.Apply", Project, Issue].
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "milestone.Suggested", Key: "Project, Issue", Val: "JSON of suggestRecord"},
+		storage.Schema{Kind: "milestone.Backtest", Key: "Name, Project, Issue", Val: "JSON of BacktestResult"},
+	)
+}
+
+// A Suggester suggests milestones for new issues.
+type Suggester struct {
+	slog           *slog.Logger
+	db             storage.DB
+	vdb            storage.VectorDB
+	github         *github.Client
+	projects       map[string]bool
+	watcher        *timed.Watcher[*github.Event]
+	name           string
+	timeLimit      time.Time
+	neighbors      int
+	minVoters      int
+	scoreCutoff    float64
+	suggestConf    float64
+	applyConf      float64
+	skipTitles     []string
+	skipMilestones map[string]bool
+	footer         *footer.Footer
+	post           bool
+	apply          bool
+}
+
+// New creates and returns a new Suggester. It logs to lg, stores state in db,
+// watches for new GitHub issues using gh, and looks up similar issues
+// in vdb, which must contain embeddings of the GitHub issues
+// (see [rsc.io/gaby/internal/githubdocs] and [rsc.io/gaby/internal/embeddocs]).
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Suggester] methods to configure the parameters
+// (especially [Suggester.EnableProject] and [Suggester.EnablePosts])
+// before calling [Suggester.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, vdb storage.VectorDB, name string) *Suggester {
+	return &Suggester{
+		slog:           lg,
+		db:             db,
+		vdb:            vdb,
+		github:         gh,
+		projects:       make(map[string]bool),
+		watcher:        gh.EventWatcher("milestone.Suggester:" + name),
+		name:           name,
+		timeLimit:      time.Now().Add(-defaultTooOld),
+		neighbors:      defaultNeighbors,
+		minVoters:      defaultMinVoters,
+		scoreCutoff:    defaultScoreCutoff,
+		suggestConf:    defaultSuggestConf,
+		applyConf:      defaultApplyConf,
+		skipMilestones: make(map[string]bool),
+		footer:         footer.Default(),
+	}
+}
+
+const (
+	defaultTooOld      = 48 * time.Hour
+	defaultNeighbors   = 10
+	defaultMinVoters   = 3
+	defaultScoreCutoff = 0.82
+	defaultSuggestConf = 0.6
+	defaultApplyConf   = 0.9
+)
+
+// EnableProject enables the Suggester to suggest milestones for issues
+// in the given GitHub project (for example "golang/go").
+// See also [Suggester.EnablePosts], which must also be called to post anything to GitHub.
+func (s *Suggester) EnableProject(project string) {
+	s.projects[project] = true
+}
+
+// EnablePosts enables the Suggester to post suggestions to GitHub.
+// If EnablePosts has not been called, [Suggester.Run] logs what it would post
+// but does not post the messages.
+func (s *Suggester) EnablePosts() {
+	s.post = true
+}
+
+// EnableApply enables the Suggester to set the milestone itself,
+// instead of posting a suggestion, when its confidence is at least
+// the apply threshold (see [Suggester.SetConfidence]).
+// Like posting, applying milestones also requires [Suggester.EnablePosts].
+func (s *Suggester) EnableApply() {
+	s.apply = true
+}
+
+// SetTimeLimit controls how old an issue can be for the Suggester to consider it.
+// Issues created before time t will be skipped.
+// The default is not to consider issues that are more than 48 hours old
+// at the time of the call to [New].
+func (s *Suggester) SetTimeLimit(t time.Time) {
+	s.timeLimit = t
+}
+
+// SetNeighbors sets the maximum number of similar issues consulted (n)
+// and the minimum number of those that must have milestones (min)
+// for the Suggester to make a suggestion.
+// The defaults are 10 and 3.
+func (s *Suggester) SetNeighbors(n, min int) {
+	s.neighbors = n
+	s.minVoters = min
+}
+
+// SetMinScore sets the minimum vector search score that an issue
+// must have to be considered similar.
+// The default is 0.82.
+func (s *Suggester) SetMinScore(min float64) {
+	s.scoreCutoff = min
+}
+
+// SetConfidence sets the thresholds for suggesting and applying milestones.
+// The confidence in a milestone is the fraction of the similarity-weighted vote
+// cast for it by the similar issues with milestones.
+// The Suggester suggests the milestone when its confidence is at least suggest,
+// and applies it (if [Suggester.EnableApply] has been called)
+// when its confidence is at least apply.
+// The defaults are 0.6 and 0.9.
+func (s *Suggester) SetConfidence(suggest, apply float64) {
+	s.suggestConf = suggest
+	s.applyConf = apply
+}
+
+// SkipTitlePrefix configures the Suggester to skip issues with a title starting
+// with the given prefix, such as "proposal: ", for issues whose milestones
+// are set by a separate process.
+func (s *Suggester) SkipTitlePrefix(prefix string) {
+	s.skipTitles = append(s.skipTitles, prefix)
+}
+
+// SkipMilestone configures the Suggester never to suggest the milestone
+// with the given title, such as a release milestone that
+// maintainers assign only deliberately.
+func (s *Suggester) SkipMilestone(title string) {
+	s.skipMilestones[title] = true
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (s *Suggester) SetFooter(f *footer.Footer) {
+	s.footer = f
+}
+
+// A Prediction is a milestone prediction for an issue.
+type Prediction struct {
+	Milestone  string  // milestone title
+	Confidence float64 // fraction of the weighted vote for Milestone
+	Voters     int     // number of similar issues with milestones
+}
+
+// A suggestRecord is the database record of an issue
+// for which the Suggester made a prediction.
+type suggestRecord struct {
+	Prediction
+	Applied bool   `json:",omitempty"` // milestone set directly
+	URL     string `json:",omitempty"` // API URL of posted suggestion, if any
+}
+
+// Run runs a single round of suggestions.
+// It scans all open issues that have been created since the last call to [Suggester.Run]
+// using a Suggester with the same name (see [New]), skipping pull requests,
+// issues that already have a milestone, and issues that do not match the configured constraints
+// (see [Suggester.EnableProject], [Suggester.SetTimeLimit], and [Suggester.SkipTitlePrefix]).
+// For each remaining issue, Run predicts a milestone from similar issues,
+// considering only milestones that are still open.
+// If the prediction is confident enough, Run posts a comment suggesting the milestone
+// or, when [Suggester.EnableApply] has been called and the prediction is
+// confident enough for that, sets the issue's milestone.
+//
+// Run logs each suggestion to the [slog.Logger] passed to [New].
+// If [Suggester.EnablePosts] has been called, then Run also makes the change on GitHub,
+// records in the database that it has considered the issue, so that it never suggests again,
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+// When [Suggester.EnablePosts] has not been called, Run only logs what it would do.
+//
+// If ctx is canceled, Run stops before the next issue.
+func (s *Suggester) Run(ctx context.Context) {
+	s.slog.Info("milestone.Suggester start", "name", s.name)
+	defer s.slog.Info("milestone.Suggester end", "name", s.name)
+
+	defer s.watcher.Flush()
+
+	open := make(map[string]map[string]int64) // project → open milestone title → number
+	for e := range s.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !s.projects[e.Project] || e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		if s.skip(issue) {
+			if s.post {
+				s.watcher.MarkOld(e.DBTime)
+			}
+			continue
+		}
+		key := ordered.Encode("milestone.Suggested", e.Project, e.Issue)
+		if _, ok := s.db.Get(key); ok {
+			continue
+		}
+
+		if open[e.Project] == nil {
+			open[e.Project] = make(map[string]int64)
+			for _, m := range s.github.Milestones(e.Project) {
+				if m.State == "open" {
+					open[e.Project][m.Title] = m.Number
+				}
+			}
+		}
+		created, _ := time.Parse(time.RFC3339, issue.CreatedAt) // checked by skip
+		pred := s.predict(e.Project, issue.Number, created, func(m string) bool {
+			_, ok := open[e.Project][m]
+			return ok
+		})
+		rec := &suggestRecord{}
+		if pred != nil {
+			rec.Prediction = *pred
+		}
+		if pred != nil && pred.Confidence >= s.suggestConf {
+			if !s.act(issue, rec, open[e.Project][pred.Milestone]) {
+				continue
+			}
+		} else if pred != nil {
+			s.slog.Info("milestone.Suggester unsure", "name", s.name, "project", e.Project, "issue", e.Issue, "milestone", pred.Milestone, "confidence", pred.Confidence, "voters", pred.Voters)
+		}
+		if !s.post {
+			continue
+		}
+		s.db.Set(key, storage.JSON(rec))
+		s.watcher.MarkOld(e.DBTime)
+
+		// Flush immediately to make sure we don't re-post if interrupted later in the loop.
+		s.watcher.Flush()
+		s.db.Flush()
+	}
+}
+
+// act posts or applies the prediction in rec for the issue,
+// recording what it did in rec and reporting whether it succeeded
+// (or, in dry-run mode, would have).
+// number is the number of the predicted milestone.
+func (s *Suggester) act(issue *github.Issue, rec *suggestRecord, number int64) bool {
+	project := issue.Project()
+	pred := &rec.Prediction
+	if s.apply && pred.Confidence >= s.applyConf {
+		s.slog.Info("milestone.Suggester apply", "name", s.name, "project", project, "issue", issue.Number, "milestone", pred.Milestone, "confidence", pred.Confidence, "voters", pred.Voters)
+		if !s.post {
+			return true
+		}
+		action := ordered.Encode("milestone.Apply", project, issue.Number)
+		if !storage.BeginAction(s.db, action) {
+			return true
+		}
+		if err := s.github.EditIssue(issue, &github.IssueChanges{Milestone: number}); err != nil {
+			s.slog.Error("EditIssue", "issue", issue.Number, "err", err)
+			storage.CancelAction(s.db, action)
+			return false
+		}
+		storage.FinishAction(s.db, action, nil)
+		rec.Applied = true
+		return true
+	}
+
+	body := s.comment(project, pred)
+	s.slog.Info("milestone.Suggester post", "name", s.name, "project", project, "issue", issue.Number, "milestone", pred.Milestone, "confidence", pred.Confidence, "voters", pred.Voters, "comment", body)
+	if !s.post {
+		return true
+	}
+	action := ordered.Encode("milestone.Post", project, issue.Number)
+	if !storage.BeginAction(s.db, action) {
+		return true
+	}
+	url, err := s.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		s.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(s.db, action)
+		return false
+	}
+	storage.FinishAction(s.db, action, url)
+	rec.URL = url
+	return true
+}
+
+// comment returns the text of a comment suggesting the predicted milestone.
+func (s *Suggester) comment(project string, pred *Prediction) string {
+	return fmt.Sprintf("Based on %d similar issues, this issue may belong in the **%s** milestone.\n%s",
+		pred.Voters, markdownEscape(pred.Milestone), s.footer.Render("milestone", project))
+}
+
+var markdownEscaper = strings.NewReplacer(
+	"_", `\_`,
+	"*", `\*`,
+	"`", "\\`",
+	"[", `\[`,
+	"]", `\]`,
+	"<", `\<`,
+	">", `\>`,
+	"&", `\&`,
+)
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// skip reports whether the Suggester should skip the issue.
+func (s *Suggester) skip(issue *github.Issue) bool {
+	if issue.State == "closed" || issue.PullRequest != nil || issue.Milestone.Title != "" {
+		return true
+	}
+	tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+	if err != nil {
+		s.slog.Error("milestone parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
+		return true
+	}
+	if tm.Before(s.timeLimit) {
+		return true
+	}
+	for _, prefix := range s.skipTitles {
+		if strings.HasPrefix(issue.Title, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// predict predicts a milestone for the given issue, created at the given time,
+// by a similarity-weighted vote of the issues in project that are most similar to it,
+// considering only issues created before it and milestones for which ok returns true.
+// It returns nil if there are too few voters.
+func (s *Suggester) predict(project string, number int64, created time.Time, ok func(string) bool) *Prediction {
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", project, number)
+	vec, found := s.vdb.Get(u)
+	if !found {
+		s.slog.Info("milestone.Suggester no embedding", "project", project, "issue", number)
+		return nil
+	}
+
+	votes := make(map[string]float64)
+	total := 0.0
+	voters := 0
+	// Search for extra results, since many will be other kinds of documents
+	// or issues without milestones.
+	for _, r := range s.vdb.Search(vec, 4*s.neighbors+5) {
+		if voters >= s.neighbors || r.Score < s.scoreCutoff {
+			break
+		}
+		if r.ID == u {
+			continue
+		}
+		other, err := s.github.LookupIssueURL(r.ID)
+		if err != nil || other.Project() != project || other.PullRequest != nil {
+			continue
+		}
+		m := other.Milestone.Title
+		if m == "" || s.skipMilestones[m] || !ok(m) {
+			continue
+		}
+		if tm, err := time.Parse(time.RFC3339, other.CreatedAt); err != nil || !tm.Before(created) {
+			continue
+		}
+		votes[m] += r.Score
+		total += r.Score
+		voters++
+	}
+	if voters < s.minVoters || voters == 0 {
+		return nil
+	}
+
+	// Break ties by title, for determinism.
+	titles := make([]string, 0, len(votes))
+	for m := range votes {
+		titles = append(titles, m)
+	}
+	best := slices.MaxFunc(titles, func(x, y string) int {
+		if c := cmp.Compare(votes[x], votes[y]); c != 0 {
+			return c
+		}
+		return -strings.Compare(x, y)
+	})
+	return &Prediction{Milestone: best, Confidence: votes[best] / total, Voters: voters}
+}
+
+// A BacktestResult is the result of predicting the milestone
+// of a single historical issue (see [Suggester.Backtest]).
+type BacktestResult struct {
+	Project   string
+	Issue     int64
+	Milestone string      // actual milestone
+	Predicted *Prediction `json:",omitempty"` // nil if no prediction
+}
+
+// Correct reports whether the prediction matches the actual milestone.
+func (r *BacktestResult) Correct() bool {
+	return r.Predicted != nil && r.Predicted.Milestone == r.Milestone
+}
+
+// Backtest predicts the milestones of the issues in project numbered issueMin ≤ issue ≤ issueMax
+// (with no upper limit if issueMax < 0) that have milestones,
+// recording the predictions in the database, and returns a summary of their accuracy.
+// Each prediction considers only the issues created before the predicted issue,
+// but with their current milestones, which may have been assigned later.
+// Unlike [Suggester.Run], Backtest considers closed issues and closed milestones
+// and ignores [Suggester.SetTimeLimit].
+// Backtest never posts to GitHub.
+// Use [Suggester.BacktestResults] to retrieve the individual results.
+func (s *Suggester) Backtest(project string, issueMin, issueMax int64) *BacktestSummary {
+	var sum BacktestSummary
+	for e := range s.github.Events(project, issueMin, issueMax) {
+		if e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		if issue.PullRequest != nil || issue.Milestone.Title == "" {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, issue.CreatedAt)
+		if err != nil {
+			continue
+		}
+		r := &BacktestResult{Project: project, Issue: issue.Number, Milestone: issue.Milestone.Title}
+		r.Predicted = s.predict(project, issue.Number, created, func(string) bool { return true })
+		s.db.Set(ordered.Encode("milestone.Backtest", s.name, project, issue.Number), storage.JSON(r))
+		sum.add(s, r)
+	}
+	s.db.Flush()
+	return &sum
+}
+
+// A BacktestSummary summarizes the accuracy of a [Suggester.Backtest].
+// Counts of suggestions include applied milestones.
+type BacktestSummary struct {
+	Issues           int // issues with milestones
+	Suggested        int // issues for which a milestone would have been suggested
+	SuggestedCorrect int // correct suggestions
+	Applied          int // issues for which a milestone would have been applied
+	AppliedCorrect   int // correct applications
+}
+
+// add adds the result r to the summary.
+func (sum *BacktestSummary) add(s *Suggester, r *BacktestResult) {
+	sum.Issues++
+	if r.Predicted == nil || r.Predicted.Confidence < s.suggestConf {
+		return
+	}
+	sum.Suggested++
+	if r.Correct() {
+		sum.SuggestedCorrect++
+	}
+	if r.Predicted.Confidence >= s.applyConf {
+		sum.Applied++
+		if r.Correct() {
+			sum.AppliedCorrect++
+		}
+	}
+}
+
+// String returns a human-readable summary.
+func (sum *BacktestSummary) String() string {
+	return fmt.Sprintf("%d issues: suggested %d (%d correct, %s), applied %d (%d correct, %s)",
+		sum.Issues, sum.Suggested, sum.SuggestedCorrect, percent(sum.SuggestedCorrect, sum.Suggested),
+		sum.Applied, sum.AppliedCorrect, percent(sum.AppliedCorrect, sum.Applied))
+}
+
+// percent returns n/d formatted as a percentage.
+func percent(n, d int) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(n)/float64(d))
+}
+
+// BacktestResults returns an iterator over the results recorded by
+// [Suggester.Backtest] for issues in project, in increasing issue order.
+func (s *Suggester) BacktestResults(project string) iter.Seq[*BacktestResult] {
+	return func(yield func(*BacktestResult) bool) {
+		start := ordered.Encode("milestone.Backtest", s.name, project)
+		end := ordered.Encode("milestone.Backtest", s.name, project, ordered.Inf)
+		for key, val := range s.db.Scan(start, end) {
+			var r BacktestResult
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				s.db.Panic("milestone.Suggester backtest decode", "key", storage.Fmt(key), "err", err)
+			}
+			if !yield(&r) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package milestone
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+var (
+	go121   = github.Milestone{Number: 3, Title: "Go1.21", State: "closed"}
+	go123   = github.Milestone{Number: 5, Title: "Go1.23", State: "open"}
+	backlog = github.Milestone{Number: 1, Title: "Backlog", State: "open"}
+)
+
+// testIssues are the test issues, in two clusters of similar issues.
+// Issues 10, 11, and 12 are new; the others are historical.
+var testIssues = []struct {
+	number    int64
+	vec       llm.Vector
+	milestone github.Milestone
+}{
+	{1, llm.Vector{1, 0}, go123},
+	{2, llm.Vector{1, 0}, go123},
+	{3, llm.Vector{1, 0}, go121},
+	{4, llm.Vector{1, 0}, go123},
+	{5, llm.Vector{1, 0}, backlog},
+	{6, llm.Vector{1, 0}, go123},
+	{7, llm.Vector{0, 1}, go123},
+	{8, llm.Vector{0, 1}, backlog},
+	{9, llm.Vector{0, 1}, backlog},
+	{10, llm.Vector{1, 0}, github.Milestone{}},
+	{11, llm.Vector{0, 1}, github.Milestone{}},
+	{12, llm.Vector{1, 0}, backlog},
+}
+
+// setup returns a GitHub client and vector database
+// containing testIssues, with issue N created N days into 2024.
+func setup(t *testing.T) (storage.DB, *github.Client, storage.VectorDB) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "vecs")
+	for _, x := range testIssues {
+		gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+			Number:    x.number,
+			Title:     fmt.Sprint("issue ", x.number),
+			State:     "open",
+			CreatedAt: time.Date(2024, 1, 1+int(x.number), 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
+			Milestone: x.milestone,
+		})
+		vdb.Set(fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", x.number), x.vec)
+	}
+	return db, gh, vdb
+}
+
+func newSuggester(t *testing.T, db storage.DB, gh *github.Client, vdb storage.VectorDB) *Suggester {
+	s := New(testutil.Slogger(t), db, gh, vdb, "test")
+	s.EnableProject("rsc/tmp")
+	s.SetTimeLimit(time.Time{})
+	s.SetConfidence(0.55, 0.7)
+	return s
+}
+
+func TestRun(t *testing.T) {
+	db, gh, vdb := setup(t)
+	s := newSuggester(t, db, gh, vdb)
+	s.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("dry run posted: %v", edits)
+	}
+
+	s.EnablePosts()
+	s.Run(ctx)
+	// Issue 10's neighbors vote 4 to 1 for Go1.23; Go1.21 is closed.
+	// Issue 11's neighbors vote 2 to 1 for Backlog.
+	// Issue 12 already has a milestone.
+	want := map[int64]string{
+		10: "Based on 5 similar issues, this issue may belong in the **Go1.23** milestone.\n" + footer.Default().Render("milestone", "rsc/tmp"),
+		11: "Based on 3 similar issues, this issue may belong in the **Backlog** milestone.\n" + footer.Default().Render("milestone", "rsc/tmp"),
+	}
+	for _, e := range gh.Testing().Edits() {
+		if e.IssueCommentChanges == nil || e.IssueCommentChanges.Body != want[e.Issue] {
+			t.Errorf("unexpected edit: %v", e)
+			continue
+		}
+		delete(want, e.Issue)
+	}
+	for issue := range want {
+		t.Errorf("did not see post on rsc/tmp#%d", issue)
+	}
+	gh.Testing().ClearEdits()
+
+	s.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Errorf("second run posted: %v", edits)
+	}
+}
+
+func TestApply(t *testing.T) {
+	db, gh, vdb := setup(t)
+	s := newSuggester(t, db, gh, vdb)
+	s.EnablePosts()
+	s.EnableApply()
+	s.SkipTitlePrefix("issue 11")
+	s.Run(ctx)
+
+	var have []string
+	for _, e := range gh.Testing().Edits() {
+		have = append(have, e.String())
+	}
+	want := []string{`EditIssue(rsc/tmp#10, {"milestone":5})`}
+	if !slices.Equal(have, want) {
+		t.Errorf("edits:\nhave %q\nwant %q", have, want)
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	db, gh, vdb := setup(t)
+	s := newSuggester(t, db, gh, vdb)
+	sum := s.Backtest("rsc/tmp", 0, 9)
+	if have, want := sum.String(), "9 issues: suggested 3 (2 correct, 67%), applied 1 (0 correct, 0%)"; have != want {
+		t.Errorf("Backtest = %q, want %q", have, want)
+	}
+
+	var have []string
+	for r := range s.BacktestResults("rsc/tmp") {
+		if r.Predicted == nil {
+			have = append(have, fmt.Sprintf("%d %s -", r.Issue, r.Milestone))
+			continue
+		}
+		have = append(have, fmt.Sprintf("%d %s %s %.2f %d %v", r.Issue, r.Milestone, r.Predicted.Milestone, r.Predicted.Confidence, r.Predicted.Voters, r.Correct()))
+	}
+	want := []string{
+		"1 Go1.23 -",
+		"2 Go1.23 -",
+		"3 Go1.21 -",
+		"4 Go1.23 Go1.23 0.67 3 true",
+		"5 Backlog Go1.23 0.75 4 false",
+		"6 Go1.23 Go1.23 0.60 5 true",
+		"7 Go1.23 -",
+		"8 Backlog -",
+		"9 Backlog -",
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("BacktestResults:\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+	if gh.Testing().Edits() != nil {
+		t.Errorf("Backtest posted: %v", gh.Testing().Edits())
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package needinfo implements asking for missing information
+// in new GitHub issues.
+//
+// A [Checker] checks each new issue for the information that a project
+// expects bug reports to contain (see [Requirement]), such as the Go version
+// and steps to reproduce the problem, and posts a comment asking for
+// exactly the missing items, if any.
+// Each requirement can be checked deterministically, with a regular expression,
+// or by asking an LLM (see [llm.TextGenerator]) a yes-or-no question about the issue,
+// or both.
+// Asking for information that is already present or irrelevant would be
+// worse than not asking, so a Checker only asks for an item when it is
+// confident the item is missing, and like other Gaby posters,
+// it only logs what it would post until [Checker.EnablePosts] is called.
+package needinfo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["needinfo.Checked", Project, Issue] => JSON of checkRecord
+//
+// and uses the [storage.BeginAction] key ["needinfo.Post", Project, Issue].
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "needinfo.Checked", Key: "Project, Issue", Val: "JSON of checkRecord"},
+	)
+}
+
+// A Requirement is a piece of information that issue reports
+// in a project are expected to contain.
+type Requirement struct {
+	Name string // short name, for logging ("Go version")
+	Ask  string // request for the information, in Markdown ("What version of Go are you using?")
+
+	// If Pattern is non-nil, an issue whose title or body matches Pattern
+	// is known to contain the information.
+	Pattern *regexp.Regexp
+
+	// If Question is non-empty and the issue does not match Pattern,
+	// the Checker asks its LLM the question about the issue,
+	// and the information is missing only if the answer is no.
+	// Question should be a yes-or-no question, such as
+	// "Does the issue include steps to reproduce the problem?"
+	// If Question is empty or the Checker has no LLM,
+	// the information is missing if Pattern is non-nil and does not match.
+	Question string
+}
+
+// GoRequirements are the requirements for bug reports in the Go project,
+// following the Go issue template.
+var GoRequirements = []*Requirement{
+	{
+		Name:    "Go version",
+		Ask:     "What version of Go are you using (`go version`)?",
+		Pattern: regexp.MustCompile(`\bgo ?1\.[0-9]+|\bgo version\b|\bdevel\b|\btip\b`),
+	},
+	{
+		Name:     "reproduction",
+		Ask:      "What did you do? If possible, please provide a small program or a recipe that reproduces the problem.",
+		Pattern:  regexp.MustCompile(`(?i)\bto reproduce\b|\breproduc(ed|ible|tion)\b|\bgo\.dev/play/|play\.golang\.org/`),
+		Question: "Does the issue include a program, commands, or specific steps that would reproduce the problem?",
+	},
+	{
+		Name:     "expected and actual",
+		Ask:      "What did you expect to see, and what did you see instead?",
+		Pattern:  regexp.MustCompile(`(?is)\bexpect.*\b(instead|actual|got|see|saw)\b|\b(instead|actual|got|see|saw)\b.*\bexpect`),
+		Question: "Does the issue say both what the reporter expected to happen and what actually happened?",
+	},
+}
+
+// A Checker checks new issues for missing information and asks for it.
+type Checker struct {
+	slog      *slog.Logger
+	db        storage.DB
+	github    *github.Client
+	llm       llm.TextGenerator
+	projects  map[string][]*Requirement
+	watcher   *timed.Watcher[*github.Event]
+	name      string
+	timeLimit time.Time
+	skips     []string // title prefixes to skip
+	footer    *footer.Footer
+	approvals *approval.Queue
+	post      bool
+}
+
+// New creates and returns a new Checker. It logs to lg, stores state in db,
+// watches for new GitHub issues using gh, and, if gen is not nil,
+// asks gen about requirements that cannot be checked deterministically.
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Checker] methods to configure the checking parameters
+// (especially [Checker.EnableProject] and [Checker.EnablePosts])
+// before calling [Checker.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, gen llm.TextGenerator, name string) *Checker {
+	return &Checker{
+		slog:      lg,
+		db:        db,
+		github:    gh,
+		llm:       gen,
+		projects:  make(map[string][]*Requirement),
+		watcher:   gh.EventWatcher("needinfo.Checker:" + name),
+		name:      name,
+		timeLimit: time.Now().Add(-defaultTooOld),
+		footer:    footer.Default(),
+	}
+}
+
+// EnableProject enables the Checker to check issues in the given GitHub project
+// (for example "golang/go") against the given requirements (for example [GoRequirements]).
+// See also [Checker.EnablePosts], which must also be called to post anything to GitHub.
+func (c *Checker) EnableProject(project string, reqs []*Requirement) {
+	c.projects[project] = reqs
+}
+
+// EnablePosts enables the Checker to post to GitHub.
+// If EnablePosts has not been called, [Checker.Run] logs what it would post
+// but does not post the messages.
+func (c *Checker) EnablePosts() {
+	c.post = true
+}
+
+// SetTimeLimit controls how old an issue can be for the Checker to check it.
+// Issues created before time t will be skipped.
+// The default is not to check issues that are more than 48 hours old
+// at the time of the call to [New].
+func (c *Checker) SetTimeLimit(t time.Time) {
+	c.timeLimit = t
+}
+
+const defaultTooOld = 48 * time.Hour
+
+// SkipTitlePrefix configures the Checker to skip issues with a title starting
+// with the given prefix, such as "proposal: ", for issues that
+// are not bug reports.
+func (c *Checker) SkipTitlePrefix(prefix string) {
+	c.skips = append(c.skips, prefix)
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (c *Checker) SetFooter(f *footer.Footer) {
+	c.footer = f
+}
+
+// SetApprovals sets the approval queue for the Checker's comments.
+// If q requires approval for "needinfo.Post" actions
+// (see [approval.Queue.Requires]), the Checker proposes each comment
+// to q instead of posting it.
+func (c *Checker) SetApprovals(q *approval.Queue) {
+	c.approvals = q
+}
+
+// A checkRecord is the database record of a checked issue.
+type checkRecord struct {
+	Missing []string `json:",omitempty"` // names of missing requirements
+	URL     string   `json:",omitempty"` // API URL of the posted comment, if any
+}
+
+// Run runs a single round of checking.
+// It scans all open issues that have been created since the last call to [Checker.Run]
+// using a Checker with the same name (see [New]), skipping pull requests
+// and issues that do not match the configured constraints
+// (see [Checker.EnableProject], [Checker.SetTimeLimit], and [Checker.SkipTitlePrefix]).
+// For each remaining issue, Run checks the project's requirements
+// and, if any are missing, posts a comment asking for them
+// (or proposes the comment for approval; see [Checker.SetApprovals]).
+//
+// Run logs each post to the [slog.Logger] passed to [New].
+// If [Checker.EnablePosts] has been called, then Run also posts the comment to GitHub,
+// records in the database that it has checked the issue, so that it never asks again,
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+// When [Checker.EnablePosts] has not been called, Run only logs the comments it would post.
+//
+// If ctx is canceled, Run stops before the next issue.
+func (c *Checker) Run(ctx context.Context) {
+	c.slog.Info("needinfo.Checker start", "name", c.name)
+	defer c.slog.Info("needinfo.Checker end", "name", c.name)
+
+	defer c.watcher.Flush()
+
+	for e := range c.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		reqs, ok := c.projects[e.Project]
+		if !ok || e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		if c.skip(issue) {
+			if c.post {
+				c.watcher.MarkOld(e.DBTime)
+			}
+			continue
+		}
+		key := ordered.Encode("needinfo.Checked", e.Project, e.Issue)
+		if _, ok := c.db.Get(key); ok {
+			continue
+		}
+
+		var missing []*Requirement
+		for _, r := range reqs {
+			if c.missing(issue, r) {
+				missing = append(missing, r)
+			}
+		}
+		rec := &checkRecord{}
+		for _, r := range missing {
+			rec.Missing = append(rec.Missing, r.Name)
+		}
+		if len(missing) > 0 {
+			body := c.comment(e.Project, missing)
+			c.slog.Info("needinfo.Checker post", "name", c.name, "project", e.Project, "issue", e.Issue, "missing", rec.Missing, "comment", body)
+			if !c.post {
+				continue
+			}
+			action := ordered.Encode("needinfo.Post", e.Project, e.Issue)
+			if c.approvals.Requires("needinfo.Post") {
+				c.approvals.Propose(issue, action, &approval.Proposal{
+					Kind:    "needinfo.Post",
+					Actor:   c.name,
+					Reason:  "missing " + strings.Join(rec.Missing, ", "),
+					Comment: body,
+				})
+			} else if storage.BeginAction(c.db, action) {
+				url, err := c.github.WithContext(ctx).PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+				if err != nil {
+					c.slog.Error("PostIssueComment", "issue", e.Issue, "err", err)
+					storage.CancelAction(c.db, action)
+					continue
+				}
+				storage.FinishAction(c.db, action, url)
+				rec.URL = url
+			}
+		}
+		if !c.post {
+			continue
+		}
+		c.db.Set(key, storage.JSON(rec))
+		c.watcher.MarkOld(e.DBTime)
+
+		// Flush immediately to make sure we don't re-post if interrupted later in the loop.
+		c.watcher.Flush()
+		c.db.Flush()
+	}
+}
+
+// skip reports whether the Checker should skip the issue.
+func (c *Checker) skip(issue *github.Issue) bool {
+	if issue.State == "closed" || issue.PullRequest != nil {
+		return true
+	}
+	tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+	if err != nil {
+		c.slog.Error("needinfo parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
+		return true
+	}
+	if tm.Before(c.timeLimit) {
+		return true
+	}
+	for _, prefix := range c.skips {
+		if strings.HasPrefix(issue.Title, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// questionPrompt is the instruction given to the LLM
+// before the issue and the requirement's question.
+const questionPrompt = "Read the following GitHub issue and answer the question after it."
+
+// An llmAnswer is the LLM's answer to a requirement's question.
+type llmAnswer struct {
+	Answer string `json:"answer" enum:"yes,no,unclear"`
+}
+
+// missing reports whether the issue is missing the information
+// described by the requirement r.
+func (c *Checker) missing(issue *github.Issue, r *Requirement) bool {
+	if r.Pattern != nil && (r.Pattern.MatchString(issue.Title) || r.Pattern.MatchString(issue.Body)) {
+		return false
+	}
+	if r.Question == "" || c.llm == nil {
+		return r.Pattern != nil
+	}
+	var a llmAnswer
+	err := llm.GenerateJSON(c.llm, &a, questionPrompt,
+		"Issue title: "+issue.Title+"\n\nIssue body:\n"+issue.Body,
+		"Question: "+r.Question)
+	if err != nil {
+		c.slog.Error("needinfo.Checker llm", "issue", issue.Number, "requirement", r.Name, "err", err)
+		return false
+	}
+	if a.Answer == "unclear" {
+		// When in doubt, don't ask.
+		c.slog.Info("needinfo.Checker unclear llm answer", "issue", issue.Number, "requirement", r.Name)
+	}
+	return a.Answer == "no"
+}
+
+// comment returns the text of a comment asking for the missing information.
+func (c *Checker) comment(project string, missing []*Requirement) string {
+	var buf bytes.Buffer
+	buf.WriteString("Thank you for the report. To help investigate it, could you please provide the following information?\n\n")
+	for _, r := range missing {
+		fmt.Fprintf(&buf, " - %s\n", r.Ask)
+	}
+	buf.WriteString(c.footer.Render("needinfo", project))
+	return buf.String()
+}
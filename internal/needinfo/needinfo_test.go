@@ -0,0 +1,189 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package needinfo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/diff"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+var issues = []*github.Issue{
+	{
+		Title: "net/http: crash in Server",
+		Body:  "go version go1.22.1 linux/amd64\n\nTo reproduce, run go.dev/play/p/abc.\n\nI expected it to work, but instead it crashed.",
+	},
+	{
+		Title: "net/http: crash in Client",
+		Body:  "Run go.dev/play/p/xyz and it crashes.",
+	},
+	{
+		Title: "proposal: net/http: add Server.Crash",
+		Body:  "Sometimes I want the server to crash.",
+	},
+	{
+		Title: "cmd/go: build fails",
+		Body:  "Using go1.23rc1, `go build` in my module fails with `no Go files`, but there are Go files.\n\nLLM: has steps",
+	},
+	{
+		Title: "cmd/go: vet fails",
+		Body:  "Using go1.23rc1, `go vet` fails with a strange error.\n\nLLM: confused",
+	},
+}
+
+// testLLM answers questions about issues by looking for
+// “LLM: has steps” and “LLM: confused” in the issue.
+type testLLM struct{}
+
+func (testLLM) GenerateText(prompt ...string) (string, error) {
+	issue, question := prompt[1], prompt[2]
+	switch {
+	case strings.Contains(issue, "LLM: confused"):
+		return "Perhaps.", nil
+	case strings.Contains(question, "reproduce") && strings.Contains(issue, "LLM: has steps"):
+		return `{"answer": "yes"}`, nil
+	}
+	return "```json\n{\"answer\": \"no\"}\n```\n", nil
+}
+
+func Test(t *testing.T) {
+	for _, gen := range []bool{false, true} {
+		t.Run(fmt.Sprint("llm=", gen), func(t *testing.T) {
+			testChecker(t, gen)
+		})
+	}
+}
+
+func testChecker(t *testing.T, useLLM bool) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	for i, issue := range issues {
+		issue.Number = int64(i + 1)
+		issue.CreatedAt = "2024-06-17T20:16:49Z"
+		gh.Testing().AddIssue("rsc/tmp", issue)
+	}
+	gh.Testing().AddIssue("rsc/tmp", &github.Issue{
+		Number:      6,
+		Title:       "net/http: fix crash",
+		CreatedAt:   "2024-06-17T20:16:49Z",
+		PullRequest: new(struct{}),
+	})
+
+	var gen llm.TextGenerator
+	if useLLM {
+		gen = testLLM{}
+	}
+	c := New(lg, db, gh, gen, "test")
+	c.EnableProject("rsc/tmp", GoRequirements)
+	c.SkipTitlePrefix("proposal: ")
+	c.SetTimeLimit(time.Time{})
+	c.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("dry run posted: %v", edits)
+	}
+
+	c.EnablePosts()
+	c.Run(ctx)
+	ask := func(items ...string) string {
+		return "Thank you for the report. To help investigate it, could you please provide the following information?\n\n" +
+			strings.Join(items, "") + footer.Default().Render("needinfo", "rsc/tmp")
+	}
+	const (
+		version  = " - What version of Go are you using (`go version`)?\n"
+		repro    = " - What did you do? If possible, please provide a small program or a recipe that reproduces the problem.\n"
+		expected = " - What did you expect to see, and what did you see instead?\n"
+	)
+	want := map[int64]string{
+		2: ask(version, expected),
+		4: ask(expected),
+		5: ask(repro, expected),
+	}
+	if useLLM {
+		// The LLM confirms that 4 has a reproduction
+		// but gives unclear answers about 5.
+		want[4] = ask(expected)
+		want[5] = ""
+	} else {
+		// Without an LLM, 4 looks like it lacks a reproduction.
+		want[4] = ask(repro, expected)
+	}
+	for _, e := range gh.Testing().Edits() {
+		w, ok := want[e.Issue]
+		if !ok || w == "" || e.IssueCommentChanges == nil {
+			t.Errorf("unexpected edit: %v", e)
+			continue
+		}
+		delete(want, e.Issue)
+		if e.IssueCommentChanges.Body != w {
+			t.Errorf("rsc/tmp#%d: wrong post:\n%s", e.Issue, diff.Diff("want", []byte(w), "have", []byte(e.IssueCommentChanges.Body)))
+		}
+	}
+	for issue, w := range want {
+		if w != "" {
+			t.Errorf("did not see post on rsc/tmp#%d", issue)
+		}
+	}
+	gh.Testing().ClearEdits()
+
+	c = New(lg, db, gh, gen, "test2")
+	c.EnableProject("rsc/tmp", GoRequirements)
+	c.SkipTitlePrefix("proposal: ")
+	c.SetTimeLimit(time.Time{})
+	c.EnablePosts()
+	c.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("second checker posted again: %v", edits)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	for i, issue := range issues {
+		issue.Number = int64(i + 1)
+		issue.CreatedAt = "2024-06-17T20:16:49Z"
+		gh.Testing().AddIssue("rsc/tmp", issue)
+	}
+
+	q := approval.New(lg, db, gh, "approvals")
+	q.Require("needinfo.Post")
+	c := New(lg, db, gh, nil, "test")
+	c.EnableProject("rsc/tmp", GoRequirements)
+	c.SkipTitlePrefix("proposal: ")
+	c.SetTimeLimit(time.Time{})
+	c.SetApprovals(q)
+	c.EnablePosts()
+	c.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("posted without approval: %v", edits)
+	}
+	var have []string
+	for p := range approval.Proposals(db) {
+		have = append(have, fmt.Sprintf("#%d %s", p.Issue, p.Reason))
+	}
+	want := []string{
+		"#2 missing Go version, expected and actual",
+		"#4 missing reproduction, expected and actual",
+		"#5 missing reproduction, expected and actual",
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("proposals = %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package openai implements access to LLMs using the OpenAI REST API.
+//
+// Many self-hosted inference servers speak the same protocol,
+// so a [Client] can also connect to them (see [NewClient]).
+//
+// [Client] implements [llm.Embedder], [llm.TextGenerator], and [llm.ToolGenerator].
+// Use [NewClient] to connect.
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/secret"
+)
+
+// Scrub is a request scrubber for use with [rsc.io/httprr].
+func Scrub(req *http.Request) error {
+	req.Header.Del("Authorization")
+	return nil
+}
+
+// DefaultURL is the base URL of the OpenAI API.
+const DefaultURL = "https://api.openai.com/v1"
+
+// A Client represents a connection to an OpenAI-compatible API.
+type Client struct {
+	slog       *slog.Logger
+	http       *http.Client
+	url        string
+	key        string
+	embedModel string
+	textModel  string
+}
+
+// NewClient returns a connection to the OpenAI-compatible API at the base URL u
+// (for example [DefaultURL] or "http://localhost:8000/v1"),
+// using the given logger and HTTP client.
+// It looks in sdb for an API key stored under the name of the URL's host
+// (for example "api.openai.com"), accepting secrets of the form "sk-..."
+// or "user:sk-...". The key is required for [DefaultURL] but optional
+// for other servers, which may not need one.
+func NewClient(lg *slog.Logger, sdb secret.DB, hc *http.Client, u string) (*Client, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := sdb.Get(pu.Host)
+	if !ok && u == DefaultURL {
+		return nil, fmt.Errorf("missing api key for %s", pu.Host)
+	}
+	// If key is from .netrc, ignore user name.
+	if _, pass, ok := strings.Cut(key, ":"); ok {
+		key = pass
+	}
+	return &Client{
+		slog:       lg,
+		http:       hc,
+		url:        strings.TrimSuffix(u, "/"),
+		key:        key,
+		embedModel: defaultEmbedModel,
+		textModel:  defaultTextModel,
+	}, nil
+}
+
+const (
+	defaultEmbedModel = "text-embedding-3-small"
+	defaultTextModel  = "gpt-4o-mini"
+)
+
+// SetEmbeddingModel sets the model used by [Client.EmbedDocs].
+// The default is "text-embedding-3-small".
+func (c *Client) SetEmbeddingModel(model string) {
+	c.embedModel = model
+}
+
+// SetTextModel sets the model used by [Client.GenerateText]
+// and [Client.GenerateMessage].
+// The default is "gpt-4o-mini".
+func (c *Client) SetTextModel(model string) {
+	c.textModel = model
+}
+
+// EmbeddingModel returns a description of the embedding model,
+// such as "openai/text-embedding-3-small",
+// suitable for recording alongside stored vectors
+// (see [rsc.io/gaby/internal/storage.SetVectorModel]).
+// Servers using models with the same name are assumed
+// to compute the same embeddings.
+func (c *Client) EmbeddingModel() string {
+	return "openai/" + c.embedModel
+}
+
+// TextModel returns a description of the text generation model,
+// such as "openai/gpt-4o-mini", for use in usage accounting
+// (see [rsc.io/gaby/internal/llmusage.Meter.SetPrice]).
+func (c *Client) TextModel() string {
+	return "openai/" + c.textModel
+}
+
+const maxBatch = 100 // well under the API's limit, to bound request size
+
+type embedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embedResponse struct {
+	Data []struct {
+		Index     int        `json:"index"`
+		Embedding llm.Vector `json:"embedding"`
+	} `json:"data"`
+}
+
+// EmbedDocs returns the vector embeddings for the docs,
+// implementing [llm.Embedder].
+// The API has no separate notion of a document title,
+// so a non-empty title is prepended to the text.
+func (c *Client) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	var vecs []llm.Vector
+	for docs := range slices.Chunk(docs, maxBatch) {
+		req := &embedRequest{Model: c.embedModel}
+		for _, d := range docs {
+			text := d.Text
+			if d.Title != "" {
+				text = d.Title + "\n\n" + text
+			}
+			req.Input = append(req.Input, text)
+		}
+		var resp embedResponse
+		if err := c.post(ctx, "/embeddings", req, &resp); err != nil {
+			return vecs, err
+		}
+		if len(resp.Data) != len(docs) {
+			return vecs, fmt.Errorf("openai: embedded %d docs, want %d", len(resp.Data), len(docs))
+		}
+		batch := make([]llm.Vector, len(docs))
+		for _, e := range resp.Data {
+			if e.Index < 0 || e.Index >= len(batch) || batch[e.Index] != nil {
+				return vecs, fmt.Errorf("openai: invalid embedding index %d", e.Index)
+			}
+			batch[e.Index] = e.Embedding
+		}
+		vecs = append(vecs, batch...)
+	}
+	return vecs, nil
+}
+
+type message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function functionCall `json:"function"`
+}
+
+type functionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON encoded as a string
+}
+
+type tool struct {
+	Type     string   `json:"type"`
+	Function function `json:"function"`
+}
+
+type function struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type chatRequest struct {
+	Model    string    `json:"model"`
+	Messages []message `json:"messages"`
+	Tools    []tool    `json:"tools,omitempty"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message message `json:"message"`
+	} `json:"choices"`
+}
+
+// GenerateText returns model-generated text for the prompt,
+// implementing [llm.TextGenerator].
+// The prompt parts are sent as a single user message.
+func (c *Client) GenerateText(prompt ...string) (string, error) {
+	req := &chatRequest{
+		Model:    c.textModel,
+		Messages: []message{{Role: "user", Content: strings.Join(prompt, "\n")}},
+	}
+	var resp chatResponse
+	if err := c.post(context.Background(), "/chat/completions", req, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("openai: no content generated")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// GenerateMessage returns the next model message in the conversation,
+// implementing [llm.ToolGenerator].
+func (c *Client) GenerateMessage(tools []llm.Tool, history []llm.Message) (*llm.Message, error) {
+	req := &chatRequest{Model: c.textModel}
+	for _, t := range tools {
+		req.Tools = append(req.Tools, tool{
+			Type:     "function",
+			Function: function{Name: t.Name(), Description: t.Description(), Parameters: t.Parameters()},
+		})
+	}
+	for _, m := range history {
+		switch m.Role {
+		default:
+			return nil, fmt.Errorf("openai: unknown message role %q", m.Role)
+		case "user":
+			req.Messages = append(req.Messages, message{Role: "user", Content: m.Text})
+		case "model":
+			msg := message{Role: "assistant", Content: m.Text}
+			for _, call := range m.Calls {
+				msg.ToolCalls = append(msg.ToolCalls, toolCall{
+					ID:       call.ID,
+					Type:     "function",
+					Function: functionCall{Name: call.Name, Arguments: string(call.Args)},
+				})
+			}
+			req.Messages = append(req.Messages, msg)
+		case "tool":
+			// The API takes one message per result.
+			for _, r := range m.Results {
+				content := string(r.Result)
+				if r.Error != "" {
+					js, _ := json.Marshal(map[string]string{"error": r.Error})
+					content = string(js)
+				}
+				req.Messages = append(req.Messages, message{Role: "tool", ToolCallID: r.ID, Content: content})
+			}
+		}
+	}
+	var resp chatResponse
+	if err := c.post(context.Background(), "/chat/completions", req, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("openai: no content generated")
+	}
+	reply := resp.Choices[0].Message
+	msg := &llm.Message{Role: "model", Text: reply.Content}
+	for _, call := range reply.ToolCalls {
+		msg.Calls = append(msg.Calls, llm.ToolCall{
+			ID:   call.ID,
+			Name: call.Function.Name,
+			Args: json.RawMessage(call.Function.Arguments),
+		})
+	}
+	return msg, nil
+}
+
+// post posts the JSON encoding of req to the API endpoint
+// with the given path and decodes the JSON response into reply.
+func (c *Client) post(ctx context.Context, path string, req, reply any) error {
+	js, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", c.url+path, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		hreq.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("openai: reading body: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("openai: %s: %s", resp.Status, e.Error.Message)
+		}
+		return fmt.Errorf("openai: %s\n%s", resp.Status, data)
+	}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return fmt.Errorf("openai: decoding reply: %v", err)
+	}
+	return nil
+}
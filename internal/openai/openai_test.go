@@ -0,0 +1,190 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// newServer returns a fake OpenAI-compatible server.
+// Its embedding of a text is the vector {len(text), number of words},
+// returned in reverse order to exercise the index handling.
+// Its generated text is the reversed user message,
+// unless tools are offered, in which case it calls the first one
+// and then reports the result.
+// It requires the API key "sk-test" if key is true.
+func newServer(t *testing.T, key bool) *httptest.Server {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if key && r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"message":"bad key"}}`))
+			return
+		}
+		switch r.URL.Path {
+		default:
+			http.NotFound(w, r)
+		case "/v1/embeddings":
+			var req embedRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "embed" {
+				t.Errorf("bad embedding request: %+v, %v", req, err)
+			}
+			type datum struct {
+				Index     int        `json:"index"`
+				Embedding llm.Vector `json:"embedding"`
+			}
+			var resp struct {
+				Data []datum `json:"data"`
+			}
+			for i, text := range slices.Backward(req.Input) {
+				resp.Data = append(resp.Data, datum{i, llm.Vector{float32(len(text)), float32(len(strings.Fields(text)))}})
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/v1/chat/completions":
+			var req chatRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != defaultTextModel || len(req.Messages) == 0 {
+				t.Errorf("bad chat request: %+v, %v", req, err)
+			}
+			var reply message
+			switch last := req.Messages[len(req.Messages)-1]; {
+			case len(req.Tools) > 0 && last.Role == "user":
+				reply = message{Role: "assistant", ToolCalls: []toolCall{{
+					ID:       "call1",
+					Type:     "function",
+					Function: functionCall{Name: req.Tools[0].Function.Name, Arguments: `{"x":1}`},
+				}}}
+			case last.Role == "tool":
+				reply = message{Role: "assistant", Content: last.ToolCallID + " returned " + last.Content}
+			default:
+				text := []rune(last.Content)
+				slices.Reverse(text)
+				reply = message{Role: "assistant", Content: string(text)}
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"choices": []any{map[string]any{"message": reply}},
+			})
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	srv := newServer(t, true)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := NewClient(lg, secret.Map{host: "user:sk-test"}, srv.Client(), srv.URL+"/v1/")
+	check(err)
+	if m, want := c.EmbeddingModel(), "openai/text-embedding-3-small"; m != want {
+		t.Errorf("EmbeddingModel() = %q, want %q", m, want)
+	}
+	if m, want := c.TextModel(), "openai/gpt-4o-mini"; m != want {
+		t.Errorf("TextModel() = %q, want %q", m, want)
+	}
+	c.SetEmbeddingModel("embed")
+	if m, want := c.EmbeddingModel(), "openai/embed"; m != want {
+		t.Errorf("EmbeddingModel() = %q, want %q", m, want)
+	}
+	var docs []llm.EmbedDoc
+	for i := range 2*maxBatch + 3 {
+		docs = append(docs, llm.EmbedDoc{Text: strings.Repeat("x ", i)})
+	}
+	docs[0] = llm.EmbedDoc{Title: "title", Text: "text"}
+	vecs, err := c.EmbedDocs(ctx, docs)
+	check(err)
+	if len(vecs) != len(docs) {
+		t.Fatalf("len(vecs) = %d, want %d", len(vecs), len(docs))
+	}
+	if want := (llm.Vector{11, 2}); !slices.Equal(vecs[0], want) {
+		t.Errorf("vecs[0] = %v, want %v", vecs[0], want)
+	}
+	for i := 1; i < len(vecs); i++ {
+		if want := (llm.Vector{float32(2 * i), float32(i)}); !slices.Equal(vecs[i], want) {
+			t.Fatalf("vecs[%d] = %v, want %v", i, vecs[i], want)
+		}
+	}
+
+	text, err := c.GenerateText("abc", "def")
+	check(err)
+	if want := "fed\ncba"; text != want {
+		t.Errorf("GenerateText = %q, want %q", text, want)
+	}
+
+	echo := llm.NewTool("echo", "echoes its arguments", json.RawMessage(`{"type":"object"}`),
+		func(args json.RawMessage) (json.RawMessage, error) { return args, nil })
+	text, err = llm.RunTools(c, []llm.Tool{echo}, 1, "call echo")
+	check(err)
+	if want := `call1 returned {"x":1}`; text != want {
+		t.Errorf("RunTools = %q, want %q", text, want)
+	}
+
+	// Without the key.
+	c, err = NewClient(lg, secret.Map{}, srv.Client(), srv.URL+"/v1")
+	check(err)
+	if _, err := c.GenerateText("abc"); err == nil || !strings.Contains(err.Error(), "bad key") {
+		t.Errorf("GenerateText without key: err = %v, want bad key", err)
+	}
+}
+
+func TestNewClientKey(t *testing.T) {
+	lg := testutil.Slogger(t)
+	if _, err := NewClient(lg, secret.Map{}, http.DefaultClient, DefaultURL); err == nil {
+		t.Errorf("NewClient(DefaultURL) without key succeeded")
+	}
+	if _, err := NewClient(lg, secret.Map{"api.openai.com": "sk-x"}, http.DefaultClient, DefaultURL); err != nil {
+		t.Errorf("NewClient(DefaultURL) with key: %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	req, _ := http.NewRequest("POST", DefaultURL+"/embeddings", nil)
+	req.Header.Set("Authorization", "Bearer sk-secret")
+	req.Header.Set("Content-Type", "application/json")
+	if err := Scrub(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Header) != 1 || req.Header.Get("Authorization") != "" {
+		t.Errorf("Scrub left headers %v", req.Header)
+	}
+}
+
+func TestFakeServer(t *testing.T) {
+	check := testutil.Checker(t)
+	srv := testutil.NewLLMServer(t)
+	c, err := NewClient(testutil.Slogger(t), secret.Map{}, srv.Client(), srv.URL())
+	check(err)
+
+	vecs, err := c.EmbedDocs(ctx, []llm.EmbedDoc{{Text: "hello"}, {Title: "title", Text: "world"}})
+	check(err)
+	if len(vecs) != 2 || llm.UnquoteVector(vecs[0]) != "hello" || llm.UnquoteVector(vecs[1]) != "title\n\nworld" {
+		t.Errorf("EmbedDocs = %d vectors, want quotes of hello and title+world", len(vecs))
+	}
+
+	srv.SetGenerate(func(model, prompt string) string { return strings.ToUpper(prompt) })
+	text, err := c.GenerateText("hello")
+	check(err)
+	if text != "HELLO" {
+		t.Errorf("GenerateText = %q, want %q", text, "HELLO")
+	}
+
+	srv.FailNext(1, http.StatusServiceUnavailable)
+	if _, err := c.GenerateText("hello"); err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Errorf("GenerateText with failure: err = %v, want injected failure", err)
+	}
+}
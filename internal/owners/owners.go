@@ -0,0 +1,486 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package owners implements routing new GitHub issues to their owners.
+//
+// A [Router] extracts the packages that each new issue is about
+// from its title (as in "net/http: Serve panics") or, failing that,
+// from the top frame of a stack trace in its body.
+// It looks up the owners of those packages in the repository's
+// CODEOWNERS file (or another file in the same format)
+// and suggests them as assignees, along with any configured area labels.
+// In high-confidence configurations it can instead set the
+// assignees and labels directly (see [Router.EnableApply]).
+package owners
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["owners.Routed", Project, Issue] => JSON of routeRecord
+//
+// and uses the [storage.BeginAction] keys ["owners.Post", Project, Issue]
+// and ["owners.Apply", Project, Issue].
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "owners.Routed", Key: "Project, Issue", Val: "JSON of routeRecord"},
+	)
+}
+
+// A Router routes new issues to the owners of the packages they mention.
+type Router struct {
+	slog         *slog.Logger
+	db           storage.DB
+	github       *github.Client
+	projects     map[string]*Config
+	watcher      *timed.Watcher[*github.Event]
+	name         string
+	timeLimit    time.Time
+	maxAssignees int
+	skipTitles   []string
+	footer       *footer.Footer
+	post         bool
+	apply        bool
+}
+
+// A Config is the routing configuration for a single project.
+type Config struct {
+	// OwnersFile is the path of the CODEOWNERS file in the repository,
+	// such as ".github/CODEOWNERS".
+	OwnersFile string
+
+	// PackageRoot is the directory in the repository that
+	// package paths are relative to, such as "src/" for golang/go.
+	PackageRoot string
+
+	// Labels maps package paths to area labels.
+	// An issue about a package gets the label for the
+	// longest matching package path prefix, if any.
+	// For example, {"cmd/compile": "compiler/runtime"}
+	// labels issues about cmd/compile/internal/ssa "compiler/runtime".
+	Labels map[string]string
+}
+
+// New creates and returns a new Router. It logs to lg, stores state in db,
+// and watches for new GitHub issues using gh.
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Router] methods to configure the parameters
+// (especially [Router.EnableProject] and [Router.EnablePosts])
+// before calling [Router.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, name string) *Router {
+	return &Router{
+		slog:         lg,
+		db:           db,
+		github:       gh,
+		projects:     make(map[string]*Config),
+		watcher:      gh.EventWatcher("owners.Router:" + name),
+		name:         name,
+		timeLimit:    time.Now().Add(-defaultTooOld),
+		maxAssignees: defaultMaxAssignees,
+		footer:       footer.Default(),
+	}
+}
+
+const (
+	defaultTooOld       = 48 * time.Hour
+	defaultMaxAssignees = 2
+)
+
+// EnableProject enables the Router to route issues in the given GitHub project
+// (for example "golang/go") using the given configuration.
+// See also [Router.EnablePosts], which must also be called to post anything to GitHub.
+func (r *Router) EnableProject(project string, cfg *Config) {
+	r.projects[project] = cfg
+}
+
+// EnablePosts enables the Router to post suggestions to GitHub.
+// If EnablePosts has not been called, [Router.Run] logs what it would post
+// but does not post the messages.
+func (r *Router) EnablePosts() {
+	r.post = true
+}
+
+// EnableApply enables the Router to set the assignees and labels itself,
+// instead of posting a suggestion.
+// Like posting, applying changes also requires [Router.EnablePosts].
+func (r *Router) EnableApply() {
+	r.apply = true
+}
+
+// SetTimeLimit controls how old an issue can be for the Router to consider it.
+// Issues created before time t will be skipped.
+// The default is not to consider issues that are more than 48 hours old
+// at the time of the call to [New].
+func (r *Router) SetTimeLimit(t time.Time) {
+	r.timeLimit = t
+}
+
+// SetMaxAssignees sets the maximum number of owners
+// that the Router suggests or assigns for a single issue.
+// The default is 2.
+func (r *Router) SetMaxAssignees(n int) {
+	r.maxAssignees = n
+}
+
+// SkipTitlePrefix configures the Router to skip issues with a title starting
+// with the given prefix, such as "proposal: ", for issues that are
+// routed by a separate process.
+func (r *Router) SkipTitlePrefix(prefix string) {
+	r.skipTitles = append(r.skipTitles, prefix)
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (r *Router) SetFooter(f *footer.Footer) {
+	r.footer = f
+}
+
+// A Route is the routing of an issue.
+type Route struct {
+	Packages []string // packages the issue is about
+	Owners   []string // GitHub logins of owners to assign
+	Labels   []string // area labels to add
+}
+
+// A routeRecord is the database record of an issue
+// that the Router has routed.
+type routeRecord struct {
+	Route
+	Applied bool   `json:",omitempty"` // assignees and labels set directly
+	URL     string `json:",omitempty"` // API URL of posted suggestion, if any
+}
+
+// Run runs a single round of routing.
+// It scans all open issues that have been created since the last call to [Router.Run]
+// using a Router with the same name (see [New]), skipping pull requests,
+// issues that already have assignees, and issues that do not match the configured constraints
+// (see [Router.EnableProject], [Router.SetTimeLimit], and [Router.SkipTitlePrefix]).
+// For each remaining issue, Run determines a [Route] (see [Router.Route]).
+// If the route has owners or labels, Run posts a comment suggesting them
+// or, when [Router.EnableApply] has been called, assigns the owners
+// and adds the labels.
+//
+// Run logs each route to the [slog.Logger] passed to [New].
+// If [Router.EnablePosts] has been called, then Run also makes the change on GitHub,
+// records in the database that it has routed the issue, so that it never routes it again,
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+// When [Router.EnablePosts] has not been called, Run only logs what it would do.
+//
+// If ctx is canceled, Run stops before the next issue.
+func (r *Router) Run(ctx context.Context) {
+	r.slog.Info("owners.Router start", "name", r.name)
+	defer r.slog.Info("owners.Router end", "name", r.name)
+
+	defer r.watcher.Flush()
+
+	tables := make(map[string]*Table)
+	for e := range r.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		cfg := r.projects[e.Project]
+		if cfg == nil || e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		if r.skip(issue) {
+			if r.post {
+				r.watcher.MarkOld(e.DBTime)
+			}
+			continue
+		}
+		key := ordered.Encode("owners.Routed", e.Project, e.Issue)
+		if _, ok := r.db.Get(key); ok {
+			continue
+		}
+
+		t := tables[e.Project]
+		if t == nil {
+			data, err := r.github.DownloadFile(e.Project, cfg.OwnersFile)
+			if err != nil {
+				// Try again next time.
+				r.slog.Error("owners.Router download", "project", e.Project, "file", cfg.OwnersFile, "err", err)
+				return
+			}
+			t = Parse(string(data))
+			tables[e.Project] = t
+		}
+		rec := &routeRecord{Route: *r.Route(t, cfg, issue)}
+		if len(rec.Owners) > 0 || len(rec.Labels) > 0 {
+			if !r.act(issue, rec) {
+				continue
+			}
+		} else {
+			r.slog.Info("owners.Router no route", "name", r.name, "project", e.Project, "issue", e.Issue, "packages", rec.Packages)
+		}
+		if !r.post {
+			continue
+		}
+		r.db.Set(key, storage.JSON(rec))
+		r.watcher.MarkOld(e.DBTime)
+
+		// Flush immediately to make sure we don't re-post if interrupted later in the loop.
+		r.watcher.Flush()
+		r.db.Flush()
+	}
+}
+
+// skip reports whether the Router should skip the issue.
+func (r *Router) skip(issue *github.Issue) bool {
+	if issue.State == "closed" || issue.PullRequest != nil || len(issue.Assignees) > 0 {
+		return true
+	}
+	tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+	if err != nil {
+		r.slog.Error("owners parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
+		return true
+	}
+	if tm.Before(r.timeLimit) {
+		return true
+	}
+	for _, prefix := range r.skipTitles {
+		if strings.HasPrefix(issue.Title, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// act posts or applies the route in rec for the issue,
+// recording what it did in rec and reporting whether it succeeded
+// (or, in dry-run mode, would have).
+func (r *Router) act(issue *github.Issue, rec *routeRecord) bool {
+	project := issue.Project()
+	if r.apply {
+		r.slog.Info("owners.Router apply", "name", r.name, "project", project, "issue", issue.Number, "packages", rec.Packages, "owners", rec.Owners, "labels", rec.Labels)
+		if !r.post {
+			return true
+		}
+		action := ordered.Encode("owners.Apply", project, issue.Number)
+		if !storage.BeginAction(r.db, action) {
+			return true
+		}
+		changes := &github.IssueChanges{}
+		if len(rec.Owners) > 0 {
+			changes.Assignees = &rec.Owners
+		}
+		if len(rec.Labels) > 0 {
+			var labels []string
+			for _, l := range issue.Labels {
+				labels = append(labels, l.Name)
+			}
+			labels = append(labels, rec.Labels...)
+			changes.Labels = &labels
+		}
+		if err := r.github.EditIssue(issue, changes); err != nil {
+			r.slog.Error("EditIssue", "issue", issue.Number, "err", err)
+			storage.CancelAction(r.db, action)
+			return false
+		}
+		storage.FinishAction(r.db, action, nil)
+		rec.Applied = true
+		return true
+	}
+
+	body := r.comment(project, &rec.Route)
+	r.slog.Info("owners.Router post", "name", r.name, "project", project, "issue", issue.Number, "packages", rec.Packages, "owners", rec.Owners, "labels", rec.Labels, "comment", body)
+	if !r.post {
+		return true
+	}
+	action := ordered.Encode("owners.Post", project, issue.Number)
+	if !storage.BeginAction(r.db, action) {
+		return true
+	}
+	url, err := r.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		r.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(r.db, action)
+		return false
+	}
+	storage.FinishAction(r.db, action, url)
+	rec.URL = url
+	return true
+}
+
+// comment returns the text of a comment suggesting the route.
+func (r *Router) comment(project string, rt *Route) string {
+	var b strings.Builder
+	pkgs := make([]string, len(rt.Packages))
+	for i, p := range rt.Packages {
+		pkgs[i] = "`" + p + "`"
+	}
+	fmt.Fprintf(&b, "This issue appears to be about %s.", strings.Join(pkgs, ", "))
+	if len(rt.Owners) > 0 {
+		owners := make([]string, len(rt.Owners))
+		for i, o := range rt.Owners {
+			owners[i] = "@" + o
+		}
+		fmt.Fprintf(&b, " CC %s (owners).", strings.Join(owners, ", "))
+	}
+	if len(rt.Labels) > 0 {
+		labels := make([]string, len(rt.Labels))
+		for i, l := range rt.Labels {
+			labels[i] = "**" + l + "**"
+		}
+		fmt.Fprintf(&b, " Suggested labels: %s.", strings.Join(labels, ", "))
+	}
+	b.WriteString("\n")
+	b.WriteString(r.footer.Render("owners", project))
+	return b.String()
+}
+
+// Route returns the route for the issue, given the project's
+// owners table t and configuration cfg.
+// The issue's author is never suggested as an owner,
+// nor are labels the issue already has.
+func (r *Router) Route(t *Table, cfg *Config, issue *github.Issue) *Route {
+	rt := &Route{Packages: Packages(issue)}
+	for _, pkg := range rt.Packages {
+		for _, o := range t.Owners(cfg.PackageRoot + pkg + "/") {
+			if len(rt.Owners) < r.maxAssignees && o != issue.User.Login && !slices.Contains(rt.Owners, o) {
+				rt.Owners = append(rt.Owners, o)
+			}
+		}
+		if l := areaLabel(cfg.Labels, pkg); l != "" && !slices.Contains(rt.Labels, l) &&
+			!slices.ContainsFunc(issue.Labels, func(x github.Label) bool { return x.Name == l }) {
+			rt.Labels = append(rt.Labels, l)
+		}
+	}
+	return rt
+}
+
+// areaLabel returns the label for the longest prefix of pkg in labels,
+// or "" if there is none.
+func areaLabel(labels map[string]string, pkg string) string {
+	for p := pkg; ; p = path.Dir(p) {
+		if l, ok := labels[p]; ok {
+			return l
+		}
+		if !strings.Contains(p, "/") {
+			return ""
+		}
+	}
+}
+
+var (
+	pkgRE   = regexp.MustCompile(`^[a-z0-9_.\-]+(/[a-z0-9_.\-]+)*$`)
+	frameRE = regexp.MustCompile(`/src/((?:[a-z0-9_.\-]+/)*[a-z0-9_.\-]+)/[\w.\-]+\.go:\d+`)
+)
+
+// Packages returns the package paths that the issue is about.
+// They are taken from the title prefix, as in "net/http, net/url: ...",
+// or if the title has no such prefix, from the top frame of the first
+// stack trace in the body.
+func Packages(issue *github.Issue) []string {
+	var pkgs []string
+	if prefix, _, ok := strings.Cut(issue.Title, ":"); ok {
+		for _, p := range strings.Split(prefix, ",") {
+			p = strings.TrimSpace(p)
+			if pkgRE.MatchString(p) && !slices.Contains(pkgs, p) {
+				pkgs = append(pkgs, p)
+			}
+		}
+	}
+	if len(pkgs) == 0 {
+		if m := frameRE.FindStringSubmatch(issue.Body); m != nil {
+			pkgs = append(pkgs, m[1])
+		}
+	}
+	return pkgs
+}
+
+// A Table is a parsed CODEOWNERS file.
+type Table struct {
+	rules []rule
+}
+
+// A rule is a single CODEOWNERS line.
+type rule struct {
+	pattern string
+	owners  []string
+}
+
+// Parse parses the content of a CODEOWNERS file.
+// Each non-blank, non-comment line is a path pattern followed by owners.
+// Owners that are teams ("@org/team") or email addresses cannot be
+// assigned issues and are ignored.
+func Parse(text string) *Table {
+	t := new(Table)
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		var owners []string
+		for _, o := range f[1:] {
+			if login, ok := strings.CutPrefix(o, "@"); ok && !strings.Contains(login, "/") {
+				owners = append(owners, login)
+			}
+		}
+		t.rules = append(t.rules, rule{f[0], owners})
+	}
+	return t
+}
+
+// Owners returns the owners of the directory dir,
+// which must end in a slash.
+// As in CODEOWNERS files, the last matching rule takes precedence.
+func (t *Table) Owners(dir string) []string {
+	for _, r := range slices.Backward(t.rules) {
+		if match(r.pattern, dir) {
+			return r.owners
+		}
+	}
+	return nil
+}
+
+// match reports whether the CODEOWNERS pattern matches the directory dir.
+// It implements the commonly used subset of the gitignore syntax:
+// patterns containing a slash (other than a trailing one) are relative
+// to the repository root and match directories and their subdirectories;
+// other patterns match any path element; and path elements may
+// contain the wildcards accepted by [path.Match].
+// Patterns with a "**" element match only as a trailing "/**".
+func match(pattern, dir string) bool {
+	pattern = strings.TrimSuffix(pattern, "/**")
+	pattern = strings.TrimSuffix(pattern, "/")
+	elems := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	if !strings.Contains(pattern, "/") {
+		for _, e := range elems {
+			if ok, _ := path.Match(pattern, e); ok {
+				return true
+			}
+		}
+		return false
+	}
+	pelems := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if len(pelems) > len(elems) {
+		return false
+	}
+	for i, p := range pelems {
+		if ok, _ := path.Match(p, elems[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
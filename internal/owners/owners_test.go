@@ -0,0 +1,150 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package owners
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+const codeowners = `
+# Default owners.
+*                     @golang/release
+/src/net/             @alice @bob
+/src/net/http/        @carol @alice # HTTP
+/src/cmd/compile/**   @dave @golang/compiler dave@example.com
+/src/cmd/*/internal/  @erin
+`
+
+var ownersTests = []struct {
+	dir    string
+	owners []string
+}{
+	{"doc/", nil},
+	{"src/net/", []string{"alice", "bob"}},
+	{"src/net/url/", []string{"alice", "bob"}},
+	{"src/net/http/", []string{"carol", "alice"}},
+	{"src/net/http/httptest/", []string{"carol", "alice"}},
+	{"src/cmd/compile/", []string{"dave"}},
+	{"src/cmd/compile/internal/", []string{"erin"}},
+	{"src/cmd/compile/internal/ssa/", []string{"erin"}},
+	{"src/netx/", nil},
+}
+
+func TestOwners(t *testing.T) {
+	tab := Parse(codeowners)
+	for _, tt := range ownersTests {
+		if owners := tab.Owners(tt.dir); !slices.Equal(owners, tt.owners) {
+			t.Errorf("Owners(%q) = %q, want %q", tt.dir, owners, tt.owners)
+		}
+	}
+}
+
+var packagesTests = []struct {
+	title string
+	body  string
+	pkgs  []string
+}{
+	{"net/http: Serve panics", "", []string{"net/http"}},
+	{"net/http, net/url: bad parsing", "", []string{"net/http", "net/url"}},
+	{"cmd/compile/internal/ssa: ICE", "", []string{"cmd/compile/internal/ssa"}},
+	{"Something is broken: help", "", nil},
+	{"crash", "goroutine 1 [running]:\nnet/url.Parse(...)\n\t/usr/local/go/src/net/url/url.go:123 +0x1c\n" +
+		"main.main()\n\t/home/me/src/x/main.go:5 +0x20\n", []string{"net/url"}},
+}
+
+func TestPackages(t *testing.T) {
+	for _, tt := range packagesTests {
+		pkgs := Packages(&github.Issue{Title: tt.title, Body: tt.body})
+		if !slices.Equal(pkgs, tt.pkgs) {
+			t.Errorf("Packages(%q) = %q, want %q", tt.title, pkgs, tt.pkgs)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	tc := gh.Testing()
+	tc.AddFile("rsc/tmp", ".github/CODEOWNERS", []byte(codeowners))
+	add := func(n int64, user, title string, assignees ...string) {
+		issue := &github.Issue{
+			Number:    n,
+			Title:     title,
+			User:      github.User{Login: user},
+			State:     "open",
+			CreatedAt: "2024-06-01T10:00:00Z",
+		}
+		for _, a := range assignees {
+			issue.Assignees = append(issue.Assignees, github.User{Login: a})
+		}
+		tc.AddIssue("rsc/tmp", issue)
+	}
+	add(1, "mallory", "net/http: Serve panics")
+	add(2, "carol", "net/http, cmd/compile: both broken")
+	add(3, "mallory", "net/http: assigned", "alice")
+	add(4, "mallory", "unclear report")
+	add(5, "mallory", "doc: typo")
+
+	cfg := &Config{
+		OwnersFile:  ".github/CODEOWNERS",
+		PackageRoot: "src/",
+		Labels:      map[string]string{"cmd/compile": "compiler/runtime", "doc": "Documentation"},
+	}
+	r := New(lg, db, gh, "test")
+	r.EnableProject("rsc/tmp", cfg)
+	r.SetTimeLimit(time.Time{})
+	r.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("dry run posted: %v", edits)
+	}
+
+	r.EnablePosts()
+	r.Run(ctx)
+	var have []string
+	for _, e := range tc.Edits() {
+		have = append(have, fmt.Sprintf("#%d %s", e.Issue, e.IssueCommentChanges.Body))
+	}
+	foot := footer.Default().Render("owners", "rsc/tmp")
+	want := []string{
+		"#1 This issue appears to be about `net/http`. CC @carol, @alice (owners).\n" + foot,
+		"#2 This issue appears to be about `net/http`, `cmd/compile`. CC @alice, @dave (owners). Suggested labels: **compiler/runtime**.\n" + foot,
+		"#5 This issue appears to be about `doc`. Suggested labels: **Documentation**.\n" + foot,
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Run posted:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+	tc.ClearEdits()
+
+	r.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("second Run posted: %v", edits)
+	}
+
+	// Applying changes.
+	add(6, "mallory", "cmd/compile: ICE")
+	r.EnableApply()
+	r.Run(ctx)
+	have = nil
+	for _, e := range tc.Edits() {
+		have = append(have, e.String())
+	}
+	want = []string{`EditIssue(rsc/tmp#6, {"labels":["compiler/runtime"],"assignees":["dave"]})`}
+	if !slices.Equal(have, want) {
+		t.Errorf("Run applied:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+}
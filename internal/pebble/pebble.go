@@ -126,6 +126,14 @@ func (d *db) Close() {
 	}
 }
 
+// Checkpoint writes a consistent copy of the database,
+// usable by [Open], to the new directory dir.
+// The database can be in use during the checkpoint.
+// (See [rsc.io/gaby/internal/backup.Checkpointer].)
+func (d *db) Checkpoint(dir string) error {
+	return d.p.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
 func (d *db) Scan(start, end []byte) iter.Seq2[[]byte, func() []byte] {
 	start = bytes.Clone(start)
 	end = bytes.Clone(end)
@@ -142,17 +150,20 @@ func (d *db) Scan(start, end []byte) iter.Seq2[[]byte, func() []byte] {
 		}
 		defer iter.Close()
 		for iter.First(); iter.Valid(); iter.Next() {
+			// Pebble reuses the memory behind Key and Value
+			// when the iterator moves, so copy them.
 			key := iter.Key()
 			if bytes.Compare(key, end) > 0 {
 				break
 			}
+			key = bytes.Clone(key)
 			val := func() []byte {
 				v, err := iter.ValueAndErr()
 				if err != nil {
 					// unreachable except db error
 					d.Panic("pebble iterator value", "key", storage.Fmt(key), "err", err)
 				}
-				return v
+				return bytes.Clone(v)
 			}
 			if !yield(key, val) {
 				return
@@ -49,6 +49,19 @@ func TestDB(t *testing.T) {
 
 	storage.TestDB(t, db)
 
+	db2, err := Create(lg, dir+"/db2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2.Close()
+	storage.TestPersistentDB(t, func() storage.DB {
+		db, err := Open(lg, dir+"/db2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+
 	if testing.Short() {
 		return
 	}
@@ -0,0 +1,359 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package priority implements ranking new GitHub issues by likely urgency.
+//
+// A [Scorer] scores each new open issue by adding up weighted signals:
+// keywords suggesting a crash, regression, or security problem
+// (see [Scorer.SetKeywords]), mentions of currently supported releases
+// (see [Scorer.SetReleases]), and similarity to past release-blocking issues
+// (see [Scorer.SetBlockerLabel]).
+// It records the scores in the database, and [Scorer.Ranking] returns
+// the open issues in order of decreasing score, so that triagers
+// can work from the top down.
+// A Scorer never writes to GitHub.
+package priority
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["priority.Score", Name, Project, Issue] => JSON of Score
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "priority.Score", Key: "Name, Project, Issue", Val: "JSON of Score"},
+	)
+}
+
+// A Scorer scores new issues by likely urgency.
+type Scorer struct {
+	slog          *slog.Logger
+	db            storage.DB
+	vdb           storage.VectorDB
+	github        *github.Client
+	projects      map[string]bool
+	watcher       *timed.Watcher[*github.Event]
+	name          string
+	timeLimit     time.Time
+	keywords      []Keyword
+	releases      []string
+	releaseWeight float64
+	blockerLabel  string
+	blockerWeight float64
+	neighbors     int
+	scoreCutoff   float64
+}
+
+// New creates and returns a new Scorer. It logs to lg, stores state in db,
+// watches for new GitHub issues using gh, and looks up similar issues
+// in vdb, which must contain embeddings of the GitHub issues
+// (see [rsc.io/gaby/internal/githubdocs] and [rsc.io/gaby/internal/embeddocs]).
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Scorer] methods to configure the parameters
+// (especially [Scorer.EnableProject]) before calling [Scorer.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, vdb storage.VectorDB, name string) *Scorer {
+	return &Scorer{
+		slog:          lg,
+		db:            db,
+		vdb:           vdb,
+		github:        gh,
+		projects:      make(map[string]bool),
+		watcher:       gh.EventWatcher("priority.Scorer:" + name),
+		name:          name,
+		timeLimit:     time.Now().Add(-defaultTooOld),
+		keywords:      DefaultKeywords,
+		releaseWeight: defaultReleaseWeight,
+		blockerLabel:  defaultBlockerLabel,
+		blockerWeight: defaultBlockerWeight,
+		neighbors:     defaultNeighbors,
+		scoreCutoff:   defaultScoreCutoff,
+	}
+}
+
+const (
+	defaultTooOld        = 7 * 24 * time.Hour
+	defaultReleaseWeight = 2
+	defaultBlockerLabel  = "release-blocker"
+	defaultBlockerWeight = 4
+	defaultNeighbors     = 10
+	defaultScoreCutoff   = 0.82
+)
+
+// A Keyword is a pattern in an issue's title or body that suggests urgency.
+type Keyword struct {
+	Name   string         // short description, used in [Reason]
+	Weight float64        // amount added to the score when Regexp matches
+	Regexp *regexp.Regexp // pattern to match
+}
+
+// DefaultKeywords is the default list of keywords used by a [Scorer].
+var DefaultKeywords = []Keyword{
+	{"crash", 3, regexp.MustCompile(`(?i)\b(panic(s|ked)?|crash(es|ed)?|SIGSEGV|fatal error|segmentation fault)\b`)},
+	{"regression", 3, regexp.MustCompile(`(?i)\b(regression|regressed|used to work|no longer works)\b`)},
+	{"security", 4, regexp.MustCompile(`(?i)\b(security|vulnerability|CVE-\d+-\d+)\b`)},
+	{"wrong result", 2, regexp.MustCompile(`(?i)\b(miscompil(e|es|ed|ation)|wrong (result|code|output|answer)|data corruption)\b`)},
+	{"hang", 2, regexp.MustCompile(`(?i)\b(deadlock(s|ed)?|hangs|data race)\b`)},
+}
+
+// EnableProject enables the Scorer to score issues in the given GitHub project
+// (for example "golang/go").
+func (s *Scorer) EnableProject(project string) {
+	s.projects[project] = true
+}
+
+// SetTimeLimit controls how old an issue can be for the Scorer to consider it.
+// Issues created before time t will be skipped.
+// The default is not to consider issues that are more than a week old
+// at the time of the call to [New].
+func (s *Scorer) SetTimeLimit(t time.Time) {
+	s.timeLimit = t
+}
+
+// SetKeywords sets the keywords that the Scorer looks for
+// in issue titles and bodies.
+// Each keyword contributes its weight at most once per issue.
+// The default is [DefaultKeywords].
+func (s *Scorer) SetKeywords(kws []Keyword) {
+	s.keywords = kws
+}
+
+// SetReleases sets the releases that are currently supported,
+// such as "go1.22" and "go1.23", and the weight added to the score
+// of an issue that mentions any of them (alone or as part
+// of a release branch name like "release-branch.go1.23").
+// There are no releases by default; the default weight is 2.
+func (s *Scorer) SetReleases(weight float64, releases ...string) {
+	s.releaseWeight = weight
+	s.releases = releases
+}
+
+// SetBlockerLabel sets the label that marks release-blocking issues
+// and the weight given to similarity to them.
+// An issue that is similar to an issue with the label has its score
+// increased by weight times the highest such similarity.
+// The defaults are "release-blocker" and 4.
+func (s *Scorer) SetBlockerLabel(label string, weight float64) {
+	s.blockerLabel = label
+	s.blockerWeight = weight
+}
+
+// SetNeighbors sets the maximum number of similar issues consulted (n)
+// and the minimum vector search score that an issue must have
+// to be considered similar (min).
+// The defaults are 10 and 0.82.
+func (s *Scorer) SetNeighbors(n int, min float64) {
+	s.neighbors = n
+	s.scoreCutoff = min
+}
+
+// A Score is the recorded urgency score of an issue.
+type Score struct {
+	Project string
+	Issue   int64
+	Title   string
+	Score   float64  // sum of reason weights
+	Reasons []Reason `json:",omitempty"`
+}
+
+// A Reason is a single contribution to a [Score].
+type Reason struct {
+	Reason string
+	Weight float64
+}
+
+// String returns a one-line description of the score.
+func (sc *Score) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%.2f %s#%d %s", sc.Score, sc.Project, sc.Issue, sc.Title)
+	for i, r := range sc.Reasons {
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "%s +%.2f", r.Reason, r.Weight)
+	}
+	if len(sc.Reasons) > 0 {
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+// Run runs a single round of scoring.
+// It scans all issues that have been created or updated since the last call to [Scorer.Run]
+// using a Scorer with the same name (see [New]), skipping pull requests
+// and issues that do not match the configured constraints
+// (see [Scorer.EnableProject] and [Scorer.SetTimeLimit]).
+// Run records a score for each remaining open issue, replacing any earlier score,
+// and deletes the scores of issues that have been closed.
+// Run logs each score to the [slog.Logger] passed to [New].
+//
+// If ctx is canceled, Run stops before the next issue.
+func (s *Scorer) Run(ctx context.Context) {
+	s.slog.Info("priority.Scorer start", "name", s.name)
+	defer s.slog.Info("priority.Scorer end", "name", s.name)
+
+	defer s.watcher.Flush()
+
+	for e := range s.watcher.Recent() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !s.projects[e.Project] || e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		key := ordered.Encode("priority.Score", s.name, e.Project, e.Issue)
+		switch {
+		case issue.PullRequest != nil:
+			// ignore
+		case issue.State == "closed":
+			s.db.Delete(key)
+		case s.tooOld(issue):
+			// ignore
+		default:
+			sc := s.Score(issue)
+			s.slog.Info("priority.Scorer score", "name", s.name, "project", e.Project, "issue", e.Issue, "score", sc.Score, "reasons", sc.Reasons)
+			s.db.Set(key, storage.JSON(sc))
+		}
+		s.watcher.MarkOld(e.DBTime)
+	}
+	s.db.Flush()
+}
+
+// tooOld reports whether the issue was created before the time limit.
+func (s *Scorer) tooOld(issue *github.Issue) bool {
+	tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+	if err != nil {
+		s.slog.Error("priority parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
+		return true
+	}
+	return tm.Before(s.timeLimit)
+}
+
+// Score computes and returns the score of the issue,
+// without recording it.
+func (s *Scorer) Score(issue *github.Issue) *Score {
+	sc := &Score{Project: issue.Project(), Issue: issue.Number, Title: issue.Title}
+	add := func(weight float64, format string, args ...any) {
+		sc.Reasons = append(sc.Reasons, Reason{fmt.Sprintf(format, args...), weight})
+		sc.Score += weight
+	}
+
+	text := issue.Title + "\n" + issue.Body
+	for _, kw := range s.keywords {
+		if m := kw.Regexp.FindString(text); m != "" {
+			add(kw.Weight, "%s: %q", kw.Name, m)
+		}
+	}
+	for _, r := range s.releases {
+		if mentions(text, r) {
+			add(s.releaseWeight, "release: %s", r)
+			break
+		}
+	}
+	if b, score := s.blocker(issue); b != nil {
+		add(s.blockerWeight*score, "similar to release blocker #%d (%.2f)", b.Number, score)
+	}
+	return sc
+}
+
+// mentions reports whether text mentions the release r,
+// not counting mentions of longer release names, such as
+// "go1.23" when r is "go1.2".
+// Patch releases ("go1.23.4") and release candidates ("go1.23rc1")
+// count as mentions.
+func mentions(text, r string) bool {
+	for {
+		i := strings.Index(text, r)
+		if i < 0 {
+			return false
+		}
+		before, after := text[:i], text[i+len(r):]
+		if (before == "" || !isWordByte(before[len(before)-1])) && (after == "" || !isDigit(after[0])) {
+			return true
+		}
+		text = after
+	}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isWordByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c) || c == '_'
+}
+
+// blocker returns the most similar release-blocking issue to issue,
+// along with its similarity score, or nil, 0 if there is none.
+func (s *Scorer) blocker(issue *github.Issue) (*github.Issue, float64) {
+	if s.blockerLabel == "" {
+		return nil, 0
+	}
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", issue.Project(), issue.Number)
+	vec, found := s.vdb.Get(u)
+	if !found {
+		s.slog.Info("priority.Scorer no embedding", "project", issue.Project(), "issue", issue.Number)
+		return nil, 0
+	}
+	n := 0
+	// Search for extra results, since many will be other kinds of documents.
+	for _, r := range s.vdb.Search(vec, 4*s.neighbors+5) {
+		if n >= s.neighbors || r.Score < s.scoreCutoff {
+			break
+		}
+		if r.ID == u {
+			continue
+		}
+		other, err := s.github.LookupIssueURL(r.ID)
+		if err != nil || other.Project() != issue.Project() || other.PullRequest != nil {
+			continue
+		}
+		n++
+		if slices.ContainsFunc(other.Labels, func(l github.Label) bool { return l.Name == s.blockerLabel }) {
+			// Results are in decreasing score order, so this is the best.
+			return other, r.Score
+		}
+	}
+	return nil, 0
+}
+
+// Ranking returns the recorded scores of the open issues in project,
+// in decreasing score order (and increasing issue order among equal scores).
+func (s *Scorer) Ranking(project string) []*Score {
+	var list []*Score
+	start := ordered.Encode("priority.Score", s.name, project)
+	end := ordered.Encode("priority.Score", s.name, project, ordered.Inf)
+	for key, val := range s.db.Scan(start, end) {
+		var sc Score
+		if err := json.Unmarshal(val(), &sc); err != nil {
+			// unreachable unless corrupt storage
+			s.db.Panic("priority.Scorer decode", "key", storage.Fmt(key), "err", err)
+		}
+		list = append(list, &sc)
+	}
+	slices.SortStableFunc(list, func(x, y *Score) int {
+		return -cmp.Compare(x.Score, y.Score)
+	})
+	return list
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package priority
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "vecs")
+	tc := gh.Testing()
+	add := func(n int64, state, title, body string, vec llm.Vector, labels ...string) {
+		issue := &github.Issue{
+			Number:    n,
+			Title:     title,
+			Body:      body,
+			State:     state,
+			CreatedAt: "2024-06-01T10:00:00Z",
+		}
+		for _, l := range labels {
+			issue.Labels = append(issue.Labels, github.Label{Name: l})
+		}
+		tc.AddIssue("rsc/tmp", issue)
+		if vec != nil {
+			vdb.Set(fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", n), vec)
+		}
+	}
+	add(1, "closed", "runtime: crash in GC", "", llm.Vector{1, 0}, "release-blocker")
+	add(2, "open", "runtime: crash during GC", "Seen with go1.23.1 on linux.", llm.Vector{1, 0})
+	add(3, "open", "fmt: improve docs", "The docs for go1.2 could be better.", llm.Vector{0, 1})
+	add(4, "open", "net/http: Serve regressed", "This used to work in go1.22.", llm.Vector{0, 1})
+	add(5, "open", "cmd/go: panic on [release-branch.go1.22]", "", nil)
+
+	s := New(lg, db, gh, vdb, "test")
+	s.EnableProject("rsc/tmp")
+	s.SetTimeLimit(time.Time{})
+	s.SetReleases(2, "go1.22", "go1.23")
+
+	// A canceled Run scores nothing, leaving the issues for the next Run.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	s.Run(canceled)
+	if r := s.Ranking("rsc/tmp"); len(r) != 0 {
+		t.Errorf("Ranking after canceled Run = %v", r)
+	}
+
+	s.Run(ctx)
+
+	var have []string
+	for _, sc := range s.Ranking("rsc/tmp") {
+		have = append(have, sc.String())
+	}
+	want := []string{
+		`9.00 rsc/tmp#2 runtime: crash during GC (crash: "crash" +3.00; release: go1.23 +2.00; similar to release blocker #1 (1.00) +4.00)`,
+		`5.00 rsc/tmp#4 net/http: Serve regressed (regression: "regressed" +3.00; release: go1.22 +2.00)`,
+		`5.00 rsc/tmp#5 cmd/go: panic on [release-branch.go1.22] (crash: "panic" +3.00; release: go1.22 +2.00)`,
+		`0.00 rsc/tmp#3 fmt: improve docs`,
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("Ranking:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("Run edited GitHub: %v", edits)
+	}
+
+	// Closed issues drop out of the ranking.
+	add(2, "closed", "runtime: crash during GC", "", nil)
+	s.Run(ctx)
+	if r := s.Ranking("rsc/tmp"); len(r) != 3 || r[0].Issue != 4 {
+		t.Errorf("Ranking after close = %v", r)
+	}
+}
+
+var mentionsTests = []struct {
+	text string
+	out  bool
+}{
+	{"go1.22", true},
+	{"go1.22.4", true},
+	{"go1.22rc1", true},
+	{"release-branch.go1.22", true},
+	{"Using go1.22.", true},
+	{"go1.220", false},
+	{"xgo1.22", false},
+	{"go1.2 and go1.22", true},
+}
+
+func TestMentions(t *testing.T) {
+	for _, tt := range mentionsTests {
+		if out := mentions(tt.text, "go1.22"); out != tt.out {
+			t.Errorf("mentions(%q, go1.22) = %v, want %v", tt.text, out, tt.out)
+		}
+	}
+}
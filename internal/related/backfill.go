@@ -0,0 +1,148 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"regexp"
+	"strconv"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This file stores the following key schema in the database:
+//
+//	["related.Backfill", Name, Project, Issue] => JSON of BackfillResult
+//
+// Name is the Poster name passed to [New].
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "related.Backfill", Key: "Name, Project, Issue", Val: "JSON of BackfillResult"},
+	)
+}
+
+// A BackfillResult is the result of evaluating a single historical issue
+// (see [Poster.Backfill]).
+type BackfillResult struct {
+	Project string
+	Issue   int64
+	Skip    string                 `json:",omitempty"` // reason the issue would have been skipped
+	Related []storage.VectorResult `json:",omitempty"` // documents that would have been posted
+
+	// DuplicateOf is the number of the issue that this issue
+	// was marked as a duplicate of, by a “Duplicate of #N” comment,
+	// or 0 if it was not marked as a duplicate.
+	// DuplicateRank is the 1-based position of that issue in Related,
+	// or 0 if it is not listed.
+	DuplicateOf   int64 `json:",omitempty"`
+	DuplicateRank int   `json:",omitempty"`
+}
+
+// duplicateOfRE matches GitHub's conventional “Duplicate of #N” comment,
+// which closes an issue as a duplicate.
+var duplicateOfRE = regexp.MustCompile(`(?im)^\s*duplicate of #([0-9]+)\b`)
+
+// Backfill evaluates the issues in project numbered issueMin ≤ issue ≤ issueMax
+// (with no upper limit if issueMax < 0), recording in the database
+// what the Poster would have posted on each one when it was created.
+// It considers only documents that existed at that time,
+// to the extent that it can tell: GitHub issues created later are ignored,
+// but other documents and edits to existing issues are not.
+// Backfill reports the number of issues evaluated.
+//
+// Backfill never posts to GitHub, and unlike [Poster.Run], it evaluates
+// closed issues and ignores [Poster.SetTimeLimit], so that maintainers
+// can assess how the Poster would have performed on historical issues.
+// Use [Poster.BackfillResults] to retrieve the results.
+// For issues that maintainers marked as duplicates,
+// the results record whether the Poster found the original issue,
+// providing evaluation data for duplicate detection.
+func (p *Poster) Backfill(project string, issueMin, issueMax int64) int {
+	p.loadConfig()
+	n := 0
+	for e := range p.github.Events(project, issueMin, issueMax) {
+		if e.API != "/issues" {
+			continue
+		}
+		issue := e.Typed.(*github.Issue)
+		r := p.backfill(project, issue)
+		p.db.Set(ordered.Encode("related.Backfill", p.name, project, issue.Number), storage.JSON(r))
+		n++
+	}
+	p.db.Flush()
+	return n
+}
+
+// backfill evaluates a single historical issue.
+func (p *Poster) backfill(project string, issue *github.Issue) *BackfillResult {
+	r := &BackfillResult{Project: project, Issue: issue.Number}
+	for e := range p.github.Events(project, issue.Number, issue.Number) {
+		if e.API != "/issues/comments" {
+			continue
+		}
+		if m := duplicateOfRE.FindStringSubmatch(e.Typed.(*github.IssueComment).Body); m != nil {
+			r.DuplicateOf, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+	}
+
+	// The issue is being evaluated as it was when created, so it was open.
+	if issue.PullRequest != nil {
+		r.Skip = "pull request"
+		return r
+	}
+	for _, ig := range p.ignores {
+		if ig.match(issue) {
+			r.Skip = ig.String()
+			return r
+		}
+	}
+	created, err := time.Parse(time.RFC3339, issue.CreatedAt)
+	if err != nil {
+		r.Skip = "invalid creation time"
+		return r
+	}
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", project, issue.Number)
+	vec, ok := p.vdb.Get(u)
+	if !ok {
+		r.Skip = "no embedding"
+		return r
+	}
+	r.Related = p.searchBefore(project, u, vec, created)
+	if r.DuplicateOf != 0 {
+		orig := fmt.Sprintf("https://github.com/%s/issues/%d", project, r.DuplicateOf)
+		for i, doc := range r.Related {
+			if doc.ID == orig {
+				r.DuplicateRank = i + 1
+				break
+			}
+		}
+	}
+	return r
+}
+
+// BackfillResults returns an iterator over the results recorded by
+// [Poster.Backfill] for issues in project, in increasing issue order.
+func (p *Poster) BackfillResults(project string) iter.Seq[*BackfillResult] {
+	return func(yield func(*BackfillResult) bool) {
+		start := ordered.Encode("related.Backfill", p.name, project)
+		end := ordered.Encode("related.Backfill", p.name, project, ordered.Inf)
+		for key, val := range p.db.Scan(start, end) {
+			var r BackfillResult
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster backfill decode", "key", storage.Fmt(key), "err", err)
+			}
+			if !yield(&r) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// A Config is the posting policy of a Poster,
+// stored in the database so that it can be inspected and changed
+// (by maintainers or, eventually, by an LLM acting on their behalf)
+// without changing the program that runs the Poster.
+//
+// Skip rules added by [Poster.SkipIf] cannot be stored
+// and are not part of a Config.
+// The zero MinScore and MaxResults mean the defaults
+// (see [Poster.SetMinScore] and [Poster.SetMaxResults]).
+type Config struct {
+	Projects         []string // projects to post on (see [Poster.EnableProject])
+	SkipBodyContains []string `json:",omitempty"` // see [Poster.SkipBodyContains]
+	SkipTitlePrefix  []string `json:",omitempty"` // see [Poster.SkipTitlePrefix]
+	SkipTitleSuffix  []string `json:",omitempty"` // see [Poster.SkipTitleSuffix]
+	SkipLabels       []string `json:",omitempty"` // see [Poster.SkipLabel]
+	SkipAuthors      []string `json:",omitempty"` // see [Poster.SkipAuthor]
+	MinScore         float64  `json:",omitempty"` // see [Poster.SetMinScore]
+	MaxResults       int      `json:",omitempty"` // see [Poster.SetMaxResults]
+}
+
+// Validate reports whether c is a valid configuration,
+// returning an error describing the first problem found, if any.
+func (c *Config) Validate() error {
+	if c.MinScore < 0 || c.MinScore > 1 {
+		return fmt.Errorf("related.Poster: invalid MinScore %v", c.MinScore)
+	}
+	if c.MaxResults < 0 {
+		return fmt.Errorf("related.Poster: invalid MaxResults %d", c.MaxResults)
+	}
+	return nil
+}
+
+// configKey returns the database key for the Poster's stored configuration.
+func (p *Poster) configKey() []byte {
+	return ordered.Encode("related.Config", p.name)
+}
+
+// Config returns the Poster's configuration:
+// the stored configuration if there is one (see [Poster.SetConfig]),
+// or else the configuration set by calling methods
+// such as [Poster.EnableProject] and [Poster.SkipBodyContains].
+// The result is a new copy that the caller can modify
+// and pass to [Poster.SetConfig].
+func (p *Poster) Config() *Config {
+	if c, ok := p.storedConfig(); ok {
+		return c
+	}
+	c := &Config{
+		Projects:   slices.Sorted(maps.Keys(p.projects)),
+		MinScore:   p.scoreCutoff,
+		MaxResults: p.maxResults,
+	}
+	for _, r := range p.ignores {
+		switch r.kind {
+		case skipBody:
+			c.SkipBodyContains = append(c.SkipBodyContains, r.text)
+		case skipTitlePrefix:
+			c.SkipTitlePrefix = append(c.SkipTitlePrefix, r.text)
+		case skipTitleSuffix:
+			c.SkipTitleSuffix = append(c.SkipTitleSuffix, r.text)
+		case skipLabel:
+			c.SkipLabels = append(c.SkipLabels, r.text)
+		case skipAuthor:
+			c.SkipAuthors = append(c.SkipAuthors, r.text)
+		}
+	}
+	return c
+}
+
+// storedConfig returns the stored configuration, if any.
+func (p *Poster) storedConfig() (*Config, bool) {
+	val, ok := p.db.Get(p.configKey())
+	if !ok {
+		return nil, false
+	}
+	var c Config
+	if err := json.Unmarshal(val, &c); err != nil {
+		// unreachable unless corrupt storage
+		p.db.Panic("related.Poster config decode", "name", p.name, "err", err)
+	}
+	return &c, true
+}
+
+// SetConfig stores c as the Poster's configuration.
+// Each call to [Poster.Run] (by any Poster with the same name; see [New])
+// loads the stored configuration, which replaces the projects,
+// skip rules, minimum score, and maximum results
+// set by calling methods such as [Poster.EnableProject],
+// so a change takes effect at the next Run, even in a running Poster.
+// SetConfig returns an error if c is invalid.
+func (p *Poster) SetConfig(c *Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	p.db.Set(p.configKey(), storage.JSON(c))
+	p.db.Flush()
+	return nil
+}
+
+// loadConfig applies the stored configuration, if any, to p.
+func (p *Poster) loadConfig() {
+	c, ok := p.storedConfig()
+	if !ok {
+		return
+	}
+	p.projects = make(map[string]bool)
+	for _, project := range c.Projects {
+		p.projects[project] = true
+	}
+	// Keep only the rules that cannot be stored (see [Poster.SkipIf]).
+	p.ignores = slices.DeleteFunc(p.ignores, func(r skipRule) bool { return r.kind != skipFunc })
+	for _, text := range c.SkipBodyContains {
+		p.SkipBodyContains(text)
+	}
+	for _, text := range c.SkipTitlePrefix {
+		p.SkipTitlePrefix(text)
+	}
+	for _, text := range c.SkipTitleSuffix {
+		p.SkipTitleSuffix(text)
+	}
+	for _, name := range c.SkipLabels {
+		p.SkipLabel(name)
+	}
+	for _, login := range c.SkipAuthors {
+		p.SkipAuthor(login)
+	}
+	p.scoreCutoff = defaultScoreCutoff
+	if c.MinScore != 0 {
+		p.scoreCutoff = c.MinScore
+	}
+	p.maxResults = defaultMaxResults
+	if c.MaxResults != 0 {
+		p.maxResults = c.MaxResults
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// EnableDuplicates enables duplicate detection.
+// When a new issue's closest match is another issue in the same project
+// with a score of at least the duplicate threshold (see [Poster.SetDuplicateMinScore]),
+// [Poster.Run] posts a separate comment noting the possible duplicate
+// and asking maintainers to confirm it by reacting with 👍.
+// Once any of the named maintainers has reacted 👍 to that comment,
+// a later call to Run adds the label to the issue,
+// or, if duplicate labels require approval (see [Poster.SetApprovals]),
+// proposes adding the label.
+// The Poster never closes issues itself.
+//
+// Like other posts, duplicate notes and labels are only posted
+// if [Poster.EnablePosts] has been called.
+func (p *Poster) EnableDuplicates(label string, maintainers ...string) {
+	p.dupLabel = label
+	p.dupMaintainers = make(map[string]bool)
+	for _, m := range maintainers {
+		p.dupMaintainers[m] = true
+	}
+}
+
+// SetApprovals sets the approval queue for duplicate labels.
+// If q requires approval for "related.DuplicateLabel" actions
+// (see [approval.Queue.Requires]), the Poster proposes each confirmed
+// duplicate's label to q instead of adding the label itself.
+func (p *Poster) SetApprovals(q *approval.Queue) {
+	p.approvals = q
+}
+
+// SetDuplicateMinScore sets the minimum vector search score for an issue
+// to be considered a possible duplicate (see [Poster.EnableDuplicates]).
+// The default is 0.97.
+func (p *Poster) SetDuplicateMinScore(min float64) {
+	p.dupScoreCutoff = min
+}
+
+const defaultDupScoreCutoff = 0.97
+
+// SetDuplicateWindow sets how long after posting a duplicate note
+// [Poster.Run] continues to check it for confirmation.
+// A note not confirmed in that time is abandoned.
+// The default is 14 days.
+func (p *Poster) SetDuplicateWindow(d time.Duration) {
+	p.dupWindow = d
+}
+
+const defaultDupWindow = 14 * 24 * time.Hour
+
+// dupInterval is the minimum time between checks of a single duplicate note.
+const dupInterval = 1 * time.Hour
+
+// A dupRecord is the database record of a duplicate note,
+// stored under the key ("related.Duplicate", project, issue).
+type dupRecord struct {
+	URL     string    // API URL of the posted note
+	Of      int64     // number of the issue that this issue probably duplicates
+	Score   float64   // similarity score of the two issues
+	Done    bool      // label applied, issue closed before confirmation, or note expired
+	Time    time.Time // time of the note (zero in notes posted by earlier versions)
+	Checked time.Time // time the note was last checked for confirmation
+}
+
+// duplicateOf returns the issue in project that is a probable
+// duplicate of issue, judging by results, and its score,
+// or else nil, 0.
+func (p *Poster) duplicateOf(project string, issue int64, results []storage.VectorResult) (*github.Issue, float64) {
+	if p.dupLabel == "" || len(results) == 0 {
+		return nil, 0
+	}
+	// Results may be ranked by more than score (see [Poster.SetOpenWeight]).
+	best := slices.MaxFunc(results, func(x, y storage.VectorResult) int {
+		return cmp.Compare(x.Score, y.Score)
+	})
+	if best.Score < p.dupScoreCutoff {
+		return nil, 0
+	}
+	orig, err := p.github.LookupIssueURL(best.ID)
+	if err != nil || orig.Project() != project || orig.Number == issue || orig.PullRequest != nil {
+		return nil, 0
+	}
+	return orig, best.Score
+}
+
+// dupNote returns the text of the comment noting that
+// the issue is a possible duplicate of orig.
+func (p *Poster) dupNote(orig *github.Issue, score float64) string {
+	return fmt.Sprintf("**Possible duplicate** of #%d (similarity %.5f).\n\n"+
+		"Maintainers: react 👍 to this comment to confirm, and the %s label will be added.\n"+
+		"\n%s\n", orig.Number, score, markdownEscape(p.dupLabel), footer.Marker("duplicate"))
+}
+
+// postDuplicate posts a note that issue is a possible duplicate of orig,
+// if it has not already done so.
+func (p *Poster) postDuplicate(issue, orig *github.Issue, score float64) {
+	key := ordered.Encode("related.Duplicate", issue.Project(), issue.Number)
+	if _, ok := p.db.Get(key); ok {
+		return
+	}
+	body := p.dupNote(orig, score)
+	p.slog.Info("related.Poster duplicate", "name", p.name, "project", issue.Project(), "issue", issue.Number, "of", orig.Number, "comment", body)
+	if !p.post {
+		return
+	}
+	action := ordered.Encode("related.DuplicateNote", issue.Project(), issue.Number)
+	if !storage.BeginAction(p.db, action) {
+		return
+	}
+	url, err := p.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		p.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(p.db, action)
+		return
+	}
+	storage.FinishAction(p.db, action, url)
+	p.db.Set(key, storage.JSON(&dupRecord{URL: url, Of: orig.Number, Score: score, Time: p.now()}))
+	p.db.Flush()
+}
+
+// checkDuplicates checks the outstanding duplicate notes
+// for confirmation and labels the confirmed duplicates.
+// It checks each note at most once an hour, and it abandons,
+// marking done, the notes older than the duplicate window
+// (see [Poster.SetDuplicateWindow]).
+func (p *Poster) checkDuplicates() {
+	now := p.now()
+	for _, project := range slices.Sorted(maps.Keys(p.projects)) {
+		start := ordered.Encode("related.Duplicate", project)
+		end := ordered.Encode("related.Duplicate", project, ordered.Inf)
+		for key, val := range p.db.Scan(start, end) {
+			var issue int64
+			if err := ordered.Decode(key, nil, nil, &issue); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster duplicate decode", "key", storage.Fmt(key), "err", err)
+			}
+			var r dupRecord
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster duplicate decode", "key", storage.Fmt(key), "err", err)
+			}
+			if r.Done || now.Sub(r.Checked) < dupInterval {
+				continue
+			}
+			if r.Time.IsZero() {
+				// Note from an earlier version; start its window now.
+				r.Time = now
+			}
+			if now.Sub(r.Time) > p.dupWindow {
+				p.slog.Info("related.Poster duplicate expired", "name", p.name, "project", project, "issue", issue, "of", r.Of)
+				r.Done = true
+			} else {
+				r.Checked = now
+				r.Done = p.checkDuplicate(project, issue, &r)
+			}
+			p.db.Set(key, storage.JSON(&r))
+			p.db.Flush()
+		}
+	}
+}
+
+// checkDuplicate checks whether the duplicate note r on the given issue
+// has been confirmed and if so labels the issue.
+// It reports whether r is finished: labeled, or no longer needing a label.
+func (p *Poster) checkDuplicate(project string, issue int64, r *dupRecord) bool {
+	live, err := p.github.DownloadIssue(fmt.Sprintf("https://api.github.com/repos/%s/issues/%d", project, issue))
+	if err != nil {
+		p.slog.Error("related.Poster duplicate download", "project", project, "issue", issue, "err", err)
+		return false
+	}
+	if live.State == "closed" {
+		return true
+	}
+	for _, l := range live.Labels {
+		if l.Name == p.dupLabel {
+			return true
+		}
+	}
+
+	reacts, err := p.github.DownloadReactions(r.URL)
+	if err != nil {
+		p.slog.Error("related.Poster duplicate reactions", "url", r.URL, "err", err)
+		return false
+	}
+	confirmedBy := ""
+	for _, react := range reacts {
+		if react.Content == "+1" && p.dupMaintainers[react.User.Login] {
+			confirmedBy = react.User.Login
+			break
+		}
+	}
+	if confirmedBy == "" {
+		return false
+	}
+
+	p.slog.Info("related.Poster duplicate confirmed", "name", p.name, "project", project, "issue", issue, "of", r.Of, "by", confirmedBy, "label", p.dupLabel)
+	if !p.post {
+		return false
+	}
+	action := ordered.Encode("related.DuplicateLabel", project, issue)
+	if p.approvals.Requires("related.DuplicateLabel") {
+		p.approvals.Propose(live, action, &approval.Proposal{
+			Kind:      "related.DuplicateLabel",
+			Actor:     p.name,
+			Reason:    fmt.Sprintf("probable duplicate of #%d (score %.2f), confirmed by @%s", r.Of, r.Score, confirmedBy),
+			AddLabels: []string{p.dupLabel},
+		})
+		return true
+	}
+	var labels []string
+	for _, l := range live.Labels {
+		labels = append(labels, l.Name)
+	}
+	labels = append(labels, p.dupLabel)
+	if !storage.BeginAction(p.db, action) {
+		return true
+	}
+	if err := p.github.EditIssue(live, &github.IssueChanges{Labels: &labels}); err != nil {
+		p.slog.Error("EditIssue", "issue", issue, "err", err)
+		storage.CancelAction(p.db, action)
+		return false
+	}
+	storage.FinishAction(p.db, action, nil)
+	return true
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// SetFeedbackWindow sets how long after posting [Poster.SyncFeedback]
+// continues to check a post for new reactions.
+// The default is 14 days.
+func (p *Poster) SetFeedbackWindow(d time.Duration) {
+	p.feedbackWindow = d
+}
+
+const defaultFeedbackWindow = 14 * 24 * time.Hour
+
+// feedbackInterval is the minimum time between checks of a single post.
+const feedbackInterval = 1 * time.Hour
+
+// helpfulReactions and unhelpfulReactions classify reactions
+// to posts as votes. Other reactions ("laugh", "eyes") are ignored.
+var (
+	helpfulReactions   = map[string]bool{"+1": true, "heart": true, "hooray": true, "rocket": true}
+	unhelpfulReactions = map[string]bool{"-1": true, "confused": true}
+)
+
+// A feedbackRecord is the database record of the reactions to a post,
+// stored under the key ("related.Feedback", project, issue).
+type feedbackRecord struct {
+	Helpful   int       // number of helpful reactions
+	Unhelpful int       // number of unhelpful reactions
+	TopScore  float64   // highest score of the documents listed in the post
+	Checked   time.Time // time reactions were last downloaded
+}
+
+// SyncFeedback downloads the reactions to the Poster's recent posts
+// (see [Poster.SetFeedbackWindow]) in the enabled projects,
+// counting the emoji votes that each post's footer asks for,
+// and records them in the database for [Poster.Feedback].
+// It checks each post at most once an hour.
+//
+// If ctx is canceled, SyncFeedback stops before the next post.
+func (p *Poster) SyncFeedback(ctx context.Context) {
+	p.loadConfig()
+	now := p.now()
+	for _, project := range slices.Sorted(maps.Keys(p.projects)) {
+		start := ordered.Encode("triage.Posted", project)
+		end := ordered.Encode("triage.Posted", project, ordered.Inf)
+		for key, val := range p.db.Scan(start, end) {
+			if ctx.Err() != nil {
+				return
+			}
+			var issue int64
+			if err := ordered.Decode(key, nil, nil, &issue); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster posted decode", "key", storage.Fmt(key), "err", err)
+			}
+			data := val()
+			if len(data) == 0 {
+				continue
+			}
+			var r postRecord
+			if err := json.Unmarshal(data, &r); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster posted decode", "key", storage.Fmt(key), "err", err)
+			}
+			if r.URL == "" || r.Time.Before(now.Add(-p.feedbackWindow)) {
+				continue
+			}
+			fkey := ordered.Encode("related.Feedback", project, issue)
+			var f feedbackRecord
+			if fval, ok := p.db.Get(fkey); ok {
+				if err := json.Unmarshal(fval, &f); err != nil {
+					// unreachable unless corrupt storage
+					p.db.Panic("related.Poster feedback decode", "key", storage.Fmt(fkey), "err", err)
+				}
+				if now.Sub(f.Checked) < feedbackInterval {
+					continue
+				}
+			}
+			reacts, err := p.github.DownloadReactions(r.URL)
+			if err != nil {
+				p.slog.Error("related.Poster feedback reactions", "url", r.URL, "err", err)
+				continue
+			}
+			f = feedbackRecord{Checked: now}
+			for _, doc := range r.Related {
+				f.TopScore = max(f.TopScore, doc.Score)
+			}
+			for _, react := range reacts {
+				switch {
+				case helpfulReactions[react.Content]:
+					f.Helpful++
+				case unhelpfulReactions[react.Content]:
+					f.Unhelpful++
+				}
+			}
+			p.db.Set(fkey, storage.JSON(&f))
+		}
+	}
+	p.db.Flush()
+}
+
+// FeedbackStats summarizes the reactions to posts in a project,
+// as recorded by [Poster.SyncFeedback].
+type FeedbackStats struct {
+	Project   string
+	Posts     int               // number of posts checked for reactions
+	Voted     int               // number of posts with at least one vote
+	Helpful   int               // total helpful reactions (👍, ❤️, 🎉, 🚀)
+	Unhelpful int               // total unhelpful reactions (👎, 😕)
+	Buckets   []*FeedbackBucket // reactions by the top score in each post, in increasing score order
+}
+
+// A FeedbackBucket summarizes the reactions to posts
+// whose top-scoring document has a score in [MinScore, MinScore+[FeedbackBucketSize]).
+type FeedbackBucket struct {
+	MinScore  float64
+	Posts     int
+	Helpful   int
+	Unhelpful int
+}
+
+// FeedbackBucketSize is the width of the score ranges in [FeedbackStats.Buckets].
+const FeedbackBucketSize = 0.02
+
+// HelpfulRate returns the fraction of votes that were helpful,
+// or 0 if there have been no votes.
+func (s *FeedbackStats) HelpfulRate() float64 {
+	return rate(s.Helpful, s.Unhelpful)
+}
+
+// HelpfulRate returns the fraction of votes in the bucket that were helpful,
+// or 0 if there have been no votes.
+func (b *FeedbackBucket) HelpfulRate() float64 {
+	return rate(b.Helpful, b.Unhelpful)
+}
+
+func rate(helpful, unhelpful int) float64 {
+	if helpful+unhelpful == 0 {
+		return 0
+	}
+	return float64(helpful) / float64(helpful+unhelpful)
+}
+
+// Feedback returns statistics about the reactions to posts in project,
+// as recorded by earlier calls to [Poster.SyncFeedback].
+// Comparing the helpful rates of the score buckets can inform
+// the choice of minimum score (see [Poster.SetMinScore]).
+func (p *Poster) Feedback(project string) *FeedbackStats {
+	s := &FeedbackStats{Project: project}
+	buckets := make(map[int]*FeedbackBucket)
+	start := ordered.Encode("related.Feedback", project)
+	end := ordered.Encode("related.Feedback", project, ordered.Inf)
+	for key, val := range p.db.Scan(start, end) {
+		var f feedbackRecord
+		if err := json.Unmarshal(val(), &f); err != nil {
+			// unreachable unless corrupt storage
+			p.db.Panic("related.Poster feedback decode", "key", storage.Fmt(key), "err", err)
+		}
+		s.Posts++
+		if f.Helpful+f.Unhelpful > 0 {
+			s.Voted++
+		}
+		s.Helpful += f.Helpful
+		s.Unhelpful += f.Unhelpful
+
+		i := int(math.Floor(f.TopScore/FeedbackBucketSize + 1e-9))
+		b := buckets[i]
+		if b == nil {
+			b = &FeedbackBucket{MinScore: float64(i) * FeedbackBucketSize}
+			buckets[i] = b
+		}
+		b.Posts++
+		b.Helpful += f.Helpful
+		b.Unhelpful += f.Unhelpful
+	}
+	for _, i := range slices.Sorted(maps.Keys(buckets)) {
+		s.Buckets = append(s.Buckets, buckets[i])
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+)
+
+// SetOpenWeight sets the weight given to open issues and pull requests
+// when ranking related documents.
+// The ranking score of each open issue or pull request is its vector
+// search score plus w, so that, for example, w = 0.01 ranks an open issue
+// above a closed one with a vector search score up to 0.01 higher.
+// Only the order of the listed documents is affected: the minimum score
+// (see [Poster.SetMinScore]) applies to the vector search scores,
+// and the scores in posts are the vector search scores.
+// The default weight is 0.
+func (p *Poster) SetOpenWeight(w float64) {
+	p.openWeight = w
+}
+
+// SetRecencyWeight sets the weight given to recent GitHub issues
+// and pull requests when ranking related documents.
+// The ranking score of each issue or pull request is its vector
+// search score plus w × 2^(-age/halfLife), where age is the time
+// since the issue was created, so that an issue created now gains w,
+// an issue created halfLife ago gains w/2, and so on.
+// As with [Poster.SetOpenWeight], only the order of the listed
+// documents is affected.
+// The default weight is 0.
+func (p *Poster) SetRecencyWeight(w float64, halfLife time.Duration) {
+	p.recencyWeight = w
+	p.recencyHalfLife = halfLife
+}
+
+// rank sorts results by decreasing ranking score,
+// as configured by p.openWeight and p.recencyWeight,
+// treating now as the current time.
+func (p *Poster) rank(results []storage.VectorResult, now time.Time) {
+	if p.openWeight == 0 && p.recencyWeight == 0 {
+		return
+	}
+	score := make(map[string]float64)
+	for _, r := range results {
+		score[r.ID] = r.Score + p.rankBonus(r.ID, now)
+	}
+	slices.SortStableFunc(results, func(x, y storage.VectorResult) int {
+		return cmp.Compare(score[y.ID], score[x.ID])
+	})
+}
+
+// rankBonus returns the amount to add to the vector search score
+// of the document with the given ID to obtain its ranking score.
+func (p *Poster) rankBonus(id string, now time.Time) float64 {
+	issue, err := p.github.LookupIssueURL(id)
+	if err != nil {
+		// Not a GitHub issue or pull request.
+		return 0
+	}
+	bonus := 0.0
+	if issue.State != "closed" {
+		bonus += p.openWeight
+	}
+	if p.recencyWeight != 0 && p.recencyHalfLife > 0 {
+		if tm, err := time.Parse(time.RFC3339, issue.CreatedAt); err == nil {
+			age := max(now.Sub(tm), 0)
+			bonus += p.recencyWeight * math.Exp2(-float64(age)/float64(p.recencyHalfLife))
+		}
+	}
+	return bonus
+}
@@ -16,18 +16,48 @@ package related
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
+	"rsc.io/gaby/internal/approval"
 	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/footer"
 	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/storage/timed"
 	"rsc.io/ordered"
 )
 
+// This package stores the following key schemas in the database
+// (see also backfill.go):
+//
+//	["triage.Posted", Project, Issue] => JSON of postRecord
+//	["related.Duplicate", Project, Issue] => JSON of dupRecord
+//	["related.Feedback", Project, Issue] => JSON of feedbackRecord
+//	["related.Config", Name] => JSON of Config
+//	["related.Explanation", Model, URL, Related] => JSON of explanation string
+//
+// and uses the [storage.BeginAction] keys ["related.Post", Project, Issue],
+// ["related.DuplicateNote", Project, Issue], and ["related.DuplicateLabel", Project, Issue].
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "triage.Posted", Key: "Project, Issue", Val: "JSON of postRecord"},
+		storage.Schema{Kind: "related.Duplicate", Key: "Project, Issue", Val: "JSON of dupRecord"},
+		storage.Schema{Kind: "related.Feedback", Key: "Project, Issue", Val: "JSON of feedbackRecord"},
+		storage.Schema{Kind: "related.Config", Key: "Name", Val: "JSON of Config"},
+		storage.Schema{Kind: "related.Explanation", Key: "Model, URL, Related", Val: "JSON of explanation string"},
+	)
+}
+
 // A Poster posts to GitHub about related issues (and eventually other documents).
 type Poster struct {
 	slog        *slog.Logger
@@ -38,11 +68,36 @@ type Poster struct {
 	projects    map[string]bool
 	watcher     *timed.Watcher[*github.Event]
 	name        string
-	timeLimit   time.Time
-	ignores     []func(*github.Issue) bool
+	timeLimit   time.Time        // set by SetTimeLimit
+	hasLimit    bool             // SetTimeLimit has been called
+	now         func() time.Time // current time; see SetClock
+	ignores     []skipRule
 	maxResults  int
+	kindMax     map[string]int
+	scopes      map[string]*scope // search scopes by project
 	scoreCutoff float64
+	footer      *footer.Footer
+	templates   map[string]*template.Template // post templates by project
 	post        bool
+
+	openWeight      float64       // ranking bonus for open issues
+	recencyWeight   float64       // ranking bonus for new issues
+	recencyHalfLife time.Duration // age at which recency bonus is halved
+
+	updateWindow      time.Duration // how long after posting to update posts; 0 means never
+	updateScoreCutoff float64       // minimum score for a document added by an update
+
+	dupLabel       string          // label for confirmed duplicates; "" means detection is disabled
+	dupMaintainers map[string]bool // logins of maintainers who can confirm duplicates
+	dupScoreCutoff float64         // minimum score for a possible duplicate
+	dupWindow      time.Duration   // how long after posting to check a duplicate note
+	approvals      *approval.Queue // queue for duplicate labels requiring approval
+
+	feedbackWindow time.Duration // how long after posting to check for reactions
+
+	explainer          llm.TextGenerator // generator for explanations; nil means no explanations
+	explainModel       string            // model used by explainer, for caching explanations
+	explainScoreCutoff float64           // minimum score for a document to be explained
 }
 
 // New creates and returns a new Poster. It logs to lg, stores state in db,
@@ -64,22 +119,48 @@ func New(lg *slog.Logger, db storage.DB, gh *github.Client, vdb storage.VectorDB
 		projects:    make(map[string]bool),
 		watcher:     gh.EventWatcher("related.Poster:" + name),
 		name:        name,
-		timeLimit:   time.Now().Add(-defaultTooOld),
+		now:         time.Now,
 		maxResults:  defaultMaxResults,
+		kindMax:     make(map[string]int),
+		scopes:      make(map[string]*scope),
 		scoreCutoff: defaultScoreCutoff,
+		footer:      footer.Default(),
+		templates:   make(map[string]*template.Template),
+
+		updateScoreCutoff: defaultUpdateScoreCutoff,
+		dupScoreCutoff:    defaultDupScoreCutoff,
+		dupWindow:         defaultDupWindow,
+		feedbackWindow:    defaultFeedbackWindow,
 	}
 }
 
 // SetTimeLimit controls how old an issue can be for the Poster to post to it.
 // Issues created before time t will be skipped.
-// The default is not to post to issues that are more than 48 hours old
-// at the time of the call to [New].
+// The default is not to post to issues that are more than 48 hours old.
 func (p *Poster) SetTimeLimit(t time.Time) {
 	p.timeLimit = t
+	p.hasLimit = true
 }
 
 const defaultTooOld = 48 * time.Hour
 
+// limit returns the time before which issues are not posted to.
+func (p *Poster) limit() time.Time {
+	if p.hasLimit {
+		return p.timeLimit
+	}
+	return p.now().Add(-defaultTooOld)
+}
+
+// SetClock sets the function the Poster uses to find the current time,
+// in place of [time.Now], for its time limit, its post records,
+// and its update, feedback, and duplicate windows.
+// It is meant for tests, which can pass the Now method of a
+// [rsc.io/gaby/internal/testutil.FakeClock].
+func (p *Poster) SetClock(now func() time.Time) {
+	p.now = now
+}
+
 // SetMaxResults sets the maximum number of related documents to
 // post to the issue.
 // The default is 10.
@@ -89,6 +170,15 @@ func (p *Poster) SetMaxResults(max int) {
 
 const defaultMaxResults = 10
 
+// SetKindMaxResults sets the maximum number of related documents
+// of the given kind (such as [docs.KindCL]) to post to the issue.
+// These per-kind limits apply in addition to the overall limit
+// set by [Poster.SetMaxResults].
+// By default, there are no per-kind limits.
+func (p *Poster) SetKindMaxResults(kind string, max int) {
+	p.kindMax[kind] = max
+}
+
 // SetMinScore sets the minimum vector search score that a
 // [storage.VectorResult] must have to be considered a related document
 // The default is 0.82, which was determined empirically.
@@ -98,28 +188,178 @@ func (p *Poster) SetMinScore(min float64) {
 
 const defaultScoreCutoff = 0.82
 
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (p *Poster) SetFooter(f *footer.Footer) {
+	p.footer = f
+}
+
+// SetUpdateWindow configures the Poster to update its own earlier posts.
+// During each call to [Poster.Run], the Poster re-runs the search
+// for every issue it posted to within the last d,
+// and if the search turns up new strong matches (see [Poster.SetUpdateMinScore])
+// that were not in the original post, it edits the post to add them.
+// Posts are never edited to remove documents.
+// The default window is 0, meaning posts are never updated.
+//
+// Only posts made after this feature was added can be updated,
+// because earlier versions of the Poster did not record
+// the URL of the posted comment.
+func (p *Poster) SetUpdateWindow(d time.Duration) {
+	p.updateWindow = d
+}
+
+// SetUpdateMinScore sets the minimum vector search score that a
+// document must have to be added to an earlier post by an update
+// (see [Poster.SetUpdateWindow]).
+// The default is 0.9, which is stricter than the default for new posts
+// (see [Poster.SetMinScore]), because an edited post is less likely to be
+// noticed and should only change to list a likely duplicate.
+func (p *Poster) SetUpdateMinScore(min float64) {
+	p.updateScoreCutoff = min
+}
+
+const defaultUpdateScoreCutoff = 0.9
+
+// EnableExplanations configures the Poster to use gen to write
+// a one-sentence explanation of why each related document
+// with a score of at least min is related to the issue.
+// The explanation is appended to the document's entry in the post.
+// If gen fails to produce an explanation for a document,
+// the Poster logs the error and lists the document without one.
+//
+// The model names the model used by gen. The Poster stores each
+// explanation in the database by issue, related document, and model,
+// so that dry runs, retries, and updated posts reuse it
+// instead of generating it again.
+func (p *Poster) EnableExplanations(gen llm.TextGenerator, model string, min float64) {
+	p.explainer = gen
+	p.explainModel = model
+	p.explainScoreCutoff = min
+}
+
 // SkipBodyContains configures the Poster to skip issues with a body containing
 // the given text.
 func (p *Poster) SkipBodyContains(text string) {
-	p.ignores = append(p.ignores, func(issue *github.Issue) bool {
-		return strings.Contains(issue.Body, text)
-	})
+	p.ignores = append(p.ignores, skipRule{kind: skipBody, text: text})
 }
 
 // SkipTitlePrefix configures the Poster to skip issues with a title starting
 // with the given prefix.
 func (p *Poster) SkipTitlePrefix(prefix string) {
-	p.ignores = append(p.ignores, func(issue *github.Issue) bool {
-		return strings.HasPrefix(issue.Title, prefix)
-	})
+	p.ignores = append(p.ignores, skipRule{kind: skipTitlePrefix, text: prefix})
 }
 
 // SkipTitleSuffix configures the Poster to skip issues with a title starting
 // with the given suffix.
 func (p *Poster) SkipTitleSuffix(suffix string) {
-	p.ignores = append(p.ignores, func(issue *github.Issue) bool {
-		return strings.HasSuffix(issue.Title, suffix)
-	})
+	p.ignores = append(p.ignores, skipRule{kind: skipTitleSuffix, text: suffix})
+}
+
+// SkipLabel configures the Poster to skip issues with the given label.
+// Note that the Poster only sees the labels an issue has when it considers
+// the issue, usually shortly after the issue is created,
+// so the rule is most useful for labels applied at creation,
+// such as by issue templates or automated reporters.
+func (p *Poster) SkipLabel(name string) {
+	p.ignores = append(p.ignores, skipRule{kind: skipLabel, text: name})
+}
+
+// SkipAuthor configures the Poster to skip issues created by
+// the GitHub user with the given login (for example "gopherbot").
+func (p *Poster) SkipAuthor(login string) {
+	p.ignores = append(p.ignores, skipRule{kind: skipAuthor, text: login})
+}
+
+// SkipIf configures the Poster to skip issues for which f returns true.
+// The description desc explains the rule in reports (see [Poster.Report]).
+// For example, using an index from [rsc.io/gaby/internal/crossref],
+// a Poster can skip issues that already have a linked CL:
+//
+//	p.SkipIf("has linked CL", func(issue *github.Issue) bool {
+//		return len(xr.CLs(issue.Project(), issue.Number)) > 0
+//	})
+//
+// Unlike the other skip rules, rules added by SkipIf are not part of
+// the Poster's stored configuration (see [Poster.Config]) and
+// remain in effect even when a stored configuration is loaded.
+func (p *Poster) SkipIf(desc string, f func(*github.Issue) bool) {
+	p.ignores = append(p.ignores, skipRule{kind: skipFunc, text: desc, f: f})
+}
+
+// A skipRule is a rule for skipping issues,
+// added by [Poster.SkipBodyContains] and similar methods.
+type skipRule struct {
+	kind skipKind
+	text string                   // text to match; description for skipFunc
+	f    func(*github.Issue) bool // predicate for skipFunc
+}
+
+type skipKind int
+
+const (
+	skipBody skipKind = iota
+	skipTitlePrefix
+	skipTitleSuffix
+	skipLabel
+	skipAuthor
+	skipFunc
+)
+
+// match reports whether the rule matches the issue.
+func (r skipRule) match(issue *github.Issue) bool {
+	switch r.kind {
+	case skipBody:
+		return strings.Contains(issue.Body, r.text)
+	case skipTitlePrefix:
+		return strings.HasPrefix(issue.Title, r.text)
+	case skipTitleSuffix:
+		return strings.HasSuffix(issue.Title, r.text)
+	case skipLabel:
+		return slices.ContainsFunc(issue.Labels, func(l github.Label) bool { return l.Name == r.text })
+	case skipAuthor:
+		return issue.User.Login == r.text
+	case skipFunc:
+		return r.f(issue)
+	}
+	return false
+}
+
+// String returns a description of the rule, for reports.
+func (r skipRule) String() string {
+	switch r.kind {
+	case skipBody:
+		return fmt.Sprintf("body contains %q", r.text)
+	case skipTitlePrefix:
+		return fmt.Sprintf("title has prefix %q", r.text)
+	case skipTitleSuffix:
+		return fmt.Sprintf("title has suffix %q", r.text)
+	case skipLabel:
+		return fmt.Sprintf("has label %q", r.text)
+	case skipAuthor:
+		return fmt.Sprintf("author is %s", r.text)
+	case skipFunc:
+		return r.text
+	}
+	return "unknown rule"
+}
+
+// skipReason returns the reason that the Poster would skip issue,
+// or "" if it would not, considering only the issue itself.
+// (Run also skips issues that are too old or already posted to.)
+func (p *Poster) skipReason(issue *github.Issue) string {
+	if issue.State == "closed" {
+		return "closed"
+	}
+	if issue.PullRequest != nil {
+		return "pull request"
+	}
+	for _, ig := range p.ignores {
+		if ig.match(issue) {
+			return ig.String()
+		}
+	}
+	return ""
 }
 
 // EnableProject enables the Poster to post on issues in the given GitHub project (for example "golang/go").
@@ -138,6 +378,7 @@ func (p *Poster) EnablePosts() {
 // deletePosted deletes all the “posted on this issue” notes.
 func (p *Poster) deletePosted() {
 	p.db.DeleteRange(ordered.Encode("triage.Posted"), ordered.Encode("triage.Posted", ordered.Inf))
+	storage.DeleteActions(p.db, ordered.Encode("related.Post"))
 }
 
 // Run runs a single round of posting to GitHub.
@@ -146,12 +387,19 @@ func (p *Poster) deletePosted() {
 // Run skips closed issues, and it also skips pull requests.
 //
 // For each issue that matches the configured posting constraints
-// (see [Poster.EnableProject], [Poster.SetTimeLimit], [Poster.IgnoreBodyContains], [Poster.IgnoreTitlePrefix], and [Poster.IgnoreTitleSuffix]),
+// (see [Poster.EnableProject], [Poster.SetTimeLimit], [Poster.SkipBodyContains], [Poster.SkipTitlePrefix], [Poster.SkipTitleSuffix],
+// [Poster.SkipLabel], [Poster.SkipAuthor], and [Poster.SkipIf]),
 // Run computes an embedding of the issue body text (ignoring comments)
-// and looks in the vector database for other documents (currently only issues)
+// and looks in the vector database for other documents
 // that are aligned closely enough with that body text
-// (see [Poster.SetMinScore]) and posts a limited number of matches
-// (see [Poster.SetMaxResults]).
+// (see [Poster.SetMinScore]), limited and weighted by the project's search scope
+// (see [Poster.SetSearchRepos], [Poster.SkipSearchRepo], and [Poster.SetRepoWeight]),
+// and posts a limited number of matches
+// (see [Poster.SetMaxResults] and [Poster.SetKindMaxResults]),
+// grouped by document kind (issues, code changes, documentation)
+// and ranked by score (see also [Poster.SetOpenWeight] and [Poster.SetRecencyWeight]).
+// If [Poster.EnableExplanations] has been called, the strongest matches
+// also include a short generated explanation of why they are related.
 //
 // Run logs each post to the [slog.Logger] passed to [New].
 // If [Poster.EnablePosts] has been called, then [Run] also posts the comment to GitHub,
@@ -160,19 +408,33 @@ func (p *Poster) deletePosted() {
 //
 // When [Poster.EnablePosts] has not been called, Run only logs the comments it would post.
 // Future calls to Run will reprocess the same issues and re-log the same comments.
-func (p *Poster) Run() {
+//
+// Before doing anything else, Run loads the Poster's stored configuration,
+// if any (see [Poster.SetConfig]).
+//
+// If [Poster.SetUpdateWindow] has been called, Run also updates recent posts
+// to add newly discovered strong matches.
+// If [Poster.EnableDuplicates] has been called, Run also notes possible
+// duplicates and labels the ones that maintainers have confirmed.
+//
+// If ctx is canceled, Run stops before the next issue,
+// skipping the post updates and duplicate checks until a future call.
+func (p *Poster) Run(ctx context.Context) {
 	p.slog.Info("related.Poster start", "name", p.name)
 	defer p.slog.Info("related.Poster end", "name", p.name)
 
+	p.loadConfig()
 	defer p.watcher.Flush()
 
-Watcher:
 	for e := range p.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
 		if !p.projects[e.Project] || e.API != "/issues" {
 			continue
 		}
 		issue := e.Typed.(*github.Issue)
-		if issue.State == "closed" || issue.PullRequest != nil {
+		if p.skipReason(issue) != "" {
 			continue
 		}
 		tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
@@ -180,14 +442,9 @@ Watcher:
 			p.slog.Error("triage parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
 			continue
 		}
-		if tm.Before(p.timeLimit) {
+		if tm.Before(p.limit()) {
 			continue
 		}
-		for _, ig := range p.ignores {
-			if ig(issue) {
-				continue Watcher
-			}
-		}
 
 		// TODO: Perhaps this key should include p.name, but perhaps not.
 		// This makes sure we only every post to each issue once.
@@ -203,18 +460,9 @@ Watcher:
 			p.slog.Error("triage lookup failed", "url", u)
 			continue
 		}
-		results := p.vdb.Search(vec, p.maxResults+5)
-		if len(results) > 0 && results[0].ID == u {
-			results = results[1:]
-		}
-		for i, r := range results {
-			if r.Score < p.scoreCutoff {
-				results = results[:i]
-				break
-			}
-		}
-		if len(results) > p.maxResults {
-			results = results[:p.maxResults]
+		results := p.search(e.Project, u, vec)
+		if orig, score := p.duplicateOf(e.Project, e.Issue, results); orig != nil {
+			p.postDuplicate(issue, orig, score)
 		}
 		if len(results) == 0 {
 			if p.post {
@@ -222,41 +470,380 @@ Watcher:
 			}
 			continue
 		}
-		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "**Related Issues**\n\n")
-		for _, r := range results {
-			title := r.ID
-			if d, ok := p.docs.Get(r.ID); ok {
-				title = d.Title
-			}
-			info := ""
-			if issue, err := p.github.LookupIssueURL(r.ID); err == nil {
-				info = fmt.Sprint(" #", issue.Number)
-				if issue.ClosedAt != "" {
-					info += " (closed)"
-				}
-			}
-			fmt.Fprintf(&buf, " - [%s%s](%s) <!-- score=%.5f -->\n", markdownEscape(title), info, r.ID, r.Score)
+		body, err := p.comment(e.Project, e.Issue, u, results)
+		if err != nil {
+			p.slog.Error("related.Poster template", "project", e.Project, "issue", e.Issue, "err", err)
+			continue
 		}
-		fmt.Fprintf(&buf, "\n<sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion](https://github.com/golang/go/discussions/67901).)</sub>\n")
-
-		p.slog.Info("related.Poster post", "name", p.name, "project", e.Project, "issue", e.Issue, "comment", buf.String())
+		p.slog.Info("related.Poster post", "name", p.name, "project", e.Project, "issue", e.Issue, "comment", body)
 
 		if !p.post {
 			continue
 		}
-
-		if err := p.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: buf.String()}); err != nil {
-			p.slog.Error("PostIssueComment", "issue", e.Issue, "err", err)
+		if err := p.postComment(issue, body, results); err != nil {
 			continue
 		}
-		p.db.Set(posted, nil)
 		p.watcher.MarkOld(e.DBTime)
 
 		// Flush immediately to make sure we don't re-post if interrupted later in the loop.
 		p.watcher.Flush()
 		p.db.Flush()
 	}
+
+	if p.updateWindow > 0 {
+		p.updatePosts()
+	}
+	if p.dupLabel != "" {
+		p.checkDuplicates()
+	}
+}
+
+// postComment posts body, listing results, as the related-documents comment on issue,
+// and records the post.
+// If the comment has already been posted, postComment does nothing.
+func (p *Poster) postComment(issue *github.Issue, body string, results []storage.VectorResult) error {
+	// The action record guarantees at most one post,
+	// even if we crash before recording the post below.
+	action := ordered.Encode("related.Post", issue.Project(), issue.Number)
+	if !storage.BeginAction(p.db, action) {
+		p.slog.Info("related.Poster already posted", "name", p.name, "project", issue.Project(), "issue", issue.Number)
+		return nil
+	}
+	url, err := p.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		p.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(p.db, action)
+		return err
+	}
+	storage.FinishAction(p.db, action, url)
+	p.db.Set(ordered.Encode("triage.Posted", issue.Project(), issue.Number), storage.JSON(&postRecord{URL: url, Time: p.now(), Related: results}))
+	return nil
+}
+
+// PostIssue posts the related-documents comment on the issue on demand,
+// as when a maintainer asks for it, regardless of the issue's age, state,
+// and the Poster's skip rules (see [Poster.SkipTitlePrefix] and so on).
+// Like [Poster.Run], PostIssue posts at most one such comment to each issue,
+// and it only logs the comment unless [Poster.EnablePosts] has been called.
+// PostIssue returns an error if the issue has already been posted to,
+// has not been embedded, or has no related documents.
+func (p *Poster) PostIssue(issue *github.Issue) error {
+	p.loadConfig()
+	project := issue.Project()
+	if _, ok := p.db.Get(ordered.Encode("triage.Posted", project, issue.Number)); ok {
+		return fmt.Errorf("related documents already posted to %s#%d", project, issue.Number)
+	}
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", project, issue.Number)
+	vec, ok := p.vdb.Get(u)
+	if !ok {
+		return fmt.Errorf("%s#%d has not been embedded", project, issue.Number)
+	}
+	results := p.search(project, u, vec)
+	if len(results) == 0 {
+		return fmt.Errorf("no related documents found for %s#%d", project, issue.Number)
+	}
+	body, err := p.comment(project, issue.Number, u, results)
+	if err != nil {
+		return err
+	}
+	p.slog.Info("related.Poster post", "name", p.name, "project", project, "issue", issue.Number, "comment", body)
+	if !p.post {
+		return nil
+	}
+	if err := p.postComment(issue, body, results); err != nil {
+		return err
+	}
+	p.db.Flush()
+	return nil
+}
+
+// search returns the documents related to the document with the given URL
+// and embedding vector in project, limited by the project's search scope,
+// p.scoreCutoff, p.kindMax, and p.maxResults,
+// in ranking order (see [Poster.SetOpenWeight] and [Poster.SetRecencyWeight]).
+func (p *Poster) search(project, u string, vec llm.Vector) []storage.VectorResult {
+	return p.searchBefore(project, u, vec, time.Time{})
+}
+
+// searchBefore is like search but, if before is not the zero time,
+// omits GitHub issues created at or after before.
+func (p *Poster) searchBefore(project, u string, vec llm.Vector, before time.Time) []storage.VectorResult {
+	n := 2*p.maxResults + 5
+	s := p.scopes[project]
+	if s != nil || !before.IsZero() {
+		n *= 2 // leave room for excluded and reweighted documents
+	}
+	results := p.vdb.Search(vec, n)
+	if len(results) > 0 && results[0].ID == u {
+		results = results[1:]
+	}
+	if s != nil {
+		results = s.apply(results)
+	}
+	if !before.IsZero() {
+		results = slices.DeleteFunc(results, func(r storage.VectorResult) bool {
+			issue, err := p.github.LookupIssueURL(r.ID)
+			if err != nil {
+				return false
+			}
+			tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+			return err == nil && !tm.Before(before)
+		})
+	}
+	results = slices.DeleteFunc(results, func(r storage.VectorResult) bool {
+		return r.Score < p.scoreCutoff
+	})
+	now := before
+	if now.IsZero() {
+		now = p.now()
+	}
+	p.rank(results, now)
+	count := make(map[string]int)
+	out := results[:0]
+	for _, r := range results {
+		if len(out) >= p.maxResults {
+			break
+		}
+		kind := p.kind(r.ID)
+		if max, ok := p.kindMax[kind]; ok && count[kind] >= max {
+			continue
+		}
+		count[kind]++
+		out = append(out, r)
+	}
+	return out
+}
+
+// kind returns the kind of the document with the given ID.
+// Documents of unknown kind are assumed to be issues,
+// since the corpus held only issues before it recorded kinds.
+func (p *Poster) kind(id string) string {
+	if d, ok := p.docs.Get(id); ok && d.Kind != "" {
+		return d.Kind
+	}
+	return docs.KindIssue
+}
+
+// kindHeaders lists the headers for each kind of document,
+// in the order the kinds are listed in posts.
+// Documents of other kinds are listed last, under "Related Documents".
+var kindHeaders = []struct {
+	kind   string
+	header string
+}{
+	{docs.KindIssue, "Related Issues"},
+	{docs.KindCL, "Related Code Changes"},
+	{docs.KindDoc, "Related Documentation"},
+	{"", "Related Documents"},
+}
+
+// hasHeader reports whether kind has its own entry in kindHeaders.
+func hasHeader(kind string) bool {
+	for _, h := range kindHeaders {
+		if h.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// comment returns the text of a comment on the given issue
+// listing the documents related to the document with the given URL,
+// grouped by kind and formatted using the project's template
+// (see [Poster.SetTemplate]).
+func (p *Poster) comment(project string, issue int64, u string, results []storage.VectorResult) (string, error) {
+	groups := make(map[string][]storage.VectorResult)
+	for _, r := range results {
+		kind := p.kind(r.ID)
+		if !hasHeader(kind) {
+			kind = ""
+		}
+		groups[kind] = append(groups[kind], r)
+	}
+
+	data := &PostData{
+		Project: project,
+		Issue:   issue,
+		Footer:  p.footer.Render("related", project),
+	}
+	for _, h := range kindHeaders {
+		list := groups[h.kind]
+		if len(list) == 0 {
+			continue
+		}
+		g := &PostGroup{Kind: h.kind, Header: h.header}
+		for _, r := range list {
+			pr := &PostResult{
+				URL:         r.ID,
+				Title:       r.ID,
+				Score:       r.Score,
+				Explanation: p.explain(u, r),
+			}
+			if d, ok := p.docs.Get(r.ID); ok {
+				pr.Title = d.Title
+			}
+			if issue, err := p.github.LookupIssueURL(r.ID); err == nil {
+				pr.Number = issue.Number
+				pr.Closed = issue.ClosedAt != ""
+			}
+			g.Results = append(g.Results, pr)
+		}
+		data.Groups = append(data.Groups, g)
+	}
+
+	var buf bytes.Buffer
+	if err := p.template(project).Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// explainPrompt is the instruction given to p.explainer,
+// followed by the issue and the related document.
+const explainPrompt = "In one short sentence, explain why the second document below " +
+	"is likely to be related to the first (a newly filed issue). " +
+	"Do not repeat the titles of the documents."
+
+// maxExplain is the maximum length in bytes of an explanation.
+const maxExplain = 300
+
+// explain returns a one-sentence explanation of why r
+// is related to the document with the given URL,
+// or "" if explanations are disabled or unavailable.
+// It generates each explanation only once (see [Poster.EnableExplanations]).
+func (p *Poster) explain(u string, r storage.VectorResult) string {
+	if p.explainer == nil || r.Score < p.explainScoreCutoff {
+		return ""
+	}
+	key := ordered.Encode("related.Explanation", p.explainModel, u, r.ID)
+	if js, ok := p.db.Get(key); ok {
+		var text string
+		if err := json.Unmarshal(js, &text); err != nil {
+			// unreachable unless corrupt storage
+			p.db.Panic("related.Poster explain decode", "key", storage.Fmt(key), "err", err)
+		}
+		return text
+	}
+	d, ok1 := p.docs.Get(u)
+	rd, ok2 := p.docs.Get(r.ID)
+	if !ok1 || !ok2 {
+		return ""
+	}
+	text, err := p.explainer.GenerateText(explainPrompt,
+		"First document: "+d.Title+"\n\n"+d.Text,
+		"Second document: "+rd.Title+"\n\n"+rd.Text)
+	if err != nil {
+		p.slog.Error("related.Poster explain", "url", u, "related", r.ID, "err", err)
+		return ""
+	}
+	// Keep only the first line, in case the model is chatty.
+	text, _, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	text = strings.TrimSpace(text)
+	if len(text) > maxExplain {
+		text = strings.ToValidUTF8(text[:maxExplain], "") + "…"
+	}
+	p.db.Set(key, storage.JSON(text))
+	return text
+}
+
+// A postRecord is the database record of a post,
+// stored under the key ("triage.Posted", project, issue).
+// (Posts made by earlier versions of the Poster have an empty record.)
+type postRecord struct {
+	URL     string                 // API URL of the posted comment
+	Time    time.Time              // time of the original post
+	Related []storage.VectorResult // documents listed in the post
+}
+
+// updatePosts updates the posts made within p.updateWindow
+// to add newly discovered strong matches.
+func (p *Poster) updatePosts() {
+	cutoff := p.now().Add(-p.updateWindow)
+	for _, project := range slices.Sorted(maps.Keys(p.projects)) {
+		start := ordered.Encode("triage.Posted", project)
+		end := ordered.Encode("triage.Posted", project, ordered.Inf)
+		for key, val := range p.db.Scan(start, end) {
+			var issue int64
+			if err := ordered.Decode(key, nil, nil, &issue); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster posted decode", "key", storage.Fmt(key), "err", err)
+			}
+			data := val()
+			if len(data) == 0 {
+				continue
+			}
+			var r postRecord
+			if err := json.Unmarshal(data, &r); err != nil {
+				// unreachable unless corrupt storage
+				p.db.Panic("related.Poster posted decode", "key", storage.Fmt(key), "err", err)
+			}
+			if r.URL == "" || r.Time.Before(cutoff) {
+				continue
+			}
+			if p.updatePost(project, issue, &r) && p.post {
+				p.db.Set(key, storage.JSON(&r))
+				p.db.Flush()
+			}
+		}
+	}
+}
+
+// updatePost updates the post r on the given issue,
+// reporting whether it did (or would, if posting were enabled).
+// If so, it also updates r.Related.
+func (p *Poster) updatePost(project string, issue int64, r *postRecord) bool {
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", project, issue)
+	if is, err := p.github.LookupIssueURL(u); err != nil || is.State == "closed" {
+		return false
+	}
+	vec, ok := p.vdb.Get(u)
+	if !ok {
+		p.slog.Error("related.Poster update lookup failed", "url", u)
+		return false
+	}
+	listed := make(map[string]bool)
+	for _, doc := range r.Related {
+		listed[doc.ID] = true
+	}
+	related := slices.Clone(r.Related)
+	for _, doc := range p.search(project, u, vec) {
+		if len(related) >= p.maxResults {
+			break
+		}
+		if !listed[doc.ID] && doc.Score >= p.updateScoreCutoff {
+			related = append(related, doc)
+		}
+	}
+	if len(related) == len(r.Related) {
+		return false
+	}
+
+	live, err := p.github.DownloadIssueComment(r.URL)
+	if err != nil {
+		p.slog.Error("related.Poster update download", "url", r.URL, "err", err)
+		return false
+	}
+	if poster, ok := footer.Poster(live.Body); !ok || poster != "related" {
+		// Comment has been edited to remove the footer; leave it alone.
+		p.slog.Info("related.Poster update skip edited post", "url", r.URL)
+		return false
+	}
+
+	body, err := p.comment(project, issue, u, related)
+	if err != nil {
+		p.slog.Error("related.Poster template", "project", project, "issue", issue, "err", err)
+		return false
+	}
+	p.slog.Info("related.Poster update", "name", p.name, "project", project, "issue", issue, "url", r.URL, "comment", body)
+	if !p.post {
+		return true
+	}
+	if err := p.github.EditIssueComment(live, &github.IssueCommentChanges{Body: body}); err != nil {
+		p.slog.Error("EditIssueComment", "issue", issue, "err", err)
+		return false
+	}
+	r.Related = related
+	return true
 }
 
 var markdownEscaper = strings.NewReplacer(
@@ -5,9 +5,15 @@
 package related
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"maps"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -15,13 +21,17 @@ import (
 	"rsc.io/gaby/internal/diff"
 	"rsc.io/gaby/internal/docs"
 	"rsc.io/gaby/internal/embeddocs"
+	"rsc.io/gaby/internal/footer"
 	"rsc.io/gaby/internal/github"
 	"rsc.io/gaby/internal/githubdocs"
 	"rsc.io/gaby/internal/llm"
 	"rsc.io/gaby/internal/storage"
 	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
 )
 
+var ctx = context.Background()
+
 func Test(t *testing.T) {
 	lg := testutil.Slogger(t)
 	db := storage.MemDB()
@@ -30,21 +40,21 @@ func Test(t *testing.T) {
 	gh.Testing().LoadTxtar("../testdata/rsctmp.txt")
 
 	dc := docs.New(db)
-	githubdocs.Sync(lg, dc, gh)
+	githubdocs.Sync(ctx, lg, dc, gh)
 
 	vdb := storage.MemVectorDB(db, lg, "vecs")
-	embeddocs.Sync(lg, vdb, llm.QuoteEmbedder(), dc)
+	embeddocs.Sync(ctx, lg, db, vdb, llm.QuoteEmbedder(), dc)
 
 	vdb = storage.MemVectorDB(db, lg, "vecs")
 	p := New(lg, db, gh, vdb, dc, "postname")
 	p.EnableProject("rsc/markdown")
 	p.SetTimeLimit(time.Time{})
-	p.Run()
+	p.Run(ctx)
 	checkEdits(t, gh.Testing().Edits(), nil)
 	gh.Testing().ClearEdits()
 
 	p.EnablePosts()
-	p.Run()
+	p.Run(ctx)
 	checkEdits(t, gh.Testing().Edits(), map[int64]string{13: post13, 19: post19})
 	gh.Testing().ClearEdits()
 
@@ -52,11 +62,11 @@ func Test(t *testing.T) {
 	p.EnableProject("rsc/markdown")
 	p.SetTimeLimit(time.Time{})
 	p.EnablePosts()
-	p.Run()
+	p.Run(ctx)
 	checkEdits(t, gh.Testing().Edits(), nil)
 	gh.Testing().ClearEdits()
 
-	for i := range 4 {
+	for i := range 6 {
 		p := New(lg, db, gh, vdb, dc, "postnameloop."+fmt.Sprint(i))
 		p.EnableProject("rsc/markdown")
 		p.SetTimeLimit(time.Time{})
@@ -70,21 +80,37 @@ func Test(t *testing.T) {
 		case 3:
 			p.SkipBodyContains("For example, this heading")
 			p.SkipBodyContains("ZZZ")
+		case 4:
+			p.SkipAuthor("adonovan")
+		case 5:
+			p.SkipIf("issue 19", func(issue *github.Issue) bool { return issue.Number == 19 })
 		}
 		p.EnablePosts()
 		p.deletePosted()
-		p.Run()
+		p.Run(ctx)
 		checkEdits(t, gh.Testing().Edits(), map[int64]string{13: post13})
 		gh.Testing().ClearEdits()
 	}
 
+	// No issues in the test data have labels, so check label rules directly.
+	p = New(lg, db, gh, vdb, dc, "postnamelabel")
+	p.SkipLabel("Documentation")
+	issue := &github.Issue{State: "open", Labels: []github.Label{{Name: "NeedsFix"}}}
+	if reason := p.skipReason(issue); reason != "" {
+		t.Errorf("skipReason(NeedsFix) = %q, want \"\"", reason)
+	}
+	issue.Labels = append(issue.Labels, github.Label{Name: "Documentation"})
+	if reason, want := p.skipReason(issue), `has label "Documentation"`; reason != want {
+		t.Errorf("skipReason(NeedsFix, Documentation) = %q, want %q", reason, want)
+	}
+
 	p = New(lg, db, gh, vdb, dc, "postname3")
 	p.EnableProject("rsc/markdown")
 	p.SetMinScore(2.0) // impossible
 	p.SetTimeLimit(time.Time{})
 	p.EnablePosts()
 	p.deletePosted()
-	p.Run()
+	p.Run(ctx)
 	checkEdits(t, gh.Testing().Edits(), nil)
 	gh.Testing().ClearEdits()
 
@@ -94,7 +120,7 @@ func Test(t *testing.T) {
 	p.SetTimeLimit(time.Date(2222, 1, 1, 1, 1, 1, 1, time.UTC))
 	p.EnablePosts()
 	p.deletePosted()
-	p.Run()
+	p.Run(ctx)
 	checkEdits(t, gh.Testing().Edits(), nil)
 	gh.Testing().ClearEdits()
 
@@ -105,12 +131,575 @@ func Test(t *testing.T) {
 	p.SetTimeLimit(time.Time{})
 	p.EnablePosts()
 	p.deletePosted()
-	p.Run()
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), nil)
+	gh.Testing().ClearEdits()
+
+	p = New(lg, db, gh, vdb, dc, "postname6")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	f, err := footer.New("Posted by {{.Poster}}.", "")
+	testutil.Check(t, err)
+	p.SetFooter(f)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: strings.Replace(post13, defaultFooter, "Posted by related.", 1),
+		19: strings.Replace(post19, defaultFooter, "Posted by related.", 1),
+	})
+	gh.Testing().ClearEdits()
+
+	// Post only the strongest matches, then update the posts
+	// to add the next strongest (all pull requests, which are
+	// listed in their own group).
+	p = New(lg, db, gh, vdb, dc, "postname7")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	clock := testutil.NewFakeClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(clock.Now)
+	p.SetMinScore(0.916)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{13: itemsAbove(post13, 0.916), 19: itemsAbove(post19, 0.916)})
+	gh.Testing().ClearEdits()
+
+	p.SetMinScore(0)
+	p.Run(ctx) // updates not enabled
 	checkEdits(t, gh.Testing().Edits(), nil)
+
+	p.SetUpdateWindow(1 * time.Hour)
+	p.SetUpdateMinScore(0.91)
+	p.Run(ctx)
+	checkUpdates(t, gh.Testing().Edits(), map[int64]string{13: itemsAbove(post13, 0.91), 19: itemsAbove(post19, 0.91)})
+	gh.Testing().ClearEdits()
+
+	p.Run(ctx) // nothing new to add
+	checkEdits(t, gh.Testing().Edits(), nil)
+
+	p.SetUpdateMinScore(0)
+	clock.Advance(2 * time.Hour) // posts too old to update
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), nil)
+
+	gh.Testing().ClearEdits()
+
+	// By default, only issues less than 48 hours old are posted to.
+	// Issue 19 was created at 2024-05-21 13:56:12, issue 13 long before.
+	for i, tt := range []struct {
+		now  time.Time
+		want map[int64]string
+	}{
+		{time.Date(2024, 5, 22, 12, 0, 0, 0, time.UTC), map[int64]string{19: post19}},
+		{time.Date(2024, 5, 24, 12, 0, 0, 0, time.UTC), nil},
+	} {
+		p = New(lg, db, gh, vdb, dc, "postnametime."+fmt.Sprint(i))
+		p.EnableProject("rsc/markdown")
+		p.SetClock(testutil.NewFakeClock(tt.now).Now)
+		p.EnablePosts()
+		p.deletePosted()
+		p.Run(ctx)
+		checkEdits(t, gh.Testing().Edits(), tt.want)
+		gh.Testing().ClearEdits()
+	}
+
+	// Limit the number of code changes.
+	p = New(lg, db, gh, vdb, dc, "postname9")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.SetMaxResults(5)
+	p.SetKindMaxResults(docs.KindCL, 1)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	keep := func(nums ...string) func(string) bool {
+		return func(line string) bool {
+			for _, n := range nums {
+				if strings.Contains(line, "/issues/"+n+")") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: filterItems(post13, keep("6", "9", "12", "19", "4")),
+		19: filterItems(post19, keep("2", "9", "6", "14", "7")),
+	})
+	gh.Testing().ClearEdits()
+
+	// Explain the strongest matches.
+	p = New(lg, db, gh, vdb, dc, "postname10")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	ex := new(testExplainer)
+	p.EnableExplanations(ex, "test-model", 0.915)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	explained := func(post string) string {
+		var out []string
+		for _, line := range strings.SplitAfter(post, "\n") {
+			_, score, ok := strings.Cut(line, "<!-- score=")
+			f, _ := strconv.ParseFloat(strings.TrimSuffix(score, " -->\n"), 64)
+			if ok && f >= 0.915 && !strings.Contains(line, "table cells") {
+				line = strings.Replace(line, " <!--", " — Both concern Markdown \\*rendering\\*. <!--", 1)
+			}
+			out = append(out, line)
+		}
+		return strings.Join(out, "")
+	}
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: explained(post13),
+		19: explained(post19),
+	})
+	gh.Testing().ClearEdits()
+
+	// Explanations are generated only once, even by a new Poster.
+	n := ex.generated
+	p = New(lg, db, gh, vdb, dc, "postname10b")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.EnableExplanations(ex, "test-model", 0.915)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	if n == 0 || ex.generated != n {
+		t.Errorf("generated %d explanations, then %d more; want >0, then none", n, ex.generated-n)
+	}
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: explained(post13),
+		19: explained(post19),
+	})
+	gh.Testing().ClearEdits()
+
+	// Skip a repo.
+	p = New(lg, db, gh, vdb, dc, "postname11")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.SetMaxResults(9) // don't let other documents take rsc/tmp#10's place
+	p.SkipSearchRepo("rsc/markdown", "rsc/tmp")
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	notTmp := func(line string) bool { return !strings.Contains(line, "/rsc/tmp/") }
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: filterItems(post13, notTmp),
+		19: filterItems(post19, notTmp),
+	})
+	gh.Testing().ClearEdits()
+
+	// Use a custom template.
+	p = New(lg, db, gh, vdb, dc, "postname13")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	for _, bad := range []string{"{{", "{{.Missing}}", "{{range .Groups}}{{.Results.Score}}{{end}}"} {
+		if err := p.SetTemplate("rsc/markdown", bad); err == nil {
+			t.Errorf("SetTemplate(%q) succeeded, want error", bad)
+		}
+	}
+	testutil.Check(t, p.SetTemplate("rsc/markdown", "{{range .Groups}}{{.Header}} for #{{$.Issue}}:{{range .Results}} #{{.Number}}{{end}}\n{{end}}{{.Footer}}"))
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	foot := footer.Default().Render("related", "rsc/markdown")
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{
+		13: "Related Issues for #13: #6 #9 #19 #4 #2\nRelated Code Changes for #13: #12 #18 #10 #14 #15\n" + foot,
+		19: "Related Issues for #19: #2 #9 #6 #7 #13 #4\nRelated Code Changes for #19: #14 #15 #12 #10\n" + foot,
+	})
+	gh.Testing().ClearEdits()
+
+	// Restrict and weight searches by repo.
+	u13 := "https://github.com/rsc/markdown/issues/13"
+	vec13, ok := vdb.Get(u13)
+	if !ok {
+		t.Fatalf("missing vector for %s", u13)
+	}
+	p = New(lg, db, gh, vdb, dc, "postname12")
+	p.SetRepoWeight("rsc/markdown", "rsc/tmp", 1.05)
+	results := p.search("rsc/markdown", u13, vec13)
+	if len(results) == 0 || results[0].ID != "https://github.com/rsc/tmp/issues/10" || fmt.Sprintf("%.5f", results[0].Score) != "0.94976" {
+		t.Fatalf("weighted search: top result is %v, want rsc/tmp#10 with score 0.94976", results[:min(len(results), 1)])
+	}
+	p.SetSearchRepos("rsc/markdown", "rsc/tmp")
+	for _, r := range p.search("rsc/markdown", u13, vec13) {
+		if githubRepo(r.ID) != "rsc/tmp" {
+			t.Errorf("restricted search found %v", r)
+		}
+	}
+	if results := p.search("rsc/tmp", u13, vec13); len(results) != len(p.search("other/project", u13, vec13)) {
+		t.Errorf("scope for rsc/markdown affected rsc/tmp")
+	}
+
+	// Store the configuration in the database.
+	p = New(lg, db, gh, vdb, dc, "config")
+	p.EnableProject("rsc/markdown")
+	p.SkipTitlePrefix("feature: ")
+	c := p.Config()
+	wantConfig := &Config{Projects: []string{"rsc/markdown"}, SkipTitlePrefix: []string{"feature: "}, MinScore: 0.82, MaxResults: 10}
+	if !reflect.DeepEqual(c, wantConfig) {
+		t.Fatalf("Config() = %+v, want %+v", c, wantConfig)
+	}
+	for _, bad := range []*Config{{MinScore: 2}, {MaxResults: -1}} {
+		if err := p.SetConfig(bad); err == nil {
+			t.Errorf("SetConfig(%+v) succeeded, want error", bad)
+		}
+	}
+	c.SkipTitlePrefix = nil
+	c.SkipBodyContains = []string{"For example, this heading"}
+	c.MaxResults = 3
+	testutil.Check(t, p.SetConfig(c))
+
+	p = New(lg, db, gh, vdb, dc, "config") // configured only by database
+	p.SkipIf("never", func(*github.Issue) bool { return false })
+	if c := p.Config(); !reflect.DeepEqual(c, &Config{Projects: []string{"rsc/markdown"}, SkipBodyContains: []string{"For example, this heading"}, MinScore: 0.82, MaxResults: 3}) {
+		t.Fatalf("stored Config() = %+v", c)
+	}
+	p.SetTimeLimit(time.Time{})
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{13: itemsAbove(post13, 0.913)})
+	gh.Testing().ClearEdits()
+
+	// Change the stored configuration to skip issues by author.
+	c = p.Config()
+	c.SkipBodyContains = nil
+	c.SkipAuthors = []string{"zacharysyoung"}
+	testutil.Check(t, p.SetConfig(c))
+	p.deletePosted()
+	p.Run(ctx)
+	if len(p.ignores) != 2 || p.ignores[0].String() != "never" {
+		t.Errorf("SkipIf rule lost when loading stored configuration: %v", p.ignores)
+	}
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{19: itemsAbove(post19, 0.918)})
+	gh.Testing().ClearEdits()
+
+	// Never post twice, even after a crash between posting and recording the post.
+	p = New(lg, db, gh, vdb, dc, "crash")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.EnablePosts()
+	p.deletePosted()
+	if !storage.BeginAction(db, ordered.Encode("related.Post", "rsc/markdown", 19)) {
+		t.Fatalf("BeginAction failed after deletePosted")
+	}
+	p.Run(ctx)
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{13: post13})
+	gh.Testing().ClearEdits()
+	if r, ok := storage.LookupAction(db, ordered.Encode("related.Post", "rsc/markdown", 13)); !ok || !r.Done {
+		t.Fatalf("post action for rsc/markdown#13 not recorded as done: %+v", r)
+	}
+
+	// Collect feedback on posts.
+	p = New(lg, db, gh, vdb, dc, "feedback")
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
 	gh.Testing().ClearEdits()
+	postURL := func(issue int64) string {
+		val, ok := db.Get(ordered.Encode("triage.Posted", "rsc/markdown", issue))
+		if !ok {
+			t.Fatalf("no post record for rsc/markdown#%d", issue)
+		}
+		var r postRecord
+		testutil.Check(t, json.Unmarshal(val, &r))
+		return r.URL
+	}
+	react := func(issue int64, who, content string) {
+		gh.Testing().AddReaction(postURL(issue), &github.Reaction{User: github.User{Login: who}, Content: content})
+	}
+	react(13, "gopher", "+1")
+	react(13, "rsc", "heart")
+	react(13, "bot", "eyes")
+	react(19, "gopher", "-1")
+	p.SyncFeedback(ctx)
+	react(19, "rsc", "+1") // not seen: checked too recently
+	p.SyncFeedback(ctx)
+	stats := p.Feedback("rsc/markdown")
+	wantStats := &FeedbackStats{
+		Project:   "rsc/markdown",
+		Posts:     2,
+		Voted:     2,
+		Helpful:   2,
+		Unhelpful: 1,
+		Buckets:   []*FeedbackBucket{{MinScore: 46 * FeedbackBucketSize, Posts: 2, Helpful: 2, Unhelpful: 1}},
+	}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Fatalf("Feedback() = %s, want %s", storage.JSON(stats), storage.JSON(wantStats))
+	}
+	if r := stats.HelpfulRate(); r != 2.0/3 {
+		t.Errorf("HelpfulRate() = %v, want 2/3", r)
+	}
+	if stats := p.Feedback("rsc/tmp"); stats.Posts != 0 || stats.HelpfulRate() != 0 {
+		t.Errorf("Feedback(rsc/tmp) = %s, want empty", storage.JSON(stats))
+	}
+
+	// Rank open and recent issues higher.
+	p = New(lg, db, gh, vdb, dc, "rank")
+	p.SetOpenWeight(0.1)
+	var ids []string
+	for _, r := range p.search("rsc/markdown", u13, vec13)[:3] {
+		ids = append(ids, r.ID)
+	}
+	wantIDs := []string{
+		"https://github.com/rsc/markdown/issues/19", // open, 0.90867
+		"https://github.com/rsc/tmp/issues/10",      // open, 0.90453
+		"https://github.com/rsc/tmp/issues/11",      // open, 0.90053
+	}
+	if !slices.Equal(ids, wantIDs) {
+		t.Errorf("search with open weight = %v, want %v", ids, wantIDs)
+	}
+	p.SetOpenWeight(0)
+	p.SetRecencyWeight(0.1, 30*24*time.Hour)
+	created13 := time.Date(2024, 3, 12, 15, 34, 33, 0, time.UTC)
+	if results := p.searchBefore("rsc/markdown", u13, vec13, created13); results[0].ID != "https://github.com/rsc/markdown/issues/12" {
+		t.Errorf("search with recency weight: top result is %v, want rsc/markdown#12 (created 2024-02-15)", results[0])
+	}
+
+	// Report what would be posted, without posting.
+	p = New(lg, db, gh, vdb, dc, "report")
+	p.EnableProject("rsc/markdown")
+	p.SkipTitlePrefix("feature: ")
+	p.EnablePosts()
+	var buf bytes.Buffer
+	testutil.Check(t, p.Report(&buf, time.Time{}, time.Now()))
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("Report posted: %v", edits)
+	}
+	report := buf.String()
+	for _, want := range []string{
+		`<h2><a href="https://github.com/rsc/markdown/issues/2">rsc/markdown#2</a> allow capital X in task list items</h2>` + "\n" +
+			`<p>Created 2023-12-12T15:28:39Z. <span class="skip">Skipped: closed.</span></p>`,
+		`<h2><a href="https://github.com/rsc/markdown/issues/13">rsc/markdown#13</a> Correctly render reference links in Markdown</h2>`,
+		`<tr class="posted"><td>0.92657</td><td>0.92657</td><td>issue</td><td><a href="https://github.com/rsc/markdown/issues/6">goldmark and markdown diff with h1 inside p</a></td></tr>`,
+		`<tr><td>0.90053</td><td></td><td>cl</td><td><a href="https://github.com/rsc/tmp/issues/11">`,
+		`<pre>**Related Issues**`,
+		`<span class="skip">Skipped: title has prefix &#34;feature: &#34;.</span>`,
+		`<p>2 posts checked, 2 with votes: 2 helpful, 1 unhelpful (67% helpful).</p>`,
+		`<tr><td>0.92</td><td>2</td><td>2</td><td>1</td><td>67%</td></tr>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %s", want)
+		}
+	}
+	buf.Reset()
+	testutil.Check(t, p.Report(&buf, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)))
+	if report := buf.String(); !strings.Contains(report, "rsc/markdown#13") || strings.Contains(report, "rsc/markdown#12") || strings.Contains(report, "rsc/markdown#19") {
+		t.Errorf("report for March 2024 should list only rsc/markdown#13:\n%s", report)
+	}
+
+	// Note possible duplicates, then label the one a maintainer confirms.
+	p = New(lg, db, gh, vdb, dc, "postname8")
+	clock = testutil.NewFakeClock(time.Now())
+	p.SetClock(clock.Now)
+	p.EnableProject("rsc/markdown")
+	p.SetTimeLimit(time.Time{})
+	p.EnableDuplicates("Duplicate", "rsc")
+	p.SetDuplicateMinScore(0.927)
+	p.EnablePosts()
+	p.deletePosted()
+	p.Run(ctx)
+	var notes []string
+	for _, e := range gh.Testing().Edits() {
+		if e.IssueCommentChanges != nil && strings.Contains(e.IssueCommentChanges.Body, "Possible duplicate") {
+			notes = append(notes, e.String())
+		}
+	}
+	wantNotes := []string{
+		`PostIssueComment(rsc/markdown#19, {"body":"**Possible duplicate** of #2 (similarity 0.92943).\n\nMaintainers: react 👍 to this comment to confirm, and the Duplicate label will be added.\n\n\u003c!-- gaby:duplicate --\u003e\n"})`,
+	}
+	if !slices.Equal(notes, wantNotes) {
+		t.Fatalf("duplicate notes:\nhave %s\nwant %s", strings.Join(notes, "\n"), strings.Join(wantNotes, "\n"))
+	}
+	gh.Testing().ClearEdits()
+
+	dup := func(issue int64) *dupRecord {
+		val, ok := db.Get(ordered.Encode("related.Duplicate", "rsc/markdown", issue))
+		if !ok {
+			t.Fatalf("no duplicate record for rsc/markdown#%d", issue)
+		}
+		var r dupRecord
+		testutil.Check(t, json.Unmarshal(val, &r))
+		return &r
+	}
+	note := dup(19).URL
+	gh.Testing().AddReaction(note, &github.Reaction{User: github.User{Login: "gopher"}, Content: "+1"})
+	gh.Testing().AddReaction(note, &github.Reaction{User: github.User{Login: "rsc"}, Content: "-1"})
+	clock.Advance(2 * time.Hour)
+	p.Run(ctx) // not confirmed by a maintainer
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("unconfirmed duplicate edits: %v", edits)
+	}
+
+	gh.Testing().AddReaction(note, &github.Reaction{User: github.User{Login: "rsc"}, Content: "+1"})
+	p.Run(ctx) // checked too recently
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("duplicate edits before check interval: %v", edits)
+	}
+	clock.Advance(2 * time.Hour)
+	p.Run(ctx)
+	var labels []string
+	for _, e := range gh.Testing().Edits() {
+		labels = append(labels, e.String())
+	}
+	wantLabels := []string{`EditIssue(rsc/markdown#19, {"labels":["Duplicate"]})`}
+	if !slices.Equal(labels, wantLabels) {
+		t.Fatalf("duplicate labels:\nhave %s\nwant %s", labels, wantLabels)
+	}
+	if !dup(19).Done {
+		t.Fatalf("duplicate record not marked done after labeling")
+	}
+	gh.Testing().ClearEdits()
+
+	p.Run(ctx) // already labeled
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("repeated duplicate edits: %v", edits)
+	}
+
+	// An old note is abandoned, not checked, even once confirmed.
+	key13 := ordered.Encode("related.Duplicate", "rsc/markdown", 13)
+	db.Set(key13, storage.JSON(&dupRecord{URL: note, Of: 2, Time: clock.Now().Add(-15 * 24 * time.Hour)}))
+	p.Run(ctx)
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("expired duplicate edits: %v", edits)
+	}
+	if r := dup(13); !r.Done || !r.Checked.IsZero() {
+		t.Fatalf("expired duplicate record = %+v, want done and never checked", r)
+	}
+
+	// Backfill historical issues.
+	gh.Testing().AddIssueComment("rsc/markdown", 19, &github.IssueComment{Body: "Duplicate of #2\n"})
+	p = New(lg, db, gh, vdb, dc, "backfill")
+	p.EnableProject("rsc/markdown")
+	p.SkipTitlePrefix("I'd like")
+	if n := p.Backfill("rsc/markdown", 12, 19); n != 8 {
+		t.Fatalf("Backfill(12, 19) = %d, want 8", n)
+	}
+	if edits := gh.Testing().Edits(); len(edits) != 0 {
+		t.Fatalf("Backfill posted: %v", edits)
+	}
+	var got []int64
+	for r := range p.BackfillResults("rsc/markdown") {
+		got = append(got, r.Issue)
+		switch r.Issue {
+		case 12:
+			if r.Skip != "pull request" || r.Related != nil {
+				t.Errorf("rsc/markdown#12: Skip = %q, Related = %v, want pull request", r.Skip, r.Related)
+			}
+		case 16:
+			if r.Skip != `title has prefix "I'd like"` || r.Related != nil {
+				t.Errorf("rsc/markdown#16: Skip = %q, Related = %v, want skip", r.Skip, r.Related)
+			}
+		case 13:
+			// Issue 13 was created 2024-03-12; issues 14 and later did not exist yet.
+			if r.Skip != "" || len(r.Related) == 0 {
+				t.Errorf("rsc/markdown#13: Skip = %q, len(Related) = %d, want results", r.Skip, len(r.Related))
+			}
+			for _, doc := range r.Related {
+				if issue, err := gh.LookupIssueURL(doc.ID); err == nil && issue.CreatedAt >= "2024-03-12T15:34:33Z" {
+					t.Errorf("rsc/markdown#13: found later issue %s", doc.ID)
+				}
+			}
+		case 19:
+			if r.DuplicateOf != 2 || r.DuplicateRank != 1 {
+				t.Errorf("rsc/markdown#19: DuplicateOf = %d, DuplicateRank = %d, want 2, 1", r.DuplicateOf, r.DuplicateRank)
+			}
+		}
+	}
+	if want := []int64{12, 13, 14, 15, 16, 17, 18, 19}; !slices.Equal(got, want) {
+		t.Errorf("BackfillResults = %v, want %v", got, want)
+	}
+
+	// PostIssue posts on demand, ignoring skip rules, but at most once.
+	p = New(lg, db, gh, vdb, dc, "postissue")
+	p.SkipTitlePrefix("")
+	p.EnablePosts()
+	p.deletePosted()
+	issue19, err := gh.LookupIssueURL("https://github.com/rsc/markdown/issues/19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PostIssue(issue19); err != nil {
+		t.Fatal(err)
+	}
+	checkEdits(t, gh.Testing().Edits(), map[int64]string{19: post19})
+	gh.Testing().ClearEdits()
+	if err := p.PostIssue(issue19); err == nil {
+		t.Errorf("second PostIssue succeeded")
+	}
+	checkEdits(t, gh.Testing().Edits(), nil)
+}
+
+// testExplainer is an [llm.TextGenerator] that explains every pair
+// of documents the same way, except that it fails for documents about tables.
+type testExplainer struct {
+	generated int // number of explanations generated
+}
+
+func (x *testExplainer) GenerateText(prompt ...string) (string, error) {
+	if strings.Contains(prompt[len(prompt)-1], "table cells") {
+		return "", fmt.Errorf("no explanation")
+	}
+	x.generated++
+	return " Both concern Markdown *rendering*.\nThe rest is ignored.\n", nil
+}
+
+// itemsAbove returns post with the related documents scoring below min removed,
+// along with any headers left with no documents.
+func itemsAbove(post string, min float64) string {
+	return filterItems(post, func(line string) bool {
+		_, score, _ := strings.Cut(line, "<!-- score=")
+		f, _ := strconv.ParseFloat(strings.TrimSuffix(score, " -->\n"), 64)
+		return f >= min
+	})
+}
 
+// filterItems returns post with only the related documents for which keep returns true,
+// removing any headers left with no documents.
+func filterItems(post string, keep func(line string) bool) string {
+	var out []string
+	for _, line := range strings.SplitAfter(post, "\n") {
+		if strings.HasPrefix(line, " - ") && !keep(line) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return emptyGroupRE.ReplaceAllString(strings.Join(out, ""), "\n")
+}
+
+var emptyGroupRE = regexp.MustCompile(`\n\*\*[^*\n]+\*\*\n\n\n`)
+
+// checkUpdates checks that edits are exactly
+// the updates of earlier posts listed in want.
+func checkUpdates(t *testing.T, edits []*github.TestingEdit, want map[int64]string) {
+	t.Helper()
+	for _, e := range edits {
+		if e.Project != "rsc/markdown" || e.Comment == 0 || e.IssueCommentChanges == nil {
+			t.Errorf("unexpected edit: %v", e)
+			continue
+		}
+		w, ok := want[e.Issue]
+		if !ok {
+			t.Errorf("update on unexpected issue: %v", e)
+			continue
+		}
+		delete(want, e.Issue)
+		if e.IssueCommentChanges.Body != w {
+			t.Errorf("rsc/markdown#%d: wrong update:\n%s", e.Issue,
+				string(diff.Diff("want", []byte(w), "have", []byte(e.IssueCommentChanges.Body))))
+		}
+	}
+	for _, issue := range slices.Sorted(maps.Keys(want)) {
+		t.Errorf("did not see update on rsc/markdown#%d", issue)
+	}
 }
 
+var defaultFooter = "<sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion](https://github.com/golang/go/discussions/67901).)</sub>"
+
 func checkEdits(t *testing.T, edits []*github.TestingEdit, want map[int64]string) {
 	t.Helper()
 	for _, e := range edits {
@@ -145,16 +734,20 @@ var post13 = unQUOT(`**Related Issues**
 
  - [goldmark and markdown diff with h1 inside p #6 (closed)](https://github.com/rsc/markdown/issues/6) <!-- score=0.92657 -->
  - [Support escaped \QUOT|\QUOT in table cells #9 (closed)](https://github.com/rsc/markdown/issues/9) <!-- score=0.91858 -->
- - [markdown: fix markdown printing for inline code #12 (closed)](https://github.com/rsc/markdown/issues/12) <!-- score=0.91325 -->
- - [markdown: emit Info in CodeBlock markdown #18 (closed)](https://github.com/rsc/markdown/issues/18) <!-- score=0.91129 -->
  - [feature: synthesize lowercase anchors for heading #19](https://github.com/rsc/markdown/issues/19) <!-- score=0.90867 -->
  - [Replace newlines with spaces in alt text #4 (closed)](https://github.com/rsc/markdown/issues/4) <!-- score=0.90859 -->
  - [allow capital X in task list items #2 (closed)](https://github.com/rsc/markdown/issues/2) <!-- score=0.90850 -->
+
+**Related Code Changes**
+
+ - [markdown: fix markdown printing for inline code #12 (closed)](https://github.com/rsc/markdown/issues/12) <!-- score=0.91325 -->
+ - [markdown: emit Info in CodeBlock markdown #18 (closed)](https://github.com/rsc/markdown/issues/18) <!-- score=0.91129 -->
  - [build(deps): bump golang.org/x/text from 0.3.6 to 0.3.8 in /rmplay #10](https://github.com/rsc/tmp/issues/10) <!-- score=0.90453 -->
  - [Render reference links in Markdown #14 (closed)](https://github.com/rsc/markdown/issues/14) <!-- score=0.90175 -->
  - [Render reference links in Markdown #15 (closed)](https://github.com/rsc/markdown/issues/15) <!-- score=0.90103 -->
 
 <sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion](https://github.com/golang/go/discussions/67901).)</sub>
+<!-- gaby:related -->
 `)
 
 var post19 = unQUOT(`**Related Issues**
@@ -162,15 +755,19 @@ var post19 = unQUOT(`**Related Issues**
  - [allow capital X in task list items #2 (closed)](https://github.com/rsc/markdown/issues/2) <!-- score=0.92943 -->
  - [Support escaped \QUOT|\QUOT in table cells #9 (closed)](https://github.com/rsc/markdown/issues/9) <!-- score=0.91994 -->
  - [goldmark and markdown diff with h1 inside p #6 (closed)](https://github.com/rsc/markdown/issues/6) <!-- score=0.91813 -->
- - [Render reference links in Markdown #14 (closed)](https://github.com/rsc/markdown/issues/14) <!-- score=0.91513 -->
- - [Render reference links in Markdown #15 (closed)](https://github.com/rsc/markdown/issues/15) <!-- score=0.91487 -->
  - [Empty column heading not recognized in table #7 (closed)](https://github.com/rsc/markdown/issues/7) <!-- score=0.90874 -->
  - [Correctly render reference links in Markdown #13](https://github.com/rsc/markdown/issues/13) <!-- score=0.90867 -->
- - [markdown: fix markdown printing for inline code #12 (closed)](https://github.com/rsc/markdown/issues/12) <!-- score=0.90795 -->
  - [Replace newlines with spaces in alt text #4 (closed)](https://github.com/rsc/markdown/issues/4) <!-- score=0.90278 -->
+
+**Related Code Changes**
+
+ - [Render reference links in Markdown #14 (closed)](https://github.com/rsc/markdown/issues/14) <!-- score=0.91513 -->
+ - [Render reference links in Markdown #15 (closed)](https://github.com/rsc/markdown/issues/15) <!-- score=0.91487 -->
+ - [markdown: fix markdown printing for inline code #12 (closed)](https://github.com/rsc/markdown/issues/12) <!-- score=0.90795 -->
  - [build(deps): bump golang.org/x/text from 0.3.6 to 0.3.8 in /rmplay #10](https://github.com/rsc/tmp/issues/10) <!-- score=0.90259 -->
 
 <sub>(Emoji vote if this was helpful or unhelpful; more detailed feedback welcome in [this discussion](https://github.com/golang/go/discussions/67901).)</sub>
+<!-- gaby:related -->
 `)
 
 func unQUOT(s string) string { return strings.ReplaceAll(s, "QUOT", "`") }
@@ -0,0 +1,199 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+)
+
+// Report writes to w an HTML page reporting what the Poster
+// would post on issues in the enabled projects
+// that were created at or after start and before end.
+// For each issue, the report lists the candidate documents
+// found by the vector search, with their scores and whether
+// they would be posted, along with the text of the post;
+// or, if the issue would be skipped, it gives the reason.
+// The report also summarizes the reactions to earlier posts
+// in each project (see [Poster.Feedback]).
+//
+// Report is meant for tuning the Poster's configuration,
+// such as [Poster.SetMinScore] and [Poster.SkipBodyContains].
+// It ignores [Poster.SetTimeLimit] and whether issues have already been
+// posted to, and it never posts to GitHub or modifies the database.
+// Like [Poster.Run], it uses the stored configuration, if any.
+func (p *Poster) Report(w io.Writer, start, end time.Time) error {
+	p.loadConfig()
+	data := &reportData{
+		Name:       p.name,
+		Start:      start.UTC().Format(time.RFC3339),
+		End:        end.UTC().Format(time.RFC3339),
+		MinScore:   p.scoreCutoff,
+		MaxResults: p.maxResults,
+	}
+	for _, project := range slices.Sorted(maps.Keys(p.projects)) {
+		data.Feedback = append(data.Feedback, p.Feedback(project))
+		for e := range p.github.Events(project, 0, -1) {
+			if e.API != "/issues" {
+				continue
+			}
+			issue := e.Typed.(*github.Issue)
+			tm, err := time.Parse(time.RFC3339, issue.CreatedAt)
+			if err != nil {
+				p.slog.Error("related.Poster report parse createdat", "CreatedAt", issue.CreatedAt, "err", err)
+				continue
+			}
+			if tm.Before(start) || !tm.Before(end) {
+				continue
+			}
+			data.Issues = append(data.Issues, p.reportIssue(project, issue))
+		}
+	}
+	return reportTemplate.Execute(w, data)
+}
+
+// reportIssue returns the report for a single issue.
+func (p *Poster) reportIssue(project string, issue *github.Issue) *reportIssue {
+	u := fmt.Sprintf("https://github.com/%s/issues/%d", project, issue.Number)
+	r := &reportIssue{
+		Project: project,
+		Number:  issue.Number,
+		Title:   issue.Title,
+		URL:     u,
+		Created: issue.CreatedAt,
+		Skip:    p.skipReason(issue),
+	}
+	if r.Skip != "" {
+		return r
+	}
+	vec, ok := p.vdb.Get(u)
+	if !ok {
+		r.Skip = "no embedding"
+		return r
+	}
+	results := p.search(project, u, vec)
+	posted := make(map[string]float64)
+	for _, res := range results {
+		posted[res.ID] = res.Score
+	}
+	for _, res := range p.vdb.Search(vec, 2*p.maxResults+5) {
+		if res.ID == u {
+			continue
+		}
+		c := &reportCandidate{
+			URL:   res.ID,
+			Title: res.ID,
+			Kind:  p.kind(res.ID),
+			Score: res.Score,
+		}
+		if d, ok := p.docs.Get(res.ID); ok {
+			c.Title = d.Title
+		}
+		c.PostedScore, c.Posted = posted[res.ID]
+		r.Candidates = append(r.Candidates, c)
+	}
+	if len(results) == 0 {
+		r.Skip = "no related documents"
+		return r
+	}
+	comment, err := p.comment(project, issue.Number, u, results)
+	if err != nil {
+		r.Skip = "template error: " + err.Error()
+		return r
+	}
+	r.Comment = comment
+	return r
+}
+
+type reportData struct {
+	Name       string
+	Start      string
+	End        string
+	MinScore   float64
+	MaxResults int
+	Feedback   []*FeedbackStats
+	Issues     []*reportIssue
+}
+
+type reportIssue struct {
+	Project    string
+	Number     int64
+	Title      string
+	URL        string
+	Created    string
+	Skip       string // reason issue would be skipped, or ""
+	Candidates []*reportCandidate
+	Comment    string // text of post
+}
+
+type reportCandidate struct {
+	URL         string
+	Title       string
+	Kind        string
+	Score       float64 // vector search score
+	Posted      bool    // document would be posted
+	PostedScore float64 // score after weighting (see [Poster.SetRepoWeight])
+}
+
+var reportFuncs = template.FuncMap{
+	"mul100": func(x float64) float64 { return 100 * x },
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Related posts: {{.Name}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { padding: 0.1em 0.5em; text-align: left; }
+tr.posted { font-weight: bold; }
+.skip { color: #888; }
+pre { background: #eee; padding: 0.5em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Related posts: {{.Name}}</h1>
+<p>Issues created from {{.Start}} to {{.End}}.
+Minimum score {{printf "%.5f" .MinScore}}, at most {{.MaxResults}} results.</p>
+{{range .Feedback}}
+<h2>Feedback: {{.Project}}</h2>
+<p>{{.Posts}} posts checked, {{.Voted}} with votes: {{.Helpful}} helpful, {{.Unhelpful}} unhelpful ({{printf "%.0f%%" (mul100 .HelpfulRate)}} helpful).</p>
+{{if .Buckets}}
+<table>
+<tr><th>Top score</th><th>Posts</th><th>Helpful</th><th>Unhelpful</th><th>Rate</th></tr>
+{{range .Buckets}}
+<tr><td>{{printf "%.2f" .MinScore}}</td><td>{{.Posts}}</td><td>{{.Helpful}}</td><td>{{.Unhelpful}}</td><td>{{printf "%.0f%%" (mul100 .HelpfulRate)}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+{{range .Issues}}
+<h2><a href="{{.URL}}">{{.Project}}#{{.Number}}</a> {{.Title}}</h2>
+<p>Created {{.Created}}.{{with .Skip}} <span class="skip">Skipped: {{.}}.</span>{{end}}</p>
+{{if .Candidates}}
+<table>
+<tr><th>Score</th><th>Posted</th><th>Kind</th><th>Document</th></tr>
+{{range .Candidates}}
+<tr{{if .Posted}} class="posted"{{end}}><td>{{printf "%.5f" .Score}}</td><td>{{if .Posted}}{{printf "%.5f" .PostedScore}}{{end}}</td><td>{{.Kind}}</td><td><a href="{{.URL}}">{{.Title}}</a></td></tr>
+{{end}}
+</table>
+{{end}}
+{{with .Comment}}
+<details><summary>Post</summary>
+<pre>{{.}}</pre>
+</details>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,107 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"rsc.io/gaby/internal/storage"
+)
+
+// A scope records the search configuration for issues in a single project.
+type scope struct {
+	include map[string]bool    // repos to search; empty means all
+	exclude map[string]bool    // repos not to search
+	weight  map[string]float64 // score multipliers for repos
+}
+
+// scope returns the scope for project, creating it if needed.
+func (p *Poster) scope(project string) *scope {
+	s := p.scopes[project]
+	if s == nil {
+		s = &scope{
+			include: make(map[string]bool),
+			exclude: make(map[string]bool),
+			weight:  make(map[string]float64),
+		}
+		p.scopes[project] = s
+	}
+	return s
+}
+
+// SetSearchRepos restricts the documents listed as related to
+// issues in project to those from the given GitHub repos
+// (for example "golang/go").
+// Documents that do not come from GitHub, such as documentation,
+// are not affected by the restriction.
+// By default, documents from all repos are considered.
+func (p *Poster) SetSearchRepos(project string, repos ...string) {
+	s := p.scope(project)
+	clear(s.include)
+	for _, r := range repos {
+		s.include[r] = true
+	}
+}
+
+// SkipSearchRepo configures the Poster not to list documents
+// from the GitHub repo (for example "golang/go") as related
+// to issues in project.
+func (p *Poster) SkipSearchRepo(project, repo string) {
+	p.scope(project).exclude[repo] = true
+}
+
+// SetRepoWeight sets the weight of documents from the GitHub repo
+// when searching for documents related to issues in project.
+// The vector search score of each such document is multiplied by weight
+// before ranking the results and applying the minimum score
+// (see [Poster.SetMinScore]), so a weight above 1 prefers the repo
+// and a weight below 1 disfavors it.
+// For example, issues in golang/tools might give golang/go
+// a weight of 1.02.
+// The scores listed in posts are the weighted scores.
+// The default weight is 1.
+func (p *Poster) SetRepoWeight(project, repo string, weight float64) {
+	p.scope(project).weight[repo] = weight
+}
+
+// apply returns the results permitted by s, with weighted scores,
+// sorted by decreasing weighted score.
+// It modifies results in place.
+func (s *scope) apply(results []storage.VectorResult) []storage.VectorResult {
+	out := results[:0]
+	for _, r := range results {
+		repo := githubRepo(r.ID)
+		if repo != "" {
+			if len(s.include) > 0 && !s.include[repo] || s.exclude[repo] {
+				continue
+			}
+			if w, ok := s.weight[repo]; ok {
+				r.Score *= w
+			}
+		}
+		out = append(out, r)
+	}
+	slices.SortStableFunc(out, func(x, y storage.VectorResult) int {
+		return cmp.Compare(y.Score, x.Score)
+	})
+	return out
+}
+
+// githubRepo returns the GitHub repo ("owner/repo") of the document
+// with the given URL, or "" if the document is not from GitHub.
+func githubRepo(url string) string {
+	rest, ok := strings.CutPrefix(url, "https://github.com/")
+	if !ok {
+		return ""
+	}
+	owner, rest, _ := strings.Cut(rest, "/")
+	repo, _, _ := strings.Cut(rest, "/")
+	if owner == "" || repo == "" {
+		return ""
+	}
+	return owner + "/" + repo
+}
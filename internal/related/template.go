@@ -0,0 +1,99 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package related
+
+import (
+	"bytes"
+	"text/template"
+
+	"rsc.io/gaby/internal/docs"
+)
+
+// DefaultTemplate is the default template for posts.
+// It lists each group of documents under a bold header,
+// with each document's score in an invisible HTML comment.
+const DefaultTemplate = `{{range $i, $g := .Groups}}{{if $i}}
+{{end}}**{{.Header}}**
+
+{{range .Results}} - [{{markdown .Title}}{{if .Number}} #{{.Number}}{{if .Closed}} (closed){{end}}{{end}}]({{.URL}}){{with .Explanation}} — {{markdown .}}{{end}} <!-- score={{printf "%.5f" .Score}} -->
+{{end}}{{end}}{{.Footer}}`
+
+// PostData is the data passed to a post template.
+type PostData struct {
+	Project string       // GitHub project being posted to ("golang/go")
+	Issue   int64        // issue number being posted to
+	Groups  []*PostGroup // non-empty groups of related documents, in display order
+	Footer  string       // rendered footer, including leading blank line and trailing marker
+}
+
+// A PostGroup is a group of related documents of a single kind.
+type PostGroup struct {
+	Kind    string        // kind of document (docs.KindIssue and so on; "" for other kinds)
+	Header  string        // header for group ("Related Issues")
+	Results []*PostResult // related documents, in decreasing score order
+}
+
+// A PostResult is a single related document.
+type PostResult struct {
+	URL         string  // URL of document
+	Title       string  // title of document (not Markdown-escaped)
+	Number      int64   // issue or pull request number; 0 if the document is not an issue
+	Closed      bool    // issue or pull request is closed
+	Score       float64 // vector search score
+	Explanation string  // generated explanation (see [Poster.EnableExplanations]), or ""
+}
+
+// templateFuncs are the functions available to post templates.
+var templateFuncs = template.FuncMap{
+	"markdown": markdownEscape,
+}
+
+var defaultTemplate = template.Must(parseTemplate(DefaultTemplate))
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("post").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+}
+
+// SetTemplate sets the template used for posts on issues in project,
+// or for all projects without their own template if project is "".
+// The template is executed with a *[PostData] as its data and
+// can use the function "markdown", which escapes Markdown syntax in text.
+// The default is [DefaultTemplate].
+// SetTemplate returns an error if the template cannot be parsed
+// or executed.
+func (p *Poster) SetTemplate(project, text string) error {
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return err
+	}
+	// Check that the template executes on sample data,
+	// so that errors are reported now instead of when posting.
+	sample := &PostData{
+		Project: "project",
+		Issue:   1,
+		Groups: []*PostGroup{{
+			Kind:    docs.KindIssue,
+			Header:  "Related Issues",
+			Results: []*PostResult{{URL: "https://example.com/", Title: "title", Number: 2, Score: 0.9, Explanation: "explanation"}},
+		}},
+		Footer: "\nfooter\n",
+	}
+	if err := tmpl.Execute(new(bytes.Buffer), sample); err != nil {
+		return err
+	}
+	p.templates[project] = tmpl
+	return nil
+}
+
+// template returns the post template for project.
+func (p *Poster) template(project string) *template.Template {
+	if t := p.templates[project]; t != nil {
+		return t
+	}
+	if t := p.templates[""]; t != nil {
+		return t
+	}
+	return defaultTemplate
+}
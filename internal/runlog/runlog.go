@@ -0,0 +1,267 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package runlog records a summary of each cycle of Gaby's main loop:
+// how many GitHub events were synced, documents added, embeddings computed,
+// and comments posted, and how many errors were logged.
+// The summaries are kept in the database, for the admin interface
+// and for simple health checks (see [Healthy]).
+//
+// A [Recorder] counts the GitHub events, documents, and comments
+// using database watchers (see [Recorder.Watch]), so the counts include
+// the work of every Gaby instance sharing the database, with each
+// piece of work counted in the summary of only one instance.
+// It counts embeddings and errors using wrappers around
+// the instance's embedder ([Recorder.Embedder]) and log handler
+// ([Recorder.Handler]).
+package runlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["runlog.Summary", End, Instance] => JSON of Summary
+//
+// End is the end time of the cycle in Unix nanoseconds.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "runlog.Summary", Key: "End, Instance", Val: "JSON of Summary"},
+	)
+}
+
+const (
+	// Retention is how long summaries are kept.
+	Retention = 7 * 24 * time.Hour
+
+	pruneEvery = 100 // delete old summaries after every pruneEvery records
+)
+
+// A Summary summarizes one cycle of the main loop.
+type Summary struct {
+	Instance   string    // Gaby instance that ran the cycle
+	Start      time.Time // start of the cycle
+	End        time.Time // end of the cycle
+	Events     int64     // GitHub events synced (added or updated)
+	Docs       int64     // documents added or updated
+	Embeddings int64     // embeddings computed (not found in the cache)
+	Comments   int64     // GitHub comments posted
+	Errors     int64     // errors logged
+}
+
+// String returns a one-line description of s.
+func (s *Summary) String() string {
+	return fmt.Sprintf("%s %s: %d events, %d docs, %d embeddings, %d comments, %d errors",
+		s.End.UTC().Format(time.RFC3339), s.End.Sub(s.Start).Round(time.Millisecond),
+		s.Events, s.Docs, s.Embeddings, s.Comments, s.Errors)
+}
+
+// A Recorder counts the work done in each cycle
+// and records summaries in a database.
+type Recorder struct {
+	db       storage.DB
+	name     string
+	instance string
+	now      func() time.Time // for testing
+	writes   int              // number of summaries written
+
+	events   *timed.Watcher[*github.Event]
+	docs     *timed.Watcher[*docs.Doc]
+	comments *timed.Watcher[*github.AuditRecord]
+
+	mu         sync.Mutex
+	start      time.Time
+	embeddings int64
+	errors     int64
+}
+
+// New returns a new Recorder storing summaries in db.
+// The name is used for the database watchers (see [Recorder.Watch]).
+// The first summary covers the time since New was called.
+func New(db storage.DB, name string) *Recorder {
+	r := &Recorder{db: db, name: name, now: time.Now}
+	r.start = r.now()
+	return r
+}
+
+// SetInstance sets the name of the Gaby instance
+// recorded in the summaries, such as
+// [rsc.io/gaby/internal/sched.Scheduler.Instance].
+func (r *Recorder) SetInstance(name string) {
+	r.instance = name
+}
+
+// Watch arranges for r to count the events synced by gh,
+// the comments posted using gh (as recorded in its audit log),
+// and the documents added to dc.
+// Only work done after the call to Watch is counted.
+func (r *Recorder) Watch(gh *github.Client, dc *docs.Corpus) {
+	r.events = gh.EventWatcher(r.name)
+	r.comments = gh.AuditWatcher(r.name)
+	r.docs = dc.DocWatcher(r.name)
+	r.events.MarkAllOld()
+	r.comments.MarkAllOld()
+	r.docs.MarkAllOld()
+}
+
+// Record returns a summary of the work done since the previous call
+// to Record (or since r was created), after storing it in the database.
+func (r *Recorder) Record() *Summary {
+	end := r.now()
+	r.mu.Lock()
+	s := &Summary{
+		Instance:   r.instance,
+		Start:      r.start,
+		End:        end,
+		Embeddings: r.embeddings,
+		Errors:     r.errors,
+	}
+	r.start, r.embeddings, r.errors = end, 0, 0
+	r.mu.Unlock()
+
+	if r.events != nil {
+		s.Events = count(r.events, func(e *github.Event) timed.DBTime { return e.DBTime }, nil)
+		s.Docs = count(r.docs, func(d *docs.Doc) timed.DBTime { return d.DBTime }, nil)
+		s.Comments = count(r.comments, func(a *github.AuditRecord) timed.DBTime { return a.DBTime }, func(a *github.AuditRecord) bool {
+			return a.Action == "PostIssueComment" && a.Error == ""
+		})
+	}
+
+	r.db.Set(ordered.Encode("runlog.Summary", s.End.UnixNano(), s.Instance), storage.JSON(s))
+	if r.writes++; r.writes%pruneEvery == 0 {
+		r.prune()
+	}
+	r.db.Flush()
+	return s
+}
+
+// count counts the recent entries in w for which keep returns true
+// (all entries, if keep is nil), marking them old.
+func count[T any](w *timed.Watcher[T], dbtime func(T) timed.DBTime, keep func(T) bool) int64 {
+	n := int64(0)
+	for e := range w.Recent() {
+		if keep == nil || keep(e) {
+			n++
+		}
+		w.MarkOld(dbtime(e))
+	}
+	return n
+}
+
+// prune deletes the summaries older than [Retention].
+func (r *Recorder) prune() {
+	cutoff := r.now().Add(-Retention).UnixNano()
+	r.db.DeleteRange(ordered.Encode("runlog.Summary"), ordered.Encode("runlog.Summary", cutoff))
+}
+
+// Embedder returns an embedder that calls e,
+// counting the embeddings it computes.
+func (r *Recorder) Embedder(e llm.Embedder) llm.Embedder {
+	return &embedder{e, r}
+}
+
+type embedder struct {
+	llm.Embedder
+	r *Recorder
+}
+
+func (e *embedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	vecs, err := e.Embedder.EmbedDocs(ctx, docs)
+	e.r.mu.Lock()
+	e.r.embeddings += int64(len(vecs))
+	e.r.mu.Unlock()
+	return vecs, err
+}
+
+// Handler returns a handler that passes records to h,
+// counting the records at level ERROR or above.
+func (r *Recorder) Handler(h slog.Handler) slog.Handler {
+	return &handler{h, r}
+}
+
+type handler struct {
+	slog.Handler
+	r *Recorder
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelError || h.Handler.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level >= slog.LevelError {
+		h.r.mu.Lock()
+		h.r.errors++
+		h.r.mu.Unlock()
+	}
+	if !h.Handler.Enabled(ctx, rec.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h *handler) WithAttrs(as []slog.Attr) slog.Handler {
+	return &handler{h.Handler.WithAttrs(as), h.r}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h.Handler.WithGroup(name), h.r}
+}
+
+// Summaries returns an iterator over the summaries stored in db
+// of the cycles that ended at or after since, oldest first.
+func Summaries(db storage.DB, since time.Time) iter.Seq[*Summary] {
+	return func(yield func(*Summary) bool) {
+		start := ordered.Encode("runlog.Summary", since.UnixNano())
+		end := ordered.Encode("runlog.Summary", ordered.Inf)
+		for key, val := range db.Scan(start, end) {
+			var s Summary
+			if err := json.Unmarshal(val(), &s); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("runlog summary decode", "key", storage.Fmt(key), "err", err)
+			}
+			if !yield(&s) {
+				return
+			}
+		}
+	}
+}
+
+// Healthy reports whether Gaby appears healthy:
+// whether some instance has recorded a summary in db
+// within the last maxAge (as of now), and the most recent
+// summary of each such instance reports no errors.
+// If not, the error describes the problem.
+func Healthy(db storage.DB, now time.Time, maxAge time.Duration) error {
+	last := make(map[string]*Summary)
+	for s := range Summaries(db, now.Add(-maxAge)) {
+		last[s.Instance] = s
+	}
+	if len(last) == 0 {
+		return fmt.Errorf("no cycles completed in the last %v", maxAge)
+	}
+	for _, name := range slices.Sorted(maps.Keys(last)) {
+		if s := last[name]; s.Errors > 0 {
+			return fmt.Errorf("instance %q: %d errors in the cycle ending %s", s.Instance, s.Errors, s.End.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
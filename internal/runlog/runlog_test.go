@@ -0,0 +1,135 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runlog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+func TestRecord(t *testing.T) {
+	check := testutil.Checker(t)
+	db := storage.MemDB()
+	gh := github.New(testutil.Slogger(t), db, nil, nil)
+	tc := gh.Testing()
+	dc := docs.New(db)
+
+	// Work done before Watch is not counted.
+	tc.AddIssue("rsc/tmp", &github.Issue{Number: 1})
+	dc.Add("doc1", "title", "text")
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	r := New(db, "runlog")
+	r.now = func() time.Time { return now }
+	r.start = now
+	r.SetInstance("inst")
+	r.Watch(gh, dc)
+	lg := slog.New(r.Handler(slog.NewTextHandler(io.Discard, nil)))
+	e := r.Embedder(llm.QuoteEmbedder())
+
+	issue := &github.Issue{Number: 2}
+	tc.AddIssue("rsc/tmp", issue)
+	tc.AddIssue("rsc/tmp", &github.Issue{Number: 3})
+	dc.Add("doc2", "title", "text")
+	_, err := e.EmbedDocs(ctx, []llm.EmbedDoc{{Text: "a"}, {Text: "b"}, {Text: "c"}})
+	check(err)
+	_, err = gh.PostIssueComment(issue, &github.IssueCommentChanges{Body: "hello"})
+	check(err)
+	check(gh.EditIssue(issue, &github.IssueChanges{State: "closed"}))
+	lg.Error("oops")
+	lg.Warn("not an error")
+
+	now = now.Add(time.Minute)
+	s := r.Record()
+	want := Summary{Instance: "inst", Start: start, End: now, Events: 2, Docs: 1, Embeddings: 3, Comments: 1, Errors: 1}
+	if *s != want {
+		t.Errorf("Record() = %+v, want %+v", s, want)
+	}
+	if str := s.String(); !strings.Contains(str, "2 events, 1 docs, 3 embeddings, 1 comments, 1 errors") {
+		t.Errorf("String() = %q", str)
+	}
+
+	// The next summary starts fresh.
+	now = now.Add(time.Minute)
+	s = r.Record()
+	want = Summary{Instance: "inst", Start: start.Add(time.Minute), End: now}
+	if *s != want {
+		t.Errorf("second Record() = %+v, want %+v", s, want)
+	}
+
+	var ends []time.Time
+	for s := range Summaries(db, start.Add(time.Minute)) {
+		ends = append(ends, s.End)
+	}
+	if len(ends) != 2 || !ends[0].Equal(start.Add(time.Minute)) || !ends[1].Equal(now) {
+		t.Errorf("Summaries = %v, want 2 ending at %v, %v", ends, start.Add(time.Minute), now)
+	}
+	for s := range Summaries(db, now.Add(time.Second)) {
+		t.Errorf("Summaries after last = %+v", s)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	db := storage.MemDB()
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	r := New(db, "runlog")
+	r.now = func() time.Time { return now }
+	r.SetInstance("inst")
+	lg := slog.New(r.Handler(slog.NewTextHandler(io.Discard, nil)))
+
+	if err := Healthy(db, now, 10*time.Minute); err == nil || !strings.Contains(err.Error(), "no cycles") {
+		t.Errorf("Healthy before any cycles = %v, want no cycles", err)
+	}
+
+	lg.Error("oops")
+	r.Record()
+	if err := Healthy(db, now, 10*time.Minute); err == nil || !strings.Contains(err.Error(), "1 errors") {
+		t.Errorf("Healthy after errors = %v, want 1 errors", err)
+	}
+
+	now = now.Add(time.Minute)
+	r.Record()
+	if err := Healthy(db, now, 10*time.Minute); err != nil {
+		t.Errorf("Healthy after clean cycle = %v", err)
+	}
+	if err := Healthy(db, now.Add(time.Hour), 10*time.Minute); err == nil {
+		t.Errorf("Healthy an hour later succeeded")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := storage.MemDB()
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	r := New(db, "runlog")
+	r.now = func() time.Time { return now }
+	for range pruneEvery {
+		r.Record()
+		now = now.Add(Retention / pruneEvery * 2)
+	}
+	// The summaries are Retention/50 apart,
+	// so the last 51 are within Retention of the last one.
+	n := 0
+	for range Summaries(db, time.Time{}) {
+		n++
+	}
+	if n != 51 {
+		t.Errorf("after pruning, %d summaries, want 51", n)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package safety checks LLM-generated text before Gaby posts it.
+//
+// A [Filter] decides whether text can be posted without review.
+// This package provides local filters: a deny-list ([Deny]),
+// a length check ([MaxLength]), and a check for leaked credentials ([Leaks]),
+// which can be combined with [All] and with provider safety ratings
+// (see [rsc.io/gaby/internal/gemini.Client.Check]).
+// Posters that publish generated text hold any text a filter rejects
+// for a maintainer's approval instead of posting it.
+package safety
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// A Filter checks text generated by an LLM before it is posted.
+type Filter interface {
+	// Check returns a non-empty reason if text must not be posted
+	// without review, or an error if text cannot be checked.
+	// Callers should treat an error like a rejection.
+	Check(text string) (reason string, err error)
+}
+
+// All returns a Filter that applies each of the filters in turn,
+// returning the first rejection or error.
+func All(filters ...Filter) Filter {
+	return all(filters)
+}
+
+type all []Filter
+
+func (fs all) Check(text string) (string, error) {
+	for _, f := range fs {
+		if reason, err := f.Check(text); reason != "" || err != nil {
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+// Default returns the default filter, which rejects text
+// longer than 10,000 characters or containing apparent credentials.
+func Default() Filter {
+	return All(MaxLength(10000), Leaks())
+}
+
+// MaxLength returns a Filter that rejects text longer than n characters.
+func MaxLength(n int) Filter {
+	return maxLength(n)
+}
+
+type maxLength int
+
+func (n maxLength) Check(text string) (string, error) {
+	if c := utf8.RuneCountInString(text); c > int(n) {
+		return fmt.Sprintf("text too long (%d > %d characters)", c, int(n)), nil
+	}
+	return "", nil
+}
+
+// Deny returns a Filter that rejects text matching any of the patterns.
+func Deny(patterns ...*regexp.Regexp) Filter {
+	return deny(patterns)
+}
+
+type deny []*regexp.Regexp
+
+func (d deny) Check(text string) (string, error) {
+	for _, re := range d {
+		if re.MatchString(text) {
+			return fmt.Sprintf("text matches deny-list pattern %q", re), nil
+		}
+	}
+	return "", nil
+}
+
+// leakPatterns match credentials that must never be posted.
+var leakPatterns = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{"OpenAI API key", regexp.MustCompile(`\bsk-[A-Za-z0-9_\-]{20,}\b`)},
+	{"AWS access key", regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// Leaks returns a Filter that rejects text containing
+// apparent credentials, such as API keys and private keys.
+func Leaks() Filter {
+	return leaks{}
+}
+
+type leaks struct{}
+
+func (leaks) Check(text string) (string, error) {
+	for _, p := range leakPatterns {
+		if p.re.MatchString(text) {
+			return "text contains apparent " + p.name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,455 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sched runs Gaby's periodic tasks, each on its own schedule.
+//
+// Each [Task] runs at its own interval, delayed by a random jitter
+// so that tasks with equal intervals drift apart instead of running
+// in lockstep. A task that fails is retried with exponential backoff
+// (up to [MaxBackoff]) instead of at its usual interval.
+//
+// A [Scheduler] records each task's last and next run in the database,
+// so that a restarted Gaby does not rerun tasks that ran recently,
+// and so that the admin interface can show them (see [Statuses]).
+//
+// Multiple Gaby instances (replicas) can share a database,
+// each running its own Scheduler with the same tasks.
+// Each Scheduler identifies itself with an instance name
+// (see [Scheduler.SetInstance]) and runs a task only while holding
+// that task's lease in the database, so that a task never runs
+// in two instances at once, and since the schedule is recorded
+// in the database, a task that one instance has run is not due
+// in the others either. A lease expires if its instance stops
+// renewing it (see [LeaseTTL]), for example because it crashed,
+// letting another instance take over.
+// Tasks marked [Task.Singleton] run only in the instance that
+// holds the leader lease, for work that should stay in one place.
+//
+// A watchdog notices runs that take much longer than expected
+// (see [Task.StuckAfter]), such as a GitHub sync wedged in a rate-limit
+// sleep or waiting for a database lock. It logs an error and marks
+// the task's status as stuck, so that the admin interface can show it,
+// and, if the task asks, cancels the run's context.
+//
+// Each run of a task is traced as a "sched.run" span
+// (see package [rsc.io/gaby/internal/tracing]);
+// tasks pass the context they are given to the work they do,
+// so that its spans appear as part of the run.
+package sched
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["sched.Status", Name] => JSON of Status
+//	["sched.Lease", Name] => JSON of Lease
+//	["sched.Leader"] => JSON of Lease
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "sched.Status", Key: "Name", Val: "JSON of Status"},
+		storage.Schema{Kind: "sched.Lease", Key: "Name", Val: "JSON of Lease"},
+		storage.Schema{Kind: "sched.Leader", Val: "JSON of Lease"},
+	)
+}
+
+// MaxBackoff is the longest delay before retrying a failed task,
+// unless the task's own interval is longer.
+const MaxBackoff = time.Hour
+
+// LeaseTTL is how long a lease lasts unless renewed.
+// An instance renews the leases it holds every LeaseTTL/4
+// while running a task, and it renews its leader lease
+// on each call to [Scheduler.RunDue].
+const LeaseTTL = 2 * time.Minute
+
+// StuckFactor and MinStuck determine when a run of a task is considered stuck,
+// if the task does not set [Task.StuckAfter]: after StuckFactor times
+// the task's interval, but no sooner than MinStuck.
+const (
+	StuckFactor = 10
+	MinStuck    = 30 * time.Minute
+)
+
+// A Task is a periodic task.
+type Task struct {
+	Name      string                          // unique name, used to record the task's status
+	Interval  time.Duration                   // time from the end of one run to the start of the next
+	Jitter    time.Duration                   // maximum random delay added to Interval
+	Singleton bool                            // run only in the leader instance
+	Run       func(ctx context.Context) error // function to run
+
+	// StuckAfter is how long a run can take before the watchdog
+	// considers it stuck. Zero means the default (see [StuckFactor]).
+	StuckAfter time.Duration
+
+	// CancelStuck asks the watchdog to cancel the context of a stuck run.
+	// The run is then recorded as failed and retried with backoff.
+	CancelStuck bool
+}
+
+// stuckAfter returns how long a run of t can take before it is stuck.
+func (t *Task) stuckAfter() time.Duration {
+	if t.StuckAfter > 0 {
+		return t.StuckAfter
+	}
+	return max(StuckFactor*t.Interval, MinStuck)
+}
+
+// A Lease records which instance holds a task or the leadership.
+type Lease struct {
+	Owner   string    // instance name
+	Expires time.Time // time the lease expires unless renewed
+}
+
+// A Status records the runs of a task.
+type Status struct {
+	Name      string
+	LastStart time.Time // start of the last run; zero if never run
+	LastEnd   time.Time // end of the last run
+	Err       string    // error from the last run, or "" if it succeeded
+	Failures  int       // number of consecutive failed runs
+	Next      time.Time // time of the next run; zero means immediately
+	Instance  string    // instance that ran the task last
+	Stuck     bool      // the run that began at LastStart is stuck (see [Task.StuckAfter])
+}
+
+// A Scheduler runs tasks when they are due.
+type Scheduler struct {
+	slog     *slog.Logger
+	db       storage.DB
+	instance string
+	tasks    []*Task
+	leader   bool                              // holds leader lease
+	ttl      time.Duration                     // lease TTL; for testing
+	now      func() time.Time                  // for testing
+	jitter   func(time.Duration) time.Duration // random duration in [0, d); for testing
+}
+
+// New returns a new Scheduler that logs to lg
+// and records task status in db.
+// Use [Scheduler.SetTasks] to set the tasks it runs.
+// The Scheduler's instance name is [DefaultInstance]()
+// unless changed by [Scheduler.SetInstance].
+func New(lg *slog.Logger, db storage.DB) *Scheduler {
+	return &Scheduler{
+		slog:     lg,
+		db:       db,
+		instance: DefaultInstance(),
+		ttl:      LeaseTTL,
+		now:      time.Now,
+		jitter:   rand.N[time.Duration],
+	}
+}
+
+// DefaultInstance returns a new instance name made from
+// the host name, the process ID, and a random suffix,
+// which is unique even among replicas that share a host name.
+func DefaultInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gaby"
+	}
+	return fmt.Sprintf("%s-%d-%04x", host, os.Getpid(), rand.N(0x10000))
+}
+
+// SetInstance sets the name identifying this instance in leases.
+// Each instance sharing a database must have a different name.
+func (s *Scheduler) SetInstance(name string) {
+	s.instance = name
+}
+
+// Instance returns the Scheduler's instance name.
+func (s *Scheduler) Instance() string {
+	return s.instance
+}
+
+// SetTasks sets the tasks to run, replacing any earlier tasks.
+// A task that has run before (under the same name,
+// even in an earlier Gaby process) keeps its recorded next run time;
+// a new task is due immediately.
+func (s *Scheduler) SetTasks(tasks []*Task) {
+	s.tasks = tasks
+}
+
+// RunDue runs each task that is due, one at a time,
+// in the order passed to [Scheduler.SetTasks],
+// skipping tasks whose leases are held by other instances
+// and, unless this instance is the leader, singleton tasks.
+// It returns the time when the next task will be due.
+// If ctx is canceled, RunDue stops before the next task.
+func (s *Scheduler) RunDue(ctx context.Context) time.Time {
+	s.elect()
+	for _, t := range s.tasks {
+		if ctx.Err() != nil {
+			break
+		}
+		if t.Singleton && !s.leader {
+			continue
+		}
+		if s.status(t.Name).Next.After(s.now()) {
+			continue
+		}
+		key := ordered.Encode("sched.Lease", t.Name)
+		if !s.acquire(key) {
+			s.slog.Debug("sched task leased elsewhere", "task", t.Name)
+			continue
+		}
+		// Reread the status now that we hold the lease:
+		// another instance may have just run the task.
+		if st := s.status(t.Name); !st.Next.After(s.now()) {
+			s.run(ctx, t, st, key)
+		}
+		s.release(key)
+	}
+	return s.next()
+}
+
+// elect acquires or renews the leader lease,
+// if any task is a singleton.
+func (s *Scheduler) elect() {
+	for _, t := range s.tasks {
+		if t.Singleton {
+			leader := s.acquire(ordered.Encode("sched.Leader"))
+			if leader != s.leader {
+				s.slog.Info("sched leader", "instance", s.instance, "leader", leader)
+			}
+			s.leader = leader
+			return
+		}
+	}
+}
+
+// Leader reports whether this instance is the leader,
+// as of the last call to [Scheduler.RunDue].
+func (s *Scheduler) Leader() bool {
+	return s.leader
+}
+
+// Resign releases the leader lease, if held,
+// so that another instance can take over immediately.
+// It is meant to be called when the instance shuts down.
+func (s *Scheduler) Resign() {
+	if s.leader {
+		s.release(ordered.Encode("sched.Leader"))
+		s.leader = false
+	}
+}
+
+// acquire acquires or renews the lease with the given key,
+// reporting whether it succeeded: that is, whether the lease
+// was free, expired, or already held by this instance.
+func (s *Scheduler) acquire(key []byte) bool {
+	lock := string(key)
+	s.db.Lock(lock)
+	defer s.db.Unlock(lock)
+
+	now := s.now()
+	if l, ok := s.lease(key); ok && l.Owner != s.instance && l.Expires.After(now) {
+		return false
+	}
+	s.db.Set(key, storage.JSON(&Lease{Owner: s.instance, Expires: now.Add(s.ttl)}))
+	s.db.Flush()
+	return true
+}
+
+// release releases the lease with the given key, if held by this instance.
+func (s *Scheduler) release(key []byte) {
+	lock := string(key)
+	s.db.Lock(lock)
+	defer s.db.Unlock(lock)
+
+	if l, ok := s.lease(key); ok && l.Owner == s.instance {
+		s.db.Delete(key)
+		s.db.Flush()
+	}
+}
+
+// lease returns the lease with the given key.
+func (s *Scheduler) lease(key []byte) (*Lease, bool) {
+	val, ok := s.db.Get(key)
+	if !ok {
+		return nil, false
+	}
+	l := new(Lease)
+	if err := json.Unmarshal(val, l); err != nil {
+		// unreachable unless corrupt storage
+		s.db.Panic("sched lease decode", "key", storage.Fmt(key), "err", err)
+	}
+	return l, true
+}
+
+// renew renews the task lease with the given key (and the leader lease,
+// if held) every LeaseTTL/4 until ctx is done.
+// If the task lease has been lost to another instance,
+// renew logs an error and calls lost.
+// If the run that began at start lasts longer than stuckAfter,
+// renew calls stuck, once.
+func (s *Scheduler) renew(ctx context.Context, key []byte, start time.Time, stuckAfter time.Duration, lost, stuck func()) {
+	tick := time.NewTicker(s.ttl / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if s.leader {
+			s.leader = s.acquire(ordered.Encode("sched.Leader"))
+		}
+		if !s.acquire(key) {
+			s.slog.Error("sched lease lost", "key", storage.Fmt(key), "instance", s.instance)
+			lost()
+			return
+		}
+		if stuck != nil && s.now().Sub(start) > stuckAfter {
+			stuck()
+			stuck = nil
+		}
+	}
+}
+
+// run runs the task t, whose lease (with the given key) is held,
+// updating and recording its status st.
+// If the lease is lost while the task is running,
+// run cancels the task and records nothing.
+// If the task is stuck, run records that in its status
+// and, if t.CancelStuck is set, cancels the task.
+func (s *Scheduler) run(ctx context.Context, t *Task, st *Status, key []byte) {
+	tctx, span := tracing.Start(ctx, "sched.run",
+		attribute.String("task", t.Name),
+		attribute.String("instance", s.instance))
+	s.slog.DebugContext(tctx, "sched run", "task", t.Name)
+	st.LastStart = s.now()
+	st.Instance = s.instance
+	tctx, cancel := context.WithCancel(tctx)
+	renewed := make(chan struct{})
+	lost, stuck := false, false
+	go func() {
+		defer close(renewed)
+		s.renew(tctx, key, st.LastStart, t.stuckAfter(), func() {
+			lost = true
+			cancel()
+		}, func() {
+			stuck = true
+			s.slog.ErrorContext(tctx, "sched task stuck", "task", t.Name, "instance", s.instance,
+				"start", st.LastStart, "running", s.now().Sub(st.LastStart), "cancel", t.CancelStuck)
+			st.Stuck = true
+			s.db.Set(ordered.Encode("sched.Status", t.Name), storage.JSON(st))
+			s.db.Flush()
+			if t.CancelStuck {
+				cancel()
+			}
+		})
+	}()
+	err := t.Run(tctx)
+	cancel()
+	<-renewed
+	st.LastEnd = s.now()
+	st.Stuck = false
+	if stuck {
+		span.SetAttributes(attribute.Bool("stuck", true))
+		if t.CancelStuck && err != nil {
+			err = fmt.Errorf("canceled stuck task after %v: %w", st.LastEnd.Sub(st.LastStart).Round(time.Second), err)
+		}
+	}
+	if lost {
+		span.SetAttributes(attribute.Bool("lost", true))
+	}
+	tracing.End(span, err)
+	if lost {
+		return
+	}
+
+	delay := t.Interval
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Interrupted; run again as soon as possible.
+		st.Err = err.Error()
+		delay = 0
+	case err != nil:
+		st.Err = err.Error()
+		st.Failures++
+		delay = backoff(t.Interval, st.Failures)
+		s.slog.ErrorContext(tctx, "sched task failed", "task", t.Name, "failures", st.Failures, "retry", delay, "err", err)
+	default:
+		st.Err = ""
+		st.Failures = 0
+	}
+	if delay > 0 && t.Jitter > 0 {
+		delay += s.jitter(t.Jitter)
+	}
+	st.Next = st.LastEnd.Add(delay)
+	s.db.Set(ordered.Encode("sched.Status", t.Name), storage.JSON(st))
+	s.db.Flush()
+}
+
+// backoff returns the delay before retrying a task with the given interval
+// after the given number of consecutive failures: the interval,
+// doubled for each failure after the first,
+// but no more than the larger of the interval and [MaxBackoff].
+func backoff(interval time.Duration, failures int) time.Duration {
+	limit := max(interval, MaxBackoff)
+	d := interval
+	for range failures - 1 {
+		if d >= limit/2 {
+			return limit
+		}
+		d *= 2
+	}
+	return d
+}
+
+// next returns the earliest next run time of the tasks,
+// or the zero time if there are no tasks.
+func (s *Scheduler) next() time.Time {
+	var next time.Time
+	for i, t := range s.tasks {
+		if n := s.status(t.Name).Next; i == 0 || n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// status returns the recorded status of the named task.
+func (s *Scheduler) status(name string) *Status {
+	key := ordered.Encode("sched.Status", name)
+	st := &Status{Name: name}
+	if val, ok := s.db.Get(key); ok {
+		if err := json.Unmarshal(val, st); err != nil {
+			// unreachable unless corrupt storage
+			s.db.Panic("sched status decode", "key", storage.Fmt(key), "err", err)
+		}
+	}
+	return st
+}
+
+// Statuses returns the recorded status of every task
+// that has ever run, ordered by name.
+func Statuses(db storage.DB) []*Status {
+	var list []*Status
+	for key, val := range db.Scan(ordered.Encode("sched.Status"), ordered.Encode("sched.Status", ordered.Inf)) {
+		st := new(Status)
+		if err := json.Unmarshal(val(), st); err != nil {
+			// unreachable unless corrupt storage
+			db.Panic("sched status decode", "key", storage.Fmt(key), "err", err)
+		}
+		list = append(list, st)
+	}
+	return list
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sched
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
+)
+
+var ctx = context.Background()
+
+func TestRunDue(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	s := New(lg, db)
+	s.now = func() time.Time { return now }
+	s.jitter = func(d time.Duration) time.Duration { return d / 2 }
+
+	var ran []string
+	var fail error
+	task := func(name string, interval, jitter time.Duration) *Task {
+		return &Task{
+			Name:     name,
+			Interval: interval,
+			Jitter:   jitter,
+			Run: func(context.Context) error {
+				ran = append(ran, name)
+				if name == "b" {
+					return fail
+				}
+				return nil
+			},
+		}
+	}
+	s.SetTasks([]*Task{
+		task("a", 2*time.Minute, 0),
+		task("b", 10*time.Minute, 0),
+		task("c", 5*time.Minute, 2*time.Minute),
+	})
+
+	step := func(d time.Duration, want ...string) time.Time {
+		t.Helper()
+		now = now.Add(d)
+		ran = nil
+		next := s.RunDue(ctx)
+		if !slices.Equal(ran, want) {
+			t.Errorf("at +%v: ran %v, want %v", now.Sub(start), ran, want)
+		}
+		return next
+	}
+
+	// All tasks are due at first.
+	if next := step(0, "a", "b", "c"); !next.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("next = %v, want +2m", next.Sub(start))
+	}
+	step(time.Minute)
+	step(time.Minute, "a")
+	step(2*time.Minute, "a")
+	step(2*time.Minute, "a", "c") // c: 5m interval + 1m jitter
+
+	// A failing task backs off: 10m, 20m, 40m, then MaxBackoff.
+	fail = errors.New("oops")
+	step(4*time.Minute, "a", "b")
+	for _, d := range []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour} {
+		step(d-time.Second, "a", "c")
+		b := Statuses(db)[1]
+		if !b.Next.Equal(now.Add(time.Second)) {
+			t.Fatalf("b.Next = +%v, want +%v", b.Next.Sub(start), now.Add(time.Second).Sub(start))
+		}
+		step(time.Second, "b")
+	}
+	if b := Statuses(db)[1]; b.Name != "b" || b.Err != "oops" || b.Failures != 6 {
+		t.Errorf("b status = %+v, want 6 failures with oops", b)
+	}
+
+	// Success resets the backoff.
+	fail = nil
+	step(time.Hour, "a", "b", "c")
+	if b := Statuses(db)[1]; b.Err != "" || b.Failures != 0 || !b.Next.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("b status after success = %+v", b)
+	}
+
+	// A new Scheduler picks up the recorded schedule.
+	s2 := New(lg, db)
+	s2.now = s.now
+	s2.SetTasks(s.tasks)
+	ran = nil
+	s2.RunDue(ctx)
+	if len(ran) != 0 {
+		t.Errorf("new Scheduler ran %v, want nothing", ran)
+	}
+}
+
+func TestRunDueCanceled(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db)
+
+	canceled, cancel := context.WithCancel(ctx)
+	var ran []string
+	s.SetTasks([]*Task{
+		{Name: "a", Interval: time.Minute, Run: func(ctx context.Context) error {
+			ran = append(ran, "a")
+			cancel()
+			return ctx.Err()
+		}},
+		{Name: "b", Interval: time.Minute, Run: func(ctx context.Context) error {
+			ran = append(ran, "b")
+			return nil
+		}},
+	})
+	s.RunDue(canceled)
+	if !slices.Equal(ran, []string{"a"}) {
+		t.Errorf("ran %v, want [a]", ran)
+	}
+	// An interrupted task is not a failure and is due again immediately.
+	st := Statuses(db)
+	if len(st) != 1 || st[0].Failures != 0 || st[0].Next.After(st[0].LastEnd) {
+		t.Errorf("status after cancel = %+v", st[0])
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{2 * time.Minute, 1, 2 * time.Minute},
+		{2 * time.Minute, 2, 4 * time.Minute},
+		{2 * time.Minute, 5, 32 * time.Minute},
+		{2 * time.Minute, 6, time.Hour},
+		{2 * time.Minute, 100, time.Hour},
+		{2 * time.Hour, 3, 2 * time.Hour},
+	} {
+		if d := backoff(tt.interval, tt.failures); d != tt.want {
+			t.Errorf("backoff(%v, %d) = %v, want %v", tt.interval, tt.failures, d, tt.want)
+		}
+	}
+}
+
+func TestLeases(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var s1, s2 *Scheduler
+	var ran []string
+	nested := true
+	task := func(name string, singleton bool) *Task {
+		return &Task{Name: name, Interval: time.Minute, Singleton: singleton, Run: func(context.Context) error {
+			ran = append(ran, name)
+			if name == "a" && nested {
+				// Another instance running meanwhile must not run a.
+				nested = false
+				s2.RunDue(ctx)
+			}
+			return nil
+		}}
+	}
+	tasks := []*Task{task("a", false), task("b", false), task("c", true)}
+	for i, s := range []**Scheduler{&s1, &s2} {
+		*s = New(lg, db)
+		(*s).SetInstance([]string{"one", "two"}[i])
+		(*s).now = func() time.Time { return now }
+		(*s).SetTasks(tasks)
+	}
+
+	// b is leased by a third instance.
+	db.Set(ordered.Encode("sched.Lease", "b"), storage.JSON(&Lease{Owner: "three", Expires: now.Add(time.Minute)}))
+
+	// s1 becomes the leader and runs a and c;
+	// s2, running during a, runs nothing.
+	s1.RunDue(ctx)
+	if want := []string{"a", "c"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if !s1.Leader() || s2.Leader() {
+		t.Errorf("Leader() = %v, %v, want true, false", s1.Leader(), s2.Leader())
+	}
+	for _, st := range Statuses(db) {
+		if st.Instance != "one" {
+			t.Errorf("%s ran in %q, want one", st.Name, st.Instance)
+		}
+	}
+
+	// Once b's lease expires, it runs.
+	now = now.Add(2 * time.Minute)
+	ran = nil
+	s1.RunDue(ctx)
+	if want := []string{"a", "b", "c"}; !slices.Equal(ran, want) {
+		t.Errorf("after expiry: ran %v, want %v", ran, want)
+	}
+
+	// When s1 resigns, s2 takes over the singleton c.
+	s1.Resign()
+	now = now.Add(time.Minute)
+	ran = nil
+	s2.RunDue(ctx)
+	if want := []string{"a", "b", "c"}; !s2.Leader() || !slices.Equal(ran, want) {
+		t.Errorf("after resignation: leader %v, ran %v, want true, %v", s2.Leader(), ran, want)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db)
+	s.ttl = 40 * time.Millisecond
+	s.SetTasks([]*Task{{Name: "a", Interval: time.Minute, Run: func(ctx context.Context) error {
+		// Another instance takes the lease.
+		db.Set(ordered.Encode("sched.Lease", "a"), storage.JSON(&Lease{Owner: "other", Expires: time.Now().Add(time.Hour)}))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("not canceled")
+		}
+	}}})
+	s.RunDue(ctx)
+	if st := Statuses(db); len(st) != 0 {
+		t.Errorf("task that lost its lease recorded status %+v", st[0])
+	}
+	if l, _ := s.lease(ordered.Encode("sched.Lease", "a")); l.Owner != "other" {
+		t.Errorf("lease owner = %q, want other", l.Owner)
+	}
+}
+
+func TestStuck(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db)
+	s.ttl = 40 * time.Millisecond
+	sawStuck := false
+	s.SetTasks([]*Task{{Name: "a", Interval: time.Minute, StuckAfter: 20 * time.Millisecond, Run: func(ctx context.Context) error {
+		// Wait for the watchdog to record the run as stuck.
+		for range 500 {
+			if st := Statuses(db); len(st) == 1 && st[0].Stuck {
+				sawStuck = true
+				return nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return errors.New("not stuck")
+	}}})
+	s.RunDue(ctx)
+	if !sawStuck {
+		t.Fatalf("task was never recorded as stuck")
+	}
+	st := Statuses(db)
+	if len(st) != 1 || st[0].Stuck || st[0].Err != "" {
+		t.Errorf("after run, status = %+v, want not stuck, no error", st)
+	}
+}
+
+func TestCancelStuck(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db)
+	s.ttl = 40 * time.Millisecond
+	s.SetTasks([]*Task{{Name: "a", Interval: time.Minute, StuckAfter: 20 * time.Millisecond, CancelStuck: true, Run: func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("not canceled")
+		}
+	}}})
+	s.RunDue(ctx)
+	st := Statuses(db)
+	if len(st) != 1 || st[0].Stuck || !strings.Contains(st[0].Err, "canceled stuck task") || st[0].Failures != 1 {
+		t.Errorf("after canceled run, status = %+v, want canceled stuck task failure", st)
+	}
+}
+
+func TestStuckAfter(t *testing.T) {
+	for _, tt := range []struct {
+		task Task
+		want time.Duration
+	}{
+		{Task{Interval: time.Minute}, MinStuck},
+		{Task{Interval: time.Hour}, StuckFactor * time.Hour},
+		{Task{Interval: time.Hour, StuckAfter: time.Minute}, time.Minute},
+	} {
+		if got := tt.task.stuckAfter(); got != tt.want {
+			t.Errorf("Task{Interval: %v, StuckAfter: %v}.stuckAfter() = %v, want %v", tt.task.Interval, tt.task.StuckAfter, got, tt.want)
+		}
+	}
+}
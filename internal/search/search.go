@@ -0,0 +1,260 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package search implements searching Gaby's vector index of documents,
+// so that maintainers can use the index directly while triaging,
+// not just through comments posted by the related-issue poster.
+//
+// [Query] runs a single search.
+// A [Server] serves an HTML search page and a JSON API:
+//
+//	GET /search?q=query&project=golang/go&kind=issue&limit=20
+//	GET /api/search?q=query&project=golang/go&kind=issue&limit=20
+//
+// The JSON API responds with a JSON array of [Result].
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+)
+
+const (
+	DefaultLimit = 20  // default number of results
+	MaxLimit     = 100 // maximum number of results
+)
+
+// Options are options for a search.
+// The zero Options search all documents for [DefaultLimit] results.
+type Options struct {
+	Project  string  // only documents from this GitHub project ("golang/go"); "" for all
+	Kind     string  // only documents of this kind (such as [docs.KindIssue]); "" for all
+	Limit    int     // maximum number of results; 0 means [DefaultLimit]
+	MinScore float64 // minimum similarity score
+}
+
+// A Result is a single search result.
+type Result struct {
+	ID    string  // document ID, usually its URL
+	Title string  // document title
+	Kind  string  // document kind (such as [docs.KindIssue])
+	Score float64 // similarity score
+}
+
+// Query embeds the query text using emb, searches vdb for similar documents,
+// and returns the results permitted by opts, in decreasing score order.
+// Documents are looked up in dc to find their titles and kinds.
+// The context is passed to emb, so that canceling it abandons the query.
+func Query(ctx context.Context, vdb storage.VectorDB, dc *docs.Corpus, emb llm.Embedder, query string, opts *Options) ([]*Result, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+	if strings.TrimSpace(query) == "" {
+		return nil, errors.New("empty query")
+	}
+
+	vecs, err := emb.EmbedDocs(ctx, []llm.EmbedDoc{{Title: "", Text: query}})
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != 1 {
+		// unreachable unless embedder is broken
+		return nil, fmt.Errorf("embedder returned %d vectors for 1 document", len(vecs))
+	}
+
+	// Leave room for results removed by the filters.
+	n := limit
+	if opts.Project != "" || opts.Kind != "" {
+		n *= 10
+	}
+	var out []*Result
+	for _, r := range vdb.Search(vecs[0], n) {
+		if len(out) >= limit || r.Score < opts.MinScore {
+			break
+		}
+		if opts.Project != "" && githubRepo(r.ID) != opts.Project {
+			continue
+		}
+		res := &Result{ID: r.ID, Score: r.Score, Kind: docs.KindIssue}
+		if d, ok := dc.Get(r.ID); ok {
+			res.Title = d.Title
+			if d.Kind != "" {
+				res.Kind = d.Kind
+			}
+		}
+		if opts.Kind != "" && res.Kind != opts.Kind {
+			continue
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// githubRepo returns the GitHub repo ("owner/repo") of the document
+// with the given URL, or "" if the document is not from GitHub.
+func githubRepo(url string) string {
+	rest, ok := strings.CutPrefix(url, "https://github.com/")
+	if !ok {
+		return ""
+	}
+	owner, rest, _ := strings.Cut(rest, "/")
+	repo, _, _ := strings.Cut(rest, "/")
+	if owner == "" || repo == "" {
+		return ""
+	}
+	return owner + "/" + repo
+}
+
+// A Server serves the search page and JSON API.
+type Server struct {
+	slog *slog.Logger
+	vdb  storage.VectorDB
+	docs *docs.Corpus
+	emb  llm.Embedder
+	mux  *http.ServeMux
+}
+
+// NewServer returns a new Server searching vdb,
+// using emb to embed queries and dc to look up results.
+func NewServer(lg *slog.Logger, vdb storage.VectorDB, dc *docs.Corpus, emb llm.Embedder) *Server {
+	s := &Server{slog: lg, vdb: vdb, docs: dc, emb: emb}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /search", s.page)
+	s.mux.HandleFunc("GET /api/search", s.api)
+	return s
+}
+
+// ServeHTTP serves /search and /api/search.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// parse parses the search form in r,
+// returning the query and options.
+func parse(r *http.Request) (query string, opts *Options, err error) {
+	opts = &Options{
+		Project: r.FormValue("project"),
+		Kind:    r.FormValue("kind"),
+	}
+	if l := r.FormValue("limit"); l != "" {
+		opts.Limit, err = strconv.Atoi(l)
+		if err != nil || opts.Limit < 0 {
+			return "", nil, fmt.Errorf("invalid limit %q", l)
+		}
+	}
+	if m := r.FormValue("minscore"); m != "" {
+		opts.MinScore, err = strconv.ParseFloat(m, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid minscore %q", m)
+		}
+	}
+	return r.FormValue("q"), opts, nil
+}
+
+// api serves the JSON API.
+func (s *Server) api(w http.ResponseWriter, r *http.Request) {
+	query, opts, err := parse(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := Query(r.Context(), s.vdb, s.docs, s.emb, query, opts)
+	if err != nil {
+		s.slog.Error("search", "query", query, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if results == nil {
+		results = []*Result{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	js, err := json.MarshalIndent(results, "", "\t")
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+	w.Write(append(js, '\n'))
+}
+
+// page serves the HTML search page.
+func (s *Server) page(w http.ResponseWriter, r *http.Request) {
+	query, opts, err := parse(r)
+	data := struct {
+		Query   string
+		Options *Options
+		Kinds   []string
+		Results []*Result
+		Error   string
+	}{
+		Query:   query,
+		Options: opts,
+		Kinds:   []string{docs.KindIssue, docs.KindCL, docs.KindDoc},
+	}
+	if err == nil && query != "" {
+		data.Results, err = Query(r.Context(), s.vdb, s.docs, s.emb, query, opts)
+		if err != nil {
+			s.slog.Error("search", "query", query, "err", err)
+		}
+	}
+	if err != nil {
+		data.Error = err.Error()
+		data.Options = new(Options)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, &data); err != nil {
+		s.slog.Error("search page template", "err", err)
+	}
+}
+
+var pageTemplate = template.Must(template.New("search").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Gaby Search{{if .Query}}: {{.Query}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+td, th { padding: 0.2em 0.5em; text-align: left; }
+.error { color: #a00; }
+</style>
+</head>
+<body>
+<h1>Gaby Search</h1>
+<form method="get" action="/search">
+<input name="q" size="60" value="{{.Query}}" autofocus>
+project <input name="project" size="15" value="{{.Options.Project}}" placeholder="any">
+kind <select name="kind">
+<option value="">any</option>
+{{$kind := .Options.Kind}}
+{{range .Kinds}}<option{{if eq . $kind}} selected{{end}}>{{.}}</option>{{end}}
+</select>
+<input type="submit" value="Search">
+</form>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{if .Results}}
+<table>
+<tr><th>Score</th><th>Kind</th><th>Document</th></tr>
+{{range .Results}}
+<tr><td>{{printf "%.5f" .Score}}</td><td>{{.Kind}}</td><td><a href="{{.ID}}">{{or .Title .ID}}</a><br><small>{{.ID}}</small></td></tr>
+{{end}}
+</table>
+{{else if .Query}}{{if not .Error}}<p>No results.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,151 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+var testDocs = []struct {
+	id, kind, title string
+}{
+	{"https://github.com/golang/go/issues/1", docs.KindIssue, "net/http: server timeout too short"},
+	{"https://github.com/golang/go/issues/2", docs.KindIssue, "cmd/go: module cache corrupted"},
+	{"https://github.com/golang/go/issues/3", "", "net/http: client timeout ignored"},
+	{"https://github.com/golang/tools/issues/4", docs.KindIssue, "gopls: http timeout in tests"},
+	{"https://go-review.googlesource.com/c/go/+/5", docs.KindCL, "net/http: fix server timeout"},
+	{"https://go.dev/doc/6", docs.KindDoc, "Writing HTTP servers with timeouts"},
+}
+
+func testIndex(t *testing.T) (storage.VectorDB, *docs.Corpus, llm.Embedder) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	vdb := storage.MemVectorDB(db, lg, "")
+	dc := docs.New(db)
+	emb := llm.BagOfWordsEmbedder(64)
+	for _, d := range testDocs {
+		dc.AddKind(d.id, d.kind, d.title, "")
+		vecs, err := emb.EmbedDocs(ctx, []llm.EmbedDoc{{Title: d.title}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vdb.Set(d.id, vecs[0])
+	}
+	return vdb, dc, emb
+}
+
+func ids(results []*Result) string {
+	var list []string
+	for _, r := range results {
+		list = append(list, r.ID[strings.LastIndex(r.ID, "/")+1:])
+	}
+	return strings.Join(list, " ")
+}
+
+func TestQuery(t *testing.T) {
+	vdb, dc, emb := testIndex(t)
+
+	results, err := Query(ctx, vdb, dc, emb, "net/http server timeout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(testDocs) {
+		t.Fatalf("Query returned %d results, want %d", len(results), len(testDocs))
+	}
+	if r := results[0]; r.ID != testDocs[4].id || r.Title != testDocs[4].title || r.Kind != docs.KindCL {
+		t.Errorf("top result = %+v, want CL 5", r)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Errorf("results not sorted by score: %v", ids(results))
+		}
+	}
+
+	var tests = []struct {
+		opts *Options
+		want string
+	}{
+		{&Options{Limit: 2}, "5 1"},
+		{&Options{Project: "golang/tools"}, "4"},
+		{&Options{Kind: docs.KindCL}, "5"},
+		{&Options{Kind: docs.KindIssue, Project: "golang/go", Limit: 2}, "1 3"}, // 3 has no kind, so is assumed an issue
+		{&Options{MinScore: 2}, ""},
+	}
+	for _, tt := range tests {
+		results, err := Query(ctx, vdb, dc, emb, "net/http server timeout", tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(results); got != tt.want {
+			t.Errorf("Query(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	if _, err := Query(ctx, vdb, dc, emb, "  ", nil); err == nil {
+		t.Errorf("Query of empty query succeeded")
+	}
+}
+
+func TestServer(t *testing.T) {
+	vdb, dc, emb := testIndex(t)
+	s := NewServer(testutil.Slogger(t), vdb, dc, emb)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	w := get("/api/search?q=net/http+server+timeout&kind=cl")
+	if w.Code != http.StatusOK {
+		t.Fatalf("api: code %d\n%s", w.Code, w.Body)
+	}
+	var results []*Result
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(results); got != "5" {
+		t.Errorf("api results = %q, want %q", got, "5")
+	}
+
+	if w := get("/api/search?q=timeout&limit=x"); w.Code != http.StatusBadRequest {
+		t.Errorf("api with bad limit: code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := get("/api/search?q=zzzz&project=rsc/none"); w.Body.String() != "[]\n" {
+		t.Errorf("api with no results = %q, want []", w.Body)
+	}
+
+	body := get("/search?q=net/http+server+timeout&project=golang/go").Body.String()
+	for _, want := range []string{
+		`value="net/http server timeout"`,
+		`<a href="https://github.com/golang/go/issues/1">net/http: server timeout too short</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("search page missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "golang/tools") {
+		t.Errorf("search page shows result outside project:\n%s", body)
+	}
+
+	if body := get("/search").Body.String(); strings.Contains(body, "No results") || strings.Contains(body, `class="error"`) {
+		t.Errorf("empty search page shows results or error:\n%s", body)
+	}
+	if body := get("/search?q=timeout&limit=-1").Body.String(); !strings.Contains(body, `invalid limit`) {
+		t.Errorf("search page with bad limit missing error:\n%s", body)
+	}
+}
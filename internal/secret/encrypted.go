@@ -0,0 +1,164 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted secret file consists of encMagic, a random salt,
+// a random nonce, and the AES-256-GCM encryption of the JSON map
+// of secrets, using the key derived from the passphrase and salt
+// by scrypt with the parameters below.
+// The nonce is regenerated each time the file is written.
+const (
+	encMagic  = "gaby encrypted secrets v1\n"
+	saltSize  = 16
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	keySize   = 32
+	nonceSize = 12
+)
+
+// An EncryptedFile is a read-write [DB] stored in a file
+// encrypted with a passphrase.
+// Unlike [Netrc] and [File], an EncryptedFile supports [EncryptedFile.Set],
+// so that Gaby can store secrets it provisions itself,
+// such as GitHub App installation tokens.
+// It is safe for concurrent use by multiple goroutines.
+type EncryptedFile struct {
+	file string
+	salt []byte
+	aead cipher.AEAD
+
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+// OpenEncrypted opens the encrypted secret file with the given passphrase.
+// If the file does not exist, OpenEncrypted returns an empty database,
+// and the first call to [EncryptedFile.Set] creates the file.
+// OpenEncrypted returns an error if the file cannot be decrypted,
+// usually because the passphrase is wrong.
+func OpenEncrypted(file, passphrase string) (*EncryptedFile, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("%s: empty passphrase", file)
+	}
+	e := &EncryptedFile{file: file, secrets: make(map[string]string)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		e.salt = make([]byte, saltSize)
+		rand.Read(e.salt)
+		if err := e.init(passphrase); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rest, ok := bytes.CutPrefix(data, []byte(encMagic))
+	if !ok || len(rest) < saltSize+nonceSize {
+		return nil, fmt.Errorf("%s: not an encrypted secret file", file)
+	}
+	e.salt = rest[:saltSize]
+	if err := e.init(passphrase); err != nil {
+		return nil, err
+	}
+	nonce, ciphertext := rest[saltSize:saltSize+nonceSize], rest[saltSize+nonceSize:]
+	plain, err := e.aead.Open(nil, nonce, ciphertext, []byte(encMagic))
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot decrypt (wrong passphrase?)", file)
+	}
+	if err := json.Unmarshal(plain, &e.secrets); err != nil {
+		return nil, fmt.Errorf("%s: corrupt secrets: %v", file, err)
+	}
+	return e, nil
+}
+
+// init initializes e.aead from the passphrase and e.salt.
+func (e *EncryptedFile) init(passphrase string) error {
+	key, err := scrypt.Key([]byte(passphrase), e.salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		// unreachable unless scrypt parameters are invalid
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// unreachable: key is 32 bytes
+		return err
+	}
+	e.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// Get returns the named secret.
+func (e *EncryptedFile) Get(name string) (secret string, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	secret, ok = e.secrets[name]
+	return
+}
+
+// Set sets the named secret and rewrites the file.
+// Set panics if the file cannot be written,
+// since [DB] provides no way to report the error.
+func (e *EncryptedFile) Set(name, secret string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.secrets[name] = secret
+	if err := e.write(); err != nil {
+		panic(fmt.Sprintf("secret.EncryptedFile.Set: %v", err))
+	}
+}
+
+// write writes the secrets to the file.
+// It writes a temporary file and renames it into place,
+// so that the file is never left partially written.
+// e.mu must be held.
+func (e *EncryptedFile) write() error {
+	plain, err := json.Marshal(e.secrets)
+	if err != nil {
+		// unreachable
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	var buf bytes.Buffer
+	buf.WriteString(encMagic)
+	buf.Write(e.salt)
+	buf.Write(nonce)
+	buf.Write(e.aead.Seal(nil, nonce, plain, []byte(encMagic)))
+
+	f, err := os.CreateTemp(filepath.Dir(e.file), filepath.Base(e.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err1 := f.Write(buf.Bytes())
+	err2 := f.Close()
+	if err := errors.Join(err1, err2); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), e.file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncrypted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secrets")
+
+	db, err := OpenEncrypted(file, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := db.Get("missing"); secret != "" || ok != false {
+		t.Errorf("Get(missing) = %q, %v, want %q, %v", secret, ok, "", false)
+	}
+	db.Set("api.github.com", "u:token1")
+	db.Set("api.github.com", "u:token2")
+	db.Set("ai.google.dev", "AIzakey")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), encMagic) || strings.Contains(string(data), "token") {
+		t.Fatalf("file not encrypted:\n%q", data)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("file mode = %v, want private", perm)
+	}
+
+	db, err = OpenEncrypted(file, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := db.Get("api.github.com"); secret != "u:token2" || ok != true {
+		t.Errorf("Get(api.github.com) = %q, %v, want %q, %v", secret, ok, "u:token2", true)
+	}
+	if secret, ok := db.Get("ai.google.dev"); secret != "AIzakey" || ok != true {
+		t.Errorf("Get(ai.google.dev) = %q, %v, want %q, %v", secret, ok, "AIzakey", true)
+	}
+
+	if _, err := OpenEncrypted(file, "wrong"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("OpenEncrypted with wrong passphrase: err = %v", err)
+	}
+	if _, err := OpenEncrypted(file, ""); err == nil {
+		t.Errorf("OpenEncrypted with empty passphrase succeeded")
+	}
+	if err := os.WriteFile(file, []byte("plain text"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenEncrypted(file, "passphrase"); err == nil || !strings.Contains(err.Error(), "not an encrypted secret file") {
+		t.Errorf("OpenEncrypted of plain file: err = %v", err)
+	}
+}
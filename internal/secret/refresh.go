@@ -0,0 +1,144 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A Subscriber is a [DB] that can notify clients when secrets change.
+// Long-lived clients that keep a copy of a secret, such as an API key,
+// should check whether their DB implements Subscriber
+// and, if so, subscribe to updates.
+type Subscriber interface {
+	DB
+
+	// Subscribe arranges for f to be called with the new value
+	// of the named secret each time it changes.
+	Subscribe(name string, f func(secret string))
+}
+
+// A Refreshing is a [DB] that periodically reloads its secrets,
+// so that rotated secrets take effect without restarting the program.
+// It implements [Subscriber].
+type Refreshing struct {
+	slog *slog.Logger
+	ttl  time.Duration
+	load func() (DB, error)
+	now  func() time.Time // for testing
+
+	mu     sync.Mutex
+	db     DB
+	loaded time.Time
+	subs   map[string][]func(string)
+	last   map[string]string // last value of subscribed secrets
+}
+
+// Refresh returns a Refreshing that serves secrets from the DB
+// returned by load, calling load again to pick up changes
+// when the previous result is more than ttl old.
+// Refresh calls load once immediately, returning any error.
+// A later load error is logged, and the previous DB is kept
+// until the next attempt, ttl later.
+//
+// Reloading happens during [Refreshing.Get] and [Refreshing.Check].
+// A long-running program with subscribers should call Check periodically.
+func Refresh(lg *slog.Logger, ttl time.Duration, load func() (DB, error)) (*Refreshing, error) {
+	db, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &Refreshing{
+		slog:   lg,
+		ttl:    ttl,
+		load:   load,
+		now:    time.Now,
+		db:     db,
+		loaded: time.Now(),
+		subs:   make(map[string][]func(string)),
+		last:   make(map[string]string),
+	}, nil
+}
+
+// Get returns the named secret, reloading the secrets first if needed.
+func (r *Refreshing) Get(name string) (secret string, ok bool) {
+	r.Check()
+	r.mu.Lock()
+	db := r.db
+	r.mu.Unlock()
+	return db.Get(name)
+}
+
+// Set sets the named secret in the current DB.
+func (r *Refreshing) Set(name, secret string) {
+	r.mu.Lock()
+	db := r.db
+	r.mu.Unlock()
+	db.Set(name, secret)
+	r.notify()
+}
+
+// Subscribe arranges for f to be called with the new value
+// of the named secret each time it changes, implementing [Subscriber].
+func (r *Refreshing) Subscribe(name string, f func(secret string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subs[name]; !ok {
+		r.last[name], _ = r.db.Get(name)
+	}
+	r.subs[name] = append(r.subs[name], f)
+}
+
+// Check reloads the secrets if they are more than ttl old,
+// notifying subscribers of any changes.
+func (r *Refreshing) Check() {
+	r.mu.Lock()
+	if r.now().Sub(r.loaded) < r.ttl {
+		r.mu.Unlock()
+		return
+	}
+	r.loaded = r.now()
+	r.mu.Unlock()
+
+	db, err := r.load()
+	if err != nil {
+		r.slog.Error("secret reload", "err", err)
+		return
+	}
+	r.mu.Lock()
+	r.db = db
+	r.mu.Unlock()
+	r.notify()
+}
+
+// notify calls the subscribers for secrets that have changed.
+func (r *Refreshing) notify() {
+	type call struct {
+		f      func(string)
+		secret string
+	}
+	var calls []call
+	r.mu.Lock()
+	for name, fs := range r.subs {
+		secret, _ := r.db.Get(name)
+		if secret == r.last[name] {
+			continue
+		}
+		r.last[name] = secret
+		r.slog.Info("secret changed", "name", name)
+		for _, f := range fs {
+			calls = append(calls, call{f, secret})
+		}
+	}
+	r.mu.Unlock()
+
+	// Call subscribers without holding r.mu,
+	// in case they call back into r.
+	for _, c := range calls {
+		c.f(c.secret)
+	}
+}
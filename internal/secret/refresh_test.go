@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/testutil"
+)
+
+func TestRefresh(t *testing.T) {
+	lg := testutil.Slogger(t)
+	current := Map{"a": "1", "b": "1"}
+	var loadErr error
+	loads := 0
+	load := func() (DB, error) {
+		loads++
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		m := make(Map)
+		for k, v := range current {
+			m[k] = v
+		}
+		return m, nil
+	}
+
+	r, err := Refresh(lg, time.Hour, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	r.loaded = now
+
+	var got []string
+	r.Subscribe("a", func(s string) { got = append(got, s) })
+
+	check := func(name, want string, wantLoads int, wantGot ...string) {
+		t.Helper()
+		if s, _ := r.Get(name); s != want {
+			t.Errorf("Get(%s) = %q, want %q", name, s, want)
+		}
+		if loads != wantLoads {
+			t.Errorf("loads = %d, want %d", loads, wantLoads)
+		}
+		if !slices.Equal(got, wantGot) {
+			t.Errorf("notified %q, want %q", got, wantGot)
+		}
+	}
+
+	// Changes are not seen until the TTL expires.
+	current["a"] = "2"
+	check("a", "1", 1)
+	now = now.Add(time.Hour)
+	check("a", "2", 2, "2")
+
+	// Changes to other secrets do not notify.
+	current["b"] = "2"
+	now = now.Add(time.Hour)
+	check("b", "2", 3, "2")
+
+	// Load errors keep the old secrets until the next attempt.
+	loadErr = errors.New("load failed")
+	current["a"] = "3"
+	now = now.Add(time.Hour)
+	check("a", "2", 4, "2")
+	check("a", "2", 4, "2")
+	loadErr = nil
+	now = now.Add(time.Hour)
+	r.Check()
+	check("a", "3", 5, "2", "3")
+
+	// Set notifies too.
+	r.Set("a", "4")
+	check("a", "4", 5, "2", "3", "4")
+
+	if _, err := Refresh(lg, time.Hour, func() (DB, error) { return nil, errors.New("bad") }); err == nil {
+		t.Errorf("Refresh with failing load succeeded")
+	}
+}
@@ -8,6 +8,8 @@
 package secret
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -82,3 +84,87 @@ func openNetrc(file string) ReadOnlyMap {
 	}
 	return m
 }
+
+// Env returns a read-only secret database backed by environment variables.
+// Get(name) returns the value of the environment variable formed by
+// adding prefix to name after converting name to upper case
+// and replacing each character other than a letter or digit with an underscore.
+// For example, Env("GABY_SECRET_").Get("api.github.com") returns
+// the value of $GABY_SECRET_API_GITHUB_COM.
+// An empty variable is treated as unset.
+// The environment is consulted on each call to Get.
+// Calling Set panics.
+func Env(prefix string) DB {
+	return env(prefix)
+}
+
+type env string
+
+// EnvName returns the name of the environment variable
+// that Env(prefix) consults for the named secret.
+func EnvName(prefix, name string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (e env) Get(name string) (secret string, ok bool) {
+	secret = os.Getenv(EnvName(string(e), name))
+	return secret, secret != ""
+}
+
+func (e env) Set(name, secret string) {
+	panic("read-only secrets")
+}
+
+// File returns a read-only secret database initialized by the content
+// of the named file, which must hold a JSON object mapping secret names
+// to values, such as
+//
+//	{"api.github.com": "user:ghp_...", "ai.google.dev": "AIza..."}
+//
+// Unlike [Netrc], File reports an error if the file
+// does not exist or is malformed.
+func File(file string) (ReadOnlyMap, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m ReadOnlyMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return m, nil
+}
+
+// Multi returns a secret database that layers the given databases.
+// Get returns the secret from the first layer that has one,
+// so earlier layers take precedence over later ones.
+// Set sets the secret in the first layer.
+func Multi(layers ...DB) DB {
+	return multi(layers)
+}
+
+type multi []DB
+
+func (m multi) Get(name string) (secret string, ok bool) {
+	for _, db := range m {
+		if secret, ok := db.Get(name); ok {
+			return secret, true
+		}
+	}
+	return "", false
+}
+
+func (m multi) Set(name, secret string) {
+	if len(m) == 0 {
+		panic("read-only secrets")
+	}
+	m[0].Set(name, secret)
+}
@@ -55,3 +55,65 @@ func TestEmpty(t *testing.T) {
 		t.Errorf("Set did not panic")
 	}()
 }
+
+func TestEnv(t *testing.T) {
+	t.Setenv("GABY_TEST_API_GITHUB_COM", "u:p")
+	t.Setenv("GABY_TEST_EMPTY", "")
+	db := Env("GABY_TEST_")
+	if secret, ok := db.Get("api.github.com"); secret != "u:p" || ok != true {
+		t.Errorf("Get(api.github.com) = %q, %v, want %q, %v", secret, ok, "u:p", true)
+	}
+	if secret, ok := db.Get("empty"); secret != "" || ok != false {
+		t.Errorf("Get(empty) = %q, %v, want %q, %v", secret, ok, "", false)
+	}
+	if name := EnvName("P_", "ai.google-dev/x9"); name != "P_AI_GOOGLE_DEV_X9" {
+		t.Errorf("EnvName = %q, want P_AI_GOOGLE_DEV_X9", name)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secrets.json")
+	if err := os.WriteFile(file, []byte(`{"example.com": "u:p"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err := File(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := db.Get("example.com"); secret != "u:p" || ok != true {
+		t.Errorf("Get(example.com) = %q, %v, want %q, %v", secret, ok, "u:p", true)
+	}
+
+	if _, err := File(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("File(missing.json) succeeded")
+	}
+	if err := os.WriteFile(file, []byte(`["not", "an", "object"]`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := File(file); err == nil {
+		t.Errorf("File with JSON array succeeded")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	top := Map{"a": "top"}
+	db := Multi(top, ReadOnlyMap{"a": "bottom", "b": "bottom"})
+	for _, tt := range []struct{ name, secret string }{{"a", "top"}, {"b", "bottom"}, {"c", ""}} {
+		if secret, ok := db.Get(tt.name); secret != tt.secret || ok != (tt.secret != "") {
+			t.Errorf("Get(%s) = %q, %v, want %q", tt.name, secret, ok, tt.secret)
+		}
+	}
+	db.Set("b", "new")
+	if secret, _ := db.Get("b"); secret != "new" || top["b"] != "new" {
+		t.Errorf("after Set, Get(b) = %q, top[b] = %q, want new, new", secret, top["b"])
+	}
+
+	func() {
+		defer func() {
+			recover()
+		}()
+		Multi().Set("name", "value")
+		t.Errorf("Set did not panic")
+	}()
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/json"
+	"iter"
+	"time"
+
+	"rsc.io/ordered"
+)
+
+// This file stores the following key schema in the database:
+//
+//	["storage.Action", Key...] => JSON of ActionRecord
+//
+// Key is the caller's [ordered] action key, such as
+// ordered.Encode("related.Post", "golang/go", 12345).
+
+func init() {
+	RegisterSchema(
+		Schema{Kind: "storage.Action", Key: "Key...", Val: "JSON of ActionRecord"},
+	)
+}
+
+// An ActionRecord records the state of an action begun by [BeginAction].
+type ActionRecord struct {
+	Start   time.Time       // time the action began
+	Done    bool            // action finished (see [FinishAction])
+	Outcome json.RawMessage `json:",omitempty"` // outcome passed to FinishAction
+}
+
+// actionKey returns the database key for the action with the given key.
+func actionKey(key []byte) []byte {
+	// A concatenation of ordered encodings is itself an ordered encoding.
+	return append(ordered.Encode("storage.Action"), key...)
+}
+
+// BeginAction records that the action identified by key,
+// typically a GitHub post or edit, is about to be performed,
+// and reports whether the caller should perform it.
+// BeginAction returns false if the action has already been begun,
+// by this process or any other process sharing the database,
+// whether or not it finished.
+// The check and the record are made atomically (using [DB.Lock])
+// and flushed to permanent storage before BeginAction returns,
+// so that an action is performed at most once,
+// even across crashes and multiple instances.
+//
+// The key should be an [ordered] encoding beginning with the name of
+// the subsystem performing the action, such as
+// ordered.Encode("related.Post", project, issue).
+// After performing the action, the caller should call [FinishAction]
+// or, if the action failed without taking effect, [CancelAction].
+// An action interrupted by a crash is left begun but not done,
+// so that a person can check whether it took effect.
+func BeginAction(db DB, key []byte) bool {
+	k := actionKey(key)
+	lock := string(k)
+	db.Lock(lock)
+	defer db.Unlock(lock)
+
+	if _, ok := db.Get(k); ok {
+		return false
+	}
+	db.Set(k, JSON(&ActionRecord{Start: time.Now()}))
+	db.Flush()
+	return true
+}
+
+// FinishAction records that the action identified by key has been performed,
+// with the given outcome, which is stored as JSON and may be nil.
+func FinishAction(db DB, key []byte, outcome any) {
+	k := actionKey(key)
+	r, ok := LookupAction(db, key)
+	if !ok {
+		db.Panic("storage.FinishAction of action not begun", "key", Fmt(key))
+	}
+	r.Done = true
+	if outcome != nil {
+		r.Outcome = JSON(outcome)
+	}
+	db.Set(k, JSON(r))
+	db.Flush()
+}
+
+// CancelAction deletes the record of the action identified by key,
+// which must not have taken effect, so that it can be attempted again.
+// It is meant to be called when the action fails.
+func CancelAction(db DB, key []byte) {
+	db.Delete(actionKey(key))
+	db.Flush()
+}
+
+// LookupAction returns the record of the action identified by key.
+// If the action has not been begun, LookupAction returns nil, false.
+func LookupAction(db DB, key []byte) (*ActionRecord, bool) {
+	k := actionKey(key)
+	val, ok := db.Get(k)
+	if !ok {
+		return nil, false
+	}
+	var r ActionRecord
+	if err := json.Unmarshal(val, &r); err != nil {
+		// unreachable unless corrupt storage
+		db.Panic("storage.Action decode", "key", Fmt(k), "err", err)
+	}
+	return &r, true
+}
+
+// DeleteActions deletes the records of all actions with keys
+// beginning with prefix, such as ordered.Encode("related.Post"),
+// allowing those actions to be performed again.
+func DeleteActions(db DB, prefix []byte) {
+	db.DeleteRange(actionKey(prefix), append(actionKey(prefix), ordered.Encode(ordered.Inf)...))
+	db.Flush()
+}
+
+// Actions returns an iterator over the records of all actions
+// with keys beginning with prefix, in key order.
+// The iterator yields each action's key (as passed to [BeginAction])
+// and its record.
+// An empty prefix matches all actions.
+func Actions(db DB, prefix []byte) iter.Seq2[[]byte, *ActionRecord] {
+	return func(yield func([]byte, *ActionRecord) bool) {
+		n := len(actionKey(nil))
+		for key, val := range db.Scan(actionKey(prefix), append(actionKey(prefix), ordered.Encode(ordered.Inf)...)) {
+			var r ActionRecord
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("storage.Action decode", "key", Fmt(key), "err", err)
+			}
+			if !yield(key[n:], &r) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"rsc.io/ordered"
+)
+
+func TestAction(t *testing.T) {
+	db := MemDB()
+	key := ordered.Encode("test.Post", "rsc/markdown", 13)
+	other := ordered.Encode("test.Post", "rsc/markdown", 19)
+
+	if _, ok := LookupAction(db, key); ok {
+		t.Fatalf("LookupAction before BeginAction succeeded")
+	}
+	if !BeginAction(db, key) {
+		t.Fatalf("first BeginAction = false")
+	}
+	if BeginAction(db, key) {
+		t.Fatalf("second BeginAction = true")
+	}
+	if r, ok := LookupAction(db, key); !ok || r.Done || r.Start.IsZero() {
+		t.Fatalf("LookupAction after BeginAction = %+v, %v", r, ok)
+	}
+
+	FinishAction(db, key, "https://example.com/post")
+	r, ok := LookupAction(db, key)
+	if !ok || !r.Done || string(r.Outcome) != `"https://example.com/post"` {
+		t.Fatalf("LookupAction after FinishAction = %+v, %v", r, ok)
+	}
+	if BeginAction(db, key) {
+		t.Fatalf("BeginAction after FinishAction = true")
+	}
+
+	if !BeginAction(db, other) {
+		t.Fatalf("BeginAction(other) = false")
+	}
+	CancelAction(db, other)
+	if !BeginAction(db, other) {
+		t.Fatalf("BeginAction after CancelAction = false")
+	}
+
+	var keys []string
+	for k, r := range Actions(db, ordered.Encode("test.Post")) {
+		keys = append(keys, fmt.Sprintf("%s done=%v", Fmt(k), r.Done))
+	}
+	want := []string{`("test.Post", "rsc/markdown", 13) done=true`, `("test.Post", "rsc/markdown", 19) done=false`}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("Actions = %q, want %q", keys, want)
+	}
+
+	DeleteActions(db, ordered.Encode("test.Post", "rsc/markdown"))
+	if _, ok := LookupAction(db, key); ok {
+		t.Fatalf("LookupAction after DeleteActions succeeded")
+	}
+
+	func() {
+		defer func() { recover() }()
+		FinishAction(db, key, nil)
+		t.Errorf("FinishAction of action not begun did not panic")
+	}()
+}
+
+func TestActionConcurrent(t *testing.T) {
+	db := MemDB()
+	key := ordered.Encode("test.Post", "rsc/markdown", 13)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	n := 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if BeginAction(db, key) {
+				mu.Lock()
+				n++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if n != 1 {
+		t.Fatalf("concurrent BeginAction succeeded %d times, want 1", n)
+	}
+}
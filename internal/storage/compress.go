@@ -0,0 +1,63 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+
+	"github.com/DataDog/zstd"
+)
+
+// CompressMin is the size of the smallest value that [Compress] compresses.
+// Smaller values gain too little to be worth the decompression cost on every read.
+const CompressMin = 1024
+
+// compressedTag is the first byte of a value returned by [Compress]
+// when it has compressed the value; zstd data follows.
+// It is not a valid first byte of an [ordered] encoding or of JSON,
+// so compressed values can be distinguished from uncompressed ones
+// written in either form, including those written before compression existed.
+const compressedTag = 0x0F
+
+// Compress returns an encoding of val for storing in a database.
+// If val is at least [CompressMin] bytes and compresses well,
+// the encoding is compressedTag followed by the zstd compression of val.
+// Otherwise Compress returns val itself.
+//
+// Compress must only be used for values that are [ordered] or JSON encodings,
+// which cannot begin with compressedTag, and the code reading the values
+// must call [Decompress] to undo it.
+func Compress(val []byte) []byte {
+	if len(val) < CompressMin {
+		return val
+	}
+	buf := make([]byte, 1+zstd.CompressBound(len(val)))
+	z, err := zstd.Compress(buf[1:], val)
+	if err != nil || 1+len(z) >= len(val) {
+		return val
+	}
+	buf[0] = compressedTag
+	return buf[:1+len(z)]
+}
+
+// IsCompressed reports whether val was compressed by [Compress].
+func IsCompressed(val []byte) bool {
+	return len(val) > 0 && val[0] == compressedTag
+}
+
+// Decompress returns the original value encoded by [Compress].
+// Values that Compress returned unchanged are returned unchanged.
+// An error means the value is corrupt;
+// callers typically pass it to [DB.Panic].
+func Decompress(val []byte) ([]byte, error) {
+	if !IsCompressed(val) {
+		return val, nil
+	}
+	out, err := zstd.Decompress(nil, val[1:])
+	if err != nil {
+		return nil, fmt.Errorf("storage.Decompress: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"rsc.io/ordered"
+)
+
+func TestCompress(t *testing.T) {
+	big := ordered.Encode(strings.Repeat("hello, world\n", 1000))
+	random := make([]byte, 2*CompressMin)
+	rand.Read(random)
+	random = ordered.Encode(ordered.Raw(random))
+
+	for _, tt := range []struct {
+		name       string
+		val        []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"small", ordered.Encode("hello"), false},
+		{"json", []byte(`{"a": "` + strings.Repeat("b", 2*CompressMin) + `"}`), true},
+		{"big", big, true},
+		{"random", random, false},
+	} {
+		z := Compress(tt.val)
+		if IsCompressed(z) != tt.compressed {
+			t.Errorf("%s: IsCompressed(Compress(val)) = %v, want %v", tt.name, IsCompressed(z), tt.compressed)
+		}
+		if tt.compressed && len(z) >= len(tt.val) {
+			t.Errorf("%s: Compress(val) = %d bytes, not smaller than %d", tt.name, len(z), len(tt.val))
+		}
+		if IsCompressed(tt.val) {
+			t.Errorf("%s: IsCompressed(val) = true", tt.name)
+		}
+		val, err := Decompress(z)
+		if err != nil || !bytes.Equal(val, tt.val) {
+			t.Errorf("%s: Decompress(Compress(val)) = %d bytes, %v, want original %d bytes", tt.name, len(val), err, len(tt.val))
+		}
+	}
+
+	if _, err := Decompress([]byte{compressedTag, 1, 2, 3}); err == nil {
+		t.Errorf("Decompress(corrupt) succeeded")
+	}
+}
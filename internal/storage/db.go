@@ -31,7 +31,9 @@ import (
 // returned corrupted data.
 // Code using multiple parallel database operations can recover
 // at the outermost calls.
-// Clients of DB
+// Code that must not crash because of a database error,
+// such as an HTTP handler, can use [Try] at its boundary
+// to convert the panic into an error.
 type DB interface {
 	// Lock acquires a lock on the given name, which need not exist in the database.
 	// After a successful Lock(name),
@@ -65,6 +67,8 @@ type DB interface {
 	//
 	// In iterations that only need the keys or only need the values for a subset of keys,
 	// some DB implementations may avoid work when the value function is not called.
+	// The keys, and the values returned by the value functions,
+	// belong to the caller and remain valid after the iteration.
 	Scan(start, end []byte) iter.Seq2[[]byte, func() []byte]
 
 	// Delete deletes any value associated with key.
@@ -131,7 +135,7 @@ type Batch interface {
 	Apply()
 }
 
-// Panic panics with the text formatting of its arguments.
+// Panic panics with an [*Error] holding the text formatting of its arguments.
 // It is meant to be called for database errors or corruption,
 // which have been defined to be impossible.
 // (See the [DB] documentation.)
@@ -145,7 +149,18 @@ func Panic(msg string, args ...any) {
 	if _, rest, ok := strings.Cut(s, " level=ERROR msg="); ok {
 		s = rest
 	}
-	panic(strings.TrimSpace(s))
+	panic(&Error{strings.TrimSpace(s)})
+}
+
+// An Error is the panic value of [Panic] and therefore of [DB.Panic].
+// Code that must keep running despite database errors,
+// such as an HTTP server, can use [Try] to recover it.
+type Error struct {
+	Msg string // text formatting of Panic's arguments
+}
+
+func (e *Error) Error() string {
+	return e.Msg
 }
 
 // JSON converts x to JSON and returns the result.
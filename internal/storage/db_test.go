@@ -15,8 +15,8 @@ func TestPanic(t *testing.T) {
 	func() {
 		defer func() {
 			r := recover()
-			if r.(string) != "msg key=val" {
-				t.Errorf("panic value is not msg key=val:\n%s", r)
+			if e, ok := r.(*Error); !ok || e.Error() != "msg key=val" {
+				t.Errorf("panic value is not *Error msg key=val:\n%v", r)
 			}
 		}()
 		Panic("msg", "key", "val")
@@ -0,0 +1,105 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/ordered"
+)
+
+// This file stores the following key schema in the database:
+//
+//	["storage.EmbedCache", Model, Hash] => [llm.Vector.Encode] of embedding
+//
+// Hash is the SHA-256 hash of ordered.Encode(Title, Text) for the document.
+
+func init() {
+	RegisterSchema(
+		Schema{Kind: "storage.EmbedCache", Key: "Model, Hash", Val: "[llm.Vector.Encode] of embedding"},
+	)
+}
+
+// CachedEmbedder returns an [llm.Embedder] that caches the embeddings
+// computed by e in db, so that embedding the same document again,
+// even for a different vector database, does not call e.
+// The cache is keyed by model, which should identify the model used
+// by e (for example "gemini/text-embedding-004"), and by a hash of
+// the document's title and text.
+// Embedders for different models must use different model names.
+func CachedEmbedder(db DB, e llm.Embedder, model string) llm.Embedder {
+	return &cachedEmbedder{db, e, model}
+}
+
+type cachedEmbedder struct {
+	db    DB
+	e     llm.Embedder
+	model string
+}
+
+// key returns the cache key for the document.
+func (c *cachedEmbedder) key(d llm.EmbedDoc) []byte {
+	sum := sha256.Sum256(ordered.Encode(d.Title, d.Text))
+	return ordered.Encode("storage.EmbedCache", c.model, sum[:])
+}
+
+// EmbedDocs returns the vector embeddings for the docs,
+// implementing [llm.Embedder].
+// It calls the underlying embedder only for the docs that
+// are not already in the cache, each at most once.
+func (c *cachedEmbedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	vecs := make([]llm.Vector, len(docs))
+	keys := make([][]byte, len(docs))
+	var missing []llm.EmbedDoc
+	missIndex := make(map[string]int) // key → index in missing
+	for i, d := range docs {
+		keys[i] = c.key(d)
+		if enc, ok := c.db.Get(keys[i]); ok {
+			vecs[i].Decode(enc)
+			continue
+		}
+		if _, ok := missIndex[string(keys[i])]; !ok {
+			missIndex[string(keys[i])] = len(missing)
+			missing = append(missing, d)
+		}
+	}
+
+	var err error
+	if len(missing) > 0 {
+		var computed []llm.Vector
+		computed, err = c.e.EmbedDocs(ctx, missing)
+		if err == nil && len(computed) != len(missing) {
+			err = fmt.Errorf("storage.CachedEmbedder: embedder returned %d vectors for %d docs", len(computed), len(missing))
+		}
+		b := c.db.Batch()
+		for i, vec := range computed {
+			b.Set(c.key(missing[i]), vec.Encode())
+			b.MaybeApply()
+		}
+		b.Apply()
+		for i := range docs {
+			if vecs[i] == nil {
+				if j := missIndex[string(keys[i])]; j < len(computed) {
+					vecs[i] = computed[j]
+				}
+			}
+		}
+	}
+
+	// Return the longest prefix of vecs that is complete.
+	for i, vec := range vecs {
+		if vec == nil {
+			if err == nil {
+				// unreachable
+				err = fmt.Errorf("storage.CachedEmbedder: missing vector")
+			}
+			return vecs[:i], err
+		}
+	}
+	return vecs, err
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"rsc.io/gaby/internal/llm"
+)
+
+var ctx = context.Background()
+
+// countEmbedder is an llm.Embedder that records the docs it is asked
+// to embed and fails on any doc with text "fail".
+type countEmbedder struct {
+	docs []llm.EmbedDoc
+}
+
+func (e *countEmbedder) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	var vecs []llm.Vector
+	for _, d := range docs {
+		if d.Text == "fail" {
+			return vecs, errors.New("fail")
+		}
+		e.docs = append(e.docs, d)
+		v, err := llm.QuoteEmbedder().EmbedDocs(ctx, []llm.EmbedDoc{d})
+		if err != nil {
+			return vecs, err
+		}
+		vecs = append(vecs, v[0])
+	}
+	return vecs, nil
+}
+
+func TestCachedEmbedder(t *testing.T) {
+	db := MemDB()
+	e := new(countEmbedder)
+	c := CachedEmbedder(db, e, "quote")
+
+	check := func(docs []llm.EmbedDoc, wantCalls []string, wantN int, wantErr bool) {
+		t.Helper()
+		e.docs = nil
+		vecs, err := c.EmbedDocs(ctx, docs)
+		if (err != nil) != wantErr {
+			t.Fatalf("EmbedDocs: err = %v, want error %v", err, wantErr)
+		}
+		if len(vecs) != wantN {
+			t.Fatalf("EmbedDocs returned %d vectors, want %d", len(vecs), wantN)
+		}
+		want, _ := llm.QuoteEmbedder().EmbedDocs(ctx, docs[:wantN])
+		for i := range vecs {
+			if !slices.Equal(vecs[i], want[i]) {
+				t.Errorf("vecs[%d] = %v, want %v", i, vecs[i], want[i])
+			}
+		}
+		var calls []string
+		for _, d := range e.docs {
+			calls = append(calls, d.Title+"/"+d.Text)
+		}
+		if !slices.Equal(calls, wantCalls) {
+			t.Errorf("embedded %q, want %q", calls, wantCalls)
+		}
+	}
+
+	a := llm.EmbedDoc{Title: "a", Text: "text"}
+	b := llm.EmbedDoc{Title: "b", Text: "text"}
+	ab := llm.EmbedDoc{Title: "a", Text: "btext"} // same concatenation as b
+	fail := llm.EmbedDoc{Text: "fail"}
+
+	check([]llm.EmbedDoc{a, b, a}, []string{"a/text", "b/text"}, 3, false)
+	check([]llm.EmbedDoc{b, ab, a}, []string{"a/btext"}, 3, false)
+	check([]llm.EmbedDoc{a, b, ab}, nil, 3, false)
+
+	c2 := llm.EmbedDoc{Title: "c", Text: "text"}
+	d := llm.EmbedDoc{Title: "d", Text: "text"}
+	check([]llm.EmbedDoc{a, c2, fail, d}, []string{"c/text"}, 2, true)
+	check([]llm.EmbedDoc{c2, a}, nil, 2, false) // c was cached despite the error
+
+	// A different model does not share the cache.
+	c = CachedEmbedder(db, e, "other")
+	check([]llm.EmbedDoc{a}, []string{"a/text"}, 1, false)
+}
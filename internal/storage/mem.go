@@ -180,6 +180,10 @@ func (b *memBatch) Apply() {
 	}
 }
 
+func init() {
+	RegisterSchema(Schema{Kind: "llm.Vector", Key: "Namespace, ID", Val: "[llm.Vector.Encode] of vector"})
+}
+
 // A memVectorDB is a VectorDB implementing in-memory search
 // but storing its vectors in an underlying DB.
 type memVectorDB struct {
@@ -188,6 +192,7 @@ type memVectorDB struct {
 	namespace string
 
 	mu    sync.RWMutex
+	dim   int                  // dimension of all vectors; 0 if unknown
 	cache map[string][]float32 // in-memory cache of all vectors, indexed by id
 }
 
@@ -204,6 +209,13 @@ type memVectorDB struct {
 //
 // A MemVectorDB requires approximately 3kB of memory per stored vector.
 //
+// The first vector stored in a namespace fixes the namespace's dimension
+// (see [VectorDim]). Set rejects vectors of any other dimension,
+// logging an error and recording the mismatch (see [VectorMismatches]),
+// and Search logs an error and returns no results for such a query.
+// Vectors of the wrong dimension already stored in db are ignored
+// when loading, also with a logged error.
+//
 // The db keys used by a MemVectorDB have the form
 //
 //	ordered.Encode("llm.Vector", namespace, id)
@@ -226,6 +238,9 @@ func MemVectorDB(db DB, lg *slog.Logger, namespace string) VectorDB {
 
 	// Load all the previously-stored vectors.
 	vdb.cache = make(map[string][]float32)
+	vdb.dim = VectorDim(db, namespace)
+	dim := vdb.dim
+	bad := 0
 	for key, getVal := range vdb.storage.Scan(
 		ordered.Encode("llm.Vector", namespace),
 		ordered.Encode("llm.Vector", namespace, ordered.Inf)) {
@@ -242,14 +257,49 @@ func MemVectorDB(db DB, lg *slog.Logger, namespace string) VectorDB {
 		}
 		var vec llm.Vector
 		vec.Decode(val)
+		if vdb.dim == 0 {
+			vdb.dim = len(vec)
+		}
+		if len(vec) == 0 || len(vec) != vdb.dim {
+			bad++
+			continue
+		}
 		vdb.cache[id] = vec
 	}
+	if dim == 0 && vdb.dim != 0 {
+		SetVectorDim(db, namespace, vdb.dim)
+	}
+	if bad > 0 {
+		vdb.slog.Error("vectordb dimension mismatch", "namespace", namespace, "dim", vdb.dim, "ignored", bad)
+	}
 
 	vdb.slog.Info("loaded vectordb", "n", len(vdb.cache), "namespace", namespace)
 	return vdb
 }
 
+// checkDim reports whether vec has the dimension of the vectors in db,
+// setting that dimension if vec is the first vector.
+// If vec has the wrong dimension, checkDim logs and records the mismatch.
+func (db *memVectorDB) checkDim(id string, vec llm.Vector) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dim == 0 && len(vec) > 0 {
+		db.dim = len(vec)
+		SetVectorDim(db.storage, db.namespace, db.dim)
+	}
+	if len(vec) > 0 && len(vec) == db.dim {
+		return true
+	}
+	db.slog.Error("vectordb dimension mismatch", "namespace", db.namespace, "id", id, "len", len(vec), "dim", db.dim)
+	RecordVectorMismatch(db.storage, db.namespace, db.dim, id, len(vec))
+	return false
+}
+
 func (db *memVectorDB) Set(id string, vec llm.Vector) {
+	if !db.checkDim(id, vec) {
+		return
+	}
 	db.storage.Set(ordered.Encode("llm.Vector", db.namespace, id), vec.Encode())
 
 	db.mu.Lock()
@@ -257,6 +307,14 @@ func (db *memVectorDB) Set(id string, vec llm.Vector) {
 	db.mu.Unlock()
 }
 
+func (db *memVectorDB) Delete(id string) {
+	db.storage.Delete(ordered.Encode("llm.Vector", db.namespace, id))
+
+	db.mu.Lock()
+	delete(db.cache, id)
+	db.mu.Unlock()
+}
+
 func (db *memVectorDB) Get(name string) (llm.Vector, bool) {
 	db.mu.RLock()
 	vec, ok := db.cache[name]
@@ -267,11 +325,12 @@ func (db *memVectorDB) Get(name string) (llm.Vector, bool) {
 func (db *memVectorDB) Search(target llm.Vector, n int) []VectorResult {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	if len(db.cache) > 0 && len(target) != db.dim {
+		db.slog.Error("vectordb search dimension mismatch", "namespace", db.namespace, "len", len(target), "dim", db.dim)
+		return nil
+	}
 	best := top.New(n, VectorResult.cmp)
 	for name, vec := range db.cache {
-		if len(vec) != len(target) {
-			continue
-		}
 		best.Add(VectorResult{name, target.Dot(vec)})
 	}
 	return best.Take()
@@ -285,7 +344,7 @@ func (db *memVectorDB) Flush() {
 type memVectorBatch struct {
 	db *memVectorDB          // underlying memVectorDB
 	sb Batch                 // batch for underlying DB
-	w  map[string]llm.Vector // vectors to write
+	w  map[string]llm.Vector // vectors to write; nil means delete
 }
 
 func (db *memVectorDB) Batch() VectorBatch {
@@ -293,11 +352,20 @@ func (db *memVectorDB) Batch() VectorBatch {
 }
 
 func (b *memVectorBatch) Set(name string, vec llm.Vector) {
+	if !b.db.checkDim(name, vec) {
+		return
+	}
 	b.sb.Set(ordered.Encode("llm.Vector", b.db.namespace, name), vec.Encode())
 
 	b.w[name] = slices.Clone(vec)
 }
 
+func (b *memVectorBatch) Delete(name string) {
+	b.sb.Delete(ordered.Encode("llm.Vector", b.db.namespace, name))
+
+	b.w[name] = nil
+}
+
 func (b *memVectorBatch) MaybeApply() bool {
 	if !b.sb.MaybeApply() {
 		return false
@@ -313,6 +381,10 @@ func (b *memVectorBatch) Apply() {
 	defer b.db.mu.Unlock()
 
 	for name, vec := range b.w {
+		if vec == nil {
+			delete(b.db.cache, name)
+			continue
+		}
 		b.db.cache[name] = vec
 	}
 	clear(b.w)
@@ -5,9 +5,13 @@
 package storage
 
 import (
+	"io"
+	"log/slog"
+	"strings"
 	"testing"
 
 	"rsc.io/gaby/internal/testutil"
+	"rsc.io/ordered"
 )
 
 func TestMemDB(t *testing.T) {
@@ -19,6 +23,69 @@ func TestMemVectorDB(t *testing.T) {
 	TestVectorDB(t, func() VectorDB { return MemVectorDB(db, testutil.Slogger(t), "") })
 }
 
+func BenchmarkMemVectorDB(b *testing.B) {
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	BenchmarkVectorDB(b, func() VectorDB { return MemVectorDB(MemDB(), lg, "") })
+}
+
+func TestMemVectorDBDim(t *testing.T) {
+	db := MemDB()
+	lg, out := testutil.SlogBuffer()
+	vdb := MemVectorDB(db, lg, "ns")
+	if d := VectorDim(db, "ns"); d != 0 {
+		t.Errorf("VectorDim of empty namespace = %d, want 0", d)
+	}
+	vdb.Set("apple1", embed("apple1"))
+	if d := VectorDim(db, "ns"); d != 16 {
+		t.Errorf("VectorDim = %d, want 16", d)
+	}
+	for range VectorMismatches(db) {
+		t.Fatalf("VectorMismatches before mismatch succeeded")
+	}
+
+	vdb.Set("apple2", embed("apple2")[:8])
+	b := vdb.Batch()
+	b.Set("apple3", embed("apple3")[:4])
+	b.Apply()
+	if !strings.Contains(out.String(), "vectordb dimension mismatch") {
+		t.Errorf("mismatched Set did not log error:\n%s", out)
+	}
+	var ms []*VectorMismatch
+	for m := range VectorMismatches(db) {
+		ms = append(ms, m)
+	}
+	if len(ms) != 1 || ms[0].Namespace != "ns" || ms[0].Dim != 16 || ms[0].Count != 2 || ms[0].ID != "apple3" || ms[0].Len != 4 {
+		t.Errorf("VectorMismatches = %+v, want ns, Dim 16, Count 2, ID apple3, Len 4", ms)
+	}
+
+	out.Reset()
+	if have := vdb.Search(embed("apple5")[:8], 5); have != nil {
+		t.Errorf("Search with mismatched vector = %v, want nil", have)
+	}
+	if !strings.Contains(out.String(), "vectordb search dimension mismatch") {
+		t.Errorf("mismatched Search did not log error:\n%s", out)
+	}
+
+	// Vectors of the wrong dimension stored before the dimension
+	// was recorded are ignored when loading.
+	db.Set(ordered.Encode("llm.Vector", "old", "a"), embed("a").Encode())
+	db.Set(ordered.Encode("llm.Vector", "old", "b"), embed("b")[:8].Encode())
+	out.Reset()
+	vdb = MemVectorDB(db, lg, "old")
+	if _, ok := vdb.Get("b"); ok {
+		t.Errorf("Get(b) of mismatched stored vector succeeded")
+	}
+	if _, ok := vdb.Get("a"); !ok {
+		t.Errorf("Get(a) failed")
+	}
+	if d := VectorDim(db, "old"); d != 16 {
+		t.Errorf("VectorDim after load = %d, want 16", d)
+	}
+	if !strings.Contains(out.String(), "ignored=1") {
+		t.Errorf("load did not log ignored vector:\n%s", out)
+	}
+}
+
 type maybeDB struct {
 	DB
 	maybe bool
@@ -0,0 +1,115 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"rsc.io/ordered"
+)
+
+// A Schema describes one kind of database key:
+// the keys whose [ordered] encoding begins with the string Kind.
+//
+// By convention, Kind begins with the name of the package
+// storing the keys, such as "githubdl.Event" or "docs.Doc".
+// Packages register the schemas they use with [RegisterSchema],
+// so that two packages cannot accidentally share a kind
+// and so that tools can describe the contents of a database.
+type Schema struct {
+	Kind string // first key element, such as "githubdl.Event"
+	Key  string // remaining key elements, such as "Project, Issue, API, ID"
+	Val  string // description of the value, such as "JSON of Issue"
+}
+
+// String returns the schema in the form used in the packages' doc comments:
+//
+//	["Kind", Key] => Val
+func (s Schema) String() string {
+	key := fmt.Sprintf("%q", s.Kind)
+	if s.Key != "" {
+		key += ", " + s.Key
+	}
+	return fmt.Sprintf("[%s] => %s", key, s.Val)
+}
+
+var schemas struct {
+	mu sync.Mutex
+	m  map[string]Schema
+}
+
+// RegisterSchema registers the given schemas.
+// It is meant to be called from the init functions of the packages
+// storing the keys, and it panics if a kind is empty
+// or has already been registered.
+func RegisterSchema(list ...Schema) {
+	schemas.mu.Lock()
+	defer schemas.mu.Unlock()
+
+	if schemas.m == nil {
+		schemas.m = make(map[string]Schema)
+	}
+	for _, s := range list {
+		if s.Kind == "" {
+			panic("storage.RegisterSchema: empty kind")
+		}
+		if old, ok := schemas.m[s.Kind]; ok {
+			panic(fmt.Sprintf("storage.RegisterSchema: conflicting schemas for %q:\n\t%v\n\t%v", s.Kind, old, s))
+		}
+		schemas.m[s.Kind] = s
+	}
+}
+
+// LookupSchema returns the registered schema for the kind.
+func LookupSchema(kind string) (Schema, bool) {
+	schemas.mu.Lock()
+	defer schemas.mu.Unlock()
+
+	s, ok := schemas.m[kind]
+	return s, ok
+}
+
+// Schemas returns the registered schemas, sorted by kind.
+func Schemas() []Schema {
+	schemas.mu.Lock()
+	defer schemas.mu.Unlock()
+
+	var list []Schema
+	for _, s := range schemas.m {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(x, y Schema) int { return strings.Compare(x.Kind, y.Kind) })
+	return list
+}
+
+// Kinds returns the kinds of the keys in db, in sorted order.
+// The kind of a key is its first element, which must be a string.
+// Kinds skips over the keys of each kind,
+// so that its cost depends on the number of kinds
+// rather than the number of keys.
+func Kinds(db DB) []string {
+	var kinds []string
+	start, end := ordered.Encode(), ordered.Encode(ordered.Inf)
+	for {
+		found := false
+		for key := range db.Scan(start, end) {
+			var kind string
+			if _, err := ordered.DecodePrefix(key, &kind); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("storage.Kinds decode", "key", Fmt(key), "err", err)
+			}
+			kinds = append(kinds, kind)
+			start = ordered.Encode(kind, ordered.Inf)
+			found = true
+			break
+		}
+		if !found {
+			return kinds
+		}
+	}
+}
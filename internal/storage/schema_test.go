@@ -0,0 +1,68 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"rsc.io/ordered"
+)
+
+func TestSchema(t *testing.T) {
+	a := Schema{Kind: "schematest.A", Key: "Project, Issue", Val: "JSON of Record"}
+	b := Schema{Kind: "schematest.B", Val: "ID"}
+	RegisterSchema(b, a)
+
+	if s, ok := LookupSchema("schematest.A"); !ok || s != a {
+		t.Errorf("LookupSchema(schematest.A) = %v, %v, want %v, true", s, ok, a)
+	}
+	if _, ok := LookupSchema("schematest.C"); ok {
+		t.Errorf("LookupSchema(schematest.C) succeeded")
+	}
+
+	list := Schemas()
+	if !slices.IsSortedFunc(list, func(x, y Schema) int { return strings.Compare(x.Kind, y.Kind) }) {
+		t.Errorf("Schemas() not sorted: %v", list)
+	}
+	if !slices.Contains(list, a) || !slices.Contains(list, b) || !slices.ContainsFunc(list, func(s Schema) bool { return s.Kind == "storage.Action" }) {
+		t.Errorf("Schemas() = %v, missing schemas", list)
+	}
+
+	if have, want := a.String(), `["schematest.A", Project, Issue] => JSON of Record`; have != want {
+		t.Errorf("String() = %s, want %s", have, want)
+	}
+	if have, want := b.String(), `["schematest.B"] => ID`; have != want {
+		t.Errorf("String() = %s, want %s", have, want)
+	}
+
+	for _, s := range []Schema{{Kind: "schematest.A", Val: "other"}, {}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterSchema(%v) did not panic", s)
+				}
+			}()
+			RegisterSchema(s)
+		}()
+	}
+}
+
+func TestKinds(t *testing.T) {
+	db := MemDB()
+	if kinds := Kinds(db); len(kinds) != 0 {
+		t.Errorf("Kinds(empty) = %v, want none", kinds)
+	}
+	for i := range 10 {
+		db.Set(ordered.Encode("b", i), nil)
+		db.Set(ordered.Encode("a", "x", i), nil)
+	}
+	db.Set(ordered.Encode("c"), nil)
+	db.Set(ordered.Encode("ab"), nil)
+	if have, want := Kinds(db), []string{"a", "ab", "b", "c"}; !slices.Equal(have, want) {
+		t.Errorf("Kinds() = %v, want %v", have, want)
+	}
+}
@@ -5,15 +5,21 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math/rand/v2"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"rsc.io/ordered"
 )
 
-// TestDB runs basic tests on db.
+// TestDB runs conformance tests on db:
+// basic operations, keys containing arbitrary bytes, large values,
+// batches, modification during Scan, concurrent access, and locking.
 // It should be empty when TestDB is called.
 func TestDB(t *testing.T, db DB) {
 	db.Set([]byte("key"), []byte("value"))
@@ -91,9 +97,424 @@ func TestDB(t *testing.T, db DB) {
 	// Can't test much, but check that it doesn't crash.
 	db.Flush()
 
+	db.DeleteRange(ordered.Encode(ordered.Rev(ordered.Inf)), ordered.Encode(ordered.Inf))
+	testDBCopy(t, db)
+	testDBBinaryKeys(t, db)
+	testDBLargeValue(t, db)
+	testDBBatchOrder(t, db)
+	testDBMaybeApply(t, db)
+	testDBScanMutate(t, db)
+	testDBConcurrent(t, db)
 	testDBLock(t, db)
 }
 
+// testDBCopy checks that db does not retain or share
+// the byte slices passed to or returned from its methods.
+func testDBCopy(t *testing.T, db DB) {
+	key := []byte("copy")
+	val := []byte("value")
+	db.Set(key, val)
+	key[0] = 'X'
+	val[0] = 'X'
+	v, ok := db.Get([]byte("copy"))
+	if !ok || string(v) != "value" {
+		// unreachable except for bad db
+		t.Fatalf("Get(copy) after modifying Set arguments = %q, %v, want %q, true", v, ok, "value")
+	}
+	v[0] = 'X'
+	if v, _ := db.Get([]byte("copy")); string(v) != "value" {
+		// unreachable except for bad db
+		t.Fatalf("Get(copy) after modifying Get result = %q, want %q", v, "value")
+	}
+
+	db.Set([]byte("copy2"), []byte("value2"))
+	var keys [][]byte
+	for key := range db.Scan([]byte("copy"), []byte("copy\xff")) {
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 || string(keys[0]) != "copy" || string(keys[1]) != "copy2" {
+		// unreachable except for bad db
+		t.Fatalf("Scan keys saved during iteration = %q, want [copy copy2]", keys)
+	}
+	db.DeleteRange([]byte("copy"), []byte("copy\xff"))
+}
+
+// testDBBinaryKeys checks that db handles keys containing
+// arbitrary bytes, including 0x00 and 0xff, in byte order.
+func testDBBinaryKeys(t *testing.T, db DB) {
+	keys := []string{
+		"\x00",
+		"\x00\x00",
+		"\x00\xff",
+		"\x01",
+		"a",
+		"a\x00",
+		"a\x00b",
+		"a\xff",
+		"b",
+		"\xfe\xff",
+		"\xff",
+		"\xff\x00",
+		"\xff\xff",
+		"\xff\xff\xff",
+	}
+	b := db.Batch()
+	for _, k := range slices.Backward(keys) {
+		b.Set([]byte(k), []byte("v"+k))
+	}
+	b.Apply()
+
+	for _, k := range keys {
+		if v, ok := db.Get([]byte(k)); !ok || string(v) != "v"+k {
+			// unreachable except for bad db
+			t.Fatalf("Get(%q) = %q, %v, want %q, true", k, v, ok, "v"+k)
+		}
+	}
+	if v, ok := db.Get([]byte("a\x00c")); ok {
+		// unreachable except for bad db
+		t.Fatalf("Get(%q) = %q, true, want nil, false", "a\x00c", v)
+	}
+
+	scan := func(start, end string) []string {
+		var list []string
+		for key, val := range db.Scan([]byte(start), []byte(end)) {
+			if v := string(val()); v != "v"+string(key) {
+				// unreachable except for bad db
+				t.Fatalf("Scan(%q, %q) key %q val=%q, want %q", start, end, key, v, "v"+string(key))
+			}
+			list = append(list, string(key))
+		}
+		return list
+	}
+	if have := scan("\x00", "\xff\xff\xff"); !slices.Equal(have, keys) {
+		// unreachable except for bad db
+		t.Fatalf("Scan of all binary keys:\nhave %q\nwant %q", have, keys)
+	}
+	if have, want := scan("a\x00", "a\xff"), keys[5:8]; !slices.Equal(have, want) {
+		// unreachable except for bad db
+		t.Fatalf("Scan(%q, %q) = %q, want %q", "a\x00", "a\xff", have, want)
+	}
+
+	db.DeleteRange([]byte("a\x00"), []byte("a\xff"))
+	db.Delete([]byte("\xff"))
+	want := slices.Concat(keys[:5], keys[8:10], keys[11:])
+	if have := scan("\x00", "\xff\xff\xff"); !slices.Equal(have, want) {
+		// unreachable except for bad db
+		t.Fatalf("Scan of binary keys after deletes:\nhave %q\nwant %q", have, want)
+	}
+	db.DeleteRange([]byte("\x00"), []byte("\xff\xff\xff"))
+	if have := scan("\x00", "\xff\xff\xff"); len(have) != 0 {
+		// unreachable except for bad db
+		t.Fatalf("Scan of binary keys after DeleteRange = %q, want none", have)
+	}
+}
+
+// testDBLargeValue checks that db can store a large value.
+func testDBLargeValue(t *testing.T, db DB) {
+	const size = 8 << 20
+	val := make([]byte, size)
+	pcg := rand.NewPCG(1, 2)
+	for i := 0; i < len(val); i += 8 {
+		binary.BigEndian.PutUint64(val[i:], pcg.Uint64())
+	}
+	db.Set([]byte("large"), val)
+	b := db.Batch()
+	b.Set([]byte("large2"), val)
+	b.Apply()
+	for _, key := range []string{"large", "large2"} {
+		if v, ok := db.Get([]byte(key)); !ok || !bytes.Equal(v, val) {
+			// unreachable except for bad db
+			t.Fatalf("Get(%s) of %d-byte value = %d bytes, %v, want %d bytes, true", key, size, len(v), ok, size)
+		}
+	}
+	for key, v := range db.Scan([]byte("large"), []byte("large2")) {
+		if !bytes.Equal(v(), val) {
+			// unreachable except for bad db
+			t.Fatalf("Scan key %q of %d-byte value = %d bytes", key, size, len(v()))
+		}
+	}
+	db.DeleteRange([]byte("large"), []byte("large2"))
+}
+
+// testDBBatchOrder checks that batched operations apply in order
+// and that a batch can be reused after Apply.
+func testDBBatchOrder(t *testing.T, db DB) {
+	key := func(i int) []byte { return ordered.Encode("batch", i) }
+	has := func(i int) bool {
+		_, ok := db.Get(key(i))
+		return ok
+	}
+
+	b := db.Batch()
+	b.Apply() // empty batch
+	b.Set(key(1), []byte("x"))
+	b.Delete(key(1))
+	b.Delete(key(2))
+	b.Set(key(2), []byte("x"))
+	b.Set(key(3), []byte("x"))
+	b.Set(key(4), []byte("x"))
+	b.DeleteRange(key(3), key(4))
+	b.DeleteRange(key(5), key(6))
+	b.Set(key(5), []byte("x"))
+	b.Set(key(6), []byte("x"))
+	b.Set(key(6), []byte("y"))
+	if has(2) || has(5) {
+		// unreachable except for bad db
+		t.Fatalf("batch operations visible before Apply")
+	}
+	b.Apply()
+	for i, want := range []bool{1: false, 2: true, 3: false, 4: false, 5: true, 6: true} {
+		if i > 0 && has(i) != want {
+			// unreachable except for bad db
+			t.Fatalf("after batch, Get(%d) ok = %v, want %v", i, has(i), want)
+		}
+	}
+	if v, _ := db.Get(key(6)); string(v) != "y" {
+		// unreachable except for bad db
+		t.Fatalf("after batch, Get(6) = %q, want %q", v, "y")
+	}
+
+	// The batch is empty and reusable after Apply.
+	b.Set(key(7), []byte("x"))
+	b.Apply()
+	if !has(7) || has(1) {
+		// unreachable except for bad db
+		t.Fatalf("reused batch: Get(7) ok = %v, Get(1) ok = %v, want true, false", has(7), has(1))
+	}
+	db.DeleteRange(ordered.Encode("batch"), ordered.Encode("batch", ordered.Inf))
+}
+
+// testDBMaybeApply checks that MaybeApply applies all the operations
+// batched so far whenever it reports that it did.
+func testDBMaybeApply(t *testing.T, db DB) {
+	const N = 2000
+	key := func(i int) []byte { return ordered.Encode("maybe", i) }
+	val := make([]byte, 64<<10)
+	b := db.Batch()
+	applied := -1 // last key applied
+	for i := range N {
+		b.Set(key(i), val)
+		if b.MaybeApply() {
+			for _, j := range []int{applied + 1, i} {
+				if _, ok := db.Get(key(j)); !ok {
+					// unreachable except for bad db
+					t.Fatalf("MaybeApply reported true but key %d missing", j)
+				}
+			}
+			applied = i
+		}
+	}
+	if applied < N-1 {
+		if _, ok := db.Get(key(N - 1)); ok {
+			// unreachable except for bad db
+			t.Fatalf("key %d visible before Apply", N-1)
+		}
+	}
+	b.Apply()
+	n := 0
+	for range db.Scan(key(0), key(N)) {
+		n++
+	}
+	if n != N {
+		// unreachable except for bad db
+		t.Fatalf("after MaybeApply loop and Apply, found %d keys, want %d", n, N)
+	}
+	db.DeleteRange(ordered.Encode("maybe"), ordered.Encode("maybe", ordered.Inf))
+}
+
+// testDBScanMutate checks that db allows modifying the database
+// during a Scan. Changes made during the scan may or may not be
+// visible in it, but keys present throughout must be, in order.
+func testDBScanMutate(t *testing.T, db DB) {
+	key := func(i int) []byte { return ordered.Encode("mutate", i) }
+	for i := range 100 {
+		db.Set(key(2*i), []byte(fmt.Sprint(2*i)))
+	}
+
+	var even []int
+	last := -1
+	for k, v := range db.Scan(key(0), key(1000)) {
+		var i int
+		if err := ordered.Decode(k, nil, &i); err != nil {
+			// unreachable except for bad db
+			t.Fatalf("Scan malformed key %v", Fmt(k))
+		}
+		if i <= last {
+			// unreachable except for bad db
+			t.Fatalf("Scan during mutation returned key %d after %d", i, last)
+		}
+		last = i
+		if i%2 != 0 {
+			continue
+		}
+		if i < 200 {
+			if sv := string(v()); sv != fmt.Sprint(i) {
+				// unreachable except for bad db
+				t.Fatalf("Scan during mutation key %d val=%q, want %q", i, sv, fmt.Sprint(i))
+			}
+			even = append(even, i)
+		}
+		db.Set(key(i+1), []byte("odd"))    // just after current key
+		db.Set(key(1000-i), []byte("new")) // far ahead
+		db.Delete(key(i))                  // current key
+		b := db.Batch()
+		b.Set(key(i+3), []byte("odd"))
+		b.Apply()
+	}
+	if len(even) != 100 {
+		// unreachable except for bad db
+		t.Fatalf("Scan during mutation saw %d original keys, want 100", len(even))
+	}
+	db.DeleteRange(ordered.Encode("mutate"), ordered.Encode("mutate", ordered.Inf))
+}
+
+// testDBConcurrent checks that db can be read by many goroutines
+// while it is being written. Readers must always see complete values.
+func testDBConcurrent(t *testing.T, db DB) {
+	const (
+		N       = 100 // keys
+		writes  = 20  // rounds of writes
+		readers = 4
+	)
+	key := func(i int) []byte { return ordered.Encode("concurrent", i) }
+	val := func(i, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d.%d;", i, round)), 100)
+	}
+	check := func(k, v []byte) error {
+		var i int
+		if err := ordered.Decode(k, nil, &i); err != nil {
+			return fmt.Errorf("malformed key %v", Fmt(k))
+		}
+		var round int
+		if _, err := fmt.Sscanf(string(v), "%d.%d;", &i, &round); err != nil || !bytes.Equal(v, val(i, round)) {
+			return fmt.Errorf("key %d: torn value %.40q...", i, v)
+		}
+		return nil
+	}
+	for i := range N {
+		db.Set(key(i), val(i, 0))
+	}
+
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	errc := make(chan error, readers)
+	for r := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; !done.Load(); n++ {
+				if r%2 == 0 {
+					k := key(n % N)
+					v, ok := db.Get(k)
+					if !ok {
+						errc <- fmt.Errorf("Get(%d) missing during writes", n%N)
+						return
+					}
+					if err := check(k, v); err != nil {
+						errc <- err
+						return
+					}
+					continue
+				}
+				seen := 0
+				for k, v := range db.Scan(key(0), key(N)) {
+					if err := check(k, v()); err != nil {
+						errc <- err
+						return
+					}
+					seen++
+				}
+				if seen != N {
+					errc <- fmt.Errorf("Scan saw %d keys during writes, want %d", seen, N)
+					return
+				}
+			}
+		}()
+	}
+	for round := 1; round <= writes; round++ {
+		if round%2 == 0 {
+			for i := range N {
+				db.Set(key(i), val(i, round))
+			}
+			continue
+		}
+		b := db.Batch()
+		for i := range N {
+			b.Set(key(i), val(i, round))
+		}
+		b.Apply()
+	}
+	done.Store(true)
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		// unreachable except for bad db
+		t.Fatal(err)
+	}
+	db.DeleteRange(ordered.Encode("concurrent"), ordered.Encode("concurrent", ordered.Inf))
+}
+
+// TestPersistentDB runs tests of persistence on a database
+// that can be closed and reopened. Each call to open must return
+// a new connection to the same database, which should be empty
+// when TestPersistentDB is called.
+func TestPersistentDB(t *testing.T, open func() DB) {
+	key := func(i int) []byte { return ordered.Encode("persist", i) }
+
+	db := open()
+	db.Set(key(1), []byte("one"))
+	b := db.Batch()
+	for i := 2; i < 100; i++ {
+		b.Set(key(i), []byte(fmt.Sprint(i)))
+	}
+	b.Apply()
+	db.Delete(key(50))
+	db.DeleteRange(key(60), key(69))
+	db.Flush()
+	db.Close()
+
+	db = open()
+	count := func() int {
+		n := 0
+		for range db.Scan(key(0), key(1000)) {
+			n++
+		}
+		return n
+	}
+	if v, ok := db.Get(key(1)); !ok || string(v) != "one" {
+		// unreachable except for bad db
+		t.Fatalf("after reopen, Get(1) = %q, %v, want %q, true", v, ok, "one")
+	}
+	if n := count(); n != 88 {
+		// unreachable except for bad db
+		t.Fatalf("after reopen, found %d keys, want 88", n)
+	}
+
+	// Unflushed changes may be lost when the database is closed,
+	// but a batch must survive or be lost as a unit,
+	// and the database must still open.
+	b = db.Batch()
+	for i := 100; i < 200; i++ {
+		b.Set(key(i), []byte(fmt.Sprint(i)))
+	}
+	b.Apply()
+	db.Close()
+
+	db = open()
+	defer db.Close()
+	switch n := count(); n {
+	case 88, 188:
+		// ok
+	default:
+		// unreachable except for bad db
+		t.Fatalf("after reopen with unflushed batch, found %d keys, want 88 or 188", n)
+	}
+	if v, ok := db.Get(key(1)); !ok || string(v) != "one" {
+		// unreachable except for bad db
+		t.Fatalf("after second reopen, Get(1) = %q, %v, want %q, true", v, ok, "one")
+	}
+}
+
 type locker interface {
 	Lock(string)
 	Unlock(string)
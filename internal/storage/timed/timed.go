@@ -45,6 +45,10 @@
 //
 //   - Scan(db, kind, start, end) returns an iterator yielding *Entry.
 //
+//   - Rewrite(db, batch, kind, key, val) replaces the value of an existing entry
+//     without changing its modtime, for re-encodings that do not change
+//     the logical content of the entry.
+//
 //   - Delete(db, batch, kind, key) deletes an entry.
 //
 //   - DeleteRange(db, batch, kind, start, end) deletes a range of entries.
@@ -79,6 +83,8 @@ type DBTime int64
 
 var lastTime atomic.Int64
 
+var timeNow = time.Now // for testing
+
 // now returns the current DBTime.
 // The implementation assumes accurate time-keeping on the systems where it runs,
 // so that if Gaby is restarted, the new instance will not see times before
@@ -89,7 +95,7 @@ var lastTime atomic.Int64
 func now() DBTime {
 	for {
 		old := lastTime.Load()
-		t := time.Now().UnixNano()
+		t := timeNow().UnixNano()
 		if t <= old {
 			t = old + 1
 		}
@@ -107,6 +113,19 @@ type Entry struct {
 	Val     []byte // value
 }
 
+// RegisterSchema registers with [storage.RegisterSchema]
+// the schemas of the actual database entries for the timed kind:
+// the entries themselves, with the given key and value descriptions
+// (not including the modtime prepended to the value),
+// the time index, and the state of the kind's [Watcher]s.
+func RegisterSchema(kind, key, val string) {
+	storage.RegisterSchema(
+		storage.Schema{Kind: kind, Key: key, Val: "[DBTime, " + val + "]"},
+		storage.Schema{Kind: kind + "ByTime", Key: "DBTime, " + key, Val: "[]"},
+		storage.Schema{Kind: kind + "Watcher", Key: "Name", Val: "DBTime"},
+	)
+}
+
 // Set adds to b the database updates to set (kind, key) → val,
 // including updating the time index.
 func Set(db storage.DB, b storage.Batch, kind string, key, val []byte) {
@@ -124,6 +143,29 @@ func Set(db storage.DB, b storage.Batch, kind string, key, val []byte) {
 	b.Set(dkey, append(ordered.Encode(int64(t)), val...))
 }
 
+// Rewrite adds to b the database updates to replace the value of the existing entry
+// (kind, key) with val, without changing the entry's ModTime.
+// If there is no such entry, Rewrite is a no-op and returns false.
+//
+// Rewrite is meant for storage-level re-encodings, such as dropping unused
+// fields or compressing values, that do not change the logical content of
+// the entry and therefore must not cause the entry to appear new
+// to a [Watcher] or to [ScanAfter].
+func Rewrite(db storage.DB, b storage.Batch, kind string, key, val []byte) bool {
+	dkey := append(ordered.Encode(kind), key...)
+	old, ok := db.Get(dkey)
+	if !ok {
+		return false
+	}
+	var t int64
+	if _, err := ordered.DecodePrefix(old, &t); err != nil {
+		// unreachable unless corrupt storage
+		db.Panic("timed.Rewrite decode old", "dkey", storage.Fmt(dkey), "old", storage.Fmt(old), "err", err)
+	}
+	b.Set(dkey, append(ordered.Encode(t), val...))
+	return true
+}
+
 // Delete adds to b the database updates to delete the value corresponding to (kind, key), if any.
 func Delete(db storage.DB, b storage.Batch, kind string, key []byte) {
 	dkey := append(ordered.Encode(kind), key...)
@@ -363,6 +405,17 @@ func (w *Watcher[T]) Restart() {
 	w.db.Delete(w.dkey)
 }
 
+// MarkAllOld marks all existing entries as “old”,
+// so that [Watcher.Recent] iterates over only the entries set after the call.
+// MarkAllOld must not be called during an iteration.
+func (w *Watcher[T]) MarkAllOld() {
+	w.lock()
+	defer w.unlock()
+
+	w.MarkOld(now())
+	w.Flush()
+}
+
 // MarkOld marks entries at or before t as “old”,
 // meaning they will no longer be iterated over by [Watcher.Recent].
 // A future call to Recent, perhaps even on a different Watcher
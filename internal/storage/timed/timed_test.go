@@ -8,8 +8,10 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
 )
 
 func Test(t *testing.T) {
@@ -31,6 +33,21 @@ func Test(t *testing.T) {
 		t.Errorf("Get after Delete = %+v, %v, want {>0, kind, key, val}, true", e, ok)
 	}
 
+	old, _ := Get(db, "kind", []byte("key"))
+	if !Rewrite(db, b, "kind", []byte("key"), []byte("val2")) {
+		t.Errorf("Rewrite(key) = false, want true")
+	}
+	if Rewrite(db, b, "kind", []byte("missing"), []byte("val2")) {
+		t.Errorf("Rewrite(missing) = true, want false")
+	}
+	b.Apply()
+	if e, ok := Get(db, "kind", []byte("key")); !ok || e == nil || string(e.Val) != "val2" || e.ModTime != old.ModTime {
+		t.Errorf("Get after Rewrite = %+v, %v, want {%d, kind, key, val2}, true", e, ok, old.ModTime)
+	}
+	for e := range ScanAfter(db, "kind", old.ModTime, nil) {
+		t.Errorf("ScanAfter after Rewrite found %+v", e)
+	}
+
 	Delete(db, b, "kind", []byte("key"))
 	b.Apply()
 	if e, ok := Get(db, "kind", []byte("key")); e != nil || ok != false {
@@ -206,6 +223,23 @@ func Test(t *testing.T) {
 		t.Errorf("Watcher.Recent() after Reset = %v, want %v", keys, want)
 	}
 
+	// Watcher marked all old sees only new entries.
+	w.MarkAllOld()
+	for e := range w.Recent() {
+		t.Errorf("Watcher.Recent() after MarkAllOld = %s", e.Key)
+	}
+	Set(db, b, "kind", []byte("k6"), []byte("v6"))
+	b.Apply()
+	keys = nil
+	for e := range w.Recent() {
+		keys = append(keys, string(e.Key))
+	}
+	if want := []string{"k6"}; !slices.Equal(keys, want) {
+		t.Errorf("Watcher.Recent() after MarkAllOld and Set = %v, want %v", keys, want)
+	}
+	Delete(db, b, "kind", []byte("k6"))
+	b.Apply()
+
 	// Filtered scan.
 	last = 0
 	keys = nil
@@ -334,3 +368,28 @@ func TestNow(t *testing.T) {
 		t1 = t2
 	}
 }
+
+func TestNowClock(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Now().Add(time.Hour))
+	timeNow = clock.Now
+	defer func() { timeNow = time.Now }()
+
+	// A stopped clock still produces increasing times.
+	t1 := now()
+	if t2 := now(); t2 != t1+1 {
+		t.Errorf("now(), now() with stopped clock = %d, %d, want %d, %d", t1, t2, t1, t1+1)
+	}
+
+	// Advancing the clock advances the times.
+	clock.Advance(time.Minute)
+	if t2, want := now(), DBTime(clock.Now().UnixNano()); t2 != want {
+		t.Errorf("now() after Advance = %d, want %d", t2, want)
+	}
+
+	// A clock that goes backward does not.
+	t1 = now()
+	clock.Advance(-time.Hour)
+	if t2 := now(); t2 <= t1 {
+		t.Errorf("now() after going backward = %d, want > %d", t2, t1)
+	}
+}
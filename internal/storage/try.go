@@ -0,0 +1,44 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+// Try calls f and returns nil, unless f panics with a database error
+// (see [Error]), in which case Try returns that error.
+// Other panics, which indicate bugs rather than database trouble,
+// are not recovered.
+//
+// Try is meant for the boundaries of subsystems that must keep running
+// when the database is failing, such as an HTTP server that should
+// return an error response for a request that hits a wedged database
+// rather than crashing. Most code should let database errors
+// take down the program, as described in the [DB] documentation.
+//
+// Note that f's database changes up to the panic are not undone,
+// and a [DB.Lock] held by f is not released unless f unlocks it
+// in a deferred call.
+func Try(f func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		e, ok := r.(*Error)
+		if !ok {
+			panic(r)
+		}
+		err = e
+	}()
+	f()
+	return nil
+}
+
+// TryValue is like [Try] but returns the result of f.
+// If f panics with a database error, TryValue returns
+// the zero value of T and the error.
+func TryValue[T any](f func() T) (T, error) {
+	var v T
+	err := Try(func() { v = f() })
+	return v, err
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTry(t *testing.T) {
+	db := MemDB()
+	if err := Try(func() { db.Set([]byte("k"), []byte("v")) }); err != nil {
+		t.Errorf("Try(Set) = %v, want nil", err)
+	}
+
+	err := Try(func() { db.Panic("wedged", "key", "k") })
+	var e *Error
+	if !errors.As(err, &e) || e.Msg != "wedged key=k" {
+		t.Errorf("Try(Panic) = %v, want *Error wedged key=k", err)
+	}
+
+	v, err := TryValue(func() []byte {
+		v, _ := db.Get([]byte("k"))
+		return v
+	})
+	if string(v) != "v" || err != nil {
+		t.Errorf("TryValue(Get) = %q, %v, want \"v\", nil", v, err)
+	}
+	v, err = TryValue(func() []byte {
+		db.Panic("wedged")
+		return []byte("x")
+	})
+	if v != nil || err == nil || err.Error() != "wedged" {
+		t.Errorf("TryValue(Panic) = %q, %v, want nil, wedged", v, err)
+	}
+
+	// Panics that are not database errors are not recovered.
+	func() {
+		defer func() {
+			if r := recover(); r != "bug" {
+				t.Errorf("Try(panic(bug)) recovered %v, want bug", r)
+			}
+		}()
+		Try(func() { panic("bug") })
+		t.Errorf("Try(panic(bug)) returned")
+	}()
+}
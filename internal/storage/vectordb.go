@@ -6,18 +6,40 @@ package storage
 
 import (
 	"cmp"
+	"encoding/json"
+	"iter"
+	"time"
 
 	"rsc.io/gaby/internal/llm"
+	"rsc.io/ordered"
 )
 
+// This file stores the following key schema in the database:
+//
+//	["storage.VectorModel", Namespace] => Model
+//	["storage.VectorDim", Namespace] => Dim
+//	["storage.VectorMismatch", Namespace] => JSON of VectorMismatch
+
+func init() {
+	RegisterSchema(
+		Schema{Kind: "storage.VectorModel", Key: "Namespace", Val: "Model"},
+		Schema{Kind: "storage.VectorDim", Key: "Namespace", Val: "Dim"},
+		Schema{Kind: "storage.VectorMismatch", Key: "Namespace", Val: "JSON of VectorMismatch"},
+	)
+}
+
 // A VectorDB is a vector database that implements
 // nearest-neighbor search over embedding vectors
 // corresponding to documents.
 type VectorDB interface {
 	// Set sets the vector associated with the given document ID to vec.
+	// All the vectors in a database must have the same dimension
+	// (see [VectorDim]); Set should reject and record
+	// (see [VectorMismatches]) any vector that does not.
 	Set(id string, vec llm.Vector)
 
-	// TODO: Add Delete.
+	// Delete deletes any vector associated with the given document ID.
+	Delete(id string)
 
 	// Get gets the vector associated with the given document ID.
 	// If no such document exists, Get returns nil, false.
@@ -47,7 +69,8 @@ type VectorBatch interface {
 	// Set sets the vector associated with the given document ID to vec.
 	Set(id string, vec llm.Vector)
 
-	// TODO: Add Delete.
+	// Delete deletes any vector associated with the given document ID.
+	Delete(id string)
 
 	// MaybeApply calls Apply if the VectorBatch is getting close to full.
 	// Every VectorBatch has a limit to how many operations can be batched,
@@ -78,3 +101,95 @@ func (x VectorResult) cmp(y VectorResult) int {
 	}
 	return cmp.Compare(x.ID, y.ID)
 }
+
+// VectorModel returns the embedding model recorded by [SetVectorModel]
+// for the vectors in the given vector database namespace,
+// or the empty string if none has been recorded.
+func VectorModel(db DB, namespace string) string {
+	model, _ := db.Get(ordered.Encode("storage.VectorModel", namespace))
+	return string(model)
+}
+
+// SetVectorModel records that the vectors in the given vector database
+// namespace are embeddings computed by model, which is a description of
+// the embedding configuration, such as "gemini/text-embedding-004".
+// Vectors computed by different models cannot be compared,
+// so a program can use [VectorModel] to check that it is using
+// the same model that computed the vectors it has stored.
+func SetVectorModel(db DB, namespace, model string) {
+	db.Set(ordered.Encode("storage.VectorModel", namespace), []byte(model))
+}
+
+// VectorDim returns the dimension of the vectors in the given
+// vector database namespace, as recorded by [SetVectorDim],
+// or 0 if none has been recorded.
+func VectorDim(db DB, namespace string) int {
+	val, ok := db.Get(ordered.Encode("storage.VectorDim", namespace))
+	if !ok {
+		return 0
+	}
+	var dim int64
+	if err := ordered.Decode(val, &dim); err != nil {
+		// unreachable unless corrupt storage
+		db.Panic("storage.VectorDim decode", "namespace", namespace, "err", err)
+	}
+	return int(dim)
+}
+
+// SetVectorDim records that the vectors in the given vector database
+// namespace have dim dimensions. A [VectorDB] records the dimension
+// of the first vector it stores, so that it can reject later vectors
+// of a different dimension, which usually come from a different
+// embedding model and cannot be compared with the rest.
+func SetVectorDim(db DB, namespace string, dim int) {
+	db.Set(ordered.Encode("storage.VectorDim", namespace), ordered.Encode(int64(dim)))
+}
+
+// A VectorMismatch records the vectors rejected by a vector database
+// namespace because their dimension did not match the namespace's.
+type VectorMismatch struct {
+	Namespace string
+	Dim       int       // dimension of namespace
+	Count     int64     // number of vectors rejected
+	ID        string    // document ID of most recent rejected vector
+	Len       int       // dimension of most recent rejected vector
+	Time      time.Time // time of most recent rejection
+}
+
+// RecordVectorMismatch records in db that the vector database namespace
+// with dimension dim rejected the vector for id, which had dimension n.
+// It is meant for use by [VectorDB] implementations.
+func RecordVectorMismatch(db DB, namespace string, dim int, id string, n int) {
+	key := ordered.Encode("storage.VectorMismatch", namespace)
+	m := &VectorMismatch{Namespace: namespace}
+	if val, ok := db.Get(key); ok {
+		if err := json.Unmarshal(val, m); err != nil {
+			// unreachable unless corrupt storage
+			db.Panic("storage.VectorMismatch decode", "namespace", namespace, "err", err)
+		}
+	}
+	m.Dim = dim
+	m.Count++
+	m.ID = id
+	m.Len = n
+	m.Time = time.Now()
+	db.Set(key, JSON(m))
+}
+
+// VectorMismatches returns an iterator over the records
+// of rejected vectors in all vector database namespaces in db,
+// in namespace order.
+func VectorMismatches(db DB) iter.Seq[*VectorMismatch] {
+	return func(yield func(*VectorMismatch) bool) {
+		for key, val := range db.Scan(ordered.Encode("storage.VectorMismatch"), ordered.Encode("storage.VectorMismatch", ordered.Inf)) {
+			var m VectorMismatch
+			if err := json.Unmarshal(val(), &m); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("storage.VectorMismatch decode", "key", Fmt(key), "err", err)
+			}
+			if !yield(&m) {
+				return
+			}
+		}
+	}
+}
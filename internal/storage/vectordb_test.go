@@ -28,3 +28,17 @@ func TestVectorResultCompare(t *testing.T) {
 		try(tt.y, tt.x, -tt.cmp)
 	}
 }
+
+func TestVectorModel(t *testing.T) {
+	db := MemDB()
+	if m := VectorModel(db, "x"); m != "" {
+		t.Errorf("VectorModel before Set = %q, want empty", m)
+	}
+	SetVectorModel(db, "x", "gemini/text-embedding-004")
+	if m := VectorModel(db, "x"); m != "gemini/text-embedding-004" {
+		t.Errorf("VectorModel = %q, want gemini/text-embedding-004", m)
+	}
+	if m := VectorModel(db, ""); m != "" {
+		t.Errorf("VectorModel of other namespace = %q, want empty", m)
+	}
+}
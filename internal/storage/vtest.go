@@ -5,7 +5,9 @@
 package storage
 
 import (
+	"fmt"
 	"math"
+	"math/rand/v2"
 	"reflect"
 	"slices"
 	"testing"
@@ -13,7 +15,27 @@ import (
 	"rsc.io/gaby/internal/llm"
 )
 
+// TestVectorDB runs conformance tests on the exact vector database
+// returned by newdb, which should be empty when TestVectorDB is called.
+// Each call to newdb must return a new connection to the same database,
+// so that TestVectorDB can check that flushed changes persist.
 func TestVectorDB(t *testing.T, newdb func() VectorDB) {
+	testVectorDB(t, newdb)
+	testVectorRandom(t, newdb, 1)
+}
+
+// TestApproxVectorDB is like [TestVectorDB] but for a vector database
+// implementing approximate nearest-neighbor search.
+// Searches on small corpora must still be exact, but on larger
+// corpora, Search need only find, on average, the fraction
+// minRecall of the true nearest neighbors.
+// The scores Search returns must still be exact.
+func TestApproxVectorDB(t *testing.T, newdb func() VectorDB, minRecall float64) {
+	testVectorDB(t, newdb)
+	testVectorRandom(t, newdb, minRecall)
+}
+
+func testVectorDB(t *testing.T, newdb func() VectorDB) {
 	vdb := newdb()
 
 	vdb.Set("orange2", embed("orange2"))
@@ -29,6 +51,17 @@ func TestVectorDB(t *testing.T, newdb func() VectorDB) {
 		// unreachable except bad vectordb
 		t.Errorf("Get(apple3) = %v, %v, want %v, true", v, ok, embed("apple3"))
 	}
+	vdb.Set("ignore2", nil)
+	for _, id := range []string{"ignore", "ignore2"} {
+		if v, ok := vdb.Get(id); ok {
+			// unreachable except bad vectordb
+			t.Errorf("Get(%s) of mismatched vector = %v, true, want nil, false", id, v)
+		}
+	}
+	if have := vdb.Search(embed("apple5")[:4], 5); len(have) != 0 {
+		// unreachable except bad vectordb
+		t.Errorf("Search with mismatched vector = %v, want none", have)
+	}
 
 	want := []VectorResult{
 		{"apple4", 0.9999961187341375},
@@ -52,10 +85,234 @@ func TestVectorDB(t *testing.T, newdb func() VectorDB) {
 		t.Errorf("Search(apple5, 3) in fresh database:\nhave %v\nwant %v", have, want)
 	}
 
+	vdb.Delete("apple4")
+	vdb.Delete("missing")
+	b = vdb.Batch()
+	b.Set("orange1", embed("orange1"))
+	b.Delete("orange1")
+	b.Delete("apple3")
+	b.Set("apple3", embed("apple3"))
+	b.Apply()
+	if v, ok := vdb.Get("apple4"); ok {
+		// unreachable except bad vectordb
+		t.Errorf("Get(apple4) after Delete = %v, true, want nil, false", v)
+	}
+	want = []VectorResult{
+		{"apple3", 0.9999843342970269},
+		{"orange2", 0.3785152783773009},
+	}
+	have = vdb.Search(embed("apple5"), 5)
+	if !reflect.DeepEqual(have, want) {
+		// unreachable except bad vectordb
+		t.Errorf("Search(apple5, 5) after Delete:\nhave %v\nwant %v", have, want)
+	}
+
+	vdb.Flush()
+
+	vdb = newdb()
+	have = vdb.Search(embed("apple5"), 5)
+	if !reflect.DeepEqual(have, want) {
+		// unreachable except bad vectordb
+		t.Errorf("Search(apple5, 5) after Delete in fresh database:\nhave %v\nwant %v", have, want)
+	}
+
+	vdb.Delete("apple3")
+	vdb.Delete("orange2")
+	vdb.Flush()
+}
+
+// testVectorRandom tests vdb with a larger corpus of random vectors,
+// checking that searches find at least the fraction minRecall
+// of the true nearest neighbors, before and after deletions
+// and after reopening the database.
+func testVectorRandom(t *testing.T, newdb func() VectorDB, minRecall float64) {
+	const (
+		N       = 2000 // vectors
+		queries = 50
+		k       = 10 // neighbors per query
+	)
+	exact := minRecall >= 1
+	r := rand.New(rand.NewPCG(1, 2))
+	corpus := make(map[string]llm.Vector)
+
+	vdb := newdb()
+	b := vdb.Batch()
+	for i := range N {
+		id := fmt.Sprintf("rand%04d", i)
+		v := randVector(r, vectorLen)
+		corpus[id] = v
+		if i%2 == 0 {
+			vdb.Set(id, v)
+		} else {
+			b.Set(id, v)
+			b.MaybeApply()
+		}
+	}
+	b.Apply()
+	for id, v := range corpus {
+		if have, ok := vdb.Get(id); !ok || !slices.Equal(have, v) {
+			// unreachable except bad vectordb
+			t.Fatalf("Get(%s) = %v, %v, want %v, true", id, have, ok, v)
+		}
+	}
+
+	// check runs the queries against vdb.
+	check := func(when string) {
+		t.Helper()
+		qr := rand.New(rand.NewPCG(3, 4))
+		total := 0.0
+		for range queries {
+			q := randVector(qr, vectorLen)
+			want := bruteSearch(corpus, q, k)
+			have := vdb.Search(q, k)
+			if len(have) != k {
+				// unreachable except bad vectordb
+				t.Fatalf("%s: Search returned %d results, want %d", when, len(have), k)
+			}
+			found := 0
+			for i, res := range have {
+				v, ok := corpus[res.ID]
+				if !ok {
+					// unreachable except bad vectordb
+					t.Fatalf("%s: Search returned unknown or deleted ID %q", when, res.ID)
+				}
+				if d := math.Abs(res.Score - q.Dot(v)); d > 1e-6 {
+					// unreachable except bad vectordb
+					t.Fatalf("%s: Search returned %s with score %v, want %v", when, res.ID, res.Score, q.Dot(v))
+				}
+				if i > 0 && res.Score > have[i-1].Score {
+					// unreachable except bad vectordb
+					t.Fatalf("%s: Search results out of order: %v", when, have)
+				}
+				if slices.ContainsFunc(want, func(w VectorResult) bool { return w.ID == res.ID }) {
+					found++
+				}
+			}
+			if exact && !reflect.DeepEqual(have, want) {
+				// unreachable except bad vectordb
+				t.Fatalf("%s: Search:\nhave %v\nwant %v", when, have, want)
+			}
+			total += float64(found) / k
+		}
+		if recall := total / queries; recall < minRecall {
+			// unreachable except bad vectordb
+			t.Fatalf("%s: recall = %.3f, want ≥ %.3f", when, recall, minRecall)
+		}
+	}
+	check("random corpus")
+
+	// Delete a quarter of the vectors, a few directly and the rest in a batch.
+	b = vdb.Batch()
+	for i := 0; i < N; i += 4 {
+		id := fmt.Sprintf("rand%04d", i)
+		delete(corpus, id)
+		if i%100 == 0 {
+			vdb.Delete(id)
+		} else {
+			b.Delete(id)
+		}
+	}
+	b.Apply()
+	for i := 0; i < N; i += 4 {
+		id := fmt.Sprintf("rand%04d", i)
+		if _, ok := vdb.Get(id); ok {
+			// unreachable except bad vectordb
+			t.Fatalf("Get(%s) after Delete succeeded", id)
+		}
+	}
+	check("after delete")
+	if exact {
+		if n := len(vdb.Search(randVector(r, vectorLen), 2*N)); n != len(corpus) {
+			// unreachable except bad vectordb
+			t.Fatalf("Search for all vectors returned %d, want %d", n, len(corpus))
+		}
+	}
+
+	vdb.Flush()
+	vdb = newdb()
+	check("after reopen")
+}
+
+// bruteSearch returns the n vectors in corpus closest to q,
+// as an exact [VectorDB.Search] would.
+func bruteSearch(corpus map[string]llm.Vector, q llm.Vector, n int) []VectorResult {
+	var all []VectorResult
+	for id, v := range corpus {
+		all = append(all, VectorResult{id, q.Dot(v)})
+	}
+	slices.SortFunc(all, func(x, y VectorResult) int { return y.cmp(x) })
+	return all[:min(n, len(all))]
+}
+
+// randVector returns a random unit vector with n dimensions.
+func randVector(r *rand.Rand, n int) llm.Vector {
+	v := make(llm.Vector, n)
+	d := 0.0
+	for i := range v {
+		x := r.NormFloat64()
+		v[i] = float32(x)
+		d += x * x
+	}
+	d = 1 / math.Sqrt(d)
+	for i := range v {
+		v[i] = float32(float64(v[i]) * d)
+	}
+	return v
 }
 
+// BenchmarkVectorDB runs benchmarks of Set, batched Set, and Search
+// on vector databases returned by newdb, with vectors of
+// a typical embedding size. Each call to newdb must return
+// a new, empty database.
+func BenchmarkVectorDB(b *testing.B, newdb func() VectorDB) {
+	const dim = 768
+	r := rand.New(rand.NewPCG(1, 2))
+	vecs := make([]llm.Vector, 1000)
+	for i := range vecs {
+		vecs[i] = randVector(r, dim)
+	}
+
+	b.Run("Set", func(b *testing.B) {
+		vdb := newdb()
+		b.ResetTimer()
+		for i := range b.N {
+			vdb.Set(fmt.Sprint(i), vecs[i%len(vecs)])
+		}
+	})
+
+	b.Run("BatchSet", func(b *testing.B) {
+		vdb := newdb()
+		batch := vdb.Batch()
+		b.ResetTimer()
+		for i := range b.N {
+			batch.Set(fmt.Sprint(i), vecs[i%len(vecs)])
+			batch.MaybeApply()
+		}
+		batch.Apply()
+	})
+
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("Search%d", n), func(b *testing.B) {
+			vdb := newdb()
+			batch := vdb.Batch()
+			for i := range n {
+				batch.Set(fmt.Sprint(i), vecs[i%len(vecs)])
+				batch.MaybeApply()
+			}
+			batch.Apply()
+			q := randVector(r, dim)
+			b.ResetTimer()
+			for range b.N {
+				vdb.Search(q, 10)
+			}
+		})
+	}
+}
+
+// vectorLen is the dimension of the vectors in the tests.
+const vectorLen = 16
+
 func embed(text string) llm.Vector {
-	const vectorLen = 16
 	v := make(llm.Vector, vectorLen)
 	d := float32(0)
 	for i := range len(text) {
@@ -0,0 +1,584 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package summary implements summarizing long GitHub issue threads.
+//
+// A [Summarizer] asks an LLM (see [llm.TextGenerator]) to summarize
+// an issue's timeline: its description, comments, and metadata events
+// such as labeling and closing.
+// It summarizes an issue when a maintainer asks for it with a command comment
+// (see [Summarizer.EnableCommand]) and, optionally, automatically
+// each time a thread grows by a configured number of comments
+// (see [Summarizer.SetAutoComments]).
+// It records each summary in the database (see [Summarizer.Summary])
+// and, like other Gaby posters, posts it to the issue
+// only once [Summarizer.EnablePosts] has been called.
+// Before posting, it checks each summary with a [safety.Filter]
+// (see [Summarizer.SetFilter]), holding rejected summaries
+// for a maintainer's approval (see [Summarizer.ApproveSummary]).
+package summary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/safety"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/storage/timed"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["summary.Summary", Name, Project, Issue] => JSON of Record
+//	["summary.Held", Name, Project, Issue] => JSON of heldRecord
+//
+// and uses the [storage.BeginAction] keys
+// ["summary.Command", Project, Issue, CommentID] and ["summary.Auto", Project, Issue, K],
+// where K is the number of comments at the time of the summary
+// divided by the automatic summary interval.
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "summary.Summary", Key: "Name, Project, Issue", Val: "JSON of Record"},
+		storage.Schema{Kind: "summary.Held", Key: "Name, Project, Issue", Val: "JSON of heldRecord"},
+	)
+}
+
+// A Summarizer summarizes issue threads.
+type Summarizer struct {
+	slog        *slog.Logger
+	db          storage.DB
+	github      *github.Client
+	llm         llm.TextGenerator
+	projects    map[string]bool
+	watcher     *timed.Watcher[*github.Event]
+	name        string
+	command     string
+	maintainers map[string]bool
+	auto        int
+	timeLimit   time.Time
+	maxText     int
+	tokens      llm.TokenCounter
+	maxTokens   int
+	footer      *footer.Footer
+	filter      safety.Filter
+	post        bool
+	now         func() time.Time // for testing
+}
+
+// New creates and returns a new Summarizer. It logs to lg, stores state in db,
+// watches for GitHub issue activity using gh, and generates summaries using gen.
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Summarizer] methods to configure the parameters
+// (especially [Summarizer.EnableProject] and [Summarizer.EnablePosts])
+// before calling [Summarizer.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, gen llm.TextGenerator, name string) *Summarizer {
+	return &Summarizer{
+		slog:      lg,
+		db:        db,
+		github:    gh,
+		llm:       gen,
+		projects:  make(map[string]bool),
+		watcher:   gh.EventWatcher("summary.Summarizer:" + name),
+		name:      name,
+		timeLimit: time.Now().Add(-defaultTooOld),
+		maxText:   defaultMaxText,
+		footer:    footer.Default(),
+		filter:    safety.Default(),
+		now:       time.Now,
+	}
+}
+
+// defaultMaxText is the default maximum length of the text
+// of a single issue body or comment in the prompt.
+const defaultMaxText = 4000
+
+// EnableProject enables the Summarizer to summarize issues in the given GitHub project
+// (for example "golang/go").
+// See also [Summarizer.EnablePosts], which must also be called to post anything to GitHub.
+func (s *Summarizer) EnableProject(project string) {
+	s.projects[project] = true
+}
+
+// EnablePosts enables the Summarizer to post summaries to GitHub.
+// If EnablePosts has not been called, [Summarizer.Run] records the summaries
+// in the database and logs what it would post but does not post the messages.
+func (s *Summarizer) EnablePosts() {
+	s.post = true
+}
+
+// EnableCommand enables summarizing on demand:
+// when one of the named maintainers posts a comment
+// containing a line consisting of cmd (for example "@gabyhelp summarize"),
+// [Summarizer.Run] summarizes the issue, once per such comment.
+func (s *Summarizer) EnableCommand(cmd string, maintainers ...string) {
+	s.command = cmd
+	s.maintainers = make(map[string]bool)
+	for _, m := range maintainers {
+		s.maintainers[m] = true
+	}
+}
+
+// SetAutoComments enables summarizing automatically
+// each time an issue thread reaches another multiple of n comments,
+// not counting Gaby's own comments or bare summary commands.
+// If n is zero, the default, automatic summaries are disabled.
+func (s *Summarizer) SetAutoComments(n int) {
+	s.auto = n
+}
+
+// SetTimeLimit controls how old a comment can be for the Summarizer to consider it.
+// Comments created before time t are ignored.
+// The default is to ignore comments that are more than 48 hours old
+// at the time of the call to [New].
+func (s *Summarizer) SetTimeLimit(t time.Time) {
+	s.timeLimit = t
+}
+
+const defaultTooOld = 48 * time.Hour
+
+// SetMaxText sets the maximum length of the text of a single
+// issue body or comment included in the prompt;
+// longer texts are truncated.
+// The default is 4000 bytes.
+func (s *Summarizer) SetMaxText(n int) {
+	s.maxText = n
+}
+
+// SetTokenBudget limits the prompt for a summary to max tokens,
+// as counted by tc. When an issue's thread does not fit,
+// the prompt includes the issue itself and as many of the most recent
+// comments and events as fit, omitting the earlier ones.
+// By default, there is no limit other than [Summarizer.SetMaxText].
+func (s *Summarizer) SetTokenBudget(tc llm.TokenCounter, max int) {
+	s.tokens = tc
+	s.maxTokens = max
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (s *Summarizer) SetFooter(f *footer.Footer) {
+	s.footer = f
+}
+
+// SetFilter sets the filter used to check each summary before posting it.
+// Summaries that the filter rejects, or cannot check, are held
+// for approval instead of being posted (see [Summarizer.Held]).
+// The default is [safety.Default].
+func (s *Summarizer) SetFilter(f safety.Filter) {
+	s.filter = f
+}
+
+// A Record is the database record of an issue's most recent summary.
+type Record struct {
+	Time     time.Time // time of summary
+	Comments int       // number of comments summarized
+	Text     string    // summary text, in Markdown
+	URL      string    `json:",omitempty"` // API URL of posted summary, if any
+}
+
+// Summary returns the most recent summary of the given issue,
+// or nil if the issue has not been summarized.
+func (s *Summarizer) Summary(project string, issue int64) *Record {
+	key := ordered.Encode("summary.Summary", s.name, project, issue)
+	val, ok := s.db.Get(key)
+	if !ok {
+		return nil
+	}
+	var r Record
+	if err := json.Unmarshal(val, &r); err != nil {
+		// unreachable unless corrupt storage
+		s.db.Panic("summary decode", "key", storage.Fmt(key), "err", err)
+	}
+	return &r
+}
+
+// Run runs a single round of summarizing.
+// It scans the issue comments in the enabled projects that have been
+// posted since the last call to [Summarizer.Run] using a Summarizer with
+// the same name (see [New]), looking for summary commands
+// (see [Summarizer.EnableCommand]) and for threads that have grown
+// enough to be summarized automatically (see [Summarizer.SetAutoComments]).
+// For each such issue, Run generates a summary, records it in the database,
+// and posts it to the issue.
+// Each command and each automatic threshold produces at most one summary.
+//
+// Run logs each post to the [slog.Logger] passed to [New].
+// If [Summarizer.EnablePosts] has been called, then Run also posts the summary to GitHub
+// and advances its GitHub issue watcher's incremental cursor to speed future calls to Run.
+// When [Summarizer.EnablePosts] has not been called, Run only records and logs the summaries.
+//
+// If ctx is canceled, Run stops before the next comment.
+func (s *Summarizer) Run(ctx context.Context) {
+	s.slog.Info("summary.Summarizer start", "name", s.name)
+	defer s.slog.Info("summary.Summarizer end", "name", s.name)
+
+	defer s.watcher.Flush()
+
+	for e := range s.watcher.Recent() {
+		if ctx.Err() != nil {
+			return
+		}
+		if !s.projects[e.Project] || e.API != "/issues/comments" {
+			continue
+		}
+		if ok := s.check(e); ok && s.post {
+			s.watcher.MarkOld(e.DBTime)
+			s.watcher.Flush()
+		}
+	}
+}
+
+// check checks whether the comment event e calls for a summary
+// and if so summarizes the issue.
+// It reports whether the event has been handled
+// (as opposed to needing a retry).
+func (s *Summarizer) check(e *github.Event) bool {
+	c := e.Typed.(*github.IssueComment)
+	created, err := time.Parse(time.RFC3339, c.CreatedAt)
+	if err != nil {
+		s.slog.Error("summary parse createdat", "CreatedAt", c.CreatedAt, "err", err)
+		return true
+	}
+	if created.Before(s.timeLimit) {
+		return true
+	}
+	var action []byte
+	if s.command != "" && s.maintainers[c.User.Login] && hasCommand(c.Body, s.command) {
+		action = ordered.Encode("summary.Command", e.Project, e.Issue, c.CommentID())
+	} else if s.auto > 0 && s.counts(c) {
+		n := 0
+		for _, e := range s.github.Timeline(e.Project, e.Issue) {
+			if x, ok := e.Typed.(*github.IssueComment); ok && s.counts(x) {
+				n++
+			}
+		}
+		if n < s.auto {
+			return true
+		}
+		action = ordered.Encode("summary.Auto", e.Project, e.Issue, n/s.auto)
+	} else {
+		return true
+	}
+	if s.post {
+		if _, ok := storage.LookupAction(s.db, action); ok {
+			return true
+		}
+	} else if r := s.Summary(e.Project, e.Issue); r != nil && !r.Time.Before(created) {
+		// Already summarized in dry-run mode.
+		return true
+	}
+
+	issue, err := s.github.LookupIssue(e.Project, e.Issue)
+	if err != nil {
+		s.slog.Error("summary.Summarizer lookup", "project", e.Project, "issue", e.Issue, "err", err)
+		return true
+	}
+	if err := s.summarizeAndPost(issue, action); err != nil {
+		s.slog.Error("summary.Summarizer", "project", e.Project, "issue", e.Issue, "err", err)
+		return false
+	}
+	return true
+}
+
+// Post summarizes the issue and posts the summary, on demand.
+// Like [Summarizer.Run], Post records the summary in the database
+// and only logs the post unless [Summarizer.EnablePosts] has been called.
+// Unlike Run, Post does not ensure that each request is handled at most once;
+// that is the caller's responsibility.
+func (s *Summarizer) Post(issue *github.Issue) error {
+	return s.summarizeAndPost(issue, nil)
+}
+
+// summarizeAndPost summarizes the issue and posts the summary.
+// If action is not nil, it is the [storage.BeginAction] key
+// ensuring the post happens at most once.
+func (s *Summarizer) summarizeAndPost(issue *github.Issue, action []byte) error {
+	project := issue.Project()
+	r, err := s.Summarize(project, issue.Number)
+	if err != nil {
+		return err
+	}
+	body := s.comment(project, r)
+	s.slog.Info("summary.Summarizer post", "name", s.name, "project", project, "issue", issue.Number, "comments", r.Comments, "comment", body)
+	reason, err := s.filter.Check(r.Text)
+	if err != nil {
+		reason = "filter error: " + err.Error()
+	}
+	if reason != "" {
+		s.slog.Warn("summary.Summarizer hold", "name", s.name, "project", project, "issue", issue.Number, "reason", reason)
+		if s.post {
+			key := ordered.Encode("summary.Held", s.name, project, issue.Number)
+			s.db.Set(key, storage.JSON(&heldRecord{Record: *r, Reason: reason}))
+			s.db.Flush()
+		}
+		return nil
+	}
+	if !s.post || action != nil && !storage.BeginAction(s.db, action) {
+		return nil
+	}
+	return s.postSummary(issue, r, action)
+}
+
+// postSummary posts the summary r to the issue, recording the posted URL.
+// If action is not nil, it is the [storage.BeginAction] key,
+// which the caller has begun.
+func (s *Summarizer) postSummary(issue *github.Issue, r *Record, action []byte) error {
+	project := issue.Project()
+	url, err := s.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: s.comment(project, r)})
+	if err != nil {
+		if action != nil {
+			storage.CancelAction(s.db, action)
+		}
+		return err
+	}
+	if action != nil {
+		storage.FinishAction(s.db, action, url)
+	}
+	r.URL = url
+	s.db.Set(ordered.Encode("summary.Summary", s.name, project, issue.Number), storage.JSON(r))
+	s.db.Flush()
+	return nil
+}
+
+// A heldRecord is the database record of a summary held for approval.
+type heldRecord struct {
+	Record
+	Reason string // reason the filter rejected the summary
+}
+
+// A HeldSummary is a summary held for approval (see [Summarizer.SetFilter]).
+type HeldSummary struct {
+	Project string
+	Issue   int64
+	Text    string // summary text
+	Reason  string // reason the filter rejected the summary
+}
+
+// Held returns an iterator over the summaries held for approval.
+func (s *Summarizer) Held() iter.Seq[*HeldSummary] {
+	return func(yield func(*HeldSummary) bool) {
+		start := ordered.Encode("summary.Held", s.name)
+		end := ordered.Encode("summary.Held", s.name, ordered.Inf)
+		for key, val := range s.db.Scan(start, end) {
+			var project string
+			var issue int64
+			if err := ordered.Decode(key, nil, nil, &project, &issue); err != nil {
+				// unreachable unless corrupt storage
+				s.db.Panic("summary held decode", "key", storage.Fmt(key), "err", err)
+			}
+			h := s.decodeHeld(key, val())
+			if !yield(&HeldSummary{Project: project, Issue: issue, Text: h.Text, Reason: h.Reason}) {
+				return
+			}
+		}
+	}
+}
+
+// ApproveSummary posts the summary of the issue that is held for approval,
+// exactly as it was generated.
+// ApproveSummary returns an error if there is no such held summary,
+// or if posts have not been enabled (see [Summarizer.EnablePosts]).
+func (s *Summarizer) ApproveSummary(project string, issue int64) error {
+	key := ordered.Encode("summary.Held", s.name, project, issue)
+	val, ok := s.db.Get(key)
+	if !ok {
+		return fmt.Errorf("summary: no held summary for %s#%d", project, issue)
+	}
+	if !s.post {
+		return fmt.Errorf("summary: posts not enabled")
+	}
+	h := s.decodeHeld(key, val)
+	iss, err := s.github.LookupIssue(project, issue)
+	if err != nil {
+		return err
+	}
+	s.slog.Info("summary.Summarizer approved post", "name", s.name, "project", project, "issue", issue)
+	if err := s.postSummary(iss, &h.Record, nil); err != nil {
+		return err
+	}
+	s.db.Delete(key)
+	s.db.Flush()
+	return nil
+}
+
+// RejectSummary discards the summary of the issue that is held for approval.
+// RejectSummary returns an error if there is no such held summary.
+func (s *Summarizer) RejectSummary(project string, issue int64) error {
+	key := ordered.Encode("summary.Held", s.name, project, issue)
+	if _, ok := s.db.Get(key); !ok {
+		return fmt.Errorf("summary: no held summary for %s#%d", project, issue)
+	}
+	s.db.Delete(key)
+	s.db.Flush()
+	return nil
+}
+
+func (s *Summarizer) decodeHeld(key, val []byte) *heldRecord {
+	var h heldRecord
+	if err := json.Unmarshal(val, &h); err != nil {
+		// unreachable unless corrupt storage
+		s.db.Panic("summary held decode", "key", storage.Fmt(key), "err", err)
+	}
+	return &h
+}
+
+// hasCommand reports whether body contains a line consisting of cmd.
+func hasCommand(body, cmd string) bool {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.TrimSpace(line) == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// isGaby reports whether body is a comment posted by Gaby.
+func isGaby(body string) bool {
+	_, ok := footer.Poster(body)
+	return ok
+}
+
+// counts reports whether the comment c counts as part of the discussion:
+// it must not be Gaby's own comment or a bare summary command.
+func (s *Summarizer) counts(c *github.IssueComment) bool {
+	return !isGaby(c.Body) && (s.command == "" || strings.TrimSpace(c.Body) != s.command)
+}
+
+// comment returns the text of a comment posting the summary r.
+func (s *Summarizer) comment(project string, r *Record) string {
+	return fmt.Sprintf("**Summary of the discussion so far** (%d comments):\n\n%s\n%s",
+		r.Comments, strings.TrimSpace(r.Text), s.footer.Render("summary", project))
+}
+
+// summaryPrompt is the instruction given to the LLM before the issue thread.
+const summaryPrompt = `Summarize the following GitHub issue discussion for a project maintainer who has not read it.
+Describe the problem being reported or the change being proposed,
+the main points raised in the discussion, including any disagreements,
+any conclusions or decisions reached, and what, if anything, remains to be done.
+Refer to participants by their GitHub user names, without an @ sign, so that they are not notified.
+Do not speculate beyond what the discussion says.
+Write at most 250 words, as a short Markdown bulleted list.`
+
+// Summarize generates a summary of the given issue
+// and records it in the database, returning the new record.
+// Summarize does not post anything to GitHub.
+func (s *Summarizer) Summarize(project string, issue int64) (*Record, error) {
+	entries, n := s.entries(project, issue)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s#%d not in database", project, issue)
+	}
+	text, err := s.fit(entries)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.llm.GenerateText(summaryPrompt, text)
+	if err != nil {
+		return nil, err
+	}
+	r := &Record{Time: s.now(), Comments: n, Text: out}
+	s.db.Set(ordered.Encode("summary.Summary", s.name, project, issue), storage.JSON(r))
+	s.db.Flush()
+	return r, nil
+}
+
+// thread returns the issue timeline formatted as text for the prompt,
+// along with the number of comments it includes.
+// Gaby's own comments and bare summary commands are omitted.
+func (s *Summarizer) thread(project string, issue int64) (string, int) {
+	entries, n := s.entries(project, issue)
+	return strings.Join(entries, ""), n
+}
+
+// fit returns the entries formatted as text for the prompt,
+// omitting early comments and events as needed to fit in the
+// token budget (see [Summarizer.SetTokenBudget]).
+// The first entry, the issue itself, is always included.
+func (s *Summarizer) fit(entries []string) (string, error) {
+	if s.tokens == nil || len(entries) == 0 {
+		return strings.Join(entries, ""), nil
+	}
+	fixed, err := s.tokens.CountTokens(summaryPrompt + entries[0])
+	if err != nil {
+		return "", err
+	}
+	rest := slices.Clone(entries[1:])
+	slices.Reverse(rest)
+	n, err := llm.Pack(s.tokens, s.maxTokens-fixed, rest...)
+	if err != nil {
+		return "", err
+	}
+	if n == len(rest) {
+		return strings.Join(entries, ""), nil
+	}
+	recent := rest[:n]
+	slices.Reverse(recent)
+	omit := fmt.Sprintf("[… %d earlier comments and events omitted]\n\n", len(rest)-n)
+	return entries[0] + omit + strings.Join(recent, ""), nil
+}
+
+// entries returns the issue timeline formatted as a list of
+// text entries for the prompt, one per issue, comment, or event,
+// along with the number of comments it includes.
+func (s *Summarizer) entries(project string, issue int64) ([]string, int) {
+	var list []string
+	n := 0
+	for _, e := range s.github.Timeline(project, issue) {
+		date, _, _ := strings.Cut(e.CreatedAt(), "T")
+		switch x := e.Typed.(type) {
+		case *github.Issue:
+			list = append(list, fmt.Sprintf("Issue #%d: %s\nOpened by %s on %s:\n\n%s\n\n", x.Number, x.Title, x.User.Login, date, s.truncate(x.Body)))
+		case *github.IssueComment:
+			if !s.counts(x) {
+				continue
+			}
+			n++
+			list = append(list, fmt.Sprintf("Comment by %s on %s:\n\n%s\n\n", x.User.Login, date, s.truncate(x.Body)))
+		case *github.IssueEvent:
+			var what string
+			switch x.Event {
+			case "closed", "reopened":
+				what = x.Event + " the issue"
+			case "labeled", "unlabeled":
+				var names []string
+				for _, l := range x.Labels {
+					names = append(names, l.Name)
+				}
+				what = x.Event + " " + strings.Join(names, ", ")
+			case "milestoned":
+				what = "added the issue to milestone " + x.Milestone.Title
+			case "demilestoned":
+				what = "removed the issue from milestone " + x.Milestone.Title
+			case "renamed":
+				what = fmt.Sprintf("retitled the issue %q", x.Rename.To)
+			default:
+				continue
+			}
+			list = append(list, fmt.Sprintf("Event: %s %s on %s.\n\n", x.Actor.Login, what, date))
+		}
+	}
+	return list, n
+}
+
+// truncate truncates text to at most s.maxText bytes.
+func (s *Summarizer) truncate(text string) string {
+	text = strings.TrimSpace(text)
+	if len(text) <= s.maxText {
+		return text
+	}
+	text = strings.ToValidUTF8(text[:s.maxText], "")
+	return text + "\n[… truncated]"
+}
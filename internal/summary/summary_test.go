@@ -0,0 +1,337 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/diff"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/gemini"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/httprr"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/safety"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// addThread adds a test issue thread to gh.
+func addThread(gh *github.Client) {
+	tc := gh.Testing()
+	tc.AddIssue("rsc/tmp", &github.Issue{
+		Number:    1,
+		Title:     "io: Copy is slow",
+		User:      github.User{Login: "alice"},
+		CreatedAt: "2024-06-01T10:00:00Z",
+		Body:      "io.Copy from a file to a socket takes twice as long as cat.\n",
+	})
+	tc.AddIssueEvent("rsc/tmp", 1, &github.IssueEvent{
+		Actor:     github.User{Login: "bob"},
+		Event:     "labeled",
+		Labels:    []github.Label{{Name: "Performance"}, {Name: "NeedsInvestigation"}},
+		CreatedAt: "2024-06-01T11:00:00Z",
+	})
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "bob"},
+		CreatedAt: "2024-06-02T10:00:00Z",
+		Body:      "Does the file implement WriterTo? " + strings.Repeat("x", 100),
+	})
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "gabyhelp"},
+		CreatedAt: "2024-06-02T11:00:00Z",
+		Body:      "Related issues:\n" + footer.Marker("related"),
+	})
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "alice"},
+		CreatedAt: "2024-06-03T10:00:00Z",
+		Body:      "No, it is wrapped in a bufio.Reader.",
+	})
+	tc.AddIssueEvent("rsc/tmp", 1, &github.IssueEvent{
+		Actor:     github.User{Login: "bob"},
+		Event:     "milestoned",
+		Milestone: github.Milestone{Title: "Backlog"},
+		CreatedAt: "2024-06-03T11:00:00Z",
+	})
+	tc.AddIssueEvent("rsc/tmp", 1, &github.IssueEvent{
+		Actor:     github.User{Login: "bob"},
+		Event:     "subscribed",
+		CreatedAt: "2024-06-03T11:00:00Z",
+	})
+}
+
+const wantThread = `Issue #1: io: Copy is slow
+Opened by alice on 2024-06-01:
+
+io.Copy from a file to a socket takes twice as long as cat.
+
+Event: bob labeled Performance, NeedsInvestigation on 2024-06-01.
+
+Comment by bob on 2024-06-02:
+
+Does the file implement WriterTo? xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx
+[… truncated]
+
+Comment by alice on 2024-06-03:
+
+No, it is wrapped in a bufio.Reader.
+
+Event: bob added the issue to milestone Backlog on 2024-06-03.
+
+`
+
+func TestThread(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addThread(gh)
+
+	s := New(lg, db, gh, nil, "test")
+	s.SetMaxText(len("Does the file implement WriterTo? ") + 53)
+	text, n := s.thread("rsc/tmp", 1)
+	if text != wantThread || n != 2 {
+		t.Errorf("thread: n=%d (want 2)\n%s", n, diff.Diff("want", []byte(wantThread), "have", []byte(text)))
+	}
+}
+
+func TestFit(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	s := New(lg, db, github.New(lg, db, nil, nil), nil, "test")
+	entries := []string{"Issue #1\n\n", strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)}
+	all := strings.Join(entries, "")
+	if text, err := s.fit(entries); text != all || err != nil {
+		t.Errorf("fit without budget = %q, %v", text, err)
+	}
+
+	tc := llm.ApproxTokenCounter()
+	fixed, _ := tc.CountTokens(summaryPrompt + entries[0])
+	s.SetTokenBudget(tc, fixed+30)
+	if text, err := s.fit(entries); text != all || err != nil {
+		t.Errorf("fit with large budget = %q, %v", text, err)
+	}
+	s.SetTokenBudget(tc, fixed+25)
+	want := entries[0] + "[… 1 earlier comments and events omitted]\n\n" + entries[2] + entries[3]
+	if text, err := s.fit(entries); text != want || err != nil {
+		t.Errorf("fit with small budget = %q, %v, want %q", text, err, want)
+	}
+}
+
+// testLLM is a TextGenerator that records its prompts
+// and returns a fixed summary.
+type testLLM struct {
+	prompts [][]string
+}
+
+func (g *testLLM) GenerateText(prompt ...string) (string, error) {
+	g.prompts = append(g.prompts, prompt)
+	return fmt.Sprintf(" - Summary %d.\n", len(g.prompts)), nil
+}
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addThread(gh)
+
+	gen := new(testLLM)
+	s := New(lg, db, gh, gen, "test")
+	s.EnableProject("rsc/tmp")
+	s.EnableCommand("@gabyhelp summarize", "bob")
+	s.SetTimeLimit(time.Time{})
+	now := time.Date(2024, 6, 4, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// No commands and no automatic summaries.
+	s.Run(ctx)
+	if len(gen.prompts) != 0 {
+		t.Fatalf("summarized without trigger")
+	}
+
+	// Non-maintainer commands are ignored; maintainer commands are obeyed,
+	// but only logged until posts are enabled.
+	tc := gh.Testing()
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "mallory"},
+		CreatedAt: "2024-06-03T12:00:00Z",
+		Body:      "@gabyhelp summarize",
+	})
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "bob"},
+		CreatedAt: "2024-06-03T13:00:00Z",
+		Body:      "This is getting long.\n@gabyhelp summarize\n",
+	})
+	s.Run(ctx)
+	s.Run(ctx)
+	if len(gen.prompts) != 1 {
+		t.Fatalf("dry run summarized %d times, want 1", len(gen.prompts))
+	}
+	if p := gen.prompts[0]; len(p) != 2 || p[0] != summaryPrompt || !strings.HasPrefix(p[1], "Issue #1: io: Copy is slow\n") {
+		t.Errorf("prompt = %q", p)
+	}
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("dry run posted: %v", edits)
+	}
+	if r := s.Summary("rsc/tmp", 1); r == nil || r.Text != " - Summary 1.\n" || r.Comments != 3 || r.URL != "" {
+		t.Errorf("Summary after dry run = %+v", r)
+	}
+
+	s.EnablePosts()
+	now = now.Add(time.Hour)
+	s.Run(ctx)
+	s.Run(ctx)
+	edits := tc.Edits()
+	if len(edits) != 1 {
+		t.Fatalf("posted %d summaries, want 1: %v", len(edits), edits)
+	}
+	want := "**Summary of the discussion so far** (3 comments):\n\n- Summary 2.\n" + footer.Default().Render("summary", "rsc/tmp")
+	if body := edits[0].IssueCommentChanges.Body; body != want {
+		t.Errorf("posted:\n%s", diff.Diff("want", []byte(want), "have", []byte(body)))
+	}
+	if r := s.Summary("rsc/tmp", 1); r == nil || r.Text != " - Summary 2.\n" || !r.Time.Equal(now) || r.URL == "" {
+		t.Errorf("Summary after post = %+v", r)
+	}
+	tc.ClearEdits()
+
+	// Automatic summaries every 5 comments.
+	s.SetAutoComments(5)
+	s.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("posted early automatic summary: %v", edits)
+	}
+	for _, who := range []string{"carol", "dave"} {
+		tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+			User:      github.User{Login: who},
+			CreatedAt: "2024-06-04T13:00:00Z",
+			Body:      "Me too.",
+		})
+	}
+	s.Run(ctx)
+	s.Run(ctx)
+	if edits := tc.Edits(); len(edits) != 1 || !strings.Contains(edits[0].IssueCommentChanges.Body, "(5 comments)") {
+		t.Fatalf("automatic summary: %v", edits)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addThread(gh)
+
+	gen := new(testLLM)
+	s := New(lg, db, gh, gen, "test")
+	s.EnableProject("rsc/tmp")
+	s.EnableCommand("@gabyhelp summarize", "bob")
+	s.SetTimeLimit(time.Time{})
+	s.SetFilter(safety.Deny(regexp.MustCompile(`Summary 1\.`)))
+	s.EnablePosts()
+
+	tc := gh.Testing()
+	tc.AddIssueComment("rsc/tmp", 1, &github.IssueComment{
+		User:      github.User{Login: "bob"},
+		CreatedAt: "2024-06-03T13:00:00Z",
+		Body:      "@gabyhelp summarize",
+	})
+	s.Run(ctx)
+	s.Run(ctx)
+	if len(gen.prompts) != 1 {
+		t.Fatalf("summarized %d times, want 1", len(gen.prompts))
+	}
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Fatalf("posted rejected summary: %v", edits)
+	}
+	held := slices.Collect(s.Held())
+	if len(held) != 1 || held[0].Issue != 1 || held[0].Text != " - Summary 1.\n" || !strings.Contains(held[0].Reason, "deny-list") {
+		t.Fatalf("Held() = %v", held)
+	}
+
+	if err := s.ApproveSummary("rsc/tmp", 2); err == nil {
+		t.Errorf("ApproveSummary of unheld summary succeeded")
+	}
+	if err := s.ApproveSummary("rsc/tmp", 1); err != nil {
+		t.Fatal(err)
+	}
+	if edits := tc.Edits(); len(edits) != 1 || !strings.Contains(edits[0].IssueCommentChanges.Body, "Summary 1.") {
+		t.Fatalf("ApproveSummary posted %v", edits)
+	}
+	if r := s.Summary("rsc/tmp", 1); r == nil || r.URL == "" {
+		t.Errorf("Summary after approval = %+v", r)
+	}
+	if held := slices.Collect(s.Held()); len(held) != 0 {
+		t.Errorf("Held() after approval = %v", held)
+	}
+
+	// Rejection discards the summary.
+	tc.ClearEdits()
+	s.SetFilter(safety.Deny(regexp.MustCompile(`Summary`)))
+	issue, err := gh.LookupIssueURL("https://github.com/rsc/tmp/issues/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Post(issue); err != nil {
+		t.Fatal(err)
+	}
+	if held := slices.Collect(s.Held()); len(held) != 1 || held[0].Text != " - Summary 2.\n" {
+		t.Fatalf("Held() = %v", held)
+	}
+	if err := s.RejectSummary("rsc/tmp", 1); err != nil {
+		t.Fatal(err)
+	}
+	if held := slices.Collect(s.Held()); len(held) != 0 {
+		t.Errorf("Held() after rejection = %v", held)
+	}
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("posted rejected summary: %v", edits)
+	}
+}
+
+// TestGemini checks the summary prompt with a real LLM.
+// The recording is made with
+//
+//	go test -run=Gemini -httprecord=summary
+//
+// which requires a Gemini API key in $HOME/.netrc.
+// Without a recording, the test is skipped.
+func TestGemini(t *testing.T) {
+	check := testutil.Checker(t)
+	lg := testutil.Slogger(t)
+	rr, err := httprr.Open("testdata/summary.httprr", http.DefaultTransport)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("no recording")
+	}
+	check(err)
+	rr.Scrub(gemini.Scrub)
+	rr.ScrubResponse(gemini.ScrubResponse)
+	ai, err := gemini.NewClient(lg, secret.Netrc(), rr.Client())
+	check(err)
+
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addThread(gh)
+	s := New(lg, db, gh, ai, "test")
+	r, err := s.Summarize("rsc/tmp", 1)
+	check(err)
+	for _, word := range []string{"bufio", "WriterTo"} {
+		if !strings.Contains(r.Text, word) {
+			t.Errorf("summary does not mention %s:\n%s", word, r.Text)
+		}
+	}
+	if strings.Contains(r.Text, "@") {
+		t.Errorf("summary mentions users with @:\n%s", r.Text)
+	}
+}
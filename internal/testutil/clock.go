@@ -0,0 +1,66 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// A FakeClock is a clock for testing time-dependent code.
+// Its time changes only when the test changes it,
+// so that tests can check time-window behavior deterministically
+// by advancing the clock instead of constructing magic timestamps.
+//
+// Packages that depend on the time accept a clock as a pair of functions,
+// typically through a SetClock method, to which a test passes
+// the method values c.Now and c.Sleep.
+type FakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	sleeps []time.Duration
+}
+
+// NewFakeClock returns a new FakeClock set to the time t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set sets the clock's current time to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// Advance advances the clock's current time by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// Sleep records a sleep for d (see [FakeClock.Sleeps])
+// and advances the clock by d, without waiting.
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.t = c.t.Add(max(d, 0))
+}
+
+// Sleeps returns the durations passed to Sleep, oldest first.
+func (c *FakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
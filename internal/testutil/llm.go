@@ -0,0 +1,301 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/llm"
+)
+
+// An LLMServer is a fake LLM service for tests.
+// It implements the parts of the Gemini REST API
+// and the OpenAI-compatible REST API that Gaby uses
+// (embedding, text generation, token counting, and Gemini context caching),
+// with deterministic results: embeddings are computed by [llm.QuoteEmbedder],
+// so tests can recover the embedded text using [llm.UnquoteVector],
+// and generated text echoes the prompt (see [LLMServer.SetGenerate]).
+//
+// Unlike recorded HTTP traces, an LLMServer answers any request,
+// so it suits end-to-end tests whose exact requests vary.
+// Use [LLMServer.Client] for a [*http.Client] that sends every request
+// to the server, regardless of host, so that clients with fixed API URLs,
+// such as [rsc.io/gaby/internal/gemini.Client], reach it unmodified.
+// Use [LLMServer.URL] as the base URL for an OpenAI-compatible client.
+type LLMServer struct {
+	srv   *httptest.Server
+	embed llm.Embedder
+
+	mu       sync.Mutex
+	generate func(model, prompt string) string
+	fail     int // number of requests left to fail
+	code     int // status code for failures
+	requests []string
+	caches   int
+}
+
+// NewLLMServer starts and returns a new fake LLM server,
+// which is shut down when the test ends.
+func NewLLMServer(t *testing.T) *LLMServer {
+	s := &LLMServer{embed: llm.QuoteEmbedder()}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// URL returns the base URL of the server's OpenAI-compatible API,
+// for use with [rsc.io/gaby/internal/openai.NewClient].
+func (s *LLMServer) URL() string {
+	return s.srv.URL + "/v1"
+}
+
+// Client returns an HTTP client that sends every request to the server.
+func (s *LLMServer) Client() *http.Client {
+	return &http.Client{Transport: redirect{s.srv.Listener.Addr().String(), s.srv.Client().Transport}}
+}
+
+// A redirect is an [http.RoundTripper] that sends every request to host.
+type redirect struct {
+	host string
+	rt   http.RoundTripper
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = r.host
+	return r.rt.RoundTrip(req)
+}
+
+// SetGenerate sets the function used to generate text for a prompt
+// (with parts or messages joined by newlines) sent to the given model.
+// The default generator replies “model: prompt”.
+func (s *LLMServer) SetGenerate(f func(model, prompt string) string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generate = f
+}
+
+// FailNext causes the next n requests to fail
+// with the given HTTP status code, such as
+// [http.StatusTooManyRequests].
+func (s *LLMServer) FailNext(n, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = n
+	s.code = code
+}
+
+// Requests returns the URL paths of the requests the server
+// has received (including failed ones), oldest first.
+func (s *LLMServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *LLMServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	fail, code := s.fail > 0, s.code
+	if fail {
+		s.fail--
+	}
+	gen := s.generate
+	s.mu.Unlock()
+
+	gemini := strings.HasPrefix(r.URL.Path, "/v1beta/")
+	if fail {
+		llmError(w, gemini, code, "injected failure")
+		return
+	}
+	if gen == nil {
+		gen = func(model, prompt string) string { return model + ": " + prompt }
+	}
+	if r.Method != "POST" {
+		llmError(w, gemini, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if gemini {
+		s.serveGemini(w, r, gen)
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/embeddings":
+		var req struct {
+			Input []string `json:"input"`
+		}
+		if !readJSON(w, r, gemini, &req) {
+			return
+		}
+		type embedding struct {
+			Index     int        `json:"index"`
+			Embedding llm.Vector `json:"embedding"`
+		}
+		var resp struct {
+			Data []embedding `json:"data"`
+		}
+		for i, text := range req.Input {
+			resp.Data = append(resp.Data, embedding{i, s.embedText("", text)})
+		}
+		writeJSON(w, resp)
+
+	case "/v1/chat/completions":
+		var req struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if !readJSON(w, r, gemini, &req) {
+			return
+		}
+		var prompt []string
+		for _, m := range req.Messages {
+			prompt = append(prompt, m.Content)
+		}
+		type message struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}
+		type choice struct {
+			Message message `json:"message"`
+		}
+		writeJSON(w, struct {
+			Choices []choice `json:"choices"`
+		}{[]choice{{message{"assistant", gen(req.Model, strings.Join(prompt, "\n"))}}}})
+
+	default:
+		llmError(w, gemini, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+	}
+}
+
+// serveGemini serves a request to the Gemini API.
+func (s *LLMServer) serveGemini(w http.ResponseWriter, r *http.Request, gen func(string, string) string) {
+	type part struct {
+		Text string `json:"text"`
+	}
+	type content struct {
+		Parts []part `json:"parts"`
+		Role  string `json:"role,omitempty"`
+	}
+	text := func(cs []*content) string {
+		var parts []string
+		for _, c := range cs {
+			for _, p := range c.Parts {
+				parts = append(parts, p.Text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1beta/")
+	if path == "cachedContents" {
+		s.mu.Lock()
+		s.caches++
+		name := fmt.Sprintf("cachedContents/fake%d", s.caches)
+		s.mu.Unlock()
+		writeJSON(w, map[string]any{"name": name, "expireTime": time.Now().Add(time.Hour).UTC()})
+		return
+	}
+	model, method, ok := strings.Cut(strings.TrimPrefix(path, "models/"), ":")
+	if !ok || !strings.HasPrefix(path, "models/") {
+		llmError(w, true, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+		return
+	}
+	switch method {
+	case "batchEmbedContents":
+		var req struct {
+			Requests []struct {
+				Content *content `json:"content"`
+				Title   string   `json:"title"`
+			} `json:"requests"`
+		}
+		if !readJSON(w, r, true, &req) {
+			return
+		}
+		type embedding struct {
+			Values llm.Vector `json:"values"`
+		}
+		var resp struct {
+			Embeddings []embedding `json:"embeddings"`
+		}
+		for _, e := range req.Requests {
+			resp.Embeddings = append(resp.Embeddings, embedding{s.embedText(e.Title, text([]*content{e.Content}))})
+		}
+		writeJSON(w, resp)
+
+	case "generateContent":
+		var req struct {
+			Contents []*content `json:"contents"`
+		}
+		if !readJSON(w, r, true, &req) {
+			return
+		}
+		type candidate struct {
+			Content      *content `json:"content"`
+			FinishReason string   `json:"finishReason"`
+		}
+		writeJSON(w, struct {
+			Candidates []candidate `json:"candidates"`
+		}{[]candidate{{&content{Parts: []part{{gen(model, text(req.Contents))}}, Role: "model"}, "STOP"}}})
+
+	case "countTokens":
+		var req struct {
+			Contents []*content `json:"contents"`
+		}
+		if !readJSON(w, r, true, &req) {
+			return
+		}
+		n, _ := llm.ApproxTokenCounter().CountTokens(text(req.Contents))
+		writeJSON(w, map[string]int{"totalTokens": n})
+
+	default:
+		llmError(w, true, http.StatusNotFound, "unknown method "+method)
+	}
+}
+
+// embedText returns the embedding of the document with the given title and text.
+func (s *LLMServer) embedText(title, text string) llm.Vector {
+	vecs, _ := s.embed.EmbedDocs(context.Background(), []llm.EmbedDoc{{Title: title, Text: text}})
+	return vecs[0]
+}
+
+// readJSON decodes the request body into v.
+// If the body is invalid, readJSON writes an error and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, gemini bool, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		llmError(w, gemini, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// llmError writes an error response in the format of the Gemini API
+// (if gemini is true) or the OpenAI API.
+func llmError(w http.ResponseWriter, gemini bool, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	e := map[string]any{"message": msg}
+	if gemini {
+		e["code"] = code
+		e["status"] = strings.ToUpper(strings.ReplaceAll(http.StatusText(code), " ", "_"))
+	}
+	json.NewEncoder(w).Encode(map[string]any{"error": e})
+}
@@ -0,0 +1,286 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package themes implements reporting emerging themes among new GitHub issues.
+//
+// A [Finder] clusters the recently created open issues in a project
+// by the similarity of their embeddings and reports the clusters
+// with at least a minimum number of issues (see [Finder.SetMinSize]).
+// A large cluster of new issues suggests a widespread regression
+// or a recurring point of confusion: a pattern that no single
+// related-issues post can show.
+// The Finder records its latest report for each project in the database,
+// and [Reports] returns them for display on the admin status page.
+// A Finder never writes to GitHub.
+package themes
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This package stores the following key schema in the database:
+//
+//	["themes.Report", Name, Project] => JSON of Report
+
+func init() {
+	storage.RegisterSchema(
+		storage.Schema{Kind: "themes.Report", Key: "Name, Project", Val: "JSON of Report"},
+	)
+}
+
+// A Finder finds emerging themes among new issues.
+type Finder struct {
+	slog     *slog.Logger
+	db       storage.DB
+	vdb      storage.VectorDB
+	github   *github.Client
+	projects map[string]bool
+	name     string
+	window   time.Duration
+	minSize  int
+	minScore float64
+
+	now func() time.Time // for testing
+}
+
+// New creates and returns a new Finder. It logs to lg, stores reports in db,
+// finds new issues using gh, and looks up their embeddings in vdb,
+// which must contain embeddings of the GitHub issues
+// (see [rsc.io/gaby/internal/githubdocs] and [rsc.io/gaby/internal/embeddocs]).
+// For the purposes of storing its reports, it uses the given name.
+//
+// Use the [Finder] methods to configure the parameters
+// (especially [Finder.EnableProject]) before calling [Finder.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, vdb storage.VectorDB, name string) *Finder {
+	return &Finder{
+		slog:     lg,
+		db:       db,
+		vdb:      vdb,
+		github:   gh,
+		projects: make(map[string]bool),
+		name:     name,
+		window:   defaultWindow,
+		minSize:  defaultMinSize,
+		minScore: defaultMinScore,
+		now:      time.Now,
+	}
+}
+
+const (
+	defaultWindow   = 14 * 24 * time.Hour
+	defaultMinSize  = 5
+	defaultMinScore = 0.85
+)
+
+// EnableProject enables the Finder to report on issues in the given GitHub project
+// (for example "golang/go").
+func (f *Finder) EnableProject(project string) {
+	f.projects[project] = true
+}
+
+// SetWindow sets how recently an issue must have been created
+// for the Finder to consider it. The default is two weeks.
+func (f *Finder) SetWindow(d time.Duration) {
+	f.window = d
+}
+
+// SetMinSize sets the minimum number of issues in a reported theme.
+// Smaller clusters are left out of the report. The default is 5.
+func (f *Finder) SetMinSize(n int) {
+	f.minSize = n
+}
+
+// SetMinScore sets the minimum similarity between an issue's embedding
+// and the center of a cluster for the issue to join the cluster.
+// The default is 0.85.
+func (f *Finder) SetMinScore(min float64) {
+	f.minScore = min
+}
+
+// A Report is the list of themes found among a project's new issues.
+type Report struct {
+	Name    string    // name of the Finder (see [New])
+	Project string    // GitHub project
+	Time    time.Time // time of the report
+	Since   time.Time // only issues created at or after Since were considered
+	Issues  int       // number of issues considered
+	Themes  []*Theme  // themes, largest first
+}
+
+// A Theme is a cluster of similar new issues.
+type Theme struct {
+	Title  string    // title of the issue closest to the center of the cluster
+	Score  float64   // mean similarity of the issues to the center
+	Issues []*Member // issues in the cluster, in increasing issue number order
+}
+
+// A Member is an issue in a [Theme].
+type Member struct {
+	Number int64
+	Title  string
+	URL    string // issue's HTML URL
+}
+
+// String returns a one-line description of the theme.
+func (t *Theme) String() string {
+	nums := make([]int64, len(t.Issues))
+	for i, m := range t.Issues {
+		nums[i] = m.Number
+	}
+	return fmt.Sprintf("%d issues (%.2f) %q %v", len(t.Issues), t.Score, t.Title, nums)
+}
+
+// Run finds the themes in each enabled project (see [Finder.Find])
+// and records the report in the database, replacing any earlier one
+// for the project from a Finder with the same name (see [New]).
+// Run logs each theme to the [slog.Logger] passed to [New].
+//
+// If ctx is canceled, Run stops before the next project.
+func (f *Finder) Run(ctx context.Context) {
+	f.slog.Info("themes.Finder start", "name", f.name)
+	defer f.slog.Info("themes.Finder end", "name", f.name)
+
+	for _, project := range slices.Sorted(maps.Keys(f.projects)) {
+		if ctx.Err() != nil {
+			break
+		}
+		r := f.Find(project)
+		for _, t := range r.Themes {
+			f.slog.Info("themes.Finder theme", "name", f.name, "project", project, "theme", t.String())
+		}
+		f.db.Set(ordered.Encode("themes.Report", f.name, project), storage.JSON(r))
+	}
+	f.db.Flush()
+}
+
+// Find computes and returns the report for project, without recording it.
+//
+// Find considers the open issues (not pull requests) created in the
+// window before the current time (see [Finder.SetWindow]) that have
+// embeddings in the vector database. It visits them in increasing
+// issue number order, adding each to the cluster with the most similar
+// center, if that similarity is at least the minimum score
+// (see [Finder.SetMinScore]), or else starting a new cluster.
+// Comparing against cluster centers, rather than individual issues,
+// keeps a chain of pairwise-similar issues from merging unrelated
+// topics into one large cluster.
+// The clusters with at least the minimum size (see [Finder.SetMinSize])
+// are the report's themes.
+func (f *Finder) Find(project string) *Report {
+	now := f.now()
+	r := &Report{
+		Name:    f.name,
+		Project: project,
+		Time:    now,
+		Since:   now.Add(-f.window),
+	}
+
+	type cluster struct {
+		issues []*github.Issue
+		vecs   []llm.Vector
+		sum    []float64 // sum of vecs
+		center llm.Vector
+	}
+	var clusters []*cluster
+	filter := &github.IssueFilter{State: "open", CreatedAfter: r.Since, NoPullRequest: true}
+	for issue := range f.github.SearchIssues(project, filter) {
+		vec, ok := f.vdb.Get(fmt.Sprintf("https://github.com/%s/issues/%d", project, issue.Number))
+		if !ok {
+			f.slog.Debug("themes.Finder no embedding", "project", project, "issue", issue.Number)
+			continue
+		}
+		r.Issues++
+		var best *cluster
+		bestScore := f.minScore
+		for _, c := range clusters {
+			if score := c.center.Dot(vec); score >= bestScore {
+				best, bestScore = c, score
+			}
+		}
+		if best == nil {
+			best = new(cluster)
+			clusters = append(clusters, best)
+		}
+		best.issues = append(best.issues, issue)
+		best.vecs = append(best.vecs, vec)
+		best.sum, best.center = addVector(best.sum, vec)
+	}
+
+	for _, c := range clusters {
+		if len(c.issues) < f.minSize {
+			continue
+		}
+		t := new(Theme)
+		bestScore := math.Inf(-1)
+		for i, issue := range c.issues {
+			score := c.center.Dot(c.vecs[i])
+			t.Score += score
+			if score > bestScore {
+				t.Title, bestScore = issue.Title, score
+			}
+			t.Issues = append(t.Issues, &Member{Number: issue.Number, Title: issue.Title, URL: issue.HTMLURL})
+		}
+		t.Score /= float64(len(c.issues))
+		r.Themes = append(r.Themes, t)
+	}
+	slices.SortStableFunc(r.Themes, func(x, y *Theme) int {
+		return -cmp.Compare(len(x.Issues), len(y.Issues))
+	})
+	return r
+}
+
+// addVector adds vec to the running sum and returns the new sum
+// along with the unit vector in its direction,
+// which is the center of the vectors added so far.
+func addVector(sum []float64, vec llm.Vector) ([]float64, llm.Vector) {
+	if len(sum) < len(vec) {
+		sum = append(sum, make([]float64, len(vec)-len(sum))...)
+	}
+	for i, x := range vec {
+		sum[i] += float64(x)
+	}
+	norm := 0.0
+	for _, x := range sum {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+	center := make(llm.Vector, len(sum))
+	if norm > 0 {
+		for i, x := range sum {
+			center[i] = float32(x / norm)
+		}
+	}
+	return sum, center
+}
+
+// Reports returns an iterator over the latest reports
+// recorded by all Finders in db, ordered by Finder name and project.
+func Reports(db storage.DB) iter.Seq[*Report] {
+	return func(yield func(*Report) bool) {
+		for key, val := range db.Scan(ordered.Encode("themes.Report"), ordered.Encode("themes.Report", ordered.Inf)) {
+			var r Report
+			if err := json.Unmarshal(val(), &r); err != nil {
+				// unreachable unless corrupt storage
+				db.Panic("themes.Reports decode", "key", storage.Fmt(key), "err", err)
+			}
+			if !yield(&r) {
+				return
+			}
+		}
+	}
+}
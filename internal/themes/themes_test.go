@@ -0,0 +1,127 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package themes
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "vecs")
+	tc := gh.Testing()
+	add := func(n int64, state, created, title string, vec llm.Vector) {
+		issue := &github.Issue{
+			Number:    n,
+			Title:     title,
+			State:     state,
+			HTMLURL:   fmt.Sprintf("https://github.com/rsc/tmp/issues/%d", n),
+			CreatedAt: created,
+		}
+		if title == "pr" {
+			issue.PullRequest = new(struct{})
+		}
+		tc.AddIssue("rsc/tmp", issue)
+		if vec != nil {
+			vdb.Set(issue.HTMLURL, vec)
+		}
+	}
+	// unit returns the unit vector at angle deg degrees.
+	unit := func(deg float64) llm.Vector {
+		r := deg * math.Pi / 180
+		return llm.Vector{float32(math.Cos(r)), float32(math.Sin(r))}
+	}
+
+	const recent, old = "2024-06-10T10:00:00Z", "2024-01-01T10:00:00Z"
+	// A theme of four recent open issues near 0°.
+	add(1, "open", recent, "runtime: crash in GC", unit(5))
+	add(2, "open", recent, "runtime: GC crash", unit(0))
+	add(3, "open", recent, "runtime: crash during GC", unit(-5))
+	add(4, "open", recent, "runtime: fatal error in GC", unit(10))
+	// Issues near 0° that do not count: old, closed, a pull request, no embedding.
+	add(5, "open", old, "runtime: old crash", unit(0))
+	add(6, "closed", recent, "runtime: fixed crash", unit(0))
+	add(7, "open", recent, "pr", unit(0))
+	add(8, "open", recent, "runtime: unembedded crash", nil)
+	// A smaller cluster near 90°.
+	add(9, "open", recent, "net/http: docs", unit(90))
+	add(10, "open", recent, "net/http: more docs", unit(92))
+	// Pairwise-similar issues drifting away from the first theme
+	// join a cluster only while close enough to its center.
+	add(11, "open", recent, "runtime: drift", unit(30))
+	add(12, "open", recent, "runtime: more drift", unit(45))
+
+	f := New(lg, db, gh, vdb, "test")
+	f.EnableProject("rsc/tmp")
+	f.now = func() time.Time { return time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC) }
+	f.SetMinSize(3)
+	f.SetMinScore(0.95)
+
+	// A canceled Run reports nothing.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	f.Run(canceled)
+	for r := range Reports(db) {
+		t.Errorf("Report after canceled Run: %+v", r)
+	}
+
+	f.Run(ctx)
+	var reports []*Report
+	for r := range Reports(db) {
+		reports = append(reports, r)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("Reports() = %d reports, want 1", len(reports))
+	}
+	r := reports[0]
+	if r.Name != "test" || r.Project != "rsc/tmp" || r.Issues != 8 || !r.Since.Equal(f.now().Add(-defaultWindow)) {
+		t.Errorf("Report = %+v, want test rsc/tmp with 8 issues", r)
+	}
+	if len(r.Themes) != 1 {
+		t.Fatalf("Report themes = %v, want 1 theme", r.Themes)
+	}
+	th := r.Themes[0]
+	var nums []int64
+	for _, m := range th.Issues {
+		nums = append(nums, m.Number)
+	}
+	if want := []int64{1, 2, 3, 4}; !slices.Equal(nums, want) {
+		t.Errorf("theme issues = %v, want %v", nums, want)
+	}
+	if th.Title != "runtime: crash in GC" || th.Score < 0.99 {
+		t.Errorf("theme = %v, want closest title %q and score ≥ 0.99", th, "runtime: crash in GC")
+	}
+	if th.Issues[0].URL != "https://github.com/rsc/tmp/issues/1" {
+		t.Errorf("theme member URL = %q", th.Issues[0].URL)
+	}
+	if edits := tc.Edits(); len(edits) != 0 {
+		t.Errorf("Run edited GitHub: %v", edits)
+	}
+
+	// Lowering the minimum size reports the smaller clusters too, largest first:
+	// the drifting issues are similar to each other but not to the first theme.
+	f.SetMinSize(2)
+	var have []string
+	for _, th := range f.Find("rsc/tmp").Themes {
+		have = append(have, fmt.Sprint(th.Issues[0].Number, "+", len(th.Issues)-1))
+	}
+	if want := []string{"1+3", "9+1", "11+1"}; !slices.Equal(have, want) {
+		t.Errorf("Find with MinSize 2 = %v, want %v", have, want)
+	}
+}
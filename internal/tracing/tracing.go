@@ -0,0 +1,129 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tracing provides optional OpenTelemetry tracing for Gaby.
+//
+// Subsystems create spans with [Start] and end them with [End].
+// Spans go to the global OpenTelemetry tracer provider,
+// which discards them unless [Init] has installed an exporter,
+// so tracing costs very little when it is not configured.
+//
+// [NewHandler] wraps a [slog.Handler] to add the trace and span IDs
+// of the current span to every record logged with a context
+// (using [slog.Logger.InfoContext] and friends), so that log lines
+// can be matched with the traces they belong to.
+//
+// [VectorDB] wraps a [storage.VectorDB] to trace its searches.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+)
+
+// tracerName is the instrumentation name recorded in every span.
+const tracerName = "rsc.io/gaby"
+
+// Start starts a new span with the given name and attributes,
+// as a child of any span in ctx.
+// It returns the span and a context containing it,
+// which should be passed to work done as part of the span.
+// The caller must end the span, usually with [End].
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, first recording err in the span if err is non-nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Init installs a tracer provider that exports spans using OTLP over HTTP,
+// if the standard OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment variable is set.
+// The exporter is configured by the other standard OTEL_* variables
+// (headers, timeouts, and so on), and the service name
+// by OTEL_SERVICE_NAME.
+// If neither endpoint variable is set, Init does nothing
+// and spans are discarded.
+//
+// Init returns a function that flushes any buffered spans and
+// shuts down the exporter; the caller should call it before exiting.
+func Init(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// NewHandler returns a [slog.Handler] that adds "trace_id" and "span_id"
+// attributes to records logged with a context containing a span,
+// and then passes them to h.
+func NewHandler(h slog.Handler) slog.Handler {
+	return &handler{h}
+}
+
+type handler struct {
+	slog.Handler
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r = r.Clone()
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h.Handler.WithGroup(name)}
+}
+
+// VectorDB returns a [storage.VectorDB] that records a span
+// for each call to Search and otherwise behaves like vdb.
+//
+// Search has no context, so its spans are not linked to
+// the work that caused them; they still show how much
+// time is spent in vector searches and how often.
+func VectorDB(vdb storage.VectorDB) storage.VectorDB {
+	return &vectorDB{vdb}
+}
+
+type vectorDB struct {
+	storage.VectorDB
+}
+
+func (v *vectorDB) Search(vec llm.Vector, n int) []storage.VectorResult {
+	_, span := Start(context.Background(), "storage.VectorDB.Search", attribute.Int("n", n))
+	defer span.End()
+	res := v.VectorDB.Search(vec, n)
+	span.SetAttributes(attribute.Int("results", len(res)))
+	return res
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// record installs a tracer provider that records spans
+// for the duration of the test.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(old) })
+	return sr
+}
+
+func TestSpans(t *testing.T) {
+	sr := record(t)
+
+	pctx, parent := Start(ctx, "parent")
+	_, child := Start(pctx, "child")
+	End(child, errors.New("failed"))
+	End(parent, nil)
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name() != "child" || p.Name() != "parent" {
+		t.Fatalf("spans %q, %q, want child, parent", c.Name(), p.Name())
+	}
+	if c.Parent().SpanID() != p.SpanContext().SpanID() {
+		t.Errorf("child not linked to parent")
+	}
+	if c.Status().Code != codes.Error || c.Status().Description != "failed" {
+		t.Errorf("child status = %+v, want error", c.Status())
+	}
+	if p.Status().Code == codes.Error {
+		t.Errorf("parent status = %+v, want ok", p.Status())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	record(t)
+
+	var buf bytes.Buffer
+	lg := slog.New(NewHandler(slog.NewTextHandler(&buf, nil))).With("x", 1)
+	sctx, span := Start(ctx, "span")
+	lg.InfoContext(sctx, "traced")
+	lg.InfoContext(ctx, "untraced")
+	span.End()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged:\n%s", buf.String())
+	}
+	want := "trace_id=" + span.SpanContext().TraceID().String() + " span_id=" + span.SpanContext().SpanID().String()
+	if !strings.Contains(lines[0], want) || !strings.Contains(lines[0], "x=1") {
+		t.Errorf("traced log = %q, want %q", lines[0], want)
+	}
+	if strings.Contains(lines[1], "trace_id") {
+		t.Errorf("untraced log = %q, has trace_id", lines[1])
+	}
+}
+
+func TestVectorDB(t *testing.T) {
+	sr := record(t)
+
+	vdb := VectorDB(storage.MemVectorDB(storage.MemDB(), testutil.Slogger(t), ""))
+	vdb.Set("a", llm.Vector{1, 0})
+	vdb.Set("b", llm.Vector{0, 1})
+	if res := vdb.Search(llm.Vector{1, 0}, 1); len(res) != 1 || res[0].ID != "a" {
+		t.Errorf("Search = %v, want a", res)
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 1 || spans[0].Name() != "storage.VectorDB.Search" {
+		t.Fatalf("spans = %v, want one search", spans)
+	}
+	var have []string
+	for _, kv := range spans[0].Attributes() {
+		have = append(have, string(kv.Key)+"="+kv.Value.Emit())
+	}
+	if got := strings.Join(have, " "); got != "n=1 results=1" {
+		t.Errorf("attributes = %q, want n=1 results=1", got)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vertexai implements access to Google's Gemini model
+// through Google Cloud's Vertex AI.
+//
+// Unlike [rsc.io/gaby/internal/gemini], which uses API keys,
+// Vertex AI authenticates using Google Cloud credentials, such as a
+// service account, and serves requests from a chosen region with
+// per-project quotas, making it more suitable for production deployments.
+//
+// [Client] implements [llm.Embedder] and [llm.TextGenerator].
+// Use [NewClient] to connect.
+package vertexai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/secret"
+)
+
+// Scrub is a request scrubber for use with [rsc.io/httprr].
+func Scrub(req *http.Request) error {
+	req.Header.Del("Authorization")
+	return nil
+}
+
+// A Client represents a connection to Vertex AI.
+type Client struct {
+	slog     *slog.Logger
+	http     *http.Client
+	endpoint string // URL prefix for model requests
+}
+
+const scope = "https://www.googleapis.com/auth/cloud-platform"
+
+// NewClient returns a connection to Vertex AI in the given Google Cloud
+// project and location (for example "us-central1"),
+// using the given logger and HTTP client.
+// If sdb has a secret named "aiplatform.googleapis.com", it must be the
+// JSON key of a service account to authenticate as.
+// Otherwise NewClient uses the application default credentials
+// (see [google.FindDefaultCredentials]), which is typically
+// the right choice when running on Google Cloud.
+func NewClient(lg *slog.Logger, sdb secret.DB, hc *http.Client, project, location string) (*Client, error) {
+	ctx := context.Background()
+	var creds *google.Credentials
+	var err error
+	if js, ok := sdb.Get("aiplatform.googleapis.com"); ok {
+		creds, err = google.CredentialsFromJSON(ctx, []byte(js), scope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, scope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vertexai: %v", err)
+	}
+	return newClient(lg, withToken(hc, creds.TokenSource), endpoint(project, location)), nil
+}
+
+// endpoint returns the URL prefix for model requests
+// in the given project and location.
+func endpoint(project, location string) string {
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/",
+		location, project, location)
+}
+
+func newClient(lg *slog.Logger, hc *http.Client, endpoint string) *Client {
+	return &Client{slog: lg, http: hc, endpoint: endpoint}
+}
+
+// withToken returns a new http.Client that is the same as hc
+// except that it authorizes every request using a token from ts.
+func withToken(hc *http.Client, ts oauth2.TokenSource) *http.Client {
+	c := *hc
+	t := c.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	c.Transport = &oauth2.Transport{Source: ts, Base: t}
+	return &c
+}
+
+// maxBatch is the number of documents embedded in a single request.
+// The API allows more, but it also limits the total number of tokens
+// per request, which larger batches of long documents can exceed.
+const maxBatch = 25
+
+type embedRequest struct {
+	Instances []embedInstance `json:"instances"`
+}
+
+type embedInstance struct {
+	TaskType string `json:"task_type"`
+	Title    string `json:"title,omitempty"`
+	Content  string `json:"content"`
+}
+
+type embedResponse struct {
+	Predictions []struct {
+		Embeddings struct {
+			Values llm.Vector `json:"values"`
+		} `json:"embeddings"`
+	} `json:"predictions"`
+}
+
+// EmbeddingModel returns a description of the embedding configuration,
+// "vertexai/text-embedding-004", suitable for recording alongside
+// stored vectors (see [rsc.io/gaby/internal/storage.SetVectorModel]).
+func (c *Client) EmbeddingModel() string {
+	return "vertexai/text-embedding-004"
+}
+
+// TextModel returns a description of the text generation model,
+// "vertexai/gemini-1.5-flash", for use in usage accounting
+// (see [rsc.io/gaby/internal/llmusage.Meter.SetPrice]).
+func (c *Client) TextModel() string {
+	return "vertexai/gemini-1.5-flash"
+}
+
+// EmbedDocs returns the vector embeddings for the docs,
+// implementing [llm.Embedder].
+func (c *Client) EmbedDocs(ctx context.Context, docs []llm.EmbedDoc) ([]llm.Vector, error) {
+	var vecs []llm.Vector
+	for docs := range slices.Chunk(docs, maxBatch) {
+		req := &embedRequest{}
+		for _, d := range docs {
+			req.Instances = append(req.Instances, embedInstance{TaskType: "RETRIEVAL_DOCUMENT", Title: d.Title, Content: d.Text})
+		}
+		var resp embedResponse
+		if err := c.post(ctx, "text-embedding-004:predict", req, &resp); err != nil {
+			return vecs, err
+		}
+		if len(resp.Predictions) != len(docs) {
+			return vecs, fmt.Errorf("vertexai: embedded %d docs, want %d", len(resp.Predictions), len(docs))
+		}
+		for _, p := range resp.Predictions {
+			vecs = append(vecs, p.Embeddings.Values)
+		}
+	}
+	return vecs, nil
+}
+
+type content struct {
+	Role  string `json:"role"`
+	Parts []part `json:"parts"`
+}
+
+type part struct {
+	Text string `json:"text"`
+}
+
+type generateRequest struct {
+	Contents []content `json:"contents"`
+}
+
+type generateResponse struct {
+	Candidates []struct {
+		Content *content `json:"content"`
+	} `json:"candidates"`
+}
+
+// GenerateText returns model-generated text for the prompt,
+// implementing [llm.TextGenerator].
+func (c *Client) GenerateText(prompt ...string) (string, error) {
+	req := &generateRequest{Contents: []content{{Role: "user"}}}
+	for _, p := range prompt {
+		req.Contents[0].Parts = append(req.Contents[0].Parts, part{Text: p})
+	}
+	var resp generateResponse
+	if err := c.post(context.Background(), "gemini-1.5-flash:generateContent", req, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return "", fmt.Errorf("vertexai: no content generated")
+	}
+	var buf strings.Builder
+	for _, p := range resp.Candidates[0].Content.Parts {
+		buf.WriteString(p.Text)
+	}
+	return buf.String(), nil
+}
+
+// post posts the JSON encoding of req to the model method
+// (for example "gemini-1.5-flash:generateContent")
+// and decodes the JSON response into reply.
+func (c *Client) post(ctx context.Context, method string, req, reply any) error {
+	js, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", c.endpoint+method, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("vertexai: reading body: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("vertexai: %s\n%s", resp.Status, data)
+	}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return fmt.Errorf("vertexai: decoding reply: %v", err)
+	}
+	return nil
+}
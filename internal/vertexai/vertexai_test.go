@@ -0,0 +1,112 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vertexai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/secret"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+// newServer returns a fake Vertex AI server.
+// Its embedding of a document is {len(title), len(content)}.
+// Its generated text is the concatenated prompt parts in upper case.
+func newServer(t *testing.T) *httptest.Server {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		default:
+			http.NotFound(w, r)
+		case "/models/text-embedding-004:predict":
+			var req embedRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Instances) > maxBatch {
+				t.Errorf("bad embedding request: %v, %d instances", err, len(req.Instances))
+			}
+			var resp embedResponse
+			resp.Predictions = make([]struct {
+				Embeddings struct {
+					Values llm.Vector `json:"values"`
+				} `json:"embeddings"`
+			}, len(req.Instances))
+			for i, in := range req.Instances {
+				resp.Predictions[i].Embeddings.Values = llm.Vector{float32(len(in.Title)), float32(len(in.Content))}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/models/gemini-1.5-flash:generateContent":
+			var req generateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Contents) != 1 {
+				t.Errorf("bad generate request: %+v, %v", req, err)
+			}
+			var text string
+			for _, p := range req.Contents[0].Parts {
+				text += strings.ToUpper(p.Text)
+			}
+			json.NewEncoder(w).Encode(&generateResponse{Candidates: []struct {
+				Content *content `json:"content"`
+			}{{&content{Role: "model", Parts: []part{{text}}}}}})
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	check := testutil.Checker(t)
+	srv := newServer(t)
+	hc := withToken(srv.Client(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tok"}))
+	c := newClient(testutil.Slogger(t), hc, srv.URL+"/models/")
+
+	var docs []llm.EmbedDoc
+	for i := range 2*maxBatch + 1 {
+		docs = append(docs, llm.EmbedDoc{Title: "t", Text: strings.Repeat("x", i)})
+	}
+	vecs, err := c.EmbedDocs(ctx, docs)
+	check(err)
+	if len(vecs) != len(docs) {
+		t.Fatalf("len(vecs) = %d, want %d", len(vecs), len(docs))
+	}
+	for i, v := range vecs {
+		if want := (llm.Vector{1, float32(i)}); !slices.Equal(v, want) {
+			t.Fatalf("vecs[%d] = %v, want %v", i, v, want)
+		}
+	}
+
+	text, err := c.GenerateText("abc", "def")
+	check(err)
+	if text != "ABCDEF" {
+		t.Errorf("GenerateText = %q, want %q", text, "ABCDEF")
+	}
+
+	// Without credentials.
+	c = newClient(testutil.Slogger(t), srv.Client(), srv.URL+"/models/")
+	if _, err := c.GenerateText("abc"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("GenerateText without token: err = %v, want 401", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient(testutil.Slogger(t), secret.Map{"aiplatform.googleapis.com": "{}"}, http.DefaultClient, "proj", "us-central1"); err == nil {
+		t.Errorf("NewClient with bad credentials succeeded")
+	}
+	want := "https://us-central1-aiplatform.googleapis.com/v1/projects/proj/locations/us-central1/publishers/google/models/"
+	if e := endpoint("proj", "us-central1"); e != want {
+		t.Errorf("endpoint = %q, want %q", e, want)
+	}
+}
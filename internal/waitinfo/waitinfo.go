@@ -0,0 +1,298 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package waitinfo implements pinging and closing GitHub issues
+// that are waiting for information from their reporters.
+//
+// Maintainers mark an issue as waiting for information by adding
+// a label (by default “WaitingForInfo”). If the reporter does not comment
+// within a configured period after the label was added, a [Pinger] posts
+// a reminder, and if the reporter still does not comment within a second period,
+// the Pinger closes the issue, or, if closures require approval,
+// proposes the closure to a maintainer (see [Pinger.SetApprovals]).
+// This mirrors the long-standing gopherbot behavior
+// but is built on Gaby's GitHub event store.
+package waitinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/footer"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/ordered"
+)
+
+// This file uses the [storage.BeginAction] keys
+// ["waitinfo.Ping", Project, Issue, Since], ["waitinfo.CloseComment", Project, Issue, Since],
+// and ["waitinfo.Close", Project, Issue, Since],
+// where Since is the time the issue was labeled, in Unix nanoseconds.
+// Posting the closing comment is a separate action from closing the issue,
+// so that if closing fails, the next run retries it without commenting again.
+
+// A Pinger pings and closes issues waiting for information.
+type Pinger struct {
+	slog       *slog.Logger
+	db         storage.DB
+	github     *github.Client
+	projects   map[string]bool
+	name       string
+	label      string
+	pingAfter  time.Duration
+	closeAfter time.Duration
+	approvals  *approval.Queue
+	footer     *footer.Footer
+	edit       bool
+	now        func() time.Time // for testing
+}
+
+// New creates and returns a new Pinger. It logs to lg, stores state in db,
+// and reads and edits GitHub issues using gh.
+// For the purposes of storing its own state, it uses the given name.
+// Future calls to New with the same name will use the same state.
+//
+// Use the [Pinger] methods to configure the parameters
+// (especially [Pinger.EnableProject] and [Pinger.EnableEdits])
+// before calling [Pinger.Run].
+func New(lg *slog.Logger, db storage.DB, gh *github.Client, name string) *Pinger {
+	return &Pinger{
+		slog:       lg,
+		db:         db,
+		github:     gh,
+		projects:   make(map[string]bool),
+		name:       name,
+		label:      "WaitingForInfo",
+		pingAfter:  defaultPingAfter,
+		closeAfter: defaultCloseAfter,
+		footer:     footer.Default(),
+		now:        time.Now,
+	}
+}
+
+const (
+	defaultPingAfter  = 14 * 24 * time.Hour
+	defaultCloseAfter = 14 * 24 * time.Hour
+)
+
+// EnableProject enables the Pinger to ping and close issues in the given GitHub project (for example "golang/go").
+// See also [Pinger.EnableEdits], which must also be called to change anything on GitHub.
+func (p *Pinger) EnableProject(project string) {
+	p.projects[project] = true
+}
+
+// EnableEdits enables the Pinger to post and close issues on GitHub.
+// If EnableEdits has not been called, [Pinger.Run] logs what it would do
+// but does not do it.
+func (p *Pinger) EnableEdits() {
+	p.edit = true
+}
+
+// SetLabel sets the label marking issues waiting for information.
+// The default is "WaitingForInfo".
+func (p *Pinger) SetLabel(label string) {
+	p.label = label
+}
+
+// SetPeriods sets the waiting periods:
+// the Pinger pings an issue's reporter when the issue has been
+// waiting for information for ping without a comment from the reporter,
+// and it closes the issue when close has passed since the ping,
+// again without a comment from the reporter.
+// The defaults are 14 days each.
+func (p *Pinger) SetPeriods(ping, close time.Duration) {
+	p.pingAfter = ping
+	p.closeAfter = close
+}
+
+// SetApprovals sets the approval queue for the Pinger's closures.
+// If q requires approval for "waitinfo.Close" actions
+// (see [approval.Queue.Requires]), the Pinger proposes each closure
+// to q instead of closing the issue itself.
+func (p *Pinger) SetApprovals(q *approval.Queue) {
+	p.approvals = q
+}
+
+// SetFooter sets the footer appended to each post.
+// The default is [footer.Default].
+func (p *Pinger) SetFooter(f *footer.Footer) {
+	p.footer = f
+}
+
+// Run runs a single round of pinging and closing.
+// It considers every open issue in the enabled projects
+// that has the waiting label (see [Pinger.SetLabel]).
+// For each one, it finds when the label was most recently added
+// and whether the reporter has commented since then.
+// If not, and the label was added long enough ago (see [Pinger.SetPeriods]),
+// Run posts a reminder to the reporter; or, if the reminder was posted
+// long enough ago, Run closes the issue (or proposes the closure for approval;
+// see [Pinger.SetApprovals]).
+// Each reminder and closure happens at most once per labeling.
+//
+// Run logs each action to the [slog.Logger] passed to [New].
+// If [Pinger.EnableEdits] has not been called, Run only logs what it would do.
+//
+// If ctx is canceled, Run stops before the next issue.
+func (p *Pinger) Run(ctx context.Context) {
+	p.slog.Info("waitinfo.Pinger start", "name", p.name)
+	defer p.slog.Info("waitinfo.Pinger end", "name", p.name)
+
+	for _, project := range slices.Sorted(maps.Keys(p.projects)) {
+		filter := &github.IssueFilter{State: "open", Labels: []string{p.label}, NoPullRequest: true}
+		for issue := range p.github.SearchIssues(project, filter) {
+			if ctx.Err() != nil {
+				return
+			}
+			p.check(project, issue)
+		}
+	}
+}
+
+// check checks a single issue waiting for information.
+func (p *Pinger) check(project string, issue *github.Issue) {
+	// Find the most recent labeling and the reporter's last comment.
+	var since, replied time.Time
+	for _, e := range p.github.Timeline(project, issue.Number) {
+		tm, err := time.Parse(time.RFC3339, e.CreatedAt())
+		if err != nil {
+			continue
+		}
+		switch x := e.Typed.(type) {
+		case *github.IssueEvent:
+			if x.Event == "labeled" && slices.ContainsFunc(x.Labels, func(l github.Label) bool { return l.Name == p.label }) {
+				since = tm
+			}
+		case *github.IssueComment:
+			if x.User.Login == issue.User.Login {
+				replied = tm
+			}
+		}
+	}
+	if since.IsZero() {
+		p.slog.Info("waitinfo.Pinger no label event", "project", project, "issue", issue.Number)
+		return
+	}
+	if !replied.Before(since) {
+		// Reporter has replied; a maintainer should remove the label.
+		return
+	}
+
+	now := p.now()
+	if now.Sub(since) < p.pingAfter {
+		return
+	}
+	ping := ordered.Encode("waitinfo.Ping", project, issue.Number, since.UnixNano())
+	r, pinged := storage.LookupAction(p.db, ping)
+	if !pinged {
+		p.ping(issue, ping)
+		return
+	}
+	if !r.Done {
+		// Ping interrupted; don't risk closing without one.
+		return
+	}
+	var out pingOutcome
+	if err := json.Unmarshal(r.Outcome, &out); err != nil {
+		// unreachable unless corrupt storage
+		p.db.Panic("waitinfo ping decode", "key", storage.Fmt(ping), "err", err)
+	}
+	if now.Sub(out.Time) < p.closeAfter {
+		return
+	}
+	p.close(project, issue, since)
+}
+
+// A pingOutcome is the outcome recorded for a ping action.
+type pingOutcome struct {
+	URL  string    // API URL of the posted comment
+	Time time.Time // time of the ping
+}
+
+// ping posts a reminder to the issue's reporter.
+func (p *Pinger) ping(issue *github.Issue, action []byte) {
+	body := fmt.Sprintf("@%s, this issue is waiting for information from you. "+
+		"If we don't hear back within %s, it will be closed. Thanks!\n%s",
+		issue.User.Login, days(p.closeAfter), p.footer.Render("waitinfo", issue.Project()))
+	p.slog.Info("waitinfo.Pinger ping", "name", p.name, "project", issue.Project(), "issue", issue.Number, "comment", body)
+	if !p.edit || !storage.BeginAction(p.db, action) {
+		return
+	}
+	url, err := p.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+	if err != nil {
+		p.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+		storage.CancelAction(p.db, action)
+		return
+	}
+	storage.FinishAction(p.db, action, &pingOutcome{URL: url, Time: p.now()})
+}
+
+// close closes the issue or, if closures require approval,
+// proposes the closure.
+func (p *Pinger) close(project string, issue *github.Issue, since time.Time) {
+	action := ordered.Encode("waitinfo.Close", project, issue.Number, since.UnixNano())
+	if _, ok := storage.LookupAction(p.db, action); ok {
+		// Already closed; the issue has not been resynced yet.
+		return
+	}
+
+	body := fmt.Sprintf("Closing this issue because we haven't heard back. "+
+		"@%s, if you have the requested information, please add it in a comment and we will reopen the issue.\n%s",
+		issue.User.Login, p.footer.Render("waitinfo", project))
+	if p.approvals.Requires("waitinfo.Close") {
+		if !p.edit {
+			p.slog.Info("waitinfo.Pinger propose close", "name", p.name, "project", project, "issue", issue.Number, "comment", body)
+			return
+		}
+		p.approvals.Propose(issue, action, &approval.Proposal{
+			Kind:    "waitinfo.Close",
+			Actor:   p.name,
+			Reason:  fmt.Sprintf("no reply from @%s since labeled %s on %s", issue.User.Login, p.label, since.UTC().Format(time.DateOnly)),
+			Comment: body,
+			State:   "closed",
+			IfLabel: p.label,
+		})
+		return
+	}
+
+	p.slog.Info("waitinfo.Pinger close", "name", p.name, "project", project, "issue", issue.Number, "comment", body)
+	if !p.edit {
+		return
+	}
+	comment := ordered.Encode("waitinfo.CloseComment", project, issue.Number, since.UnixNano())
+	if storage.BeginAction(p.db, comment) {
+		url, err := p.github.PostIssueComment(issue, &github.IssueCommentChanges{Body: body})
+		if err != nil {
+			p.slog.Error("PostIssueComment", "issue", issue.Number, "err", err)
+			storage.CancelAction(p.db, comment)
+			return
+		}
+		storage.FinishAction(p.db, comment, url)
+	}
+	if !storage.BeginAction(p.db, action) {
+		return
+	}
+	if err := p.github.EditIssue(issue, &github.IssueChanges{State: "closed"}); err != nil {
+		// The closing comment has been posted; the next run retries only the closing.
+		p.slog.Error("EditIssue", "issue", issue.Number, "err", err)
+		storage.CancelAction(p.db, action)
+		return
+	}
+	storage.FinishAction(p.db, action, nil)
+}
+
+// days formats d as a number of days.
+func days(d time.Duration) string {
+	n := int(d.Round(24*time.Hour) / (24 * time.Hour))
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
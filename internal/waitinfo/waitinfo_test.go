@@ -0,0 +1,236 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package waitinfo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var ctx = context.Background()
+
+const day = 24 * time.Hour
+
+var labeledAt = time.Date(2024, 6, 17, 20, 0, 0, 0, time.UTC)
+
+// addIssues adds test issues to project:
+//
+//	#1 waiting, reporter silent, maintainer commented
+//	#2 waiting, reporter replied after labeling
+//	#3 label since removed
+//	#4 waiting, but closed
+func addIssues(gh *github.Client, project string) {
+	tc := gh.Testing()
+	waiting := []github.Label{{Name: "WaitingForInfo"}}
+	at := func(d time.Duration) string { return labeledAt.Add(d).Format(time.RFC3339) }
+	for i, state := range []string{"open", "open", "open", "closed"} {
+		n := int64(i + 1)
+		issue := &github.Issue{
+			Number:    n,
+			Title:     "issue",
+			User:      github.User{Login: "reporter"},
+			State:     state,
+			CreatedAt: at(-2 * day),
+			Labels:    waiting,
+		}
+		if n == 3 {
+			issue.Labels = nil
+		}
+		tc.AddIssue(project, issue)
+		tc.AddIssueComment(project, n, &github.IssueComment{
+			User:      github.User{Login: "reporter"},
+			CreatedAt: at(-1 * day),
+			Body:      "it broke",
+		})
+		tc.AddIssueEvent(project, n, &github.IssueEvent{
+			Actor:     github.User{Login: "maintainer"},
+			Event:     "labeled",
+			Labels:    waiting,
+			CreatedAt: at(0),
+		})
+		tc.AddIssueComment(project, n, &github.IssueComment{
+			User:      github.User{Login: "maintainer"},
+			CreatedAt: at(1 * time.Hour),
+			Body:      "what version?",
+		})
+	}
+	tc.AddIssueComment(project, 2, &github.IssueComment{
+		User:      github.User{Login: "reporter"},
+		CreatedAt: at(2 * day),
+		Body:      "go1.23",
+	})
+}
+
+// editIssues returns the issue numbers and kinds of the edits in gh,
+// as strings like "1 comment" or "1 close", and clears the edits.
+func editIssues(gh *github.Client) []string {
+	var list []string
+	for _, e := range gh.Testing().Edits() {
+		kind := "comment"
+		if e.IssueChanges != nil {
+			kind = "close"
+			if e.IssueChanges.State != "closed" {
+				kind = "edit"
+			}
+		}
+		list = append(list, fmt.Sprintf("%s#%d %s", e.Project, e.Issue, kind))
+	}
+	gh.Testing().ClearEdits()
+	return list
+}
+
+func TestRun(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addIssues(gh, "rsc/tmp")
+
+	p := New(lg, db, gh, "test")
+	p.EnableProject("rsc/tmp")
+	now := labeledAt
+	p.now = func() time.Time { return now }
+
+	check := func(when time.Duration, want ...string) {
+		t.Helper()
+		now = labeledAt.Add(when)
+		p.Run(ctx)
+		if have := editIssues(gh); !slices.Equal(have, want) {
+			t.Errorf("at %v: edits = %q, want %q", when, have, want)
+		}
+	}
+
+	// Not yet time to ping.
+	p.EnableEdits()
+	check(13 * day)
+
+	// Dry run does nothing.
+	p.edit = false
+	check(15 * day)
+	p.EnableEdits()
+
+	check(15*day, "rsc/tmp#1 comment")
+	check(16 * day) // at most once
+	check(28 * day) // not yet time to close
+
+	check(30*day, "rsc/tmp#1 comment", "rsc/tmp#1 close")
+	check(31 * day) // at most once
+}
+
+func TestPingText(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addIssues(gh, "rsc/tmp")
+
+	p := New(lg, db, gh, "test")
+	p.EnableProject("rsc/tmp")
+	p.EnableEdits()
+	p.SetPeriods(3*day, 7*day)
+	p.now = func() time.Time { return labeledAt.Add(4 * day) }
+	p.Run(ctx)
+	edits := gh.Testing().Edits()
+	if len(edits) != 1 || edits[0].IssueCommentChanges == nil {
+		t.Fatalf("edits = %v, want 1 comment", edits)
+	}
+	body := edits[0].IssueCommentChanges.Body
+	if !strings.HasPrefix(body, "@reporter, ") || !strings.Contains(body, "within 7 days") {
+		t.Errorf("ping = %q, want @reporter and 7 days", body)
+	}
+}
+
+func TestApproval(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addIssues(gh, "rsc/tmp")
+
+	q := approval.New(lg, db, gh, "approvals")
+	q.Require("waitinfo.Close")
+	q.EnableEdits()
+	p := New(lg, db, gh, "test")
+	p.EnableProject("rsc/tmp")
+	p.EnableEdits()
+	p.SetApprovals(q)
+	now := labeledAt.Add(15 * day)
+	p.now = func() time.Time { return now }
+	p.Run(ctx)
+	gh.Testing().ClearEdits()
+
+	now = labeledAt.Add(30 * day)
+	p.Run(ctx)
+	p.Run(ctx)
+	if edits := editIssues(gh); len(edits) != 0 {
+		t.Fatalf("closed without approval: %q", edits)
+	}
+	var pending []*approval.Proposal
+	for pr := range approval.Proposals(db) {
+		pending = append(pending, pr)
+	}
+	if len(pending) != 1 || pending[0].Issue != 1 || pending[0].Actor != "test" || pending[0].State != "closed" {
+		t.Fatalf("proposals = %v, want one closing rsc/tmp#1", pending)
+	}
+
+	// Still pending; no closing.
+	q.Run(ctx)
+	if edits := editIssues(gh); len(edits) != 0 {
+		t.Fatalf("closed without approval: %q", edits)
+	}
+
+	if err := q.Decide(pending[0].ID, true, "maintainer"); err != nil {
+		t.Fatal(err)
+	}
+	q.Run(ctx)
+	want := []string{"rsc/tmp#1 comment", "rsc/tmp#1 close"}
+	if edits := editIssues(gh); !slices.Equal(edits, want) {
+		t.Errorf("edits = %q, want %q", edits, want)
+	}
+	p.Run(ctx)
+	q.Run(ctx)
+	if edits := editIssues(gh); len(edits) != 0 {
+		t.Errorf("closed twice: %q", edits)
+	}
+}
+
+func TestCloseRetry(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	addIssues(gh, "rsc/tmp")
+
+	p := New(lg, db, gh, "test")
+	p.EnableProject("rsc/tmp")
+	p.EnableEdits()
+	now := labeledAt
+	p.now = func() time.Time { return now }
+
+	check := func(when time.Duration, want ...string) {
+		t.Helper()
+		now = labeledAt.Add(when)
+		p.Run(ctx)
+		if have := editIssues(gh); !slices.Equal(have, want) {
+			t.Errorf("at %v: edits = %q, want %q", when, have, want)
+		}
+	}
+
+	check(15*day, "rsc/tmp#1 comment")
+
+	// The closing comment is posted, but closing fails.
+	gh.Testing().FailEdit("EditIssue", fmt.Errorf("edit failed"))
+	check(30*day, "rsc/tmp#1 comment")
+
+	// The next run closes the issue without commenting again.
+	gh.Testing().FailEdit("EditIssue", nil)
+	check(31*day, "rsc/tmp#1 close")
+	check(32 * day) // at most once
+}
@@ -97,32 +97,47 @@
 //
 // Gaby needs to manage a few secret keys used to access services.
 // The [rsc.io/gaby/internal/secret] package defines the interface for
-// obtaining those secrets. The only implementations at the moment
-// are an in-memory map and a disk-based implementation that reads
-// $HOME/.netrc. Future implementations may include other file formats
-// as well as cloud-based secret storage services.
+// obtaining those secrets. The implementations at the moment are
+// an in-memory map, a disk-based implementation that reads $HOME/.netrc,
+// one that reads a JSON file, one that reads environment variables,
+// and a passphrase-encrypted file that Gaby can also write.
+// [secret.Multi] layers several secret databases, and [secret.Refresh]
+// reloads them periodically so that rotated secrets take effect
+// without a restart. Future implementations may include
+// cloud-based secret storage services.
 //
 // Secret storage is intentionally separated from the main database storage,
 // described below. The main database should hold public data, not secrets.
 //
 // # Large Language Models
 //
-// Gaby defines the interface it expects from a large language model.
+// Gaby defines the interfaces it expects from a large language model.
 //
 // The [llm.Embedder] interface abstracts an LLM that can take a collection
 // of documents and return their vector embeddings, each of type [llm.Vector].
-// The only real implementation to date is [rsc.io/gaby/internal/gemini].
-// It would be good to add an offline implementation using Ollama as well.
+// The [llm.TextGenerator] interface abstracts an LLM that can generate text
+// from a prompt, which subsystems use to check issues for missing information,
+// summarize discussions, and explain related documents.
+// [llm.GenerateJSON] builds structured output on top of it,
+// [llm.ToolGenerator] adds tool use, and [llm.TokenCounter] lets
+// callers fit prompts to a model's limits.
+//
+// There are three real implementations:
+// [rsc.io/gaby/internal/gemini], for the Gemini API;
+// [rsc.io/gaby/internal/vertexai], for Gemini on Google Cloud Vertex AI; and
+// [rsc.io/gaby/internal/openai], for the OpenAI API and compatible servers,
+// including a local Ollama server for running Gaby offline.
+// The Backends section of the configuration chooses among them
+// (see [rsc.io/gaby/internal/config.Backends]), and
+// [rsc.io/gaby/internal/llmusage] wraps the chosen one to account for
+// each subsystem's usage and enforce its daily budget.
 //
 // For tests that need an embedder but don't care about the quality of
 // the embeddings, [llm.QuoteEmbedder] copies a prefix of the text
 // into the vector (preserving vector unit length) in a deterministic way.
 // This is good enough for testing functionality like vector search
 // and simplifies tests by avoiding a dependence on a real LLM.
-//
-// At the moment, only the embedding interface is defined.
-// In the future we expect to add more interfaces around text generation
-// and tool use.
+// Similarly, [llm.EchoTextGenerator] returns its prompt as the generated text.
 //
 // # Storage
 //
@@ -218,6 +233,9 @@
 // [rsc.io/gaby/internal/docs]. A document consists of an ID (conventionally a URL),
 // a document title, and document text. Documents are stored using timed storage,
 // enabling incremental processing of newly added documents .
+// Downloaded GitHub events and documents compress well, so setting
+// Backends.Compress in the configuration stores the large ones
+// zstd-compressed, substantially reducing the size of the database.
 //
 // # Document Embedding
 //
@@ -225,7 +243,28 @@
 // that vector in a vector database. The [rsc.io/gaby/internal/embeddocs] package
 // does this, and there is very little to it, given the abstractions of a document store
 // with incremental scanning, an LLM embedder, and a vector database, all of which
-// are provided by other packages.
+// are provided by other packages. To catch up quickly after a large import,
+// it embeds several batches of documents at once (Backends.EmbedWorkers in the
+// configuration), stopping early if the LLM reports an error such as
+// an exceeded rate limit or budget. Failed batches are retried with backoff;
+// a document that keeps failing (for example, because it is too long)
+// is eventually skipped and listed on the admin status page.
+// When a document is deleted from the corpus, for example because its
+// issue was transferred to another repository, its vector is deleted too.
+// Each vector is stored with a hash of the text it was computed from,
+// so documents that are re-added unchanged, as after a githubdocs restart,
+// are not embedded again.
+//
+// Vectors from different embedding models cannot be compared,
+// so each vector database namespace records the model that computed it,
+// and Gaby refuses to start if the configured model does not match.
+// The namespace also records the dimension of its vectors; a vector of
+// any other dimension is rejected instead of being stored, and the
+// rejection is logged as an error and listed on the admin status page.
+// To change models, run “gaby reembed -model name namespace”
+// to embed every document into a new namespace (it can be interrupted
+// and run again to resume), and then set Backends.VectorNamespace
+// and Backends.EmbedModel in the configuration.
 //
 // # HTTP Record and Replay
 //
@@ -311,29 +350,171 @@
 // # Main Loop
 //
 // All of these pieces are put together in the main program, this package, [rsc.io/gaby].
-// The actual main package has no tests yet but is also incredibly straightforward.
-// It does need tests, but we also need to identify ways that the hard-coded policies
-// in the package can be lifted out into data that a natural language interface can
-// manipulate. For example the current policy choices in package main amount to:
-//
-//	cf := commentfix.New(lg, gh, "gerritlinks")
-//	cf.EnableProject("golang/go")
-//	cf.EnableEdits()
-//	cf.AutoLink(`\bCL ([0-9]+)\b`, "https://go.dev/cl/$1")
-//	cf.ReplaceURL(`\Qhttps://go-review.git.corp.google.com/\E`, "https://go-review.googlesource.com/")
-//
-//	rp := related.New(lg, db, gh, vdb, dc, "related")
-//	rp.EnableProject("golang/go")
-//	rp.EnablePosts()
-//	rp.SkipBodyContains("— [watchflakes](https://go.dev/wiki/Watchflakes)")
-//	rp.SkipTitlePrefix("x/tools/gopls: release version v")
-//	rp.SkipTitleSuffix(" backport]")
-//
-// These could be stored somewhere as data and manipulated and added to by the LLM
-// in response to prompts from maintainers. And other features could be added and
+// The main package is incredibly straightforward. Its tests run scenarios
+// (in testdata/scenario) that load issue histories and a configuration,
+// run the whole pipeline, from the document index to the subsystems,
+// against the GitHub testing client and a deterministic fake LLM,
+// and check the resulting GitHub edits and database state,
+// so that changes in one package that break another are caught before production.
+// The policy choices, such as which projects each subsystem
+// watches, the comment fixer's rewrite rules, and the related poster's skip filters,
+// are not in the program at all: they are data, described by [rsc.io/gaby/internal/config]
+// and read from the JSON file named by the -config flag
+// (or taken from [config.Default], which is the policy for the Go issue tracker).
+// For example the comment fixer and related poster are configured by:
+//
+//	"CommentFix": {
+//		"Name": "gerritlinks",
+//		"Edits": true,
+//		"Projects": [{
+//			"Project": "golang/go",
+//			"Rules": [
+//				{"Kind": "AutoLink", "Pattern": "\\bCL ([0-9]+)\\b", "Repl": "https://go.dev/cl/$1"},
+//				{"Kind": "ReplaceURL", "Pattern": "\\Qhttps://go-review.git.corp.google.com/\\E", "Repl": "https://go-review.googlesource.com/"}
+//			]
+//		}]
+//	},
+//	"Related": {
+//		"Name": "related",
+//		"Posts": true,
+//		"Projects": ["golang/go"],
+//		"SkipBodyContains": ["— [watchflakes](https://go.dev/wiki/Watchflakes)"],
+//		"SkipTitlePrefix": ["x/tools/gopls: release version v"],
+//		"SkipTitleSuffix": [" backport]"]
+//	}
+//
+// The configuration is validated when it is loaded, so that a bad rule
+// or misspelled field stops Gaby before it does anything.
+// Being data, the policy can eventually be inspected and changed
+// by the LLM in response to prompts from maintainers. And other features could be added and
 // configured in a similar way. Exactly how to do this is an important thing to learn in
 // future experimentation.
 //
+// The Backends section of the configuration chooses, when Gaby starts,
+// the implementations of the interfaces described above:
+// the database (Pebble, or an in-memory database for testing and demos),
+// the vector database, the LLM (the Gemini API, Vertex AI, the OpenAI API
+// or a compatible server, or a local Ollama server), and the sources of secrets.
+// For example, to run Gaby against a local Ollama server:
+//
+//	"Backends": {
+//		"LLM": "ollama",
+//		"EmbedModel": "nomic-embed-text"
+//	}
+//
+// The -vertexai, -embedmodel, -embeddim, -secrets, and -secretstore flags
+// override the configured backends.
+// There is no Firestore implementation of [storage.DB] yet.
+//
+// The program is organized as subcommands sharing the same initialization:
+//
+//	gaby serve [-admin addr]          # run the periodic tasks (the default)
+//	gaby sync [project...]            # sync GitHub and update the document index
+//	gaby search [query]               # search the document index
+//	gaby backfill related project min max
+//	gaby commentfix undo -since=time project...
+//	gaby audit project [duration]     # print recent GitHub edits
+//	gaby dump [name]                  # print database entries
+//	gaby schema                       # print the database key schemas
+//	gaby backup [-dest url]           # back up the database now
+//	gaby backup list [-dest url]      # list the database backups
+//	gaby backup restore [-dest url] name dir
+//	gaby config check [file]          # validate a configuration file
+//	gaby eval file                    # evaluate the embedding model
+//	gaby reembed [-model name] namespace
+//
+// so that operational tasks do not require editing the program.
+//
+// The serve -admin flag serves a small web interface ([rsc.io/gaby/internal/admin])
+// for inspecting and controlling a running Gaby: it shows the configuration
+// and recent actions, toggles each subsystem's dry-run mode, and queues
+// one-off project syncs and related-issue backfills.
+// It also serves a search page and JSON API for Gaby's document index
+// ([rsc.io/gaby/internal/search]), the web version of “gaby search”,
+// so that maintainers can use the index directly while triaging.
+//
+// Gaby serve runs each periodic task (GitHub sync, document indexing,
+// and each subsystem) on its own schedule, with jitter and with backoff
+// after errors ([rsc.io/gaby/internal/sched]), as configured by the
+// Interval and Schedules fields of the configuration.
+// The admin interface shows when each task last ran and will next run.
+//
+// Every edit Gaby makes on GitHub (posting a comment, editing a comment,
+// or changing an issue's text, labels, milestone, assignees, or state)
+// is recorded in an append-only audit log in the database,
+// with the subsystem that made it, the target URL, the changes, and the result
+// (see [github.Client.Audit]). “gaby audit” prints a project's recent edits.
+//
+// Kinds of actions listed in the Approvals section of the configuration,
+// such as closing issues that are waiting for information,
+// are not performed directly. Instead, the subsystem proposes the action
+// ([rsc.io/gaby/internal/approval]), and a maintainer approves or rejects it
+// in the admin interface or, if the section names the bot and the approvers,
+// with a “@gabyhelp approve” or “@gabyhelp reject” comment on the issue.
+// Proposals not decided within the expiry period (by default a week) expire.
+//
+// In observe-only (“gabysitter”) mode, every subsystem that writes to GitHub
+// runs in dry-run mode, logging what it would do instead of doing it,
+// regardless of the Posts and Edits settings in the configuration.
+// The -observe flag, the $GABY_OBSERVE_ONLY environment variable,
+// and the configuration's ObserveOnly field all enable the mode,
+// and the admin interface shows it prominently.
+//
+// Several replicas of gaby serve can share one database, for example
+// in a cloud deployment, provided the database's locks work across processes
+// (see [storage.DB]); the local Pebble database cannot be shared.
+// The replicas coordinate only through the database:
+// each periodic task runs in one replica at a time, under a lease that
+// another replica takes over if the holder dies ([rsc.io/gaby/internal/sched]),
+// and GitHub actions are recorded atomically so that each is performed
+// at most once ([storage.BeginAction]). Tasks whose schedule sets Singleton
+// run only in the replica currently elected leader.
+// The -instance flag names a replica in the leases; the default is unique.
+//
+// A task run that takes far longer than its schedule suggests
+// (by default, ten times its interval, but at least 30 minutes)
+// is logged as stuck and shown as stuck on the status page,
+// and /healthz fails until it finishes. A schedule can set StuckAfter
+// to change that limit and CancelStuck to cancel stuck runs,
+// which are then retried like failed runs.
+//
+// To see where the time in a slow cycle goes, set the standard
+// $OTEL_EXPORTER_OTLP_ENDPOINT (and related) environment variables
+// to export OpenTelemetry traces to a collector ([rsc.io/gaby/internal/tracing]).
+// Each task run is a trace, with spans for the GitHub and document syncs,
+// embedding batches, and GitHub edits made during it;
+// vector searches are traced separately.
+// Log messages written during a traced span include its trace_id and span_id.
+//
+// Gaby logs to standard output, but it also keeps warnings, errors,
+// and the messages recording its changes to GitHub in the database
+// for a month ([rsc.io/gaby/internal/logstore]), so that they are not lost
+// when no one is collecting standard output. The admin interface shows
+// recent problems on its home page and can search the stored logs.
+//
+// At the end of each cycle of its main loop, gaby serve records and logs
+// a summary of the work done: GitHub events synced, documents added,
+// embeddings computed, comments posted, and errors logged
+// ([rsc.io/gaby/internal/runlog]). The admin interface shows the recent
+// summaries, and its /healthz page, which needs no password, reports
+// whether a cycle finished in the last ten minutes without errors.
+//
+// If the configuration has a Prune section, gaby serve prunes the stored
+// GitHub events older than a few months (three, by default) once a day,
+// dropping the rarely used fields that make up most of their size
+// ([github.Client.PruneEvents]).
+//
+// If the configuration has a Backup section, gaby serve backs up the database
+// once a day, by default, to a local directory (ideally on another disk),
+// a Google Cloud Storage bucket, or an Amazon S3 bucket,
+// keeping the most recent backups and one a day for two weeks
+// ([rsc.io/gaby/internal/backup]). The package documentation explains
+// how to restore a backup using gaby backup list and gaby backup restore.
+//
+// On SIGINT or SIGTERM, gaby serve and gaby sync finish the issue or
+// document they are working on, flush their progress, and close the
+// database before exiting, so that a restart picks up where they left off.
+//
 // # Future Work and Structure
 //
 // As mentioned above, the two jobs Gaby does already are both fairly simple and straightforward.
@@ -367,106 +548,584 @@
 package main
 
 import (
-	"bufio"
+	"cmp"
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"rsc.io/gaby/internal/admin"
+	"rsc.io/gaby/internal/approval"
+	"rsc.io/gaby/internal/commands"
 	"rsc.io/gaby/internal/commentfix"
+	"rsc.io/gaby/internal/config"
 	"rsc.io/gaby/internal/docs"
-	"rsc.io/gaby/internal/embeddocs"
+	"rsc.io/gaby/internal/flakes"
 	"rsc.io/gaby/internal/gemini"
 	"rsc.io/gaby/internal/github"
-	"rsc.io/gaby/internal/githubdocs"
 	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/llmusage"
+	"rsc.io/gaby/internal/milestone"
+	"rsc.io/gaby/internal/needinfo"
+	"rsc.io/gaby/internal/openai"
+	"rsc.io/gaby/internal/owners"
 	"rsc.io/gaby/internal/pebble"
+	"rsc.io/gaby/internal/priority"
 	"rsc.io/gaby/internal/related"
+	"rsc.io/gaby/internal/sched"
 	"rsc.io/gaby/internal/secret"
 	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/summary"
+	"rsc.io/gaby/internal/themes"
+	"rsc.io/gaby/internal/tracing"
+	"rsc.io/gaby/internal/vertexai"
+	"rsc.io/gaby/internal/waitinfo"
 )
 
-var searchMode = flag.Bool("search", false, "run in interactive search mode")
+var (
+	vertexAI    = flag.String("vertexai", "", "use Vertex AI in the Google Cloud `project/location` instead of the configured LLM")
+	embedModel  = flag.String("embedmodel", "", "use the embedding `model` instead of the configured one")
+	embedDim    = flag.Int("embeddim", 0, "shorten Gemini embeddings to `n` dimensions")
+	secretFile  = flag.String("secrets", "", "read secrets from the JSON `file` in addition to the environment and $HOME/.netrc")
+	dbDir       = flag.String("db", "gaby.db", "use the database in `dir`")
+	configFile  = flag.String("config", "", "read the subsystem configuration from the JSON `file` instead of using the default")
+	secretStore = flag.String("secretstore", "", "store secrets in the encrypted `file`, using the passphrase in $"+secretStorePassEnv)
+	observe     = flag.Bool("observe", false, "observe-only (“gabysitter”) mode: run every subsystem in dry-run mode (also set by $"+observeEnv+")")
+)
 
-func main() {
-	flag.Parse()
-	// TODO gabysitter flag?
+// An llmClient is the LLM access needed by Gaby.
+type llmClient interface {
+	llm.Embedder
+	llm.TextGenerator
 
-	lg := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	// EmbeddingModel returns a description of the embedding
+	// configuration, for recording alongside stored vectors.
+	EmbeddingModel() string
 
-	sdb := secret.Netrc()
+	// TextModel returns a description of the text generation
+	// model, for usage accounting.
+	TextModel() string
+}
 
-	db, err := pebble.Open(lg, "gaby.db")
-	if err != nil {
-		log.Fatal(err)
+// backends returns the backends configured by cfg,
+// as overridden by the command-line flags.
+func backends(cfg *config.Config) config.Backends {
+	var b config.Backends
+	if cfg.Backends != nil {
+		b = *cfg.Backends
 	}
+	if *vertexAI != "" {
+		b.LLM = "vertexai"
+		b.VertexAI = *vertexAI
+		b.URL = ""
+	}
+	if *embedModel != "" {
+		b.EmbedModel = *embedModel
+	}
+	if *embedDim != 0 {
+		b.EmbedDim = *embedDim
+	}
+	return b
+}
 
-	vdb := storage.MemVectorDB(db, lg, "")
+// ollamaURL is the base URL of the OpenAI-compatible API
+// of a local Ollama server.
+const ollamaURL = "http://localhost:11434/v1"
 
-	gh := github.New(lg, db, secret.Netrc(), http.DefaultClient)
-	/*
-		gh.Add("rsc/markdown")
-		gh.Add("robpike/ivy")
-		gh.Add("rsc/top")
-		gh.Add("rsc/omap")
-		gh.Add("golang/go")
-	*/
-	dc := docs.New(db)
-	ai, err := gemini.NewClient(lg, sdb, http.DefaultClient)
+// Default Ollama models, which must be pulled
+// (with “ollama pull”) before Gaby can use them.
+const (
+	ollamaEmbedModel = "nomic-embed-text"
+	ollamaTextModel  = "llama3.1"
+)
+
+// newLLM returns the LLM client selected by cfg
+// and the command-line flags (see [backends]).
+func newLLM(lg *slog.Logger, sdb secret.DB, cfg *config.Config) (llmClient, error) {
+	b := backends(cfg)
+	switch b.LLM {
+	case "vertexai":
+		project, location, ok := strings.Cut(b.VertexAI, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid -vertexai %q: want project/location", b.VertexAI)
+		}
+		if b.EmbedModel != "" || b.TextModel != "" || b.EmbedDim != 0 {
+			return nil, fmt.Errorf("vertexai does not support changing models or -embeddim")
+		}
+		return vertexai.NewClient(lg, sdb, http.DefaultClient, project, location)
+
+	case "openai", "ollama":
+		if b.EmbedDim != 0 {
+			return nil, fmt.Errorf("%s does not support -embeddim", b.LLM)
+		}
+		u := cmp.Or(b.URL, openai.DefaultURL)
+		if b.LLM == "ollama" {
+			u = cmp.Or(b.URL, ollamaURL)
+			b.EmbedModel = cmp.Or(b.EmbedModel, ollamaEmbedModel)
+			b.TextModel = cmp.Or(b.TextModel, ollamaTextModel)
+		}
+		c, err := openai.NewClient(lg, sdb, http.DefaultClient, u)
+		if err != nil {
+			return nil, err
+		}
+		if b.EmbedModel != "" {
+			c.SetEmbeddingModel(b.EmbedModel)
+		}
+		if b.TextModel != "" {
+			c.SetTextModel(b.TextModel)
+		}
+		return c, nil
+	}
+
+	c, err := gemini.NewClient(lg, sdb, http.DefaultClient)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if b.EmbedModel != "" {
+		c.SetEmbeddingModel(b.EmbedModel)
+	}
+	if b.TextModel != "" {
+		c.SetTextModel(b.TextModel)
+	}
+	c.SetEmbeddingDim(b.EmbedDim)
+	return c, nil
+}
+
+// textPrices lists the prices of the text generation models
+// (as described by [llmClient.TextModel]) in US dollars
+// per million tokens. Other models are accounted at zero cost.
+var textPrices = map[string]llmusage.Price{
+	"gemini/gemini-1.5-flash":   {Input: 0.075, Output: 0.30},
+	"vertexai/gemini-1.5-flash": {Input: 0.075, Output: 0.30},
+	"openai/gpt-4o-mini":        {Input: 0.15, Output: 0.60},
+}
+
+// openDB returns the database selected by cfg (see [config.Backends]).
+func openDB(lg *slog.Logger, cfg *config.Config) (storage.DB, error) {
+	switch b := backends(cfg); b.DB {
+	case "", "pebble":
+		return pebble.Open(lg, *dbDir)
+	case "mem":
+		lg.Warn("gaby using in-memory database; all data will be lost at exit")
+		return storage.MemDB(), nil
+	default:
+		// unreachable unless cfg was not validated
+		return nil, fmt.Errorf("unknown DB backend %q", b.DB)
+	}
+}
+
+// openVectorDB returns the vector database selected by cfg
+// (see [config.Backends]), storing vectors in db.
+func openVectorDB(lg *slog.Logger, db storage.DB, cfg *config.Config) (storage.VectorDB, error) {
+	switch b := backends(cfg); b.VectorDB {
+	case "", "mem":
+		return storage.MemVectorDB(db, lg, b.VectorNamespace), nil
+	default:
+		// unreachable unless cfg was not validated
+		return nil, fmt.Errorf("unknown VectorDB backend %q", b.VectorDB)
+	}
+}
+
+// embedName returns the name of the embeddocs Syncer
+// for the vector database namespace (see [embeddocs.Syncer.SetName]).
+// The default namespace keeps the original name, "embeddocs".
+func embedName(namespace string) string {
+	if namespace == "" {
+		return "embeddocs"
+	}
+	return "embeddocs:" + namespace
+}
+
+// checkVectorModel checks that the vectors in the vector database
+// namespace were computed by model, recording model as the namespace's
+// model if none has been recorded yet.
+func checkVectorModel(db storage.DB, namespace, model string) error {
+	switch old := storage.VectorModel(db, namespace); old {
+	case model:
+		return nil
+	case "":
+		storage.SetVectorModel(db, namespace, model)
+		return nil
+	default:
+		return fmt.Errorf("vector namespace %q was computed by %s, not %s; use a new namespace to change models", namespace, old, model)
+	}
+}
+
+// secretEnvPrefix is the prefix of environment variables holding secrets.
+// See [secret.Env].
+const secretEnvPrefix = "GABY_SECRET_"
+
+// observeEnv is the environment variable that,
+// when set to a non-empty value, is equivalent to the -observe flag.
+const observeEnv = "GABY_OBSERVE_ONLY"
+
+// observeOnly reports whether the -observe flag
+// or the observeEnv environment variable requests observe-only mode.
+func observeOnly() bool {
+	return *observe || os.Getenv(observeEnv) != ""
+}
+
+// secretStorePassEnv is the environment variable holding
+// the passphrase for the -secretstore file.
+const secretStorePassEnv = "GABY_SECRETSTORE_PASSPHRASE"
+
+// secretSources returns the secret sources (see [config.Backends.Secrets])
+// configured by cfg or, if cfg configures none or the -secrets
+// or -secretstore flag is given, by the flags.
+// The flags select, in decreasing precedence, the encrypted -secretstore file,
+// environment variables beginning with [secretEnvPrefix],
+// the -secrets file, and $HOME/.netrc.
+// The -secretstore file comes first so that secrets Gaby
+// provisions itself (using Set) are stored there.
+func secretSources(cfg *config.Config) []string {
+	if b := cfg.Backends; b != nil && len(b.Secrets) > 0 && *secretStore == "" && *secretFile == "" {
+		return b.Secrets
+	}
+	var list []string
+	if *secretStore != "" {
+		list = append(list, "store:"+*secretStore)
+	}
+	list = append(list, "env")
+	if *secretFile != "" {
+		list = append(list, "file:"+*secretFile)
 	}
+	return append(list, "netrc")
+}
 
-	if *searchMode {
-		// Search loop.
-		s := bufio.NewScanner(os.Stdin)
-		for {
-			fmt.Fprintf(os.Stderr, "> ")
-			if !s.Scan() {
-				break
+// secrets returns the secret database, which layers
+// the sources returned by [secretSources].
+func secrets(cfg *config.Config) (secret.DB, error) {
+	var layers []secret.DB
+	for _, src := range secretSources(cfg) {
+		kind, file, _ := strings.Cut(src, ":")
+		switch kind {
+		case "env":
+			layers = append(layers, secret.Env(secretEnvPrefix))
+		case "netrc":
+			layers = append(layers, secret.Netrc())
+		case "file":
+			f, err := secret.File(file)
+			if err != nil {
+				return nil, err
 			}
-			vecs, err := ai.EmbedDocs([]llm.EmbedDoc{{Title: "", Text: s.Text()}})
+			layers = append(layers, f)
+		case "store":
+			store, err := secret.OpenEncrypted(file, os.Getenv(secretStorePassEnv))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: %v\n", err)
-				continue
+				return nil, err
 			}
-			vec := vecs[0]
-			for _, r := range vdb.Search(vec, 20) {
-				title := "?"
-				if d, ok := dc.Get(r.ID); ok {
-					title = d.Title
-				}
-				fmt.Printf(" %.5f %s # %s\n", r.Score, r.ID, title)
+			layers = append(layers, store)
+		default:
+			// unreachable unless cfg was not validated
+			return nil, fmt.Errorf("unknown secret source %q", src)
+		}
+	}
+	return secret.Multi(layers...), nil
+}
+
+// runTask runs a task queued in the admin interface, returning its result.
+func runTask(ctx context.Context, gh *github.Client, sys *system, t *admin.Task) string {
+	switch t.Kind {
+	case "sync":
+		if err := gh.SyncProject(ctx, t.Project); err != nil {
+			return err.Error()
+		}
+		return "synced"
+	case "backfill":
+		if sys.related == nil {
+			return "related poster not enabled"
+		}
+		return fmt.Sprintf("evaluated %d issues", sys.related.Backfill(t.Project, t.Min, t.Max))
+	}
+	return fmt.Sprintf("unknown task kind %q", t.Kind)
+}
+
+// A system is the set of subsystems created from a configuration.
+type system struct {
+	tasks   []*sched.Task     // the subsystems' periodic tasks
+	fixer   *commentfix.Fixer // nil if not enabled
+	related *related.Poster   // nil if not enabled
+}
+
+// add adds a task named name that calls run
+// on the schedule configured in cfg.
+func (sys *system) add(cfg *config.Config, name string, run func(context.Context)) {
+	sys.tasks = append(sys.tasks, newTask(cfg, name, func(ctx context.Context) error {
+		run(ctx)
+		return nil
+	}))
+}
+
+// newTask returns a task named name that calls run
+// on the schedule configured in cfg.
+func newTask(cfg *config.Config, name string, run func(context.Context) error) *sched.Task {
+	interval, jitter := cfg.Schedule(name)
+	stuckAfter, cancelStuck := cfg.Watchdog(name)
+	return &sched.Task{
+		Name:        name,
+		Interval:    interval,
+		Jitter:      jitter,
+		Singleton:   cfg.Singleton(name),
+		StuckAfter:  stuckAfter,
+		CancelStuck: cancelStuck,
+		Run:         run,
+	}
+}
+
+// setup creates the subsystems enabled in cfg.
+// Subsystems that write to GitHub run in dry-run mode
+// unless cfg enables their posts or edits
+// and is not in observe-only mode (see [config.Config.Writes]).
+// Each subsystem's GitHub edits are recorded in the audit log
+// under the subsystem's name (see [github.Client.Audit]).
+func setup(lg *slog.Logger, cfg *config.Config, db storage.DB, gh *github.Client, vdb storage.VectorDB, dc *docs.Corpus, ai llmClient, meter *llmusage.Meter) (*system, error) {
+	sys := new(system)
+
+	// Organizations dropped from the configuration stop being listed.
+	orgs := make(map[string]bool)
+	for _, o := range cfg.Orgs {
+		if err := gh.SetOrg(o.Org, o.Pattern); err != nil {
+			return nil, err
+		}
+		orgs[o.Org] = true
+	}
+	for _, org := range gh.Orgs() {
+		if !orgs[org] {
+			gh.RemoveOrg(org)
+		}
+	}
+
+	// The approval queue must exist before the subsystems that propose to it,
+	// but its tasks run after theirs (see [config.Config.Tasks]).
+	var approvals *approval.Queue
+	var approvalCmds *commands.Dispatcher
+	if c := cfg.Approvals; c != nil {
+		approvals = approval.New(lg, db, gh.As(c.Name), c.Name)
+		for _, kind := range c.Kinds {
+			approvals.Require(kind)
+		}
+		if c.Expiry != 0 {
+			approvals.SetExpiry(time.Duration(c.Expiry))
+		}
+		if cfg.Writes(c.Name) {
+			approvals.EnableEdits()
+		}
+		if c.Bot != "" {
+			name := c.Name + ".commands"
+			d := commands.New(lg, db, gh.As(name), c.Bot, name)
+			approvalCmds = d
+			d.Register("approve", commands.Approve(db, approvals))
+			d.Register("reject", commands.Reject(db, approvals))
+			for project, users := range c.Approvers {
+				d.EnableProject(project)
+				d.Allow(project, "approve", users...)
+				d.Allow(project, "reject", users...)
 			}
+			if cfg.Writes(c.Name) {
+				d.EnableCommands()
+			}
+		}
+	}
+
+	if c := cfg.CommentFix; c != nil {
+		cf := commentfix.New(lg, db, gh.As(c.Name), c.Name)
+		cf.SetHTTPClient(http.DefaultClient)
+		if err := cf.SetConfig(&c.Config); err != nil {
+			return nil, err
+		}
+		if cfg.Writes(c.Name) {
+			cf.EnableEdits()
+		}
+		sys.fixer = cf
+		sys.add(cfg, c.Name, cf.Run)
+	}
+
+	if c := cfg.Related; c != nil {
+		rp := related.New(lg, db, gh.As(c.Name), vdb, dc, c.Name)
+		if cfg.Writes(c.Name) {
+			rp.EnablePosts()
+		}
+		rp.SetApprovals(approvals)
+		if err := rp.SetConfig(&c.Config); err != nil {
+			return nil, err
+		}
+		sys.related = rp
+		sys.add(cfg, c.Name, rp.Run)
+		sys.add(cfg, c.Name+".feedback", rp.SyncFeedback)
+	}
+
+	if c := cfg.NeedInfo; c != nil {
+		ni := needinfo.New(lg, db, gh.As(c.Name), meter.TextGenerator(c.Name, ai.TextModel(), ai), c.Name)
+		for _, p := range c.Projects {
+			ni.EnableProject(p, config.Requirements[c.Requirements])
+		}
+		for _, prefix := range c.SkipTitlePrefix {
+			ni.SkipTitlePrefix(prefix)
+		}
+		if cfg.Writes(c.Name) {
+			ni.EnablePosts()
+		}
+		ni.SetApprovals(approvals)
+		sys.add(cfg, c.Name, ni.Run)
+	}
+
+	var summarizer *summary.Summarizer
+	if c := cfg.Summary; c != nil {
+		sm := summary.New(lg, db, gh.As(c.Name), meter.TextGenerator(c.Name, ai.TextModel(), ai), c.Name)
+		for _, p := range c.Projects {
+			sm.EnableProject(p)
+		}
+		if c.Command != "" {
+			sm.EnableCommand(c.Command, c.Maintainers...)
+		}
+		sm.SetAutoComments(c.AutoComments)
+		if cfg.Writes(c.Name) {
+			sm.EnablePosts()
+		}
+		summarizer = sm
+		sys.add(cfg, c.Name, sm.Run)
+	}
+
+	if c := cfg.Owners; c != nil {
+		rt := owners.New(lg, db, gh.As(c.Name), c.Name)
+		for _, p := range slices.Sorted(maps.Keys(c.Projects)) {
+			rt.EnableProject(p, c.Projects[p])
+		}
+		for _, prefix := range c.SkipTitlePrefix {
+			rt.SkipTitlePrefix(prefix)
+		}
+		if c.MaxAssignees != 0 {
+			rt.SetMaxAssignees(c.MaxAssignees)
+		}
+		if c.Apply {
+			rt.EnableApply()
+		}
+		if cfg.Writes(c.Name) {
+			rt.EnablePosts()
+		}
+		sys.add(cfg, c.Name, rt.Run)
+	}
+
+	if c := cfg.Milestone; c != nil {
+		ms := milestone.New(lg, db, gh.As(c.Name), vdb, c.Name)
+		for _, p := range c.Projects {
+			ms.EnableProject(p)
+		}
+		for _, prefix := range c.SkipTitlePrefix {
+			ms.SkipTitlePrefix(prefix)
 		}
+		if c.MinScore != 0 {
+			ms.SetMinScore(c.MinScore)
+		}
+		if cfg.Writes(c.Name) {
+			ms.EnablePosts()
+		}
+		sys.add(cfg, c.Name, ms.Run)
+	}
+
+	if c := cfg.Flakes; c != nil {
+		// The flake tracker keeps its failure embeddings
+		// apart from the document embeddings.
+		ft := flakes.New(lg, db, gh.As(c.Name), meter.Embedder(c.Name, ai.EmbeddingModel(), ai), tracing.VectorDB(storage.MemVectorDB(db, lg, "flakes")), c.Name)
+		for _, p := range c.Projects {
+			ft.EnableProject(p)
+		}
+		if c.MinScore != 0 {
+			ft.SetMinScore(c.MinScore)
+		}
+		if cfg.Writes(c.Name) {
+			ft.EnablePosts()
+		}
+		sys.add(cfg, c.Name, ft.Run)
+	}
+
+	if c := cfg.WaitInfo; c != nil {
+		wi := waitinfo.New(lg, db, gh.As(c.Name), c.Name)
+		for _, p := range c.Projects {
+			wi.EnableProject(p)
+		}
+		if cfg.Writes(c.Name) {
+			wi.EnableEdits()
+		}
+		wi.SetApprovals(approvals)
+		sys.add(cfg, c.Name, wi.Run)
+	}
+
+	if c := cfg.Priority; c != nil {
+		// The priority scorer never writes to GitHub,
+		// so it needs no dry-run mode.
+		ps := priority.New(lg, db, gh.As(c.Name), vdb, c.Name)
+		for _, p := range c.Projects {
+			ps.EnableProject(p)
+		}
+		sys.add(cfg, c.Name, ps.Run)
+	}
+
+	if c := cfg.Themes; c != nil {
+		// The theme finder only reports to the admin page,
+		// so it needs no dry-run mode either.
+		tf := themes.New(lg, db, gh.As(c.Name), vdb, c.Name)
+		for _, p := range c.Projects {
+			tf.EnableProject(p)
+		}
+		if c.Window != 0 {
+			tf.SetWindow(time.Duration(c.Window))
+		}
+		if c.MinSize != 0 {
+			tf.SetMinSize(c.MinSize)
+		}
+		if c.MinScore != 0 {
+			tf.SetMinScore(c.MinScore)
+		}
+		sys.add(cfg, c.Name, tf.Run)
+	}
+
+	if c := cfg.Commands; c != nil {
+		d := commands.New(lg, db, gh.As(c.Name), c.Bot, c.Name)
+		if sys.related != nil {
+			d.Register("related", commands.Related(sys.related))
+		}
+		if summarizer != nil {
+			d.Register("summarize", commands.Summarize(summarizer))
+		}
+		d.Register("label", commands.Label(gh.As(c.Name)))
+		for _, project := range slices.Sorted(maps.Keys(c.Allow)) {
+			d.EnableProject(project)
+			for cmd, users := range c.Allow[project] {
+				d.Allow(project, cmd, users...)
+			}
+		}
+		if cfg.Writes(c.Name) {
+			d.EnableCommands()
+		}
+		sys.add(cfg, c.Name, d.Run)
+	}
+
+	if c := cfg.Approvals; c != nil {
+		if approvalCmds != nil {
+			sys.add(cfg, c.Name+".commands", approvalCmds.Run)
+		}
+		sys.add(cfg, c.Name, approvals.Run)
+	}
+
+	if c := cfg.Prune; c != nil {
+		months := cmp.Or(c.Months, config.DefaultPruneMonths)
+		sys.add(cfg, c.Name, func(ctx context.Context) {
+			cutoff := time.Now().AddDate(0, -months, 0)
+			for _, p := range c.Projects {
+				if ctx.Err() != nil {
+					return
+				}
+				gh.PruneEvents(p, cutoff)
+			}
+		})
 	}
 
-	gh.Sync()
-	githubdocs.Sync(lg, dc, gh)
-	embeddocs.Sync(lg, vdb, ai, dc)
-
-	cf := commentfix.New(lg, gh, "gerritlinks")
-	cf.EnableProject("golang/go")
-	cf.EnableEdits()
-	cf.AutoLink(`\bCL ([0-9]+)\b`, "https://go.dev/cl/$1")
-	cf.ReplaceURL(`\Qhttps://go-review.git.corp.google.com/\E`, "https://go-review.googlesource.com/")
-
-	rp := related.New(lg, db, gh, vdb, dc, "related")
-	rp.EnableProject("golang/go")
-	rp.EnablePosts()
-	rp.SkipBodyContains("— [watchflakes](https://go.dev/wiki/Watchflakes)")
-	rp.SkipTitlePrefix("x/tools/gopls: release version v")
-	rp.SkipTitleSuffix(" backport]")
-	for {
-		gh.Sync()
-		githubdocs.Sync(lg, dc, gh)
-		embeddocs.Sync(lg, vdb, ai, dc)
-		cf.Run()
-		rp.Run()
-		time.Sleep(2 * time.Minute)
-	}
-	return
+	return sys, nil
 }
@@ -0,0 +1,283 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/txtar"
+	"rsc.io/gaby/internal/config"
+	"rsc.io/gaby/internal/crossref"
+	"rsc.io/gaby/internal/diff"
+	"rsc.io/gaby/internal/docs"
+	"rsc.io/gaby/internal/github"
+	"rsc.io/gaby/internal/llm"
+	"rsc.io/gaby/internal/llmusage"
+	"rsc.io/gaby/internal/related"
+	"rsc.io/gaby/internal/storage"
+	"rsc.io/gaby/internal/testutil"
+)
+
+var update = flag.Bool("update", false, "update the expected results in the scenarios")
+
+// TestScenarios runs the end-to-end scenarios in testdata/scenario.
+//
+// Each scenario is a txtar archive. Its comment describes the scenario.
+// Its files are:
+//
+//   - config.json, the Gaby configuration (see [config.Parse]);
+//   - files named “project#n”, issue histories in the format read by
+//     [github.TestingClient.LoadTxtar];
+//   - load, an optional list of txtar files of issue histories to load,
+//     one per line, relative to the scenario;
+//   - edits, the expected GitHub edits, one per line,
+//     as printed by [github.TestingEdit.String], except that comment IDs,
+//     which depend on the order in which the tests run, are replaced by
+//     the comment's position in its issue (1 for the first comment);
+//   - docs, the expected IDs of the documents in the corpus, one per line;
+//   - vectors, the expected IDs of the documents with vectors
+//     in the vector database, one per line.
+//
+// The edits, docs, and vectors files are optional;
+// a missing file means that the scenario does not check that result.
+// Running “go test -update” rewrites the files present
+// in each scenario with the actual results.
+//
+// The scenario runs one cycle of the main loop: the document syncs
+// (but not the GitHub sync; the issues come from the scenario)
+// and then the subsystems' tasks, in the order “gaby serve” runs them.
+// The LLM is deterministic: embeddings are made by [llm.QuoteEmbedder],
+// and text generation echoes the prompt ([llm.EchoTextGenerator]).
+// The subsystems' time limits are disabled, so that the scenario's
+// issues count as new however old their times are.
+// Every key the scenario writes to the database must have
+// a registered schema (see [storage.RegisterSchema]).
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob("testdata/scenario/*.txt")
+	testutil.Check(t, err)
+	if len(files) == 0 {
+		t.Fatal("no scenarios")
+	}
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			runScenario(t, file)
+		})
+	}
+}
+
+// TestRelatedConfig checks that a changed Related config section
+// replaces the related poster's stored configuration,
+// as when “gaby serve” reloads the configuration.
+func TestRelatedConfig(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "")
+	ai := testLLM{llm.QuoteEmbedder(), llm.EchoTextGenerator()}
+
+	run := func(js string) *related.Poster {
+		cfg, err := config.Parse([]byte(js))
+		testutil.Check(t, err)
+		sys, err := setup(lg, cfg, db, gh, vdb, docs.New(db), ai, llmusage.New(lg, db))
+		testutil.Check(t, err)
+		for _, task := range sys.tasks {
+			testutil.Check(t, task.Run(context.Background()))
+		}
+		return sys.related
+	}
+	run(`{"Related": {"Name": "related", "Projects": ["rsc/tmp"], "MaxResults": 5}}`)
+	p := run(`{"Related": {"Name": "related", "Projects": ["rsc/markdown"], "SkipTitlePrefix": ["x/tools: "]}}`)
+	want := &related.Config{Projects: []string{"rsc/markdown"}, SkipTitlePrefix: []string{"x/tools: "}}
+	if c := p.Config(); !reflect.DeepEqual(c, want) {
+		t.Errorf("Config() after reload = %+v, want %+v", c, want)
+	}
+}
+
+func TestOrgsConfig(t *testing.T) {
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	vdb := storage.MemVectorDB(db, lg, "")
+	ai := testLLM{llm.QuoteEmbedder(), llm.EchoTextGenerator()}
+
+	run := func(js string) []string {
+		cfg, err := config.Parse([]byte(js))
+		testutil.Check(t, err)
+		_, err = setup(lg, cfg, db, gh, vdb, docs.New(db), ai, llmusage.New(lg, db))
+		testutil.Check(t, err)
+		return gh.Orgs()
+	}
+	if orgs := run(`{"Orgs": [{"Org": "golang"}, {"Org": "rsc"}]}`); !slices.Equal(orgs, []string{"golang", "rsc"}) {
+		t.Errorf("Orgs() = %v, want [golang rsc]", orgs)
+	}
+	if orgs := run(`{"Orgs": [{"Org": "rsc"}]}`); !slices.Equal(orgs, []string{"rsc"}) {
+		t.Errorf("Orgs() after reload = %v, want [rsc]", orgs)
+	}
+	if orgs := run(`{}`); len(orgs) != 0 {
+		t.Errorf("Orgs() after removing all = %v, want none", orgs)
+	}
+}
+
+// A testLLM is a deterministic [llmClient] for scenarios.
+type testLLM struct {
+	llm.Embedder
+	llm.TextGenerator
+}
+
+func (testLLM) EmbeddingModel() string { return "quote" }
+func (testLLM) TextModel() string      { return "echo" }
+
+// runScenario runs the scenario in file.
+func runScenario(t *testing.T, file string) {
+	ar, err := txtar.ParseFile(file)
+	testutil.Check(t, err)
+
+	lg := testutil.Slogger(t)
+	db := storage.MemDB()
+	gh := github.New(lg, db, nil, nil)
+	var cfg *config.Config
+	var issues []txtar.File
+	want := make(map[string][]byte)
+	for _, f := range ar.Files {
+		switch {
+		case f.Name == "config.json":
+			cfg, err = config.Parse(f.Data)
+			if err != nil {
+				t.Fatalf("%s: config.json: %v", file, err)
+			}
+		case f.Name == "load":
+			for _, name := range strings.Fields(string(f.Data)) {
+				testutil.Check(t, gh.Testing().LoadTxtar(filepath.Join(filepath.Dir(file), name)))
+			}
+		case strings.Contains(f.Name, "#"):
+			issues = append(issues, f)
+		case f.Name == "edits" || f.Name == "docs" || f.Name == "vectors":
+			want[f.Name] = f.Data
+		default:
+			t.Fatalf("%s: unknown file %q", file, f.Name)
+		}
+	}
+	if cfg == nil {
+		t.Fatalf("%s: missing config.json", file)
+	}
+	if len(issues) > 0 {
+		testutil.Check(t, gh.Testing().LoadTxtarData(txtar.Format(&txtar.Archive{Files: issues})))
+	}
+
+	ai := testLLM{llm.QuoteEmbedder(), llm.EchoTextGenerator()}
+	g := &gaby{
+		slog:   lg,
+		cfg:    cfg,
+		db:     db,
+		vdb:    storage.MemVectorDB(db, lg, backends(cfg).VectorNamespace),
+		github: gh,
+		docs:   docs.New(db),
+		ai:     ai,
+		meter:  llmusage.New(lg, db),
+	}
+	g.embeds = g.newEmbeds(g.vdb, ai, backends(cfg).VectorNamespace)
+	sys, err := setup(lg, cfg, g.db, g.github, g.vdb, g.docs, g.ai, g.meter)
+	testutil.Check(t, err)
+	if sys.fixer != nil {
+		sys.fixer.SetTimeLimit(time.Time{})
+		sys.fixer.SetStderr(testutil.LogWriter(t))
+	}
+	if sys.related != nil {
+		sys.related.SetTimeLimit(time.Time{})
+	}
+
+	ctx := context.Background()
+	for _, task := range append(g.syncTasks(cfg, crossref.New(lg, db)), sys.tasks...) {
+		if task.Name == "github" {
+			continue
+		}
+		if err := task.Run(ctx); err != nil {
+			t.Fatalf("%s: %v", task.Name, err)
+		}
+	}
+
+	for _, kind := range storage.Kinds(db) {
+		if _, ok := storage.LookupSchema(kind); !ok {
+			t.Errorf("database has keys of unregistered kind %q", kind)
+		}
+	}
+
+	have := make(map[string][]byte)
+	var edits []string
+	for _, e := range gh.Testing().Edits() {
+		if e.Comment != 0 {
+			e1 := *e
+			e1.Comment = commentIndex(gh, e.Project, e.Issue, e.Comment)
+			e = &e1
+		}
+		edits = append(edits, e.String())
+	}
+	have["edits"] = lines(edits)
+
+	var ids []string
+	for d := range g.docs.Docs("") {
+		ids = append(ids, d.ID)
+	}
+	have["docs"] = lines(ids)
+
+	var vecs []string
+	for _, id := range ids {
+		if _, ok := g.vdb.Get(id); ok {
+			vecs = append(vecs, id)
+		}
+	}
+	have["vectors"] = lines(vecs)
+
+	changed := false
+	for i, f := range ar.Files {
+		w, ok := want[f.Name]
+		if !ok || bytes.Equal(w, have[f.Name]) {
+			continue
+		}
+		if *update {
+			ar.Files[i].Data = have[f.Name]
+			changed = true
+			continue
+		}
+		t.Errorf("%s:\n%s", f.Name, diff.Diff("want", w, "have", have[f.Name]))
+	}
+	if changed {
+		testutil.Check(t, os.WriteFile(file, txtar.Format(ar), 0666))
+	}
+}
+
+// commentIndex returns the position of the comment with the given ID
+// among the comments on the issue, counting from 1,
+// or -1 if there is no such comment.
+func commentIndex(gh *github.Client, project string, issue, id int64) int64 {
+	n := int64(0)
+	for e := range gh.Events(project, issue, issue) {
+		if e.API == "/issues/comments" {
+			n++
+			if e.ID == id {
+				return n
+			}
+		}
+	}
+	return -1
+}
+
+// lines returns the text consisting of the given lines.
+func lines(list []string) []byte {
+	var b bytes.Buffer
+	for _, line := range list {
+		b.WriteString(line + "\n")
+	}
+	return b.Bytes()
+}